@@ -0,0 +1,122 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ShardRefusedCode container拒绝add时http响应中的code，sm据此把shard分配给其他container
+const ShardRefusedCode = "SHARD_REFUSED"
+
+// ShardAdmission 接受sm下发的shard之前调用，task已经解密。返回 RefuseShard 创建的错误时sm把shard分配给其他container，
+// 其他错误按照add失败处理
+type ShardAdmission func(ctx context.Context, id string, spec *ShardSpec) error
+
+// ShardRefusal container拒绝shard的原因，随container的session写入etcd，sm分配时避开拒绝过的container
+type ShardRefusal struct {
+	ContainerId string `json:"containerId"`
+	Reason      string `json:"reason"`
+	Time        int64  `json:"time"`
+}
+
+func (r *ShardRefusal) Error() string {
+	return "shard refused: " + r.Reason
+}
+
+func (r *ShardRefusal) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// RefuseShard ShardAdmission 中返回，例如内存不足时 RefuseShard("not enough memory")
+func RefuseShard(reason string) error {
+	return &ShardRefusal{Reason: reason}
+}
+
+// IsShardRefusal err是否由 RefuseShard 创建，支持被wrap的错误
+func IsShardRefusal(err error) (*ShardRefusal, bool) {
+	var r *ShardRefusal
+	if errors.As(err, &r) {
+		return r, true
+	}
+	return nil, false
+}
+
+// admit 没有设置 ShardAdmission 时接受所有shard，拒绝时写入refusal节点，之后接受同一个shard时删除
+func (ss *ShardServer) admit(ctx context.Context, id string, spec *ShardSpec) error {
+	if ss.opts.admission == nil {
+		return nil
+	}
+	checked := spec
+	if TaskEncrypted(spec.Task) {
+		task, err := DecryptTask(ss.opts.taskKey, spec.Task)
+		if err != nil {
+			return errors.Wrapf(err, "shardId: %s", id)
+		}
+		decrypted := *spec
+		decrypted.Task = task
+		checked = &decrypted
+	}
+
+	container := ss.opts.container
+	node := container.EtcdPath().AppRefusal(container.Service(), id) + "/" + container.Id()
+	err := ss.opts.admission(ctx, id, checked)
+	refusal, refused := IsShardRefusal(err)
+	switch {
+	case refused:
+		refusal.ContainerId = container.Id()
+		refusal.Time = time.Now().Unix()
+		if err := container.Backend().PutEphemeral(ctx, container.BackendSession(), node, refusal.String()); err != nil {
+			// 写入失败时http模式的sm仍然可以通过响应得知
+			ss.opts.lg.Error(
+				"put refusal error",
+				zap.String("node", node),
+				zap.Error(err),
+			)
+		}
+		ss.refusedMu.Lock()
+		ss.refused[id] = struct{}{}
+		ss.refusedMu.Unlock()
+		ss.opts.lg.Warn(
+			"shard refused",
+			zap.String("id", id),
+			zap.String("reason", refusal.Reason),
+		)
+		return refusal
+	case err != nil:
+		return errors.Wrap(err, "")
+	}
+
+	ss.refusedMu.Lock()
+	_, ok := ss.refused[id]
+	delete(ss.refused, id)
+	ss.refusedMu.Unlock()
+	if ok {
+		if err := container.Backend().Delete(ctx, node); err != nil {
+			ss.opts.lg.Error(
+				"delete refusal error",
+				zap.String("node", node),
+				zap.Error(err),
+			)
+		}
+	}
+	return nil
+}
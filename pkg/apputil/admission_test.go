@@ -0,0 +1,22 @@
+package apputil
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func Test_IsShardRefusal(t *testing.T) {
+	err := errors.Wrap(RefuseShard("disk full"), "add")
+	refusal, ok := IsShardRefusal(err)
+	if !ok || refusal.Reason != "disk full" {
+		t.Errorf("expect refusal, actual %v", err)
+	}
+
+	if _, ok := IsShardRefusal(errors.New("foo")); ok {
+		t.Errorf("plain error should not be refusal")
+	}
+	if _, ok := IsShardRefusal(nil); ok {
+		t.Errorf("nil should not be refusal")
+	}
+}
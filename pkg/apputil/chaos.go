@@ -0,0 +1,41 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"net/http"
+
+	"github.com/entertainment-venue/sm/pkg/chaos"
+	"github.com/gin-gonic/gin"
+)
+
+// ginChaos 使用 -tags chaos 编译时挂载到 /sm/admin/chaos，返回container进程中注入的故障和计数
+func ginChaos(c *gin.Context) {
+	c.JSON(http.StatusOK, chaos.Get())
+}
+
+// ginSetChaos 替换container进程中注入的故障，body为 {} 时清除故障
+func ginSetChaos(c *gin.Context) {
+	var faults chaos.Faults
+	if err := c.ShouldBind(&faults); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := chaos.Set(faults); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, chaos.Get())
+}
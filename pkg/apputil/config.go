@@ -0,0 +1,273 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ContainerConfig 配置文件中的container参数，和 ContainerOption 一一对应，时间单位和sm的配置文件保持一致
+type ContainerConfig struct {
+	Id              string   `yaml:"id"`
+	Service         string   `yaml:"service"`
+	Endpoints       []string `yaml:"endpoints"`
+	MirrorEndpoints []string `yaml:"mirrorEndpoints"`
+
+	EtcdPrefix    string `yaml:"etcdPrefix"`
+	EtcdNamespace string `yaml:"etcdNamespace"`
+
+	// etcd开启认证和tls时使用
+	EtcdUsername string `yaml:"etcdUsername"`
+	EtcdPassword string `yaml:"etcdPassword"`
+	EtcdCAFile   string `yaml:"etcdCAFile"`
+	EtcdCertFile string `yaml:"etcdCertFile"`
+	EtcdKeyFile  string `yaml:"etcdKeyFile"`
+
+	// EtcdDialTimeout、EtcdKeepAlive 和 EtcdKeepAliveTimeout 单位秒，为0使用默认值
+	EtcdDialTimeout      int `yaml:"etcdDialTimeout"`
+	EtcdKeepAlive        int `yaml:"etcdKeepAlive"`
+	EtcdKeepAliveTimeout int `yaml:"etcdKeepAliveTimeout"`
+	// EtcdMaxRetries 幂等操作的重试次数，为0使用默认值，小于0不重试
+	EtcdMaxRetries int `yaml:"etcdMaxRetries"`
+	// EtcdRetryBackoff、EtcdReadTimeout 和 EtcdWriteTimeout 单位毫秒，为0使用默认值
+	EtcdRetryBackoff int `yaml:"etcdRetryBackoff"`
+	EtcdReadTimeout  int `yaml:"etcdReadTimeout"`
+	EtcdWriteTimeout int `yaml:"etcdWriteTimeout"`
+
+	Watch      bool              `yaml:"watch"`
+	Zone       string            `yaml:"zone"`
+	Deployment string            `yaml:"deployment"`
+	Version    string            `yaml:"version"`
+	Capacity   int               `yaml:"capacity"`
+	Labels     map[string]string `yaml:"labels"`
+
+	// CpuUnits 和 MemUnits 是container可以提供给shard预留的资源，为0不限制
+	CpuUnits int `yaml:"cpuUnits"`
+	MemUnits int `yaml:"memUnits"`
+
+	// SessionTTL 和 HeartbeatInterval 单位秒，为0使用sm中service的配置
+	SessionTTL        int `yaml:"sessionTTL"`
+	HeartbeatInterval int `yaml:"heartbeatInterval"`
+	// MaxHeartbeatBackoff 单位秒，为0使用默认值
+	MaxHeartbeatBackoff int     `yaml:"maxHeartbeatBackoff"`
+	HeartbeatJitter     float64 `yaml:"heartbeatJitter"`
+
+	// SessionRecoveryBackoff 大于0时开启session自动恢复，和 MaxSessionRecoveryBackoff 单位都是秒
+	SessionRecoveryBackoff    int `yaml:"sessionRecoveryBackoff"`
+	MaxSessionRecoveryBackoff int `yaml:"maxSessionRecoveryBackoff"`
+}
+
+// LoadContainerConfig 加载配置文件后使用 SM_CONTAINER_ 开头的环境变量覆盖，path为空时只读取环境变量
+func LoadContainerConfig(path string) (*ContainerConfig, error) {
+	var cfg ContainerConfig
+	if path != "" {
+		if err := LoadConfigFile(path, &cfg); err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	if err := ApplyEnvOverrides("SM_CONTAINER_", &cfg); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &cfg, nil
+}
+
+// Options 转换为 NewContainer 的参数，可以追加代码中的option，后面的option优先
+func (c *ContainerConfig) Options() []ContainerOption {
+	opts := []ContainerOption{
+		ContainerWithId(c.Id),
+		ContainerWithService(c.Service),
+		ContainerWithEndpoints(c.Endpoints),
+		ContainerWithEtcdPrefix(c.EtcdPrefix),
+		ContainerWithEtcdNamespace(c.EtcdNamespace),
+		ContainerWithWatch(c.Watch),
+		ContainerWithZone(c.Zone),
+		ContainerWithDeployment(c.Deployment),
+		ContainerWithVersion(c.Version),
+		ContainerWithCapacity(c.Capacity),
+		ContainerWithResources(c.CpuUnits, c.MemUnits),
+		ContainerWithSessionTTL(c.SessionTTL),
+		ContainerWithHeartbeatInterval(c.HeartbeatInterval),
+		ContainerWithEtcdClientOptions(
+			etcdutil.EtcdClientWithDialTimeout(time.Duration(c.EtcdDialTimeout)*time.Second),
+			etcdutil.EtcdClientWithKeepAlive(time.Duration(c.EtcdKeepAlive)*time.Second, time.Duration(c.EtcdKeepAliveTimeout)*time.Second),
+			etcdutil.EtcdClientWithRetry(c.EtcdMaxRetries, time.Duration(c.EtcdRetryBackoff)*time.Millisecond),
+			etcdutil.EtcdClientWithOpTimeout(time.Duration(c.EtcdReadTimeout)*time.Millisecond, time.Duration(c.EtcdWriteTimeout)*time.Millisecond),
+		),
+	}
+	if len(c.MirrorEndpoints) > 0 {
+		opts = append(opts, ContainerWithMirrorEndpoints(c.MirrorEndpoints))
+	}
+	if len(c.Labels) > 0 {
+		opts = append(opts, ContainerWithLabels(c.Labels))
+	}
+	if c.EtcdUsername != "" {
+		opts = append(opts, ContainerWithEtcdAuth(c.EtcdUsername, c.EtcdPassword))
+	}
+	if c.EtcdCAFile != "" || c.EtcdCertFile != "" || c.EtcdKeyFile != "" {
+		opts = append(opts, ContainerWithEtcdTLS(c.EtcdCAFile, c.EtcdCertFile, c.EtcdKeyFile))
+	}
+	if c.MaxHeartbeatBackoff > 0 || c.HeartbeatJitter > 0 {
+		backoff := time.Duration(c.MaxHeartbeatBackoff) * time.Second
+		if backoff <= 0 {
+			backoff = defaultMaxHeartbeatBackoff
+		}
+		opts = append(opts, ContainerWithHeartbeatBackoff(backoff, c.HeartbeatJitter))
+	}
+	if c.SessionRecoveryBackoff > 0 {
+		opts = append(opts, ContainerWithSessionRecovery(time.Duration(c.SessionRecoveryBackoff)*time.Second, time.Duration(c.MaxSessionRecoveryBackoff)*time.Second))
+	}
+	return opts
+}
+
+// LoadConfigFile 按照扩展名解析配置文件，.toml使用toml，其他按照yaml解析，toml的key和yaml相同，不区分大小写
+func LoadConfigFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		if _, err := toml.Decode(string(data), v); err != nil {
+			return errors.Wrapf(err, "FAILED to parse %s", path)
+		}
+	default:
+		if err := yaml.Unmarshal(data, v); err != nil {
+			return errors.Wrapf(err, "FAILED to parse %s", path)
+		}
+	}
+	return nil
+}
+
+// ApplyEnvOverrides 使用环境变量覆盖v（结构体指针）中的字段，变量名是prefix加上yaml tag（没有tag时使用字段名）的大写下划线形式，
+// 例如prefix为 SM_ 时 etcdCAFile 对应 SM_ETCD_CA_FILE，支持string、bool、整数、浮点数，
+// 字符串slice使用逗号分隔，map[string]string使用 k1=v1,k2=v2，yaml tag为"-"以及其他类型的字段忽略
+func ApplyEnvOverrides(prefix string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("unexpected %T, struct pointer required", v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		key := prefix + envName(name)
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(rv.Field(i), value); err != nil {
+			return errors.Wrapf(err, "FAILED to parse env %s", key)
+		}
+	}
+	return nil
+}
+
+// envName 驼峰转换为大写下划线，连续的大写字母作为一个单词，例如 etcdCAFile 转换为 ETCD_CA_FILE
+func envName(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func setEnvValue(fv reflect.Value, value string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		fv.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		items := splitEnvList(value)
+		s := reflect.MakeSlice(fv.Type(), len(items), len(items))
+		for i, item := range items {
+			s.Index(i).SetString(item)
+		}
+		fv.Set(s)
+	case reflect.Map:
+		if fv.Type().Key().Kind() != reflect.String || fv.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		m := reflect.MakeMap(fv.Type())
+		for _, item := range splitEnvList(value) {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return errors.Errorf("unexpected item %s, k=v required", item)
+			}
+			m.SetMapIndex(reflect.ValueOf(kv[0]).Convert(fv.Type().Key()), reflect.ValueOf(kv[1]).Convert(fv.Type().Elem()))
+		}
+		fv.Set(m)
+	}
+	return nil
+}
+
+func splitEnvList(value string) []string {
+	var r []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			r = append(r, item)
+		}
+	}
+	return r
+}
@@ -0,0 +1,59 @@
+package apputil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_envName(t *testing.T) {
+	for name, expect := range map[string]string{
+		"service":        "SERVICE",
+		"etcdCAFile":     "ETCD_CA_FILE",
+		"leaderLeaseTTL": "LEADER_LEASE_TTL",
+		"EtcdPrefix":     "ETCD_PREFIX",
+	} {
+		if actual := envName(name); actual != expect {
+			t.Errorf("envName(%s) expect %s, actual %s", name, expect, actual)
+		}
+	}
+}
+
+func Test_LoadContainerConfig(t *testing.T) {
+	dir := t.TempDir()
+	yml := filepath.Join(dir, "container.yml")
+	if err := ioutil.WriteFile(yml, []byte("service: foo\nendpoints:\n  - 127.0.0.1:2379\netcdCAFile: ca.pem\ncapacity: 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SM_CONTAINER_CAPACITY", "5")
+	t.Setenv("SM_CONTAINER_LABELS", "rack=r1, disk=ssd")
+	cfg, err := LoadContainerConfig(yml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Service != "foo" || cfg.EtcdCAFile != "ca.pem" || !reflect.DeepEqual(cfg.Endpoints, []string{"127.0.0.1:2379"}) {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if cfg.Capacity != 5 || !reflect.DeepEqual(cfg.Labels, map[string]string{"rack": "r1", "disk": "ssd"}) {
+		t.Errorf("env should override file, actual %+v", cfg)
+	}
+
+	tml := filepath.Join(dir, "container.toml")
+	if err := ioutil.WriteFile(tml, []byte("service = \"bar\"\nendpoints = [\"127.0.0.1:2379\"]\nheartbeatJitter = 0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SM_CONTAINER_WATCH", "true")
+	cfg, err = LoadContainerConfig(tml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Service != "bar" || cfg.HeartbeatJitter != 0.2 || !cfg.Watch {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	t.Setenv("SM_CONTAINER_CAPACITY", "x")
+	if _, err := LoadContainerConfig(""); err == nil {
+		t.Errorf("expect error for invalid int")
+	}
+}
@@ -17,21 +17,43 @@ package apputil
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"sync"
 	"time"
 
+	"github.com/entertainment-venue/sm/pkg/coordination"
 	"github.com/entertainment-venue/sm/pkg/etcdutil"
 	"github.com/pkg/errors"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/net"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
 	"go.uber.org/zap"
 )
 
+const (
+	// defaultSessionTTL session默认的ttl，单位秒
+	defaultSessionTTL = 5
+
+	// defaultHeartbeatInterval container和shard上报heartbeat的默认间隔，单位秒
+	defaultHeartbeatInterval = 3
+)
+
+// AppConfig sm根据service的spec写入etcd，不同service可以根据对延迟的敏感程度调整container丢失的发现时间，
+// 为0的字段使用默认值
+type AppConfig struct {
+	// HeartbeatInterval heartbeat上报的间隔，单位秒
+	HeartbeatInterval int `json:"heartbeatInterval"`
+
+	// SessionTTL container和etcd之间session的ttl，单位秒
+	SessionTTL int `json:"sessionTTL"`
+}
+
+func (c *AppConfig) String() string {
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
 // Container 1 上报container的load信息，保证container的liveness，才能够参与shard的分配
 // 2 与sm交互，下发add和drop给到Shard
 type Container struct {
@@ -43,21 +65,129 @@ type Container struct {
 	service string
 	lg      *zap.Logger
 
+	// watch 通过watch etcd接收shard，不提供http接口
+	watch bool
+
+	// zone container所在的可用区，sm按照spread策略把副本分散到不同zone
+	zone string
+	// deployment container所属的部署，例如blue/green或者发布的revision
+	deployment string
+
+	// capacity container可以承载的负载单位，sm的binpack分配按照capacity放置shard
+	capacity int
+
+	// resources container声明可以提供给shard预留的资源
+	resources *Resources
+
+	// labels container的标签，sm在shard的placement约束中引用
+	labels map[string]string
+
+	// process 采集进程的运行状态，随heartbeat上报
+	process *processCollector
+
 	// donec 可以通知调用方
 	donec chan struct{}
 
 	mu sync.Mutex
 	// closed 导致 Container 被关闭的事件是异步的，需要做保护
 	closed bool
+	// etcdPath container在etcd中的存储路径，同一个进程中的container可以使用不同的prefix
+	etcdPath *EtcdPath
+	// etcdNamespace Client 所在的namespace，为空时没有使用namespace
+	etcdNamespace string
+
+	// heartbeatInterval container和shard上报heartbeat的间隔
+	heartbeatInterval time.Duration
+	// maxHeartbeatBackoff heartbeat失败后退避的上限，heartbeatJitter 等待时间随机浮动的比例
+	maxHeartbeatBackoff time.Duration
+	heartbeatJitter     float64
+	// sessionTTL heartbeat连续失败超过该时间认为丢失
+	sessionTTL time.Duration
+
+	// heartbeatLost heartbeat是否处于丢失状态，heartbeatHandler 状态变化时通知业务
+	heartbeatLost    bool
+	heartbeatHandler HeartbeatHandler
+
+	// draining 调用 Drain 后在heartbeat中上报
+	draining bool
+
+	// grpcAddr ShardServer 开启grpc后在heartbeat中上报
+	grpcAddr string
+
+	// backend heartbeat和leader竞选使用的协调存储，默认基于 Client 和 Session
+	backend        coordination.Backend
+	backendSession coordination.Session
+
+	// sessionMu 保护session恢复时替换的 Session 和 backendSession
+	sessionMu sync.RWMutex
+	// recovery 不为空时session过期后自动重建，sessionDonec 在session不再恢复时关闭
+	recovery         *sessionRecovery
+	sessionDonec     chan struct{}
+	lifecycleHandler LifecycleHandler
+	// sessionListeners session重建后、对外可见之前调用，用新的session重新获取lock
+	sessionListeners []func(s *concurrency.Session) error
 }
 
 type containerOptions struct {
 	endpoints []string
 
+	// mirrorEndpoints 迁移etcd集群时的新集群，写入同步到这里，读取仍然走endpoints
+	mirrorEndpoints []string
+
 	// 数据传递
 	id      string
 	service string
 	lg      *zap.Logger
+
+	// watch 在心跳中告知sm通过etcd下发shard
+	watch bool
+
+	// zone 在心跳中告知sm所在的可用区
+	zone string
+
+	// deployment 在心跳中告知sm所属的部署
+	deployment string
+
+	// capacity 在心跳中告知sm可以承载的负载单位
+	capacity int
+
+	// resources 在心跳中告知sm可以提供的cpu/mem单位
+	resources *Resources
+
+	// labels 在心跳中上报给sm
+	labels map[string]string
+
+	// version 在心跳中上报给sm的业务版本
+	version string
+
+	// etcdOpts 安全的etcd集群需要的认证和tls配置
+	etcdOpts []etcdutil.EtcdClientOption
+
+	// sessionTTL container和etcd之间session的ttl，单位秒，heartbeat和shard的lock都依赖session
+	sessionTTL int
+
+	// heartbeatInterval heartbeat上报的间隔，单位秒
+	heartbeatInterval int
+
+	// maxHeartbeatBackoff heartbeat失败后退避的上限
+	maxHeartbeatBackoff time.Duration
+	// heartbeatJitter 等待时间随机浮动的比例，取值[0, 1)
+	heartbeatJitter float64
+	// heartbeatHandler heartbeat丢失和恢复时回调
+	heartbeatHandler HeartbeatHandler
+
+	// recoveryBackoff 和 maxRecoveryBackoff 大于0时开启session自动恢复
+	recoveryBackoff    time.Duration
+	maxRecoveryBackoff time.Duration
+
+	// lifecycleHandler session丢失、恢复等事件的回调
+	lifecycleHandler LifecycleHandler
+
+	// etcdPrefix 为空时使用进程级别的默认prefix
+	etcdPrefix string
+
+	// etcdNamespace 非空时etcd client工作在namespace下，etcdPrefix不再生效
+	etcdNamespace string
 }
 
 type ContainerOption func(options *containerOptions)
@@ -80,14 +210,160 @@ func ContainerWithEndpoints(v []string) ContainerOption {
 	}
 }
 
+// ContainerWithMirrorEndpoints 开启双写，endpoints作为primary，写入同时同步到mirror集群，用于迁移etcd集群
+func ContainerWithMirrorEndpoints(v []string) ContainerOption {
+	return func(co *containerOptions) {
+		co.mirrorEndpoints = v
+	}
+}
+
 func ContainerWithLogger(lg *zap.Logger) ContainerOption {
 	return func(co *containerOptions) {
 		co.lg = lg
 	}
 }
 
+func ContainerWithWatch(v bool) ContainerOption {
+	return func(co *containerOptions) {
+		co.watch = v
+	}
+}
+
+// ContainerWithZone 设置container所在的可用区，例如机房或者云厂商的availability zone
+func ContainerWithZone(v string) ContainerOption {
+	return func(co *containerOptions) {
+		co.zone = v
+	}
+}
+
+// ContainerWithCapacity 声明container可以承载的负载单位，例如大规格机器设置更大的值，<=0使用sm的默认值
+func ContainerWithCapacity(v int) ContainerOption {
+	return func(co *containerOptions) {
+		co.capacity = v
+	}
+}
+
+// ContainerWithResources 声明container可以提供给shard预留的cpu/mem单位，sm不会让shard声明的资源之和超过这个值，
+// 为0的项不限制
+func ContainerWithResources(cpu, mem int) ContainerOption {
+	return func(co *containerOptions) {
+		if cpu <= 0 && mem <= 0 {
+			co.resources = nil
+			return
+		}
+		co.resources = &Resources{Cpu: cpu, Mem: mem}
+	}
+}
+
+// ContainerWithLabels 声明container的标签，shard的Constraint中通过 container.labels.<key> 引用
+func ContainerWithLabels(v map[string]string) ContainerOption {
+	return func(co *containerOptions) {
+		co.labels = v
+	}
+}
+
+// ContainerWithVersion 在heartbeat中上报的业务版本，没有设置时使用main module的版本
+// ContainerWithDeployment 设置container所属的部署，例如blue/green或者发布的revision，
+// service的spec配置了deploymentPolicy时，sm按照部署分散或者集中分配shard
+func ContainerWithDeployment(v string) ContainerOption {
+	return func(co *containerOptions) {
+		co.deployment = v
+	}
+}
+
+func ContainerWithVersion(v string) ContainerOption {
+	return func(co *containerOptions) {
+		co.version = v
+	}
+}
+
+// ContainerWithEtcdAuth etcd开启认证时使用
+func ContainerWithEtcdAuth(username, password string) ContainerOption {
+	return func(co *containerOptions) {
+		co.etcdOpts = append(co.etcdOpts, etcdutil.EtcdClientWithAuth(username, password))
+	}
+}
+
+// ContainerWithEtcdTLS etcd开启tls时使用
+func ContainerWithEtcdTLS(caFile, certFile, keyFile string) ContainerOption {
+	return func(co *containerOptions) {
+		co.etcdOpts = append(co.etcdOpts, etcdutil.EtcdClientWithTLS(caFile, certFile, keyFile))
+	}
+}
+
+// ContainerWithEtcdClientOptions etcd client的超时、keepalive和重试等配置，参考 etcdutil.EtcdClientOption
+func ContainerWithEtcdClientOptions(opts ...etcdutil.EtcdClientOption) ContainerOption {
+	return func(co *containerOptions) {
+		co.etcdOpts = append(co.etcdOpts, opts...)
+	}
+}
+
+func ContainerWithSessionTTL(v int) ContainerOption {
+	return func(co *containerOptions) {
+		co.sessionTTL = v
+	}
+}
+
+// ContainerWithHeartbeatInterval 单位秒，优先级高于sm中service的配置
+func ContainerWithHeartbeatInterval(v int) ContainerOption {
+	return func(co *containerOptions) {
+		co.heartbeatInterval = v
+	}
+}
+
+// ContainerWithHeartbeatBackoff etcd短暂不可用时，heartbeat从上报间隔开始指数退避，max为上限，
+// jitter为等待时间随机浮动的比例，取值[0, 1)
+func ContainerWithHeartbeatBackoff(max time.Duration, jitter float64) ContainerOption {
+	return func(co *containerOptions) {
+		co.maxHeartbeatBackoff = max
+		co.heartbeatJitter = jitter
+	}
+}
+
+// ContainerWithSessionRecovery session过期后不关闭container，从backoff开始指数退避重建session（上限maxBackoff），
+// 重新注册container并用新的session获取本地shard的lock，已经被其他container获取的shard会被drop，
+// backoff<=0时关闭，session过期后container关闭，需要业务重新创建
+func ContainerWithSessionRecovery(backoff, maxBackoff time.Duration) ContainerOption {
+	return func(co *containerOptions) {
+		co.recoveryBackoff = backoff
+		co.maxRecoveryBackoff = maxBackoff
+	}
+}
+
+// ContainerWithLifecycleHandler session丢失、恢复，以及恢复后shard被其他container获取时回调，fn不能阻塞
+func ContainerWithLifecycleHandler(fn LifecycleHandler) ContainerOption {
+	return func(co *containerOptions) {
+		co.lifecycleHandler = fn
+	}
+}
+
+// ContainerWithHeartbeatHandler heartbeat连续失败超过session ttl时回调 fn(false)，业务应暂停shard上的工作，
+// 恢复后回调 fn(true)
+func ContainerWithHeartbeatHandler(fn HeartbeatHandler) ContainerOption {
+	return func(co *containerOptions) {
+		co.heartbeatHandler = fn
+	}
+}
+
+func ContainerWithEtcdPrefix(v string) ContainerOption {
+	return func(co *containerOptions) {
+		co.etcdPrefix = v
+	}
+}
+
+// ContainerWithEtcdNamespace 使用clientv3的namespace隔离container在etcd中的数据，
+// 和sm使用相同的namespace，取代 ContainerWithEtcdPrefix 的字符串拼接
+func ContainerWithEtcdNamespace(v string) ContainerOption {
+	return func(co *containerOptions) {
+		co.etcdNamespace = v
+	}
+}
+
 func NewContainer(opts ...ContainerOption) (*Container, error) {
-	ops := &containerOptions{}
+	ops := &containerOptions{
+		maxHeartbeatBackoff: defaultMaxHeartbeatBackoff,
+		heartbeatJitter:     defaultHeartbeatJitter,
+	}
 	for _, opt := range opts {
 		opt(ops)
 	}
@@ -104,12 +380,47 @@ func NewContainer(opts ...ContainerOption) (*Container, error) {
 	if ops.lg == nil {
 		return nil, errors.New("lg err")
 	}
+	if ops.heartbeatJitter < 0 || ops.heartbeatJitter >= 1 {
+		return nil, errors.New("heartbeatJitter err")
+	}
 
-	ec, err := etcdutil.NewEtcdClient(ops.endpoints, ops.lg)
+	if ops.etcdNamespace != "" {
+		ops.etcdOpts = append(ops.etcdOpts, etcdutil.EtcdClientWithNamespace(ops.etcdNamespace))
+	}
+	ec, err := etcdutil.NewEtcdClient(ops.endpoints, ops.lg, ops.etcdOpts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
-	s, err := concurrency.NewSession(ec.Client, concurrency.WithTTL(5))
+
+	etcdPath := defaultEtcdPath
+	switch {
+	case ops.etcdNamespace != "":
+		etcdPath = NewNamespacedEtcdPath()
+	case ops.etcdPrefix != "":
+		etcdPath = NewEtcdPath(ops.etcdPrefix)
+	}
+
+	// option中没有指定时，使用sm中service的配置
+	if ops.sessionTTL <= 0 || ops.heartbeatInterval <= 0 {
+		appConfig, err := getAppConfig(ec, etcdPath, ops.service)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		if ops.sessionTTL <= 0 {
+			ops.sessionTTL = appConfig.SessionTTL
+		}
+		if ops.heartbeatInterval <= 0 {
+			ops.heartbeatInterval = appConfig.HeartbeatInterval
+		}
+	}
+	if ops.sessionTTL <= 0 {
+		ops.sessionTTL = defaultSessionTTL
+	}
+	if ops.heartbeatInterval <= 0 {
+		ops.heartbeatInterval = defaultHeartbeatInterval
+	}
+
+	s, err := concurrency.NewSession(ec.Client, concurrency.WithTTL(ops.sessionTTL))
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
@@ -117,50 +428,85 @@ func NewContainer(opts ...ContainerOption) (*Container, error) {
 	ops.lg.Info("session opened",
 		zap.String("id", ops.id),
 		zap.String("service", ops.service),
+		zap.Int("sessionTTL", ops.sessionTTL),
+		zap.Int("heartbeatInterval", ops.heartbeatInterval),
 	)
 
+	var client etcdutil.EtcdWrapper = ec
+	if len(ops.mirrorEndpoints) > 0 {
+		mirror, err := etcdutil.NewEtcdClient(ops.mirrorEndpoints, ops.lg, ops.etcdOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		// session和lock只在primary上，lease不能跨集群
+		client = etcdutil.NewDualWriteClient(ops.lg, ec, mirror)
+	}
+
 	c := Container{
-		Client:  ec,
+		Client:  client,
 		Session: s,
 		stopper: &GoroutineStopper{},
 
-		id:      ops.id,
-		service: ops.service,
-		donec:   make(chan struct{}),
-		lg:      ops.lg,
+		id:         ops.id,
+		service:    ops.service,
+		watch:      ops.watch,
+		zone:       ops.zone,
+		deployment: ops.deployment,
+		capacity:   ops.capacity,
+		resources:  ops.resources,
+		labels:     ops.labels,
+		process:    newProcessCollector(ops.version),
+		donec:      make(chan struct{}),
+		lg:         ops.lg,
+
+		etcdPath:          etcdPath,
+		etcdNamespace:     ops.etcdNamespace,
+		heartbeatInterval: time.Duration(ops.heartbeatInterval) * time.Second,
+
+		maxHeartbeatBackoff: ops.maxHeartbeatBackoff,
+		heartbeatJitter:     ops.heartbeatJitter,
+		sessionTTL:          time.Duration(ops.sessionTTL) * time.Second,
+		heartbeatHandler:    ops.heartbeatHandler,
+
+		backend:        coordination.NewEtcdBackend(ec),
+		backendSession: coordination.NewEtcdSession(s),
+
+		sessionDonec:     make(chan struct{}),
+		lifecycleHandler: ops.lifecycleHandler,
+	}
+	if ops.recoveryBackoff > 0 {
+		c.recovery = &sessionRecovery{client: ec, ttl: ops.sessionTTL, backoff: ops.recoveryBackoff, maxBackoff: ops.maxRecoveryBackoff}
 	}
 
-	// 通过heartbeat上报数据
+	// 通过heartbeat上报数据，失败时退避
 	c.stopper.Wrap(
 		func(ctx context.Context) {
-			TickerLoop(ctx, ops.lg, 3*time.Second, "container stop upload load", c.UploadSysLoad)
+			c.heartbeatLoop(ctx, c.UploadSysLoad)
 		},
 	)
 
-	// 1 监控session，关注etcd导致的异常关闭
+	// 1 监控session，关注etcd导致的异常关闭，开启恢复时重建session
 	// 2 使用donec，关注外部调用Close导致的关闭
-	go func() {
-		select {
-		case <-c.donec:
-			// 被动关闭
-			c.lg.Info("container: stopper closed",
-				zap.String("id", c.Id()),
-				zap.String("service", c.Service()),
-			)
-		case <-c.Session.Done():
-			// 主动关闭
-			c.close()
-
-			c.lg.Info("container: session closed",
-				zap.String("id", c.Id()),
-				zap.String("service", c.Service()),
-			)
-		}
-	}()
+	go c.watchSession()
 
 	return &c, nil
 }
 
+// NewReadOnlyContainer 创建不带session的container，不上报heartbeat，也不会被分配shard，给sm的只读副本使用，
+// client可以是本地缓存，backend用于leader等需要etcd排序的查询
+func NewReadOnlyContainer(id, service string, client etcdutil.EtcdWrapper, backend coordination.Backend, etcdPath *EtcdPath, lg *zap.Logger) *Container {
+	return &Container{
+		Client:   client,
+		stopper:  &GoroutineStopper{},
+		id:       id,
+		service:  service,
+		lg:       lg,
+		donec:    make(chan struct{}),
+		etcdPath: etcdPath,
+		backend:  backend,
+	}
+}
+
 func (c *Container) Close() {
 	c.close()
 
@@ -176,6 +522,7 @@ func (c *Container) close() {
 	if c.closed {
 		return
 	}
+	c.closed = true
 	if c.stopper != nil {
 		c.stopper.Close()
 	}
@@ -194,6 +541,135 @@ func (c *Container) Service() string {
 	return c.service
 }
 
+func (c *Container) Zone() string {
+	return c.zone
+}
+
+func (c *Container) Deployment() string {
+	return c.deployment
+}
+
+func (c *Container) Capacity() int {
+	return c.capacity
+}
+
+func (c *Container) Resources() *Resources {
+	return c.resources
+}
+
+func (c *Container) Labels() map[string]string {
+	return c.labels
+}
+
+// Drain 通过heartbeat通知sm把当前container上的shard移走，container继续工作直到调用方关闭，
+// 立即上报一次heartbeat，不等待下一个interval
+func (c *Container) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+	return errors.Wrap(c.UploadSysLoad(ctx), "")
+}
+
+func (c *Container) Draining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+func (c *Container) EtcdPath() *EtcdPath {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.etcdPath
+}
+
+// EtcdNamespace Client 使用的namespace，为空代表key使用 EtcdPath 中的prefix
+func (c *Container) EtcdNamespace() string {
+	return c.etcdNamespace
+}
+
+// HeartbeatInterval container和shard上报heartbeat的间隔，没有通过 NewContainer 创建时使用默认值
+func (c *Container) HeartbeatInterval() time.Duration {
+	if c.heartbeatInterval <= 0 {
+		return defaultHeartbeatInterval * time.Second
+	}
+	return c.heartbeatInterval
+}
+
+// Backend 没有通过 NewContainer 创建时（unit test），基于 Client 构建
+func (c *Container) Backend() coordination.Backend {
+	if c.backend == nil {
+		return coordination.NewEtcdBackend(c.Client)
+	}
+	return c.backend
+}
+
+// BackendSession 和 Session 对应同一个lease
+func (c *Container) BackendSession() coordination.Session {
+	c.sessionMu.RLock()
+	defer c.sessionMu.RUnlock()
+	if c.backendSession == nil {
+		return coordination.NewEtcdSession(c.Session)
+	}
+	return c.backendSession
+}
+
+// CurrentSession 开启session恢复时 Session 会被替换，并发场景使用这个方法获取当前的session
+func (c *Container) CurrentSession() *concurrency.Session {
+	c.sessionMu.RLock()
+	defer c.sessionMu.RUnlock()
+	return c.Session
+}
+
+// SessionDone session结束并且不再恢复时关闭，开启恢复时只有恢复过程中 Close 才会关闭，
+// 没有通过 NewContainer 创建时（unit test）等同于 Session 的Done
+func (c *Container) SessionDone() <-chan struct{} {
+	if c.sessionDonec == nil {
+		return c.Session.Done()
+	}
+	return c.sessionDonec
+}
+
+// getAppConfig 没有配置时返回零值
+func getAppConfig(ec etcdutil.EtcdWrapper, etcdPath *EtcdPath, service string) (*AppConfig, error) {
+	var appConfig AppConfig
+	resp, err := ec.GetKV(context.TODO(), etcdPath.AppConfig(service), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return &appConfig, nil
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &appConfig); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &appConfig, nil
+}
+
+// GrpcAddr ShardServer 开启grpc时sm下发add/drop的地址，为空表示只支持http
+func (c *Container) GrpcAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.grpcAddr
+}
+
+func (c *Container) setGrpcAddr(v string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.grpcAddr = v
+}
+
+// setEtcdPath 兼容只在 ShardServer 上指定prefix的接入方式
+func (c *Container) setEtcdPath(p *EtcdPath) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.etcdPath = p
+}
+
+// SetId 4 unit test
+func (c *Container) SetId(id string) {
+	c.id = id
+}
+
 // SetService 4 unit test
 func (c *Container) SetService(s string) {
 	c.service = s
@@ -216,6 +692,33 @@ type ContainerHeartbeat struct {
 	CPUUsedPercent     float64                `json:"cpuUsedPercent"`
 	DiskIOCountersStat []*disk.IOCountersStat `json:"diskIOCountersStat"`
 	NetIOCountersStat  *net.IOCountersStat    `json:"netIOCountersStat"`
+
+	// Watch 为true时container通过watch etcd获取shard，sm不会通过http下发add/drop
+	Watch bool `json:"watch"`
+
+	// Zone container所在的可用区，为空表示没有设置
+	Zone string `json:"zone,omitempty"`
+
+	// Deployment container所属的部署，为空表示没有设置
+	Deployment string `json:"deployment,omitempty"`
+
+	// Capacity container可以承载的负载单位，为0表示没有设置
+	Capacity int `json:"capacity,omitempty"`
+
+	// Resources container可以提供给shard预留的资源，为空表示没有设置
+	Resources *Resources `json:"resources,omitempty"`
+
+	// Labels container的标签，为空表示没有设置
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Draining container准备退出，sm不再分配shard，并把已有的shard移走
+	Draining bool `json:"draining,omitempty"`
+
+	// GrpcAddr 不为空时sm可以通过grpc下发add/drop
+	GrpcAddr string `json:"grpcAddr,omitempty"`
+
+	// Process 进程的运行状态，采集失败时为空
+	Process *ProcessStats `json:"process,omitempty"`
 }
 
 func (l *ContainerHeartbeat) String() string {
@@ -224,7 +727,7 @@ func (l *ContainerHeartbeat) String() string {
 }
 
 func (c *Container) UploadSysLoad(ctx context.Context) error {
-	ld := ContainerHeartbeat{}
+	ld := ContainerHeartbeat{Watch: c.watch, Zone: c.zone, Deployment: c.deployment, Capacity: c.capacity, Resources: c.resources, Labels: c.labels, Draining: c.Draining(), GrpcAddr: c.GrpcAddr()}
 	ld.Timestamp = time.Now().Unix()
 
 	// 内存使用比率
@@ -241,6 +744,16 @@ func (c *Container) UploadSysLoad(ctx context.Context) error {
 	}
 	ld.CPUUsedPercent = cp[0]
 
+	// 进程状态只用于展示，采集失败不影响heartbeat
+	if c.process != nil {
+		ps, err := c.process.collect()
+		if err != nil {
+			c.lg.Warn("collect process stats error", zap.String("service", c.service), zap.Error(err))
+		} else {
+			ld.Process = ps
+		}
+	}
+
 	// 磁盘io使用比率
 	diskIOCounters, err := disk.IOCounters()
 	if err != nil {
@@ -259,15 +772,14 @@ func (c *Container) UploadSysLoad(ctx context.Context) error {
 
 	// https://tangxusc.github.io/blog/2019/05/etcd-lock%E8%AF%A6%E8%A7%A3/
 	// 利用etcd内置lock，防止container冲突，这个问题在container应该比较少见，做到heartbeat即可，smserver就可以做
-	lockPfx := EtcdPathAppContainerIdHb(c.service, c.id)
-	mutex := concurrency.NewMutex(c.Session, lockPfx)
-	if err := mutex.Lock(c.Client.Ctx()); err != nil {
+	lockPfx := c.EtcdPath().AppContainerIdHb(c.service, c.id)
+	dataPfx, err := c.Backend().Lock(c.Client.Ctx(), c.BackendSession(), lockPfx)
+	if err != nil {
 		return errors.Wrap(err, "")
 	}
 
 	// 上传负载和基础信息
-	dataPfx := fmt.Sprintf("%s/%x", lockPfx, c.Session.Lease())
-	if _, err := c.Client.Put(ctx, dataPfx, ld.String(), clientv3.WithLease(c.Session.Lease())); err != nil {
+	if err := c.Backend().PutEphemeral(ctx, c.BackendSession(), dataPfx, ld.String()); err != nil {
 		return errors.Wrap(err, "")
 	}
 	return nil
@@ -16,26 +16,101 @@ package apputil
 
 import "fmt"
 
-var (
-	// etcdPrefix 需要可配置
-	etcdPrefix = "/sm"
-)
+const defaultEtcdPrefix = "/sm"
 
+// defaultEtcdPath 没有指定prefix的实例共用
+var defaultEtcdPath = NewEtcdPath(defaultEtcdPrefix)
+
+// InitEtcdPrefix 修改进程级别的默认prefix，只影响之后创建且没有指定prefix的 Container，
+// 同一个进程中需要使用多个prefix时，使用 ContainerWithEtcdPrefix
 func InitEtcdPrefix(prefix string) {
 	if prefix == "" {
 		panic("prefix should not be empty")
 	}
-	etcdPrefix = prefix
+	defaultEtcdPath = NewEtcdPath(prefix)
+}
+
+// EtcdPath 在prefix下生成etcd中的路径，不同prefix的实例在同一个进程中互不影响
+type EtcdPath struct {
+	prefix string
+}
+
+func NewEtcdPath(prefix string) *EtcdPath {
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+	return &EtcdPath{prefix: prefix}
+}
+
+// NewNamespacedEtcdPath etcd client已经通过namespace隔离，路径不再拼接prefix
+func NewNamespacedEtcdPath() *EtcdPath {
+	return &EtcdPath{}
+}
+
+func (p *EtcdPath) Prefix() string {
+	return p.prefix
+}
+
+func (p *EtcdPath) AppPrefix(service string) string {
+	return fmt.Sprintf("%s/app/%s", p.prefix, service)
+}
+
+func (p *EtcdPath) AppContainerIdHb(service, id string) string {
+	return fmt.Sprintf("%s/containerhb/%s", p.AppPrefix(service), id)
+}
+
+func (p *EtcdPath) AppShardHbId(service, id string) string {
+	return fmt.Sprintf("%s/shardhb/%s", p.AppPrefix(service), id)
+}
+
+// AppAssignment watch模式的container从这个节点下获取分配给自己的shard
+func (p *EtcdPath) AppAssignment(service, containerId string) string {
+	return fmt.Sprintf("%s/assignment/%s", p.AppPrefix(service), containerId)
+}
+
+// AppConfig sm根据service的spec写入，container启动时读取heartbeat相关配置
+func (p *EtcdPath) AppConfig(service string) string {
+	return fmt.Sprintf("%s/config", p.AppPrefix(service))
+}
+
+// AppFencing sm下发add之前写入，节点的ModRevision就是shard当前的fencing token
+func (p *EtcdPath) AppFencing(service, shardId string) string {
+	return fmt.Sprintf("%s/fencing/%s", p.AppPrefix(service), shardId)
+}
+
+// AppRefusal container拒绝shard时在这个节点下写入以container id命名的临时节点
+func (p *EtcdPath) AppRefusal(service, shardId string) string {
+	return fmt.Sprintf("%s/refusal/%s", p.AppPrefix(service), shardId)
 }
 
 func EtcdPathAppPrefix(service string) string {
-	return fmt.Sprintf("%s/app/%s", etcdPrefix, service)
+	return defaultEtcdPath.AppPrefix(service)
 }
 
 func EtcdPathAppContainerIdHb(service, id string) string {
-	return fmt.Sprintf("%s/containerhb/%s", EtcdPathAppPrefix(service), id)
+	return defaultEtcdPath.AppContainerIdHb(service, id)
 }
 
 func EtcdPathAppShardHbId(service, id string) string {
-	return fmt.Sprintf("%s/shardhb/%s", EtcdPathAppPrefix(service), id)
+	return defaultEtcdPath.AppShardHbId(service, id)
+}
+
+// EtcdPathAppAssignment watch模式的container从这个节点下获取分配给自己的shard
+func EtcdPathAppAssignment(service, containerId string) string {
+	return defaultEtcdPath.AppAssignment(service, containerId)
+}
+
+// EtcdPathAppConfig sm根据service的spec写入，container启动时读取heartbeat相关配置
+func EtcdPathAppConfig(service string) string {
+	return defaultEtcdPath.AppConfig(service)
+}
+
+// EtcdPathAppRefusal container拒绝shard时在这个节点下写入以container id命名的临时节点
+func EtcdPathAppRefusal(service, shardId string) string {
+	return defaultEtcdPath.AppRefusal(service, shardId)
+}
+
+// EtcdPathAppFencing sm下发add之前写入，节点的ModRevision就是shard当前的fencing token
+func EtcdPathAppFencing(service, shardId string) string {
+	return defaultEtcdPath.AppFencing(service, shardId)
 }
@@ -0,0 +1,35 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import "testing"
+
+func Test_EtcdPath(t *testing.T) {
+	foo := NewEtcdPath("/foo")
+	bar := NewEtcdPath("/bar")
+	if v := foo.AppShardHbId("proxy", "s1"); v != "/foo/app/proxy/shardhb/s1" {
+		t.Errorf("unexpected path %s", v)
+	}
+	if v := bar.AppContainerIdHb("proxy", "c1"); v != "/bar/app/proxy/containerhb/c1" {
+		t.Errorf("unexpected path %s", v)
+	}
+	if v := NewEtcdPath("").AppAssignment("proxy", "c1"); v != "/sm/app/proxy/assignment/c1" {
+		t.Errorf("unexpected path %s", v)
+	}
+	// namespace "/foo" 加上相对路径后和prefix "/foo" 在etcd中的key一致
+	if v := "/foo" + NewNamespacedEtcdPath().AppShardHbId("proxy", "s1"); v != foo.AppShardHbId("proxy", "s1") {
+		t.Errorf("unexpected path %s", v)
+	}
+}
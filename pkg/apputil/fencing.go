@@ -0,0 +1,48 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// FencingToken 返回shard当前的fencing token，sm还没有分配过的shard返回0。
+// token是sm写入fencing节点时etcd的revision，单调递增，leader切换后也不会回退
+func (c *Container) FencingToken(ctx context.Context, shardId string) (int64, error) {
+	resp, err := c.Client.GetKV(ctx, c.EtcdPath().AppFencing(c.Service(), shardId), nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return 0, nil
+	}
+	return resp.Kvs[0].ModRevision, nil
+}
+
+// CheckFencingToken token是 Add 时 ShardSpec 中的 FencingToken，shard已经重新分配、删除或者不再分配时返回 ErrStaleFencingToken，
+// 业务在提交写入之前检查，或者把token写入存储由存储拒绝更小的token
+func (c *Container) CheckFencingToken(ctx context.Context, shardId string, token int64) error {
+	current, err := c.FencingToken(ctx, shardId)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	// 节点不存在而token不为0，说明shard已经被删除或者不再分配
+	if token < current || (current == 0 && token > 0) {
+		return errors.Wrapf(ErrStaleFencingToken, "shard %s token %d current %d", shardId, token, current)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	shardControlService = "sm.ShardControl"
+
+	shardControlAdd  = "/" + shardControlService + "/Add"
+	shardControlDrop = "/" + shardControlService + "/Drop"
+
+	// shardRefusedTrailer 拒绝add时写入trailer，区分业务拒绝和其他FailedPrecondition
+	shardRefusedTrailer = "sm-code"
+)
+
+// jsonCodec 请求和http接口使用相同的 ShardMessage，不引入protoc生成代码
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) Name() string { return "json" }
+
+// ShardControlReply add/drop成功时的响应，失败通过grpc的status返回
+type ShardControlReply struct{}
+
+type shardControlServer interface {
+	Add(ctx context.Context, req *ShardMessage) (*ShardControlReply, error)
+	Drop(ctx context.Context, req *ShardMessage) (*ShardControlReply, error)
+}
+
+func shardControlHandler(method string, call func(srv shardControlServer, ctx context.Context, req *ShardMessage) (*ShardControlReply, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			var req ShardMessage
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(shardControlServer), ctx, req.(*ShardMessage))
+			}
+			if interceptor == nil {
+				return handler(ctx, &req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + shardControlService + "/" + method}
+			return interceptor(ctx, &req, info, handler)
+		},
+	}
+}
+
+var shardControlServiceDesc = grpc.ServiceDesc{
+	ServiceName: shardControlService,
+	HandlerType: (*shardControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		shardControlHandler("Add", shardControlServer.Add),
+		shardControlHandler("Drop", shardControlServer.Drop),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "grpc.go",
+}
+
+// NewMutualTLSConfig 加载双向认证的证书，server为true时要求对端提供caFile签发的证书
+func NewMutualTLSConfig(caFile, certFile, keyFile string, server bool) (*tls.Config, error) {
+	if caFile == "" || certFile == "" || keyFile == "" {
+		return nil, errors.New("mutual tls requires ca, cert and key")
+	}
+	info := transport.TLSInfo{
+		TrustedCAFile:  caFile,
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientCertAuth: server,
+	}
+	if server {
+		cfg, err := info.ServerConfig()
+		return cfg, errors.Wrap(err, "")
+	}
+	cfg, err := info.ClientConfig()
+	return cfg, errors.Wrap(err, "")
+}
+
+// validateGrpcServerTLS 没有校验client证书时任何人都可以下发add/drop，明文需要通过 ShardServerWithInsecureGrpc 显式开启
+func validateGrpcServerTLS(tlsConfig *tls.Config, insecure bool) error {
+	if tlsConfig == nil {
+		if insecure {
+			return nil
+		}
+		return errors.New("grpc requires tls, use ShardServerWithInsecureGrpc for plaintext")
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return errors.New("grpc tls should require and verify client cert")
+	}
+	return nil
+}
+
+// shardControl 通过grpc接收sm下发的add/drop，和http接口共用校验和admission
+type shardControl struct {
+	ss *ShardServer
+}
+
+func (sc *shardControl) Add(ctx context.Context, req *ShardMessage) (*ShardControlReply, error) {
+	ss := sc.ss
+	ctx, span := Tracer().Start(req.TraceContext.Extract(ctx), "ShardServer.grpcAdd")
+	defer span.End()
+	span.SetAttributes(attribute.String("shardId", req.Id))
+
+	if err := ss.checkShardMessage(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// ctx带有sm的deadline，admission可以据此放弃耗时的检查
+	if err := ss.admit(ctx, req.Id, req.Spec); err != nil {
+		span.RecordError(err)
+		if refusal, ok := IsShardRefusal(err); ok {
+			return nil, refusedStatus(ctx, refusal.Reason)
+		}
+		ss.opts.lg.Error(
+			"admit err",
+			zap.Reflect("req", req),
+			zap.Error(err),
+		)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ss.keeper.Add(ctx, req.Id, req.Spec); err != nil {
+		span.RecordError(err)
+		ss.opts.lg.Error(
+			"Add err",
+			zap.Reflect("req", req),
+			zap.Error(err),
+		)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ss.opts.lg.Info(
+		"add shard success",
+		zap.Reflect("req", req),
+	)
+	return &ShardControlReply{}, nil
+}
+
+func (sc *shardControl) Drop(ctx context.Context, req *ShardMessage) (*ShardControlReply, error) {
+	ss := sc.ss
+	_, span := Tracer().Start(req.TraceContext.Extract(ctx), "ShardServer.grpcDrop")
+	defer span.End()
+	span.SetAttributes(attribute.String("shardId", req.Id))
+
+	if err := ss.keeper.Drop(req.Id); err != nil {
+		span.RecordError(err)
+		ss.opts.lg.Error(
+			"Drop err",
+			zap.Error(err),
+			zap.String("id", req.Id),
+		)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ss.opts.lg.Info(
+		"drop shard success",
+		zap.Reflect("req", req),
+	)
+	return &ShardControlReply{}, nil
+}
+
+// refusedStatus 通过trailer标记业务拒绝，client转换为 ShardRefusal
+func refusedStatus(ctx context.Context, reason string) error {
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(shardRefusedTrailer, ShardRefusedCode))
+	return status.Error(codes.FailedPrecondition, reason)
+}
+
+// serveGrpc 同步监听，端口被占用时 NewShardServer 直接返回错误
+func (ss *ShardServer) serveGrpc() error {
+	lis, err := net.Listen("tcp", ss.opts.grpcAddr)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	// NewShardServer 中已经校验，为空时是显式开启的明文
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(jsonCodec{})}
+	if ss.opts.grpcTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(ss.opts.grpcTLS)))
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&shardControlServiceDesc, &shardControl{ss: ss})
+	ss.grpcSrv = srv
+
+	// 监听所有网卡时使用container id中的host，sm通过heartbeat获取地址
+	ss.opts.container.setGrpcAddr(advertiseAddr(ss.opts.container.Id(), lis.Addr().String()))
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			ss.opts.lg.Error(
+				"grpc serve exit",
+				zap.Error(err),
+				zap.String("addr", ss.opts.grpcAddr),
+			)
+			return
+		}
+		ss.opts.lg.Info(
+			"grpc serve exit",
+			zap.String("addr", ss.opts.grpcAddr),
+			zap.String("service", ss.opts.container.Service()),
+		)
+	}()
+	return nil
+}
+
+// stopGrpc 等待进行中的add/drop完成，超时后强制关闭
+func (ss *ShardServer) stopGrpc() {
+	if ss.grpcSrv == nil {
+		return
+	}
+	ss.opts.container.setGrpcAddr("")
+
+	stopped := make(chan struct{})
+	go func() {
+		ss.grpcSrv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(ss.opts.shutdownTimeout):
+		ss.opts.lg.Error(
+			"grpc graceful stop timeout, force stop",
+			zap.String("service", ss.opts.container.Service()),
+			zap.Duration("timeout", ss.opts.shutdownTimeout),
+		)
+		ss.grpcSrv.Stop()
+	}
+}
+
+// advertiseAddr listener没有指定host时，使用containerId中的host
+func advertiseAddr(containerId string, listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+	if h, _, err := net.SplitHostPort(containerId); err == nil {
+		host = h
+	} else {
+		host = containerId
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// ShardControlClient sm通过grpc向container下发add/drop
+type ShardControlClient struct {
+	cc *grpc.ClientConn
+}
+
+// DialShardControl 不阻塞等待连接建立，tlsConfig是和container的 ShardServerWithGrpc 同一个ca签发的client证书
+func DialShardControl(addr string, tlsConfig *tls.Config) (*ShardControlClient, error) {
+	if tlsConfig == nil {
+		return nil, errors.New("tls config required, use DialInsecureShardControl for plaintext")
+	}
+	return dialShardControl(addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+}
+
+// DialInsecureShardControl 连接 ShardServerWithInsecureGrpc 开启的明文grpc，只用于开发和测试环境
+func DialInsecureShardControl(addr string) (*ShardControlClient, error) {
+	return dialShardControl(addr, grpc.WithInsecure())
+}
+
+func dialShardControl(addr string, creds grpc.DialOption) (*ShardControlClient, error) {
+	opts := []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})), creds}
+	cc, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &ShardControlClient{cc: cc}, nil
+}
+
+// Add ctx的deadline传递给container，container拒绝时返回 ShardRefusal
+func (c *ShardControlClient) Add(ctx context.Context, msg *ShardMessage) error {
+	var (
+		reply   ShardControlReply
+		trailer metadata.MD
+	)
+	err := c.cc.Invoke(ctx, shardControlAdd, msg, &reply, grpc.Trailer(&trailer))
+	if err == nil {
+		return nil
+	}
+	if st, ok := status.FromError(err); ok && st.Code() == codes.FailedPrecondition {
+		for _, v := range trailer.Get(shardRefusedTrailer) {
+			if v == ShardRefusedCode {
+				return &ShardRefusal{Reason: st.Message(), Time: time.Now().Unix()}
+			}
+		}
+	}
+	return errors.Wrap(err, "")
+}
+
+func (c *ShardControlClient) Drop(ctx context.Context, msg *ShardMessage) error {
+	var reply ShardControlReply
+	return errors.Wrap(c.cc.Invoke(ctx, shardControlDrop, msg, &reply), "")
+}
+
+func (c *ShardControlClient) Close() error {
+	return errors.Wrap(c.cc.Close(), "")
+}
@@ -0,0 +1,172 @@
+package apputil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+type fakeShardControl struct {
+	deadline bool
+	refuse   string
+}
+
+func (f *fakeShardControl) Add(ctx context.Context, req *ShardMessage) (*ShardControlReply, error) {
+	_, f.deadline = ctx.Deadline()
+	if f.refuse != "" {
+		return nil, refusedStatus(ctx, f.refuse)
+	}
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty id")
+	}
+	return &ShardControlReply{}, nil
+}
+
+func (f *fakeShardControl) Drop(ctx context.Context, req *ShardMessage) (*ShardControlReply, error) {
+	return &ShardControlReply{}, nil
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, dir, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	kb, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600))
+	return &testCert{cert: cert, key: key}
+}
+
+func Test_ShardControl_mutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	newTestCert(t, dir, "server", ca)
+	newTestCert(t, dir, "client", ca)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	serverTLS, err := NewMutualTLSConfig(file("ca.pem"), file("server.pem"), file("server-key.pem"), true)
+	assert.Nil(t, err)
+	clientTLS, err := NewMutualTLSConfig(file("ca.pem"), file("client.pem"), file("client-key.pem"), false)
+	assert.Nil(t, err)
+	_, err = NewMutualTLSConfig(file("ca.pem"), "", "", false)
+	assert.NotNil(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	impl := &fakeShardControl{}
+	srv := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}), grpc.Creds(credentials.NewTLS(serverTLS)))
+	srv.RegisterService(&shardControlServiceDesc, impl)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	client, err := DialShardControl(lis.Addr().String(), clientTLS)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// deadline传递给container
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	assert.Nil(t, client.Add(ctx, &ShardMessage{Id: "s1"}))
+	assert.True(t, impl.deadline)
+	assert.Nil(t, client.Drop(ctx, &ShardMessage{Id: "s1"}))
+
+	err = client.Add(ctx, &ShardMessage{})
+	_, refused := IsShardRefusal(err)
+	assert.False(t, refused)
+	assert.Equal(t, codes.InvalidArgument, status.Code(errors.Cause(err)))
+
+	impl.refuse = "busy"
+	refusal, refused := IsShardRefusal(client.Add(ctx, &ShardMessage{Id: "s2"}))
+	assert.True(t, refused)
+	assert.Equal(t, "busy", refusal.Reason)
+
+	// 没有client证书的连接被拒绝
+	noCert := clientTLS.Clone()
+	noCert.Certificates = nil
+	noCert.GetClientCertificate = nil
+	anonymous, err := DialShardControl(lis.Addr().String(), noCert)
+	assert.Nil(t, err)
+	defer anonymous.Close()
+	assert.NotNil(t, anonymous.Add(ctx, &ShardMessage{Id: "s3"}))
+}
+
+func Test_validateGrpcServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil)
+	newTestCert(t, dir, "server", ca)
+	file := func(name string) string { return filepath.Join(dir, name) }
+	serverTLS, err := NewMutualTLSConfig(file("ca.pem"), file("server.pem"), file("server-key.pem"), true)
+	assert.Nil(t, err)
+	assert.Nil(t, validateGrpcServerTLS(serverTLS, false))
+
+	// 不校验client证书的配置被拒绝
+	noClientAuth := serverTLS.Clone()
+	noClientAuth.ClientAuth = tls.VerifyClientCertIfGiven
+	assert.NotNil(t, validateGrpcServerTLS(noClientAuth, false))
+
+	// 明文需要显式开启
+	assert.NotNil(t, validateGrpcServerTLS(nil, false))
+	assert.Nil(t, validateGrpcServerTLS(nil, true))
+
+	_, err = DialShardControl("127.0.0.1:0", nil)
+	assert.NotNil(t, err)
+}
+
+func Test_advertiseAddr(t *testing.T) {
+	var tests = []struct {
+		id     string
+		listen string
+		expect string
+	}{
+		{id: "10.0.0.1:8888", listen: "[::]:9090", expect: "10.0.0.1:9090"},
+		{id: "10.0.0.1:8888", listen: "0.0.0.0:9090", expect: "10.0.0.1:9090"},
+		{id: "10.0.0.1:8888", listen: "127.0.0.1:9090", expect: "127.0.0.1:9090"},
+		{id: "host-a", listen: ":9090", expect: "host-a:9090"},
+	}
+	for idx, tt := range tests {
+		assert.Equal(t, tt.expect, advertiseAddr(tt.id, tt.listen), "case %d", idx)
+	}
+}
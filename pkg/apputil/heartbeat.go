@@ -0,0 +1,122 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/chaos"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultMaxHeartbeatBackoff heartbeat连续失败时等待时间的上限
+	defaultMaxHeartbeatBackoff = 30 * time.Second
+
+	// defaultHeartbeatJitter 等待时间随机浮动的比例，防止etcd恢复时所有container同时上报
+	defaultHeartbeatJitter = 0.1
+)
+
+// HeartbeatHandler heartbeat丢失时alive为false，业务应该暂停shard上的工作，恢复后alive为true
+type HeartbeatHandler func(alive bool)
+
+// heartbeatLoop 成功时按照interval上报，失败后从interval开始指数退避，两种情况都叠加jitter。
+// 连续失败超过sessionTTL时，sm大概率已经认为container下线，通知业务heartbeat丢失
+func (c *Container) heartbeatLoop(ctx context.Context, fn func(ctx context.Context) error) {
+	var (
+		backoff   time.Duration
+		failSince time.Time
+	)
+	for {
+		wait := c.heartbeatInterval
+		chaos.DelayHeartbeat(ctx)
+		if err := fn(ctx); err != nil {
+			now := time.Now()
+			if failSince.IsZero() {
+				failSince = now
+			}
+			if backoff == 0 {
+				backoff = c.heartbeatInterval
+			} else {
+				backoff *= 2
+			}
+			if c.maxHeartbeatBackoff > 0 && backoff > c.maxHeartbeatBackoff {
+				backoff = c.maxHeartbeatBackoff
+			}
+			wait = backoff
+
+			c.lg.Warn(
+				"heartbeat error, backoff",
+				zap.String("id", c.Id()),
+				zap.String("service", c.Service()),
+				zap.Duration("backoff", backoff),
+				zap.Duration("failing", now.Sub(failSince)),
+				zap.Error(err),
+			)
+			if now.Sub(failSince) >= c.sessionTTL {
+				c.setHeartbeatAlive(false)
+			}
+		} else {
+			backoff = 0
+			failSince = time.Time{}
+			c.setHeartbeatAlive(true)
+		}
+
+		select {
+		case <-ctx.Done():
+			c.lg.Info("container stop upload load")
+			return
+		case <-time.After(jitter(wait, c.heartbeatJitter)):
+		}
+	}
+}
+
+// setHeartbeatAlive 只在状态变化时回调
+func (c *Container) setHeartbeatAlive(alive bool) {
+	c.mu.Lock()
+	changed := c.heartbeatLost == alive
+	c.heartbeatLost = !alive
+	handler := c.heartbeatHandler
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if alive {
+		c.lg.Info("heartbeat recovered", zap.String("id", c.Id()), zap.String("service", c.Service()))
+	} else {
+		c.lg.Error("heartbeat lost", zap.String("id", c.Id()), zap.String("service", c.Service()))
+	}
+	if handler != nil {
+		handler(alive)
+	}
+}
+
+// HeartbeatLost 连续失败超过sessionTTL后为true，下一次成功上报后恢复为false
+func (c *Container) HeartbeatLost() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.heartbeatLost
+}
+
+// jitter 返回 [d*(1-factor), d*(1+factor)) 之间的随机值
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 || d <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + factor*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,72 @@
+package apputil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_jitter(t *testing.T) {
+	d := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		v := jitter(d, 0.2)
+		if v < 80*time.Millisecond || v >= 120*time.Millisecond {
+			t.Fatalf("unexpected jitter %s", v)
+		}
+	}
+	if v := jitter(d, 0); v != d {
+		t.Errorf("unexpected jitter %s", v)
+	}
+}
+
+func Test_heartbeatLoop(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		states []bool
+		calls  int
+	)
+	c := Container{
+		lg:                  zap.NewNop(),
+		heartbeatInterval:   10 * time.Millisecond,
+		maxHeartbeatBackoff: 20 * time.Millisecond,
+		sessionTTL:          30 * time.Millisecond,
+		heartbeatHandler: func(alive bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, alive)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		c.heartbeatLoop(ctx, func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			// 第一次成功，之后连续失败5次，超过sessionTTL，再恢复
+			if calls > 1 && calls <= 6 {
+				return errors.New("fake")
+			}
+			return nil
+		})
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	<-donec
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) != 2 || states[0] || !states[1] {
+		t.Errorf("unexpected states %v", states)
+	}
+	if c.HeartbeatLost() {
+		t.Errorf("heartbeat should recover")
+	}
+}
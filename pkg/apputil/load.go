@@ -0,0 +1,79 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ShardLoad shard结构化的负载，存储在shardhb中，sm按照container和shard聚合
+type ShardLoad struct {
+	// CPU cpu使用率，单位%
+	CPU float64 `json:"cpu"`
+
+	QPS float64 `json:"qps"`
+
+	// Memory 内存占用，单位byte
+	Memory uint64 `json:"memory"`
+
+	// Gauges 业务自定义的指标，聚合时按照key累加
+	Gauges map[string]float64 `json:"gauges,omitempty"`
+}
+
+func (l *ShardLoad) String() string {
+	b, _ := json.Marshal(l)
+	return string(b)
+}
+
+// Add 累加o到l，用于计算container的负载
+func (l *ShardLoad) Add(o *ShardLoad) {
+	if o == nil {
+		return
+	}
+	l.CPU += o.CPU
+	l.QPS += o.QPS
+	l.Memory += o.Memory
+	for k, v := range o.Gauges {
+		if l.Gauges == nil {
+			l.Gauges = make(map[string]float64)
+		}
+		l.Gauges[k] += v
+	}
+}
+
+// ShardLoadReporter ShardInterface 的实现可以选择实现，heartbeat中上报结构化的负载，
+// 没有实现时，Load 返回 ShardLoad 的json也可以被识别
+type ShardLoadReporter interface {
+	LoadStats(id string) (*ShardLoad, error)
+}
+
+// ShardMoveCostReporter ShardInterface 的实现可以选择实现，heartbeat中上报迁移shard的代价，例如本地状态的大小，
+// sm在多种均衡方案中选择总代价最小的，覆盖 ShardSpec 中的 MoveCost
+type ShardMoveCostReporter interface {
+	MoveCost(id string) (int64, error)
+}
+
+// ParseShardLoad 兼容之前不透明的load字符串，不是 ShardLoad 的json时返回nil
+func ParseShardLoad(s string) *ShardLoad {
+	if !strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return nil
+	}
+	var l ShardLoad
+	if err := json.Unmarshal([]byte(s), &l); err != nil {
+		return nil
+	}
+	return &l
+}
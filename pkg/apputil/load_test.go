@@ -0,0 +1,23 @@
+package apputil
+
+import "testing"
+
+func Test_ShardLoad(t *testing.T) {
+	if l := ParseShardLoad("foo"); l != nil {
+		t.Errorf("unexpected load %v", l)
+	}
+	if l := ParseShardLoad("{bar"); l != nil {
+		t.Errorf("unexpected load %v", l)
+	}
+
+	var total ShardLoad
+	total.Add(ParseShardLoad(`{"cpu":10,"qps":100,"memory":1024,"gauges":{"conn":3}}`))
+	total.Add(&ShardLoad{CPU: 5, QPS: 50, Gauges: map[string]float64{"conn": 2, "lag": 1}})
+	total.Add(nil)
+	if total.CPU != 15 || total.QPS != 150 || total.Memory != 1024 {
+		t.Errorf("unexpected total %s", total.String())
+	}
+	if total.Gauges["conn"] != 5 || total.Gauges["lag"] != 1 {
+		t.Errorf("unexpected gauges %v", total.Gauges)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ProcessStats container进程的运行状态，随heartbeat上报，sm汇总后展示整个service的container
+type ProcessStats struct {
+	Pid        int32   `json:"pid"`
+	Goroutines int     `json:"goroutines"`
+	RSS        uint64  `json:"rss"`
+	CPUPercent float64 `json:"cpuPercent"`
+
+	// StartTime 进程启动的时间，Uptime 到本次heartbeat为止的运行时间，单位都是秒
+	StartTime int64 `json:"startTime"`
+	Uptime    int64 `json:"uptime"`
+
+	// Version 业务通过 ContainerWithVersion 设置，没有设置时使用main module的版本
+	Version   string `json:"version,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// processCollector 保留process对象，CPUPercent计算的是两次heartbeat之间的使用率
+type processCollector struct {
+	startTime time.Time
+	version   string
+
+	mu   sync.Mutex
+	proc *process.Process
+}
+
+func newProcessCollector(version string) *processCollector {
+	if version == "" {
+		version = buildVersion()
+	}
+	return &processCollector{startTime: time.Now(), version: version}
+}
+
+// buildVersion main module是 (devel) 时说明没有版本信息
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "(devel)" {
+		return ""
+	}
+	return info.Main.Version
+}
+
+func (pc *processCollector) collect() (*ProcessStats, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.proc == nil {
+		p, err := process.NewProcess(int32(os.Getpid()))
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		pc.proc = p
+	}
+
+	now := time.Now()
+	stats := ProcessStats{
+		Pid:        pc.proc.Pid,
+		Goroutines: runtime.NumGoroutine(),
+		StartTime:  pc.startTime.Unix(),
+		Uptime:     int64(now.Sub(pc.startTime).Seconds()),
+		Version:    pc.version,
+		GoVersion:  runtime.Version(),
+	}
+	mi, err := pc.proc.MemoryInfo()
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	stats.RSS = mi.RSS
+	// 第一次调用没有上一次的采样，返回0
+	percent, err := pc.proc.Percent(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	stats.CPUPercent = percent
+	return &stats, nil
+}
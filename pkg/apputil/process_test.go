@@ -0,0 +1,25 @@
+package apputil
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_processCollector_collect(t *testing.T) {
+	pc := newProcessCollector("v1.2.3")
+	stats, err := pc.collect()
+	if err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+	if stats.Pid != int32(os.Getpid()) || stats.Goroutines <= 0 || stats.RSS == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.Version != "v1.2.3" || stats.GoVersion == "" || stats.StartTime <= 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// 第二次采样开始计算cpu使用率
+	if _, err := pc.collect(); err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+}
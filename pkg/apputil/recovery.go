@@ -0,0 +1,207 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"context"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/coordination"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+)
+
+// defaultMaxRecoveryBackoff 重建session失败时等待时间的上限
+const defaultMaxRecoveryBackoff = 30 * time.Second
+
+type LifecycleEventType string
+
+const (
+	// LifecycleSessionLost session过期，container在sm中被认为下线
+	LifecycleSessionLost LifecycleEventType = "sessionLost"
+	// LifecycleRecoveryFailed 一次重建session失败，等待退避后重试
+	LifecycleRecoveryFailed LifecycleEventType = "recoveryFailed"
+	// LifecycleSessionRecovered session重建成功，container重新注册，本地shard的lock已经重新获取
+	LifecycleSessionRecovered LifecycleEventType = "sessionRecovered"
+	// LifecycleShardLost session丢失期间shard被sm分配给其他container，已经在本地drop
+	LifecycleShardLost LifecycleEventType = "shardLost"
+	// LifecycleClosed session不再恢复，container关闭，需要业务重新创建
+	LifecycleClosed LifecycleEventType = "closed"
+)
+
+// LifecycleEvent container的session事件
+type LifecycleEvent struct {
+	Type        LifecycleEventType
+	ContainerId string
+	Service     string
+
+	// Attempt 重建session的次数，只在 LifecycleRecoveryFailed 和 LifecycleSessionRecovered 中设置
+	Attempt int
+
+	// ShardId 只在 LifecycleShardLost 中设置
+	ShardId string
+
+	Err  error
+	Time time.Time
+}
+
+// LifecycleHandler 在container内部的goroutine中同步调用，不能阻塞
+type LifecycleHandler func(ev *LifecycleEvent)
+
+// sessionRecovery 重建session使用primary集群，lease不能跨集群
+type sessionRecovery struct {
+	client     *etcdutil.EtcdClient
+	ttl        int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// newSession lease的申请设置超时，etcd不可用时不会一直阻塞，keepalive使用client的context
+func (r *sessionRecovery) newSession() (*concurrency.Session, error) {
+	ctx, cancel := context.WithTimeout(r.client.Ctx(), time.Duration(r.ttl)*time.Second)
+	defer cancel()
+	resp, err := r.client.Grant(ctx, int64(r.ttl))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	s, err := concurrency.NewSession(r.client.Client, concurrency.WithTTL(r.ttl), concurrency.WithLease(resp.ID))
+	return s, errors.Wrap(err, "")
+}
+
+func (c *Container) emit(ev *LifecycleEvent) {
+	if c.lifecycleHandler == nil {
+		return
+	}
+	ev.ContainerId = c.Id()
+	ev.Service = c.Service()
+	ev.Time = time.Now()
+	c.lifecycleHandler(ev)
+}
+
+// addSessionListener session重建后在对外可见之前调用，返回错误时放弃这次重建
+func (c *Container) addSessionListener(fn func(s *concurrency.Session) error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	c.sessionListeners = append(c.sessionListeners, fn)
+}
+
+// watchSession 没有开启恢复时，session过期后关闭container，开启时重建session直到 Close
+func (c *Container) watchSession() {
+	for {
+		select {
+		case <-c.donec:
+			// 被动关闭
+			c.lg.Info("container: stopper closed",
+				zap.String("id", c.Id()),
+				zap.String("service", c.Service()),
+			)
+			return
+		case <-c.CurrentSession().Done():
+		}
+
+		// session过期后container不再注册在sm中
+		c.setHeartbeatAlive(false)
+		c.emit(&LifecycleEvent{Type: LifecycleSessionLost})
+
+		if c.recovery == nil || !c.recoverSession() {
+			// 主动关闭
+			c.close()
+			close(c.sessionDonec)
+			c.emit(&LifecycleEvent{Type: LifecycleClosed})
+
+			c.lg.Info("container: session closed",
+				zap.String("id", c.Id()),
+				zap.String("service", c.Service()),
+			)
+			return
+		}
+	}
+}
+
+// recoverSession 指数退避重建session，成功返回true，Close时返回false
+func (c *Container) recoverSession() bool {
+	backoff := c.recovery.backoff
+	maxBackoff := c.recovery.maxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRecoveryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.renewSession()
+		if err == nil {
+			c.lg.Info("container: session recovered",
+				zap.String("id", c.Id()),
+				zap.String("service", c.Service()),
+				zap.Int("attempt", attempt),
+			)
+			c.emit(&LifecycleEvent{Type: LifecycleSessionRecovered, Attempt: attempt})
+			return true
+		}
+
+		c.lg.Warn("container: recover session error, backoff",
+			zap.String("id", c.Id()),
+			zap.String("service", c.Service()),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		c.emit(&LifecycleEvent{Type: LifecycleRecoveryFailed, Attempt: attempt, Err: err})
+		select {
+		case <-c.donec:
+			return false
+		case <-time.After(jitter(backoff, c.heartbeatJitter)):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// renewSession 先让listener用新的session重新获取lock，再替换session，最后立即上报一次heartbeat重新注册container，
+// 替换之前heartbeat使用旧的session会失败，不会阻塞在被其他container持有的lock上
+func (c *Container) renewSession() error {
+	s, err := c.recovery.newSession()
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	c.sessionMu.RLock()
+	listeners := c.sessionListeners
+	c.sessionMu.RUnlock()
+	for _, fn := range listeners {
+		if err := fn(s); err != nil {
+			_ = s.Close()
+			return errors.Wrap(err, "")
+		}
+	}
+
+	c.sessionMu.Lock()
+	c.Session = s
+	c.backendSession = coordination.NewEtcdSession(s)
+	c.sessionMu.Unlock()
+
+	// 注册失败时由heartbeat的循环重试
+	if err := c.UploadSysLoad(context.TODO()); err != nil {
+		c.lg.Warn("container: register after recovery error",
+			zap.String("id", c.Id()),
+			zap.String("service", c.Service()),
+			zap.Error(err),
+		)
+		return nil
+	}
+	c.setHeartbeatAlive(true)
+	return nil
+}
@@ -0,0 +1,102 @@
+package apputil
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+func TestContainer_SessionRecovery(t *testing.T) {
+	events := make(chan *LifecycleEvent, 16)
+	ops := append(
+		newTestContainerOptions(context.TODO()),
+		ContainerWithSessionTTL(2),
+		ContainerWithHeartbeatInterval(1),
+		ContainerWithSessionRecovery(100*time.Millisecond, time.Second),
+		ContainerWithLifecycleHandler(func(ev *LifecycleEvent) { events <- ev }),
+	)
+	container, err := NewContainer(ops...)
+	assert.Nil(t, err)
+	defer container.Close()
+
+	// 撤销lease模拟session过期
+	client, _ := etcdutil.UnwrapEtcdClient(container.Client)
+	lease := container.CurrentSession().Lease()
+	_, err = client.Revoke(context.TODO(), lease)
+	assert.Nil(t, err)
+
+	for _, typ := range []LifecycleEventType{LifecycleSessionLost, LifecycleSessionRecovered} {
+		select {
+		case ev := <-events:
+			assert.Equal(t, typ, ev.Type)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expect %s", typ)
+		}
+	}
+	assert.NotEqual(t, lease, container.CurrentSession().Lease())
+	select {
+	case <-container.Done():
+		t.Fatal("container closed")
+	case <-container.SessionDone():
+		t.Fatal("session done")
+	default:
+	}
+
+	// container重新注册
+	resp, err := client.Get(context.TODO(), container.EtcdPath().AppContainerIdHb(container.Service(), container.Id()), clientv3.WithPrefix())
+	assert.Nil(t, err)
+	assert.True(t, resp.Count > 0)
+}
+
+func Test_shardKeeper_relock(t *testing.T) {
+	ec, err := etcdutil.NewEtcdClient([]string{"127.0.0.1:2379"}, ttLogger)
+	assert.Nil(t, err)
+	defer ec.Close()
+
+	sk := shardKeeper{
+		lg:           ttLogger,
+		service:      "foo.bar",
+		etcdPath:     defaultEtcdPath,
+		client:       ec,
+		shardImpl:    &testShardImpl{},
+		shardMutexes: make(map[string]*concurrency.Mutex),
+		shardCtxs:    make(map[string]*shardContext),
+	}
+	sk.db, err = bolt.Open(filepath.Join(t.TempDir(), "sm.db"), 0600, nil)
+	assert.Nil(t, err)
+	defer sk.db.Close()
+	assert.Nil(t, sk.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(sk.service))
+		return err
+	}))
+	assert.Nil(t, sk.Add(context.TODO(), "s1", &ShardSpec{}))
+	assert.Nil(t, sk.Add(context.TODO(), "s2", &ShardSpec{}))
+
+	// s2 在session丢失期间被其他container获取
+	other, err := concurrency.NewSession(ec.Client, concurrency.WithTTL(5))
+	assert.Nil(t, err)
+	defer other.Close()
+	assert.Nil(t, concurrency.NewMutex(other, sk.etcdPath.AppShardHbId(sk.service, "s2")).Lock(context.TODO()))
+
+	s, err := concurrency.NewSession(ec.Client, concurrency.WithTTL(5))
+	assert.Nil(t, err)
+	defer s.Close()
+	lost, err := sk.relock(s)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"s2"}, lost)
+	assert.Contains(t, sk.shardMutexes, "s1")
+
+	var ids []string
+	_ = sk.forEach(func(k, v []byte) error {
+		ids = append(ids, string(k))
+		return nil
+	})
+	assert.Equal(t, []string{"s1"}, ids)
+}
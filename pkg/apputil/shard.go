@@ -16,19 +16,27 @@ package apputil
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/entertainment-venue/sm/pkg/chaos"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 type ShardAction int
@@ -37,10 +45,19 @@ const (
 	ShardActionDelete ShardAction = iota + 1
 )
 
+// replicaSeparator 分隔shard id和副本序号
+const replicaSeparator = "#"
+
+// defaultShutdownTimeout 关闭时等待进行中的http请求完成的最长时间
+const defaultShutdownTimeout = 10 * time.Second
+
 var (
 	ErrClosing  = errors.New("closing")
 	ErrExist    = errors.New("exist")
 	ErrNotExist = errors.New("not exist")
+
+	// ErrStaleFencingToken shard已经分配给了其他container，持有的fencing token过期
+	ErrStaleFencingToken = errors.New("stale fencing token")
 )
 
 type ShardSpec struct {
@@ -65,6 +82,60 @@ type ShardSpec struct {
 
 	// Action 标记当前ShardSpec所处状态，smserver删除分片
 	Action ShardAction `json:"action"`
+
+	// ReplicaCount shard需要分配到多少个不同的container上，包含primary，<=1代表没有副本
+	ReplicaCount int `json:"replicaCount"`
+
+	// Replica sm下发时填写的副本序号，0为primary，其余为secondary
+	Replica int `json:"replica"`
+
+	// Priority 值越大优先级越高，container不足时优先分配高优先级的shard，container需要移走shard时优先移走低优先级的shard
+	Priority int `json:"priority"`
+
+	// LoadEstimate shard预估的负载单位，和container的capacity对应，binpack分配时使用，<=0按照1计算
+	LoadEstimate int `json:"loadEstimate,omitempty"`
+
+	// Weight 默认分配方式下shard的权重，weight为10的shard按照10个普通shard计算，<=0按照1计算
+	Weight int `json:"weight,omitempty"`
+
+	// Resources shard需要预留的cpu/mem单位，sm拒绝让container声明的资源超卖的分配，为空不预留
+	Resources *Resources `json:"resources,omitempty"`
+
+	// Warmup shard在Add之后重建缓存等需要的时间，单位秒，service开启warmup时，
+	// 新启动的container在这批shard预热完成之前不会收到下一批，为0使用service的间隔
+	Warmup int `json:"warmup,omitempty"`
+
+	// Constraint placement约束表达式，只分配到满足条件的container，为空不限制，例如:
+	// container.labels.zone == "us-east-1" && container.load.cpu < 0.7
+	Constraint string `json:"constraint,omitempty"`
+
+	// PreferredContainers shard没有分配到container时（例如所在container故障），按照顺序优先选择这些container，
+	// 都不能接收时再走通用的分配，适合在特定container上有本地缓存的shard
+	PreferredContainers []string `json:"preferredContainers,omitempty"`
+
+	// MoveCost 迁移shard的代价，例如需要传输的状态大小，多种均衡方案时sm选择总代价最小的，为0没有代价，
+	// shard实现 ShardMoveCostReporter 时以上报的值为准
+	MoveCost int64 `json:"moveCost,omitempty"`
+
+	// ExpireAt shard过期的时间，单位秒，sm在过期后drop并删除shard，为0不过期
+	ExpireAt int64 `json:"expireAt,omitempty"`
+
+	// Revision 查询时填写etcd中的ModRevision，修改时带上做乐观锁校验，不持久化
+	Revision int64 `json:"revision,omitempty"`
+
+	// TraceContext 最近一次修改shard的api调用，sm移动shard时关联到这个调用
+	TraceContext TraceContext `json:"traceContext,omitempty"`
+
+	// FencingToken sm每次下发add时填写，同一个shard后一次分配的token一定更大，业务写存储时带上token，
+	// 拒绝token更小的写入，防止迁移过程中旧container的写入覆盖新container，不持久化
+	FencingToken int64 `json:"fencingToken,omitempty"`
+}
+
+// Resources cpu/mem的资源单位，含义由业务约定，例如cpu 1000代表1核，mem单位MB，
+// 用于shard声明需要预留的资源，以及container声明可以提供的资源，container的某一项为0代表这一项不限制
+type Resources struct {
+	Cpu int `json:"cpu,omitempty"`
+	Mem int `json:"mem,omitempty"`
 }
 
 func (ss *ShardSpec) String() string {
@@ -72,6 +143,53 @@ func (ss *ShardSpec) String() string {
 	return string(b)
 }
 
+// Expired 没有设置ExpireAt的shard不会过期
+func (ss *ShardSpec) Expired(now time.Time) bool {
+	return ss.ExpireAt > 0 && now.Unix() >= ss.ExpireAt
+}
+
+// IsPrimary 没有开启副本的shard都是primary
+func (ss *ShardSpec) IsPrimary() bool {
+	return ss.Replica == 0
+}
+
+// ReplicaShardId 副本在container中的标识，primary保持原有shard id，secondary增加序号后缀
+func ReplicaShardId(shardId string, replica int) string {
+	if replica == 0 {
+		return shardId
+	}
+	return fmt.Sprintf("%s%s%d", shardId, replicaSeparator, replica)
+}
+
+// ReplicaShardIdPrefix shard所有secondary副本标识的公共前缀
+func ReplicaShardIdPrefix(shardId string) string {
+	return shardId + replicaSeparator
+}
+
+// ValidateShardId 副本标识使用 replicaSeparator 分隔序号，shard id中出现时会被解析成其他shard的副本
+func ValidateShardId(shardId string) error {
+	if shardId == "" {
+		return errors.New("empty shard id")
+	}
+	if strings.Contains(shardId, replicaSeparator) {
+		return errors.Errorf("shard id %s should not contain %q", shardId, replicaSeparator)
+	}
+	return nil
+}
+
+// ParseReplicaShardId 从副本标识中解析shard id和副本序号
+func ParseReplicaShardId(id string) (string, int) {
+	idx := strings.LastIndex(id, replicaSeparator)
+	if idx < 0 {
+		return id, 0
+	}
+	replica, err := strconv.Atoi(id[idx+len(replicaSeparator):])
+	if err != nil || replica <= 0 {
+		return id, 0
+	}
+	return id[:idx], replica
+}
+
 func (ss *ShardSpec) Validate() error {
 	if ss.Service == "" {
 		return errors.New("Empty service")
@@ -90,6 +208,12 @@ type ShardHeartbeat struct {
 
 	Load        string `json:"load"`
 	ContainerId string `json:"containerId"`
+
+	// Stats 结构化的负载，shard没有提供时为空
+	Stats *ShardLoad `json:"stats,omitempty"`
+
+	// MoveCost 通过 ShardMoveCostReporter 上报的迁移代价，没有实现时为0
+	MoveCost int64 `json:"moveCost,omitempty"`
 }
 
 func (s *ShardHeartbeat) String() string {
@@ -103,6 +227,12 @@ type ShardInterface interface {
 	Load(id string) (string, error)
 }
 
+// ShardContextAdder ShardInterface 的实现可以选择实现，实现后代替 Add 调用，ctx在shard被drop、session丢失或者
+// ShardServer 关闭时取消，业务绑定在shard上的goroutine监听ctx及时退出
+type ShardContextAdder interface {
+	AddWithContext(ctx context.Context, id string, spec *ShardSpec) error
+}
+
 type ShardOpReceiver interface {
 	AddShard(c *gin.Context)
 	DropShard(c *gin.Context)
@@ -115,6 +245,9 @@ type ShardServer struct {
 	// 在Close方法中需要能被close掉
 	srv *http.Server
 
+	// grpcSrv 开启grpc时接收add/drop，和srv一起关闭
+	grpcSrv *grpc.Server
+
 	donec chan struct{}
 
 	// opts 存储选项中的数据，没必要copy一遍
@@ -126,6 +259,11 @@ type ShardServer struct {
 	mu sync.Mutex
 	// closed 导致 ShardServer 被关闭的事件是异步的，需要做保护
 	closed bool
+
+	// refusedMu 保护refused，http和watch模式的add可能并发
+	refusedMu sync.Mutex
+	// refused 拒绝过并且写入了refusal节点的shard
+	refused map[string]struct{}
 }
 
 type shardServerOptions struct {
@@ -141,9 +279,32 @@ type shardServerOptions struct {
 	// 例如：现有的web项目使用gin，sm把server启动拿过来也不合适。
 	router *gin.Engine
 
-	// etcdPrefix 作为sharded application的数据存储prefix，能通过acl做限制
-	// TODO 配合 etcdPrefix 需要有用户名和密码的字段
+	// etcdPrefix 作为sharded application的数据存储prefix，能通过acl做限制，为空时使用container的prefix
 	etcdPrefix string
+
+	// dbPath 本地存储shard的boltdb文件，同一个进程中的多个 ShardServer 需要使用不同的文件
+	dbPath string
+
+	// watch 不提供http接口，通过watch etcd中的assignment节点接收shard，
+	// 适用于不能额外开放端口的app，container需要同时开启watch
+	watch bool
+
+	// taskKey sm开启task加密时使用相同的key，下发给 ShardInterface 之前解密
+	taskKey []byte
+
+	// shutdownTimeout 关闭webserver时等待进行中请求完成的时间，超时后强制断开连接
+	shutdownTimeout time.Duration
+
+	// admission 接受shard之前由业务判断是否有能力处理
+	admission ShardAdmission
+
+	// grpcAddr 不为空时额外通过grpc接收add/drop，地址通过container的heartbeat告知sm，
+	// sm没有开启grpc时仍然使用http接口
+	grpcAddr string
+	// grpcTLS grpc的双向认证配置，必须校验sm的client证书
+	grpcTLS *tls.Config
+	// grpcInsecure 显式开启明文grpc，只用于开发和测试环境
+	grpcInsecure bool
 }
 
 type ShardServerOption func(options *shardServerOptions)
@@ -196,14 +357,66 @@ func ShardServerWithEtcdPrefix(v string) ShardServerOption {
 	}
 }
 
+func ShardServerWithDbPath(v string) ShardServerOption {
+	return func(sso *shardServerOptions) {
+		sso.dbPath = v
+	}
+}
+
+func ShardServerWithWatch(v bool) ShardServerOption {
+	return func(sso *shardServerOptions) {
+		sso.watch = v
+	}
+}
+
+// ShardServerWithTaskKey 和sm使用相同的AES key，加密的task在调用 ShardInterface.Add 之前解密，
+// 没有设置时从环境变量 SM_TASK_KEY 读取
+func ShardServerWithTaskKey(v []byte) ShardServerOption {
+	return func(sso *shardServerOptions) {
+		sso.taskKey = v
+	}
+}
+
+// ShardServerWithShutdownTimeout 关闭时先停止接收新请求，最多等待v让进行中的请求完成，默认10s
+func ShardServerWithShutdownTimeout(v time.Duration) ShardServerOption {
+	return func(sso *shardServerOptions) {
+		sso.shutdownTimeout = v
+	}
+}
+
+// ShardServerWithAdmission 接受shard之前调用v，v返回 RefuseShard 时sm把shard分配给其他container
+func ShardServerWithAdmission(v ShardAdmission) ShardServerOption {
+	return func(sso *shardServerOptions) {
+		sso.admission = v
+	}
+}
+
+// ShardServerWithGrpc 在addr上开启grpc的add/drop接口，tlsConfig 一般通过 NewMutualTLSConfig 创建，
+// 必须要求并校验client证书，大规模rebalance时相比http延迟更低，http接口仍然保留
+func ShardServerWithGrpc(addr string, tlsConfig *tls.Config) ShardServerOption {
+	return func(sso *shardServerOptions) {
+		sso.grpcAddr = addr
+		sso.grpcTLS = tlsConfig
+	}
+}
+
+// ShardServerWithInsecureGrpc 在addr上开启明文的grpc接口，任何能访问端口的进程都可以下发add/drop，只用于开发和测试环境
+func ShardServerWithInsecureGrpc(addr string) ShardServerOption {
+	return func(sso *shardServerOptions) {
+		sso.grpcAddr = addr
+		sso.grpcTLS = nil
+		sso.grpcInsecure = true
+	}
+}
+
 func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 	ops := &shardServerOptions{}
 	for _, opt := range opts {
 		opt(ops)
 	}
 
-	// addr 和 router 二选一，否则啥也不用干了
-	if ops.addr == "" && ops.router == nil {
+	// addr 和 router 二选一，否则啥也不用干了，watch模式不需要http接口
+	if ops.addr == "" && ops.router == nil && !ops.watch {
 		return nil, errors.New("addr err")
 	}
 	if ops.container == nil {
@@ -215,14 +428,42 @@ func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 	if ops.impl == nil {
 		return nil, errors.New("impl err")
 	}
+	// watch模式不开放端口
+	if ops.watch && ops.grpcAddr != "" {
+		return nil, errors.New("grpc err")
+	}
+	if ops.grpcAddr != "" {
+		if err := validateGrpcServerTLS(ops.grpcTLS, ops.grpcInsecure); err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	if ops.taskKey == nil {
+		key, err := TaskKeyFromEnv()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		ops.taskKey = key
+	}
+	if ops.taskKey != nil {
+		if err := ValidateTaskKey(ops.taskKey); err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	if ops.shutdownTimeout <= 0 {
+		ops.shutdownTimeout = defaultShutdownTimeout
+	}
 
-	// FIXME 直接刚常量有点粗糙，暂时没有更好的方案
-	InitEtcdPrefix(ops.etcdPrefix)
+	// 指定prefix时container的heartbeat也使用相同的prefix，不再修改进程级别的prefix，
+	// container使用namespace时，prefix已经由namespace决定
+	if ops.etcdPrefix != "" && ops.container.EtcdNamespace() == "" && ops.etcdPrefix != ops.container.EtcdPath().Prefix() {
+		ops.container.setEtcdPath(NewEtcdPath(ops.etcdPrefix))
+	}
 
 	ss := ShardServer{
 		stopper: &GoroutineStopper{},
 		donec:   make(chan struct{}),
 		opts:    ops,
+		refused: make(map[string]struct{}),
 	}
 
 	// keeper: 向调用方下发shard move指令，提供本地持久存储能力
@@ -232,14 +473,24 @@ func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 	}
 	ss.keeper = keeper
 
+	// 开启session恢复时，新的session对外可见之前重新获取shard的lock
+	ss.opts.container.addSessionListener(func(s *concurrency.Session) error {
+		lost, err := keeper.relock(s)
+		for _, shardId := range lost {
+			ss.opts.container.emit(&LifecycleEvent{Type: LifecycleShardLost, ShardId: shardId})
+		}
+		return err
+	})
+
 	// heartbeat:
 	ss.stopper.Wrap(func(ctx context.Context) {
 		TickerLoop(
 			ctx,
 			ops.lg,
-			3*time.Second,
+			ss.opts.container.HeartbeatInterval(),
 			fmt.Sprintf("shardserver: service %s stop heartbeat", ss.opts.container.Service()),
 			func(ctx context.Context) error {
+				chaos.DelayHeartbeat(ctx)
 				hbFn := func(k, v []byte) error {
 					id := string(k)
 					load, err := ss.keeper.Load(id)
@@ -255,16 +506,19 @@ func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 					hb := ShardHeartbeat{
 						Load:        load,
 						ContainerId: ss.opts.container.Id(),
+						Stats:       ss.keeper.LoadStats(id, load),
+						MoveCost:    ss.keeper.MoveCost(id),
 					}
 					hb.Timestamp = time.Now().Unix()
 
-					session := ss.opts.container.Session
+					backend := ss.opts.container.Backend()
+					session := ss.opts.container.BackendSession()
 
 					// lock: 失败场景打印日志，不影响其他shard的heartbeat
-					lockPfx := EtcdPathAppShardHbId(ss.opts.container.Service(), id)
-					mutex := concurrency.NewMutex(session, lockPfx)
-					if err := mutex.Lock(ss.opts.container.Client.Ctx()); err != nil {
-						if err == rpctypes.ErrLeaseNotFound {
+					lockPfx := ss.opts.container.EtcdPath().AppShardHbId(ss.opts.container.Service(), id)
+					dataPfx, err := backend.Lock(ss.opts.container.Client.Ctx(), session, lockPfx)
+					if err != nil {
+						if errors.Cause(err) == rpctypes.ErrLeaseNotFound {
 							ops.lg.Info(
 								"lock released",
 								zap.String("pfx", lockPfx),
@@ -279,8 +533,7 @@ func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 						return nil
 					}
 
-					dataPfx := fmt.Sprintf("%s/%x", lockPfx, session.Lease())
-					if _, err := ss.opts.container.Client.Put(ctx, dataPfx, hb.String(), clientv3.WithLease(session.Lease())); err != nil {
+					if err := backend.PutEphemeral(ctx, session, dataPfx, hb.String()); err != nil {
 						ops.lg.Error(
 							"put error",
 							zap.String("pfx", dataPfx),
@@ -305,7 +558,7 @@ func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 				"shardserver: stopper closed",
 				zap.String("service", ss.opts.container.Service()),
 			)
-		case <-ss.opts.container.Session.Done():
+		case <-ss.opts.container.SessionDone():
 			ss.close()
 
 			ss.opts.lg.Info(
@@ -315,6 +568,15 @@ func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 		}
 	}()
 
+	// watch模式通过etcd接收shard，不需要挂接口和启动webserver
+	if ops.watch {
+		if err := ss.watchAssignment(); err != nil {
+			ss.close()
+			return nil, errors.Wrap(err, "")
+		}
+		return &ss, nil
+	}
+
 	router := ops.router
 	if ops.router == nil {
 		router = gin.Default()
@@ -347,6 +609,18 @@ func NewShardServer(opts ...ShardServerOption) (*ShardServer, error) {
 		{
 			ssg.POST("/add-shard", receiver.AddShard)
 			ssg.POST("/drop-shard", receiver.DropShard)
+			ssg.GET("/health", ss.Health)
+			if chaos.Enabled {
+				ssg.GET("/chaos", ginChaos)
+				ssg.POST("/set-chaos", ginSetChaos)
+			}
+		}
+	}
+
+	if ops.grpcAddr != "" {
+		if err := ss.serveGrpc(); err != nil {
+			ss.close()
+			return nil, errors.Wrap(err, "")
 		}
 	}
 
@@ -397,6 +671,13 @@ func (ss *ShardServer) close() {
 		return
 	}
 
+	// session丢失时shard已经不属于当前container，先通知业务的goroutine退出
+	ss.keeper.cancelShards()
+
+	// 先停止接收新的请求，等待进行中的add/drop完成，避免shard在drop之后又被add进来
+	ss.shutdown()
+	ss.stopGrpc()
+
 	// 保证shard回收的手段，允许调用方启动for不断尝试重新加入存活container中
 	// FIXME session会触发drop动作，不允许失败，但也是潜在风险，一般的sdk使用者，不了解close的机制
 	dropFn := func(k, v []byte) error {
@@ -412,20 +693,6 @@ func (ss *ShardServer) close() {
 	}
 	ss.keeper.Close()
 
-	if ss.srv != nil {
-		if err := ss.srv.Shutdown(context.TODO()); err != nil {
-			ss.opts.lg.Error(
-				"Shutdown error",
-				zap.Error(err),
-				zap.String("service", ss.opts.container.Service()),
-			)
-		} else {
-			ss.opts.lg.Info(
-				"Shutdown success",
-				zap.String("service", ss.opts.container.Service()),
-			)
-		}
-	}
 	if ss.stopper != nil {
 		ss.stopper.Close()
 	}
@@ -437,6 +704,126 @@ func (ss *ShardServer) close() {
 	)
 }
 
+// shutdown 关闭listener和空闲连接，等待进行中的请求完成，超时后强制关闭剩余连接
+func (ss *ShardServer) shutdown() {
+	if ss.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ss.opts.shutdownTimeout)
+	defer cancel()
+	if err := ss.srv.Shutdown(ctx); err != nil {
+		ss.opts.lg.Error(
+			"Shutdown error, force close",
+			zap.Error(err),
+			zap.String("service", ss.opts.container.Service()),
+			zap.Duration("timeout", ss.opts.shutdownTimeout),
+		)
+		_ = ss.srv.Close()
+		return
+	}
+	ss.opts.lg.Info(
+		"Shutdown success",
+		zap.String("service", ss.opts.container.Service()),
+	)
+}
+
+// watchAssignment watch模式下，从etcd的assignment节点接收sm下发的shard，节点删除即drop
+func (ss *ShardServer) watchAssignment() error {
+	pfx := ss.opts.container.EtcdPath().AppAssignment(ss.opts.container.Service(), ss.opts.container.Id()) + "/"
+	resp, err := ss.opts.container.Client.Get(context.TODO(), pfx, clientv3.WithPrefix())
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	for _, kv := range resp.Kvs {
+		if err := ss.onAssignment(mvccpb.PUT, kv); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	startRev := resp.Header.Revision + 1
+
+	ss.stopper.Wrap(func(ctx context.Context) {
+		WatchLoop(
+			ctx,
+			ss.opts.lg,
+			ss.opts.container.Client,
+			pfx,
+			startRev,
+			func(ctx context.Context, ev *clientv3.Event) error {
+				return ss.onAssignment(ev.Type, ev.Kv)
+			},
+		)
+	})
+	return nil
+}
+
+func (ss *ShardServer) onAssignment(typ mvccpb.Event_EventType, kv *mvccpb.KeyValue) error {
+	id := path.Base(string(kv.Key))
+	if typ == mvccpb.DELETE {
+		if err := ss.keeper.Drop(id); err != nil {
+			return errors.Wrap(err, "")
+		}
+		ss.opts.lg.Info(
+			"drop shard success",
+			zap.String("id", id),
+			zap.String("service", ss.opts.container.Service()),
+		)
+		return nil
+	}
+
+	var msg ShardMessage
+	if err := json.Unmarshal(kv.Value, &msg); err != nil {
+		// 内容不合法，重试没有意义，等待sm重新下发
+		ss.opts.lg.Error(
+			"Unmarshal err",
+			zap.ByteString("value", kv.Value),
+			zap.Error(err),
+		)
+		return nil
+	}
+	if msg.Spec == nil {
+		ss.opts.lg.Error("empty spec", zap.ByteString("value", kv.Value))
+		return nil
+	}
+	if err := msg.Spec.Validate(); err != nil {
+		ss.opts.lg.Error(
+			"Validate err",
+			zap.Reflect("msg", msg),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	ctx, span := Tracer().Start(msg.TraceContext.Extract(context.Background()), "ShardServer.onAssignment")
+	defer span.End()
+	span.SetAttributes(attribute.String("shardId", id))
+	if err := ss.admit(ctx, id, msg.Spec); err != nil {
+		span.RecordError(err)
+		if _, ok := IsShardRefusal(err); ok {
+			// 删除assignment节点，sm通过refusal节点得知后分配给其他container
+			if _, err := ss.opts.container.Client.Delete(ctx, string(kv.Key)); err != nil {
+				return errors.Wrap(err, "")
+			}
+			return nil
+		}
+		return errors.Wrap(err, "")
+	}
+	if err := ss.keeper.Add(ctx, id, msg.Spec); err != nil {
+		span.RecordError(err)
+		return errors.Wrap(err, "")
+	}
+	ss.opts.lg.Info(
+		"add shard success",
+		zap.Reflect("msg", msg),
+	)
+	return nil
+}
+
+// ShardContext 返回当前container持有的shard的context，shard被drop或者session丢失时取消，
+// 没有持有的shard返回已经取消的context
+func (ss *ShardServer) ShardContext(id string) context.Context {
+	return ss.keeper.shardContext(id)
+}
+
 func (ss *ShardServer) Done() <-chan struct{} {
 	return ss.donec
 }
@@ -449,16 +836,21 @@ func (ss *ShardServer) Container() *Container {
 type ShardMessage struct {
 	Id   string     `json:"id"`
 	Spec *ShardSpec `json:"spec"`
+
+	// TraceContext sm下发shard的span，watch模式没有http header，通过这个字段传递
+	TraceContext TraceContext `json:"traceContext,omitempty"`
 }
 
-func (ss *ShardServer) AddShard(c *gin.Context) {
-	var req ShardMessage
-	if err := c.ShouldBind(&req); err != nil {
-		ss.opts.lg.Error("ShouldBind err", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+// Health sm的leader探测container是否能正常处理请求，etcd的lease正常不代表进程正常
+func (ss *ShardServer) Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{})
+}
 
+// checkShardMessage http和grpc的add共用，校验shard属性和指定的container
+func (ss *ShardServer) checkShardMessage(req *ShardMessage) error {
+	if req.Spec == nil {
+		return errors.New("empty spec")
+	}
 	// shard属性校验
 	if err := req.Spec.Validate(); err != nil {
 		ss.opts.lg.Error(
@@ -466,8 +858,7 @@ func (ss *ShardServer) AddShard(c *gin.Context) {
 			zap.Reflect("req", req),
 			zap.Error(err),
 		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+		return err
 	}
 
 	// container校验
@@ -479,11 +870,44 @@ func (ss *ShardServer) AddShard(c *gin.Context) {
 			zap.String("actual", ss.opts.container.Id()),
 			zap.String("expect", req.Spec.ManualContainerId),
 		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "unexpected container"})
+		return errors.New("unexpected container")
+	}
+	return nil
+}
+
+func (ss *ShardServer) AddShard(c *gin.Context) {
+	ctx, span := Tracer().Start(ExtractTraceHeader(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header)), "ShardServer.AddShard")
+	defer span.End()
+
+	var req ShardMessage
+	if err := c.ShouldBind(&req); err != nil {
+		ss.opts.lg.Error("ShouldBind err", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ss.checkShardMessage(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := ss.keeper.Add(req.Id, req.Spec); err != nil {
+	span.SetAttributes(attribute.String("shardId", req.Id))
+	if err := ss.admit(ctx, req.Id, req.Spec); err != nil {
+		span.RecordError(err)
+		if refusal, ok := IsShardRefusal(err); ok {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": ShardRefusedCode, "reason": refusal.Reason})
+			return
+		}
+		ss.opts.lg.Error(
+			"admit err",
+			zap.Reflect("req", req),
+			zap.Error(err),
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ss.keeper.Add(ctx, req.Id, req.Spec); err != nil {
+		span.RecordError(err)
 		ss.opts.lg.Error(
 			"Add err",
 			zap.Reflect("req", req),
@@ -502,6 +926,9 @@ func (ss *ShardServer) AddShard(c *gin.Context) {
 }
 
 func (ss *ShardServer) DropShard(c *gin.Context) {
+	_, span := Tracer().Start(ExtractTraceHeader(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header)), "ShardServer.DropShard")
+	defer span.End()
+
 	var req ShardMessage
 	if err := c.ShouldBind(&req); err != nil {
 		ss.opts.lg.Error(
@@ -512,7 +939,9 @@ func (ss *ShardServer) DropShard(c *gin.Context) {
 		return
 	}
 
+	span.SetAttributes(attribute.String("shardId", req.Id))
 	if err := ss.keeper.Drop(req.Id); err != nil {
+		span.RecordError(err)
 		ss.opts.lg.Error(
 			"Drop err",
 			zap.Error(err),
@@ -3,6 +3,8 @@ package apputil
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
@@ -169,3 +171,90 @@ func TestShardServer_Api(t *testing.T) {
 	time.Sleep(60 * time.Second)
 	ss.Close()
 }
+
+func Test_ReplicaShardId(t *testing.T) {
+	var tests = []struct {
+		shardId string
+		replica int
+		expect  string
+	}{
+		{shardId: "s1", replica: 0, expect: "s1"},
+		{shardId: "s1", replica: 2, expect: "s1#2"},
+		{shardId: "a#b", replica: 1, expect: "a#b#1"},
+	}
+	for idx, tt := range tests {
+		id := ReplicaShardId(tt.shardId, tt.replica)
+		if id != tt.expect {
+			t.Errorf("idx %d expect %s actual %s", idx, tt.expect, id)
+			t.SkipNow()
+		}
+		shardId, replica := ParseReplicaShardId(id)
+		if shardId != tt.shardId || replica != tt.replica {
+			t.Errorf("idx %d parse err, shardId %s replica %d", idx, shardId, replica)
+			t.SkipNow()
+		}
+	}
+
+	// 不符合副本格式的id原样返回
+	shardId, replica := ParseReplicaShardId("a#b")
+	if shardId != "a#b" || replica != 0 {
+		t.Errorf("unexpected shardId %s replica %d", shardId, replica)
+	}
+}
+
+func Test_ValidateShardId(t *testing.T) {
+	if err := ValidateShardId("s1"); err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+	for _, id := range []string{"", "foo#2", "a#b"} {
+		if err := ValidateShardId(id); err == nil {
+			t.Errorf("expect err for %q", id)
+		}
+	}
+}
+
+func TestShardServer_shutdown(t *testing.T) {
+	var tests = []struct {
+		timeout   time.Duration
+		expectErr bool
+	}{
+		// 进行中的请求在超时前完成
+		{timeout: 2 * time.Second, expectErr: false},
+		// 超时后强制断开连接
+		{timeout: 50 * time.Millisecond, expectErr: true},
+	}
+	for idx, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Errorf("err: %v", err)
+			t.SkipNow()
+		}
+		startc := make(chan struct{})
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(startc)
+			time.Sleep(500 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		})}
+		go srv.Serve(ln)
+
+		ss := ShardServer{
+			srv:  srv,
+			opts: &shardServerOptions{lg: ttLogger, container: &Container{}, shutdownTimeout: tt.timeout},
+		}
+		errc := make(chan error, 1)
+		go func() {
+			resp, err := http.Get("http://" + ln.Addr().String())
+			if err == nil {
+				resp.Body.Close()
+			}
+			errc <- err
+		}()
+		<-startc
+		ss.shutdown()
+
+		if err := <-errc; (err != nil) != tt.expectErr {
+			t.Errorf("idx %d expectErr %v actual %v", idx, tt.expectErr, err)
+			t.SkipNow()
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/zd3tl/evtrigger"
 	bolt "go.etcd.io/bbolt"
 	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -22,6 +23,9 @@ const (
 	dropTrigger = "dropTrigger"
 
 	defaultSyncInterval = time.Second
+
+	// defaultDbPath 本地存储shard的boltdb文件
+	defaultDbPath = "shard.db"
 )
 
 // shardKeeper 参考raft中log replication节点的实现机制，记录日志到boltdb，开goroutine异步下发指令给调用方
@@ -39,13 +43,27 @@ type shardKeeper struct {
 
 	// 以下字段从ShardServer初始化
 	service   string
+	etcdPath  *EtcdPath
 	shardImpl ShardInterface
+	taskKey   []byte
 	client    etcdutil.EtcdWrapper
 	session   *concurrency.Session
 
 	// Unlock保证使用的相同mutex，否则myKey设定不上
 	mu           sync.Mutex
 	shardMutexes map[string]*concurrency.Mutex
+
+	// ctxMu 保护shardCtxs，ctx是所有shard context的parent，Close时取消
+	ctxMu     sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	shardCtxs map[string]*shardContext
+}
+
+// shardContext shard下发给调用方时创建，drop时取消
+type shardContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type shardKeeperTriggerValue struct {
@@ -65,6 +83,9 @@ type shardKeeperDbValue struct {
 
 	// Drop 软删除，在异步协程中清理
 	Drop bool `json:"drop"`
+
+	// TraceContext 异步下发给调用方时，继续sm下发shard的trace
+	TraceContext TraceContext `json:"traceContext,omitempty"`
 }
 
 func (v *shardKeeperDbValue) String() string {
@@ -78,14 +99,22 @@ func newShardKeeper(lg *zap.Logger, ss *ShardServer) (*shardKeeper, error) {
 		stopper: &GoroutineStopper{},
 
 		service:   ss.Container().Service(),
+		etcdPath:  ss.Container().EtcdPath(),
 		shardImpl: ss.opts.impl,
+		taskKey:   ss.opts.taskKey,
 		client:    ss.Container().Client,
 		session:   ss.Container().Session,
 
 		shardMutexes: make(map[string]*concurrency.Mutex),
+		shardCtxs:    make(map[string]*shardContext),
 	}
+	sk.ctx, sk.cancel = context.WithCancel(context.Background())
 
-	db, err := bolt.Open("shard.db", 0600, nil)
+	dbPath := ss.opts.dbPath
+	if dbPath == "" {
+		dbPath = defaultDbPath
+	}
+	db, err := bolt.Open(dbPath, 0600, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
@@ -112,7 +141,7 @@ func newShardKeeper(lg *zap.Logger, ss *ShardServer) (*shardKeeper, error) {
 			return err
 		}
 		// 使用shardImpl还是lk.Add要区分清楚，forEach中如果有boltdb访问会block
-		return sk.shardImpl.Add(string(k), value.Spec)
+		return sk.add(string(k), value.Spec)
 	}
 	if err := sk.forEach(initFn); err != nil {
 		return nil, errors.Wrap(err, "")
@@ -134,10 +163,12 @@ func newShardKeeper(lg *zap.Logger, ss *ShardServer) (*shardKeeper, error) {
 	return &sk, nil
 }
 
-func (sk *shardKeeper) Add(id string, spec *ShardSpec) error {
+func (sk *shardKeeper) Add(ctx context.Context, id string, spec *ShardSpec) error {
 	value := &shardKeeperDbValue{
 		Spec: spec,
 		Disp: false,
+
+		TraceContext: InjectTraceContext(ctx),
 	}
 	err := sk.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(sk.service))
@@ -177,6 +208,42 @@ func (sk *shardKeeper) Load(id string) (string, error) {
 	return sk.shardImpl.Load(id)
 }
 
+// LoadStats 优先使用 ShardLoadReporter，否则尝试从 Load 返回的字符串中解析
+func (sk *shardKeeper) LoadStats(id string, load string) *ShardLoad {
+	reporter, ok := sk.shardImpl.(ShardLoadReporter)
+	if !ok {
+		return ParseShardLoad(load)
+	}
+	stats, err := reporter.LoadStats(id)
+	if err != nil {
+		sk.lg.Error(
+			"call LoadStats error",
+			zap.String("id", id),
+			zap.Error(err),
+		)
+		return nil
+	}
+	return stats
+}
+
+// MoveCost 没有实现 ShardMoveCostReporter 或者出错时返回0，使用spec中的值
+func (sk *shardKeeper) MoveCost(id string) int64 {
+	reporter, ok := sk.shardImpl.(ShardMoveCostReporter)
+	if !ok {
+		return 0
+	}
+	cost, err := reporter.MoveCost(id)
+	if err != nil {
+		sk.lg.Error(
+			"call MoveCost error",
+			zap.String("id", id),
+			zap.Error(err),
+		)
+		return 0
+	}
+	return cost
+}
+
 func (sk *shardKeeper) forEach(visitor func(k, v []byte) error) error {
 	return sk.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(sk.service))
@@ -217,6 +284,7 @@ func (sk *shardKeeper) sync() error {
 }
 
 func (sk *shardKeeper) Close() {
+	sk.cancelShards()
 	sk.stopper.Close()
 	sk.trigger.Close()
 	_ = sk.db.Close()
@@ -226,6 +294,71 @@ func (sk *shardKeeper) Close() {
 	)
 }
 
+// add boltdb中保存加密的task，下发给调用方时才解密
+func (sk *shardKeeper) add(shardId string, spec *ShardSpec) error {
+	if spec != nil && TaskEncrypted(spec.Task) {
+		task, err := DecryptTask(sk.taskKey, spec.Task)
+		if err != nil {
+			return errors.Wrapf(err, "shardId: %s", shardId)
+		}
+		decrypted := *spec
+		decrypted.Task = task
+		spec = &decrypted
+	}
+
+	ctx := sk.newShardContext(shardId)
+	var err error
+	if adder, ok := sk.shardImpl.(ShardContextAdder); ok {
+		err = adder.AddWithContext(ctx, shardId, spec)
+	} else {
+		err = sk.shardImpl.Add(shardId, spec)
+	}
+	if err != nil && err != ErrExist {
+		sk.cancelShard(shardId)
+	}
+	return err
+}
+
+// newShardContext 已经存在时返回现有的context，重复下发不影响业务的goroutine
+func (sk *shardKeeper) newShardContext(shardId string) context.Context {
+	sk.ctxMu.Lock()
+	defer sk.ctxMu.Unlock()
+	if sc, ok := sk.shardCtxs[shardId]; ok && sc.ctx.Err() == nil {
+		return sc.ctx
+	}
+	ctx, cancel := context.WithCancel(sk.ctx)
+	sk.shardCtxs[shardId] = &shardContext{ctx: ctx, cancel: cancel}
+	return ctx
+}
+
+func (sk *shardKeeper) shardContext(shardId string) context.Context {
+	sk.ctxMu.Lock()
+	defer sk.ctxMu.Unlock()
+	if sc, ok := sk.shardCtxs[shardId]; ok {
+		return sc.ctx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func (sk *shardKeeper) cancelShard(shardId string) {
+	sk.ctxMu.Lock()
+	defer sk.ctxMu.Unlock()
+	if sc, ok := sk.shardCtxs[shardId]; ok {
+		sc.cancel()
+		delete(sk.shardCtxs, shardId)
+	}
+}
+
+// cancelShards session丢失或者关闭时取消所有shard的context
+func (sk *shardKeeper) cancelShards() {
+	sk.ctxMu.Lock()
+	defer sk.ctxMu.Unlock()
+	sk.cancel()
+	sk.shardCtxs = make(map[string]*shardContext)
+}
+
 func (sk *shardKeeper) Dispatch(typ string, value interface{}) error {
 	tv := value.(*shardKeeperTriggerValue)
 	shardId := tv.shardId
@@ -240,7 +373,13 @@ func (sk *shardKeeper) Dispatch(typ string, value interface{}) error {
 		// 有lock的前提下，下发boltdb中的分片给调用方，这里存在异常情况：
 		// 1 lock失效，并已经下发给调用方，此处逻辑以boltdb中的shard为准，lock失效会触发shardKeeper的Close，
 		spec := tv.Spec
-		opErr = sk.shardImpl.Add(shardId, spec)
+		_, span := Tracer().Start(tv.TraceContext.Extract(context.Background()), "ShardInterface.Add")
+		span.SetAttributes(attribute.String("shardId", shardId), attribute.String("service", sk.service))
+		opErr = sk.add(shardId, spec)
+		if opErr != nil && opErr != ErrExist {
+			span.RecordError(opErr)
+		}
+		span.End()
 		if opErr == nil || opErr == ErrExist {
 			// 下发成功后更新boltdb
 			tv.Disp = true
@@ -259,6 +398,8 @@ func (sk *shardKeeper) Dispatch(typ string, value interface{}) error {
 			return nil
 		}
 	case dropTrigger:
+		// 先取消context，业务的goroutine和Drop同时开始退出
+		sk.cancelShard(shardId)
 		opErr = sk.shardImpl.Drop(shardId)
 		if opErr == nil || opErr == ErrNotExist {
 			if err := sk.unlock(shardId); err != nil {
@@ -304,7 +445,7 @@ func (sk *shardKeeper) lock(shardId string) error {
 	sk.mu.Lock()
 	defer sk.mu.Unlock()
 
-	lockPfx := EtcdPathAppShardHbId(sk.service, shardId)
+	lockPfx := sk.etcdPath.AppShardHbId(sk.service, shardId)
 	mutex := concurrency.NewMutex(sk.session, lockPfx)
 	if err := mutex.Lock(sk.client.Ctx()); err != nil {
 		// lock被占用
@@ -332,6 +473,60 @@ func (sk *shardKeeper) lock(shardId string) error {
 	return nil
 }
 
+// relock session重建后用新的session重新获取本地shard的lock，session丢失期间被其他container获取的shard从本地删除并drop，
+// 返回被drop的shard
+func (sk *shardKeeper) relock(s *concurrency.Session) ([]string, error) {
+	var ids []string
+	if err := sk.forEach(func(k, v []byte) error {
+		ids = append(ids, string(k))
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	sk.mu.Lock()
+	sk.session = s
+	sk.shardMutexes = make(map[string]*concurrency.Mutex)
+	sk.mu.Unlock()
+
+	var lost []string
+	for _, shardId := range ids {
+		lockPfx := sk.etcdPath.AppShardHbId(sk.service, shardId)
+		mutex := concurrency.NewMutex(s, lockPfx)
+		err := mutex.TryLock(sk.client.Ctx())
+		if err == nil {
+			sk.mu.Lock()
+			sk.shardMutexes[shardId] = mutex
+			sk.mu.Unlock()
+			continue
+		}
+		if err != concurrency.ErrLocked {
+			return lost, errors.Wrapf(err, "pfx: %s", lockPfx)
+		}
+
+		// 先从boltdb删除，heartbeat不会再尝试获取这个lock
+		if err := sk.delete(shardId); err != nil {
+			return lost, errors.Wrapf(err, "shardId: %s", shardId)
+		}
+		sk.cancelShard(shardId)
+		if err := sk.shardImpl.Drop(shardId); err != nil && err != ErrNotExist {
+			sk.lg.Error(
+				"drop lost shard error",
+				zap.String("service", sk.service),
+				zap.String("shardId", shardId),
+				zap.Error(err),
+			)
+		}
+		sk.lg.Warn(
+			"shard locked by other container after session recovery, dropped",
+			zap.String("service", sk.service),
+			zap.String("shardId", shardId),
+		)
+		lost = append(lost, shardId)
+	}
+	return lost, nil
+}
+
 func (sk *shardKeeper) unlock(shardId string) error {
 	sk.mu.Lock()
 	defer sk.mu.Unlock()
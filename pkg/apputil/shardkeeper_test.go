@@ -1,18 +1,21 @@
 package apputil
 
 import (
+	"context"
 	"fmt"
 	"go.uber.org/zap"
+	"path/filepath"
 	"testing"
 
 	bolt "go.etcd.io/bbolt"
 )
 
-func testNewDb(bucket string) (*bolt.DB, error) {
-	db, err := bolt.Open("debug.db", 0600, nil)
+func testNewDb(t *testing.T, bucket string) (*bolt.DB, error) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "debug.db"), 0600, nil)
 	if err != nil {
 		return nil, err
 	}
+	t.Cleanup(func() { _ = db.Close() })
 	if err := db.Update(
 		func(tx *bolt.Tx) error {
 			_ = tx.DeleteBucket([]byte(bucket))
@@ -27,8 +30,8 @@ func testNewDb(bucket string) (*bolt.DB, error) {
 
 func Test_shardKeeper_Add(t *testing.T) {
 	sk := shardKeeper{service: "test"}
-	sk.db, _ = testNewDb(sk.service)
-	if err := sk.Add("foo", &ShardSpec{Service: "bar"}); err != nil {
+	sk.db, _ = testNewDb(t, sk.service)
+	if err := sk.Add(context.TODO(), "foo", &ShardSpec{Service: "bar"}); err != nil {
 		t.Error(err)
 		t.SkipNow()
 	}
@@ -36,7 +39,7 @@ func Test_shardKeeper_Add(t *testing.T) {
 
 func Test_shardKeeper_Drop(t *testing.T) {
 	sk := shardKeeper{service: "test"}
-	sk.db, _ = testNewDb(sk.service)
+	sk.db, _ = testNewDb(t, sk.service)
 
 	key := "foo"
 
@@ -58,7 +61,7 @@ func Test_shardKeeper_Drop(t *testing.T) {
 
 func Test_shardKeeper_forEach(t *testing.T) {
 	sk := shardKeeper{service: "test"}
-	sk.db, _ = testNewDb(sk.service)
+	sk.db, _ = testNewDb(t, sk.service)
 
 	sk.db.Update(
 		func(tx *bolt.Tx) error {
@@ -84,7 +87,7 @@ func Test_shardKeeper_forEach(t *testing.T) {
 
 func Test_shardKeeper_sync(t *testing.T) {
 	sk := shardKeeper{service: "test"}
-	sk.db, _ = testNewDb(sk.service)
+	sk.db, _ = testNewDb(t, sk.service)
 
 	sk.db.Update(
 		func(tx *bolt.Tx) error {
@@ -110,10 +113,72 @@ func Test_shardKeeper_sync(t *testing.T) {
 func Test_shardKeeper_Dispatch(t *testing.T) {
 	lg, _ := zap.NewDevelopment()
 	sk := shardKeeper{lg: lg, service: "test", shardImpl: &testShardImpl{}}
-	sk.db, _ = testNewDb(sk.service)
+	sk.db, _ = testNewDb(t, sk.service)
 	value := shardKeeperTriggerValue{shardId: "foo", shardKeeperDbValue: shardKeeperDbValue{}}
 	if err := sk.Dispatch(dropTrigger, &value); err != nil {
 		t.Error(err)
 		t.SkipNow()
 	}
 }
+
+type testContextShardImpl struct {
+	testShardImpl
+
+	ctxs map[string]context.Context
+}
+
+func (impl *testContextShardImpl) AddWithContext(ctx context.Context, id string, spec *ShardSpec) error {
+	impl.ctxs[id] = ctx
+	return nil
+}
+
+func Test_shardKeeper_shardContext(t *testing.T) {
+	lg, _ := zap.NewDevelopment()
+	impl := &testContextShardImpl{ctxs: make(map[string]context.Context)}
+	sk := shardKeeper{lg: lg, service: "test", shardImpl: impl, shardCtxs: make(map[string]*shardContext)}
+	sk.ctx, sk.cancel = context.WithCancel(context.Background())
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "context.db"), 0600, nil)
+	if err != nil {
+		t.Error(err)
+		t.SkipNow()
+	}
+	defer db.Close()
+	_ = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(sk.service))
+		return err
+	})
+	sk.db = db
+
+	for _, id := range []string{"s1", "s2"} {
+		if err := sk.add(id, &ShardSpec{}); err != nil {
+			t.Error(err)
+			t.SkipNow()
+		}
+	}
+	if impl.ctxs["s1"] != sk.shardContext("s1") || impl.ctxs["s1"].Err() != nil {
+		t.Error("expect alive context")
+		t.SkipNow()
+	}
+	// 不属于当前container的shard返回取消的context
+	if sk.shardContext("s3").Err() == nil {
+		t.Error("expect canceled context for unknown shard")
+		t.SkipNow()
+	}
+
+	// drop只取消对应shard的context
+	value := shardKeeperTriggerValue{shardId: "s1", shardKeeperDbValue: shardKeeperDbValue{}}
+	if err := sk.Dispatch(dropTrigger, &value); err != nil {
+		t.Error(err)
+		t.SkipNow()
+	}
+	if impl.ctxs["s1"].Err() == nil || impl.ctxs["s2"].Err() != nil {
+		t.Error("expect only s1 canceled")
+		t.SkipNow()
+	}
+
+	// session丢失或者关闭时全部取消
+	sk.cancelShards()
+	if impl.ctxs["s2"].Err() == nil {
+		t.Error("expect s2 canceled")
+	}
+}
@@ -16,9 +16,23 @@ package apputil
 
 import (
 	"context"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// stopperGoroutines 进程中所有 GoroutineStopper 管理的正在运行的goroutine数量，排查goroutine泄漏使用
+var stopperGoroutines int64
+
+// StopperGoroutines 返回进程中通过 GoroutineStopper 启动且没有退出的goroutine数量
+func StopperGoroutines() int64 {
+	return atomic.LoadInt64(&stopperGoroutines)
+}
+
 // GoroutineStopper 提出container和shard的公共属性
 // 抽象数据结构，也会引入数据结构之间的耦合
 type GoroutineStopper struct {
@@ -30,27 +44,170 @@ type GoroutineStopper struct {
 	cancel context.CancelFunc
 
 	wg sync.WaitGroup
+
+	// running 正在运行的goroutine数量
+	running int64
+
+	// name 出现在 Goroutines 的结果中，子stopper的名称带上父stopper的名称
+	name   string
+	parent *GoroutineStopper
+
+	mu sync.Mutex
+	// children 通过 NewChild 创建且没有Close的子stopper，父stopper Close时先停止子stopper
+	children map[*GoroutineStopper]struct{}
+	// goroutines 正在运行的goroutine
+	goroutines map[int64]*GoroutineInfo
+	seq        int64
+}
+
+// GoroutineInfo 通过 GoroutineStopper 启动且没有退出的goroutine
+type GoroutineInfo struct {
+	// Name WrapNamed 指定的名称，Wrap 使用函数名
+	Name string `json:"name"`
+	// Stopper 所属stopper的名称，子stopper用 / 连接父stopper的名称
+	Stopper   string    `json:"stopper,omitempty"`
+	StartTime time.Time `json:"startTime"`
 }
 
 type StopableFunc func(ctx context.Context)
 
-func (stopper *GoroutineStopper) Wrap(fn StopableFunc) {
+// NewGoroutineStopper 创建带名称的stopper，零值的 GoroutineStopper 同样可以使用
+func NewGoroutineStopper(name string) *GoroutineStopper {
+	return &GoroutineStopper{name: name}
+}
+
+func (stopper *GoroutineStopper) init() {
 	stopper.once.Do(func() {
-		// 不需要外部ctx
-		stopper.ctx, stopper.cancel = context.WithCancel(context.TODO())
+		// 不需要外部ctx，子stopper跟随父stopper退出
+		parent := context.TODO()
+		if stopper.parent != nil {
+			stopper.parent.init()
+			parent = stopper.parent.ctx
+		}
+		stopper.ctx, stopper.cancel = context.WithCancel(parent)
 	})
+}
+
+// NewChild 创建子stopper，父stopper Close时子stopper中的goroutine一起退出，
+// 子stopper可以单独Close，不影响父stopper。stopper为nil时返回独立的stopper
+func (stopper *GoroutineStopper) NewChild(name string) *GoroutineStopper {
+	if stopper == nil {
+		return NewGoroutineStopper(name)
+	}
+	stopper.init()
+
+	child := &GoroutineStopper{name: name, parent: stopper}
+	stopper.mu.Lock()
+	defer stopper.mu.Unlock()
+	if stopper.children == nil {
+		stopper.children = make(map[*GoroutineStopper]struct{})
+	}
+	stopper.children[child] = struct{}{}
+	return child
+}
+
+func (stopper *GoroutineStopper) Wrap(fn StopableFunc) {
+	stopper.WrapNamed(funcName(fn), fn)
+}
+
+// WrapNamed 和 Wrap 相同，name 用来在 Goroutines 中区分匿名函数启动的goroutine
+func (stopper *GoroutineStopper) WrapNamed(name string, fn StopableFunc) {
+	stopper.init()
+
+	stopper.mu.Lock()
+	if stopper.goroutines == nil {
+		stopper.goroutines = make(map[int64]*GoroutineInfo)
+	}
+	stopper.seq++
+	id := stopper.seq
+	stopper.goroutines[id] = &GoroutineInfo{Name: name, Stopper: stopper.path(), StartTime: time.Now()}
+	stopper.mu.Unlock()
 
 	stopper.wg.Add(1)
+	atomic.AddInt64(&stopper.running, 1)
+	atomic.AddInt64(&stopperGoroutines, 1)
 	go func(fn StopableFunc, ctx context.Context) {
 		defer stopper.wg.Done()
+		defer atomic.AddInt64(&stopperGoroutines, -1)
+		defer atomic.AddInt64(&stopper.running, -1)
+		defer func() {
+			stopper.mu.Lock()
+			delete(stopper.goroutines, id)
+			stopper.mu.Unlock()
+		}()
 
 		fn(ctx)
 	}(fn, stopper.ctx)
 }
 
+// Running 返回通过 Wrap 启动且没有退出的goroutine数量，不包含子stopper
+func (stopper *GoroutineStopper) Running() int64 {
+	return atomic.LoadInt64(&stopper.running)
+}
+
+// Goroutines 返回stopper和子stopper中正在运行的goroutine，按照启动时间排序
+func (stopper *GoroutineStopper) Goroutines() []GoroutineInfo {
+	if stopper == nil {
+		return nil
+	}
+	stopper.mu.Lock()
+	var r []GoroutineInfo
+	for _, info := range stopper.goroutines {
+		r = append(r, *info)
+	}
+	children := make([]*GoroutineStopper, 0, len(stopper.children))
+	for child := range stopper.children {
+		children = append(children, child)
+	}
+	stopper.mu.Unlock()
+
+	for _, child := range children {
+		r = append(r, child.Goroutines()...)
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].StartTime.Before(r[j].StartTime) })
+	return r
+}
+
 func (stopper *GoroutineStopper) Close() {
 	if stopper.cancel != nil {
 		stopper.cancel()
 	}
+
+	stopper.mu.Lock()
+	children := make([]*GoroutineStopper, 0, len(stopper.children))
+	for child := range stopper.children {
+		children = append(children, child)
+	}
+	stopper.mu.Unlock()
+	for _, child := range children {
+		child.Close()
+	}
+
 	stopper.wg.Wait()
+
+	if stopper.parent != nil {
+		stopper.parent.mu.Lock()
+		delete(stopper.parent.children, stopper)
+		stopper.parent.mu.Unlock()
+	}
+}
+
+// path 父stopper的名称在前，没有名称的stopper不出现
+func (stopper *GoroutineStopper) path() string {
+	var names []string
+	for s := stopper; s != nil; s = s.parent {
+		if s.name != "" {
+			names = append([]string{s.name}, names...)
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+// funcName 去掉包路径，例如 smserver.(*smShard).balanceLoop-fm
+func funcName(fn StopableFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	if idx := strings.LastIndex(name, "/"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return name
 }
@@ -18,8 +18,40 @@ func testFunc(ctx context.Context) {
 func Test_GoroutineStopper_Start(t *testing.T) {
 	gs := GoroutineStopper{}
 	gs.Wrap(testFunc)
+	if gs.Running() != 1 || StopperGoroutines() < 1 {
+		t.Errorf("unexpected running %d", gs.Running())
+	}
 
 	time.Sleep(5 * time.Second)
 	fmt.Println("call Close func")
 	gs.Close()
+	if gs.Running() != 0 {
+		t.Errorf("unexpected running %d after close", gs.Running())
+	}
+}
+
+func Test_GoroutineStopper_NewChild(t *testing.T) {
+	parent := NewGoroutineStopper("container")
+	parent.Wrap(func(ctx context.Context) { <-ctx.Done() })
+	child := parent.NewChild("service")
+	child.WrapNamed("balanceLoop", func(ctx context.Context) { <-ctx.Done() })
+
+	infos := parent.Goroutines()
+	if len(infos) != 2 || infos[1].Name != "balanceLoop" || infos[1].Stopper != "container/service" || infos[0].Stopper != "container" {
+		t.Fatalf("unexpected goroutines %+v", infos)
+	}
+
+	// 子stopper单独退出，父stopper不受影响
+	child.Close()
+	if child.Running() != 0 || parent.Running() != 1 || len(parent.Goroutines()) != 1 {
+		t.Fatalf("unexpected running after child close %+v", parent.Goroutines())
+	}
+
+	// 父stopper退出时子stopper一起退出
+	child = parent.NewChild("service")
+	child.Wrap(testFunc)
+	parent.Close()
+	if child.Running() != 0 || len(parent.Goroutines()) != 0 {
+		t.Errorf("unexpected running %d after parent close", child.Running())
+	}
 }
@@ -0,0 +1,119 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TaskKeyEnv 没有通过option指定时，从这个环境变量读取base64编码的task加密key
+	TaskKeyEnv = "SM_TASK_KEY"
+
+	// encryptedTaskPrefix 加密后的task前缀，没有前缀的task按照明文处理，兼容开启加密之前写入的shard
+	encryptedTaskPrefix = "enc:v1:"
+)
+
+// ValidateTaskKey AES-GCM的key长度只能是16、24或者32字节，分别对应AES-128、AES-192和AES-256
+func ValidateTaskKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return errors.Errorf("task key length %d should be 16, 24 or 32", len(key))
+}
+
+// TaskKeyFromEnv 环境变量没有设置时返回nil，代表不加密
+func TaskKeyFromEnv() ([]byte, error) {
+	v := os.Getenv(TaskKeyEnv)
+	if v == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %s", TaskKeyEnv)
+	}
+	if err := ValidateTaskKey(key); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return key, nil
+}
+
+// TaskEncrypted task是否已经加密
+func TaskEncrypted(task string) bool {
+	return strings.HasPrefix(task, encryptedTaskPrefix)
+}
+
+// EncryptTask 使用AES-GCM加密task，nonce放在密文之前一起做base64编码，空task和已经加密的task保持不变
+func EncryptTask(key []byte, task string) (string, error) {
+	if task == "" || TaskEncrypted(task) {
+		return task, nil
+	}
+	gcm, err := newTaskGCM(key)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(task), nil)
+	return encryptedTaskPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptTask 没有加密的task原样返回，加密的task没有key或者key不匹配时返回错误
+func DecryptTask(key []byte, task string) (string, error) {
+	if !TaskEncrypted(task) {
+		return task, nil
+	}
+	if key == nil {
+		return "", errors.New("task is encrypted but no task key provided")
+	}
+	gcm, err := newTaskGCM(key)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(task, encryptedTaskPrefix))
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted task too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Wrap(err, "decrypt task")
+	}
+	return string(plain), nil
+}
+
+func newTaskGCM(key []byte) (cipher.AEAD, error) {
+	if err := ValidateTaskKey(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,40 @@
+package apputil
+
+import (
+	"testing"
+)
+
+func Test_EncryptTask(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	enc, err := EncryptTask(key, `{"password": "secret"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !TaskEncrypted(enc) {
+		t.Errorf("expect encrypted task, actual %s", enc)
+	}
+	// 已经加密的task不会重复加密
+	if again, _ := EncryptTask(key, enc); again != enc {
+		t.Errorf("encrypted task should not be encrypted again")
+	}
+
+	plain, err := DecryptTask(key, enc)
+	if err != nil || plain != `{"password": "secret"}` {
+		t.Errorf("unexpected decrypt result %s %v", plain, err)
+	}
+
+	// 明文task原样返回
+	if plain, err := DecryptTask(nil, "foo"); err != nil || plain != "foo" {
+		t.Errorf("unexpected plain task %s %v", plain, err)
+	}
+	if _, err := DecryptTask(nil, enc); err == nil {
+		t.Errorf("expect error without key")
+	}
+	if _, err := DecryptTask([]byte("fedcba9876543210fedcba9876543210"), enc); err == nil {
+		t.Errorf("expect error with wrong key")
+	}
+	if _, err := EncryptTask([]byte("short"), "foo"); err == nil {
+		t.Errorf("expect key length error")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apputil
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName sm使用otel全局的TracerProvider，没有设置时span不会被采集
+const TracerName = "github.com/entertainment-venue/sm"
+
+// Tracer 4 sm server和 ShardServer 共用
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// traceContextPropagator 不依赖全局的propagator，保证没有初始化otel的container也能把trace传递下去
+var traceContextPropagator = propagation.TraceContext{}
+
+// TraceContext w3c trace context的载体，跟随shard在etcd、http以及boltdb之间传递，
+// 一次shard移动可以从api调用一直追踪到目标container的Add
+type TraceContext map[string]string
+
+// InjectTraceContext ctx中没有span时返回nil
+func InjectTraceContext(ctx context.Context) TraceContext {
+	carrier := propagation.MapCarrier{}
+	traceContextPropagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return TraceContext(carrier)
+}
+
+// Extract 把tc中的span作为ctx中的remote parent
+func (tc TraceContext) Extract(ctx context.Context) context.Context {
+	if len(tc) == 0 {
+		return ctx
+	}
+	return traceContextPropagator.Extract(ctx, propagation.MapCarrier(tc))
+}
+
+// SpanContext tc中没有span时返回无效的SpanContext
+func (tc TraceContext) SpanContext() trace.SpanContext {
+	return trace.SpanContextFromContext(tc.Extract(context.Background()))
+}
+
+// InjectTraceHeader http调用时传递trace
+func InjectTraceHeader(ctx context.Context, header propagation.HeaderCarrier) {
+	traceContextPropagator.Inject(ctx, header)
+}
+
+// ExtractTraceHeader 从http请求中提取trace
+func ExtractTraceHeader(ctx context.Context, header propagation.HeaderCarrier) context.Context {
+	return traceContextPropagator.Extract(ctx, header)
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chaos 集成测试使用的故障注入点，只有使用 -tags chaos 编译时生效，默认编译下所有注入点都是空操作，
+// 故障通过 Set、环境变量 SM_CHAOS（json格式的 Faults）或者sm和container的内部接口设置
+package chaos
+
+import (
+	"github.com/pkg/errors"
+)
+
+// EnvFaults 进程启动时注入的故障，覆盖leader竞选等接口还不可用的阶段
+const EnvFaults = "SM_CHAOS"
+
+var (
+	// ErrInjected 注入的失败，调用方按照普通错误处理
+	ErrInjected = errors.New("chaos: injected fault")
+
+	// ErrDisabled 没有使用 -tags chaos 编译
+	ErrDisabled = errors.New("chaos: built without chaos tag")
+)
+
+// Faults 注入的故障，零值表示不注入
+type Faults struct {
+	// EtcdWriteDropNth 设置故障后第N次etcd写入失败，0表示关闭
+	EtcdWriteDropNth int `json:"etcdWriteDropNth"`
+
+	// EtcdWriteDropRepeat 为true时每N次写入失败一次
+	EtcdWriteDropRepeat bool `json:"etcdWriteDropRepeat"`
+
+	// EtcdWriteKeyPrefix 只对key有该前缀的写入计数，为空时所有写入都计数
+	EtcdWriteKeyPrefix string `json:"etcdWriteKeyPrefix"`
+
+	// HeartbeatDelayMs container和shard每次上报heartbeat前等待的时间，单位毫秒，超过session ttl可以模拟container丢失
+	HeartbeatDelayMs int `json:"heartbeatDelayMs"`
+
+	// MoveFailRatio moveAction每次执行失败的比例，取值[0, 1]，1时所有move进入dead letter
+	MoveFailRatio float64 `json:"moveFailRatio"`
+
+	// Seed MoveFailRatio使用的随机数种子，种子和调用顺序相同时失败的move相同
+	Seed int64 `json:"seed"`
+}
+
+func (f *Faults) Validate() error {
+	if f.EtcdWriteDropNth < 0 {
+		return errors.New("etcdWriteDropNth err")
+	}
+	if f.HeartbeatDelayMs < 0 {
+		return errors.New("heartbeatDelayMs err")
+	}
+	if f.MoveFailRatio < 0 || f.MoveFailRatio > 1 {
+		return errors.New("moveFailRatio err")
+	}
+	return nil
+}
+
+// Stats 设置故障后注入点的计数
+type Stats struct {
+	EtcdWrites        int64 `json:"etcdWrites"`
+	EtcdWritesDropped int64 `json:"etcdWritesDropped"`
+	HeartbeatsDelayed int64 `json:"heartbeatsDelayed"`
+	Moves             int64 `json:"moves"`
+	MovesFailed       int64 `json:"movesFailed"`
+}
+
+// Status 当前进程的故障注入状态
+type Status struct {
+	Enabled bool   `json:"enabled"`
+	Faults  Faults `json:"faults"`
+	Stats   Stats  `json:"stats"`
+}
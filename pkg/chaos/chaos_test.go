@@ -0,0 +1,71 @@
+//go:build chaos
+// +build chaos
+
+package chaos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EtcdWrite(t *testing.T) {
+	defer Set(Faults{})
+
+	assert.Nil(t, Set(Faults{EtcdWriteDropNth: 2, EtcdWriteKeyPrefix: "/sm/app/foo"}))
+	assert.Nil(t, EtcdWrite("/sm/app/foo/a"))
+	assert.Nil(t, EtcdWrite("/sm/app/bar/a"))
+	assert.Equal(t, ErrInjected, errors.Cause(EtcdWrite("/sm/app/foo/b")))
+	assert.Nil(t, EtcdWrite("/sm/app/foo/c"))
+	assert.Equal(t, Stats{EtcdWrites: 4, EtcdWritesDropped: 1}, Get().Stats)
+
+	assert.Nil(t, Set(Faults{EtcdWriteDropNth: 2, EtcdWriteDropRepeat: true}))
+	var dropped int
+	for i := 0; i < 6; i++ {
+		if EtcdWrite("k") != nil {
+			dropped++
+		}
+	}
+	assert.Equal(t, 3, dropped)
+}
+
+func Test_MoveAction(t *testing.T) {
+	defer Set(Faults{})
+
+	run := func() []bool {
+		assert.Nil(t, Set(Faults{MoveFailRatio: 0.5, Seed: 7}))
+		var r []bool
+		for i := 0; i < 20; i++ {
+			r = append(r, MoveAction("s") != nil)
+		}
+		return r
+	}
+	first := run()
+	assert.Equal(t, first, run())
+	assert.Contains(t, first, true)
+	assert.Contains(t, first, false)
+
+	assert.Nil(t, Set(Faults{MoveFailRatio: 1}))
+	assert.NotNil(t, MoveAction("s"))
+	assert.NotNil(t, Set(Faults{MoveFailRatio: 2}))
+}
+
+func Test_DelayHeartbeat(t *testing.T) {
+	defer Set(Faults{})
+
+	assert.Nil(t, Set(Faults{HeartbeatDelayMs: 50}))
+	start := time.Now()
+	DelayHeartbeat(context.Background())
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	assert.Nil(t, Set(Faults{HeartbeatDelayMs: 60000}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	DelayHeartbeat(ctx)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int64(1), Get().Stats.HeartbeatsDelayed)
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !chaos
+// +build !chaos
+
+package chaos
+
+import "context"
+
+// Enabled 使用 -tags chaos 编译
+const Enabled = false
+
+func Set(_ Faults) error {
+	return ErrDisabled
+}
+
+func Get() *Status {
+	return &Status{}
+}
+
+func EtcdWrite(_ string) error {
+	return nil
+}
+
+func DelayHeartbeat(_ context.Context) {}
+
+func MoveAction(_ string) error {
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build chaos
+// +build chaos
+
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Enabled 使用 -tags chaos 编译
+const Enabled = true
+
+var state = struct {
+	mu     sync.Mutex
+	faults Faults
+	stats  Stats
+	rnd    *rand.Rand
+	// writes 符合 EtcdWriteKeyPrefix 的写入次数
+	writes int
+}{rnd: rand.New(rand.NewSource(0))}
+
+func init() {
+	v := os.Getenv(EnvFaults)
+	if v == "" {
+		return
+	}
+	var f Faults
+	if err := json.Unmarshal([]byte(v), &f); err != nil {
+		panic(fmt.Sprintf("%s err: %s", EnvFaults, err))
+	}
+	if err := Set(f); err != nil {
+		panic(fmt.Sprintf("%s err: %s", EnvFaults, err))
+	}
+}
+
+// Set 替换当前的故障，计数和随机数从头开始，Faults 零值清除所有故障
+func Set(f Faults) error {
+	if err := f.Validate(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.faults = f
+	state.stats = Stats{}
+	state.rnd = rand.New(rand.NewSource(f.Seed))
+	state.writes = 0
+	return nil
+}
+
+func Get() *Status {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return &Status{Enabled: true, Faults: state.faults, Stats: state.stats}
+}
+
+// EtcdWrite etcd写入前调用，返回错误时放弃本次写入
+func EtcdWrite(key string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.stats.EtcdWrites++
+	f := state.faults
+	if f.EtcdWriteDropNth == 0 || !strings.HasPrefix(key, f.EtcdWriteKeyPrefix) {
+		return nil
+	}
+	state.writes++
+	drop := state.writes == f.EtcdWriteDropNth
+	if f.EtcdWriteDropRepeat {
+		drop = state.writes%f.EtcdWriteDropNth == 0
+	}
+	if !drop {
+		return nil
+	}
+	state.stats.EtcdWritesDropped++
+	return errors.Wrapf(ErrInjected, "drop etcd write %s", key)
+}
+
+// DelayHeartbeat heartbeat上报前调用，ctx结束时提前返回
+func DelayHeartbeat(ctx context.Context) {
+	state.mu.Lock()
+	delay := time.Duration(state.faults.HeartbeatDelayMs) * time.Millisecond
+	if delay > 0 {
+		state.stats.HeartbeatsDelayed++
+	}
+	state.mu.Unlock()
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+}
+
+// MoveAction 每次执行moveAction前调用，返回错误时本次执行失败
+func MoveAction(shardId string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.stats.Moves++
+	if state.faults.MoveFailRatio <= 0 || state.rnd.Float64() >= state.faults.MoveFailRatio {
+		return nil
+	}
+	state.stats.MovesFailed++
+	return errors.Wrapf(ErrInjected, "fail move %s", shardId)
+}
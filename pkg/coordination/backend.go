@@ -0,0 +1,84 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package coordination sm依赖的协调存储的抽象，默认使用etcd，另外提供基于consul的实现，
+// shard的watch、任务队列和api还直接依赖etcd，迁移到接口之前sm仍然需要etcd
+package coordination
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSessionClosed = errors.New("coordination: session closed")
+	ErrLockHeld      = errors.New("coordination: lock held by other session")
+)
+
+type KeyValue struct {
+	Key   string
+	Value string
+
+	// Revision 节点最后一次修改时的版本
+	Revision int64
+}
+
+// Session 进程和后端之间的会话，会话失效后，通过会话写入的临时节点和持有的锁都会被清理
+type Session interface {
+	// Id 会话的唯一标识，etcd中是lease的16进制
+	Id() string
+
+	// Done 会话失效时关闭
+	Done() <-chan struct{}
+
+	Close() error
+}
+
+// LeaseSession 可以查询租约剩余时间的session，health检查使用，consul的session不支持
+type LeaseSession interface {
+	Session
+
+	// TTL 返回剩余的ttl和申请时的ttl，单位秒，租约已经过期时remaining<=0
+	TTL(ctx context.Context) (remaining int64, granted int64, err error)
+}
+
+// Backend nodeManager、leader竞选以及heartbeat使用的协调存储操作
+type Backend interface {
+	// Get 节点不存在时返回nil
+	Get(ctx context.Context, key string) (*KeyValue, error)
+	GetPrefix(ctx context.Context, prefix string) ([]*KeyValue, error)
+	Put(ctx context.Context, key string, value string) error
+	Delete(ctx context.Context, key string) error
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// NewSession ttl单位秒，会话需要后端自己续约
+	NewSession(ctx context.Context, ttl int) (Session, error)
+
+	// PutEphemeral 节点随session失效删除
+	PutEphemeral(ctx context.Context, s Session, key string, value string) error
+
+	// Lock 阻塞直到session持有key对应的锁，返回session在锁下的节点，heartbeat的数据写在这个节点，
+	// 同一个session重复调用直接返回
+	Lock(ctx context.Context, s Session, key string) (string, error)
+
+	// Campaign 阻塞直到当选leader，value是leader对外提供的信息
+	Campaign(ctx context.Context, s Session, key string, value string) error
+
+	// Resign session放弃通过 Campaign 获得的leader，等待中的其他session可以当选，session没有当选时直接返回
+	Resign(ctx context.Context, s Session, key string) error
+
+	// Leader 当前leader通过 Campaign 提供的value，没有leader时返回空
+	Leader(ctx context.Context, key string) (string, error)
+}
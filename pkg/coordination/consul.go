@@ -0,0 +1,367 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coordination
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// minConsulSessionTTL consul的session ttl不能小于10s
+	minConsulSessionTTL = 10
+
+	// defaultConsulWait 阻塞查询的最长等待时间
+	defaultConsulWait = "10s"
+
+	// defaultConsulLockPrefix 锁节点放在单独的目录下，不影响业务节点的前缀查询
+	defaultConsulLockPrefix = "sm-lock"
+)
+
+var (
+	_ Backend = new(consulBackend)
+	_ Session = new(consulSession)
+
+	errConsulNotFound = errors.New("consul: key not found")
+)
+
+// consulBackend 通过consul的http api实现，session使用delete行为，失效后通过session acquire的节点被删除，
+// 在consul中对应etcd的lease
+type consulBackend struct {
+	lg      *zap.Logger
+	address string
+	opts    *consulOptions
+
+	httpClient *http.Client
+}
+
+type consulOptions struct {
+	// token consul开启acl时使用
+	token string
+
+	lockPrefix string
+}
+
+type ConsulOption func(options *consulOptions)
+
+func ConsulWithToken(v string) ConsulOption {
+	return func(co *consulOptions) {
+		co.token = v
+	}
+}
+
+func ConsulWithLockPrefix(v string) ConsulOption {
+	return func(co *consulOptions) {
+		co.lockPrefix = v
+	}
+}
+
+// NewConsulBackend address是consul agent的地址，例如：http://127.0.0.1:8500
+func NewConsulBackend(address string, lg *zap.Logger, opts ...ConsulOption) Backend {
+	ops := &consulOptions{lockPrefix: defaultConsulLockPrefix}
+	for _, opt := range opts {
+		opt(ops)
+	}
+	return &consulBackend{
+		lg:         lg,
+		address:    strings.TrimSuffix(address, "/"),
+		opts:       ops,
+		httpClient: &http.Client{},
+	}
+}
+
+// consulKV consul返回的value是base64，[]byte在json解码时自动处理
+type consulKV struct {
+	Key         string `json:"Key"`
+	Value       []byte `json:"Value"`
+	Session     string `json:"Session"`
+	ModifyIndex int64  `json:"ModifyIndex"`
+}
+
+// toKeyValue consul的key不能以/开头，写入时去掉，读取时补回，和etcd中的节点保持一致
+func (kv *consulKV) toKeyValue() *KeyValue {
+	return &KeyValue{Key: "/" + kv.Key, Value: string(kv.Value), Revision: kv.ModifyIndex}
+}
+
+func consulKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+// do 返回body和X-Consul-Index，阻塞查询需要index
+func (b *consulBackend) do(ctx context.Context, method string, path string, query url.Values, body []byte) ([]byte, uint64, error) {
+	u := b.address + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "")
+	}
+	if b.opts.token != "" {
+		req.Header.Set("X-Consul-Token", b.opts.token)
+	}
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "")
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, index, errConsulNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("consul: %s %s status %d %s", method, path, resp.StatusCode, string(rb))
+	}
+	return rb, index, nil
+}
+
+func (b *consulBackend) getKVs(ctx context.Context, key string, query url.Values) ([]*consulKV, uint64, error) {
+	body, index, err := b.do(ctx, http.MethodGet, "/v1/kv/"+consulKey(key), query, nil)
+	if err != nil {
+		if err == errConsulNotFound {
+			return nil, index, nil
+		}
+		return nil, 0, errors.Wrap(err, "")
+	}
+	var kvs []*consulKV
+	if err := json.Unmarshal(body, &kvs); err != nil {
+		return nil, 0, errors.Wrap(err, "")
+	}
+	return kvs, index, nil
+}
+
+func (b *consulBackend) Get(ctx context.Context, key string) (*KeyValue, error) {
+	kvs, _, err := b.getKVs(ctx, key, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	return kvs[0].toKeyValue(), nil
+}
+
+func (b *consulBackend) GetPrefix(ctx context.Context, prefix string) ([]*KeyValue, error) {
+	kvs, _, err := b.getKVs(ctx, prefix, url.Values{"recurse": []string{"true"}})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var r []*KeyValue
+	for _, kv := range kvs {
+		r = append(r, kv.toKeyValue())
+	}
+	return r, nil
+}
+
+func (b *consulBackend) Put(ctx context.Context, key string, value string) error {
+	_, _, err := b.do(ctx, http.MethodPut, "/v1/kv/"+consulKey(key), nil, []byte(value))
+	return errors.Wrap(err, "")
+}
+
+func (b *consulBackend) Delete(ctx context.Context, key string) error {
+	_, _, err := b.do(ctx, http.MethodDelete, "/v1/kv/"+consulKey(key), nil, nil)
+	return errors.Wrap(err, "")
+}
+
+func (b *consulBackend) DeletePrefix(ctx context.Context, prefix string) error {
+	_, _, err := b.do(ctx, http.MethodDelete, "/v1/kv/"+consulKey(prefix), url.Values{"recurse": []string{"true"}}, nil)
+	return errors.Wrap(err, "")
+}
+
+// tryAcquire session已经持有节点时也返回true
+func (b *consulBackend) tryAcquire(ctx context.Context, sessionId string, key string, value string) (bool, error) {
+	body, _, err := b.do(ctx, http.MethodPut, "/v1/kv/"+consulKey(key), url.Values{"acquire": []string{sessionId}}, []byte(value))
+	if err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	return strings.TrimSpace(string(body)) == "true", nil
+}
+
+// acquire 阻塞直到session持有节点，通过阻塞查询等待节点的变化
+func (b *consulBackend) acquire(ctx context.Context, s Session, key string, value string) error {
+	var index uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "")
+		case <-s.Done():
+			return ErrSessionClosed
+		default:
+		}
+
+		ok, err := b.tryAcquire(ctx, s.Id(), key, value)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		if ok {
+			return nil
+		}
+
+		query := url.Values{"index": []string{strconv.FormatUint(index, 10)}, "wait": []string{defaultConsulWait}}
+		_, index, err = b.getKVs(ctx, key, query)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+}
+
+func (b *consulBackend) NewSession(ctx context.Context, ttl int) (Session, error) {
+	if ttl < minConsulSessionTTL {
+		ttl = minConsulSessionTTL
+	}
+	req := struct {
+		TTL       string `json:"TTL"`
+		Behavior  string `json:"Behavior"`
+		LockDelay string `json:"LockDelay"`
+	}{
+		TTL:      fmt.Sprintf("%ds", ttl),
+		Behavior: "delete",
+		// session失效后锁立即可以被其他session获取，和etcd的行为保持一致
+		LockDelay: "0s",
+	}
+	rb, _ := json.Marshal(req)
+	body, _, err := b.do(ctx, http.MethodPut, "/v1/session/create", nil, rb)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	s := consulSession{
+		b:     b,
+		id:    resp.ID,
+		donec: make(chan struct{}),
+		stopc: make(chan struct{}),
+	}
+	go s.keepAlive(time.Duration(ttl) * time.Second / 3)
+	return &s, nil
+}
+
+func (b *consulBackend) PutEphemeral(ctx context.Context, s Session, key string, value string) error {
+	ok, err := b.tryAcquire(ctx, s.Id(), key, value)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if !ok {
+		return ErrLockHeld
+	}
+	return nil
+}
+
+// Lock 锁节点是 <lockPrefix>/key，session在锁下的节点是 key/<session>，和etcd的mutex节点格式一致
+func (b *consulBackend) Lock(ctx context.Context, s Session, key string) (string, error) {
+	if err := b.acquire(ctx, s, b.opts.lockPrefix+"/"+consulKey(key), ""); err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	return fmt.Sprintf("%s/%s", key, s.Id()), nil
+}
+
+func (b *consulBackend) Campaign(ctx context.Context, s Session, key string, value string) error {
+	return errors.Wrap(b.acquire(ctx, s, key, value), "")
+}
+
+// Resign 释放session持有的leader节点，其他session的acquire可以成功
+func (b *consulBackend) Resign(ctx context.Context, s Session, key string) error {
+	_, _, err := b.do(ctx, http.MethodPut, "/v1/kv/"+consulKey(key), url.Values{"release": []string{s.Id()}}, nil)
+	return errors.Wrap(err, "")
+}
+
+// Leader 节点没有被session持有时，说明leader已经失效
+func (b *consulBackend) Leader(ctx context.Context, key string) (string, error) {
+	kvs, _, err := b.getKVs(ctx, key, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	if len(kvs) == 0 || kvs[0].Session == "" {
+		return "", nil
+	}
+	return string(kvs[0].Value), nil
+}
+
+type consulSession struct {
+	b  *consulBackend
+	id string
+
+	// donec session失效或者被关闭
+	donec chan struct{}
+	// stopc 停止续约
+	stopc chan struct{}
+	once  sync.Once
+}
+
+func (s *consulSession) Id() string {
+	return s.id
+}
+
+func (s *consulSession) Done() <-chan struct{} {
+	return s.donec
+}
+
+func (s *consulSession) Close() error {
+	s.once.Do(func() {
+		close(s.stopc)
+	})
+	_, _, err := s.b.do(context.TODO(), http.MethodPut, "/v1/session/destroy/"+s.id, nil, nil)
+	return errors.Wrap(err, "")
+}
+
+// keepAlive session被consul清理后不再续约，网络错误时继续重试，直到ttl过期
+func (s *consulSession) keepAlive(interval time.Duration) {
+	defer close(s.donec)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopc:
+			return
+		case <-ticker.C:
+			_, _, err := s.b.do(context.TODO(), http.MethodPut, "/v1/session/renew/"+s.id, nil, nil)
+			if err == nil {
+				continue
+			}
+			if err == errConsulNotFound {
+				s.b.lg.Warn("consul session expired", zap.String("session", s.id))
+				return
+			}
+			s.b.lg.Error(
+				"renew consul session error",
+				zap.String("session", s.id),
+				zap.Error(err),
+			)
+		}
+	}
+}
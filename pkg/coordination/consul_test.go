@@ -0,0 +1,179 @@
+package coordination
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeConsul 实现测试用到的kv和session接口
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    int64
+	kvs      map[string]*consulKV
+	sessions map[string]struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{kvs: make(map[string]*consulKV), sessions: make(map[string]struct{})}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", fmt.Sprint(f.index))
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		f.index++
+		id := fmt.Sprintf("s%d", f.index)
+		f.sessions[id] = struct{}{}
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"ID":"%s"}`, id)))
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		if _, ok := f.sessions[strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		delete(f.sessions, id)
+		for k, kv := range f.kvs {
+			if kv.Session == id {
+				delete(f.kvs, k)
+			}
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.serveKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"), body)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	recurse := r.URL.Query().Get("recurse") != ""
+	switch r.Method {
+	case http.MethodGet:
+		// 阻塞查询简化为短暂的等待
+		if r.URL.Query().Get("index") != "" {
+			f.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			f.mu.Lock()
+		}
+		var r []*consulKV
+		for k, kv := range f.kvs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				r = append(r, kv)
+			}
+		}
+		if len(r) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Slice(r, func(i, j int) bool { return r[i].Key < r[j].Key })
+		b, _ := json.Marshal(r)
+		_, _ = w.Write(b)
+	case http.MethodPut:
+		f.index++
+		if release := r.URL.Query().Get("release"); release != "" {
+			if cur, ok := f.kvs[key]; ok && cur.Session == release {
+				cur.Session = ""
+				cur.ModifyIndex = f.index
+			}
+			_, _ = w.Write([]byte("true"))
+			return
+		}
+		session := r.URL.Query().Get("acquire")
+		if cur, ok := f.kvs[key]; ok && session != "" && cur.Session != "" && cur.Session != session {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		f.kvs[key] = &consulKV{Key: key, Value: body, Session: session, ModifyIndex: f.index}
+		_, _ = w.Write([]byte("true"))
+	case http.MethodDelete:
+		f.index++
+		for k := range f.kvs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				delete(f.kvs, k)
+			}
+		}
+	}
+}
+
+func Test_consulBackend(t *testing.T) {
+	srv := httptest.NewServer(newFakeConsul())
+	defer srv.Close()
+
+	lg, _ := zap.NewDevelopment()
+	b := NewConsulBackend(srv.URL, lg)
+	ctx := context.TODO()
+
+	// kv
+	assert.Nil(t, b.Put(ctx, "/sm/app/foo/spec", "bar"))
+	assert.Nil(t, b.Put(ctx, "/sm/app/foo/shard/s1", "v1"))
+	kv, err := b.Get(ctx, "/sm/app/foo/spec")
+	assert.Nil(t, err)
+	assert.Equal(t, "/sm/app/foo/spec", kv.Key)
+	assert.Equal(t, "bar", kv.Value)
+	kvs, err := b.GetPrefix(ctx, "/sm/app/foo/")
+	assert.Nil(t, err)
+	assert.Len(t, kvs, 2)
+	assert.Nil(t, b.DeletePrefix(ctx, "/sm/app/foo/shard/"))
+	kv, err = b.Get(ctx, "/sm/app/foo/shard/s1")
+	assert.Nil(t, err)
+	assert.Nil(t, kv)
+
+	// lock
+	s1, err := b.NewSession(ctx, 5)
+	assert.Nil(t, err)
+	s2, err := b.NewSession(ctx, 5)
+	assert.Nil(t, err)
+	node, err := b.Lock(ctx, s1, "/sm/app/foo/containerhb/c1")
+	assert.Nil(t, err)
+	assert.Equal(t, "/sm/app/foo/containerhb/c1/"+s1.Id(), node)
+	assert.Nil(t, b.PutEphemeral(ctx, s1, node, "hb"))
+	// 重复加锁直接返回
+	_, err = b.Lock(ctx, s1, "/sm/app/foo/containerhb/c1")
+	assert.Nil(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = b.Lock(timeoutCtx, s2, "/sm/app/foo/containerhb/c1")
+	cancel()
+	assert.NotNil(t, err)
+
+	// leader
+	assert.Nil(t, b.Campaign(ctx, s1, "/sm/app/foo/leader", "c1"))
+	leader, err := b.Leader(ctx, "/sm/app/foo/leader")
+	assert.Nil(t, err)
+	assert.Equal(t, "c1", leader)
+
+	// 放弃leader后没有leader，重新竞选
+	assert.Nil(t, b.Resign(ctx, s1, "/sm/app/foo/leader"))
+	leader, err = b.Leader(ctx, "/sm/app/foo/leader")
+	assert.Nil(t, err)
+	assert.Equal(t, "", leader)
+	assert.Nil(t, b.Campaign(ctx, s1, "/sm/app/foo/leader", "c1"))
+
+	// session关闭后锁、leader和临时节点都被清理
+	assert.Nil(t, s1.Close())
+	<-s1.Done()
+	_, err = b.Lock(ctx, s2, "/sm/app/foo/containerhb/c1")
+	assert.Nil(t, err)
+	kv, err = b.Get(ctx, node)
+	assert.Nil(t, err)
+	assert.Nil(t, kv)
+	assert.Nil(t, b.Campaign(ctx, s2, "/sm/app/foo/leader", "c2"))
+	leader, err = b.Leader(ctx, "/sm/app/foo/leader")
+	assert.Nil(t, err)
+	assert.Equal(t, "c2", leader)
+	assert.Nil(t, s2.Close())
+}
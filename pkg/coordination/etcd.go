@@ -0,0 +1,168 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coordination
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+var (
+	_ Backend      = new(etcdBackend)
+	_ LeaseSession = new(etcdSession)
+)
+
+// etcdBackend 默认的实现
+type etcdBackend struct {
+	client etcdutil.EtcdWrapper
+}
+
+func NewEtcdBackend(client etcdutil.EtcdWrapper) Backend {
+	return &etcdBackend{client: client}
+}
+
+type etcdSession struct {
+	*concurrency.Session
+}
+
+// NewEtcdSession 复用已经创建的session，container和shard的heartbeat共用一个lease
+func NewEtcdSession(s *concurrency.Session) Session {
+	return &etcdSession{Session: s}
+}
+
+func (s *etcdSession) Id() string {
+	return fmt.Sprintf("%x", s.Lease())
+}
+
+func (s *etcdSession) TTL(ctx context.Context) (int64, int64, error) {
+	resp, err := s.Client().TimeToLive(ctx, s.Lease())
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "")
+	}
+	return resp.TTL, resp.GrantedTTL, nil
+}
+
+// toEtcdSession consul等其他后端的session不能在etcd中使用
+func toEtcdSession(s Session) (*concurrency.Session, error) {
+	es, ok := s.(*etcdSession)
+	if !ok {
+		return nil, errors.Errorf("unexpected session %T", s)
+	}
+	return es.Session, nil
+}
+
+func (b *etcdBackend) Get(ctx context.Context, key string) (*KeyValue, error) {
+	resp, err := b.client.GetKV(ctx, key, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	kv := resp.Kvs[0]
+	return &KeyValue{Key: string(kv.Key), Value: string(kv.Value), Revision: kv.ModRevision}, nil
+}
+
+func (b *etcdBackend) GetPrefix(ctx context.Context, prefix string) ([]*KeyValue, error) {
+	resp, err := b.client.GetKV(ctx, prefix, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var r []*KeyValue
+	for _, kv := range resp.Kvs {
+		r = append(r, &KeyValue{Key: string(kv.Key), Value: string(kv.Value), Revision: kv.ModRevision})
+	}
+	return r, nil
+}
+
+func (b *etcdBackend) Put(ctx context.Context, key string, value string) error {
+	_, err := b.client.Put(ctx, key, value)
+	return errors.Wrap(err, "")
+}
+
+func (b *etcdBackend) Delete(ctx context.Context, key string) error {
+	_, err := b.client.Delete(ctx, key)
+	return errors.Wrap(err, "")
+}
+
+func (b *etcdBackend) DeletePrefix(ctx context.Context, prefix string) error {
+	_, err := b.client.Delete(ctx, prefix, clientv3.WithPrefix())
+	return errors.Wrap(err, "")
+}
+
+func (b *etcdBackend) NewSession(ctx context.Context, ttl int) (Session, error) {
+	client, ok := etcdutil.UnwrapEtcdClient(b.client)
+	if !ok {
+		return nil, errors.Errorf("unexpected client %T", b.client)
+	}
+	s, err := concurrency.NewSession(client.Client, concurrency.WithTTL(ttl), concurrency.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return NewEtcdSession(s), nil
+}
+
+func (b *etcdBackend) PutEphemeral(ctx context.Context, s Session, key string, value string) error {
+	es, err := toEtcdSession(s)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	_, err = b.client.Put(ctx, key, value, clientv3.WithLease(es.Lease()))
+	return errors.Wrap(err, "")
+}
+
+// Lock 利用etcd内置的mutex，mutex的节点是 key/<lease>，同一个lease重复加锁直接返回
+func (b *etcdBackend) Lock(ctx context.Context, s Session, key string) (string, error) {
+	es, err := toEtcdSession(s)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	mutex := concurrency.NewMutex(es, key)
+	if err := mutex.Lock(ctx); err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	return mutex.Key(), nil
+}
+
+func (b *etcdBackend) Campaign(ctx context.Context, s Session, key string, value string) error {
+	es, err := toEtcdSession(s)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	return errors.Wrap(concurrency.NewElection(es, key).Campaign(ctx, value), "")
+}
+
+// Resign election的节点是 key/<lease>，和 concurrency.Election 的Resign一样删除自己的节点
+func (b *etcdBackend) Resign(ctx context.Context, s Session, key string) error {
+	_, err := b.client.Delete(ctx, fmt.Sprintf("%s/%s", key, s.Id()))
+	return errors.Wrap(err, "")
+}
+
+// Leader election中createRevision最小的节点是leader
+func (b *etcdBackend) Leader(ctx context.Context, key string) (string, error) {
+	resp, err := b.client.GetKV(ctx, key, clientv3.WithFirstCreate())
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdutil
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+var (
+	_ EtcdWrapper = new(DualWriteClient)
+)
+
+// DualWriteClient 迁移etcd集群时使用，读取只走primary，写入在primary成功后同步写到secondary，Cutover 交换两个集群。
+// lease只在创建它的集群有效，带option的Put（例如 WithLease）只写primary，heartbeat、leader这类临时节点
+// 在进程连接到新集群后重新生成。带条件的写入（revision、CAS）只在primary上判断，成功后按照结果覆盖写secondary
+type DualWriteClient struct {
+	lg *zap.Logger
+
+	mu        sync.RWMutex
+	primary   EtcdWrapper
+	secondary EtcdWrapper
+	cutoverAt int64
+
+	// mirrored 和 mirrorErrors secondary写入的成功和失败次数，失败不影响primary的结果
+	mirrored     int64
+	mirrorErrors int64
+}
+
+// DualWriteStatus 迁移的进度
+type DualWriteStatus struct {
+	// Primary 和 Secondary 当前读取和同步写入的集群的endpoints
+	Primary   []string `json:"primary"`
+	Secondary []string `json:"secondary"`
+
+	// CutoverAt 最近一次 Cutover 的unix秒，为0没有切换过
+	CutoverAt int64 `json:"cutoverAt,omitempty"`
+
+	Mirrored     int64 `json:"mirrored"`
+	MirrorErrors int64 `json:"mirrorErrors"`
+}
+
+func NewDualWriteClient(lg *zap.Logger, primary, secondary EtcdWrapper) *DualWriteClient {
+	return &DualWriteClient{lg: lg, primary: primary, secondary: secondary}
+}
+
+// Primary 当前读取的集群，session和watch需要直接使用primary的client
+func (w *DualWriteClient) Primary() EtcdWrapper {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.primary
+}
+
+func (w *DualWriteClient) Secondary() EtcdWrapper {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.secondary
+}
+
+// Cutover 交换primary和secondary，之后从新集群读取，写入继续同步到旧集群，需要回滚时再次调用
+func (w *DualWriteClient) Cutover() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.primary, w.secondary = w.secondary, w.primary
+	w.cutoverAt = time.Now().Unix()
+	w.lg.Info(
+		"etcd cutover",
+		zap.Strings("primary", endpoints(w.primary)),
+		zap.Strings("secondary", endpoints(w.secondary)),
+	)
+}
+
+func (w *DualWriteClient) Status() *DualWriteStatus {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return &DualWriteStatus{
+		Primary:      endpoints(w.primary),
+		Secondary:    endpoints(w.secondary),
+		CutoverAt:    w.cutoverAt,
+		Mirrored:     atomic.LoadInt64(&w.mirrored),
+		MirrorErrors: atomic.LoadInt64(&w.mirrorErrors),
+	}
+}
+
+// Sync 把primary中prefix下没有lease的节点覆盖写到secondary，开启双写之前已经存在的数据通过它补齐，返回写入的数量
+func (w *DualWriteClient) Sync(ctx context.Context, prefix string) (int, error) {
+	primary, secondary := w.Primary(), w.Secondary()
+	resp, err := primary.GetKV(ctx, prefix, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return 0, errors.Wrap(err, "")
+	}
+	var n int
+	for _, kv := range resp.Kvs {
+		if kv.Lease != 0 {
+			continue
+		}
+		if _, err := secondary.Put(ctx, string(kv.Key), string(kv.Value)); err != nil {
+			return n, errors.Wrap(err, string(kv.Key))
+		}
+		n++
+	}
+	w.lg.Info(
+		"etcd sync",
+		zap.String("prefix", prefix),
+		zap.Int("count", n),
+	)
+	return n, nil
+}
+
+// mirror secondary的写入失败只记录，迁移期间通过 Status 观察，切换之前用 Sync 补齐
+func (w *DualWriteClient) mirror(key string, fn func(secondary EtcdWrapper) error) {
+	if err := fn(w.Secondary()); err != nil {
+		atomic.AddInt64(&w.mirrorErrors, 1)
+		w.lg.Warn(
+			"etcd mirror error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return
+	}
+	atomic.AddInt64(&w.mirrored, 1)
+}
+
+func (w *DualWriteClient) GetKV(ctx context.Context, node string, opts []clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return w.Primary().GetKV(ctx, node, opts)
+}
+
+func (w *DualWriteClient) GetKVs(ctx context.Context, prefix string) (map[string]string, error) {
+	return w.Primary().GetKVs(ctx, prefix)
+}
+
+func (w *DualWriteClient) UpdateKV(ctx context.Context, key string, value string) error {
+	if err := w.Primary().UpdateKV(ctx, key, value); err != nil {
+		return err
+	}
+	w.mirror(key, func(secondary EtcdWrapper) error { return secondary.UpdateKV(ctx, key, value) })
+	return nil
+}
+
+func (w *DualWriteClient) UpdateKVWithRevision(ctx context.Context, key string, value string, revision int64) error {
+	if err := w.Primary().UpdateKVWithRevision(ctx, key, value, revision); err != nil {
+		return err
+	}
+	// 两个集群的revision不同，只在primary上校验
+	w.mirror(key, func(secondary EtcdWrapper) error { return secondary.UpdateKV(ctx, key, value) })
+	return nil
+}
+
+func (w *DualWriteClient) DelKV(ctx context.Context, prefix string) error {
+	if err := w.Primary().DelKV(ctx, prefix); err != nil {
+		return err
+	}
+	w.mirror(prefix, func(secondary EtcdWrapper) error { return secondary.DelKV(ctx, prefix) })
+	return nil
+}
+
+func (w *DualWriteClient) CreateAndGet(ctx context.Context, nodes []string, values []string, leaseID clientv3.LeaseID) error {
+	if err := w.Primary().CreateAndGet(ctx, nodes, values, leaseID); err != nil {
+		return err
+	}
+	if leaseID != clientv3.NoLease {
+		return nil
+	}
+	for idx, node := range nodes {
+		node, value := node, values[idx]
+		w.mirror(node, func(secondary EtcdWrapper) error {
+			_, err := secondary.Put(ctx, node, value)
+			return err
+		})
+	}
+	return nil
+}
+
+func (w *DualWriteClient) CompareAndSwap(ctx context.Context, node string, curValue string, newValue string, leaseID clientv3.LeaseID) (string, error) {
+	r, err := w.Primary().CompareAndSwap(ctx, node, curValue, newValue, leaseID)
+	if err != nil || leaseID != clientv3.NoLease {
+		return r, err
+	}
+	w.mirror(node, func(secondary EtcdWrapper) error {
+		_, err := secondary.Put(ctx, node, newValue)
+		return err
+	})
+	return r, nil
+}
+
+func (w *DualWriteClient) Ctx() context.Context {
+	return w.Primary().Ctx()
+}
+
+func (w *DualWriteClient) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return w.Primary().Get(ctx, key, opts...)
+}
+
+func (w *DualWriteClient) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := w.Primary().Put(ctx, key, val, opts...)
+	if err != nil || len(opts) > 0 {
+		return resp, err
+	}
+	w.mirror(key, func(secondary EtcdWrapper) error {
+		_, err := secondary.Put(ctx, key, val)
+		return err
+	})
+	return resp, nil
+}
+
+func (w *DualWriteClient) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := w.Primary().Delete(ctx, key, opts...)
+	if err != nil {
+		return resp, err
+	}
+	w.mirror(key, func(secondary EtcdWrapper) error {
+		_, err := secondary.Delete(ctx, key, opts...)
+		return err
+	})
+	return resp, nil
+}
+
+func (w *DualWriteClient) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return w.Primary().Watch(ctx, key, opts...)
+}
+
+// UnwrapEtcdClient 返回直接连接etcd的client，双写时是当前的primary，session、lock需要使用原生的client
+func UnwrapEtcdClient(w EtcdWrapper) (*EtcdClient, bool) {
+	for {
+		switch c := w.(type) {
+		case *EtcdClient:
+			return c, true
+		case *DualWriteClient:
+			w = c.Primary()
+		default:
+			return nil, false
+		}
+	}
+}
+
+func endpoints(w EtcdWrapper) []string {
+	if c, ok := UnwrapEtcdClient(w); ok && c.Client != nil {
+		return c.Endpoints()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package etcdutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// memWrapper 只实现双写用到的方法，其他方法调用时panic
+type memWrapper struct {
+	EtcdWrapper
+
+	kvs  map[string]string
+	fail bool
+}
+
+func (m *memWrapper) GetKV(_ context.Context, node string, _ []clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp := &clientv3.GetResponse{}
+	for k, v := range m.kvs {
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(v)})
+	}
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func (m *memWrapper) Put(_ context.Context, key, val string, _ ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	if m.fail {
+		return nil, errors.New("unavailable")
+	}
+	m.kvs[key] = val
+	return &clientv3.PutResponse{}, nil
+}
+
+func (m *memWrapper) UpdateKVWithRevision(_ context.Context, key string, value string, revision int64) error {
+	if revision != 1 {
+		return ErrEtcdRevisionNotMatch
+	}
+	m.kvs[key] = value
+	return nil
+}
+
+func (m *memWrapper) UpdateKV(_ context.Context, key string, value string) error {
+	m.kvs[key] = value
+	return nil
+}
+
+func Test_DualWriteClient(t *testing.T) {
+	primary := &memWrapper{kvs: map[string]string{"/sm/old": "v0"}}
+	secondary := &memWrapper{kvs: map[string]string{}}
+	w := NewDualWriteClient(zap.NewNop(), primary, secondary)
+
+	// 没有option的写入同步到secondary，带lease等option的只写primary
+	w.Put(context.TODO(), "/sm/a", "1")
+	w.Put(context.TODO(), "/sm/hb", "1", clientv3.WithLease(1))
+	if secondary.kvs["/sm/a"] != "1" || secondary.kvs["/sm/hb"] != "" || primary.kvs["/sm/hb"] != "1" {
+		t.Fatalf("unexpected secondary %v", secondary.kvs)
+	}
+
+	// revision只在primary上校验
+	if err := w.UpdateKVWithRevision(context.TODO(), "/sm/a", "2", 2); err != ErrEtcdRevisionNotMatch {
+		t.Fatalf("expect revision error, got %v", err)
+	}
+	if err := w.UpdateKVWithRevision(context.TODO(), "/sm/a", "2", 1); err != nil || secondary.kvs["/sm/a"] != "2" {
+		t.Fatalf("unexpected secondary %v err %v", secondary.kvs, err)
+	}
+
+	// secondary失败不影响primary
+	secondary.fail = true
+	if _, err := w.Put(context.TODO(), "/sm/b", "1"); err != nil || w.Status().MirrorErrors != 1 {
+		t.Fatalf("unexpected status %+v err %v", w.Status(), err)
+	}
+	secondary.fail = false
+
+	// Sync 补齐开启双写之前和写入失败的数据
+	if n, err := w.Sync(context.TODO(), "/sm"); err != nil || n != 4 || secondary.kvs["/sm/old"] != "v0" || secondary.kvs["/sm/b"] != "1" {
+		t.Fatalf("unexpected sync %d %v err %v", n, secondary.kvs, err)
+	}
+
+	w.Cutover()
+	if w.Primary() != secondary || w.Secondary() != primary || w.Status().CutoverAt == 0 {
+		t.Errorf("expect swapped after cutover")
+	}
+}
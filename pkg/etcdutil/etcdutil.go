@@ -19,10 +19,13 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/entertainment-venue/sm/pkg/chaos"
 	"github.com/entertainment-venue/sm/pkg/logutil"
 
 	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
@@ -33,12 +36,25 @@ var (
 
 var (
 	defaultOpTimeout = 3 * time.Second
+
+	defaultDialTimeout = 3 * time.Second
+
+	// defaultKeepAliveTime 和 defaultKeepAliveTimeout 探测连接是否可用，etcd节点异常时尽快切换到其他节点
+	defaultKeepAliveTime    = 10 * time.Second
+	defaultKeepAliveTimeout = 3 * time.Second
+
+	// defaultMaxRetries 幂等操作遇到etcd短暂不可用时的重试次数
+	defaultMaxRetries = 2
+	// defaultRetryBackoff 第一次重试前的等待时间，之后每次翻倍
+	defaultRetryBackoff = 100 * time.Millisecond
 )
 
 var (
 	ErrEtcdNodeExist     = errors.New("etcd: node exist")
 	ErrEtcdValueExist    = errors.New("etcd: value exist")
 	ErrEtcdValueNotMatch = errors.New("etcd: value not match")
+
+	ErrEtcdRevisionNotMatch = errors.New("etcd: revision not match")
 )
 
 // EtcdWrapper 4 unit test
@@ -47,6 +63,7 @@ type EtcdWrapper interface {
 	GetKV(_ context.Context, node string, opts []clientv3.OpOption) (*clientv3.GetResponse, error)
 	GetKVs(ctx context.Context, prefix string) (map[string]string, error)
 	UpdateKV(ctx context.Context, key string, value string) error
+	UpdateKVWithRevision(ctx context.Context, key string, value string, revision int64) error
 	DelKV(ctx context.Context, prefix string) error
 
 	CreateAndGet(ctx context.Context, nodes []string, values []string, leaseID clientv3.LeaseID) error
@@ -63,28 +80,195 @@ type EtcdClient struct {
 	*clientv3.Client
 
 	lg logutil.Logger
+
+	// readTimeout 和 writeTimeout 单次读写操作的超时时间
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// maxRetries 和 retryBackoff 幂等操作的重试策略
+	maxRetries   int
+	retryBackoff time.Duration
+
+	stats retryStats
+}
+
+type etcdClientOptions struct {
+	// username和password 开启etcd auth的集群需要
+	username string
+	password string
+
+	// 开启tls的etcd集群需要提供证书
+	caFile   string
+	certFile string
+	keyFile  string
+
+	// namespace 非空时所有key都在namespace下，调用方使用相对路径
+	namespace string
+
+	dialTimeout time.Duration
+
+	// keepAliveTime 和 keepAliveTimeout grpc连接的keepalive探测，为0使用默认值
+	keepAliveTime    time.Duration
+	keepAliveTimeout time.Duration
+
+	// maxRetries 为0使用默认值，<0不重试
+	maxRetries   int
+	retryBackoff time.Duration
+
+	// readTimeout 和 writeTimeout 为0使用默认值
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+type EtcdClientOption func(options *etcdClientOptions)
+
+// EtcdClientWithAuth etcd集群开启认证时，提供用户名和密码
+func EtcdClientWithAuth(username, password string) EtcdClientOption {
+	return func(options *etcdClientOptions) {
+		options.username = username
+		options.password = password
+	}
 }
 
-func NewEtcdClient(endpoints []string, lg *zap.Logger) (*EtcdClient, error) {
-	return NewEtcdClientWithCustomLogger(endpoints, logutil.NewZapLogger(lg))
+// EtcdClientWithTLS etcd集群开启tls时，提供ca、客户端证书和私钥文件
+func EtcdClientWithTLS(caFile, certFile, keyFile string) EtcdClientOption {
+	return func(options *etcdClientOptions) {
+		options.caFile = caFile
+		options.certFile = certFile
+		options.keyFile = keyFile
+	}
+}
+
+// EtcdClientWithNamespace 使用etcd官方的namespace包包装KV、Watcher和Lease，
+// 读写的key自动加上namespace，返回的key自动去掉namespace，多个sm部署可以共用一个etcd集群
+func EtcdClientWithNamespace(ns string) EtcdClientOption {
+	return func(options *etcdClientOptions) {
+		options.namespace = ns
+	}
+}
+
+// EtcdClientWithDialTimeout 建立连接的超时时间，默认3秒
+func EtcdClientWithDialTimeout(v time.Duration) EtcdClientOption {
+	return func(options *etcdClientOptions) {
+		options.dialTimeout = v
+	}
+}
+
+// EtcdClientWithKeepAlive grpc连接keepalive探测的间隔和超时时间，默认10秒和3秒，连接异常时尽快切换etcd节点
+func EtcdClientWithKeepAlive(interval, timeout time.Duration) EtcdClientOption {
+	return func(options *etcdClientOptions) {
+		options.keepAliveTime = interval
+		options.keepAliveTimeout = timeout
+	}
 }
 
-func NewEtcdClientWithCustomLogger(endpoints []string, lg logutil.Logger) (*EtcdClient, error) {
+// EtcdClientWithRetry 幂等操作（读、Put、Delete）遇到etcd短暂不可用时的重试次数和第一次重试前的等待时间，
+// 等待时间每次翻倍，默认重试2次、等待100ms，maxRetries小于0时不重试，事务类的操作结果不确定，不重试
+func EtcdClientWithRetry(maxRetries int, backoff time.Duration) EtcdClientOption {
+	return func(options *etcdClientOptions) {
+		options.maxRetries = maxRetries
+		options.retryBackoff = backoff
+	}
+}
+
+// EtcdClientWithOpTimeout 读和写操作各自的超时时间，默认都是3秒，防止etcd抖动时调用方长时间阻塞
+func EtcdClientWithOpTimeout(read, write time.Duration) EtcdClientOption {
+	return func(options *etcdClientOptions) {
+		options.readTimeout = read
+		options.writeTimeout = write
+	}
+}
+
+func NewEtcdClient(endpoints []string, lg *zap.Logger, opts ...EtcdClientOption) (*EtcdClient, error) {
+	return NewEtcdClientWithCustomLogger(endpoints, logutil.NewZapLogger(lg), opts...)
+}
+
+func NewEtcdClientWithCustomLogger(endpoints []string, lg logutil.Logger, opts ...EtcdClientOption) (*EtcdClient, error) {
 	if len(endpoints) < 1 {
 		return nil, errors.New("You must provide at least one etcd address")
 	}
-	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 3 * time.Second, DialOptions: []grpc.DialOption{grpc.WithBlock()}})
+	ops := &etcdClientOptions{}
+	for _, opt := range opts {
+		opt(ops)
+	}
+	ops.setDefaults()
+
+	cfg := clientv3.Config{
+		Endpoints:            endpoints,
+		DialTimeout:          ops.dialTimeout,
+		DialKeepAliveTime:    ops.keepAliveTime,
+		DialKeepAliveTimeout: ops.keepAliveTimeout,
+		DialOptions:          []grpc.DialOption{grpc.WithBlock()},
+		Username:             ops.username,
+		Password:             ops.password,
+	}
+	if ops.caFile != "" || ops.certFile != "" || ops.keyFile != "" {
+		tlsInfo := transport.TLSInfo{
+			TrustedCAFile: ops.caFile,
+			CertFile:      ops.certFile,
+			KeyFile:       ops.keyFile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		cfg.TLS = tlsConfig
+	}
+
+	client, err := clientv3.New(cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
-	return &EtcdClient{Client: client, lg: lg}, nil
+	if ops.namespace != "" {
+		// concurrency包中的session和election也通过这三个接口访问etcd，同样生效
+		client.KV = namespace.NewKV(client.KV, ops.namespace)
+		client.Watcher = namespace.NewWatcher(client.Watcher, ops.namespace)
+		client.Lease = namespace.NewLease(client.Lease, ops.namespace)
+	}
+	return &EtcdClient{
+		Client:       client,
+		lg:           lg,
+		readTimeout:  ops.readTimeout,
+		writeTimeout: ops.writeTimeout,
+		maxRetries:   ops.maxRetries,
+		retryBackoff: ops.retryBackoff,
+	}, nil
 }
 
-func (w *EtcdClient) GetKV(_ context.Context, node string, opts []clientv3.OpOption) (*clientv3.GetResponse, error) {
-	timeoutCtx, cancel := context.WithTimeout(context.TODO(), defaultOpTimeout)
-	defer cancel()
+func (o *etcdClientOptions) setDefaults() {
+	if o.dialTimeout <= 0 {
+		o.dialTimeout = defaultDialTimeout
+	}
+	if o.keepAliveTime <= 0 {
+		o.keepAliveTime = defaultKeepAliveTime
+	}
+	if o.keepAliveTimeout <= 0 {
+		o.keepAliveTimeout = defaultKeepAliveTimeout
+	}
+	switch {
+	case o.maxRetries == 0:
+		o.maxRetries = defaultMaxRetries
+	case o.maxRetries < 0:
+		o.maxRetries = 0
+	}
+	if o.retryBackoff <= 0 {
+		o.retryBackoff = defaultRetryBackoff
+	}
+	if o.readTimeout <= 0 {
+		o.readTimeout = defaultOpTimeout
+	}
+	if o.writeTimeout <= 0 {
+		o.writeTimeout = defaultOpTimeout
+	}
+}
 
-	resp, err := w.Get(timeoutCtx, node, opts...)
+func (w *EtcdClient) GetKV(_ context.Context, node string, opts []clientv3.OpOption) (*clientv3.GetResponse, error) {
+	var resp *clientv3.GetResponse
+	err := w.retry(w.readTimeout, func(ctx context.Context) error {
+		var err error
+		resp, err = w.Get(ctx, node, opts...)
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
@@ -111,10 +295,15 @@ func (w *EtcdClient) GetKVs(ctx context.Context, prefix string) (map[string]stri
 }
 
 func (w *EtcdClient) DelKV(_ context.Context, prefix string) error {
-	timeoutCtx, cancel := context.WithTimeout(context.TODO(), defaultOpTimeout)
-	defer cancel()
-
-	resp, err := w.Delete(timeoutCtx, prefix, clientv3.WithPrefix())
+	if err := chaos.EtcdWrite(prefix); err != nil {
+		return errors.Wrap(err, "")
+	}
+	var resp *clientv3.DeleteResponse
+	err := w.retry(w.writeTimeout, func(ctx context.Context) error {
+		var err error
+		resp, err = w.Delete(ctx, prefix, clientv3.WithPrefix())
+		return err
+	})
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
@@ -125,13 +314,40 @@ func (w *EtcdClient) DelKV(_ context.Context, prefix string) error {
 }
 
 func (w *EtcdClient) UpdateKV(_ context.Context, key string, value string) error {
-	timeoutCtx, cancel := context.WithTimeout(context.TODO(), defaultOpTimeout)
+	if err := chaos.EtcdWrite(key); err != nil {
+		return errors.Wrap(err, "")
+	}
+	err := w.retry(w.writeTimeout, func(ctx context.Context) error {
+		_, err := w.Put(ctx, key, value)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	return nil
+}
+
+// UpdateKVWithRevision key的ModRevision和revision一致时才更新，防止并发的更新相互覆盖
+func (w *EtcdClient) UpdateKVWithRevision(_ context.Context, key string, value string, revision int64) error {
+	if err := chaos.EtcdWrite(key); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(context.TODO(), w.writeTimeout)
 	defer cancel()
 
-	_, err := w.Put(timeoutCtx, key, value)
+	cmp := clientv3.Compare(clientv3.ModRevision(key), "=", revision)
+	resp, err := w.Txn(timeoutCtx).If(cmp).Then(clientv3.OpPut(key, value)).Commit()
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
+	if !resp.Succeeded {
+		w.lg.Warn("revision not match",
+			zap.String("key", key),
+			zap.Int64("revision", revision),
+		)
+		return ErrEtcdRevisionNotMatch
+	}
 	return nil
 }
 
@@ -139,6 +355,9 @@ func (w *EtcdClient) CreateAndGet(_ context.Context, nodes []string, values []st
 	if len(nodes) == 0 {
 		return errors.New("FAILED empty nodes")
 	}
+	if err := chaos.EtcdWrite(nodes[0]); err != nil {
+		return errors.Wrap(err, "")
+	}
 
 	mainNode := nodes[0]
 	// 创建的场景下，cmp只发生一次
@@ -153,7 +372,7 @@ func (w *EtcdClient) CreateAndGet(_ context.Context, nodes []string, values []st
 		}
 	}
 
-	timeoutCtx, cancel := context.WithTimeout(context.TODO(), defaultOpTimeout)
+	timeoutCtx, cancel := context.WithTimeout(context.TODO(), w.writeTimeout)
 	defer cancel()
 
 	resp, err := w.Txn(timeoutCtx).If(cmp).Then(create...).Commit()
@@ -174,8 +393,11 @@ func (w *EtcdClient) CompareAndSwap(_ context.Context, node string, curValue str
 	if curValue == "" && newValue == "" {
 		return "", errors.Errorf("FAILED node %s's curValue and newValue should not be empty both", node)
 	}
+	if err := chaos.EtcdWrite(node); err != nil {
+		return "", errors.Wrap(err, "")
+	}
 
-	timeoutCtx, cancel := context.WithTimeout(context.TODO(), defaultOpTimeout)
+	timeoutCtx, cancel := context.WithTimeout(context.TODO(), w.writeTimeout)
 	defer cancel()
 
 	var put clientv3.Op
@@ -0,0 +1,93 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdutil
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type retryStats struct {
+	retries  int64
+	failures int64
+}
+
+// EtcdClientStats 从client创建开始累计的重试计数
+type EtcdClientStats struct {
+	// Retries 重试的次数
+	Retries int64 `json:"retries"`
+
+	// RetryFailures 重试之后仍然失败的操作数量
+	RetryFailures int64 `json:"retryFailures"`
+}
+
+// Stats 提供给调用方的metrics
+func (w *EtcdClient) Stats() EtcdClientStats {
+	return EtcdClientStats{
+		Retries:       atomic.LoadInt64(&w.stats.retries),
+		RetryFailures: atomic.LoadInt64(&w.stats.failures),
+	}
+}
+
+// retry 每次尝试使用独立的超时时间，只有etcd短暂不可用导致的错误才重试，只能用于幂等的操作
+func (w *EtcdClient) retry(timeout time.Duration, op func(ctx context.Context) error) error {
+	backoff := w.retryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+		err := op(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= w.maxRetries || !retryable(err) {
+			if attempt > 0 {
+				atomic.AddInt64(&w.stats.failures, 1)
+			}
+			return err
+		}
+
+		atomic.AddInt64(&w.stats.retries, 1)
+		w.lg.Warn("etcd op retry", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryable 超时、连接不可用和etcd选主期间的错误可以重试，其他错误重试也不会成功
+func retryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch err {
+	case rpctypes.ErrNoLeader,
+		rpctypes.ErrLeaderChanged,
+		rpctypes.ErrTimeout,
+		rpctypes.ErrTimeoutDueToLeaderFail,
+		rpctypes.ErrTimeoutDueToConnectionLost:
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package etcdutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/logutil"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+)
+
+func Test_EtcdClient_retry(t *testing.T) {
+	w := &EtcdClient{
+		lg:           logutil.NewZapLogger(zap.NewNop()),
+		maxRetries:   2,
+		retryBackoff: time.Millisecond,
+	}
+
+	// etcd选主期间的错误重试后成功
+	var calls int
+	err := w.retry(time.Second, func(ctx context.Context) error {
+		calls++
+		if calls < 2 {
+			return rpctypes.ErrNoLeader
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("expect success after retry, calls %d err %v", calls, err)
+	}
+
+	// 超过重试次数返回最后一次的错误
+	calls = 0
+	err = w.retry(time.Second, func(ctx context.Context) error {
+		calls++
+		return context.DeadlineExceeded
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || calls != 3 {
+		t.Errorf("expect 3 calls and deadline exceeded, calls %d err %v", calls, err)
+	}
+
+	// 不可重试的错误直接返回
+	calls = 0
+	err = w.retry(time.Second, func(ctx context.Context) error {
+		calls++
+		return rpctypes.ErrKeyNotFound
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expect no retry, calls %d err %v", calls, err)
+	}
+
+	stats := w.Stats()
+	if stats.Retries != 3 || stats.RetryFailures != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package smclient 提供watch模式的接入方式，业务app不需要开放http端口，
+// 通过watch etcd中分配给自己的shard节点，回调 apputil.ShardInterface 的Add/Drop
+package smclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEtcdPrefix = "/sm"
+
+	defaultRetryInterval = 3 * time.Second
+)
+
+type Client struct {
+	stopper *apputil.GoroutineStopper
+	opts    *clientOptions
+
+	// mu 保护container和shardServer，session失效后会重建
+	mu          sync.Mutex
+	container   *apputil.Container
+	shardServer *apputil.ShardServer
+}
+
+type clientOptions struct {
+	service     string
+	containerId string
+	etcdPrefix  string
+	endpoints   []string
+	impl        apputil.ShardInterface
+	lg          *zap.Logger
+
+	// containerOpts 透传给container，例如etcd的认证和tls配置
+	containerOpts []apputil.ContainerOption
+
+	// taskKey sm开启task加密时使用的key
+	taskKey []byte
+
+	// admission 接受shard之前的检查
+	admission apputil.ShardAdmission
+}
+
+type ClientOption func(options *clientOptions)
+
+func ClientWithService(v string) ClientOption {
+	return func(co *clientOptions) {
+		co.service = v
+	}
+}
+
+func ClientWithContainerId(v string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerId = v
+	}
+}
+
+func ClientWithEtcdPrefix(v string) ClientOption {
+	return func(co *clientOptions) {
+		co.etcdPrefix = v
+	}
+}
+
+// ClientWithEtcdNamespace 和sm使用相同的etcd namespace，设置后 ClientWithEtcdPrefix 不再生效
+func ClientWithEtcdNamespace(v string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithEtcdNamespace(v))
+	}
+}
+
+func ClientWithEndpoints(v []string) ClientOption {
+	return func(co *clientOptions) {
+		co.endpoints = v
+	}
+}
+
+func ClientWithImplementation(v apputil.ShardInterface) ClientOption {
+	return func(co *clientOptions) {
+		co.impl = v
+	}
+}
+
+func ClientWithLogger(v *zap.Logger) ClientOption {
+	return func(co *clientOptions) {
+		co.lg = v
+	}
+}
+
+func ClientWithEtcdAuth(username, password string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithEtcdAuth(username, password))
+	}
+}
+
+func ClientWithEtcdTLS(caFile, certFile, keyFile string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithEtcdTLS(caFile, certFile, keyFile))
+	}
+}
+
+// ClientWithTaskKey 和sm使用相同的AES key，shard的task解密后再交给 ShardInterface
+func ClientWithTaskKey(v []byte) ClientOption {
+	return func(co *clientOptions) {
+		co.taskKey = v
+	}
+}
+
+// ClientWithAdmission 接受shard之前调用v，v返回 apputil.RefuseShard 时sm把shard分配给其他container
+func ClientWithAdmission(v apputil.ShardAdmission) ClientOption {
+	return func(co *clientOptions) {
+		co.admission = v
+	}
+}
+
+// ClientWithEtcdClientOptions etcd client的超时、keepalive和重试等配置
+func ClientWithEtcdClientOptions(opts ...etcdutil.EtcdClientOption) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithEtcdClientOptions(opts...))
+	}
+}
+
+func ClientWithZone(v string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithZone(v))
+	}
+}
+
+// ClientWithDeployment 设置container所属的部署，参考 apputil.ContainerWithDeployment
+func ClientWithDeployment(v string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithDeployment(v))
+	}
+}
+
+// ClientWithCapacity 声明container可以承载的负载单位
+func ClientWithCapacity(v int) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithCapacity(v))
+	}
+}
+
+// ClientWithResources 声明container可以提供给shard预留的cpu/mem单位
+func ClientWithResources(cpu, mem int) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithResources(cpu, mem))
+	}
+}
+
+// ClientWithLabels 声明container的标签，shard的Constraint中引用
+func ClientWithLabels(v map[string]string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithLabels(v))
+	}
+}
+
+// ClientWithVersion 在heartbeat中上报的业务版本
+func ClientWithVersion(v string) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithVersion(v))
+	}
+}
+
+// ClientWithHeartbeatBackoff etcd短暂不可用时heartbeat的退避上限和jitter比例
+func ClientWithHeartbeatBackoff(max time.Duration, jitter float64) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithHeartbeatBackoff(max, jitter))
+	}
+}
+
+// ClientWithHeartbeatHandler heartbeat丢失时回调 fn(false)，业务应暂停shard上的工作，恢复后回调 fn(true)
+func ClientWithHeartbeatHandler(fn apputil.HeartbeatHandler) ClientOption {
+	return func(co *clientOptions) {
+		co.containerOpts = append(co.containerOpts, apputil.ContainerWithHeartbeatHandler(fn))
+	}
+}
+
+func NewClient(opts ...ClientOption) (*Client, error) {
+	ops := &clientOptions{}
+	for _, opt := range opts {
+		opt(ops)
+	}
+	if ops.service == "" {
+		return nil, errors.New("service err")
+	}
+	if ops.containerId == "" {
+		return nil, errors.New("containerId err")
+	}
+	if len(ops.endpoints) == 0 {
+		return nil, errors.New("endpoints err")
+	}
+	if ops.impl == nil {
+		return nil, errors.New("impl err")
+	}
+	if ops.lg == nil {
+		return nil, errors.New("lg err")
+	}
+	if ops.etcdPrefix == "" {
+		ops.etcdPrefix = defaultEtcdPrefix
+	}
+
+	c := &Client{
+		stopper: &apputil.GoroutineStopper{},
+		opts:    ops,
+	}
+	if err := c.newServer(); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	// session失效后重建container，重新加入sm的分配
+	c.stopper.Wrap(
+		func(ctx context.Context) {
+			for {
+				select {
+				case <-ctx.Done():
+					ops.lg.Info("smclient exit", zap.String("service", ops.service))
+					return
+				case <-c.done():
+					ops.lg.Info("session done, try again", zap.String("service", ops.service))
+					if err := c.newServer(); err != nil {
+						ops.lg.Error(
+							"newServer error",
+							zap.String("service", ops.service),
+							zap.Error(err),
+						)
+						time.Sleep(defaultRetryInterval)
+					}
+				}
+			}
+		},
+	)
+	return c, nil
+}
+
+func (c *Client) newServer() error {
+	// 重建之前先关闭旧的实例，释放etcd session、http listener和goroutine，新的ShardServer才能监听相同的端口
+	c.mu.Lock()
+	c.closeServer()
+	c.mu.Unlock()
+
+	opts := []apputil.ContainerOption{
+		apputil.ContainerWithService(c.opts.service),
+		apputil.ContainerWithId(c.opts.containerId),
+		apputil.ContainerWithEndpoints(c.opts.endpoints),
+		apputil.ContainerWithLogger(c.opts.lg),
+		apputil.ContainerWithWatch(true),
+		apputil.ContainerWithEtcdPrefix(c.opts.etcdPrefix),
+	}
+	container, err := apputil.NewContainer(append(opts, c.opts.containerOpts...)...)
+	if err != nil {
+		return errors.Wrap(err, "new container failed")
+	}
+
+	shardServer, err := apputil.NewShardServer(
+		apputil.ShardServerWithEtcdPrefix(c.opts.etcdPrefix),
+		apputil.ShardServerWithContainer(container),
+		apputil.ShardServerWithShardImplementation(c.opts.impl),
+		apputil.ShardServerWithLogger(c.opts.lg),
+		apputil.ShardServerWithTaskKey(c.opts.taskKey),
+		apputil.ShardServerWithAdmission(c.opts.admission),
+		apputil.ShardServerWithWatch(true))
+	if err != nil {
+		container.Close()
+		return errors.Wrap(err, "new shard server failed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.container = container
+	c.shardServer = shardServer
+	return nil
+}
+
+// FencingToken 返回shard当前的fencing token，Add 收到的 ShardSpec.FencingToken 比它小说明shard已经被重新分配
+func (c *Client) FencingToken(ctx context.Context, shardId string) (int64, error) {
+	c.mu.Lock()
+	container := c.container
+	c.mu.Unlock()
+	return container.FencingToken(ctx, shardId)
+}
+
+// CheckFencingToken shard已经被重新分配时返回 apputil.ErrStaleFencingToken，业务在提交写入之前检查
+func (c *Client) CheckFencingToken(ctx context.Context, shardId string, token int64) error {
+	c.mu.Lock()
+	container := c.container
+	c.mu.Unlock()
+	return container.CheckFencingToken(ctx, shardId, token)
+}
+
+// ShardContext shard被drop或者session丢失时取消，session重建后重新下发的shard使用新的context
+func (c *Client) ShardContext(shardId string) context.Context {
+	c.mu.Lock()
+	shardServer := c.shardServer
+	c.mu.Unlock()
+	return shardServer.ShardContext(shardId)
+}
+
+func (c *Client) done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shardServer.Done()
+}
+
+func (c *Client) Close() {
+	if c.stopper != nil {
+		c.stopper.Close()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeServer()
+}
+
+// closeServer 调用方持有 c.mu ，Close可以重复调用，重建失败时保留已经关闭的实例，done 仍然可以触发重试
+func (c *Client) closeServer() {
+	if c.shardServer != nil {
+		c.shardServer.Close()
+	}
+	if c.container != nil {
+		c.container.Close()
+		// container不负责关闭创建时建立的session和etcd连接
+		if s := c.container.CurrentSession(); s != nil {
+			_ = s.Close()
+			_ = s.Client().Close()
+		}
+	}
+}
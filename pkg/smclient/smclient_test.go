@@ -0,0 +1,74 @@
+package smclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"go.uber.org/zap"
+)
+
+var (
+	ttLogger, _ = zap.NewProduction()
+)
+
+type testShard struct{}
+
+func (s *testShard) Add(id string, spec *apputil.ShardSpec) error { return nil }
+func (s *testShard) Drop(id string) error                         { return nil }
+func (s *testShard) Load(id string) (string, error)               { return "", nil }
+
+func TestNewClient_ParamErr(t *testing.T) {
+	var tests = []struct {
+		opts []ClientOption
+	}{
+		{
+			opts: []ClientOption{
+				ClientWithContainerId("127.0.0.1:8888"),
+				ClientWithEndpoints([]string{"127.0.0.1:2379"}),
+				ClientWithImplementation(&testShard{}),
+				ClientWithLogger(ttLogger),
+			},
+		},
+		{
+			opts: []ClientOption{
+				ClientWithService("foo.bar"),
+				ClientWithEndpoints([]string{"127.0.0.1:2379"}),
+				ClientWithImplementation(&testShard{}),
+				ClientWithLogger(ttLogger),
+			},
+		},
+		{
+			opts: []ClientOption{
+				ClientWithService("foo.bar"),
+				ClientWithContainerId("127.0.0.1:8888"),
+				ClientWithImplementation(&testShard{}),
+				ClientWithLogger(ttLogger),
+			},
+		},
+		{
+			opts: []ClientOption{
+				ClientWithService("foo.bar"),
+				ClientWithContainerId("127.0.0.1:8888"),
+				ClientWithEndpoints([]string{"127.0.0.1:2379"}),
+				ClientWithLogger(ttLogger),
+			},
+		},
+		{
+			opts: []ClientOption{
+				ClientWithService("foo.bar"),
+				ClientWithContainerId("127.0.0.1:8888"),
+				ClientWithEndpoints([]string{"127.0.0.1:2379"}),
+				ClientWithImplementation(&testShard{}),
+			},
+		},
+	}
+
+	for idx, tt := range tests {
+		_, err := NewClient(tt.opts...)
+		if err == nil || !strings.HasSuffix(err.Error(), " err") {
+			t.Errorf("idx %d expect param err", idx)
+			t.SkipNow()
+		}
+	}
+}
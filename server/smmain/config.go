@@ -4,6 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/server/smserver"
+	"github.com/pkg/errors"
 )
 
 // MultiOption copy from goreplay setttings.go
@@ -20,16 +24,130 @@ func (h *MultiOption) Set(value string) error {
 }
 
 type Config struct {
-	Service   string      `json:"service"`
-	Port      string      `json:"port"`
-	Endpoints MultiOption `json:"endpoints"`
+	Service   string      `json:"service" yaml:"service"`
+	Port      string      `json:"port" yaml:"port"`
+	Endpoints MultiOption `json:"endpoints" yaml:"endpoints"`
+	// MirrorEndpoints 迁移etcd集群时的新集群，写入同时同步到这里
+	MirrorEndpoints MultiOption `json:"mirrorEndpoints" yaml:"mirrorEndpoints"`
+
+	EtcdPrefix string `json:"etcdPrefix" yaml:"etcdPrefix"`
+	// EtcdNamespace 通过etcd client的namespace隔离数据，设置后EtcdPrefix不再生效
+	EtcdNamespace string `json:"etcdNamespace" yaml:"etcdNamespace"`
+
+	// etcd开启认证和tls时使用
+	EtcdUsername string `json:"etcdUsername" yaml:"etcdUsername"`
+	EtcdPassword string `json:"-" yaml:"etcdPassword"`
+	EtcdCAFile   string `json:"etcdCAFile" yaml:"etcdCAFile"`
+	EtcdCertFile string `json:"etcdCertFile" yaml:"etcdCertFile"`
+	EtcdKeyFile  string `json:"etcdKeyFile" yaml:"etcdKeyFile"`
+
+	// EtcdDialTimeout、EtcdKeepAlive 和 EtcdKeepAliveTimeout 单位秒，为0使用默认值
+	EtcdDialTimeout      int `json:"etcdDialTimeout" yaml:"etcdDialTimeout"`
+	EtcdKeepAlive        int `json:"etcdKeepAlive" yaml:"etcdKeepAlive"`
+	EtcdKeepAliveTimeout int `json:"etcdKeepAliveTimeout" yaml:"etcdKeepAliveTimeout"`
+	// EtcdMaxRetries 幂等操作的重试次数，为0使用默认值，小于0不重试
+	EtcdMaxRetries int `json:"etcdMaxRetries" yaml:"etcdMaxRetries"`
+	// EtcdRetryBackoff、EtcdReadTimeout 和 EtcdWriteTimeout 单位毫秒，为0使用默认值
+	EtcdRetryBackoff int `json:"etcdRetryBackoff" yaml:"etcdRetryBackoff"`
+	EtcdReadTimeout  int `json:"etcdReadTimeout" yaml:"etcdReadTimeout"`
+	EtcdWriteTimeout int `json:"etcdWriteTimeout" yaml:"etcdWriteTimeout"`
+
+	// ApiTokens 只支持配置文件，token到可操作service的映射，"*"代表所有service，
+	// 密码和token不输出到日志
+	ApiTokens map[string][]string `json:"-" yaml:"apiTokens"`
+
+	// MaxServices 和 MaxShardsPerService 全局quota，为0不限制
+	MaxServices         int `json:"maxServices" yaml:"maxServices"`
+	MaxShardsPerService int `json:"maxShardsPerService" yaml:"maxShardsPerService"`
+	// TenantQuotas 只支持配置文件，key是ApiTokens中的token，不输出到日志
+	TenantQuotas map[string]smserver.Quota `json:"-" yaml:"tenantQuotas"`
+
+	// ShardGrpc 通过grpc向开启grpc的container下发add/drop，ShardGrpcCAFile、ShardGrpcCertFile 和 ShardGrpcKeyFile
+	// 是双向认证的client证书，ShardGrpcInsecure 显式开启明文
+	ShardGrpc         bool   `json:"shardGrpc" yaml:"shardGrpc"`
+	ShardGrpcCAFile   string `json:"shardGrpcCAFile" yaml:"shardGrpcCAFile"`
+	ShardGrpcCertFile string `json:"shardGrpcCertFile" yaml:"shardGrpcCertFile"`
+	ShardGrpcKeyFile  string `json:"shardGrpcKeyFile" yaml:"shardGrpcKeyFile"`
+	ShardGrpcInsecure bool   `json:"shardGrpcInsecure" yaml:"shardGrpcInsecure"`
+
+	// MoveBreakerThreshold 同一个container连续add/drop失败的次数，达到后熔断，为负数时关闭
+	MoveBreakerThreshold int `json:"moveBreakerThreshold" yaml:"moveBreakerThreshold"`
+	// MoveBreakerCooldown 熔断的时间，单位秒
+	MoveBreakerCooldown int `json:"moveBreakerCooldown" yaml:"moveBreakerCooldown"`
+
+	// LeaderLeaseTTL leader竞选session的ttl，单位秒，默认5秒
+	LeaderLeaseTTL int `json:"leaderLeaseTTL" yaml:"leaderLeaseTTL"`
+	// HeartbeatLeaseTTL heartbeat session的ttl，单位秒，为0时和LeaderLeaseTTL相同
+	HeartbeatLeaseTTL int `json:"heartbeatLeaseTTL" yaml:"heartbeatLeaseTTL"`
+	// StabilizationDelay 竞选leader成功后开始管理shard之前的等待时间，单位秒
+	StabilizationDelay int `json:"stabilizationDelay" yaml:"stabilizationDelay"`
+
+	// LeaderForwarding 非leader节点收到的写请求转发给leader
+	LeaderForwarding bool `json:"leaderForwarding" yaml:"leaderForwarding"`
+
+	// ApiRate 和 ApiBurst 每个client的接口限流，ApiGlobalRate 和 ApiGlobalBurst 所有client共享的接口限流，rate为0不限制
+	ApiRate        float64 `json:"apiRate" yaml:"apiRate"`
+	ApiBurst       int     `json:"apiBurst" yaml:"apiBurst"`
+	ApiGlobalRate  float64 `json:"apiGlobalRate" yaml:"apiGlobalRate"`
+	ApiGlobalBurst int     `json:"apiGlobalBurst" yaml:"apiGlobalBurst"`
+
+	// ApiAudit 修改类的接口调用写入事件日志
+	ApiAudit bool `json:"apiAudit" yaml:"apiAudit"`
+
+	// DrainTimeout 收到退出信号后等待shard移交的时间，单位秒，为0直接退出
+	DrainTimeout int `json:"drainTimeout" yaml:"drainTimeout"`
+	// ShutdownTimeout 关闭http server时等待进行中请求的时间，单位秒，为0使用默认的10s
+	ShutdownTimeout int `json:"shutdownTimeout" yaml:"shutdownTimeout"`
+
+	// JanitorMaxAge etcd中孤儿节点的保留时间，单位秒，为0不清理
+	JanitorMaxAge int `json:"janitorMaxAge" yaml:"janitorMaxAge"`
+
+	// BackupDir 不为空时leader每隔BackupInterval秒备份etcd prefix下的key，BackupInterval为0只能通过api触发，
+	// BackupKeep 保留的备份数量，为0使用默认值7
+	BackupDir      string `json:"backupDir" yaml:"backupDir"`
+	BackupInterval int    `json:"backupInterval" yaml:"backupInterval"`
+	BackupKeep     int    `json:"backupKeep" yaml:"backupKeep"`
 
-	EtcdPrefix string `json:"etcdPrefix"`
+	// FederationRegions 只支持配置文件，作为联邦coordinator时region名称到region中sm节点地址的映射
+	FederationRegions map[string]string `json:"federationRegions" yaml:"federationRegions"`
+	// FederationCAFile region使用https时校验证书的ca，为空使用系统的ca
+	FederationCAFile string `json:"federationCAFile" yaml:"federationCAFile"`
+	// FederationInsecure 允许通过明文http向region转发token，只用于开发和测试环境
+	FederationInsecure bool `json:"federationInsecure" yaml:"federationInsecure"`
 
-	// TODO 支持配置文件
-	ConfigFile string `json:"config-file"`
+	// IdempotencyWindow Idempotency-Key 的有效时间，单位秒，为0使用默认的3600
+	IdempotencyWindow int `json:"idempotencyWindow" yaml:"idempotencyWindow"`
+
+	// ShardHistorySize 每个shard保留的分配记录数量，为0使用默认值20
+	ShardHistorySize int `json:"shardHistorySize" yaml:"shardHistorySize"`
+
+	// Debug 开启 /debug/pprof 和 /debug/vars
+	Debug bool `json:"debug" yaml:"debug"`
+
+	// ReadOnly 以只读副本运行，只提供查询接口
+	ReadOnly bool `json:"readOnly" yaml:"readOnly"`
+
+	// EmbeddedEtcdDir 不为空时在进程内启动单节点etcd，endpoints为空时连接内置的etcd
+	EmbeddedEtcdDir       string `json:"embeddedEtcdDir" yaml:"embeddedEtcdDir"`
+	EmbeddedEtcdClientURL string `json:"embeddedEtcdClientURL" yaml:"embeddedEtcdClientURL"`
+	EmbeddedEtcdPeerURL   string `json:"embeddedEtcdPeerURL" yaml:"embeddedEtcdPeerURL"`
+
+	// TraceFile 不为空时开启opentelemetry，span写入文件，"-"代表标准输出
+	TraceFile string `json:"traceFile" yaml:"traceFile"`
+
+	// Check 只执行启动前的自检，输出报告后退出，有失败项时退出码为1
+	Check bool `json:"-" yaml:"-" toml:"-"`
+
+	// Restore 不为空时把备份文件写入一个新的etcd集群，自检后退出，不启动server
+	Restore string `json:"-" yaml:"-" toml:"-"`
+
+	// ConfigFile yaml或者toml格式的配置文件，key和yaml tag相同
+	ConfigFile string `json:"config-file" yaml:"-" toml:"-"`
 }
 
+// envPrefix 环境变量覆盖配置文件的前缀，例如 SM_ETCD_PASSWORD 对应 etcdPassword
+const envPrefix = "SM_"
+
 var cfg Config
 
 func usage() {
@@ -40,19 +158,86 @@ func usage() {
 
 func init() {
 	flag.Usage = usage
-	flag.StringVar(&cfg.ConfigFile, "config-file", "", "You can use config file to save your common config.")
+	flag.StringVar(&cfg.ConfigFile, "config", "", "Yaml or toml (.toml) config file, SM_ prefixed env variables override the file and flags given on the command line override both")
+	flag.StringVar(&cfg.ConfigFile, "config-file", "", "Same as -config, kept for compatibility")
+	flag.BoolVar(&cfg.Check, "check", false, "Check etcd connectivity, permission, spec consistency, orphaned keys and leader reachability, print the report and exit")
+	flag.StringVar(&cfg.Restore, "restore", "", "Restore the backup file into a fresh etcd cluster, validate specs, print the report and exit")
 	flag.StringVar(&cfg.Service, "service", "", "The sharded application service name, should be used in service discovery")
 	flag.StringVar(&cfg.Port, "port", "", "Http server listen port like '8888'")
 	flag.Var(&cfg.Endpoints, "endpoints", "The etcd cluster server list")
-	flag.StringVar(&cfg.EtcdPrefix, "", "/sm", "Etcd namespace, default '/sm'")
+	flag.Var(&cfg.MirrorEndpoints, "mirror-endpoints", "The etcd cluster to migrate to, writes are mirrored to it until cutover")
+	flag.StringVar(&cfg.EtcdPrefix, "etcd-prefix", "/sm", "Etcd key prefix, default '/sm'")
+	flag.StringVar(&cfg.EtcdNamespace, "etcd-namespace", "", "Etcd client namespace, overrides etcd-prefix when set")
+	flag.StringVar(&cfg.EtcdUsername, "etcd-username", "", "Etcd username when auth enabled")
+	flag.StringVar(&cfg.EtcdPassword, "etcd-password", "", "Etcd password when auth enabled")
+	flag.StringVar(&cfg.EtcdCAFile, "etcd-ca", "", "Etcd trusted ca file when tls enabled")
+	flag.StringVar(&cfg.EtcdCertFile, "etcd-cert", "", "Etcd client cert file when tls enabled")
+	flag.StringVar(&cfg.EtcdKeyFile, "etcd-key", "", "Etcd client key file when tls enabled")
+	flag.IntVar(&cfg.EtcdDialTimeout, "etcd-dial-timeout", 0, "Etcd dial timeout in seconds, 0 means 3")
+	flag.IntVar(&cfg.EtcdKeepAlive, "etcd-keepalive", 0, "Etcd connection keepalive interval in seconds, 0 means 10")
+	flag.IntVar(&cfg.EtcdKeepAliveTimeout, "etcd-keepalive-timeout", 0, "Etcd connection keepalive timeout in seconds, 0 means 3")
+	flag.IntVar(&cfg.EtcdMaxRetries, "etcd-max-retries", 0, "Retries of idempotent etcd operations when etcd is temporarily unavailable, 0 means 2, negative disables retry")
+	flag.IntVar(&cfg.EtcdRetryBackoff, "etcd-retry-backoff", 0, "Milliseconds to wait before the first etcd retry, doubled on each retry, 0 means 100")
+	flag.IntVar(&cfg.EtcdReadTimeout, "etcd-read-timeout", 0, "Etcd read timeout in milliseconds, 0 means 3000")
+	flag.IntVar(&cfg.EtcdWriteTimeout, "etcd-write-timeout", 0, "Etcd write timeout in milliseconds, 0 means 3000")
+	flag.IntVar(&cfg.LeaderLeaseTTL, "leader-lease-ttl", 5, "Leader lease ttl in seconds")
+	flag.IntVar(&cfg.HeartbeatLeaseTTL, "heartbeat-lease-ttl", 0, "Heartbeat lease ttl in seconds, renewed separately from the leader lease, 0 means leader-lease-ttl")
+	flag.IntVar(&cfg.StabilizationDelay, "stabilization-delay", 0, "Seconds to wait after becoming leader before managing shards")
+	flag.BoolVar(&cfg.LeaderForwarding, "leader-forwarding", true, "Forward write api requests to the leader")
+	flag.Float64Var(&cfg.ApiRate, "api-rate", 0, "Api requests per second allowed for each client (token or ip), 0 means unlimited")
+	flag.IntVar(&cfg.ApiBurst, "api-burst", 0, "Api burst for each client, default equal to api-rate")
+	flag.Float64Var(&cfg.ApiGlobalRate, "api-global-rate", 0, "Api requests per second allowed for all clients, 0 means unlimited")
+	flag.IntVar(&cfg.ApiGlobalBurst, "api-global-burst", 0, "Api burst for all clients, default equal to api-global-rate")
+	flag.BoolVar(&cfg.ApiAudit, "api-audit", false, "Record mutating api calls in the event history")
+	flag.IntVar(&cfg.DrainTimeout, "drain-timeout", 0, "Seconds to keep serving after exit signal while shards are handed over, 0 means exit immediately")
+	flag.IntVar(&cfg.MaxServices, "max-services", 0, "Max number of registered services, 0 means no limit")
+	flag.IntVar(&cfg.MaxShardsPerService, "max-shards-per-service", 0, "Max number of shards per service, 0 means no limit")
+	flag.BoolVar(&cfg.ShardGrpc, "shard-grpc", false, "Send shard add/drop over grpc to containers that advertise a grpc address")
+	flag.StringVar(&cfg.ShardGrpcCAFile, "shard-grpc-ca", "", "Trusted ca file for shard grpc mutual tls")
+	flag.StringVar(&cfg.ShardGrpcCertFile, "shard-grpc-cert", "", "Client cert file for shard grpc mutual tls")
+	flag.StringVar(&cfg.ShardGrpcKeyFile, "shard-grpc-key", "", "Client key file for shard grpc mutual tls")
+	flag.BoolVar(&cfg.ShardGrpcInsecure, "shard-grpc-insecure", false, "Allow plaintext shard grpc without certificates, for development only")
+	flag.IntVar(&cfg.MoveBreakerThreshold, "move-breaker-threshold", 0, "Consecutive add/drop failures to one container before its circuit opens, 0 means 5, negative disables")
+	flag.IntVar(&cfg.MoveBreakerCooldown, "move-breaker-cooldown", 0, "Seconds a container circuit stays open before a probe request is let through, 0 means 30")
+	flag.IntVar(&cfg.ShutdownTimeout, "shutdown-timeout", 0, "Seconds to wait for in-flight api requests when the http server shuts down, 0 means 10s")
+	flag.IntVar(&cfg.JanitorMaxAge, "janitor-max-age", 0, "Seconds an orphaned etcd node is kept before the leader deletes it, 0 means never")
+	flag.StringVar(&cfg.BackupDir, "backup-dir", "", "Directory the leader saves backups of the etcd prefix to, empty disables saving backups")
+	flag.IntVar(&cfg.BackupInterval, "backup-interval", 0, "Seconds between scheduled backups, 0 means backups are only triggered by api")
+	flag.IntVar(&cfg.BackupKeep, "backup-keep", 0, "Backups kept in backup-dir, 0 means 7")
+	flag.IntVar(&cfg.IdempotencyWindow, "idempotency-window", 0, "Seconds an Idempotency-Key replays the first result of add-spec/add-shard/del-shard, 0 means 3600")
+	flag.IntVar(&cfg.ShardHistorySize, "shard-history-size", 0, "Assignment history entries kept for each shard, 0 means 20")
+	flag.BoolVar(&cfg.Debug, "debug", false, "Expose pprof and expvar under /debug/ for diagnosis")
+	flag.BoolVar(&cfg.ReadOnly, "read-only", false, "Run as a read-only replica serving queries from a watch-maintained cache, mutations are rejected")
+	flag.StringVar(&cfg.EmbeddedEtcdDir, "embedded-etcd-dir", "", "Run a single-node etcd inside sm with data in the dir, used when endpoints is empty")
+	flag.StringVar(&cfg.EmbeddedEtcdClientURL, "embedded-etcd-client-url", "", "Client url of the embedded etcd, empty means http://127.0.0.1:2379")
+	flag.StringVar(&cfg.EmbeddedEtcdPeerURL, "embedded-etcd-peer-url", "", "Peer url of the embedded etcd, empty means http://127.0.0.1:2380")
+	flag.StringVar(&cfg.TraceFile, "trace-file", "", "Enable opentelemetry tracing and write spans to the file, '-' for stdout")
 }
 
-func checkSettings() {
-	// 传递配置文件，不需要校验其他配置参数
+// loadConfig 优先级从低到高：flag默认值、配置文件、SM_开头的环境变量、命令行中显式指定的flag
+func loadConfig() error {
+	if cfg.ConfigFile == "" {
+		cfg.ConfigFile = os.Getenv(envPrefix + "CONFIG")
+	}
 	if cfg.ConfigFile != "" {
-		return
+		if err := apputil.LoadConfigFile(cfg.ConfigFile, &cfg); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	if err := apputil.ApplyEnvOverrides(envPrefix, &cfg); err != nil {
+		return errors.Wrap(err, "")
 	}
 
+	// 重新解析命令行，显式指定的flag覆盖配置文件和环境变量，MultiOption是追加的，先清空
+	flag.Visit(func(f *flag.Flag) {
+		if m, ok := f.Value.(*MultiOption); ok {
+			*m = nil
+		}
+	})
+	return flag.CommandLine.Parse(os.Args[1:])
+}
+
+func checkSettings() {
 	if cfg.Service == "" {
 		fmt.Printf("Err: Service require\n")
 		usage()
@@ -61,11 +246,11 @@ func checkSettings() {
 		fmt.Printf("Err: Port require\n")
 		usage()
 	}
-	if len(cfg.Endpoints) == 0 {
+	if len(cfg.Endpoints) == 0 && cfg.EmbeddedEtcdDir == "" {
 		fmt.Printf("Err: Endpoints require\n")
 		usage()
 	}
-	if cfg.EtcdPrefix == "" {
+	if cfg.EtcdPrefix == "" && cfg.EtcdNamespace == "" {
 		fmt.Printf("Err: EtcdPrefix require\n")
 		usage()
 	}
@@ -1,36 +1,25 @@
 package smmain
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/entertainment-venue/sm/server/smserver"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v2"
 )
 
 func startSM() error {
 	flag.Parse()
-	checkSettings()
-
-	if cfg.ConfigFile != "" {
-		data, err := ioutil.ReadFile(cfg.ConfigFile)
-		if err != nil {
-			return errors.Wrap(err, "")
-		}
-
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return errors.Wrap(err, "")
-		}
-
-		cfg.ConfigFile = ""
-		checkSettings()
+	if err := loadConfig(); err != nil {
+		return errors.Wrap(err, "")
 	}
+	checkSettings()
 
 	lg, zapError := NewSMLogger()
 	if zapError != nil {
@@ -39,13 +28,85 @@ func startSM() error {
 	}
 	defer lg.Sync()
 
-	srv, err := smserver.NewServer(
+	if cfg.TraceFile != "" {
+		shutdown, err := initTracer(cfg.TraceFile)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		defer shutdown()
+	}
+
+	opts := []smserver.ServerOption{
 		smserver.WithId(fmt.Sprintf("%s:%s", smserver.GetLocalIP(), cfg.Port)),
 		smserver.WithService(cfg.Service),
 		smserver.WithAddr(fmt.Sprintf(":%s", cfg.Port)),
 		smserver.WithEndpoints(cfg.Endpoints),
+		smserver.WithMirrorEndpoints(cfg.MirrorEndpoints),
 		smserver.WithLogger(lg),
-		smserver.WithEtcdPrefix(cfg.EtcdPrefix))
+		smserver.WithEtcdPrefix(cfg.EtcdPrefix),
+		smserver.WithEtcdNamespace(cfg.EtcdNamespace),
+		smserver.WithEtcdAuth(cfg.EtcdUsername, cfg.EtcdPassword),
+		smserver.WithEtcdTLS(cfg.EtcdCAFile, cfg.EtcdCertFile, cfg.EtcdKeyFile),
+		smserver.WithEtcdDialTimeout(time.Duration(cfg.EtcdDialTimeout) * time.Second),
+		smserver.WithEtcdKeepAlive(time.Duration(cfg.EtcdKeepAlive)*time.Second, time.Duration(cfg.EtcdKeepAliveTimeout)*time.Second),
+		smserver.WithEtcdRetry(cfg.EtcdMaxRetries, time.Duration(cfg.EtcdRetryBackoff)*time.Millisecond),
+		smserver.WithEtcdOpTimeout(time.Duration(cfg.EtcdReadTimeout)*time.Millisecond, time.Duration(cfg.EtcdWriteTimeout)*time.Millisecond),
+		smserver.WithApiTokens(cfg.ApiTokens),
+		smserver.WithQuota(smserver.Quota{MaxServices: cfg.MaxServices, MaxShardsPerService: cfg.MaxShardsPerService}),
+		smserver.WithTenantQuotas(cfg.TenantQuotas),
+		smserver.WithShardGrpc(cfg.ShardGrpc, cfg.ShardGrpcCAFile, cfg.ShardGrpcCertFile, cfg.ShardGrpcKeyFile),
+		smserver.WithShardGrpcInsecure(cfg.ShardGrpcInsecure),
+		smserver.WithMoveCircuitBreaker(cfg.MoveBreakerThreshold, time.Duration(cfg.MoveBreakerCooldown)*time.Second),
+		smserver.WithLeaderLeaseTTL(cfg.LeaderLeaseTTL),
+		smserver.WithHeartbeatLeaseTTL(cfg.HeartbeatLeaseTTL),
+		smserver.WithStabilizationDelay(time.Duration(cfg.StabilizationDelay) * time.Second),
+		smserver.WithLeaderForwarding(cfg.LeaderForwarding),
+		smserver.WithApiRateLimit(cfg.ApiRate, cfg.ApiBurst),
+		smserver.WithApiGlobalRateLimit(cfg.ApiGlobalRate, cfg.ApiGlobalBurst),
+		smserver.WithApiAudit(cfg.ApiAudit),
+		smserver.WithDrainTimeout(time.Duration(cfg.DrainTimeout) * time.Second),
+		smserver.WithShutdownTimeout(time.Duration(cfg.ShutdownTimeout) * time.Second),
+		smserver.WithJanitorMaxAge(time.Duration(cfg.JanitorMaxAge) * time.Second),
+		smserver.WithBackup(cfg.BackupDir, time.Duration(cfg.BackupInterval)*time.Second, cfg.BackupKeep),
+		smserver.WithFederationRegions(cfg.FederationRegions),
+		smserver.WithFederationTLS(cfg.FederationCAFile),
+		smserver.WithFederationInsecure(cfg.FederationInsecure),
+		smserver.WithIdempotencyWindow(time.Duration(cfg.IdempotencyWindow) * time.Second),
+		smserver.WithShardHistorySize(cfg.ShardHistorySize),
+		smserver.WithDebug(cfg.Debug),
+		smserver.WithReadOnly(cfg.ReadOnly),
+		smserver.WithEmbeddedEtcd(cfg.EmbeddedEtcdDir, cfg.EmbeddedEtcdClientURL, cfg.EmbeddedEtcdPeerURL),
+	}
+
+	// check模式只检查部署环境，输出报告后退出，不启动server
+	if cfg.Check {
+		report, err := smserver.SelfCheck(opts...)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+		if !report.Ok {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	// restore模式把备份写入新的etcd集群，输出报告后退出，不启动server
+	if cfg.Restore != "" {
+		report, err := smserver.Restore(cfg.Restore, opts...)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+		if !report.Ok {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	srv, err := smserver.NewServer(opts...)
 	if err != nil {
 		lg.Panic(
 			"NewServer error",
@@ -56,7 +117,7 @@ func startSM() error {
 
 	// 监听信号
 	go func() {
-		sigChan := make(chan os.Signal)
+		sigChan := make(chan os.Signal, 1)
 		signals := []os.Signal{
 			syscall.SIGINT,
 			syscall.SIGTERM,
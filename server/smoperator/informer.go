@@ -0,0 +1,114 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smoperator
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// watchRetryInterval list或者watch失败后等待的时间
+const watchRetryInterval = 3 * time.Second
+
+// informer 和client-go的informer相同：先list得到全部对象和resourceVersion，再从这个版本开始watch，
+// watch结束时从最后一个事件的版本继续，版本过期时重新list
+type informer struct {
+	lg   *zap.Logger
+	kube *kubeClient
+	path string
+
+	// replace list之后替换全部缓存
+	replace func(items []json.RawMessage) error
+	// apply 处理watch事件
+	apply func(typ string, object json.RawMessage) error
+}
+
+func (i *informer) run(ctx context.Context) {
+	var resourceVersion string
+	for ctx.Err() == nil {
+		if resourceVersion == "" {
+			list, err := i.kube.list(ctx, i.path)
+			if err == nil {
+				err = i.replace(list.Items)
+			}
+			if err != nil {
+				i.lg.Error("list error", zap.String("path", i.path), zap.Error(err))
+				sleepCtx(ctx, watchRetryInterval)
+				continue
+			}
+			resourceVersion = list.Metadata.ResourceVersion
+		}
+
+		next, err := i.kube.watch(ctx, i.path, resourceVersion, i.apply)
+		resourceVersion = next
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if errors.Is(err, errResourceExpired) {
+			i.lg.Info("resource version expired, relist", zap.String("path", i.path))
+			resourceVersion = ""
+			continue
+		}
+		i.lg.Error("watch error", zap.String("path", i.path), zap.Error(err))
+		sleepCtx(ctx, watchRetryInterval)
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// workQueue 排队中的ShardedService只保留一次，事件再多也只reconcile一次
+type workQueue struct {
+	mu     sync.Mutex
+	names  map[string]struct{}
+	notify chan struct{}
+}
+
+func newWorkQueue() *workQueue {
+	return &workQueue{names: make(map[string]struct{}), notify: make(chan struct{}, 1)}
+}
+
+func (q *workQueue) add(names ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, name := range names {
+		q.names[name] = struct{}{}
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take 取出所有排队的ShardedService
+func (q *workQueue) take() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var names []string
+	for name := range q.names {
+		names = append(names, name)
+	}
+	q.names = make(map[string]struct{})
+	return names
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smoperator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	defaultRequestTimeout = 5 * time.Second
+
+	// watchTimeout api server在这个时间后结束watch，informer从最后的resourceVersion重新watch
+	watchTimeout = 5 * time.Minute
+)
+
+// errResourceExpired watch使用的resourceVersion已经被api server压缩，需要重新list
+var errResourceExpired = errors.New("resource version expired")
+
+// kubeClient 只使用operator需要的几个api，不引入client-go
+type kubeClient struct {
+	host       string
+	token      string
+	httpClient *http.Client
+
+	// watchClient watch是长连接，不能使用httpClient的超时
+	watchClient *http.Client
+}
+
+// newInClusterKubeClient 使用pod的service account访问api server
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid ca")
+	}
+	httpClient := &http.Client{
+		Timeout:   defaultRequestTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return newKubeClient("https://"+net.JoinHostPort(host, port), string(token), httpClient), nil
+}
+
+func newKubeClient(host string, token string, httpClient *http.Client) *kubeClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultRequestTimeout}
+	}
+	return &kubeClient{
+		host:        strings.TrimSuffix(host, "/"),
+		token:       token,
+		httpClient:  httpClient,
+		watchClient: &http.Client{Transport: httpClient.Transport},
+	}
+}
+
+func (k *kubeClient) shardedServicePath(namespace string, name string) string {
+	pth := fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", crdGroup, crdVersion, namespace, crdPlural)
+	if name != "" {
+		pth += "/" + name
+	}
+	return pth
+}
+
+func (k *kubeClient) podPath(namespace string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)
+}
+
+func (k *kubeClient) list(ctx context.Context, pth string) (*rawList, error) {
+	var list rawList
+	if err := k.do(ctx, http.MethodGet, pth, "", nil, &list); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &list, nil
+}
+
+// watch 从resourceVersion之后开始接收事件，连接正常结束时返回最后一个事件的resourceVersion，
+// resourceVersion过期时返回 errResourceExpired
+func (k *kubeClient) watch(ctx context.Context, pth string, resourceVersion string, handle func(typ string, object json.RawMessage) error) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", strconv.Itoa(int(watchTimeout/time.Second)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.host+pth+"?"+query.Encode(), nil)
+	if err != nil {
+		return resourceVersion, errors.Wrap(err, "")
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.watchClient.Do(req)
+	if err != nil {
+		return resourceVersion, errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return resourceVersion, errResourceExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resourceVersion, errors.Errorf("watch %s status %d: %s", pth, resp.StatusCode, string(b))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return resourceVersion, errors.Wrap(err, "")
+		}
+		if event.Type == "ERROR" {
+			var status watchStatus
+			_ = json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return resourceVersion, errResourceExpired
+			}
+			return resourceVersion, errors.Errorf("watch %s error %d: %s", pth, status.Code, status.Message)
+		}
+
+		var object struct {
+			Metadata objectMeta `json:"metadata"`
+		}
+		if err := json.Unmarshal(event.Object, &object); err != nil {
+			return resourceVersion, errors.Wrap(err, "")
+		}
+		// BOOKMARK只推进resourceVersion
+		if event.Type != "BOOKMARK" {
+			if err := handle(event.Type, event.Object); err != nil {
+				return resourceVersion, errors.Wrap(err, "")
+			}
+		}
+		resourceVersion = object.Metadata.ResourceVersion
+	}
+}
+
+// patchFinalizers merge patch会整体替换finalizers
+func (k *kubeClient) patchFinalizers(ctx context.Context, svc *ShardedService, finalizers []string) error {
+	patch := map[string]interface{}{"metadata": map[string]interface{}{"finalizers": finalizers}}
+	return k.patch(ctx, k.shardedServicePath(svc.Metadata.Namespace, svc.Metadata.Name), patch)
+}
+
+func (k *kubeClient) patchStatus(ctx context.Context, svc *ShardedService, status ShardedServiceStatus) error {
+	patch := map[string]interface{}{"status": status}
+	return k.patch(ctx, k.shardedServicePath(svc.Metadata.Namespace, svc.Metadata.Name)+"/status", patch)
+}
+
+func (k *kubeClient) patch(ctx context.Context, pth string, patch interface{}) error {
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	return k.do(ctx, http.MethodPatch, pth, "application/merge-patch+json", bytes.NewReader(b), nil)
+}
+
+func (k *kubeClient) do(ctx context.Context, method string, pth string, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, k.host+pth, body)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s %s status %d: %s", method, pth, resp.StatusCode, string(b))
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(b, result), "")
+}
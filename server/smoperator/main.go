@@ -0,0 +1,103 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smoperator
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type config struct {
+	// Namespace 为空时使用operator所在的namespace
+	Namespace string
+	SMAddr    string
+	SMToken   string
+	// Interval ShardedService和pod的变化通过watch实时触发reconcile，Interval是全量reconcile的间隔
+	Interval time.Duration
+
+	// KubeApi 和 KubeToken 在集群外调试时使用
+	KubeApi   string
+	KubeToken string
+}
+
+// Main sm-k8s-operator的入口
+func Main() {
+	var cfg config
+	flag.StringVar(&cfg.Namespace, "namespace", "", "Namespace of ShardedService, default the namespace of operator")
+	flag.StringVar(&cfg.SMAddr, "sm-addr", "", "Sm http address like 'http://sm:8888'")
+	flag.StringVar(&cfg.SMToken, "sm-token", "", "Sm api token when auth enabled")
+	flag.DurationVar(&cfg.Interval, "interval", time.Minute, "Resync interval, changes are reconciled as they are watched")
+	flag.StringVar(&cfg.KubeApi, "kube-api", "", "Kubernetes api server, default in cluster config")
+	flag.StringVar(&cfg.KubeToken, "kube-token", "", "Kubernetes bearer token used with kube-api")
+	flag.Parse()
+
+	if err := run(&cfg); err != nil {
+		fmt.Printf("sm-k8s-operator exit: %+v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg *config) error {
+	if cfg.SMAddr == "" {
+		return errors.New("sm-addr require")
+	}
+	lg, err := zap.NewProduction()
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer lg.Sync()
+
+	var kube *kubeClient
+	if cfg.KubeApi != "" {
+		kube = newKubeClient(cfg.KubeApi, cfg.KubeToken, nil)
+	} else {
+		kube, err = newInClusterKubeClient()
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	if cfg.Namespace == "" {
+		b, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return errors.Wrap(err, "namespace require")
+		}
+		cfg.Namespace = strings.TrimSpace(string(b))
+	}
+
+	op := newOperator(lg, kube, newSMClient(cfg.SMAddr, cfg.SMToken), cfg.Namespace)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigChan
+		lg.Warn("Received exit signal", zap.String("sig", sig.String()))
+		cancel()
+	}()
+
+	lg.Info("operator started", zap.String("namespace", cfg.Namespace), zap.String("sm", cfg.SMAddr))
+	op.run(ctx, cfg.Interval)
+	return nil
+}
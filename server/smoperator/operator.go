@@ -0,0 +1,314 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smoperator
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// reconcileRetryInterval reconcile失败后重新排队的时间
+const reconcileRetryInterval = 5 * time.Second
+
+// operator 把ShardedService同步为sm的spec和shard group，删除时清理sm中的spec。
+// ShardedService和pod通过informer缓存在本地，变化时只reconcile受影响的ShardedService
+type operator struct {
+	lg        *zap.Logger
+	kube      *kubeClient
+	sm        *smClient
+	namespace string
+
+	mu       sync.Mutex
+	services map[string]*ShardedService
+	pods     map[string]*pod
+	// podsSynced pod完成第一次list之前不reconcile，避免把readyContainers写成0
+	podsSynced bool
+
+	queue *workQueue
+}
+
+func newOperator(lg *zap.Logger, kube *kubeClient, sm *smClient, namespace string) *operator {
+	return &operator{
+		lg:        lg,
+		kube:      kube,
+		sm:        sm,
+		namespace: namespace,
+		services:  make(map[string]*ShardedService),
+		pods:      make(map[string]*pod),
+		queue:     newWorkQueue(),
+	}
+}
+
+// run ShardedService和pod的变化触发reconcile，另外每隔resync reconcile全部ShardedService
+func (o *operator) run(ctx context.Context, resync time.Duration) {
+	services := informer{
+		lg:      o.lg,
+		kube:    o.kube,
+		path:    o.kube.shardedServicePath(o.namespace, ""),
+		replace: o.replaceServices,
+		apply:   o.applyService,
+	}
+	pods := informer{
+		lg:      o.lg,
+		kube:    o.kube,
+		path:    o.kube.podPath(o.namespace),
+		replace: o.replacePods,
+		apply:   o.applyPod,
+	}
+	go services.run(ctx)
+	go pods.run(ctx)
+
+	ticker := time.NewTicker(resync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			o.lg.Info("operator exit")
+			return
+		case <-ticker.C:
+			o.queue.add(o.serviceNames()...)
+		case <-o.queue.notify:
+			o.process(ctx)
+		}
+	}
+}
+
+// process reconcile排队中的ShardedService，单个失败不影响其他的，失败的稍后重新排队
+func (o *operator) process(ctx context.Context) {
+	o.mu.Lock()
+	synced := o.podsSynced
+	o.mu.Unlock()
+	if !synced {
+		return
+	}
+
+	for _, name := range o.queue.take() {
+		o.mu.Lock()
+		svc := o.services[name]
+		o.mu.Unlock()
+		if svc == nil {
+			continue
+		}
+		if err := o.reconcileOne(ctx, svc); err != nil {
+			o.lg.Error(
+				"reconcile error",
+				zap.String("name", svc.Metadata.Name),
+				zap.String("service", svc.Spec.Service),
+				zap.Error(err),
+			)
+			name := name
+			time.AfterFunc(reconcileRetryInterval, func() { o.queue.add(name) })
+		}
+	}
+}
+
+func (o *operator) serviceNames() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var names []string
+	for name := range o.services {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (o *operator) replaceServices(items []json.RawMessage) error {
+	services := make(map[string]*ShardedService)
+	for _, item := range items {
+		var svc ShardedService
+		if err := json.Unmarshal(item, &svc); err != nil {
+			return errors.Wrap(err, "")
+		}
+		services[svc.Metadata.Name] = &svc
+	}
+	o.mu.Lock()
+	o.services = services
+	o.mu.Unlock()
+	o.queue.add(o.serviceNames()...)
+	return nil
+}
+
+func (o *operator) applyService(typ string, object json.RawMessage) error {
+	var svc ShardedService
+	if err := json.Unmarshal(object, &svc); err != nil {
+		return errors.Wrap(err, "")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if typ == "DELETED" {
+		delete(o.services, svc.Metadata.Name)
+		return nil
+	}
+	o.services[svc.Metadata.Name] = &svc
+	o.queue.add(svc.Metadata.Name)
+	return nil
+}
+
+func (o *operator) replacePods(items []json.RawMessage) error {
+	pods := make(map[string]*pod)
+	for _, item := range items {
+		var p pod
+		if err := json.Unmarshal(item, &p); err != nil {
+			return errors.Wrap(err, "")
+		}
+		pods[p.Metadata.Name] = &p
+	}
+	o.mu.Lock()
+	o.pods = pods
+	o.podsSynced = true
+	var names []string
+	for name, svc := range o.services {
+		if len(svc.Spec.PodSelector) > 0 {
+			names = append(names, name)
+		}
+	}
+	o.mu.Unlock()
+	// 没有ShardedService时也要唤醒process，处理pod同步之前排队的ShardedService
+	o.queue.add(names...)
+	return nil
+}
+
+// applyPod pod的label可能变化，新旧label匹配的ShardedService都需要reconcile
+func (o *operator) applyPod(typ string, object json.RawMessage) error {
+	var p pod
+	if err := json.Unmarshal(object, &p); err != nil {
+		return errors.Wrap(err, "")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	old := o.pods[p.Metadata.Name]
+	if typ == "DELETED" {
+		delete(o.pods, p.Metadata.Name)
+	} else {
+		o.pods[p.Metadata.Name] = &p
+	}
+	for name, svc := range o.services {
+		if p.matches(svc.Spec.PodSelector) || (old != nil && old.matches(svc.Spec.PodSelector)) {
+			o.queue.add(name)
+		}
+	}
+	return nil
+}
+
+// readyPods 统计缓存中selector匹配的pod中ready的数量
+func (o *operator) readyPods(selector map[string]string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var ready int
+	for _, p := range o.pods {
+		if p.matches(selector) && p.ready() {
+			ready++
+		}
+	}
+	return ready
+}
+
+func (o *operator) reconcileOne(ctx context.Context, svc *ShardedService) error {
+	if svc.deleting() {
+		if !svc.hasFinalizer() {
+			return nil
+		}
+		if err := o.sm.delSpec(ctx, svc.Spec.Service); err != nil && !isSMCode(err, codeServiceNotFound) {
+			return errors.Wrap(err, "")
+		}
+		var finalizers []string
+		for _, f := range svc.Metadata.Finalizers {
+			if f != finalizer {
+				finalizers = append(finalizers, f)
+			}
+		}
+		o.lg.Info("spec deleted", zap.String("service", svc.Spec.Service))
+		return o.kube.patchFinalizers(ctx, svc, finalizers)
+	}
+
+	// 先加finalizer，保证sm中的spec一定能被清理
+	if !svc.hasFinalizer() {
+		if err := o.kube.patchFinalizers(ctx, svc, append(svc.Metadata.Finalizers, finalizer)); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+
+	status := svc.Status
+	if svc.Metadata.Generation != status.ObservedGeneration {
+		if err := o.apply(ctx, svc); err != nil {
+			return errors.Wrap(err, "")
+		}
+		status.ObservedGeneration = svc.Metadata.Generation
+		status.Shards = svc.Spec.ShardCount
+	}
+	if len(svc.Spec.PodSelector) > 0 {
+		status.ReadyContainers = o.readyPods(svc.Spec.PodSelector)
+	}
+	if status == svc.Status {
+		return nil
+	}
+	return o.kube.patchStatus(ctx, svc, status)
+}
+
+// apply add-spec和add-shard-group都是幂等的，shard数量减少时不删除多出的shard
+func (o *operator) apply(ctx context.Context, svc *ShardedService) error {
+	spec := smSpec{
+		Service:               svc.Spec.Service,
+		MaxShardCount:         svc.Spec.MaxShardCount,
+		MaxRecoveryTime:       svc.Spec.MaxRecoveryTime,
+		MinimizeMovement:      svc.Spec.MinimizeMovement,
+		MaxShardsPerContainer: svc.Spec.MaxShardsPerContainer,
+		HealthProbe:           svc.Spec.HealthProbe,
+	}
+	group := smShardGroup{
+		Name:         svc.group(),
+		Count:        svc.Spec.ShardCount,
+		Task:         svc.Spec.Task,
+		ReplicaCount: svc.Spec.ReplicaCount,
+	}
+
+	create := spec
+	if group.Count > 0 {
+		create.ShardGroups = []*smShardGroup{&group}
+	}
+	err := o.sm.addSpec(ctx, &create)
+	if err == nil {
+		o.lg.Info("spec added", zap.String("service", spec.Service))
+		return nil
+	}
+	if !isSMCode(err, codeServiceExists) {
+		return errors.Wrap(err, "")
+	}
+
+	// update-spec整体替换spec，先读取sm中的spec和revision，只覆盖CR负责的字段，
+	// 读取之后spec被修改时revision不一致，update-spec失败后重新reconcile
+	current, err := o.sm.getSpec(ctx, spec.Service)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if err := spec.overlay(current); err != nil {
+		return errors.Wrap(err, "")
+	}
+	if err := o.sm.updateSpec(ctx, current); err != nil {
+		return errors.Wrap(err, "")
+	}
+	if group.Count > 0 {
+		if err := o.sm.addShardGroup(ctx, spec.Service, &group); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	o.lg.Info("spec updated", zap.String("service", spec.Service))
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smoperator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeServer 记录请求，按照path返回预设的结果
+type fakeServer struct {
+	mu        sync.Mutex
+	requests  []string
+	bodies    map[string]string
+	responses map[string]func(w http.ResponseWriter)
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{bodies: make(map[string]string), responses: make(map[string]func(w http.ResponseWriter))}
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, _ := ioutil.ReadAll(r.Body)
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.bodies[r.URL.Path] = string(b)
+	if fn, ok := s.responses[r.URL.Path]; ok {
+		fn(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("{}"))
+}
+
+func Test_operator_reconcile(t *testing.T) {
+	svc := ShardedService{
+		Metadata: objectMeta{Name: "orders", Namespace: "default", Generation: 2},
+		Spec:     ShardedServiceSpec{Service: "orders.dev", ShardCount: 4, PodSelector: map[string]string{"app": "orders"}},
+		Status:   ShardedServiceStatus{ObservedGeneration: 1},
+	}
+
+	kube := newFakeServer()
+	kubeSrv := httptest.NewServer(kube)
+	defer kubeSrv.Close()
+
+	// service已经存在，走update-spec和add-shard-group，sm中设置的frozen和rebalanceWindows保持不变
+	sm := newFakeServer()
+	sm.responses["/sm/server/add-spec"] = func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"code":"SERVICE_EXISTS","error":"etcd: node exist"}`))
+	}
+	sm.responses["/sm/server/get-spec"] = func(w http.ResponseWriter) {
+		_, _ = w.Write([]byte(`{"spec":{"service":"orders.dev","createTime":1646092800123,"maxShardCount":5,"frozen":true,"rebalanceWindows":["01:00-02:00"],"revision":42}}`))
+	}
+	smSrv := httptest.NewServer(sm)
+	defer smSrv.Close()
+
+	lg, _ := zap.NewDevelopment()
+	o := newOperator(lg, newKubeClient(kubeSrv.URL, "", nil), newSMClient(smSrv.URL, ""), "default")
+	b, _ := json.Marshal(svc)
+	if err := o.replaceServices([]json.RawMessage{b}); err != nil {
+		t.Fatal(err)
+	}
+	// pod没有同步之前不reconcile
+	o.process(context.TODO())
+	assert.Empty(t, sm.requests)
+
+	pods := []json.RawMessage{
+		json.RawMessage(`{"metadata":{"name":"orders-0","labels":{"app":"orders"}},"status":{"phase":"Running","conditions":[{"type":"Ready","status":"True"}]}}`),
+		json.RawMessage(`{"metadata":{"name":"orders-1","labels":{"app":"orders"}},"status":{"phase":"Pending"}}`),
+		json.RawMessage(`{"metadata":{"name":"users-0","labels":{"app":"users"}},"status":{"phase":"Running","conditions":[{"type":"Ready","status":"True"}]}}`),
+	}
+	if err := o.replacePods(pods); err != nil {
+		t.Fatal(err)
+	}
+	o.process(context.TODO())
+
+	assert.Equal(t, []string{
+		"POST /sm/server/add-spec",
+		"GET /sm/server/get-spec",
+		"POST /sm/server/update-spec",
+		"POST /sm/server/add-shard-group",
+	}, sm.requests)
+	assert.JSONEq(t, `{"service":"orders.dev","createTime":1646092800123,"maxShardCount":0,"maxRecoveryTime":0,"minimizeMovement":false,"maxShardsPerContainer":0,"healthProbe":false,"frozen":true,"rebalanceWindows":["01:00-02:00"],"revision":42}`,
+		sm.bodies["/sm/server/update-spec"])
+	assert.JSONEq(t, `{"service":"orders.dev","group":{"name":"shard","count":4,"task":"","replicaCount":0}}`, sm.bodies["/sm/server/add-shard-group"])
+
+	assert.JSONEq(t, `{"metadata":{"finalizers":["sm.entertainment-venue.io/del-spec"]}}`,
+		kube.bodies["/apis/sm.entertainment-venue.io/v1alpha1/namespaces/default/shardedservices/orders"])
+	assert.JSONEq(t, `{"status":{"observedGeneration":2,"shards":4,"readyContainers":1}}`,
+		kube.bodies["/apis/sm.entertainment-venue.io/v1alpha1/namespaces/default/shardedservices/orders/status"])
+}
+
+func Test_operator_reconcileDeleting(t *testing.T) {
+	ts := "2022-03-01T00:00:00Z"
+	svc := ShardedService{
+		Metadata: objectMeta{Name: "orders", Namespace: "default", DeletionTimestamp: &ts, Finalizers: []string{finalizer}},
+		Spec:     ShardedServiceSpec{Service: "orders.dev"},
+	}
+
+	kube := newFakeServer()
+	kubeSrv := httptest.NewServer(kube)
+	defer kubeSrv.Close()
+	sm := newFakeServer()
+	smSrv := httptest.NewServer(sm)
+	defer smSrv.Close()
+
+	lg, _ := zap.NewDevelopment()
+	o := newOperator(lg, newKubeClient(kubeSrv.URL, "", nil), newSMClient(smSrv.URL, ""), "default")
+	if err := o.reconcileOne(context.TODO(), &svc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"GET /sm/server/del-spec"}, sm.requests)
+	assert.JSONEq(t, `{"metadata":{"finalizers":null}}`,
+		kube.bodies["/apis/sm.entertainment-venue.io/v1alpha1/namespaces/default/shardedservices/orders"])
+}
+
+func Test_operator_applyPod(t *testing.T) {
+	lg, _ := zap.NewDevelopment()
+	o := newOperator(lg, nil, nil, "default")
+	for _, name := range []string{"orders", "users"} {
+		b, _ := json.Marshal(ShardedService{
+			Metadata: objectMeta{Name: name, Namespace: "default"},
+			Spec:     ShardedServiceSpec{PodSelector: map[string]string{"app": name}},
+		})
+		if err := o.applyService("ADDED", b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.queue.take()
+
+	ready := `{"metadata":{"name":"p0","labels":{"app":"%s"}},"status":{"phase":"Running","conditions":[{"type":"Ready","status":"True"}]}}`
+	assert.Nil(t, o.applyPod("ADDED", json.RawMessage(fmt.Sprintf(ready, "orders"))))
+	assert.Equal(t, []string{"orders"}, o.queue.take())
+	assert.Equal(t, 1, o.readyPods(map[string]string{"app": "orders"}))
+
+	// label变化时新旧两个ShardedService都需要更新
+	assert.Nil(t, o.applyPod("MODIFIED", json.RawMessage(fmt.Sprintf(ready, "users"))))
+	names := o.queue.take()
+	sort.Strings(names)
+	assert.Equal(t, []string{"orders", "users"}, names)
+	assert.Equal(t, 0, o.readyPods(map[string]string{"app": "orders"}))
+	assert.Equal(t, 1, o.readyPods(map[string]string{"app": "users"}))
+
+	assert.Nil(t, o.applyPod("DELETED", json.RawMessage(fmt.Sprintf(ready, "users"))))
+	assert.Equal(t, []string{"users"}, o.queue.take())
+	assert.Equal(t, 0, o.readyPods(map[string]string{"app": "users"}))
+}
+
+func Test_kubeClient_watch(t *testing.T) {
+	var query url.Values
+	events := []string{
+		`{"type":"ADDED","object":{"metadata":{"name":"orders","resourceVersion":"11"}}}`,
+		`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		for _, ev := range events {
+			_, _ = w.Write([]byte(ev + "\n"))
+		}
+	}))
+	defer srv.Close()
+
+	k := newKubeClient(srv.URL, "", nil)
+	var handled []string
+	rv, err := k.watch(context.TODO(), k.podPath("default"), "10", func(typ string, object json.RawMessage) error {
+		handled = append(handled, typ)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "12", rv)
+	assert.Equal(t, []string{"ADDED"}, handled)
+	assert.Equal(t, "true", query.Get("watch"))
+	assert.Equal(t, "10", query.Get("resourceVersion"))
+
+	// 版本过期时重新list
+	events = []string{`{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version"}}`}
+	rv, err = k.watch(context.TODO(), k.podPath("default"), "12", func(typ string, object json.RawMessage) error { return nil })
+	assert.ErrorIs(t, err, errResourceExpired)
+	assert.Equal(t, "12", rv)
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smoperator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sm返回的错误码，参考smserver的apiError
+const (
+	codeServiceExists   = "SERVICE_EXISTS"
+	codeServiceNotFound = "SERVICE_NOT_FOUND"
+)
+
+// smError sm接口返回的错误
+type smError struct {
+	Status int    `json:"-"`
+	Code   string `json:"code"`
+	Msg    string `json:"error"`
+}
+
+func (e *smError) Error() string {
+	return fmt.Sprintf("sm status %d code %s: %s", e.Status, e.Code, e.Msg)
+}
+
+func isSMCode(err error, code string) bool {
+	e, ok := errors.Cause(err).(*smError)
+	return ok && e.Code == code
+}
+
+type smShardGroup struct {
+	Name         string `json:"name"`
+	Count        int    `json:"count"`
+	Task         string `json:"task"`
+	ReplicaCount int    `json:"replicaCount"`
+}
+
+// smSpec ShardedService负责的spec字段，其他字段（Frozen、RebalanceWindows等）在sm中维护
+type smSpec struct {
+	Service               string          `json:"service"`
+	MaxShardCount         int             `json:"maxShardCount"`
+	MaxRecoveryTime       int             `json:"maxRecoveryTime"`
+	MinimizeMovement      bool            `json:"minimizeMovement"`
+	MaxShardsPerContainer int             `json:"maxShardsPerContainer"`
+	HealthProbe           bool            `json:"healthProbe"`
+	ShardGroups           []*smShardGroup `json:"shardGroups,omitempty"`
+}
+
+// overlay 把CR负责的字段写入sm中完整的spec，其他字段保持不变
+func (s *smSpec) overlay(current map[string]interface{}) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return errors.Wrap(err, "")
+	}
+	for key, value := range fields {
+		current[key] = value
+	}
+	return nil
+}
+
+// smClient 调用sm的/sm/server接口，开启leader转发时可以访问任意sm节点
+type smClient struct {
+	addr       string
+	token      string
+	httpClient *http.Client
+}
+
+func newSMClient(addr string, token string) *smClient {
+	return &smClient{
+		addr:       strings.TrimSuffix(addr, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: defaultRequestTimeout},
+	}
+}
+
+func (c *smClient) addSpec(ctx context.Context, spec *smSpec) error {
+	return c.post(ctx, "/sm/server/add-spec", spec)
+}
+
+// getSpec 返回sm中完整的spec，包含revision，smSpec中没有声明的字段原样保留
+func (c *smClient) getSpec(ctx context.Context, service string) (map[string]interface{}, error) {
+	var resp struct {
+		Spec map[string]interface{} `json:"spec"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/sm/server/get-spec?service="+url.QueryEscape(service), nil, &resp); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Spec == nil {
+		return nil, errors.Errorf("service %s spec empty", service)
+	}
+	return resp.Spec, nil
+}
+
+// updateSpec update-spec整体替换sm中的spec，spec需要是 getSpec 返回的完整spec
+func (c *smClient) updateSpec(ctx context.Context, spec map[string]interface{}) error {
+	return c.post(ctx, "/sm/server/update-spec", spec)
+}
+
+func (c *smClient) addShardGroup(ctx context.Context, service string, group *smShardGroup) error {
+	return c.post(ctx, "/sm/server/add-shard-group", map[string]interface{}{"service": service, "group": group})
+}
+
+// delSpec 资源删除时service的shard都由operator创建，一起drop并删除
+func (c *smClient) delSpec(ctx context.Context, service string) error {
+	return c.do(ctx, http.MethodGet, "/sm/server/del-spec?cascade=true&service="+url.QueryEscape(service), nil, nil)
+}
+
+func (c *smClient) post(ctx context.Context, pth string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	return c.do(ctx, http.MethodPost, pth, b, nil)
+}
+
+func (c *smClient) do(ctx context.Context, method string, pth string, body []byte, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+pth, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("X-SM-Token", c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		if result == nil {
+			return nil
+		}
+		// UseNumber 保证createTime、revision等int64字段原样写回
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		return errors.Wrap(decoder.Decode(result), "")
+	}
+	e := smError{Status: resp.StatusCode}
+	if err := json.Unmarshal(b, &e); err != nil {
+		e.Msg = string(b)
+	}
+	return errors.Wrap(&e, pth)
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smoperator
+
+import "encoding/json"
+
+const (
+	// crdGroup ShardedService所在的api group
+	crdGroup   = "sm.entertainment-venue.io"
+	crdVersion = "v1alpha1"
+	crdPlural  = "shardedservices"
+
+	// finalizer 删除ShardedService之前先删除sm中的spec
+	finalizer = crdGroup + "/del-spec"
+
+	// defaultGroup ShardedService没有指定group时shard id的前缀
+	defaultGroup = "shard"
+)
+
+// objectMeta 只解析operator使用的字段
+type objectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	Generation        int64             `json:"generation"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	DeletionTimestamp *string           `json:"deletionTimestamp,omitempty"`
+	Finalizers        []string          `json:"finalizers,omitempty"`
+}
+
+// ShardedService 声明一个接入sm的service以及shard数量
+type ShardedService struct {
+	Metadata objectMeta           `json:"metadata"`
+	Spec     ShardedServiceSpec   `json:"spec"`
+	Status   ShardedServiceStatus `json:"status"`
+}
+
+type ShardedServiceSpec struct {
+	// Service sm中的service名称
+	Service string `json:"service"`
+
+	// ShardCount 生成 <group>-0 到 <group>-<shardCount-1> 的shard
+	ShardCount int    `json:"shardCount"`
+	Group      string `json:"group"`
+
+	// Task 所有shard共用的task，为空时使用shard序号
+	Task         string `json:"task"`
+	ReplicaCount int    `json:"replicaCount"`
+
+	// 以下字段和sm的spec保持一致
+	MaxShardCount         int  `json:"maxShardCount"`
+	MaxRecoveryTime       int  `json:"maxRecoveryTime"`
+	MinimizeMovement      bool `json:"minimizeMovement"`
+	MaxShardsPerContainer int  `json:"maxShardsPerContainer"`
+	HealthProbe           bool `json:"healthProbe"`
+
+	// PodSelector service的container所在pod的label，用于统计ready的container
+	PodSelector map[string]string `json:"podSelector"`
+}
+
+type ShardedServiceStatus struct {
+	// ObservedGeneration 已经同步到sm的generation，相同时不重复调用sm接口
+	ObservedGeneration int64 `json:"observedGeneration"`
+	Shards             int   `json:"shards"`
+	ReadyContainers    int   `json:"readyContainers"`
+}
+
+func (s *ShardedService) group() string {
+	if s.Spec.Group != "" {
+		return s.Spec.Group
+	}
+	return defaultGroup
+}
+
+func (s *ShardedService) deleting() bool {
+	return s.Metadata.DeletionTimestamp != nil
+}
+
+func (s *ShardedService) hasFinalizer() bool {
+	for _, f := range s.Metadata.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ShardedService) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// listMeta list返回的resourceVersion，watch从这个版本开始
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// rawList item按照类型在informer的回调中解析
+type rawList struct {
+	Metadata listMeta          `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+// watchEvent watch返回的事件，Type是ADDED、MODIFIED、DELETED、BOOKMARK或者ERROR
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watchStatus ERROR事件的object，410说明resourceVersion已经过期
+type watchStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// pod 只解析判断ready以及匹配selector需要的字段
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+	Status   struct {
+		Phase      string `json:"phase"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func (p *pod) ready() bool {
+	if p.Status.Phase != "Running" {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// matches pod的label包含selector中所有的label
+func (p *pod) matches(selector map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for key, value := range selector {
+		if p.Metadata.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// apiAccessLog 每个 /sm/server 请求输出一条结构化日志，开启audit时修改类的请求同时写入事件日志
+type apiAccessLog struct {
+	lg        *zap.Logger
+	container *smContainer
+
+	// audit 修改类请求（非GET）写入 eventLog，可以通过events接口查询
+	audit bool
+}
+
+func newApiAccessLog(lg *zap.Logger, container *smContainer, audit bool) *apiAccessLog {
+	return &apiAccessLog{lg: lg, container: container, audit: audit}
+}
+
+func (a *apiAccessLog) wrap(handler func(c *gin.Context)) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		start := time.Now()
+		digest := payloadDigest(c)
+		// handler中可能转发请求，提前记录
+		service := requestService(c)
+
+		handler(c)
+
+		status := c.Writer.Status()
+		latency := time.Since(start)
+		a.lg.Info(
+			"api access",
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("query", c.Request.URL.RawQuery),
+			zap.String("remote", c.ClientIP()),
+			zap.String("caller", apiCaller(c)),
+			zap.String("service", service),
+			zap.String("payloadDigest", digest),
+			zap.Duration("latency", latency),
+			zap.Int("status", status),
+			zap.String("forwardedBy", c.GetHeader(forwardedHeader)),
+		)
+
+		if !a.audit || !mutating(c.Request.Method) {
+			return
+		}
+		// 转发给其他节点的请求由实际处理的节点记录，forward会把当前节点的id写入header
+		if by := c.GetHeader(forwardedHeader); by != "" && by == a.container.Id() {
+			return
+		}
+		if service == "" {
+			service = a.container.Service()
+		}
+		a.container.events.append(
+			eventApiCall,
+			service,
+			c.ClientIP(),
+			fmt.Sprintf("%s %s caller %s status %d payload %s latency %s", c.Request.Method, c.Request.URL.Path, apiCaller(c), status, digest, latency),
+		)
+	}
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// payloadDigest body的sha256，日志中不输出body原文，防止泄露webhook secret等敏感内容
+func payloadDigest(c *gin.Context) string {
+	if c.Request.Body == nil {
+		return ""
+	}
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+	if len(b) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// apiCaller token只输出摘要，没有token时为空，调用方通过remote区分
+func apiCaller(c *gin.Context) string {
+	token := c.GetHeader(headerToken)
+	if token == "" {
+		token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:])[:8]
+	}
+	return ""
+}
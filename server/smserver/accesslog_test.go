@@ -0,0 +1,54 @@
+package smserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_apiAccessLog_wrap(t *testing.T) {
+	client := new(MockedEtcdWrapper)
+	container := &smContainer{
+		lg:          ttLogger,
+		Container:   &apputil.Container{},
+		nodeManager: &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")},
+	}
+	container.Client = client
+	container.events = newEventLog(ttLogger, container)
+	client.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+
+	var body string
+	router := gin.New()
+	handler := newApiAccessLog(ttLogger, container, true).wrap(func(c *gin.Context) {
+		b, _ := ioutil.ReadAll(c.Request.Body)
+		body = string(b)
+		c.JSON(http.StatusOK, gin.H{})
+	})
+	router.Any("/sm/server/add-shard", handler)
+
+	// 读取过的body需要还给handler，修改类请求写入事件日志
+	payload := `{"service":"foo.bar","shardId":"s1"}`
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBufferString(payload))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if body != payload {
+		t.Errorf("unexpected body %s", body)
+		t.SkipNow()
+	}
+	pfx := container.nodeManager.nodeServiceEvent("foo.bar")
+	client.AssertCalled(t, "Put", mock.Anything, mock.MatchedBy(func(key string) bool { return strings.HasPrefix(key, pfx) }), mock.MatchedBy(func(val string) bool {
+		return strings.Contains(val, `"type":"apiCall"`) && strings.Contains(val, "status 200")
+	}), mock.Anything)
+
+	// 查询类请求不写入
+	req = httptest.NewRequest(http.MethodGet, "/sm/server/add-shard?service=foo.bar", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	client.AssertNumberOfCalls(t, "Put", 1)
+}
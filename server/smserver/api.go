@@ -19,9 +19,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -32,6 +35,9 @@ type smAppSpec struct {
 	// Service 目前app的spec更多承担的是管理职能，shard配置的一个起点，先只配置上service，可以唯一标记一个app
 	Service string `json:"service"`
 
+	// Parent 父service，多个app组成一个产品时，冻结、drain和导出父service会同时作用到所有子service，为空是根节点
+	Parent string `json:"parent,omitempty"`
+
 	CreateTime int64 `json:"createTime"`
 
 	// MaxShardCount 单container承载的最大分片数量，防止雪崩
@@ -39,6 +45,68 @@ type smAppSpec struct {
 
 	// MaxRecoveryTime 遇到container删除的场景，等待的时间，超时认为该container被清理
 	MaxRecoveryTime int `json:"maxRecoveryTime"`
+
+	// MinimizeMovement rebalance时尽量保留现有shard和container的分配关系，只移动恢复均衡所需的差量
+	MinimizeMovement bool `json:"minimizeMovement"`
+
+	// MaxShardsPerContainer 单container最多分配的shard数量，container不足时多出的shard不分配，<=0不限制
+	MaxShardsPerContainer int `json:"maxShardsPerContainer"`
+
+	// HealthProbe leader通过http探测container，连续失败的container上的shard会被重新分配
+	HealthProbe bool `json:"healthProbe"`
+
+	// HeartbeatInterval container上报heartbeat的间隔，单位秒，为0使用默认值，container重启后生效
+	HeartbeatInterval int `json:"heartbeatInterval"`
+
+	// SessionTTL container的session ttl，单位秒，决定container丢失后多久能被发现，为0使用默认值，container重启后生效
+	SessionTTL int `json:"sessionTTL"`
+
+	// SpreadPolicy 为zone时同一个shard的副本尽量分布在不同zone，rebalance时移动的shard优先留在原zone，为空不区分zone
+	SpreadPolicy string `json:"spreadPolicy"`
+
+	// DeploymentPolicy 按照container上报的deployment分配：spread时同一个shard的副本尽量分布在不同deployment，
+	// newest时shard集中到最新的deployment，旧deployment的container上的shard被移走，为空不区分deployment
+	DeploymentPolicy string `json:"deploymentPolicy,omitempty"`
+
+	// Frozen 冻结时leader继续观察service的状态，但是不下发任何move，用于故障处理时防止自动迁移扩大影响
+	Frozen bool `json:"frozen"`
+
+	// Assignor 为binpack时按照container声明的capacity和shard的loadEstimate分配，为空使用默认的按数量均衡
+	Assignor string `json:"assignor"`
+
+	// ShardDefaults add-shard时请求中没有设置的字段使用这里的默认值
+	ShardDefaults *shardDefaults `json:"shardDefaults,omitempty"`
+
+	// ShardGroups add-spec时批量声明shard，不需要逐个调用add-shard
+	ShardGroups []*shardGroup `json:"shardGroups,omitempty"`
+
+	// MoveConcurrency 同一个container同时处理的add/drop请求数量，<=0时为1
+	MoveConcurrency int `json:"moveConcurrency,omitempty"`
+
+	// TaskSchema JSON Schema的子集，设置后add shard时要求Task是满足schema的json
+	TaskSchema json.RawMessage `json:"taskSchema,omitempty"`
+
+	// MoveCooldown shard移动后的冷却时间，单位s，冷却中的shard所在container存活时不参与rebalance，为0不限制
+	MoveCooldown int `json:"moveCooldown,omitempty"`
+
+	// Canary 设置后rebalance先移动一部分shard，观察窗口内健康再移动剩余的shard
+	Canary *canarySpec `json:"canary,omitempty"`
+
+	// Warmup 设置后新启动的container分批接收shard，防止所有shard同时预热
+	Warmup *warmupSpec `json:"warmup,omitempty"`
+
+	// RebalanceInterval leader周期检查rebalance的间隔，单位s，为0使用默认的3s
+	RebalanceInterval int `json:"rebalanceInterval,omitempty"`
+
+	// RebalanceDebounce container加入或丢失后等待的时间，单位ms，窗口内的变化合并为一次rebalance，为0只周期检查
+	RebalanceDebounce int `json:"rebalanceDebounce,omitempty"`
+
+	// RebalanceWindows 允许移动存活container上shard的时间窗口，例如 "0 2 * * 1-5 2h"，为空不限制，
+	// 窗口之外只做故障转移和新增shard的分配
+	RebalanceWindows []string `json:"rebalanceWindows,omitempty"`
+
+	// Revision get-spec返回etcd中的ModRevision，update-spec带上时做乐观锁校验，为0不校验，不持久化
+	Revision int64 `json:"revision,omitempty"`
 }
 
 func (s *smAppSpec) String() string {
@@ -46,14 +114,299 @@ func (s *smAppSpec) String() string {
 	return string(b)
 }
 
+// validateHeartbeat heartbeat间隔不小于ttl时，container的session会在两次heartbeat之间过期
+// redacted 日志使用的副本，shard group中的task可能包含敏感信息，不能以明文记录
+func (s *smAppSpec) redacted() *smAppSpec {
+	r := *s
+	r.ShardGroups = nil
+	for _, g := range s.ShardGroups {
+		r.ShardGroups = append(r.ShardGroups, g.redacted())
+	}
+	return &r
+}
+
+func (s *smAppSpec) validateHeartbeat() error {
+	if s.HeartbeatInterval < 0 || s.SessionTTL < 0 {
+		return errors.New("heartbeatInterval and sessionTTL should not be negative")
+	}
+	if s.HeartbeatInterval > 0 && s.SessionTTL > 0 && s.HeartbeatInterval >= s.SessionTTL {
+		return errors.Errorf("heartbeatInterval %d should be less than sessionTTL %d", s.HeartbeatInterval, s.SessionTTL)
+	}
+	return nil
+}
+
+func (s *smAppSpec) validateSpreadPolicy() error {
+	if s.SpreadPolicy != "" && s.SpreadPolicy != spreadPolicyZone {
+		return errors.Errorf("unknown spreadPolicy %s", s.SpreadPolicy)
+	}
+	switch s.DeploymentPolicy {
+	case "", deploymentPolicyNewest:
+	case deploymentPolicySpread:
+		// 副本只能按照一个维度分散
+		if s.SpreadPolicy != "" {
+			return errors.Errorf("deploymentPolicy %s conflicts with spreadPolicy %s", s.DeploymentPolicy, s.SpreadPolicy)
+		}
+	default:
+		return errors.Errorf("unknown deploymentPolicy %s", s.DeploymentPolicy)
+	}
+	return nil
+}
+
+func (s *smAppSpec) validateShardDefaults() error {
+	if s.ShardDefaults == nil {
+		return nil
+	}
+	return s.ShardDefaults.Validate()
+}
+
+func (s *smAppSpec) validateMoveCooldown() error {
+	if s.MoveCooldown < 0 {
+		return errors.New("moveCooldown should not be negative")
+	}
+	return nil
+}
+
+func (s *smAppSpec) validateRebalance() error {
+	if s.RebalanceInterval < 0 || s.RebalanceDebounce < 0 {
+		return errors.New("rebalanceInterval and rebalanceDebounce should not be negative")
+	}
+	return validateRebalanceWindows(s.RebalanceWindows)
+}
+
+func (s *smAppSpec) validateCanary() error {
+	if s.Canary == nil {
+		return nil
+	}
+	return s.Canary.Validate()
+}
+
+func (s *smAppSpec) validateWarmup() error {
+	if s.Warmup == nil {
+		return nil
+	}
+	return s.Warmup.Validate()
+}
+
+func (s *smAppSpec) validateAssignor() error {
+	if s.Assignor != "" && s.Assignor != assignorBinpack {
+		return errors.Errorf("unknown assignor %s", s.Assignor)
+	}
+	return nil
+}
+
+// validate 依次执行所有的spec校验，用于校验不经过add-spec写入的spec，例如restore
+func (s *smAppSpec) validate() error {
+	for _, fn := range []func() error{
+		s.validateHeartbeat,
+		s.validateSpreadPolicy,
+		s.validateShardDefaults,
+		s.validateMoveCooldown,
+		s.validateRebalance,
+		s.validateCanary,
+		s.validateWarmup,
+		s.validateAssignor,
+		s.validateTaskSchema,
+	} {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appConfig container启动时从etcd读取
+func (s *smAppSpec) appConfig() *apputil.AppConfig {
+	return &apputil.AppConfig{HeartbeatInterval: s.HeartbeatInterval, SessionTTL: s.SessionTTL}
+}
+
+// shardGroup 声明一组partition，sm生成 <name>-0 到 <name>-<count-1> 的shard id，
+// 生成的shard使用name作为balance的group
+type shardGroup struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+
+	// Task 所有partition共用的task，为空时使用partition序号
+	Task string `json:"task"`
+
+	ReplicaCount int `json:"replicaCount"`
+
+	Priority int `json:"priority"`
+
+	LoadEstimate int `json:"loadEstimate"`
+
+	Weight int `json:"weight"`
+
+	// Resources 每个partition需要预留的资源
+	Resources *apputil.Resources `json:"resources,omitempty"`
+
+	// Warmup 每个partition的预热时间，单位s
+	Warmup int `json:"warmup,omitempty"`
+
+	// Constraint 所有partition共用的placement约束
+	Constraint string `json:"constraint"`
+}
+
+// shardTaskPlaceholder 默认task中的占位符，替换为shard的id
+const shardTaskPlaceholder = "{shardId}"
+
+// shardDefaults service级别的shard模板，值为0的字段和请求中的0一样视为没有设置
+type shardDefaults struct {
+	// Task task模板，支持 {shardId} 占位符
+	Task string `json:"task"`
+
+	Group string `json:"group"`
+
+	ReplicaCount int `json:"replicaCount"`
+
+	Priority int `json:"priority"`
+
+	// LoadEstimate 资源提示，binpack分配时使用
+	LoadEstimate int `json:"loadEstimate"`
+
+	// Weight 默认分配方式下shard的权重
+	Weight int `json:"weight"`
+
+	// Resources shard需要预留的资源
+	Resources *apputil.Resources `json:"resources,omitempty"`
+
+	// Warmup shard的预热时间，单位s
+	Warmup int `json:"warmup,omitempty"`
+
+	// Constraint placement约束
+	Constraint string `json:"constraint"`
+}
+
+func (d *shardDefaults) Validate() error {
+	if d.ReplicaCount < 0 || d.LoadEstimate < 0 || d.Weight < 0 || d.Warmup < 0 {
+		return errors.New("shardDefaults replicaCount, loadEstimate, weight and warmup should not be negative")
+	}
+	if err := validateResources(d.Resources); err != nil {
+		return errors.Wrap(err, "shardDefaults")
+	}
+	return validateConstraint(d.Constraint)
+}
+
+// apply 只填充spec中没有设置的字段，请求中显式设置的值优先
+func (d *shardDefaults) apply(shardId string, spec *apputil.ShardSpec) {
+	if d == nil {
+		return
+	}
+	if spec.Task == "" {
+		spec.Task = strings.ReplaceAll(d.Task, shardTaskPlaceholder, shardId)
+	}
+	if spec.Group == "" {
+		spec.Group = d.Group
+	}
+	if spec.ReplicaCount == 0 {
+		spec.ReplicaCount = d.ReplicaCount
+	}
+	if spec.Priority == 0 {
+		spec.Priority = d.Priority
+	}
+	if spec.LoadEstimate == 0 {
+		spec.LoadEstimate = d.LoadEstimate
+	}
+	if spec.Weight == 0 {
+		spec.Weight = d.Weight
+	}
+	if spec.Resources == nil {
+		spec.Resources = d.Resources
+	}
+	if spec.Warmup == 0 {
+		spec.Warmup = d.Warmup
+	}
+	if spec.Constraint == "" {
+		spec.Constraint = d.Constraint
+	}
+}
+
+// validatePreferredContainers container id不能为空或者重复
+func validatePreferredContainers(preferred []string) error {
+	seen := make(map[string]struct{})
+	for _, id := range preferred {
+		if id == "" {
+			return errors.New("empty preferred container")
+		}
+		if _, ok := seen[id]; ok {
+			return errors.Errorf("duplicate preferred container %s", id)
+		}
+		seen[id] = struct{}{}
+	}
+	return nil
+}
+
+func (g *shardGroup) Validate() error {
+	if g.Name == "" {
+		return errors.New("empty group name")
+	}
+	// 生成的shard id是 <name>-<序号>
+	if err := apputil.ValidateShardId(g.Name); err != nil {
+		return errors.Wrap(err, "group name")
+	}
+	if g.Count <= 0 || g.Count > maxShardGroupCount {
+		return errors.Errorf("group %s count should be in (0, %d]", g.Name, maxShardGroupCount)
+	}
+	if g.Weight < 0 || g.Warmup < 0 {
+		return errors.Errorf("group %s weight and warmup should not be negative", g.Name)
+	}
+	if err := validateResources(g.Resources); err != nil {
+		return errors.Wrapf(err, "group %s", g.Name)
+	}
+	return validateConstraint(g.Constraint)
+}
+
+// redacted 日志和事件使用的副本，去掉task
+func (g *shardGroup) redacted() *shardGroup {
+	r := *g
+	r.Task = ""
+	return &r
+}
+
+// shardIds 生成partition对应的shard id
+func (g *shardGroup) shardIds() []string {
+	var r []string
+	for i := 0; i < g.Count; i++ {
+		r = append(r, fmt.Sprintf("%s-%d", g.Name, i))
+	}
+	return r
+}
+
+// shardSpecs key是shard id
+func (g *shardGroup) shardSpecs(service string) map[string]*apputil.ShardSpec {
+	r := make(map[string]*apputil.ShardSpec)
+	for idx, shardId := range g.shardIds() {
+		task := g.Task
+		if task == "" {
+			task = strconv.Itoa(idx)
+		}
+		r[shardId] = &apputil.ShardSpec{
+			Service:      service,
+			Task:         task,
+			UpdateTime:   time.Now().Unix(),
+			Group:        g.Name,
+			ReplicaCount: g.ReplicaCount,
+			Priority:     g.Priority,
+			LoadEstimate: g.LoadEstimate,
+			Weight:       g.Weight,
+			Resources:    g.Resources,
+			Warmup:       g.Warmup,
+			Constraint:   g.Constraint,
+		}
+	}
+	return r
+}
+
 type smShardApi struct {
 	container *smContainer
 
 	lg *zap.Logger
+
+	// httpClient 父service的操作分发给子service的governor
+	httpClient *http.Client
 }
 
 func newSMShardApi(container *smContainer) *smShardApi {
-	return &smShardApi{container: container, lg: container.lg}
+	return &smShardApi{container: container, lg: container.lg, httpClient: newHttpClient()}
 }
 
 // @Description add spec
@@ -67,38 +420,231 @@ func (ss *smShardApi) GinAddSpec(c *gin.Context) {
 	var req smAppSpec
 	if err := c.ShouldBind(&req); err != nil {
 		ss.lg.Error("ShouldBind err", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeParam, err)
 		return
 	}
 	req.CreateTime = time.Now().Unix()
-	ss.lg.Info("receive add spec request", zap.Reflect("request", req))
+	ss.lg.Info("receive add spec request", zap.Reflect("request", req.redacted()))
 
 	// sm的service是保留service，在程序启动的时候初始化
 	if req.Service == ss.container.Service() {
 		err := errors.Errorf("Same as shard manager's service")
 		ss.lg.Error("service error", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeReservedService, err)
+		return
+	}
+	for _, g := range req.ShardGroups {
+		if err := g.Validate(); err != nil {
+			ss.lg.Error("shard group error", zap.Error(err))
+			apiErrorResponse(c, errCodeParam, err)
+			return
+		}
+	}
+	if err := req.validateHeartbeat(); err != nil {
+		ss.lg.Error("heartbeat error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateSpreadPolicy(); err != nil {
+		ss.lg.Error("spread policy error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateAssignor(); err != nil {
+		ss.lg.Error("assignor error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateShardDefaults(); err != nil {
+		ss.lg.Error("shard defaults error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateTaskSchema(); err != nil {
+		ss.lg.Error("task schema error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateCanary(); err != nil {
+		ss.lg.Error("canary error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateWarmup(); err != nil {
+		ss.lg.Error("warmup error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
 		return
 	}
+	if err := req.validateMoveCooldown(); err != nil {
+		ss.lg.Error("move cooldown error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateRebalance(); err != nil {
+		ss.lg.Error("rebalance error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if code, err := ss.checkParent(context.TODO(), &req); err != nil {
+		ss.lg.Error("parent error", zap.Error(err))
+		apiErrorResponse(c, code, err)
+		return
+	}
+	var groupShards int
+	for _, g := range req.ShardGroups {
+		specs := g.shardSpecs(req.Service)
+		if err := ss.validateShards(&req, specs); err != nil {
+			ss.lg.Error("validateShards err", zap.Error(err))
+			apiErrorResponse(c, errCodeInvalidTask, err)
+			return
+		}
+		groupShards += len(specs)
+	}
+	tenant := requestTenant(c)
+	if err := ss.checkServiceQuota(context.TODO(), tenant, 1); err != nil {
+		ss.lg.Error("checkServiceQuota err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, quotaErrCode(err), err)
+		return
+	}
+	if err := ss.checkShardQuota(context.TODO(), tenant, req.Service, groupShards); err != nil {
+		ss.lg.Error("checkShardQuota err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, quotaErrCode(err), err)
+		return
+	}
+
+	if err := ss.createSpec(&req, tenant); err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeServiceExists), err)
+		return
+	}
+	ss.container.events.append(eventSpecChange, req.Service, c.ClientIP(), "add spec "+req.redacted().String())
+
+	// shard数量可能超过etcd单个txn的限制，spec创建成功后逐个创建
+	for _, g := range req.ShardGroups {
+		if err := ss.createShardGroup(req.Service, g); err != nil {
+			ss.lg.Error("createShardGroup err",
+				zap.String("service", req.Service),
+				zap.Reflect("group", g.redacted()),
+				zap.Error(err),
+			)
+			apiErrorResponse(c, etcdErrCode(err, errCodeShardExists), err)
+			return
+		}
+	}
+	ss.lg.Info("add spec success", zap.String("service", req.Service))
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// createShardGroup 已经存在的shard跳过，失败后可以通过add-shard-group重试
+func (ss *smShardApi) createShardGroup(service string, g *shardGroup) error {
+	for shardId, spec := range g.shardSpecs(service) {
+		if err := ss.container.encryptTask(spec); err != nil {
+			return errors.Wrap(err, "")
+		}
+		node := ss.container.nodeManager.nodeServiceShard(service, shardId)
+		err := ss.container.Client.CreateAndGet(context.Background(), []string{node}, []string{spec.String()}, clientv3.NoLease)
+		if err != nil && err != etcdutil.ErrEtcdNodeExist {
+			return errors.Wrap(err, "")
+		}
+	}
+	return nil
+}
+
+type addShardGroupRequest struct {
+	Service string `json:"service" binding:"required"`
+
+	Group *shardGroup `json:"group" binding:"required"`
+}
 
-	//  写入app spec和app task节点在一个tx
+// @Description add shard group to existing service, existing shards are skipped
+// @Tags  shard
+// @Accept  json
+// @Produce  json
+// @Param param body addShardGroupRequest true "param"
+// @success 200
+// @Router /sm/server/add-shard-group [post]
+func (ss *smShardApi) GinAddShardGroup(c *gin.Context) {
+	var req addShardGroupRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.Group.Validate(); err != nil {
+		ss.lg.Error("shard group error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if req.Service == ss.container.Service() {
+		err := errors.Errorf("same as shard manager's service")
+		ss.lg.Error("service error", zap.Error(err))
+		apiErrorResponse(c, errCodeReservedService, err)
+		return
+	}
+	if _, err := ss.container.GetShard(req.Service); err != nil {
+		err := errors.Errorf("service[%s] not exist", req.Service)
+		ss.lg.Error("service error", zap.Error(err))
+		apiErrorResponse(c, errCodeServiceNotFound, err)
+		return
+	}
+	appSpec, err := ss.getAppSpec(context.TODO(), req.Service)
+	if err != nil {
+		ss.lg.Error("getAppSpec err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if appSpec == nil {
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not exist", req.Service))
+		return
+	}
+	specs := req.Group.shardSpecs(req.Service)
+	if err := ss.validateShards(appSpec, specs); err != nil {
+		ss.lg.Error("validateShards err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, errCodeInvalidTask, err)
+		return
+	}
+	// 已经存在的shard也计算在内，接近上限时需要分批添加
+	if err := ss.checkShardQuota(context.TODO(), requestTenant(c), req.Service, len(specs)); err != nil {
+		ss.lg.Error("checkShardQuota err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, quotaErrCode(err), err)
+		return
+	}
+
+	if err := ss.createShardGroup(req.Service, req.Group); err != nil {
+		ss.lg.Error("createShardGroup err",
+			zap.String("service", req.Service),
+			zap.Reflect("group", req.Group.redacted()),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeShardExists), err)
+		return
+	}
+	b, _ := json.Marshal(req.Group.redacted())
+	ss.container.events.append(eventSpecChange, req.Service, c.ClientIP(), "add shard group "+string(b))
+	ss.lg.Info("add shard group success", zap.String("service", req.Service), zap.Reflect("group", req.Group.redacted()))
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// putAppConfig 把heartbeat相关配置写到service自己的prefix下，container不需要知道sm的service
+// createSpec 写入app spec和app task节点在一个tx，service已经存在时返回 etcdutil.ErrEtcdNodeExist，
+// owner是创建service的租户，记录在task中
+func (ss *smShardApi) createSpec(spec *smAppSpec, owner string) error {
 	var (
 		nodes  []string
 		values []string
 	)
 
 	// 业务节点的service放在sm的pfx下面
-	nodes = append(nodes, ss.container.nodeManager.nodeServiceSpec(req.Service))
-	values = append(values, req.String())
+	nodes = append(nodes, ss.container.nodeManager.nodeServiceSpec(spec.Service))
+	values = append(values, spec.String())
 
 	// 需要将service注册到sm的spec中
-	t := shardTask{GovernedService: req.Service}
+	t := shardTask{GovernedService: spec.Service, Owner: owner}
 	v := apputil.ShardSpec{
 		Service:    ss.container.Service(),
 		Task:       t.String(),
 		UpdateTime: time.Now().Unix(),
 	}
-	nodes = append(nodes, ss.container.nodeManager.nodeServiceShard(ss.container.Service(), req.Service))
+	nodes = append(nodes, ss.container.nodeManager.nodeServiceShard(ss.container.Service(), spec.Service))
 	values = append(values, v.String())
 	if err := ss.container.Client.CreateAndGet(context.Background(), nodes, values, clientv3.NoLease); err != nil {
 		ss.lg.Error("CreateAndGet err",
@@ -106,18 +652,46 @@ func (ss *smShardApi) GinAddSpec(c *gin.Context) {
 			zap.Strings("values", values),
 			zap.Error(err),
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return errors.Wrap(err, "")
 	}
-	ss.lg.Info("add spec success", zap.String("service", req.Service))
-	c.JSON(http.StatusOK, gin.H{})
+	return errors.Wrap(ss.putAppConfig(spec), "")
 }
 
-// @Description del spec
+func (ss *smShardApi) putAppConfig(spec *smAppSpec) error {
+	pfx := ss.container.nodeManager.nodeServiceConfig(spec.Service)
+	if err := ss.container.Client.UpdateKV(context.Background(), pfx, spec.appConfig().String()); err != nil {
+		ss.lg.Error("UpdateKV err",
+			zap.String("pfx", pfx),
+			zap.Reflect("appConfig", spec.appConfig()),
+			zap.Error(err),
+		)
+		return errors.Wrap(err, "")
+	}
+	return nil
+}
+
+// getAppSpec service不存在时返回nil
+func (ss *smShardApi) getAppSpec(ctx context.Context, service string) (*smAppSpec, error) {
+	resp, err := ss.container.Client.GetKV(ctx, ss.container.nodeManager.nodeServiceSpec(service), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	var spec smAppSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &spec); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &spec, nil
+}
+
+// @Description del spec, refused while the service still has shards unless cascade drops them from containers first
 // @Tags  spec
 // @Accept  json
 // @Produce  json
 // @Param service query string true "param"
+// @Param cascade query bool false "drop and delete all shards of the service"
 // @success 200
 // @Router /sm/server/del-spec [get]
 func (ss *smShardApi) GinDelSpec(c *gin.Context) {
@@ -132,7 +706,7 @@ func (ss *smShardApi) GinDelSpec(c *gin.Context) {
 			"empty service",
 			zap.String("service", service),
 		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeParam, err)
 		return
 	}
 	// 不允许删除sm
@@ -142,9 +716,18 @@ func (ss *smShardApi) GinDelSpec(c *gin.Context) {
 			"same as shard manager's service",
 			zap.String("service", service),
 		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeReservedService, err)
 		return
 	}
+	var cascade bool
+	if v := c.Query("cascade"); v != "" {
+		var err error
+		cascade, err = strconv.ParseBool(v)
+		if err != nil {
+			apiErrorResponse(c, errCodeParam, err)
+			return
+		}
+	}
 
 	// 停掉worker
 	shard, err := ss.container.GetShard(service)
@@ -154,43 +737,231 @@ func (ss *smShardApi) GinDelSpec(c *gin.Context) {
 			"shard not found",
 			zap.String("service", service),
 		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeServiceNotFound, err)
 		return
 	}
+
+	if cascade {
+		// 先drop再删除etcd数据，container上不会残留没有配置的shard
+		failed, err := shard.DropAll(c.Request.Context())
+		if err != nil {
+			apiErrorResponse(c, errCodeInternal, err)
+			return
+		}
+		if len(failed) > 0 {
+			apiErrorResponse(c, errCodeInternal, errors.Errorf("service[%s] drop shards %v failed", service, failed))
+			return
+		}
+	} else {
+		// 只删除spec会留下shard和assignment节点，需要业务先删除shard或者使用cascade
+		resp, err := ss.container.Client.GetKV(context.Background(), ss.container.nodeManager.nodeServiceShard(service, ""), []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCountOnly()})
+		if err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		if resp.Count > 0 {
+			apiErrorResponse(c, errCodeServiceHasShards, errors.Errorf("service[%s] still has %d shards, delete them or use cascade", service, resp.Count))
+			return
+		}
+	}
 	shard.Close()
 
-	// 清除etcd数据
-	pfx := ss.container.nodeManager.nodeServiceShard(ss.container.Service(), service)
-	if err := ss.container.Client.DelKV(context.Background(), pfx); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	// 清除etcd数据：spec、shard、分配历史等service下的节点，heartbeat、assignment等业务app下的节点，最后是sm中代表service的shard
+	pfxs := []string{
+		ss.container.nodeManager.nodeService(service),
+		ss.container.nodeManager.etcdPath.AppPrefix(service) + "/",
+		ss.container.nodeManager.nodeServiceShard(ss.container.Service(), service),
 	}
+	for _, pfx := range pfxs {
+		if err := ss.container.Client.DelKV(context.Background(), pfx); err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+	}
+	ss.container.events.append(eventSpecChange, service, c.ClientIP(), fmt.Sprintf("delete spec cascade %t", cascade))
 	ss.lg.Info(
 		"delete spec success",
-		zap.String("pfx", pfx),
+		zap.String("service", service),
+		zap.Bool("cascade", cascade),
 	)
 	c.JSON(http.StatusOK, gin.H{})
 }
 
-// @Description get all service
+// @Description get all service, or the spec with revision of the service in query
 // @Tags  spec
 // @Accept  json
 // @Produce  json
+// @Param service query string false "param"
 // @success 200
 // @Router /sm/server/get-spec [get]
 func (ss *smShardApi) GinGetSpec(c *gin.Context) {
+	if service := c.Query("service"); service != "" {
+		ss.getSpec(c, service)
+		return
+	}
+
 	pfx := ss.container.nodeManager.nodeServiceShard(ss.container.Service(), "")
 	kvs, err := ss.container.Client.GetKVs(context.Background(), pfx)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	var services []string
+	for s, _ := range kvs {
+		// 开启鉴权时，只返回有权限的service
+		if !authorized(c, s) {
+			continue
+		}
+		services = append(services, s)
+	}
+	ss.lg.Info("get all service success")
+	c.JSON(http.StatusOK, gin.H{"services": services})
+}
+
+func (ss *smShardApi) getSpec(c *gin.Context, service string) {
+	pfx := ss.container.nodeManager.nodeServiceSpec(service)
+	resp, err := ss.container.Client.GetKV(context.TODO(), pfx, nil)
+	if err != nil {
+		ss.lg.Error("GetKV error",
+			zap.String("pfx", pfx),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if resp.Count == 0 {
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not exist", service))
+		return
+	}
+	var spec smAppSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &spec); err != nil {
+		ss.lg.Error("Unmarshal error",
+			zap.String("pfx", pfx),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	spec.Revision = resp.Kvs[0].ModRevision
+	c.JSON(http.StatusOK, gin.H{"spec": spec})
+}
+
+// serviceSummary list-services中每个service的概要
+type serviceSummary struct {
+	Spec *smAppSpec `json:"spec"`
+
+	// Shards 注册的shard数量，Assigned 其中已经分配到container的数量
+	Shards   int `json:"shards"`
+	Assigned int `json:"assigned"`
+
+	// Governor 负责该service的sm container
+	Governor string `json:"governor"`
+
+	// Containers 存活的container
+	Containers []string `json:"containers"`
+
+	// Children 直接的子service
+	Children []string `json:"children,omitempty"`
+}
+
+// @Description list all services governed by sm with shard counts and container summaries, or only the subtree of root
+// @Tags  spec
+// @Produce  json
+// @Param root query string false "param"
+// @success 200
+// @Router /sm/server/list-services [get]
+func (ss *smShardApi) GinListServices(c *gin.Context) {
+	ctx := context.TODO()
+
+	leader, err := ss.container.leader(ctx)
+	if err != nil {
+		ss.lg.Error("leader error", zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+
+	specs, err := ss.serviceSpecs(ctx)
+	if err != nil {
+		ss.lg.Error("serviceSpecs error", zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	tree := newServiceTree(specs)
+
+	// root不为空时只返回root和它的子孙
+	var subtree map[string]struct{}
+	if root := c.Query("root"); root != "" {
+		if _, ok := tree.parents[root]; !ok {
+			apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not exist", root))
+			return
+		}
+		subtree = map[string]struct{}{root: {}}
+		for _, service := range tree.descendants(root) {
+			subtree[service] = struct{}{}
+		}
+	}
+
+	// 每个service是sm的一个shard，sm的shard heartbeat记录了service所在的container
+	governors, err := ss.shardHeartbeats(ctx, ss.container.Service())
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+
+	services := make([]*serviceSummary, 0)
+	for _, spec := range specs {
+		if subtree != nil {
+			if _, ok := subtree[spec.Service]; !ok {
+				continue
+			}
+		}
+		// 开启鉴权时，只返回有权限的service
+		if !authorized(c, spec.Service) {
+			continue
+		}
+
+		summary, err := ss.serviceSummary(ctx, spec)
+		if err != nil {
+			ss.lg.Error("serviceSummary error",
+				zap.String("service", spec.Service),
+				zap.Error(err),
+			)
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		if hb, ok := governors[spec.Service]; ok {
+			summary.Governor = hb.ContainerId
+		}
+		summary.Children = tree.children[spec.Service]
+		services = append(services, summary)
+	}
+	c.JSON(http.StatusOK, gin.H{"leader": leader, "services": services})
+}
+
+func (ss *smShardApi) serviceSummary(ctx context.Context, spec *smAppSpec) (*serviceSummary, error) {
+	summary := serviceSummary{Spec: spec}
+
+	shards, err := ss.container.Client.GetKVs(ctx, ss.container.nodeManager.nodeServiceShard(spec.Service, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	summary.Shards = len(shards)
+
+	assignment, err := ss.shardHeartbeats(ctx, spec.Service)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
 	}
-	var services []string
-	for s, _ := range kvs {
-		services = append(services, s)
+	for shardId := range shards {
+		if _, ok := assignment[shardId]; ok {
+			summary.Assigned++
+		}
 	}
-	ss.lg.Info("get all service success")
-	c.JSON(http.StatusOK, gin.H{"services": services})
+
+	summary.Containers, err = ss.aliveContainers(ctx, spec.Service)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &summary, nil
 }
 
 // @Description update spec
@@ -204,11 +975,61 @@ func (ss *smShardApi) GinUpdateSpec(c *gin.Context) {
 	var req smAppSpec
 	if err := c.ShouldBind(&req); err != nil {
 		ss.lg.Error("ShouldBind err", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeParam, err)
 		return
 	}
 	req.CreateTime = time.Now().Unix()
 	ss.lg.Info("receive update spec request", zap.String("request", req.String()))
+	if err := req.validateHeartbeat(); err != nil {
+		ss.lg.Error("heartbeat error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateSpreadPolicy(); err != nil {
+		ss.lg.Error("spread policy error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateAssignor(); err != nil {
+		ss.lg.Error("assignor error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateShardDefaults(); err != nil {
+		ss.lg.Error("shard defaults error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateTaskSchema(); err != nil {
+		ss.lg.Error("task schema error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateCanary(); err != nil {
+		ss.lg.Error("canary error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateWarmup(); err != nil {
+		ss.lg.Error("warmup error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateMoveCooldown(); err != nil {
+		ss.lg.Error("move cooldown error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := req.validateRebalance(); err != nil {
+		ss.lg.Error("rebalance error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if code, err := ss.checkParent(context.TODO(), &req); err != nil {
+		ss.lg.Error("parent error", zap.Error(err))
+		apiErrorResponse(c, code, err)
+		return
+	}
 	//  查询是否存在该service
 	shard, err := ss.container.GetShard(req.Service)
 	if err != nil {
@@ -217,24 +1038,53 @@ func (ss *smShardApi) GinUpdateSpec(c *gin.Context) {
 			zap.String("service", req.Service),
 			zap.Error(err),
 		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "service not exist"})
+		apiErrorResponse(c, errCodeServiceNotFound, errors.New("service not exist"))
 		return
 	}
 
+	// revision不存储到etcd中
+	revision := req.Revision
+	req.Revision = 0
+
 	pfx := ss.container.nodeManager.nodeServiceSpec(req.Service)
-	if err := ss.container.Client.UpdateKV(context.Background(), pfx, req.String()); err != nil {
+	if revision > 0 {
+		err = ss.container.Client.UpdateKVWithRevision(context.Background(), pfx, req.String(), revision)
+	} else {
+		err = ss.container.Client.UpdateKV(context.Background(), pfx, req.String())
+	}
+	if err != nil {
 		ss.lg.Error("UpdateKV err",
 			zap.String("pfx", pfx),
 			zap.String("value", req.String()),
 			zap.Error(err),
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
 		return
 	}
+	if err := ss.putAppConfig(&req); err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+
 	//  更新sm container内存中的值
 	shard.SetMaxShardCount(req.MaxShardCount)
 	shard.SetMaxRecoveryTime(req.MaxRecoveryTime)
+	shard.SetMinimizeMovement(req.MinimizeMovement)
+	shard.SetMaxShardsPerContainer(req.MaxShardsPerContainer)
+	shard.SetHealthProbe(req.HealthProbe)
+	shard.SetSpreadPolicy(req.SpreadPolicy)
+	shard.SetDeploymentPolicy(req.DeploymentPolicy)
+	shard.SetFrozen(req.Frozen)
+	shard.SetAssignor(req.Assignor)
+	shard.SetMoveConcurrency(req.MoveConcurrency)
+	shard.SetCanary(req.Canary)
+	shard.SetWarmup(req.Warmup)
+	shard.SetMoveCooldown(req.MoveCooldown)
+	shard.SetRebalanceInterval(req.RebalanceInterval)
+	shard.SetRebalanceDebounce(req.RebalanceDebounce)
+	shard.SetRebalanceWindows(req.RebalanceWindows)
 
+	ss.container.events.append(eventSpecChange, req.Service, c.ClientIP(), "update spec "+req.String())
 	ss.lg.Info("update spec success", zap.String("pfx", pfx))
 	c.JSON(http.StatusOK, gin.H{})
 }
@@ -252,6 +1102,33 @@ type addShardRequest struct {
 
 	// Group 同一个service需要区分不同种类的shard，这些shard之间不相关的balance到现有container上
 	Group string `json:"group"`
+
+	// ReplicaCount shard的副本数，包含primary，副本会被分配到不同的container
+	ReplicaCount int `json:"replicaCount"`
+
+	// Priority 值越大优先级越高，container不足时优先分配
+	Priority int `json:"priority"`
+
+	// LoadEstimate shard预估的负载单位，binpack分配时使用
+	LoadEstimate int `json:"loadEstimate"`
+
+	// Weight 默认分配方式下shard的权重，weight为10的shard按照10个普通shard均衡
+	Weight int `json:"weight"`
+
+	// Resources shard需要预留的cpu/mem单位，leader不会把shard分配到剩余资源不足的container
+	Resources *apputil.Resources `json:"resources,omitempty"`
+
+	// Warmup shard add之后的预热时间，单位s，service开启warmup时新container按照批次接收shard
+	Warmup int `json:"warmup,omitempty"`
+
+	// TTL shard的存活时间，单位秒，到期后sm自动drop并删除shard，为0不过期
+	TTL int64 `json:"ttl"`
+
+	// Constraint placement约束表达式，例如 container.labels.zone == "us-east-1" && container.load.cpu < 0.7
+	Constraint string `json:"constraint"`
+
+	// PreferredContainers 故障转移时按照顺序优先选择的container
+	PreferredContainers []string `json:"preferredContainers"`
 }
 
 func (r *addShardRequest) String() string {
@@ -270,19 +1147,60 @@ func (ss *smShardApi) GinAddShard(c *gin.Context) {
 	var req addShardRequest
 	if err := c.ShouldBind(&req); err != nil {
 		ss.lg.Error("ShouldBind err", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeParam, err)
 		return
 	}
+	// task在encryptTask之前是明文，只记录service和shard id
 	ss.lg.Info(
 		"add shard request",
-		zap.Reflect("req", req),
+		zap.String("service", req.Service),
+		zap.String("shardId", req.ShardId),
 	)
 
+	if err := apputil.ValidateShardId(req.ShardId); err != nil {
+		ss.lg.Error("shard id error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if req.TTL < 0 {
+		err := errors.Errorf("ttl %d should not be negative", req.TTL)
+		ss.lg.Error("ttl error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if req.Weight < 0 {
+		err := errors.Errorf("weight %d should not be negative", req.Weight)
+		ss.lg.Error("weight error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if req.Warmup < 0 {
+		err := errors.Errorf("warmup %d should not be negative", req.Warmup)
+		ss.lg.Error("warmup error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := validateResources(req.Resources); err != nil {
+		ss.lg.Error("resources error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := validateConstraint(req.Constraint); err != nil {
+		ss.lg.Error("constraint error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := validatePreferredContainers(req.PreferredContainers); err != nil {
+		ss.lg.Error("preferred containers error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
 	// sm本身的shard是和service添加绑定的，不需要走这个接口
 	if req.Service == ss.container.Service() {
 		err := errors.Errorf("same as shard manager's service")
 		ss.lg.Error("service error", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeReservedService, err)
 		return
 	}
 
@@ -290,7 +1208,7 @@ func (ss *smShardApi) GinAddShard(c *gin.Context) {
 	if _, ok := ss.container.shards[req.Service]; !ok {
 		err := errors.Errorf(fmt.Sprintf("service[%s] not exist", req.Service))
 		ss.lg.Error("service error", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeServiceNotFound, err)
 		return
 	}
 
@@ -300,6 +1218,53 @@ func (ss *smShardApi) GinAddShard(c *gin.Context) {
 		UpdateTime:        time.Now().Unix(),
 		ManualContainerId: req.ManualContainerId,
 		Group:             req.Group,
+		ReplicaCount:      req.ReplicaCount,
+		Priority:          req.Priority,
+		LoadEstimate:      req.LoadEstimate,
+		Weight:            req.Weight,
+		Resources:         req.Resources,
+		Warmup:            req.Warmup,
+		Constraint:        req.Constraint,
+
+		PreferredContainers: req.PreferredContainers,
+
+		TraceContext: apputil.InjectTraceContext(c.Request.Context()),
+	}
+
+	// 合并service配置的shard默认值
+	specResp, err := ss.container.Client.GetKV(context.TODO(), ss.container.nodeManager.nodeServiceSpec(req.Service), nil)
+	if err != nil {
+		ss.lg.Error("GetKV error", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if specResp.Count == 0 {
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not exist", req.Service))
+		return
+	}
+	var appSpec smAppSpec
+	if err := json.Unmarshal(specResp.Kvs[0].Value, &appSpec); err != nil {
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	appSpec.ShardDefaults.apply(req.ShardId, &spec)
+	if req.TTL > 0 {
+		spec.ExpireAt = time.Now().Unix() + req.TTL
+	}
+	if err := ss.validateShards(&appSpec, map[string]*apputil.ShardSpec{req.ShardId: &spec}); err != nil {
+		ss.lg.Error("validateShards err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, errCodeInvalidTask, err)
+		return
+	}
+	if err := ss.checkShardQuota(context.TODO(), requestTenant(c), req.Service, 1); err != nil {
+		ss.lg.Error("checkShardQuota err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, quotaErrCode(err), err)
+		return
+	}
+	if err := ss.container.encryptTask(&spec); err != nil {
+		ss.lg.Error("encryptTask err", zap.String("service", req.Service), zap.Error(err))
+		apiErrorResponse(c, errCodeInternal, err)
+		return
 	}
 
 	// 区分更新和添加
@@ -313,12 +1278,18 @@ func (ss *smShardApi) GinAddShard(c *gin.Context) {
 		ss.lg.Error("CreateAndGet error",
 			zap.Error(err),
 			zap.Strings("nodes", nodes),
-			zap.Strings("values", values),
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apiErrorResponse(c, etcdErrCode(err, errCodeShardExists), err)
 		return
 	}
+	// 覆盖相同id的shard之前留下的Dropped
+	ss.container.states.transition(req.Service, &shardStateRecord{ShardId: req.ShardId, State: shardStatePending})
 
+	// 开启加密时，task不能以明文记录在事件中
+	if ss.container.taskKey != nil {
+		req.Task = ""
+	}
+	ss.container.events.append(eventSpecChange, req.Service, c.ClientIP(), "add shard "+req.String())
 	c.JSON(http.StatusOK, gin.H{})
 }
 
@@ -344,7 +1315,7 @@ func (ss *smShardApi) GinDelShard(c *gin.Context) {
 	var req delShardRequest
 	if err := c.ShouldBind(&req); err != nil {
 		ss.lg.Error("ShouldBind err", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeParam, err)
 		return
 	}
 	ss.lg.Info("del shard request", zap.Reflect("req", req))
@@ -357,7 +1328,7 @@ func (ss *smShardApi) GinDelShard(c *gin.Context) {
 			zap.Error(err),
 			zap.String("pfx", pfx),
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
 		return
 	}
 	if delResp.Deleted != 1 {
@@ -368,7 +1339,21 @@ func (ss *smShardApi) GinDelShard(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{})
 		return
 	}
+	if err := ss.container.states.removeUnassigned(context.TODO(), req.Service, req.ShardId); err != nil {
+		ss.lg.Warn("removeUnassigned err",
+			zap.Reflect("req", req),
+			zap.Error(err),
+		)
+	}
+	// shard已经删除，fencing节点（包括secondary副本的）不会再被使用
+	if err := unfence(context.TODO(), ss.container.Client, ss.container.nodeManager.etcdPath, req.Service, req.ShardId, true); err != nil {
+		ss.lg.Warn("unfence err",
+			zap.Reflect("req", req),
+			zap.Error(err),
+		)
+	}
 
+	ss.container.events.append(eventSpecChange, req.Service, c.ClientIP(), "delete shard "+req.String())
 	ss.lg.Info(
 		"delete shard success",
 		zap.Reflect("req", req),
@@ -377,11 +1362,130 @@ func (ss *smShardApi) GinDelShard(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{})
 }
 
-// @Description get service all shard
+type pinShardRequest struct {
+	ShardId string `json:"shardId" binding:"required"`
+	Service string `json:"service" binding:"required"`
+
+	// ContainerId shard固定到的container，unpin时不需要
+	ContainerId string `json:"containerId"`
+
+	// Revision 不为0时需要和shard在etcd中的ModRevision一致
+	Revision int64 `json:"revision"`
+}
+
+func (r *pinShardRequest) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// @Description pin shard to container, pinned shard is excluded from rebalance
+// @Tags  shard
+// @Accept  json
+// @Produce  json
+// @Param param body pinShardRequest true "param"
+// @success 200
+// @Router /sm/server/pin-shard [post]
+func (ss *smShardApi) GinPinShard(c *gin.Context) {
+	var req pinShardRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if req.ContainerId == "" {
+		err := errors.Errorf("empty containerId")
+		ss.lg.Error("param error", zap.Reflect("req", req), zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	ss.lg.Info("pin shard request", zap.Reflect("req", req))
+	ss.pinShard(c, &req)
+}
+
+// @Description unpin shard, shard joins rebalance again
+// @Tags  shard
+// @Accept  json
+// @Produce  json
+// @Param param body pinShardRequest true "param"
+// @success 200
+// @Router /sm/server/unpin-shard [post]
+func (ss *smShardApi) GinUnpinShard(c *gin.Context) {
+	var req pinShardRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	ss.lg.Info("unpin shard request", zap.Reflect("req", req))
+	req.ContainerId = ""
+	ss.pinShard(c, &req)
+}
+
+// pinShard 通过ManualContainerId记录固定的container，rebalance不会移动manual的shard
+func (ss *smShardApi) pinShard(c *gin.Context, req *pinShardRequest) {
+	pfx := ss.container.nodeManager.nodeServiceShard(req.Service, req.ShardId)
+	resp, err := ss.container.Client.GetKV(context.TODO(), pfx, nil)
+	if err != nil {
+		ss.lg.Error("GetKV error",
+			zap.Error(err),
+			zap.String("pfx", pfx),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if resp.Count == 0 {
+		err := errors.Errorf("shard[%s] not exist", req.ShardId)
+		ss.lg.Error("shard error", zap.String("pfx", pfx), zap.Error(err))
+		apiErrorResponse(c, errCodeShardNotFound, err)
+		return
+	}
+
+	if req.Revision > 0 && req.Revision != resp.Kvs[0].ModRevision {
+		err := errors.Errorf("shard[%s] revision %d not match %d", req.ShardId, req.Revision, resp.Kvs[0].ModRevision)
+		ss.lg.Error("revision error", zap.String("pfx", pfx), zap.Error(err))
+		apiErrorResponse(c, errCodeConflict, err)
+		return
+	}
+
+	curValue := string(resp.Kvs[0].Value)
+	var spec apputil.ShardSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &spec); err != nil {
+		ss.lg.Error("Unmarshal error",
+			zap.Error(err),
+			zap.String("value", curValue),
+		)
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	spec.ManualContainerId = req.ContainerId
+	spec.UpdateTime = time.Now().Unix()
+	spec.TraceContext = apputil.InjectTraceContext(c.Request.Context())
+
+	// 防止和其他修改spec的请求并发覆盖
+	if _, err := ss.container.Client.CompareAndSwap(context.TODO(), pfx, curValue, spec.String(), clientv3.NoLease); err != nil {
+		ss.lg.Error("CompareAndSwap error",
+			zap.Error(err),
+			zap.String("pfx", pfx),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+
+	ss.container.events.append(eventSpecChange, req.Service, c.ClientIP(), "pin shard "+req.String())
+	ss.lg.Info(
+		"pin shard success",
+		zap.Reflect("req", req),
+		zap.String("pfx", pfx),
+	)
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// @Description get service all shard, or the spec with revision, states and assignment history of the shard in query
 // @Tags  shard
 // @Accept  json
 // @Produce  json
 // @Param service query string true "param"
+// @Param shardId query string false "param"
 // @success 200
 // @Router /sm/server/get-shard [get]
 func (ss *smShardApi) GinGetShard(c *gin.Context) {
@@ -392,7 +1496,11 @@ func (ss *smShardApi) GinGetShard(c *gin.Context) {
 			"empty service",
 			zap.String("service", service),
 		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if shardId := c.Query("shardId"); shardId != "" {
+		ss.getShard(c, service, shardId)
 		return
 	}
 
@@ -404,7 +1512,7 @@ func (ss *smShardApi) GinGetShard(c *gin.Context) {
 			zap.String("service", service),
 			zap.Error(err),
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
 		return
 	}
 	var shards []string
@@ -418,3 +1526,180 @@ func (ss *smShardApi) GinGetShard(c *gin.Context) {
 	)
 	c.JSON(http.StatusOK, gin.H{"shards": shards})
 }
+
+func (ss *smShardApi) getShard(c *gin.Context, service string, shardId string) {
+	pfx := ss.container.nodeManager.nodeServiceShard(service, shardId)
+	resp, err := ss.container.Client.GetKV(context.TODO(), pfx, nil)
+	if err != nil {
+		ss.lg.Error("GetKV error",
+			zap.String("pfx", pfx),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if resp.Count == 0 {
+		apiErrorResponse(c, errCodeShardNotFound, errors.Errorf("shard[%s] not exist", shardId))
+		return
+	}
+	var spec apputil.ShardSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &spec); err != nil {
+		ss.lg.Error("Unmarshal error",
+			zap.String("pfx", pfx),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	spec.Revision = resp.Kvs[0].ModRevision
+
+	states, err := ss.container.states.list(context.TODO(), service, shardId, &spec)
+	if err != nil {
+		ss.lg.Error("list shard states error",
+			zap.String("service", service),
+			zap.String("shardId", shardId),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	history, err := ss.container.history.list(context.TODO(), service, shardId, &spec)
+	if err != nil {
+		ss.lg.Error("list shard history error",
+			zap.String("service", service),
+			zap.String("shardId", shardId),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"spec": spec, "states": states, "history": history})
+}
+
+// @Description dry-run rebalance, return the move actions without executing
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200
+// @Router /sm/server/rebalance-plan [get]
+func (ss *smShardApi) GinRebalancePlan(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	// service的shard移动由负责它的sm container计算，其他container上没有存活信息
+	shard, err := ss.container.GetShard(service)
+	if err != nil {
+		ss.lg.Error(
+			"shard not found",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", service))
+		return
+	}
+
+	mals, err := shard.RebalancePlan(context.TODO())
+	if err != nil {
+		ss.lg.Error(
+			"RebalancePlan error",
+			zap.String("service", service),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	ss.lg.Info(
+		"rebalance plan success",
+		zap.String("service", service),
+		zap.Reflect("mals", mals),
+	)
+	c.JSON(http.StatusOK, gin.H{"moveActions": mals})
+}
+
+// @Description get shards which are not assigned because of maxShardsPerContainer
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200
+// @Router /sm/server/unassigned-shards [get]
+func (ss *smShardApi) GinUnassignedShards(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	shard, err := ss.container.GetShard(service)
+	if err != nil {
+		ss.lg.Error(
+			"shard not found",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", service))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shards": shard.UnassignedShards()})
+}
+
+// @Description resign the leadership of the current leader and let another instance take over
+// @Tags  leader
+// @Produce  json
+// @success 200
+// @Router /sm/server/resign-leader [post]
+func (ss *smShardApi) GinResignLeader(c *gin.Context) {
+	if err := ss.container.resign(c.Request.Context()); err != nil {
+		ss.lg.Error("resign error", zap.Error(err))
+		code := errCodeInternal
+		if errors.Cause(err) == errNotLeader {
+			code = errCodeNotLeader
+		}
+		apiErrorResponse(c, code, err)
+		return
+	}
+	ss.lg.Info("resign leader success", zap.String("id", ss.container.Id()))
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// @Description get the current leader, with service the container governing the service is returned too
+// @Tags  leader
+// @Produce  json
+// @Param service query string false "param"
+// @success 200
+// @Router /sm/server/leader [get]
+func (ss *smShardApi) GinLeader(c *gin.Context) {
+	info, err := ss.container.leaderInfo(c.Request.Context())
+	if err != nil {
+		ss.lg.Error("leaderInfo error", zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if info == nil {
+		apiErrorResponse(c, errCodeLeaderUnavailable, errors.New("no leader"))
+		return
+	}
+
+	r := gin.H{"leader": info}
+	// sm自己的service由leader负责
+	if service := c.Query("service"); service != "" && service != ss.container.Service() {
+		governor, err := ss.container.governor(c.Request.Context(), service)
+		if err != nil {
+			ss.lg.Error("governor error", zap.String("service", service), zap.Error(err))
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		r["governor"] = governor
+	}
+	c.JSON(http.StatusOK, r)
+}
@@ -3,9 +3,11 @@ package smserver
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 )
@@ -23,6 +26,16 @@ func TestApi(t *testing.T) {
 	suite.Run(t, new(ApiTestSuite))
 }
 
+func Test_smAppSpec_redacted(t *testing.T) {
+	spec := smAppSpec{Service: "foo", ShardGroups: []*shardGroup{{Name: "p", Count: 2, Task: "secret"}}}
+	r := spec.redacted()
+	assert.Equal(t, "foo", r.Service)
+	assert.Equal(t, "", r.ShardGroups[0].Task)
+	assert.Equal(t, 2, r.ShardGroups[0].Count)
+	// 原始请求中的task还要写入etcd
+	assert.Equal(t, "secret", spec.ShardGroups[0].Task)
+}
+
 type ApiTestSuite struct {
 	suite.Suite
 
@@ -33,16 +46,16 @@ type ApiTestSuite struct {
 
 func (suite *ApiTestSuite) SetupTest() {
 	suite.testRouter = gin.Default()
-	suite.testServer = &Server{}
 
 	lg, _ := zap.NewDevelopment()
+	suite.testServer = &Server{opts: &serverOptions{lg: lg}}
 	suite.container = &smContainer{
 		lg:        lg,
 		Container: &apputil.Container{},
 		stopper:   &apputil.GoroutineStopper{},
 		shards:    make(map[string]Shard),
 
-		nodeManager: &nodeManager{"foo"},
+		nodeManager: &nodeManager{smService: "foo", etcdPath: apputil.NewEtcdPath("")},
 	}
 	suite.container.SetService("foo")
 
@@ -85,15 +98,18 @@ type MockedEtcdWrapper struct {
 }
 
 func (m *MockedEtcdWrapper) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
-	panic("implement me")
+	args := m.Called(ctx, key, opts)
+	return args.Get(0).(*clientv3.GetResponse), args.Error(1)
 }
 
 func (m *MockedEtcdWrapper) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
-	panic("implement me")
+	args := m.Called(ctx, key)
+	return args.Get(0).(clientv3.WatchChan)
 }
 
-func (m *MockedEtcdWrapper) GetKV(_ context.Context, node string, opts []clientv3.OpOption) (*clientv3.GetResponse, error) {
-	panic("implement me")
+func (m *MockedEtcdWrapper) GetKV(ctx context.Context, node string, opts []clientv3.OpOption) (*clientv3.GetResponse, error) {
+	args := m.Called(ctx, node, opts)
+	return args.Get(0).(*clientv3.GetResponse), args.Error(1)
 }
 
 func (m *MockedEtcdWrapper) GetKVs(ctx context.Context, prefix string) (map[string]string, error) {
@@ -106,6 +122,11 @@ func (m *MockedEtcdWrapper) UpdateKV(ctx context.Context, key string, value stri
 	return args.Error(0)
 }
 
+func (m *MockedEtcdWrapper) UpdateKVWithRevision(ctx context.Context, key string, value string, revision int64) error {
+	args := m.Called(ctx, key, value, revision)
+	return args.Error(0)
+}
+
 func (m *MockedEtcdWrapper) DelKV(ctx context.Context, prefix string) error {
 	args := m.Called(ctx, prefix)
 	return args.Error(0)
@@ -116,8 +137,9 @@ func (m *MockedEtcdWrapper) CreateAndGet(ctx context.Context, nodes []string, va
 	return args.Error(0)
 }
 
-func (m *MockedEtcdWrapper) CompareAndSwap(_ context.Context, node string, curValue string, newValue string, leaseID clientv3.LeaseID) (string, error) {
-	panic("implement me")
+func (m *MockedEtcdWrapper) CompareAndSwap(ctx context.Context, node string, curValue string, newValue string, leaseID clientv3.LeaseID) (string, error) {
+	args := m.Called(ctx, node, curValue, newValue, leaseID)
+	return args.String(0), args.Error(1)
 }
 
 func (m *MockedEtcdWrapper) Ctx() context.Context {
@@ -125,7 +147,8 @@ func (m *MockedEtcdWrapper) Ctx() context.Context {
 }
 
 func (m *MockedEtcdWrapper) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
-	panic("implement me")
+	args := m.Called(ctx, key, val, opts)
+	return args.Get(0).(*clientv3.PutResponse), args.Error(1)
 }
 
 func (m *MockedEtcdWrapper) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
@@ -148,6 +171,7 @@ func (suite *ApiTestSuite) TestGinAddSpec_success() {
 		mock.Anything,
 		clientv3.NoLease,
 	).Return(nil)
+	mockedEtcdWrapper.On("UpdateKV", mock.Anything, "/sm/app/serviceA/config", mock.Anything).Return(nil)
 	suite.container.Client = mockedEtcdWrapper
 
 	spec := smAppSpec{
@@ -163,6 +187,37 @@ func (suite *ApiTestSuite) TestGinAddSpec_success() {
 	assert.Equal(suite.T(), w.Code, http.StatusOK)
 }
 
+func (suite *ApiTestSuite) TestGinAddSpec_tenantQuotaExceeded() {
+	// 开启鉴权后租户才能区分
+	suite.testServer.opts.apiTokens = map[string][]string{"t1": {allServices}}
+	suite.testRouter = gin.Default()
+	for path, handler := range suite.testServer.getHandlers(suite.container) {
+		suite.testRouter.Any(path, handler)
+	}
+	suite.container.quotas = newQuotaChecker(Quota{MaxServices: 10}, map[string]Quota{"t1": {MaxServices: 1}})
+
+	registered := func(service, owner string) *mvccpb.KeyValue {
+		st := shardTask{GovernedService: service, Owner: owner}
+		spec := apputil.ShardSpec{Service: "foo", Task: st.String()}
+		return &mvccpb.KeyValue{Value: []byte(spec.String())}
+	}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/foo/shard/", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 2, Kvs: []*mvccpb.KeyValue{registered("serviceX", tokenIdentity("t1")), registered("serviceY", "")}}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	spec := smAppSpec{Service: "serviceA"}
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-spec", bytes.NewBuffer([]byte(spec.String())))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add(headerToken, "t1")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "CreateAndGet", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(suite.T(), w.Code, http.StatusForbidden)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeQuotaExceeded))
+}
+
 func (suite *ApiTestSuite) TestGinDelSpec_emptyService() {
 	req := httptest.NewRequest(http.MethodGet, "/sm/server/del-spec", nil)
 	w := httptest.NewRecorder()
@@ -181,11 +236,13 @@ func (suite *ApiTestSuite) TestGinDelSpec_notFound() {
 
 func (suite *ApiTestSuite) TestGinDelSpec_success() {
 	service := "serviceA"
-	pfx := "/sm/app/foo/service/foo/shard/" + service
 
 	// mock
 	mockedEtcdWrapper := new(MockedEtcdWrapper)
-	mockedEtcdWrapper.On("DelKV", mock.Anything, pfx).Return(nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/shard/", mock.Anything).Return(&clientv3.GetResponse{}, nil)
+	mockedEtcdWrapper.On("DelKV", mock.Anything, "/sm/app/foo/service/serviceA/").Return(nil)
+	mockedEtcdWrapper.On("DelKV", mock.Anything, "/sm/app/serviceA/").Return(nil)
+	mockedEtcdWrapper.On("DelKV", mock.Anything, "/sm/app/foo/service/foo/shard/"+service).Return(nil)
 	suite.container.Client = mockedEtcdWrapper
 
 	mockedShard := new(MockedShard)
@@ -201,6 +258,56 @@ func (suite *ApiTestSuite) TestGinDelSpec_success() {
 	assert.Equal(suite.T(), w.Code, http.StatusOK)
 }
 
+func (suite *ApiTestSuite) TestGinDelSpec_hasShards() {
+	service := "serviceA"
+
+	// mock
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/shard/", mock.Anything).Return(&clientv3.GetResponse{Count: 2}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	mockedShard := new(MockedShard)
+	suite.container.shards[service] = mockedShard
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/del-spec?service="+service, nil)
+	w := httptest.NewRecorder()
+
+	suite.testRouter.ServeHTTP(w, req)
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "DelKV", mock.Anything, mock.Anything)
+	mockedShard.AssertNotCalled(suite.T(), "Close")
+	assert.Equal(suite.T(), http.StatusConflict, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeServiceHasShards))
+}
+
+func (suite *ApiTestSuite) TestGinDelSpec_cascade() {
+	service := "serviceA"
+
+	// mock
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("DelKV", mock.Anything, mock.Anything).Return(nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	// drop失败时不删除数据
+	mockedShard := new(MockedShard)
+	mockedShard.On("DropAll", mock.Anything).Return([]string{"s1"}, nil).Once()
+	suite.container.shards[service] = mockedShard
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/del-spec?service="+service+"&cascade=true", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusInternalServerError, w.Code)
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "DelKV", mock.Anything, mock.Anything)
+
+	mockedShard.On("DropAll", mock.Anything).Return([]string(nil), nil)
+	mockedShard.On("Close").Return(nil)
+	w = httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sm/server/del-spec?service="+service+"&cascade=true", nil))
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	mockedShard.AssertExpectations(suite.T())
+	mockedEtcdWrapper.AssertNumberOfCalls(suite.T(), "DelKV", 3)
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "GetKV", mock.Anything, mock.Anything, mock.Anything)
+}
+
 func (suite *ApiTestSuite) TestGinGetSpec_success() {
 	pfx := "/sm/app/foo/service/foo/shard/"
 
@@ -229,7 +336,8 @@ func (suite *ApiTestSuite) TestGinUpdateSpec_notFound() {
 	req := httptest.NewRequest(http.MethodPost, "/sm/server/update-spec", bytes.NewBuffer([]byte(spec.String())))
 	w := httptest.NewRecorder()
 	suite.testRouter.ServeHTTP(w, req)
-	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+	assert.Equal(suite.T(), w.Code, http.StatusNotFound)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeServiceNotFound))
 }
 
 func (suite *ApiTestSuite) TestGinUpdateSpec_success() {
@@ -239,11 +347,26 @@ func (suite *ApiTestSuite) TestGinUpdateSpec_success() {
 
 	mockedEtcdWrapper := new(MockedEtcdWrapper)
 	mockedEtcdWrapper.On("UpdateKV", mock.Anything, pfx, mock.Anything).Return(nil)
+	mockedEtcdWrapper.On("UpdateKV", mock.Anything, "/sm/app/serviceA/config", mock.Anything).Return(nil)
 	suite.container.Client = mockedEtcdWrapper
 
 	mockedShard := new(MockedShard)
 	mockedShard.On("SetMaxShardCount", 0)
 	mockedShard.On("SetMaxRecoveryTime", 0)
+	mockedShard.On("SetMinimizeMovement", false)
+	mockedShard.On("SetMaxShardsPerContainer", 0)
+	mockedShard.On("SetSpreadPolicy", "")
+	mockedShard.On("SetDeploymentPolicy", "")
+	mockedShard.On("SetFrozen", false)
+	mockedShard.On("SetAssignor", "")
+	mockedShard.On("SetMoveConcurrency", 0)
+	mockedShard.On("SetCanary", (*canarySpec)(nil))
+	mockedShard.On("SetWarmup", (*warmupSpec)(nil))
+	mockedShard.On("SetMoveCooldown", 0)
+	mockedShard.On("SetRebalanceInterval", 0)
+	mockedShard.On("SetRebalanceDebounce", 0)
+	mockedShard.On("SetRebalanceWindows", []string(nil))
+	mockedShard.On("SetHealthProbe", false)
 	suite.container.shards[service] = mockedShard
 
 	spec := smAppSpec{Service: service}
@@ -256,6 +379,123 @@ func (suite *ApiTestSuite) TestGinUpdateSpec_success() {
 	assert.Equal(suite.T(), w.Code, http.StatusOK)
 }
 
+func (suite *ApiTestSuite) TestGinUpdateSpec_heartbeatError() {
+	service := "serviceA"
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	suite.container.Client = mockedEtcdWrapper
+
+	mockedShard := new(MockedShard)
+	suite.container.shards[service] = mockedShard
+
+	spec := smAppSpec{Service: service, HeartbeatInterval: 5, SessionTTL: 5}
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/update-spec", bytes.NewBuffer([]byte(spec.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "UpdateKV", mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeParam))
+}
+
+func (suite *ApiTestSuite) TestGinUpdateSpec_rebalanceError() {
+	service := "serviceA"
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	suite.container.Client = mockedEtcdWrapper
+
+	mockedShard := new(MockedShard)
+	suite.container.shards[service] = mockedShard
+
+	spec := smAppSpec{Service: service, RebalanceDebounce: -1}
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/update-spec", bytes.NewBuffer([]byte(spec.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "UpdateKV", mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeParam))
+}
+
+func (suite *ApiTestSuite) TestGinUpdateSpec_revisionConflict() {
+	service := "serviceA"
+
+	pfx := "/sm/app/foo/service/serviceA/spec"
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("UpdateKVWithRevision", mock.Anything, pfx, mock.Anything, int64(3)).Return(etcdutil.ErrEtcdRevisionNotMatch)
+	suite.container.Client = mockedEtcdWrapper
+
+	mockedShard := new(MockedShard)
+	suite.container.shards[service] = mockedShard
+
+	spec := smAppSpec{Service: service, Revision: 3}
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/update-spec", bytes.NewBuffer([]byte(spec.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	// 版本冲突时不更新内存中的spec
+	mockedShard.AssertNotCalled(suite.T(), "SetMaxShardCount", 0)
+	assert.Equal(suite.T(), w.Code, http.StatusConflict)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeConflict))
+}
+
+func (suite *ApiTestSuite) TestGinMaintenance_success() {
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("Put", mock.Anything, "/sm/app/foo/service/serviceA/maintenance", mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	r := maintenanceRequest{Service: "serviceA", Duration: 600}
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/maintenance", bytes.NewBuffer([]byte(r.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestGinMaintenance_durationError() {
+	r := maintenanceRequest{Service: "serviceA", Duration: 7 * 24 * 3600}
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/maintenance", bytes.NewBuffer([]byte(r.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestGinCordonContainer_success() {
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("Put", mock.Anything, "/sm/app/foo/service/serviceA/cordon/c1", mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	mockedEtcdWrapper.On("Delete", mock.Anything, "/sm/app/foo/service/serviceA/cordon/c1", mock.Anything).Return(&clientv3.DeleteResponse{}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	r := cordonRequest{Service: "serviceA", ContainerId: "c1"}
+	for _, path := range []string{"/sm/server/cordon-container", "/sm/server/uncordon-container"} {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer([]byte(r.String())))
+		req.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		suite.testRouter.ServeHTTP(w, req)
+		assert.Equal(suite.T(), w.Code, http.StatusOK)
+	}
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+}
+
+func (suite *ApiTestSuite) TestGinCordonContainer_bindError() {
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/cordon-container", bytes.NewBuffer([]byte(`{"service": "serviceA"}`)))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+}
+
 func (suite *ApiTestSuite) TestGinAddShard_bindError() {
 	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBuffer([]byte("foo")))
 	req.Header.Add("Content-Type", "application/json")
@@ -275,6 +515,18 @@ func (suite *ApiTestSuite) TestGinAddShard_sameService() {
 	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
 }
 
+func (suite *ApiTestSuite) TestGinAddShard_replicaSeparator() {
+	shardReq := addShardRequest{Service: "serviceA", ShardId: "shardA#2"}
+	suite.container.shards[shardReq.Service] = new(smShard)
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBuffer([]byte(shardReq.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeParam))
+}
+
 func (suite *ApiTestSuite) TestGinAddShard_notFound() {
 	shardReq := addShardRequest{Service: "serviceA", ShardId: "shardA"}
 	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBuffer([]byte(shardReq.String())))
@@ -282,7 +534,8 @@ func (suite *ApiTestSuite) TestGinAddShard_notFound() {
 	w := httptest.NewRecorder()
 	suite.testRouter.ServeHTTP(w, req)
 
-	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+	assert.Equal(suite.T(), w.Code, http.StatusNotFound)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeServiceNotFound))
 }
 
 func (suite *ApiTestSuite) TestGinAddShard_success() {
@@ -290,7 +543,75 @@ func (suite *ApiTestSuite) TestGinAddShard_success() {
 	pfx := fmt.Sprintf("/sm/app/foo/service/%s/shard/%s", shardReq.Service, shardReq.ShardId)
 	suite.container.shards[shardReq.Service] = new(smShard)
 
+	spec := smAppSpec{Service: shardReq.Service}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}}, nil)
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{pfx}, mock.Anything, clientv3.NoLease).Return(nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBuffer([]byte(shardReq.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestGinAddShard_quotaExceeded() {
+	shardReq := addShardRequest{Service: "serviceA", ShardId: "shardC"}
+	suite.container.shards[shardReq.Service] = new(smShard)
+	suite.container.quotas = newQuotaChecker(Quota{MaxShardsPerService: 2}, nil)
+
+	spec := smAppSpec{Service: shardReq.Service}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}}, nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/shard/", mock.Anything).Return(&clientv3.GetResponse{Count: 2}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBuffer([]byte(shardReq.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "CreateAndGet", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(suite.T(), w.Code, http.StatusForbidden)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeQuotaExceeded))
+}
+
+func (suite *ApiTestSuite) TestGinAddShard_shardDefaults() {
+	shardReq := addShardRequest{Service: "serviceA", ShardId: "shardA", Priority: 2}
+	pfx := fmt.Sprintf("/sm/app/foo/service/%s/shard/%s", shardReq.Service, shardReq.ShardId)
+	suite.container.shards[shardReq.Service] = new(smShard)
+
+	spec := smAppSpec{Service: shardReq.Service, ShardDefaults: &shardDefaults{Task: "topic-{shardId}", Priority: 1, LoadEstimate: 10}}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}}, nil)
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{pfx}, mock.Anything, clientv3.NoLease).Return(nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBuffer([]byte(shardReq.String())))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	// 请求中设置的priority优先，没有设置的字段使用默认值
+	mockedEtcdWrapper.AssertCalled(suite.T(), "CreateAndGet", mock.Anything, []string{pfx}, mock.MatchedBy(func(values []string) bool {
+		var shardSpec apputil.ShardSpec
+		_ = json.Unmarshal([]byte(values[0]), &shardSpec)
+		return shardSpec.Task == "topic-shardA" && shardSpec.Priority == 2 && shardSpec.LoadEstimate == 10
+	}), clientv3.NoLease)
+}
+
+func (suite *ApiTestSuite) TestGinAddShard_encryptTask() {
+	shardReq := addShardRequest{Service: "serviceA", ShardId: "shardA", Task: "password=secret"}
+	pfx := fmt.Sprintf("/sm/app/foo/service/%s/shard/%s", shardReq.Service, shardReq.ShardId)
+	suite.container.shards[shardReq.Service] = new(smShard)
+	suite.container.taskKey = []byte("0123456789abcdef")
+
+	spec := smAppSpec{Service: shardReq.Service}
 	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}}, nil)
 	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{pfx}, mock.Anything, clientv3.NoLease).Return(nil)
 	suite.container.Client = mockedEtcdWrapper
 
@@ -300,6 +621,13 @@ func (suite *ApiTestSuite) TestGinAddShard_success() {
 	suite.testRouter.ServeHTTP(w, req)
 
 	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	// etcd中只保存密文，使用相同的key可以解密
+	mockedEtcdWrapper.AssertCalled(suite.T(), "CreateAndGet", mock.Anything, []string{pfx}, mock.MatchedBy(func(values []string) bool {
+		var shardSpec apputil.ShardSpec
+		_ = json.Unmarshal([]byte(values[0]), &shardSpec)
+		task, err := apputil.DecryptTask(suite.container.taskKey, shardSpec.Task)
+		return apputil.TaskEncrypted(shardSpec.Task) && err == nil && task == "password=secret"
+	}), clientv3.NoLease)
 }
 
 func (suite *ApiTestSuite) TestGinDelShard_bindError() {
@@ -340,6 +668,9 @@ func (suite *ApiTestSuite) TestGinDelShard_success() {
 	mockedEtcdWrapper := new(MockedEtcdWrapper)
 	delResp := clientv3.DeleteResponse{Deleted: 1}
 	mockedEtcdWrapper.On("Delete", mock.Anything, pfx, mock.Anything).Return(&delResp, nil)
+	// shard和secondary副本的fencing节点
+	mockedEtcdWrapper.On("Delete", mock.Anything, "/sm/app/serviceA/fencing/shardA", mock.Anything).Return(&delResp, nil)
+	mockedEtcdWrapper.On("Delete", mock.Anything, "/sm/app/serviceA/fencing/shardA#", mock.Anything).Return(&delResp, nil)
 	suite.container.Client = mockedEtcdWrapper
 
 	shardReq := addShardRequest{Service: service, ShardId: shard}
@@ -372,3 +703,715 @@ func (suite *ApiTestSuite) TestGinGetShard_success() {
 	suite.testRouter.ServeHTTP(w, req)
 	assert.Equal(suite.T(), w.Code, http.StatusOK)
 }
+
+func (suite *ApiTestSuite) TestGinDashboard() {
+	req := httptest.NewRequest(http.MethodGet, "/sm/dashboard", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	assert.Contains(suite.T(), w.Body.String(), "/sm/server/cluster-state")
+}
+
+func (suite *ApiTestSuite) TestGinRebalancePlan_notFound() {
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/rebalance-plan?service=serviceA", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusNotFound)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeServiceNotFound))
+}
+
+func (suite *ApiTestSuite) TestGinRebalancePlan_success() {
+	service := "serviceA"
+
+	mals := moveActionList{&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1"}}
+	mockedShard := new(MockedShard)
+	mockedShard.On("RebalancePlan", mock.Anything).Return(mals, nil)
+	suite.container.shards[service] = mockedShard
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/rebalance-plan?service=serviceA", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedShard.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	assert.Contains(suite.T(), w.Body.String(), `"shardId":"s1"`)
+}
+
+func (suite *ApiTestSuite) TestGinTriggerRebalance_success() {
+	service := "serviceA"
+
+	mockedShard := new(MockedShard)
+	mockedShard.On("TriggerRebalance", mock.Anything).Return(nil)
+	suite.container.shards[service] = mockedShard
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/trigger-rebalance?service=serviceA", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedShard.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestGinPinShard_emptyContainer() {
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/pin-shard", bytes.NewBuffer([]byte(`{"service":"serviceA","shardId":"s1"}`)))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestGinPinShard_success() {
+	pfx := "/sm/app/foo/service/serviceA/shard/s1"
+	spec := apputil.ShardSpec{Service: "serviceA", Task: "t", UpdateTime: 1}
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, pfx, mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Key: []byte(pfx), Value: []byte(spec.String())}}},
+		nil,
+	)
+	mockedEtcdWrapper.On(
+		"CompareAndSwap",
+		mock.Anything,
+		pfx,
+		spec.String(),
+		mock.MatchedBy(func(v string) bool { return strings.Contains(v, `"manualContainerId":"c1"`) }),
+		clientv3.NoLease,
+	).Return("", nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/pin-shard", bytes.NewBuffer([]byte(`{"service":"serviceA","shardId":"s1","containerId":"c1"}`)))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestGinEvents_success() {
+	ev := smEvent{Type: eventMove, Service: "serviceA", Actor: "c1", Timestamp: time.Now().UnixNano()}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("Get", mock.Anything, "/sm/app/foo/event/serviceA/"+eventKey(time.Unix(100, 0).UnixNano()), mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(ev.String())}}},
+		nil,
+	)
+	suite.container.Client = mockedEtcdWrapper
+	suite.container.events = newEventLog(suite.container.lg, suite.container)
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/events?service=serviceA&since=100", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	assert.Contains(suite.T(), w.Body.String(), `"actor":"c1"`)
+}
+
+func (suite *ApiTestSuite) TestGinEvents_paramError() {
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/events?service=serviceA&since=foo", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestGinUnassignedShards_success() {
+	service := "serviceA"
+
+	mockedShard := new(MockedShard)
+	mockedShard.On("UnassignedShards").Return([]string{"s3"})
+	suite.container.shards[service] = mockedShard
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/unassigned-shards?service=serviceA", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedShard.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	assert.Contains(suite.T(), w.Body.String(), `"s3"`)
+}
+
+func (suite *ApiTestSuite) TestGinAddShardGroup_success() {
+	service := "serviceA"
+	suite.container.shards[service] = new(MockedShard)
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	spec := smAppSpec{Service: service}
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}},
+		nil,
+	)
+	for _, shardId := range []string{"orders-0", "orders-1"} {
+		mockedEtcdWrapper.On(
+			"CreateAndGet",
+			mock.Anything,
+			[]string{"/sm/app/foo/service/serviceA/shard/" + shardId},
+			mock.Anything,
+			clientv3.NoLease,
+		).Return(nil)
+	}
+	suite.container.Client = mockedEtcdWrapper
+
+	body := `{"service":"serviceA","group":{"name":"orders","count":2}}`
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard-group", bytes.NewBuffer([]byte(body)))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestGinAddShardGroup_invalidTask() {
+	service := "serviceA"
+	suite.container.shards[service] = new(MockedShard)
+
+	// 没有task时partition序号作为task，不满足schema
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	spec := smAppSpec{Service: service, TaskSchema: json.RawMessage(`{"type":"object"}`)}
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}},
+		nil,
+	)
+	suite.container.Client = mockedEtcdWrapper
+
+	body := `{"service":"serviceA","group":{"name":"orders","count":2}}`
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard-group", bytes.NewBuffer([]byte(body)))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeInvalidTask))
+}
+
+func (suite *ApiTestSuite) TestGinAddShardGroup_countError() {
+	suite.container.shards["serviceA"] = new(MockedShard)
+
+	body := `{"service":"serviceA","group":{"name":"orders","count":0}}`
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard-group", bytes.NewBuffer([]byte(body)))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestGinListServices_success() {
+	spec := smAppSpec{Service: "serviceA", MaxShardsPerContainer: 2}
+	hb := apputil.ShardHeartbeat{ContainerId: "c1"}
+	smHb := apputil.ShardHeartbeat{ContainerId: "sm1"}
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/leader", mock.Anything).Return(&clientv3.GetResponse{}, nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/", mock.Anything).Return(
+		&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{
+			{Key: []byte("/sm/app/foo/service/serviceA/spec"), Value: []byte(spec.String()), ModRevision: 3},
+			{Key: []byte("/sm/app/foo/service/serviceA/shard/s1"), Value: []byte("{}")},
+		}},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/shardhb/", mock.Anything).Return(
+		&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte("/sm/app/foo/shardhb/serviceA/1"), Value: []byte(smHb.String())}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKVs", mock.Anything, "/sm/app/foo/service/serviceA/shard/").Return(
+		map[string]string{"s1": "{}", "s2": "{}"},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/serviceA/shardhb/", mock.Anything).Return(
+		&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte("/sm/app/serviceA/shardhb/s1/1"), Value: []byte(hb.String())}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/serviceA/containerhb/", mock.Anything).Return(
+		&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte("/sm/app/serviceA/containerhb/c1/1")}}},
+		nil,
+	)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/list-services", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	assert.Contains(suite.T(), w.Body.String(), `"shards":2,"assigned":1,"governor":"sm1","containers":["c1"]`)
+}
+
+func (suite *ApiTestSuite) TestGinExport_success() {
+	spec := smAppSpec{Service: "serviceA", MaxShardsPerContainer: 2, ShardGroups: []*shardGroup{{Name: "g", Count: 1}}}
+	shardSpec := apputil.ShardSpec{Service: "serviceA", Task: "t1"}
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKVs", mock.Anything, "/sm/app/foo/service/foo/shard/").Return(map[string]string{"serviceA": "{}"}, nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKVs", mock.Anything, "/sm/app/foo/service/serviceA/shard/").Return(map[string]string{"s1": shardSpec.String()}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/export", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	var doc specDocument
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(suite.T(), 1, len(doc.Services))
+	assert.Equal(suite.T(), 2, doc.Services[0].Spec.MaxShardsPerContainer)
+	assert.Nil(suite.T(), doc.Services[0].Spec.ShardGroups)
+	assert.Equal(suite.T(), "t1", doc.Services[0].Shards["s1"].Task)
+}
+
+func (suite *ApiTestSuite) TestGinImport_success() {
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	// serviceA已经存在，只补充缺少的shard
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{"/sm/app/foo/service/serviceA/spec", "/sm/app/foo/service/foo/shard/serviceA"}, mock.Anything, clientv3.NoLease).Return(etcdutil.ErrEtcdNodeExist)
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{"/sm/app/foo/service/serviceA/shard/s1"}, mock.Anything, clientv3.NoLease).Return(etcdutil.ErrEtcdNodeExist)
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{"/sm/app/foo/service/serviceA/shard/s2"}, mock.Anything, clientv3.NoLease).Return(nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	doc := specDocument{
+		Version: specDocumentVersion,
+		Services: []*serviceDump{
+			{
+				Spec:   &smAppSpec{Service: "serviceA"},
+				Shards: map[string]*apputil.ShardSpec{"s1": {Task: "t1"}, "s2": {Task: "t2"}},
+			},
+		},
+	}
+	b, _ := json.Marshal(doc)
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/import", bytes.NewBuffer(b))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	assert.Contains(suite.T(), w.Body.String(), `{"service":"serviceA","specCreated":false,"shardsCreated":1,"shardsSkipped":1}`)
+}
+
+func (suite *ApiTestSuite) TestGinImport_versionError() {
+	doc := specDocument{Version: specDocumentVersion + 1}
+	b, _ := json.Marshal(doc)
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/import", bytes.NewBuffer(b))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestGinCloneService_success() {
+	spec := smAppSpec{Service: "prod", MaxShardsPerContainer: 2, SessionTTL: 20}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/staging/spec", mock.Anything).Return(&clientv3.GetResponse{Count: 0}, nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/prod/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String())}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKVs", mock.Anything, "/sm/app/foo/service/prod/shard/").Return(map[string]string{
+		"s1": (&apputil.ShardSpec{Service: "prod", Task: "t1"}).String(),
+		"s2": (&apputil.ShardSpec{Service: "prod", Task: "t2"}).String(),
+	}, nil)
+	// 覆盖的字段生效，没有覆盖的字段保持不变，service不能覆盖
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{"/sm/app/foo/service/staging/spec", "/sm/app/foo/service/foo/shard/staging"}, mock.MatchedBy(func(values []string) bool {
+		var cloned smAppSpec
+		_ = json.Unmarshal([]byte(values[0]), &cloned)
+		return cloned.Service == "staging" && cloned.MaxShardsPerContainer == 1 && cloned.SessionTTL == 20
+	}), clientv3.NoLease).Return(nil)
+	mockedEtcdWrapper.On("UpdateKV", mock.Anything, "/sm/app/staging/config", mock.Anything).Return(nil)
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{"/sm/app/foo/service/staging/shard/s1"}, mock.MatchedBy(func(values []string) bool {
+		var shardSpec apputil.ShardSpec
+		_ = json.Unmarshal([]byte(values[0]), &shardSpec)
+		return shardSpec.Service == "staging" && shardSpec.Task == "t1-staging"
+	}), clientv3.NoLease).Return(nil)
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{"/sm/app/foo/service/staging/shard/s2"}, mock.MatchedBy(func(values []string) bool {
+		var shardSpec apputil.ShardSpec
+		_ = json.Unmarshal([]byte(values[0]), &shardSpec)
+		return shardSpec.Service == "staging" && shardSpec.Task == "staging"
+	}), clientv3.NoLease).Return(nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	body := `{"spec": {"service": "other", "maxShardsPerContainer": 1}, "shard": {"task": "staging"}, "shards": {"s1": {"task": "t1-staging"}}}`
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/clone-service?from=prod&to=staging", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `{"service":"staging","specCreated":true,"shardsCreated":2,"shardsSkipped":0}`)
+}
+
+func (suite *ApiTestSuite) TestGinCloneService_exists() {
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/staging/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte((&smAppSpec{Service: "staging"}).String())}}},
+		nil,
+	)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/clone-service?from=prod&to=staging", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusConflict, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeServiceExists))
+}
+
+func (suite *ApiTestSuite) TestGinResignLeader_notLeader() {
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/resign-leader", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusConflict)
+	assert.Contains(suite.T(), w.Body.String(), string(errCodeNotLeader))
+}
+
+func (suite *ApiTestSuite) TestGinLeader_success() {
+	lv := leaderEtcdValue{ContainerId: "c1", CreateTime: 100, LeaseId: "1a"}
+	term := leaderTerm{Term: 3, ContainerId: "c1", LeaseId: "1a"}
+	hb := apputil.ShardHeartbeat{ContainerId: "c2"}
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/leader", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(lv.String())}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/term", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(term.String())}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, mock.Anything, mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(hb.String())}}},
+		nil,
+	)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/leader?service=serviceA", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+
+	var resp struct {
+		Leader   leaderInfo `json:"leader"`
+		Governor string     `json:"governor"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(suite.T(), resp.Leader, leaderInfo{ContainerId: "c1", LeaseId: "1a", CampaignTime: 100, Term: 3})
+	assert.Equal(suite.T(), resp.Governor, "c2")
+}
+
+func (suite *ApiTestSuite) TestGinFreeze_success() {
+	spec := smAppSpec{Service: "serviceA", MaxShardsPerContainer: 2}
+	expect := spec
+	expect.Frozen = true
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String()), ModRevision: 5}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("UpdateKVWithRevision", mock.Anything, "/sm/app/foo/service/serviceA/spec", expect.String(), int64(5)).Return(nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/", mock.Anything).Return(
+		&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte("/sm/app/foo/service/serviceA/spec"), Value: []byte(spec.String())}}},
+		nil,
+	)
+	suite.container.Client = mockedEtcdWrapper
+
+	mockedShard := new(MockedShard)
+	mockedShard.On("SetFrozen", true)
+	suite.container.shards["serviceA"] = mockedShard
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/freeze", bytes.NewBufferString(`{"service": "serviceA", "frozen": true}`))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	mockedShard.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestGinFreeze_cascade() {
+	parent := smAppSpec{Service: "serviceA"}
+	child := smAppSpec{Service: "serviceB", Parent: "serviceA"}
+	grandchild := smAppSpec{Service: "serviceC", Parent: "serviceB"}
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/", mock.Anything).Return(
+		&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{
+			{Key: []byte("/sm/app/foo/service/serviceA/spec"), Value: []byte(parent.String())},
+			{Key: []byte("/sm/app/foo/service/serviceB/spec"), Value: []byte(child.String())},
+			{Key: []byte("/sm/app/foo/service/serviceC/spec"), Value: []byte(grandchild.String())},
+		}},
+		nil,
+	)
+	for _, spec := range []smAppSpec{parent, child, grandchild} {
+		pfx := "/sm/app/foo/service/" + spec.Service + "/spec"
+		mockedEtcdWrapper.On("GetKV", mock.Anything, pfx, mock.Anything).Return(
+			&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String()), ModRevision: 5}}},
+			nil,
+		)
+		expect := spec
+		expect.Frozen = true
+		mockedEtcdWrapper.On("UpdateKVWithRevision", mock.Anything, pfx, expect.String(), int64(5)).Return(nil)
+	}
+	suite.container.Client = mockedEtcdWrapper
+
+	for _, service := range []string{"serviceA", "serviceB", "serviceC"} {
+		mockedShard := new(MockedShard)
+		mockedShard.On("SetFrozen", true)
+		suite.container.shards[service] = mockedShard
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/freeze", bytes.NewBufferString(`{"service": "serviceA", "frozen": true}`))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	for _, shard := range suite.container.shards {
+		shard.(*MockedShard).AssertExpectations(suite.T())
+	}
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"cascade":[{"service":"serviceB"},{"service":"serviceC"}]`)
+
+	// 分发过来的请求只处理请求中的service
+	req = httptest.NewRequest(http.MethodPost, "/sm/server/freeze", bytes.NewBufferString(`{"service": "serviceB", "frozen": true}`))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Set(cascadedHeader, "sm1")
+	w = httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	mockedEtcdWrapper.AssertNumberOfCalls(suite.T(), "UpdateKVWithRevision", 4)
+	mockedEtcdWrapper.AssertNumberOfCalls(suite.T(), "GetKV", 5)
+}
+
+func (suite *ApiTestSuite) TestGinDrainService_dropFailed() {
+	spec := smAppSpec{Service: "serviceA"}
+	expect := spec
+	expect.Frozen = true
+
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/serviceA/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(spec.String()), ModRevision: 5}}},
+		nil,
+	)
+	mockedEtcdWrapper.On("UpdateKVWithRevision", mock.Anything, "/sm/app/foo/service/serviceA/spec", expect.String(), int64(5)).Return(nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	// 冻结状态先持久化，drop失败时不分发给子service
+	mockedShard := new(MockedShard)
+	mockedShard.On("SetFrozen", true)
+	mockedShard.On("DropAll", mock.Anything).Return([]string{"s1"}, nil)
+	suite.container.shards["serviceA"] = mockedShard
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/drain-service", bytes.NewBufferString(`{"service": "serviceA"}`))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+	mockedShard.AssertExpectations(suite.T())
+	assert.Equal(suite.T(), http.StatusInternalServerError, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), "drop shards [s1] failed")
+	mockedEtcdWrapper.AssertNotCalled(suite.T(), "GetKV", mock.Anything, "/sm/app/foo/service/", mock.Anything)
+}
+
+func (suite *ApiTestSuite) TestGinRequeueDeadLetters_frozen() {
+	mockedShard := new(MockedShard)
+	mockedShard.On("Frozen").Return(true)
+	suite.container.shards["serviceA"] = mockedShard
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/requeue-dead-letters", bytes.NewBufferString(`{"service": "serviceA"}`))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusConflict)
+}
+
+func (suite *ApiTestSuite) TestGinEtcdMigration() {
+	// 没有开启双写
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/etcd-migration/cutover", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+
+	primary := new(MockedEtcdWrapper)
+	primary.On("GetKV", mock.Anything, "/sm", mock.Anything).Return(&clientv3.GetResponse{Count: 2, Kvs: []*mvccpb.KeyValue{
+		{Key: []byte("/sm/app/foo/service/foo/spec"), Value: []byte("{}")},
+		{Key: []byte("/sm/app/foo/containerhb/c1"), Value: []byte("{}"), Lease: 1},
+	}}, nil)
+	secondary := new(MockedEtcdWrapper)
+	secondary.On("Put", mock.Anything, "/sm/app/foo/service/foo/spec", "{}", mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	dual := etcdutil.NewDualWriteClient(suite.container.lg, primary, secondary)
+	suite.container.Client = dual
+
+	// 带lease的节点不同步
+	req = httptest.NewRequest(http.MethodPost, "/sm/server/etcd-migration/sync", nil)
+	w = httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	secondary.AssertNumberOfCalls(suite.T(), "Put", 1)
+
+	req = httptest.NewRequest(http.MethodPost, "/sm/server/etcd-migration/cutover", nil)
+	w = httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), secondary, dual.Primary())
+}
+
+func (suite *ApiTestSuite) TestGinHealth() {
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/leader", mock.Anything).Return(&clientv3.GetResponse{}, nil)
+	suite.container.Client = mockedEtcdWrapper
+	suite.container.shards["foo.bar"] = &smShard{service: "foo.bar", stopper: &apputil.GoroutineStopper{}, queued: 2}
+	donec := make(chan struct{})
+	suite.container.shardServerDone = donec
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/health", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	// 测试中没有session，foo.bar的worker也没有运行
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, w.Code)
+	var r ServerHealth
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &r))
+	assert.Equal(suite.T(), healthFail, r.Status)
+	status := make(map[string]string)
+	for _, c := range r.Components {
+		status[c.Name] = c.Status
+	}
+	assert.Equal(suite.T(), map[string]string{
+		"session":         selfCheckFail,
+		"electionSession": selfCheckWarn,
+		"leader":          selfCheckWarn,
+		"shardServer":     selfCheckOk,
+		"queue":           selfCheckOk,
+		"worker:foo.bar":  selfCheckFail,
+	}, status)
+
+	close(donec)
+	assert.Equal(suite.T(), healthFail, suite.container.health(context.TODO()).Status)
+}
+
+func (suite *ApiTestSuite) TestGinSelfCheck() {
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer leader.Close()
+	lv := leaderEtcdValue{ContainerId: strings.TrimPrefix(leader.URL, "http://")}
+
+	keys := func(keys ...string) *clientv3.GetResponse {
+		resp := clientv3.GetResponse{Count: int64(len(keys))}
+		for _, key := range keys {
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(key)})
+		}
+		return &resp
+	}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/foo/spec", mock.Anything).Return(keys("/sm/app/foo/service/foo/spec"), nil)
+	mockedEtcdWrapper.On("Put", mock.Anything, "/sm/app/foo/selfcheck/", mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	mockedEtcdWrapper.On("Delete", mock.Anything, "/sm/app/foo/selfcheck/", mock.Anything).Return(&clientv3.DeleteResponse{}, nil)
+	// serviceB有spec但是没有注册
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/service/", mock.Anything).Return(keys(
+		"/sm/app/foo/service/foo/spec",
+		"/sm/app/foo/service/foo/shard/serviceA",
+		"/sm/app/foo/service/serviceA/spec",
+		"/sm/app/foo/service/serviceB/spec",
+	), nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/", mock.Anything).Return(keys(), nil)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/leader", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(lv.String())}}}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/selfcheck", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, w.Code)
+	var report SelfCheckReport
+	assert.Nil(suite.T(), json.Unmarshal(w.Body.Bytes(), &report))
+	status := make(map[string]string)
+	for _, item := range report.Items {
+		status[item.Name] = item.Status
+	}
+	assert.Equal(suite.T(), map[string]string{
+		"etcd":       selfCheckOk,
+		"permission": selfCheckOk,
+		"spec":       selfCheckFail,
+		"orphans":    selfCheckOk,
+		"leader":     selfCheckOk,
+	}, status)
+}
+
+func (suite *ApiTestSuite) TestGinPause() {
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("Put", mock.Anything, "/sm/app/foo/pause", mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil).Once()
+	suite.container.Client = mockedEtcdWrapper
+
+	// 必须设置过期时间
+	for _, body := range []string{`{"duration": 0}`, `{"duration": 86401}`} {
+		req := httptest.NewRequest(http.MethodPost, "/sm/server/pause", bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		suite.testRouter.ServeHTTP(w, req)
+		assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/pause", bytes.NewBufferString(`{"duration": 600, "reason": "etcd upgrade"}`))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	mockedEtcdWrapper.AssertExpectations(suite.T())
+
+	var p schedulerPause
+	assert.Nil(suite.T(), json.Unmarshal([]byte(mockedEtcdWrapper.Calls[0].Arguments.String(2)), &p))
+	assert.Equal(suite.T(), "etcd upgrade", p.Reason)
+	assert.True(suite.T(), p.active(time.Now()))
+	assert.False(suite.T(), p.active(time.Now().Add(601*time.Second)))
+}
+
+func (suite *ApiTestSuite) TestGinPauseStatus() {
+	expired := schedulerPause{Until: time.Now().Add(-time.Second).Unix()}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/pause", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(expired.String())}}}, nil)
+	suite.container.Client = mockedEtcdWrapper
+
+	// 过期的暂停自动解除
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/pause-status", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.JSONEq(suite.T(), `{"paused": false, "pause": null}`, w.Body.String())
+	assert.False(suite.T(), suite.container.schedulerPaused(context.TODO()))
+}
+
+func (suite *ApiTestSuite) TestGinExplain() {
+	service := "serviceA"
+
+	mockedShard := new(MockedShard)
+	mockedShard.On("Explain", mock.Anything, "s1").Return(&shardExplanation{Service: service, ShardId: "s1", ContainerId: "c1", Rule: &placementRule{Assignor: "count"}}, nil)
+	mockedShard.On("Explain", mock.Anything, "s2").Return(nil, errShardNotFound)
+	suite.container.shards[service] = mockedShard
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/explain?service=serviceA", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/sm/server/explain?service=serviceA&shard=s1", nil)
+	w = httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Contains(suite.T(), w.Body.String(), `"containerId":"c1"`)
+
+	req = httptest.NewRequest(http.MethodGet, "/sm/server/explain?service=serviceA&shard=s2", nil)
+	w = httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), http.StatusNotFound, w.Code)
+	mockedShard.AssertExpectations(suite.T())
+}
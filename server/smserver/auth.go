@@ -0,0 +1,200 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// allServices 授权给identity所有service的操作权限
+	allServices = "*"
+
+	// ctxKeyAuthServices gin.Context中存放当前请求可操作的service
+	ctxKeyAuthServices = "smAuthServices"
+	// ctxKeyAuthIdentity gin.Context中存放当前请求的identity，作为租户使用
+	ctxKeyAuthIdentity = "smAuthIdentity"
+
+	headerToken = "X-SM-Token"
+)
+
+// apiAuth 对 /sm/server 下的管理接口鉴权，identity（token）限定可以操作的service，
+// 避免一个租户删除其他租户的shard
+type apiAuth struct {
+	lg *zap.Logger
+
+	// tokens token到可操作service的映射
+	tokens map[string]map[string]struct{}
+}
+
+func newApiAuth(lg *zap.Logger, tokens map[string][]string) *apiAuth {
+	return &apiAuth{lg: lg, tokens: toServiceSet(tokens)}
+}
+
+func toServiceSet(v map[string][]string) map[string]map[string]struct{} {
+	r := make(map[string]map[string]struct{})
+	for identity, services := range v {
+		set := make(map[string]struct{})
+		for _, service := range services {
+			set[service] = struct{}{}
+		}
+		r[identity] = set
+	}
+	return r
+}
+
+// enabled 没有配置任何identity时，保持接口开放，兼容之前的部署
+func (a *apiAuth) enabled() bool {
+	return a != nil && len(a.tokens) > 0
+}
+
+// wrap 给handler挂上鉴权逻辑，handler内部可以通过 authorized 判断service的权限
+func (a *apiAuth) wrap(handler func(c *gin.Context)) func(c *gin.Context) {
+	if !a.enabled() {
+		return handler
+	}
+	return func(c *gin.Context) {
+		identity, services, ok := a.identify(c)
+		if !ok {
+			a.lg.Warn(
+				"unauthenticated request",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("remote", c.ClientIP()),
+			)
+			apiErrorResponse(c, errCodeUnauthenticated, errors.New("unauthenticated"))
+			return
+		}
+		c.Set(ctxKeyAuthServices, services)
+		c.Set(ctxKeyAuthIdentity, identity)
+
+		// query和body都带service时必须一致，否则鉴权的service和handler实际bind的service不是同一个
+		queryService, bodyService := requestServices(c)
+		if queryService != "" && bodyService != "" && queryService != bodyService {
+			a.lg.Warn(
+				"service mismatch between query and body",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("query", queryService),
+				zap.String("body", bodyService),
+			)
+			apiErrorResponse(c, errCodeParam, errors.New("service mismatch between query and body"))
+			return
+		}
+
+		// 请求中不带service的接口（例如get-spec），由handler自己过滤结果
+		service := requestService(c)
+		if service != "" && !authorized(c, service) {
+			a.lg.Warn(
+				"unauthorized request",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("service", service),
+			)
+			apiErrorResponse(c, errCodeForbidden, errors.New("forbidden"))
+			return
+		}
+		handler(c)
+	}
+}
+
+// admin 不针对单个service的全局接口（pause、backup等），只允许scope为 * 的identity调用
+func (a *apiAuth) admin(handler func(c *gin.Context)) func(c *gin.Context) {
+	if !a.enabled() {
+		return handler
+	}
+	return a.wrap(func(c *gin.Context) {
+		if !authorized(c, allServices) {
+			a.lg.Warn(
+				"admin scope required",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("identity", c.GetString(ctxKeyAuthIdentity)),
+			)
+			apiErrorResponse(c, errCodeForbidden, errors.New("admin scope required"))
+			return
+		}
+		handler(c)
+	})
+}
+
+// identify token可以放在 X-SM-Token 或者 Authorization 中
+func (a *apiAuth) identify(c *gin.Context) (string, map[string]struct{}, bool) {
+	token := c.GetHeader(headerToken)
+	if token == "" {
+		token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if token != "" {
+		if services, ok := a.tokens[token]; ok {
+			return tokenIdentity(token), services, true
+		}
+	}
+	return "", nil, false
+}
+
+// tokenIdentity token会被记录到etcd和日志中，使用hash代替token本身
+func tokenIdentity(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token-" + hex.EncodeToString(sum[:8])
+}
+
+// requestService 提取handler实际bind的service，json body优先，没有body的GET接口使用query
+func requestService(c *gin.Context) string {
+	queryService, bodyService := requestServices(c)
+	if bodyService != "" {
+		return bodyService
+	}
+	return queryService
+}
+
+// requestServices 分别从query和json body中提取service，body读取后需要放回去，handler还要bind
+func requestServices(c *gin.Context) (string, string) {
+	queryService := c.Query("service")
+	if c.Request.Body == nil {
+		return queryService, ""
+	}
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return queryService, ""
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+
+	var req struct {
+		Service string `json:"service"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return queryService, ""
+	}
+	return queryService, req.Service
+}
+
+// authorized 未开启鉴权时所有service都可以操作
+func authorized(c *gin.Context, service string) bool {
+	v, ok := c.Get(ctxKeyAuthServices)
+	if !ok {
+		return true
+	}
+	services := v.(map[string]struct{})
+	if _, ok := services[allServices]; ok {
+		return true
+	}
+	_, ok = services[service]
+	return ok
+}
@@ -0,0 +1,109 @@
+package smserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func Test_apiAuth_wrap(t *testing.T) {
+	lg, _ := zap.NewDevelopment()
+	auth := newApiAuth(lg, map[string][]string{"foo-token": {"foo"}, "admin-token": {allServices}})
+
+	var tests = []struct {
+		token  string
+		method string
+		url    string
+		body   string
+		expect int
+	}{
+		{token: "", method: http.MethodGet, url: "/test?service=foo", expect: http.StatusUnauthorized},
+		{token: "bad-token", method: http.MethodGet, url: "/test?service=foo", expect: http.StatusUnauthorized},
+		{token: "foo-token", method: http.MethodGet, url: "/test?service=foo", expect: http.StatusOK},
+		{token: "foo-token", method: http.MethodGet, url: "/test?service=bar", expect: http.StatusForbidden},
+		{token: "foo-token", method: http.MethodPost, url: "/test", body: `{"service":"bar","shardId":"1"}`, expect: http.StatusForbidden},
+		{token: "foo-token", method: http.MethodPost, url: "/test", body: `{"service":"foo","shardId":"1"}`, expect: http.StatusOK},
+		{token: "admin-token", method: http.MethodPost, url: "/test", body: `{"service":"bar","shardId":"1"}`, expect: http.StatusOK},
+		// query中的service不能替body中的service通过鉴权
+		{token: "foo-token", method: http.MethodPost, url: "/test?service=foo", body: `{"service":"bar","shardId":"1"}`, expect: http.StatusBadRequest},
+		{token: "admin-token", method: http.MethodPost, url: "/test?service=foo", body: `{"service":"bar","shardId":"1"}`, expect: http.StatusBadRequest},
+		{token: "foo-token", method: http.MethodPost, url: "/test?service=foo", body: `{"service":"foo","shardId":"1"}`, expect: http.StatusOK},
+	}
+	for idx, tt := range tests {
+		router := gin.New()
+		router.Any("/test", auth.wrap(func(c *gin.Context) {
+			// body需要能被handler再次读取
+			var req delShardRequest
+			if c.Request.Method == http.MethodPost {
+				if err := c.ShouldBind(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{})
+					return
+				}
+			}
+			c.JSON(http.StatusOK, gin.H{})
+		}))
+
+		req := httptest.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+		req.Header.Add("Content-Type", "application/json")
+		if tt.token != "" {
+			req.Header.Add(headerToken, tt.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.expect {
+			t.Errorf("idx %d expect %d actual %d", idx, tt.expect, w.Code)
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_apiAuth_admin(t *testing.T) {
+	lg, _ := zap.NewDevelopment()
+	auth := newApiAuth(lg, map[string][]string{"foo-token": {"foo"}, "admin-token": {allServices}})
+
+	var tests = []struct {
+		token  string
+		expect int
+	}{
+		{token: "", expect: http.StatusUnauthorized},
+		{token: "foo-token", expect: http.StatusForbidden},
+		{token: "admin-token", expect: http.StatusOK},
+	}
+	for idx, tt := range tests {
+		router := gin.New()
+		router.Any("/test", auth.admin(func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{})
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBufferString("{}"))
+		req.Header.Add("Content-Type", "application/json")
+		if tt.token != "" {
+			req.Header.Add(headerToken, tt.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.expect {
+			t.Errorf("idx %d expect %d actual %d", idx, tt.expect, w.Code)
+		}
+	}
+}
+
+func Test_apiAuth_disabled(t *testing.T) {
+	lg, _ := zap.NewDevelopment()
+	auth := newApiAuth(lg, nil)
+
+	router := gin.New()
+	router.Any("/test", auth.wrap(func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/test?service=foo", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expect %d actual %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/coordination"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// backupDocumentVersion 备份文件格式变化时递增，restore拒绝不认识的版本
+	backupDocumentVersion = 1
+
+	// defaultBackupKeep 备份目录中保留的备份文件数量
+	defaultBackupKeep = 7
+
+	// restoreBatchSize 单个txn写入的key数量，etcd默认限制单个txn最多128个操作
+	restoreBatchSize = 64
+
+	backupFilePrefix = "sm-backup-"
+	backupFileSuffix = ".json"
+)
+
+var errBackupDirNotConfigured = errors.New("backup dir not configured")
+
+// backupKV Key是去掉etcd prefix之后的路径，restore到使用其他prefix的集群时重新拼接
+type backupKV struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// backupDocument prefix下所有没有绑定lease的key，heartbeat、leader等临时节点由存活的进程重新创建
+type backupDocument struct {
+	Version int `json:"version"`
+	// Service sm自己的service，restore时必须一致，否则spec的路径对不上
+	Service  string      `json:"service"`
+	Time     int64       `json:"time"`
+	Revision int64       `json:"revision"`
+	Kvs      []*backupKV `json:"kvs"`
+}
+
+// BackupResult 一次备份的结果，File为空表示没有写入备份目录
+type BackupResult struct {
+	File     string `json:"file,omitempty"`
+	Time     int64  `json:"time"`
+	Revision int64  `json:"revision"`
+	Keys     int    `json:"keys"`
+}
+
+// backuper leader按照interval把prefix下的key保存到备份目录，也可以通过api触发，
+// 备份目录可以是挂载的共享存储，leader切换后继续写入同一个目录
+type backuper struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	nodeManager *nodeManager
+
+	mu sync.Mutex
+	// dir 为空时只能通过api下载备份，不做定时备份
+	dir      string
+	interval time.Duration
+	keep     int
+	last     *BackupResult
+}
+
+func newBackuper(lg *zap.Logger, client etcdutil.EtcdWrapper, nodeManager *nodeManager) *backuper {
+	return &backuper{lg: lg, client: client, nodeManager: nodeManager, keep: defaultBackupKeep}
+}
+
+func (b *backuper) setStore(dir string, interval time.Duration, keep int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dir = dir
+	b.interval = interval
+	if keep > 0 {
+		b.keep = keep
+	}
+}
+
+// scheduled 返回定时备份的间隔，没有备份目录或者间隔为0时不做定时备份
+func (b *backuper) scheduled() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.interval, b.dir != "" && b.interval > 0
+}
+
+// snapshot 在同一个revision读取prefix下所有的key
+func (b *backuper) snapshot(ctx context.Context) (*backupDocument, error) {
+	pfx := b.nodeManager.etcdPath.Prefix()
+	resp, err := b.client.GetKV(ctx, pfx+"/", []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	doc := backupDocument{
+		Version:  backupDocumentVersion,
+		Service:  b.nodeManager.smService,
+		Time:     time.Now().Unix(),
+		Revision: resp.Header.GetRevision(),
+		Kvs:      make([]*backupKV, 0, len(resp.Kvs)),
+	}
+	for _, kv := range resp.Kvs {
+		if kv.Lease != 0 {
+			continue
+		}
+		doc.Kvs = append(doc.Kvs, &backupKV{Key: strings.TrimPrefix(string(kv.Key), pfx), Value: kv.Value})
+	}
+	return &doc, nil
+}
+
+// save 备份写入临时文件后rename，不会留下写了一半的备份，之后删除超过keep数量的旧备份
+func (b *backuper) save(ctx context.Context) (*BackupResult, error) {
+	b.mu.Lock()
+	dir, keep := b.dir, b.keep
+	b.mu.Unlock()
+	if dir == "" {
+		return nil, errBackupDirNotConfigured
+	}
+
+	doc, err := b.snapshot(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	name := fmt.Sprintf("%s%s-%d%s", backupFilePrefix, time.Unix(doc.Time, 0).UTC().Format("20060102T150405Z"), doc.Revision, backupFileSuffix)
+	file := filepath.Join(dir, name)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return nil, errors.Wrap(err, "")
+	}
+
+	result := BackupResult{File: file, Time: doc.Time, Revision: doc.Revision, Keys: len(doc.Kvs)}
+	b.mu.Lock()
+	b.last = &result
+	b.mu.Unlock()
+	b.lg.Info("backup saved",
+		zap.String("file", file),
+		zap.Int64("revision", doc.Revision),
+		zap.Int("keys", len(doc.Kvs)),
+	)
+
+	if err := pruneBackups(dir, keep); err != nil {
+		// 清理失败不影响本次备份
+		b.lg.Warn("prune backups error", zap.String("dir", dir), zap.Error(err))
+	}
+	return &result, nil
+}
+
+func (b *backuper) lastResult() *BackupResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
+
+// pruneBackups 文件名中的时间保证按名称排序就是按时间排序，只删除sm生成的备份文件
+func pruneBackups(dir string, keep int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	return nil
+}
+
+// validateBackup restore写入之前校验所有spec和shard，返回service和shard的数量
+func validateBackup(doc *backupDocument, nm *nodeManager) (int, int, error) {
+	if doc.Version != backupDocumentVersion {
+		return 0, 0, errors.Errorf("unsupported version %d", doc.Version)
+	}
+	if doc.Service != nm.smService {
+		return 0, 0, errors.Errorf("backup of service %s can not be restored to %s", doc.Service, nm.smService)
+	}
+
+	pfx := nm.nodeSM() + "/service/"
+	specs := make(map[string]struct{})
+	shards := make(map[string][]string)
+	seen := make(map[string]struct{})
+	for _, kv := range doc.Kvs {
+		if kv.Key == "" || !strings.HasPrefix(kv.Key, "/") {
+			return 0, 0, errors.Errorf("invalid key %q", kv.Key)
+		}
+		if _, ok := seen[kv.Key]; ok {
+			return 0, 0, errors.Errorf("duplicate key %s", kv.Key)
+		}
+		seen[kv.Key] = struct{}{}
+
+		key := nm.etcdPath.Prefix() + kv.Key
+		if !strings.HasPrefix(key, pfx) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(key, pfx), "/")
+		switch {
+		case len(parts) == 2 && parts[1] == "spec":
+			var spec smAppSpec
+			if err := json.Unmarshal(kv.Value, &spec); err != nil {
+				return 0, 0, errors.Wrap(err, key)
+			}
+			if spec.Service != parts[0] {
+				return 0, 0, errors.Errorf("spec %s has service %s", key, spec.Service)
+			}
+			if err := spec.validate(); err != nil {
+				return 0, 0, errors.Wrap(err, key)
+			}
+			specs[parts[0]] = struct{}{}
+		case len(parts) == 3 && parts[1] == "shard":
+			var shardSpec apputil.ShardSpec
+			if err := json.Unmarshal(kv.Value, &shardSpec); err != nil {
+				return 0, 0, errors.Wrap(err, key)
+			}
+			if shardSpec.Service != "" && shardSpec.Service != parts[0] {
+				return 0, 0, errors.Errorf("shard %s has service %s", key, shardSpec.Service)
+			}
+			shards[parts[0]] = append(shards[parts[0]], parts[2])
+		}
+	}
+
+	var count int
+	for service, ids := range shards {
+		if _, ok := specs[service]; !ok {
+			return 0, 0, errors.Errorf("service %s has shards but no spec", service)
+		}
+		// sm的shard是注册的service
+		if service == nm.smService {
+			for _, id := range ids {
+				if _, ok := specs[id]; !ok {
+					return 0, 0, errors.Errorf("service %s registered without spec", id)
+				}
+			}
+			continue
+		}
+		count += len(ids)
+	}
+	if _, ok := specs[nm.smService]; !ok {
+		return 0, 0, errors.Errorf("spec of %s not found", nm.smService)
+	}
+	return len(specs) - 1, count, nil
+}
+
+// RestoreReport Check是写入之后对目标集群的自检结果
+type RestoreReport struct {
+	Ok       bool             `json:"ok"`
+	Revision int64            `json:"revision"`
+	Keys     int              `json:"keys"`
+	Services int              `json:"services"`
+	Shards   int              `json:"shards"`
+	Check    *SelfCheckReport `json:"check"`
+}
+
+// Restore 使用和 NewServer 相同的选项，把备份文件写入一个新的etcd集群，目标prefix下已经存在key时拒绝，
+// 写入之后重新读取所有的spec并执行自检
+func Restore(file string, fn ...ServerOption) (*RestoreReport, error) {
+	ops := serverOptions{}
+	for _, f := range fn {
+		f(&ops)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var doc backupDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	client, etcdPath, err := newOptionsEtcdClient(&ops)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	defer client.Close()
+
+	nm := &nodeManager{smService: ops.service, etcdPath: etcdPath}
+	services, shards, err := validateBackup(&doc, nm)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid backup")
+	}
+
+	ctx := context.Background()
+	pfx := etcdPath.Prefix()
+	resp, err := client.GetKV(ctx, pfx+"/", []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCountOnly()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count > 0 {
+		return nil, errors.Errorf("prefix %s is not empty, %d keys exist", pfx, resp.Count)
+	}
+
+	for i := 0; i < len(doc.Kvs); i += restoreBatchSize {
+		end := i + restoreBatchSize
+		if end > len(doc.Kvs) {
+			end = len(doc.Kvs)
+		}
+		var nodes, values []string
+		for _, kv := range doc.Kvs[i:end] {
+			nodes = append(nodes, pfx+kv.Key)
+			values = append(values, string(kv.Value))
+		}
+		if err := client.CreateAndGet(ctx, nodes, values, clientv3.NoLease); err != nil {
+			return nil, errors.Wrapf(err, "restore keys %d-%d", i, end)
+		}
+	}
+	ops.lg.Info("restore written",
+		zap.String("file", file),
+		zap.Int64("revision", doc.Revision),
+		zap.Int("keys", len(doc.Kvs)),
+	)
+
+	// 重新读取写入的数据校验，防止写入过程中被其他客户端修改
+	restored, err := newBackuper(ops.lg, client, nm).snapshot(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	restored.Version, restored.Service = doc.Version, doc.Service
+	if len(restored.Kvs) != len(doc.Kvs) {
+		return nil, errors.Errorf("restored %d keys, expect %d", len(restored.Kvs), len(doc.Kvs))
+	}
+	if _, _, err := validateBackup(restored, nm); err != nil {
+		return nil, errors.Wrap(err, "invalid restored data")
+	}
+
+	probeId := ops.id
+	if probeId == "" {
+		probeId = GetLocalIP()
+	}
+	report := RestoreReport{Revision: doc.Revision, Keys: len(doc.Kvs), Services: services, Shards: shards}
+	report.Check = newSelfChecker(ops.lg, client, coordination.NewEtcdBackend(client), nm, probeId).run(ctx)
+	report.Ok = report.Check.Ok
+	return &report, nil
+}
+
+// @Description save all keys under the etcd prefix to the backup dir, or download them when the method is GET
+// @Tags  leader
+// @Produce  json
+// @success 200 {object} BackupResult
+// @Router /sm/server/backup [post]
+func (ss *smShardApi) GinBackup(c *gin.Context) {
+	if c.Request.Method == http.MethodGet {
+		doc, err := ss.container.backuper.snapshot(c.Request.Context())
+		if err != nil {
+			ss.lg.Error("backup snapshot error", zap.Error(err))
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s%d%s", backupFilePrefix, doc.Revision, backupFileSuffix))
+		c.JSON(http.StatusOK, doc)
+		return
+	}
+
+	result, err := ss.container.backuper.save(c.Request.Context())
+	if err != nil {
+		ss.lg.Error("backup save error", zap.Error(err))
+		if err == errBackupDirNotConfigured {
+			apiErrorResponse(c, errCodeParam, err)
+			return
+		}
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"backup": result})
+}
@@ -0,0 +1,112 @@
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_backuper_save(t *testing.T) {
+	client := new(MockedEtcdWrapper)
+	nm := &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")}
+	b := newBackuper(ttLogger, client, nm)
+
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/sm/app/sm/leader/1"), Value: []byte("{}"), Lease: 1},
+		{Key: []byte("/sm/app/sm/service/sm/spec"), Value: []byte(`{"service":"sm"}`)},
+		{Key: []byte("/sm/app/sm/service/foo/spec"), Value: []byte(`{"service":"foo"}`)},
+		{Key: []byte("/sm/app/sm/service/sm/shard/foo"), Value: []byte(`{"service":"sm"}`)},
+		{Key: []byte("/sm/app/sm/service/foo/shard/s1"), Value: []byte(`{"service":"foo","task":"t1"}`)},
+		{Key: []byte("/sm/app/foo/containerhb/c1/1"), Value: []byte("{}"), Lease: 1},
+	}
+	client.On("GetKV", mock.Anything, "/sm/", mock.Anything).Return(
+		&clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: 10}, Count: int64(len(kvs)), Kvs: kvs}, nil)
+
+	// 没有配置备份目录
+	_, err := b.save(context.TODO())
+	assert.Equal(t, errBackupDirNotConfigured, err)
+
+	dir := t.TempDir()
+	b.setStore(dir, 0, 2)
+	for _, name := range []string{"sm-backup-20200101T000000Z-1.json", "sm-backup-20200102T000000Z-2.json", "other.json"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0600))
+	}
+	result, err := b.save(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 4, result.Keys)
+	assert.Equal(t, int64(10), result.Revision)
+	assert.Equal(t, result, b.lastResult())
+
+	// 只保留最新的2个备份，其他文件不处理
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "sm-backup-20200102T000000Z-2.json"),
+		filepath.Join(dir, "other.json"),
+		result.File,
+	}, files)
+
+	data, err := ioutil.ReadFile(result.File)
+	assert.Nil(t, err)
+	var doc backupDocument
+	assert.Nil(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, "/app/sm/service/foo/spec", doc.Kvs[1].Key)
+
+	// restore到其他prefix
+	services, shards, err := validateBackup(&doc, &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("/bak")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, services)
+	assert.Equal(t, 1, shards)
+
+	_, _, err = validateBackup(&doc, &nodeManager{smService: "sm2", etcdPath: apputil.NewEtcdPath("")})
+	assert.NotNil(t, err)
+}
+
+func Test_validateBackup(t *testing.T) {
+	nm := &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")}
+	smSpec := &backupKV{Key: "/app/sm/service/sm/spec", Value: []byte(`{"service":"sm"}`)}
+	tests := []struct {
+		name string
+		kvs  []*backupKV
+	}{
+		{
+			name: "invalid spec",
+			kvs:  []*backupKV{smSpec, {Key: "/app/sm/service/foo/spec", Value: []byte(`{"service":"foo","sessionTTL":-1}`)}},
+		},
+		{
+			name: "spec of other service",
+			kvs:  []*backupKV{smSpec, {Key: "/app/sm/service/foo/spec", Value: []byte(`{"service":"bar"}`)}},
+		},
+		{
+			name: "shard without spec",
+			kvs:  []*backupKV{smSpec, {Key: "/app/sm/service/foo/shard/s1", Value: []byte(`{"service":"foo"}`)}},
+		},
+		{
+			name: "registered without spec",
+			kvs:  []*backupKV{smSpec, {Key: "/app/sm/service/sm/shard/foo", Value: []byte(`{"service":"sm"}`)}},
+		},
+		{
+			name: "duplicate key",
+			kvs:  []*backupKV{smSpec, smSpec},
+		},
+		{
+			name: "no sm spec",
+			kvs:  []*backupKV{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := backupDocument{Version: backupDocumentVersion, Service: "sm", Kvs: tt.kvs}
+			_, _, err := validateBackup(&doc, nm)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -1,13 +1,28 @@
 package smserver
 
+import (
+	"sort"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+)
+
 type balancer struct {
 	bcs map[string]*balancerContainer
+
+	// filter shard的placement约束，为空不限制
+	filter *constraintFilter
+
+	// costOf 返回shard的迁移代价，为空时代价都是0
+	costOf func(shardId string) int64
 }
 
 type balancerContainer struct {
 	// id container标识
 	id string
 
+	// zone container所在的可用区
+	zone string
+
 	// shards shard => nothing
 	shards map[string]*balancerShard
 }
@@ -18,22 +33,53 @@ type balancerShard struct {
 
 	// isManual 是否是制定container的
 	isManual bool
+
+	// priority 对应 apputil.ShardSpec 中的Priority
+	priority int
+
+	// weight 对应 apputil.ShardSpec 中的Weight，最小为1
+	weight int
+
+	// cost 对应 apputil.ShardSpec 中的MoveCost
+	cost int64
 }
 
-func (b *balancer) put(containerId, shardId string, isManual bool) {
+func (b *balancer) put(containerId, shardId string, isManual bool, priority int, weight int) {
 	b.addContainer(containerId)
 	b.bcs[containerId].shards[shardId] = &balancerShard{
 		id:       shardId,
 		isManual: isManual,
+		priority: priority,
+		weight:   weight,
+		cost:     b.cost(shardId),
 	}
 }
 
+func (b *balancer) cost(shardId string) int64 {
+	if b.costOf == nil {
+		return 0
+	}
+	return b.costOf(shardId)
+}
+
 func (b *balancer) forEach(visitor func(bc *balancerContainer)) {
 	for _, bc := range b.bcs {
 		visitor(bc)
 	}
 }
 
+// forEachSorted 按照container id顺序遍历，保证遍历结果稳定
+func (b *balancer) forEachSorted(visitor func(bc *balancerContainer)) {
+	var ids []string
+	for id := range b.bcs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		visitor(b.bcs[id])
+	}
+}
+
 func (b *balancer) addContainer(containerId string) {
 	cs := b.bcs[containerId]
 	if cs == nil {
@@ -44,6 +90,67 @@ func (b *balancer) addContainer(containerId string) {
 	}
 }
 
+// sortedShards 优先级低的shard在前，优先被移走，相同优先级迁移代价小的在前，再按照shard id顺序返回
+func (bc *balancerContainer) sortedShards() []*balancerShard {
+	var r []*balancerShard
+	for _, bs := range bc.shards {
+		r = append(r, bs)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].priority != r[j].priority {
+			return r[i].priority < r[j].priority
+		}
+		if r[i].cost != r[j].cost {
+			return r[i].cost < r[j].cost
+		}
+		return r[i].id < r[j].id
+	})
+	return r
+}
+
+// preferredContainer 按照preferred的顺序返回第一个可以接收shard的container，都不能接收时返回nil
+func (b *balancer) preferredContainer(shardId string, preferred []string, quota func(bc *balancerContainer) int) *balancerContainer {
+	for _, id := range preferred {
+		bc, ok := b.bcs[id]
+		if !ok || bc.load() >= quota(bc) || bc.hasReplica(shardId) || !b.allowed(bc, shardId) {
+			continue
+		}
+		return bc
+	}
+	return nil
+}
+
+// allowed shard是否满足在container上的placement约束
+func (b *balancer) allowed(bc *balancerContainer, shardId string) bool {
+	return b.filter.allowed(bc.id, shardId)
+}
+
+// hasReplica 判断container上是否已经有shard的其他副本
+func (bc *balancerContainer) hasReplica(id string) bool {
+	shardId, _ := apputil.ParseReplicaShardId(id)
+	for _, bs := range bc.shards {
+		if sid, _ := apputil.ParseReplicaShardId(bs.id); sid == shardId {
+			return true
+		}
+	}
+	return false
+}
+
+// replicaConflicts 同一个shard的多个副本在container上时，返回需要移走的副本，primary优先保留
+func (bc *balancerContainer) replicaConflicts() []*balancerShard {
+	var r []*balancerShard
+	seen := make(map[string]struct{})
+	for _, bs := range bc.sortedShards() {
+		shardId, _ := apputil.ParseReplicaShardId(bs.id)
+		if _, ok := seen[shardId]; ok && !bs.isManual {
+			r = append(r, bs)
+			continue
+		}
+		seen[shardId] = struct{}{}
+	}
+	return r
+}
+
 // balancerGroup 同一个container支持在shard维度支持分组，分开balance
 type balancerGroup struct {
 	// fixShardIdAndManualContainerId shard配置
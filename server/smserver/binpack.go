@@ -0,0 +1,314 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"sort"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"go.uber.org/zap"
+)
+
+const (
+	// assignorBinpack 按照container的capacity和shard的loadEstimate分配
+	assignorBinpack = "binpack"
+
+	// defaultContainerCapacity 没有声明capacity的container按照这个值参与binpack
+	defaultContainerCapacity = 100
+)
+
+// binpackContainer binpack计算过程中container的负载
+type binpackContainer struct {
+	id       string
+	capacity int
+	load     int
+
+	// shards shardId到是否manual
+	shards map[string]bool
+}
+
+// ratioLess a的负载比例是否低于b，用乘法避免浮点误差
+func (bc *binpackContainer) ratioLess(load int, other *binpackContainer, otherLoad int) bool {
+	return load*other.capacity < otherLoad*bc.capacity
+}
+
+func (bc *binpackContainer) fits(w int) bool {
+	return bc.load+w <= bc.capacity
+}
+
+// hasReplica container上是否已经有同一个shard的其他副本
+func (bc *binpackContainer) hasReplica(shardId string) bool {
+	origin, _ := apputil.ParseReplicaShardId(shardId)
+	for id := range bc.shards {
+		if o, _ := apputil.ParseReplicaShardId(id); o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (bc *binpackContainer) add(shardId string, w int, manual bool) {
+	bc.shards[shardId] = manual
+	bc.load += w
+}
+
+func (bc *binpackContainer) remove(shardId string, w int) {
+	delete(bc.shards, shardId)
+	bc.load -= w
+}
+
+// binpack 异构container场景下的分配，每个container承载的loadEstimate总和不超过capacity，并且负载比例尽量接近：
+// 1 manual的shard固定在指定container
+// 2 已经分配的shard保持不动，超过capacity的container按照优先级从低到高、负载从大到小移出shard
+// 3 未分配的shard按照优先级从高到低、负载从大到小，放到放入后负载比例最低的container，放不下的保持未分配
+// 4 负载比例最高的container向比例最低的container移动shard，直到不能再降低最高比例
+func (ss *smShard) binpack(fixShardIdAndManualContainerId ArmorMap, hbContainerIdAndAny ArmorMap, hbShardIdAndContainerId ArmorMap, shardIdAndShardSpec map[string]*apputil.ShardSpec, capacities map[string]int) moveActionList {
+	loadOf := func(shardId string) int {
+		if spec := shardIdAndShardSpec[shardId]; spec != nil && spec.LoadEstimate > 0 {
+			return spec.LoadEstimate
+		}
+		return 1
+	}
+	priorityOf := func(shardId string) int {
+		if spec := shardIdAndShardSpec[shardId]; spec != nil {
+			return spec.Priority
+		}
+		return 0
+	}
+	costOf := costOf(shardIdAndShardSpec)
+
+	filter := ss.constraintFilter(shardIdAndShardSpec)
+
+	var containers []*binpackContainer
+	bcs := make(map[string]*binpackContainer)
+	for _, containerId := range hbContainerIdAndAny.KeyList() {
+		capacity := capacities[containerId]
+		if capacity <= 0 {
+			capacity = defaultContainerCapacity
+		}
+		bc := &binpackContainer{id: containerId, capacity: capacity, shards: make(map[string]bool)}
+		containers = append(containers, bc)
+		bcs[containerId] = bc
+	}
+	// 保证相同输入下计算结果稳定
+	sort.Slice(containers, func(i, j int) bool { return containers[i].id < containers[j].id })
+
+	var (
+		mals    moveActionList
+		pending []string
+		// origin shard当前所在的存活container，用于最后生成move
+		origin = make(map[string]string)
+	)
+	for _, shardId := range fixShardIdAndManualContainerId.KeyList() {
+		manualContainerId := fixShardIdAndManualContainerId[shardId]
+		currentContainerId := hbShardIdAndContainerId[shardId]
+		if _, ok := bcs[currentContainerId]; ok {
+			origin[shardId] = currentContainerId
+		}
+
+		if manualContainerId != "" {
+			// manual的shard不受capacity约束，和默认分配方式保持一致
+			if bc, ok := bcs[manualContainerId]; ok {
+				bc.add(shardId, loadOf(shardId), true)
+			}
+			if currentContainerId != manualContainerId {
+				mals = append(
+					mals,
+					&moveAction{
+						Service:      ss.service,
+						ShardId:      shardId,
+						DropEndpoint: origin[shardId],
+						AddEndpoint:  manualContainerId,
+						Spec:         shardIdAndShardSpec[shardId],
+					},
+				)
+			}
+			continue
+		}
+
+		bc, ok := bcs[origin[shardId]]
+		if !ok || bc.hasReplica(shardId) || !filter.allowed(bc.id, shardId) {
+			pending = append(pending, shardId)
+			continue
+		}
+		bc.add(shardId, loadOf(shardId), false)
+	}
+
+	// 超过capacity的container移出低优先级、负载大的shard
+	for _, bc := range containers {
+		if bc.load <= bc.capacity {
+			continue
+		}
+		var candidates []string
+		for shardId, manual := range bc.shards {
+			if !manual {
+				candidates = append(candidates, shardId)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if priorityOf(a) != priorityOf(b) {
+				return priorityOf(a) < priorityOf(b)
+			}
+			if loadOf(a) != loadOf(b) {
+				return loadOf(a) > loadOf(b)
+			}
+			if costOf(a) != costOf(b) {
+				return costOf(a) < costOf(b)
+			}
+			return a < b
+		})
+		for _, shardId := range candidates {
+			if bc.load <= bc.capacity {
+				break
+			}
+			bc.remove(shardId, loadOf(shardId))
+			pending = append(pending, shardId)
+			ss.lg.Warn(
+				"container over capacity, shard removed",
+				zap.String("service", ss.service),
+				zap.String("containerId", bc.id),
+				zap.String("shardId", shardId),
+				zap.Int("capacity", bc.capacity),
+			)
+		}
+	}
+
+	// 未分配的shard，大的shard先放置，减少碎片
+	sort.Slice(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		if priorityOf(a) != priorityOf(b) {
+			return priorityOf(a) > priorityOf(b)
+		}
+		if loadOf(a) != loadOf(b) {
+			return loadOf(a) > loadOf(b)
+		}
+		return a < b
+	})
+	for _, shardId := range pending {
+		w := loadOf(shardId)
+		var target *binpackContainer
+		// 故障转移的shard按照声明的顺序尝试preferred container
+		if spec := shardIdAndShardSpec[shardId]; spec != nil && origin[shardId] == "" {
+			for _, id := range spec.PreferredContainers {
+				bc, ok := bcs[id]
+				if ok && bc.fits(w) && !bc.hasReplica(shardId) && filter.allowed(bc.id, shardId) {
+					target = bc
+					break
+				}
+			}
+		}
+		if target != nil {
+			target.add(shardId, w, false)
+			continue
+		}
+		for _, bc := range containers {
+			if !bc.fits(w) || bc.hasReplica(shardId) || !filter.allowed(bc.id, shardId) {
+				continue
+			}
+			if target == nil || bc.ratioLess(bc.load+w, target, target.load+w) {
+				target = bc
+			}
+		}
+		if target != nil {
+			target.add(shardId, w, false)
+		}
+	}
+
+	// 每次移动都让最高负载比例的container下降，且接收方移动后的比例低于移动前的最高比例，保证收敛，次数上限防止异常输入
+	for i := 0; i < len(fixShardIdAndManualContainerId); i++ {
+		if !ss.binpackMoveOnce(containers, loadOf, filter) {
+			break
+		}
+	}
+
+	// 对比最终分配和当前分配生成move
+	final := make(map[string]string)
+	for _, bc := range containers {
+		for shardId, manual := range bc.shards {
+			if !manual {
+				final[shardId] = bc.id
+			}
+		}
+	}
+	for _, shardId := range fixShardIdAndManualContainerId.KeyList() {
+		if fixShardIdAndManualContainerId[shardId] != "" {
+			continue
+		}
+		from, to := origin[shardId], final[shardId]
+		if from == to {
+			continue
+		}
+		ma := &moveAction{Service: ss.service, ShardId: shardId, DropEndpoint: from}
+		if to != "" {
+			ma.AddEndpoint = to
+			ma.Spec = shardIdAndShardSpec[shardId]
+		}
+		mals = append(mals, ma)
+	}
+	sort.Sort(mals)
+	return mals
+}
+
+// binpackMoveOnce 从负载比例最高的container移出一个shard，没有可以移动的shard返回false
+func (ss *smShard) binpackMoveOnce(containers []*binpackContainer, loadOf func(shardId string) int, filter *constraintFilter) bool {
+	var donor *binpackContainer
+	for _, bc := range containers {
+		if donor == nil || donor.ratioLess(donor.load, bc, bc.load) {
+			donor = bc
+		}
+	}
+	if donor == nil {
+		return false
+	}
+
+	var candidates []string
+	for shardId, manual := range donor.shards {
+		if !manual {
+			candidates = append(candidates, shardId)
+		}
+	}
+	// 优先移动大的shard，更快接近均衡
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if loadOf(a) != loadOf(b) {
+			return loadOf(a) > loadOf(b)
+		}
+		return a < b
+	})
+	for _, shardId := range candidates {
+		w := loadOf(shardId)
+		var target *binpackContainer
+		for _, bc := range containers {
+			if bc == donor || !bc.fits(w) || bc.hasReplica(shardId) || !filter.allowed(bc.id, shardId) {
+				continue
+			}
+			// 接收方移动后的比例需要低于donor移动前的比例
+			if !bc.ratioLess(bc.load+w, donor, donor.load) {
+				continue
+			}
+			if target == nil || bc.ratioLess(bc.load+w, target, target.load+w) {
+				target = bc
+			}
+		}
+		if target == nil {
+			continue
+		}
+		donor.remove(shardId, w)
+		target.add(shardId, w, false)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var errCircuitOpen = errors.New("container circuit open")
+
+// containerBreaker operator对每个container的add/drop熔断，连续失败达到threshold后打开，cooldown期间请求直接失败，
+// leader分配时避开该container，cooldown结束后放行一个请求探测，成功后关闭，失败后重新打开
+type containerBreaker struct {
+	lg *zap.Logger
+
+	// threshold 连续失败的次数，<=0时不熔断
+	threshold int
+	cooldown  time.Duration
+
+	mu         sync.Mutex
+	containers map[string]*breakerState
+}
+
+type breakerState struct {
+	// failures 连续失败的次数，成功后删除
+	failures int
+
+	// openUntil 打开的截止时间，为零值时没有打开
+	openUntil time.Time
+
+	// probing cooldown之后放行的探测请求还没有返回
+	probing bool
+}
+
+// suspectContainer cluster-state中展示的熔断中的container
+type suspectContainer struct {
+	ContainerId string `json:"containerId"`
+	Failures    int    `json:"failures"`
+
+	// OpenUntil unix秒，之后放行探测请求
+	OpenUntil int64 `json:"openUntil"`
+}
+
+func newContainerBreaker(lg *zap.Logger, threshold int, cooldown time.Duration) *containerBreaker {
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &containerBreaker{lg: lg, threshold: threshold, cooldown: cooldown, containers: make(map[string]*breakerState)}
+}
+
+// allow 打开期间和探测请求没有返回时拒绝
+func (b *containerBreaker) allow(containerId string, now time.Time) error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.containers[containerId]
+	if !ok || s.openUntil.IsZero() {
+		return nil
+	}
+	if now.Before(s.openUntil) || s.probing {
+		return errors.Wrapf(errCircuitOpen, "container %s", containerId)
+	}
+	s.probing = true
+	return nil
+}
+
+// done 记录请求结果，返回true表示这次失败打开了熔断
+func (b *containerBreaker) done(containerId string, succ bool, now time.Time) bool {
+	if b == nil || b.threshold <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if succ {
+		if s, ok := b.containers[containerId]; ok && !s.openUntil.IsZero() {
+			b.lg.Info("container circuit closed", zap.String("containerId", containerId))
+		}
+		delete(b.containers, containerId)
+		return false
+	}
+
+	s, ok := b.containers[containerId]
+	if !ok {
+		s = &breakerState{}
+		b.containers[containerId] = s
+	}
+	s.failures++
+	// 探测失败直接重新打开
+	if !s.probing && s.failures < b.threshold {
+		return false
+	}
+	s.probing = false
+	s.openUntil = now.Add(b.cooldown)
+	b.lg.Warn(
+		"container circuit open",
+		zap.String("containerId", containerId),
+		zap.Int("failures", s.failures),
+		zap.Time("openUntil", s.openUntil),
+	)
+	return true
+}
+
+// suspect 返回cooldown还没有结束的container，cooldown结束后重新参与分配，分配过去的move作为探测请求
+func (b *containerBreaker) suspect(now time.Time) []*suspectContainer {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var r []*suspectContainer
+	for id, s := range b.containers {
+		if s.openUntil.IsZero() || !now.Before(s.openUntil) {
+			continue
+		}
+		r = append(r, &suspectContainer{ContainerId: id, Failures: s.failures, OpenUntil: s.openUntil.Unix()})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ContainerId < r[j].ContainerId })
+	return r
+}
+
+// retain 删除已经不存活的container的记录
+func (b *containerBreaker) retain(alive map[string]struct{}) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id := range b.containers {
+		if _, ok := alive[id]; !ok {
+			delete(b.containers, id)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package smserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_containerBreaker(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	b := newContainerBreaker(ttLogger, 2, 10*time.Second)
+
+	assert.Nil(t, b.allow("c1", now))
+	assert.False(t, b.done("c1", false, now))
+	assert.Nil(t, b.allow("c1", now))
+	assert.True(t, b.done("c1", false, now))
+	assert.Equal(t, errCircuitOpen, errors.Cause(b.allow("c1", now.Add(time.Second))))
+	assert.Nil(t, b.allow("c2", now))
+	assert.Equal(t, []*suspectContainer{{ContainerId: "c1", Failures: 2, OpenUntil: now.Unix() + 10}}, b.suspect(now))
+
+	// cooldown之后只放行一个探测请求，探测失败重新打开
+	later := now.Add(10 * time.Second)
+	assert.Nil(t, b.suspect(later))
+	assert.Nil(t, b.allow("c1", later))
+	assert.NotNil(t, b.allow("c1", later))
+	assert.True(t, b.done("c1", false, later))
+	assert.NotNil(t, b.allow("c1", later.Add(time.Second)))
+
+	// 探测成功后关闭
+	later = later.Add(10 * time.Second)
+	assert.Nil(t, b.allow("c1", later))
+	assert.False(t, b.done("c1", true, later))
+	assert.Nil(t, b.allow("c1", later))
+	assert.Nil(t, b.suspect(now))
+
+	// 不存活的container的记录被删除
+	b.done("c3", false, now)
+	b.done("c3", false, now)
+	b.retain(map[string]struct{}{"c1": {}})
+	assert.Nil(t, b.allow("c3", now))
+
+	// threshold为负数时关闭熔断
+	b = newContainerBreaker(ttLogger, -1, 0)
+	for i := 0; i < 10; i++ {
+		b.done("c1", false, now)
+	}
+	assert.Nil(t, b.allow("c1", now))
+	assert.Nil(t, b.suspect(now))
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// errCanaryAborted canary失败后剩余的move不再执行
+var errCanaryAborted = errors.New("canary aborted")
+
+// canarySpec rebalance的canary配置，先移动Percent比例的shard，Window内健康再移动剩余的shard
+type canarySpec struct {
+	// Percent 参与canary的shard比例，[1, 100]，至少1个shard
+	Percent int `json:"percent"`
+
+	// Window 观察窗口，单位s，<=0时使用默认值
+	Window int `json:"window"`
+
+	// MaxLoad canary目标container的cpu和内存使用比例上限，[0, 1]，为0不检查
+	MaxLoad float64 `json:"maxLoad"`
+}
+
+func (c *canarySpec) Validate() error {
+	if c.Percent < 1 || c.Percent > 100 {
+		return errors.Errorf("canary percent %d should be in [1, 100]", c.Percent)
+	}
+	if c.Window < 0 {
+		return errors.New("canary window should not be negative")
+	}
+	if c.MaxLoad < 0 || c.MaxLoad > 1 {
+		return errors.Errorf("canary maxLoad %v should be in [0, 1]", c.MaxLoad)
+	}
+	return nil
+}
+
+func (c *canarySpec) window() time.Duration {
+	if c.Window <= 0 {
+		return defaultCanaryWindow
+	}
+	return time.Duration(c.Window) * time.Second
+}
+
+// canary appSpec为空的场景 4 unit test
+func (ss *smShard) canary() *canarySpec {
+	spec := ss.spec()
+	if spec == nil || spec.Canary == nil || spec.Canary.Percent <= 0 {
+		return nil
+	}
+	return spec.Canary
+}
+
+// splitCanary 从有add的move中选出canary，单纯的drop不影响container的负载，放在剩余的move中
+// 没有剩余的move时canary没有意义，返回的canary为空
+func splitCanary(mal moveActionList, percent int) (moveActionList, moveActionList) {
+	var adds, drops moveActionList
+	for _, ma := range mal {
+		if ma.AddEndpoint != "" {
+			adds = append(adds, ma)
+		} else {
+			drops = append(drops, ma)
+		}
+	}
+	n := (len(adds)*percent + 99) / 100
+	if n == 0 || n == len(mal) {
+		return nil, mal
+	}
+	return adds[:n], append(adds[n:], drops...)
+}
+
+// revertMoves 把canary的move反向执行，shard回到原来的container，原来没有分配的shard直接drop
+func revertMoves(mal moveActionList) moveActionList {
+	var r moveActionList
+	for _, ma := range mal {
+		r = append(
+			r,
+			&moveAction{
+				Service:      ma.Service,
+				ShardId:      ma.ShardId,
+				DropEndpoint: ma.AddEndpoint,
+				AddEndpoint:  ma.DropEndpoint,
+				Spec:         ma.Spec,
+				TraceContext: ma.TraceContext,
+				Reason:       ma.Reason,
+			},
+		)
+	}
+	return r
+}
+
+// canaryMove 先执行canary，观察窗口结束后检查canary的shard，健康时执行剩余的move，否则回滚canary并放弃剩余的move
+func (ss *smShard) canaryMove(mal moveActionList) error {
+	c := ss.canary()
+	if c == nil {
+		return ss.operator.move(mal)
+	}
+	canary, rest := splitCanary(mal, c.Percent)
+	if len(canary) == 0 {
+		return ss.operator.move(mal)
+	}
+
+	ss.lg.Info(
+		"canary start",
+		zap.String("service", ss.service),
+		zap.Reflect("canary", canary),
+		zap.Int("rest", len(rest)),
+	)
+	if err := ss.operator.move(canary); err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	select {
+	case <-time.After(c.window()):
+	case <-ss.closing:
+		// leader切换，剩余的move由新的leader重新计算
+		ss.abortMoves(rest, "smShard closing")
+		return nil
+	}
+
+	failed := ss.canaryFailed(canary, c.MaxLoad)
+	if len(failed) == 0 {
+		ss.lg.Info(
+			"canary passed",
+			zap.String("service", ss.service),
+			zap.Int("rest", len(rest)),
+		)
+		return ss.operator.move(rest)
+	}
+
+	ss.lg.Error(
+		"canary failed, revert",
+		zap.String("service", ss.service),
+		zap.Reflect("failed", failed),
+	)
+	ss.abortMoves(rest, fmt.Sprintf("canary failed %v", failed))
+	return ss.operator.move(revertMoves(canary))
+}
+
+// abortMoves 没有执行的move记录为失败，本轮rebalance可以结束，下一次balanceChecker重新计算
+func (ss *smShard) abortMoves(mal moveActionList, reason string) {
+	for _, ma := range mal {
+		ss.rounds.done(ma.RoundId, ma.ShardId, errCanaryAborted)
+	}
+	if ss.container != nil && ss.container.events != nil {
+		ss.container.events.append(eventMove, ss.service, "", fmt.Sprintf("canary aborted %d moves: %s", len(mal), reason))
+	}
+}
+
+// canaryFailed 返回不健康的canary shard和原因：shard heartbeat不在目标container、目标container不存活或者探测失败、负载超过上限
+func (ss *smShard) canaryFailed(canary moveActionList, maxLoad float64) map[string]string {
+	shards := ss.mpr.AliveShards()
+	containers := ss.mpr.AliveContainers()
+	attrs := ss.mpr.ContainerAttributes()
+	unhealthy := ss.unhealthyContainers()
+
+	r := make(map[string]string)
+	for _, ma := range canary {
+		if _, ok := containers[ma.AddEndpoint]; !ok {
+			r[ma.ShardId] = "container not alive"
+			continue
+		}
+		if _, ok := unhealthy[ma.AddEndpoint]; ok {
+			r[ma.ShardId] = "container unhealthy"
+			continue
+		}
+		if tmp, ok := shards[ma.ShardId]; !ok || tmp.curContainerId != ma.AddEndpoint {
+			r[ma.ShardId] = "shard heartbeat missing"
+			continue
+		}
+		if a, ok := attrs[ma.AddEndpoint]; ok && maxLoad > 0 && (a.cpu > maxLoad || a.mem > maxLoad) {
+			r[ma.ShardId] = fmt.Sprintf("container load cpu %.2f mem %.2f", a.cpu, a.mem)
+		}
+	}
+	return r
+}
@@ -0,0 +1,88 @@
+package smserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+)
+
+func Test_splitCanary(t *testing.T) {
+	mal := moveActionList{
+		&moveAction{ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s2", DropEndpoint: "c1", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s3", AddEndpoint: "c3"},
+		&moveAction{ShardId: "s4", DropEndpoint: "c1"},
+	}
+	var tests = []struct {
+		percent int
+		canary  []string
+		rest    []string
+	}{
+		{percent: 10, canary: []string{"s1"}, rest: []string{"s2", "s3", "s4"}},
+		{percent: 50, canary: []string{"s1", "s2"}, rest: []string{"s3", "s4"}},
+		// 只剩下drop也需要等待canary
+		{percent: 100, canary: []string{"s1", "s2", "s3"}, rest: []string{"s4"}},
+	}
+	ids := func(mal moveActionList) []string {
+		var r []string
+		for _, ma := range mal {
+			r = append(r, ma.ShardId)
+		}
+		return r
+	}
+	for idx, tt := range tests {
+		canary, rest := splitCanary(mal, tt.percent)
+		if !reflect.DeepEqual(ids(canary), tt.canary) || !reflect.DeepEqual(ids(rest), tt.rest) {
+			t.Errorf("idx: %d canary %v rest %v", idx, ids(canary), ids(rest))
+		}
+	}
+
+	// 全部都是canary时直接执行
+	canary, rest := splitCanary(mal[:2], 100)
+	if canary != nil || len(rest) != 2 {
+		t.Errorf("unexpected canary %v rest %v", ids(canary), ids(rest))
+	}
+}
+
+func Test_smShard_canaryFailed(t *testing.T) {
+	service := "foo.bar"
+	mpr := &mapper{lg: ttLogger, appSpec: &smAppSpec{Service: service}}
+	mpr.containerState = newMapperState(mpr, containerTrigger)
+	mpr.shardState = newMapperState(mpr, shardTrigger)
+	for id, cpu := range map[string]float64{"c1": 10, "c2": 95} {
+		b, _ := json.Marshal(apputil.ContainerHeartbeat{CPUUsedPercent: cpu})
+		if err := mpr.containerState.Create(id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, containerId := range map[string]string{"s1": "c1", "s2": "c2", "s3": "c1"} {
+		b, _ := json.Marshal(apputil.ShardHeartbeat{ContainerId: containerId})
+		if err := mpr.shardState.Create(id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ss := smShard{service: service, lg: ttLogger, mpr: mpr, appSpec: &smAppSpec{}}
+
+	canary := moveActionList{
+		&moveAction{ShardId: "s1", AddEndpoint: "c1"},
+		&moveAction{ShardId: "s2", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s3", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s4", AddEndpoint: "c3"},
+	}
+	failed := ss.canaryFailed(canary, 0)
+	if len(failed) != 2 || failed["s3"] == "" || failed["s4"] == "" {
+		t.Errorf("unexpected failed %v", failed)
+	}
+	// c2的cpu超过上限
+	failed = ss.canaryFailed(canary, 0.9)
+	if len(failed) != 3 || failed["s2"] == "" {
+		t.Errorf("unexpected failed %v", failed)
+	}
+
+	r := revertMoves(canary[:1])
+	if r[0].DropEndpoint != "c1" || r[0].AddEndpoint != "" {
+		t.Errorf("unexpected revert %v", r[0])
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"net/http"
+
+	"github.com/entertainment-venue/sm/pkg/chaos"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// @Description faults injected into this sm process, only available when built with -tags chaos
+// @Tags  debug
+// @Produce  json
+// @success 200 {object} chaos.Status
+// @Router /sm/server/chaos [get]
+func (ss *smShardApi) GinChaos(c *gin.Context) {
+	c.JSON(http.StatusOK, chaos.Get())
+}
+
+// @Description replace the faults injected into this sm process, {} clears all faults
+// @Tags  debug
+// @Accept  json
+// @Produce  json
+// @Param param body chaos.Faults true "param"
+// @success 200 {object} chaos.Status
+// @Router /sm/server/set-chaos [post]
+func (ss *smShardApi) GinSetChaos(c *gin.Context) {
+	var faults chaos.Faults
+	if err := c.ShouldBind(&faults); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if err := chaos.Set(faults); err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	ss.lg.Warn("chaos faults changed", zap.Reflect("faults", faults))
+	c.JSON(http.StatusOK, chaos.Get())
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// cloneServiceRequest 覆盖复制出的spec和shard中的字段，只覆盖出现的字段，例如
+// {"spec": {"sessionTTL": 10}, "shard": {"task": "staging"}}
+type cloneServiceRequest struct {
+	// Spec 覆盖spec中的字段，service字段不能覆盖
+	Spec json.RawMessage `json:"spec,omitempty"`
+
+	// Shard 覆盖所有shard中的字段
+	Shard json.RawMessage `json:"shard,omitempty"`
+
+	// Shards 按照shard id覆盖单个shard中的字段，在Shard之后执行
+	Shards map[string]json.RawMessage `json:"shards,omitempty"`
+}
+
+// @Description clone spec and shard definitions of service from to a new service to, fields can be overridden by the body
+// @Tags  spec
+// @Accept  json
+// @Produce  json
+// @Param from query string true "param"
+// @Param to query string true "param"
+// @Param param body cloneServiceRequest false "param"
+// @success 200
+// @Router /sm/server/clone-service [post]
+func (ss *smShardApi) GinCloneService(c *gin.Context) {
+	from, to := c.Query("from"), c.Query("to")
+	if from == "" || to == "" || from == to {
+		apiErrorResponse(c, errCodeParam, errors.Errorf("invalid from %q or to %q", from, to))
+		return
+	}
+	if !authorized(c, from) {
+		apiErrorResponse(c, errCodeForbidden, errors.Errorf("forbidden service %s", from))
+		return
+	}
+	var req cloneServiceRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBind(&req); err != nil {
+			ss.lg.Error("ShouldBind err", zap.Error(err))
+			apiErrorResponse(c, errCodeParam, err)
+			return
+		}
+	}
+
+	ctx := context.TODO()
+	existing, err := ss.getAppSpec(ctx, to)
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if existing != nil {
+		apiErrorResponse(c, errCodeServiceExists, errors.Errorf("service[%s] already exist", to))
+		return
+	}
+
+	dump, err := ss.dumpService(ctx, from)
+	if err != nil {
+		ss.lg.Error("dumpService error",
+			zap.String("service", from),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if dump == nil {
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not exist", from))
+		return
+	}
+	if err := cloneService(dump, to, &req); err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	// 复制出的service和import走相同的校验和写入
+	doc := specDocument{Version: specDocumentVersion, Services: []*serviceDump{dump}}
+	if code, err := ss.validateDocument(c, &doc); err != nil {
+		ss.lg.Error("validateDocument err", zap.Error(err))
+		apiErrorResponse(c, code, err)
+		return
+	}
+	result, err := ss.importService(dump, requestTenant(c))
+	if err != nil {
+		ss.lg.Error("importService err",
+			zap.String("service", to),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, quotaErrCode(err), err)
+		return
+	}
+	ss.container.events.append(eventSpecChange, to, c.ClientIP(), "clone from "+from+" "+result.String())
+	ss.lg.Info("clone service success",
+		zap.String("from", from),
+		zap.String("to", to),
+		zap.Reflect("result", result),
+	)
+	c.JSON(http.StatusOK, gin.H{"service": result})
+}
+
+// cloneService 把dump改写为service to，依次应用spec、所有shard和单个shard的覆盖
+func cloneService(dump *serviceDump, to string, req *cloneServiceRequest) error {
+	if len(req.Spec) > 0 {
+		if err := json.Unmarshal(req.Spec, dump.Spec); err != nil {
+			return errors.Wrap(err, "spec")
+		}
+	}
+	dump.Spec.Service = to
+
+	for id := range req.Shards {
+		if _, ok := dump.Shards[id]; !ok {
+			return errors.Errorf("shard %s not exist", id)
+		}
+	}
+	for id, shardSpec := range dump.Shards {
+		if len(req.Shard) > 0 {
+			if err := json.Unmarshal(req.Shard, shardSpec); err != nil {
+				return errors.Wrap(err, "shard")
+			}
+		}
+		if override, ok := req.Shards[id]; ok {
+			if err := json.Unmarshal(override, shardSpec); err != nil {
+				return errors.Wrap(err, id)
+			}
+		}
+		shardSpec.Service = to
+	}
+	return nil
+}
@@ -21,4 +21,59 @@ import (
 const (
 	defaultSleepTimeout = 3 * time.Second
 	defaultLoopInterval = 3 * time.Second
+
+	// defaultMoveRecordSize dashboard展示最近move的数量
+	defaultMoveRecordSize = 100
+
+	// defaultHandoverTimeout move时等待旧container确认drop的超时时间
+	defaultHandoverTimeout = 10 * time.Second
+	// defaultHandoverCheckInterval 检查drop确认的间隔
+	defaultHandoverCheckInterval = 200 * time.Millisecond
+
+	// defaultMoveRetry move失败后的重试次数，仍然失败的move进入dead letter
+	defaultMoveRetry = 3
+	// defaultMoveBackoff 第一次重试前的等待时间，之后每次翻倍
+	defaultMoveBackoff = time.Second
+	// maxMoveBackoff 重试等待时间的上限
+	maxMoveBackoff = 30 * time.Second
+
+	// defaultBreakerThreshold 同一个container连续add/drop失败的次数，达到后打开熔断
+	defaultBreakerThreshold = 5
+	// defaultBreakerCooldown 熔断打开的时间，之后放行一个探测请求
+	defaultBreakerCooldown = 30 * time.Second
+
+	// defaultMoveConcurrency 同一个container同时处理的add/drop请求数量
+	defaultMoveConcurrency = 1
+
+	// defaultWorkerBackoff service的后台goroutine panic后第一次重启前的等待时间，之后每次翻倍
+	defaultWorkerBackoff = time.Second
+	// maxWorkerBackoff 重启等待时间的上限
+	maxWorkerBackoff = 30 * time.Second
+
+	// defaultReconcileInterval leader对比期望分配和实际分配的间隔
+	defaultReconcileInterval = 30 * time.Second
+
+	// defaultShardHistorySize 每个shard保留的分配记录数量
+	defaultShardHistorySize = 20
+
+	// defaultCanaryWindow canary move完成后观察shard和container健康状态的时间
+	defaultCanaryWindow = 30 * time.Second
+
+	// defaultResignBackoff 放弃leader后等待其他container当选，之后再重新参与竞选
+	defaultResignBackoff = 10 * time.Second
+
+	// defaultLeaderLeaseTTL leader竞选session的ttl，单位秒
+	defaultLeaderLeaseTTL = 5
+
+	// defaultSessionRecoveryBackoff sm的heartbeat session过期后第一次重建前的等待时间，之后每次翻倍
+	defaultSessionRecoveryBackoff = time.Second
+
+	// defaultDrainCheckInterval drain时检查shard是否已经移走的间隔
+	defaultDrainCheckInterval = time.Second
+
+	// defaultJanitorInterval leader扫描etcd孤儿节点的间隔
+	defaultJanitorInterval = time.Minute
+
+	// maxShardGroupCount shard group单次生成shard的上限
+	maxShardGroupCount = 10000
 )
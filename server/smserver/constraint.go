@@ -0,0 +1,508 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// containerAttributes placement约束中可以引用的container属性，来自container的心跳
+type containerAttributes struct {
+	id       string
+	zone     string
+	capacity int
+	labels   map[string]string
+
+	// cpu 和 mem 使用比例，取值[0, 1]
+	cpu float64
+	mem float64
+}
+
+// constraintFields 约束中支持的container属性，labels通过 container.labels.<key> 引用
+var constraintFields = map[string]func(attrs *containerAttributes) interface{}{
+	"container.id":       func(attrs *containerAttributes) interface{} { return attrs.id },
+	"container.zone":     func(attrs *containerAttributes) interface{} { return attrs.zone },
+	"container.capacity": func(attrs *containerAttributes) interface{} { return float64(attrs.capacity) },
+	"container.load.cpu": func(attrs *containerAttributes) interface{} { return attrs.cpu },
+	"container.load.mem": func(attrs *containerAttributes) interface{} { return attrs.mem },
+}
+
+const constraintLabelPrefix = "container.labels."
+
+// constraintExpr ShardSpec中Constraint编译后的表达式，支持:
+// 1 字符串、数字、true/false字面量，container属性
+// 2 == != < <= > >= 比较，&& || ! 逻辑运算和括号
+type constraintExpr interface {
+	eval(attrs *containerAttributes) (interface{}, error)
+}
+
+type constraintLiteral struct {
+	v interface{}
+}
+
+func (e *constraintLiteral) eval(_ *containerAttributes) (interface{}, error) {
+	return e.v, nil
+}
+
+type constraintField struct {
+	name string
+}
+
+func (e *constraintField) eval(attrs *containerAttributes) (interface{}, error) {
+	if strings.HasPrefix(e.name, constraintLabelPrefix) {
+		// 没有设置的label视为空字符串
+		return attrs.labels[strings.TrimPrefix(e.name, constraintLabelPrefix)], nil
+	}
+	return constraintFields[e.name](attrs), nil
+}
+
+type constraintNot struct {
+	x constraintExpr
+}
+
+func (e *constraintNot) eval(attrs *containerAttributes) (interface{}, error) {
+	v, err := evalBool(e.x, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return !v, nil
+}
+
+type constraintBinary struct {
+	op          string
+	left, right constraintExpr
+}
+
+func (e *constraintBinary) eval(attrs *containerAttributes) (interface{}, error) {
+	switch e.op {
+	case "&&", "||":
+		l, err := evalBool(e.left, attrs)
+		if err != nil {
+			return nil, err
+		}
+		// 短路求值
+		if (e.op == "&&" && !l) || (e.op == "||" && l) {
+			return l, nil
+		}
+		return evalBool(e.right, attrs)
+	}
+
+	l, err := e.left.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.right.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return compareConstraintValues(e.op, l, r)
+}
+
+func evalBool(e constraintExpr, attrs *containerAttributes) (bool, error) {
+	v, err := e.eval(attrs)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, errors.Errorf("%v is not bool", v)
+	}
+	return b, nil
+}
+
+// compareConstraintValues 字符串和数字比较时，字符串（一般是label）按照数字解析
+func compareConstraintValues(op string, l, r interface{}) (bool, error) {
+	if ls, ok := l.(string); ok {
+		if _, ok := r.(float64); ok {
+			f, err := strconv.ParseFloat(ls, 64)
+			if err != nil {
+				return false, errors.Errorf("%q is not number", ls)
+			}
+			l = f
+		}
+	}
+	if rs, ok := r.(string); ok {
+		if _, ok := l.(float64); ok {
+			f, err := strconv.ParseFloat(rs, 64)
+			if err != nil {
+				return false, errors.Errorf("%q is not number", rs)
+			}
+			r = f
+		}
+	}
+
+	switch op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	}
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return false, errors.Errorf("%s only supports numbers, got %v and %v", op, l, r)
+	}
+	switch op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	default:
+		return lf >= rf, nil
+	}
+}
+
+// parseConstraint 编译约束表达式，语法错误和未知的属性在添加shard时返回
+func parseConstraint(s string) (constraintExpr, error) {
+	tokens, err := tokenizeConstraint(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	p := &constraintParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+// validateConstraint 空字符串代表没有约束
+func validateConstraint(s string) error {
+	if s == "" {
+		return nil
+	}
+	_, err := parseConstraint(s)
+	return errors.Wrapf(err, "constraint %q", s)
+}
+
+type constraintTokenKind int
+
+const (
+	tokenIdent constraintTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type constraintToken struct {
+	kind constraintTokenKind
+	text string
+}
+
+func tokenizeConstraint(s string) ([]*constraintToken, error) {
+	var tokens []*constraintToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			// 字符串不支持转义
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, &constraintToken{kind: tokenString, text: s[i+1 : i+1+end]})
+			i += end + 2
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, &constraintToken{kind: tokenNumber, text: s[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || strings.IndexByte("_.-/", s[j]) >= 0) {
+				j++
+			}
+			tokens = append(tokens, &constraintToken{kind: tokenIdent, text: s[i:j]})
+			i = j
+		default:
+			var op string
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, errors.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, &constraintToken{kind: tokenOp, text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// constraintParser 递归下降，优先级从低到高: || && ! 比较
+type constraintParser struct {
+	tokens []*constraintToken
+	pos    int
+}
+
+func (p *constraintParser) peekOp(ops ...string) string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOp {
+		return ""
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *constraintParser) parseOr() (constraintExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("||") != "" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &constraintBinary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *constraintParser) parseAnd() (constraintExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("&&") != "" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &constraintBinary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *constraintParser) parseUnary() (constraintExpr, error) {
+	if p.peekOp("!") != "" {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &constraintNot{x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *constraintParser) parseComparison() (constraintExpr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.peekOp("==", "!=", "<=", ">=", "<", ">"); op != "" {
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &constraintBinary{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *constraintParser) parsePrimary() (constraintExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokenString:
+		return &constraintLiteral{v: t.text}, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid number %q", t.text)
+		}
+		return &constraintLiteral{v: f}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &constraintLiteral{v: true}, nil
+		case "false":
+			return &constraintLiteral{v: false}, nil
+		}
+		if _, ok := constraintFields[t.text]; !ok && (!strings.HasPrefix(t.text, constraintLabelPrefix) || t.text == constraintLabelPrefix) {
+			return nil, errors.Errorf("unknown field %q", t.text)
+		}
+		return &constraintField{name: t.text}, nil
+	}
+	if t.text == "(" {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peekOp(")") == "" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return e, nil
+	}
+	return nil, errors.Errorf("unexpected %q", t.text)
+}
+
+// constraintFilter 判断shard能否分配到container，没有约束的shard可以分配到任意container，
+// 表达式无法编译或者求值出错的shard不能分配到任何container，在日志中体现
+type constraintFilter struct {
+	lg    *zap.Logger
+	specs map[string]*apputil.ShardSpec
+	attrs map[string]*containerAttributes
+	exprs map[string]constraintExpr
+
+	// cordoned 不接收新shard的container
+	cordoned map[string]struct{}
+
+	// suspect 熔断中的container，不接收新的shard
+	suspect map[string]struct{}
+
+	// refused shard id到拒绝过这个shard的container
+	refused map[string]map[string]struct{}
+
+	// reservations container剩余资源不足的shard不能分配，为空不限制
+	reservations *reservationLedger
+}
+
+func newConstraintFilter(lg *zap.Logger, specs map[string]*apputil.ShardSpec, attrs map[string]*containerAttributes) *constraintFilter {
+	return &constraintFilter{lg: lg, specs: specs, attrs: attrs, exprs: make(map[string]constraintExpr)}
+}
+
+// constraintFilter mapper为空的场景 4 unit test
+func (ss *smShard) constraintFilter(specs map[string]*apputil.ShardSpec) *constraintFilter {
+	var attrs map[string]*containerAttributes
+	if ss.mpr != nil {
+		attrs = ss.mpr.ContainerAttributes()
+	}
+	f := newConstraintFilter(ss.lg, specs, attrs)
+	f.cordoned = ss.cordonedContainers()
+	f.suspect = ss.operator.suspectContainers()
+	f.refused = ss.refusals(context.TODO())
+	f.reservations = ss.currentReservations()
+	return f
+}
+
+// cordonedContainer container被cordon时不能接收新的shard，已有的shard在balancePlan中固定
+func (f *constraintFilter) cordonedContainer(containerId string) bool {
+	if f == nil {
+		return false
+	}
+	_, ok := f.cordoned[containerId]
+	return ok
+}
+
+func (f *constraintFilter) allowed(containerId string, shardId string) bool {
+	return f.reject(containerId, shardId) == ""
+}
+
+// reject 返回shard不能分配到container的原因，为空表示可以分配，explain接口使用
+func (f *constraintFilter) reject(containerId string, shardId string) string {
+	if f == nil {
+		return ""
+	}
+	if _, ok := f.suspect[containerId]; ok {
+		return "circuit open"
+	}
+	if f.cordonedContainer(containerId) {
+		return "container cordoned"
+	}
+	if _, ok := f.refused[shardId][containerId]; ok {
+		return "refused by container"
+	}
+	if !f.reservations.fits(containerId, shardId) {
+		return "insufficient reserved resources"
+	}
+	spec := f.specs[shardId]
+	if spec == nil || spec.Constraint == "" {
+		return ""
+	}
+
+	e, ok := f.exprs[spec.Constraint]
+	if !ok {
+		var err error
+		e, err = parseConstraint(spec.Constraint)
+		if err != nil {
+			f.lg.Error(
+				"parse constraint error",
+				zap.String("shardId", shardId),
+				zap.String("constraint", spec.Constraint),
+				zap.Error(err),
+			)
+		}
+		// 编译失败也缓存，每轮只打印一次
+		f.exprs[spec.Constraint] = e
+	}
+	if e == nil {
+		return "invalid constraint"
+	}
+
+	attrs := f.attrs[containerId]
+	if attrs == nil {
+		attrs = &containerAttributes{id: containerId}
+	}
+	v, err := evalBool(e, attrs)
+	if err != nil {
+		f.lg.Warn(
+			"eval constraint error",
+			zap.String("shardId", shardId),
+			zap.String("containerId", containerId),
+			zap.String("constraint", spec.Constraint),
+			zap.Error(err),
+		)
+		return "constraint eval error: " + err.Error()
+	}
+	if !v {
+		return "constraint not satisfied"
+	}
+	return ""
+}
+
+// violated 返回已经分配的shard中不满足约束的shard，manual的shard不受约束
+func (f *constraintFilter) violated(hbShardIdAndContainerId ArmorMap, fixShardIdAndManualContainerId ArmorMap) []string {
+	var r []string
+	for shardId, containerId := range hbShardIdAndContainerId {
+		if fixShardIdAndManualContainerId[shardId] != "" {
+			continue
+		}
+		if !f.allowed(containerId, shardId) {
+			r = append(r, shardId)
+		}
+	}
+	return r
+}
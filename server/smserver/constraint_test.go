@@ -0,0 +1,87 @@
+package smserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+func Test_parseConstraint(t *testing.T) {
+	attrs := &containerAttributes{
+		id:       "c1",
+		zone:     "z1",
+		capacity: 100,
+		labels:   map[string]string{"zone": "us-east-1", "gpu": "2"},
+		cpu:      0.5,
+		mem:      0.8,
+	}
+	var tests = []struct {
+		expr   string
+		expect bool
+		err    bool
+	}{
+		{expr: `container.labels.zone == "us-east-1" && container.load.cpu < 0.7`, expect: true},
+		{expr: `container.labels.zone == "us-west-1" || container.load.mem >= 0.8`, expect: true},
+		{expr: `!(container.zone == "z1") || container.capacity > 100`, expect: false},
+		{expr: `container.labels.gpu >= 2 && container.labels.missing == ""`, expect: true},
+		{expr: `container.id != "c1"`, expect: false},
+		{expr: `container.labels.zone > 1`, err: true},
+		{expr: `container.unknown == 1`, err: true},
+		{expr: `container.labels.zone == "us-east-1" &&`, err: true},
+		{expr: `(container.load.cpu < 1`, err: true},
+		{expr: `container.load.cpu # 1`, err: true},
+	}
+	for idx, tt := range tests {
+		e, err := parseConstraint(tt.expr)
+		if err == nil {
+			var v bool
+			v, err = evalBool(e, attrs)
+			if err == nil && v != tt.expect {
+				t.Errorf("idx: %d expr %s expect %v", idx, tt.expr, tt.expect)
+			}
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("idx: %d expr %s unexpected err %v", idx, tt.expr, err)
+		}
+	}
+}
+
+func Test_rebalance_constraint(t *testing.T) {
+	service := "foo.bar"
+	mpr := &mapper{lg: ttLogger, appSpec: &smAppSpec{Service: service}}
+	mpr.containerState = newMapperState(mpr, containerTrigger)
+	for id, disk := range map[string]string{"c1": "ssd", "c2": "hdd"} {
+		hb := apputil.ContainerHeartbeat{Labels: map[string]string{"disk": disk}, VirtualMemoryStat: &mem.VirtualMemoryStat{UsedPercent: 50}}
+		b, _ := json.Marshal(hb)
+		if err := mpr.containerState.Create(id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ss := smShard{service: service, lg: ttLogger, mpr: mpr, appSpec: &smAppSpec{MinimizeMovement: true}}
+	specs := map[string]*apputil.ShardSpec{
+		"s1": {Constraint: `container.labels.disk == "ssd"`},
+		"s2": {},
+		"s3": {Constraint: `container.load.mem > 0.9`},
+	}
+
+	// s1 只能在c1上，s3 没有满足条件的container保持未分配
+	r := ss.rebalance(ArmorMap{"s1": "", "s2": "", "s3": ""}, ArmorMap{"c1": "", "c2": ""}, ArmorMap{"s1": "c2", "s2": "c1"}, specs)
+	expect := moveActionList{
+		&moveAction{Service: service, ShardId: "s1", DropEndpoint: "c2", AddEndpoint: "c1", Spec: specs["s1"]},
+	}
+	if !reflect.DeepEqual(r, expect) {
+		t.Errorf("actual: %s, expect: %s", r.String(), expect.String())
+	}
+
+	filter := ss.constraintFilter(specs)
+	if v := filter.violated(ArmorMap{"s1": "c2", "s2": "c1"}, ArmorMap{}); !reflect.DeepEqual(v, []string{"s1"}) {
+		t.Errorf("unexpected violated %v", v)
+	}
+	// manual的shard不受约束
+	if v := filter.violated(ArmorMap{"s1": "c2"}, ArmorMap{"s1": "c2"}); len(v) != 0 {
+		t.Errorf("unexpected violated %v", v)
+	}
+}
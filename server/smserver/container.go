@@ -17,6 +17,7 @@ package smserver
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
@@ -24,12 +25,16 @@ import (
 	"github.com/entertainment-venue/sm/pkg/etcdutil"
 	"github.com/pkg/errors"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.etcd.io/etcd/client/v3/concurrency"
 	"go.uber.org/zap"
 )
 
 var (
 	_ apputil.ShardInterface = new(smContainer)
+
+	errNotLeader = errors.New("not leader")
+
+	// errTaskUpdateUnsupported task的变更不能在运行中生效，需要重新创建shard
+	errTaskUpdateUnsupported = errors.New("task update unsupported")
 )
 
 // smContainer 竞争leader，管理sm整个集群
@@ -55,18 +60,71 @@ type smContainer struct {
 
 	// shardWrapper 4 unit test，隔离shard和container
 	shardWrapper ShardWrapper
-}
 
-func newSMContainer(lg *zap.Logger, c *apputil.Container) (*smContainer, error) {
-	container := smContainer{
-		lg:        lg,
-		Container: c,
+	// moveRecorder 当前container作为leader时执行过的move，dashboard展示使用
+	moveRecorder *moveRecorder
 
-		stopper:      &apputil.GoroutineStopper{},
-		shards:       make(map[string]Shard),
-		nodeManager:  &nodeManager{smService: c.Service()},
-		shardWrapper: &smShardWrapper{},
-	}
+	// stabilizationDelay 竞选leader成功后的等待时间
+	stabilizationDelay time.Duration
+
+	// warm 非leader时预热的sm自身mapper，当选后直接接管
+	warm *warmCache
+
+	// events 审计日志，记录move、leader变更、spec变更以及container丢失
+	events *eventLog
+
+	// deadLetters 重试后仍然失败的move
+	deadLetters *deadLetterQueue
+
+	// states shard的生命周期状态
+	states *shardStateStore
+
+	// history shard分配过的container
+	history *shardHistoryStore
+
+	// webhooks move成功后通知service注册的webhook
+	webhooks *webhookNotifier
+
+	// janitor leader清理etcd中的孤儿节点
+	janitor *janitor
+
+	// backuper leader定期备份prefix下的所有key
+	backuper *backuper
+
+	// shardValidators shard写入etcd之前执行的业务校验
+	shardValidators []ShardValidator
+
+	// taskKey 不为空时shard的Task使用AES-GCM加密后写入etcd
+	taskKey []byte
+
+	// shardGrpc 不为空时通过grpc向开启grpc的container下发add/drop
+	shardGrpc *shardGrpcPool
+
+	// breakerThreshold 和 breakerCooldown 每个service的operator对container熔断的配置，为0使用默认值
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// quotas 接口创建service和shard时检查的全局和租户quota
+	quotas *quotaChecker
+
+	// election leader竞选使用的session，和container heartbeat的session分开续约，只读副本为nil
+	election *electionSession
+
+	// resignc leader在campaign中接收放弃leader的请求，处理结果通过请求中的channel返回
+	resignc chan chan error
+	// resignBackoff 放弃leader后重新竞选前的等待时间
+	resignBackoff time.Duration
+
+	// shardServerDone shard server退出时关闭，health接口使用
+	shardServerDone <-chan struct{}
+
+	// cache 只读副本通过watch维护的etcd缓存，正常的smserver为nil
+	cache *readCache
+}
+
+func newSMContainer(lg *zap.Logger, c *apputil.Container, stabilizationDelay time.Duration, electionTTL int) (*smContainer, error) {
+	container := initSMContainer(lg, c, stabilizationDelay)
+	container.election = newElectionSession(lg, c.Backend(), electionTTL)
 	// 判断sm的spec是否存在,如果不存在，那么进行创建,可以通过接口进行参数更改
 	spec := smAppSpec{Service: c.Service(), CreateTime: time.Now().Unix()}
 	if err := c.Client.CreateAndGet(
@@ -84,7 +142,35 @@ func newSMContainer(lg *zap.Logger, c *apputil.Container) (*smContainer, error)
 		},
 	)
 
-	return &container, nil
+	return container, nil
+}
+
+// initSMContainer 只初始化smContainer的成员，只读副本不创建sm的spec，也不参与leader竞选
+func initSMContainer(lg *zap.Logger, c *apputil.Container, stabilizationDelay time.Duration) *smContainer {
+	container := smContainer{
+		lg:        lg,
+		Container: c,
+
+		stopper:      apputil.NewGoroutineStopper("smContainer"),
+		shards:       make(map[string]Shard),
+		nodeManager:  &nodeManager{smService: c.Service(), etcdPath: c.EtcdPath()},
+		shardWrapper: &smShardWrapper{},
+		moveRecorder: newMoveRecorder(defaultMoveRecordSize),
+
+		stabilizationDelay: stabilizationDelay,
+		warm:               newWarmCache(lg),
+
+		resignc:       make(chan chan error),
+		resignBackoff: defaultResignBackoff,
+	}
+	container.events = newEventLog(lg, &container)
+	container.deadLetters = newDeadLetterQueue(lg, c.Client, container.nodeManager)
+	container.states = newShardStateStore(lg, c.Client, container.nodeManager)
+	container.history = newShardHistoryStore(lg, c.Client, container.nodeManager)
+	container.webhooks = newWebhookNotifier(lg, c.Client, container.nodeManager)
+	container.janitor = newJanitor(lg, c.Client, container.nodeManager)
+	container.backuper = newBackuper(lg, c.Client, container.nodeManager)
+	return &container
 }
 
 func (c *smContainer) GetShard(service string) (Shard, error) {
@@ -97,6 +183,56 @@ func (c *smContainer) GetShard(service string) (Shard, error) {
 	return ss, nil
 }
 
+// drain 关闭之前调用，container继续工作，等待leader把负责的service移交给其他sm container，
+// 超时后不再等待，由 Close 直接关闭剩下的shard
+func (c *smContainer) drain(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// leader需要先交出去，新的leader负责移动当前container上的shard
+	if err := c.resign(ctx); err != nil && err != errNotLeader {
+		c.lg.Warn(
+			"resign leader error when draining",
+			zap.String("service", c.Service()),
+			zap.Error(err),
+		)
+	}
+	if err := c.Container.Drain(ctx); err != nil {
+		c.lg.Error(
+			"drain error",
+			zap.String("service", c.Service()),
+			zap.Error(err),
+		)
+		return
+	}
+
+	ticker := time.NewTicker(defaultDrainCheckInterval)
+	defer ticker.Stop()
+	for {
+		remaining := c.shardCount()
+		if remaining == 0 {
+			c.lg.Info("drain completed", zap.String("service", c.Service()))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			c.lg.Warn(
+				"drain timeout",
+				zap.String("service", c.Service()),
+				zap.Int("remaining", remaining),
+			)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *smContainer) shardCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.shards)
+}
+
 func (c *smContainer) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -125,6 +261,23 @@ func (c *smContainer) Close() error {
 	if c.stopper != nil {
 		c.stopper.Close()
 	}
+	// campaign退出后revoke竞选的lease，其他container立即开始竞选
+	if c.election != nil {
+		c.election.Close()
+	}
+
+	// campaign退出后不会再预热
+	if c.warm != nil {
+		c.warm.Close()
+	}
+
+	// shard关闭后不会再产生move
+	if c.webhooks != nil {
+		c.webhooks.Close()
+	}
+	if c.shardGrpc != nil {
+		c.shardGrpc.Close()
+	}
 
 	c.lg.Info(
 		"smContainer closing",
@@ -161,6 +314,22 @@ func (c *smContainer) Add(id string, spec *apputil.ShardSpec) error {
 			return apputil.ErrExist
 		}
 
+		// 支持热更新的shard直接更新task，避免一次完整的停止和启动
+		if updater, ok := sd.(TaskUpdater); ok {
+			err := updater.UpdateTask(spec.Task)
+			if err == nil {
+				c.lg.Info("shard task updated",
+					zap.String("id", id),
+					zap.String("new", spec.Task),
+				)
+				return nil
+			}
+			c.lg.Info("shard task update unsupported, restart shard",
+				zap.String("id", id),
+				zap.Error(err),
+			)
+		}
+
 		// 判断是否需要更新shard的工作内容，task有变更停掉当前shard，重新启动
 		if sd.Spec().Task != spec.Task {
 			sd.Close()
@@ -249,6 +418,9 @@ func (c *smContainer) Load(id string) (string, error) {
 type leaderEtcdValue struct {
 	ContainerId string `json:"containerId"`
 	CreateTime  int64  `json:"createTime"`
+
+	// LeaseId 竞选使用的session，etcd中是lease的16进制
+	LeaseId string `json:"leaseId,omitempty"`
 }
 
 func (v *leaderEtcdValue) String() string {
@@ -256,6 +428,114 @@ func (v *leaderEtcdValue) String() string {
 	return string(b)
 }
 
+// leaderTerm 每次当选递增，怀疑脑裂时对比不同节点看到的term
+type leaderTerm struct {
+	Term        int64  `json:"term"`
+	ContainerId string `json:"containerId"`
+	LeaseId     string `json:"leaseId"`
+}
+
+func (t *leaderTerm) String() string {
+	b, _ := json.Marshal(t)
+	return string(b)
+}
+
+// leaderInfo leader接口的返回
+type leaderInfo struct {
+	ContainerId string `json:"containerId"`
+	LeaseId     string `json:"leaseId"`
+
+	// CampaignTime 开始竞选的时间，单位秒
+	CampaignTime int64 `json:"campaignTime"`
+
+	// Term 新leader还没有写入term时为0
+	Term int64 `json:"term"`
+}
+
+// leader 没有leader时返回空
+func (c *smContainer) leader(ctx context.Context) (string, error) {
+	info, err := c.leaderInfo(ctx)
+	if err != nil || info == nil {
+		return "", err
+	}
+	return info.ContainerId, nil
+}
+
+// leaderInfo 没有leader时返回nil
+func (c *smContainer) leaderInfo(ctx context.Context) (*leaderInfo, error) {
+	value, err := c.Backend().Leader(ctx, c.nodeManager.nodeSMLeader())
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if value == "" {
+		return nil, nil
+	}
+	var lv leaderEtcdValue
+	if err := json.Unmarshal([]byte(value), &lv); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	info := leaderInfo{ContainerId: lv.ContainerId, LeaseId: lv.LeaseId, CampaignTime: lv.CreateTime}
+
+	term, err := c.term(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	// term属于之前的leader时不返回，防止误导
+	if term.ContainerId == lv.ContainerId && term.LeaseId == lv.LeaseId {
+		info.Term = term.Term
+	}
+	return &info, nil
+}
+
+func (c *smContainer) term(ctx context.Context) (*leaderTerm, error) {
+	kv, err := c.Backend().Get(ctx, c.nodeManager.nodeSMTerm())
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var term leaderTerm
+	if kv == nil {
+		return &term, nil
+	}
+	if err := json.Unmarshal([]byte(kv.Value), &term); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &term, nil
+}
+
+// increaseTerm 只有leader写入，当选后调用，失败不影响leader的工作
+func (c *smContainer) increaseTerm(ctx context.Context) (int64, error) {
+	term, err := c.term(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "")
+	}
+	next := leaderTerm{Term: term.Term + 1, ContainerId: c.Id(), LeaseId: c.election.current().Id()}
+	if err := c.Backend().Put(ctx, c.nodeManager.nodeSMTerm(), next.String()); err != nil {
+		return 0, errors.Wrap(err, "")
+	}
+	return next.Term, nil
+}
+
+// governor 返回负责service的sm container，每个service的smShard是sm自身的一个shard，
+// 从shard heartbeat中获取所在的container，没有分配时返回空
+func (c *smContainer) governor(ctx context.Context, service string) (string, error) {
+	kvs, err := c.Backend().GetPrefix(ctx, c.nodeManager.etcdPath.AppShardHbId(c.Service(), service))
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	for _, kv := range kvs {
+		// mutex刚创建的节点还没有写入heartbeat
+		if len(kv.Value) == 0 {
+			continue
+		}
+		var hb apputil.ShardHeartbeat
+		if err := json.Unmarshal([]byte(kv.Value), &hb); err != nil {
+			return "", errors.Wrap(err, kv.Value)
+		}
+		return hb.ContainerId, nil
+	}
+	return "", nil
+}
+
 func (c *smContainer) campaign(ctx context.Context) {
 	for {
 	loop:
@@ -266,10 +546,23 @@ func (c *smContainer) campaign(ctx context.Context) {
 		default:
 		}
 
+		// 等待选举期间维护sm自身的mapper，当选后不需要全量扫描heartbeat
+		c.warmUp(ctx)
+
+		session, err := c.election.get(ctx)
+		if err != nil {
+			c.lg.Error(
+				"election session error",
+				zap.String("service", c.Service()),
+				zap.Error(err),
+			)
+			time.Sleep(defaultSleepTimeout)
+			goto loop
+		}
+
 		leaderNodePrefix := c.nodeManager.nodeSMLeader()
-		lvalue := leaderEtcdValue{ContainerId: c.Id(), CreateTime: time.Now().Unix()}
-		election := concurrency.NewElection(c.Session, leaderNodePrefix)
-		if err := election.Campaign(ctx, lvalue.String()); err != nil {
+		lvalue := leaderEtcdValue{ContainerId: c.Id(), CreateTime: time.Now().Unix(), LeaseId: session.Id()}
+		if err := c.Backend().Campaign(ctx, session, leaderNodePrefix, lvalue.String()); err != nil {
 			c.lg.Error(
 				"Campaign error",
 				zap.String("service", c.Service()),
@@ -278,10 +571,27 @@ func (c *smContainer) campaign(ctx context.Context) {
 			time.Sleep(defaultSleepTimeout)
 			goto loop
 		}
+		// 等待期间lease过期，竞选的节点已经被删除，不能认为当选
+		select {
+		case <-session.Done():
+			c.lg.Warn("election session expired when campaign", zap.String("service", c.Service()))
+			goto loop
+		default:
+		}
+		term, err := c.increaseTerm(ctx)
+		if err != nil {
+			c.lg.Error(
+				"increase term error",
+				zap.String("service", c.Service()),
+				zap.Error(err),
+			)
+		}
 		c.lg.Info("campaign leader success",
 			zap.String("pfx", leaderNodePrefix),
-			zap.Int64("lease", int64(c.Session.Lease())),
+			zap.String("session", session.Id()),
+			zap.Int64("term", term),
 		)
+		c.events.append(eventLeaderChange, c.Service(), "", fmt.Sprintf("leader %s elected, term %d", c.Id(), term))
 
 		// leader有几种情况会重新选举：
 		// 1 重启
@@ -293,11 +603,23 @@ func (c *smContainer) campaign(ctx context.Context) {
 		// leader更换，需要重新构建mapper(存活container)，最差情况是一个container不存活，触发rebalance，
 		// 旧的container加回来，发现不能lock shard，剔除掉shard即可，所以这块不用等待
 
+		// 网络较差的部署可以配置等待时间，让container的heartbeat稳定下来，减少新leader上任后不必要的shard移动，
+		// standby期间已经观察heartbeat的时间从等待时间中扣除
+		if delay := c.stabilizationDelay - c.warm.warmFor(); delay > 0 {
+			select {
+			case <-ctx.Done():
+				c.lg.Info("leader exit when stabilizing", zap.String("service", c.Service()))
+				return
+			case <-time.After(delay):
+			}
+		} else if c.stabilizationDelay > 0 {
+			c.lg.Info("leader skip stabilization with warm cache", zap.String("service", c.Service()))
+		}
+
 		// 检查所有shard应该都被分配container，当前app的配置信息是预先录入etcd的。此时提取该信息，得到所有shard的id，
 		// https://github.com/entertainment-venue/sm/wiki/leader%E8%AE%BE%E8%AE%A1%E6%80%9D%E8%B7%AF
 		st := shardTask{GovernedService: c.Service()}
 		spec := apputil.ShardSpec{Service: c.Service(), Task: st.String()}
-		var err error
 		c.leaderShard, err = newSMShard(c, &spec)
 		if err != nil {
 			c.lg.Error(
@@ -307,6 +629,45 @@ func (c *smContainer) campaign(ctx context.Context) {
 			)
 			goto loop
 		}
+		// janitor和leaderShard同生命周期，放弃leader时一起停止
+		leaderShard := c.leaderShard
+		leaderShard.stopper.Wrap(
+			func(ctx context.Context) {
+				leaderShard.supervise(ctx, "janitor", func(ctx context.Context) {
+					apputil.TickerLoop(
+						ctx,
+						c.lg,
+						defaultJanitorInterval,
+						fmt.Sprintf("janitor exit, service %s ", c.Service()),
+						func(ctx context.Context) error {
+							// 全局暂停期间不删除节点
+							if c.schedulerPaused(ctx) {
+								return nil
+							}
+							return c.janitor.sweep(ctx)
+						},
+					)
+				})
+			},
+		)
+		if interval, ok := c.backuper.scheduled(); ok {
+			leaderShard.stopper.Wrap(
+				func(ctx context.Context) {
+					leaderShard.supervise(ctx, "backup", func(ctx context.Context) {
+						apputil.TickerLoop(
+							ctx,
+							c.lg,
+							interval,
+							fmt.Sprintf("backup exit, service %s ", c.Service()),
+							func(ctx context.Context) error {
+								_, err := c.backuper.save(ctx)
+								return err
+							},
+						)
+					})
+				},
+			)
+		}
 
 		// block until出现需要放弃leader职权的事件
 		c.lg.Info("leader completed op", zap.String("service", c.Service()))
@@ -315,6 +676,66 @@ func (c *smContainer) campaign(ctx context.Context) {
 			c.lg.Info("leader exit", zap.String("service", c.Service()))
 			c.leaderShard = nil
 			return
+		case <-session.Done():
+			// leader节点随lease删除，其他container可能已经当选，先停掉leader的工作再用新的session竞选，
+			// heartbeat的session不受影响，sm负责的service不会移动
+			c.lg.Warn(
+				"election session expired, campaign again",
+				zap.String("service", c.Service()),
+				zap.String("session", session.Id()),
+			)
+			c.leaderShard.Close()
+			c.leaderShard = nil
+			c.events.append(eventLeaderChange, c.Service(), "", fmt.Sprintf("leader %s lost election session %s", c.Id(), session.Id()))
+			goto loop
+		case donec := <-c.resignc:
+			err := c.resignLeader(ctx)
+			donec <- err
+			if err != nil {
+				// 节点还在，重新Campaign会直接当选，恢复leader的工作
+				c.lg.Error(
+					"resign leader error",
+					zap.String("service", c.Service()),
+					zap.Error(err),
+				)
+				goto loop
+			}
+
+			select {
+			case <-ctx.Done():
+				c.lg.Info("leader exit after resign", zap.String("service", c.Service()))
+				return
+			case <-time.After(c.resignBackoff):
+			}
 		}
 	}
 }
+
+// resignLeader 先停掉leader的工作，再删除election的节点，和 Close 的顺序一致
+func (c *smContainer) resignLeader(ctx context.Context) error {
+	c.leaderShard.Close()
+	c.leaderShard = nil
+
+	if err := c.Backend().Resign(ctx, c.election.current(), c.nodeManager.nodeSMLeader()); err != nil {
+		return errors.Wrap(err, "")
+	}
+	c.lg.Info("resign leader success", zap.String("service", c.Service()))
+	c.events.append(eventLeaderChange, c.Service(), "", fmt.Sprintf("leader %s resigned", c.Id()))
+	return nil
+}
+
+// resign 只有当前container是leader并且campaign在等待时才能放弃leader
+func (c *smContainer) resign(ctx context.Context) error {
+	donec := make(chan error, 1)
+	select {
+	case c.resignc <- donec:
+	default:
+		return errNotLeader
+	}
+	select {
+	case err := <-donec:
+		return errors.Wrap(err, "")
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "")
+	}
+}
@@ -1,9 +1,12 @@
 package smserver
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
@@ -35,6 +38,104 @@ func (m *MockedShard) SetMaxRecoveryTime(maxRecoveryTime int) {
 	m.Called(maxRecoveryTime)
 }
 
+func (m *MockedShard) SetMinimizeMovement(minimizeMovement bool) {
+	m.Called(minimizeMovement)
+}
+
+func (m *MockedShard) RebalancePlan(ctx context.Context) (moveActionList, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(moveActionList), args.Error(1)
+}
+
+func (m *MockedShard) SetMaxShardsPerContainer(maxShardsPerContainer int) {
+	m.Called(maxShardsPerContainer)
+}
+
+func (m *MockedShard) SetHealthProbe(healthProbe bool) {
+	m.Called(healthProbe)
+}
+
+func (m *MockedShard) SetSpreadPolicy(spreadPolicy string) {
+	m.Called(spreadPolicy)
+}
+
+func (m *MockedShard) SetDeploymentPolicy(deploymentPolicy string) {
+	m.Called(deploymentPolicy)
+}
+
+func (m *MockedShard) SetFrozen(frozen bool) {
+	m.Called(frozen)
+}
+
+func (m *MockedShard) SetAssignor(assignor string) {
+	m.Called(assignor)
+}
+
+func (m *MockedShard) SetMoveConcurrency(moveConcurrency int) {
+	m.Called(moveConcurrency)
+}
+
+func (m *MockedShard) SetCanary(canary *canarySpec) {
+	m.Called(canary)
+}
+
+func (m *MockedShard) SetWarmup(warmup *warmupSpec) {
+	m.Called(warmup)
+}
+
+func (m *MockedShard) SetMoveCooldown(moveCooldown int) {
+	m.Called(moveCooldown)
+}
+
+func (m *MockedShard) SetRebalanceInterval(rebalanceInterval int) {
+	m.Called(rebalanceInterval)
+}
+
+func (m *MockedShard) SetRebalanceDebounce(rebalanceDebounce int) {
+	m.Called(rebalanceDebounce)
+}
+
+func (m *MockedShard) SetRebalanceWindows(rebalanceWindows []string) {
+	m.Called(rebalanceWindows)
+}
+
+func (m *MockedShard) Frozen() bool {
+	args := m.Called()
+	return args.Bool(0)
+}
+
+func (m *MockedShard) Requeue(mals moveActionList) {
+	m.Called(mals)
+}
+
+func (m *MockedShard) TriggerRebalance(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockedShard) DropAll(ctx context.Context) ([]string, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockedShard) UnassignedShards() []string {
+	args := m.Called()
+	return args.Get(0).([]string)
+}
+
+func (m *MockedShard) Explain(ctx context.Context, shardId string) (*shardExplanation, error) {
+	args := m.Called(ctx, shardId)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*shardExplanation), args.Error(1)
+}
+
+func (m *MockedShard) Reservations() *serviceReservations {
+	args := m.Called()
+	return args.Get(0).(*serviceReservations)
+}
+
 func (m *MockedShard) Close() error {
 	args := m.Called()
 	return args.Error(0)
@@ -132,6 +233,24 @@ func (suite *ContainerTestSuite) TestAdd_update() {
 	assert.Nil(suite.T(), err)
 }
 
+func (suite *ContainerTestSuite) TestAdd_updateTask() {
+	st := shardTask{GovernedService: "foo"}
+	fakeShard := &smShard{service: "foo", shardSpec: &apputil.ShardSpec{Id: "s2", Task: st.String()}}
+	suite.container.shards["s2"] = fakeShard
+
+	// governedService不变，不重新创建shard
+	st.Owner = "t1"
+	err := suite.container.Add("s2", &apputil.ShardSpec{Task: st.String()})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), suite.container.shards["s2"], fakeShard)
+	assert.Equal(suite.T(), st.String(), fakeShard.Spec().Task)
+	assert.Equal(suite.T(), "s2", fakeShard.Spec().Id)
+
+	// governedService变化需要重新创建
+	other := shardTask{GovernedService: "bar"}
+	assert.Equal(suite.T(), errTaskUpdateUnsupported, fakeShard.UpdateTask(other.String()))
+}
+
 func (suite *ContainerTestSuite) TestDrop_closing() {
 	suite.container.closing = true
 	err := suite.container.Drop("s1")
@@ -180,3 +299,20 @@ func (suite *ContainerTestSuite) TestClose_closing() {
 	err := suite.container.Close()
 	assert.Equal(suite.T(), err, apputil.ErrClosing)
 }
+
+func Test_smContainer_resign(t *testing.T) {
+	c := smContainer{resignc: make(chan chan error)}
+	if err := c.resign(context.TODO()); errors.Cause(err) != errNotLeader {
+		t.Errorf("unexpected err %v", err)
+	}
+
+	// 模拟campaign中等待的leader
+	go func() {
+		donec := <-c.resignc
+		donec <- nil
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := c.resign(context.TODO()); err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+}
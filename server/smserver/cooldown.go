@@ -0,0 +1,101 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// moveCooldown 记录shard最近一次被add到container的时间，leader切换后重新开始记录
+type moveCooldown struct {
+	mu      sync.Mutex
+	movedAt map[string]time.Time
+}
+
+func newMoveCooldown() *moveCooldown {
+	return &moveCooldown{movedAt: make(map[string]time.Time)}
+}
+
+// moved move成功后调用，单纯的drop不影响shard的位置
+func (c *moveCooldown) moved(ma *moveAction, now time.Time) {
+	if c == nil || ma.AddEndpoint == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.movedAt[ma.ShardId] = now
+}
+
+// cooling 返回d时间内移动过的shard，同时清理过期的记录
+func (c *moveCooldown) cooling(d time.Duration, now time.Time) map[string]struct{} {
+	if c == nil || d <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := make(map[string]struct{})
+	for shardId, t := range c.movedAt {
+		if now.Sub(t) >= d {
+			delete(c.movedAt, shardId)
+			continue
+		}
+		r[shardId] = struct{}{}
+	}
+	return r
+}
+
+// holdCooling 冷却中的shard固定在当前container上，container存活时不参与本轮rebalance，
+// 防止负载在均衡阈值附近波动时shard来回移动，container丢失、不健康或者draining时不受限制
+func (ss *smShard) holdCooling(groups map[string]*balancerGroup, aliveContainers ArmorMap, hbShards map[string]*temporary, shardIdAndGroup ArmorMap) {
+	spec := ss.spec()
+	if spec == nil || spec.MoveCooldown <= 0 {
+		return
+	}
+	cooling := ss.cooldown.cooling(time.Duration(spec.MoveCooldown)*time.Second, time.Now())
+	ss.holdShards(cooling, groups, aliveContainers, hbShards, shardIdAndGroup, "shard cooling, hold on current container")
+}
+
+// holdShards shardIds中所在container存活的shard固定在当前container上，人工指定container的shard不变
+func (ss *smShard) holdShards(shardIds map[string]struct{}, groups map[string]*balancerGroup, aliveContainers ArmorMap, hbShards map[string]*temporary, shardIdAndGroup ArmorMap, msg string) {
+	for shardId := range shardIds {
+		value, ok := hbShards[shardId]
+		if !ok {
+			continue
+		}
+		if _, ok := aliveContainers[value.curContainerId]; !ok {
+			continue
+		}
+		group, ok := shardIdAndGroup[shardId]
+		if !ok {
+			continue
+		}
+		bg := groups[group]
+		// 人工指定的container优先
+		if manual, ok := bg.fixShardIdAndManualContainerId[shardId]; !ok || manual != "" {
+			continue
+		}
+		bg.fixShardIdAndManualContainerId[shardId] = value.curContainerId
+		ss.lg.Debug(
+			msg,
+			zap.String("service", ss.service),
+			zap.String("shardId", shardId),
+			zap.String("containerId", value.curContainerId),
+		)
+	}
+}
@@ -0,0 +1,54 @@
+package smserver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_moveCooldown(t *testing.T) {
+	c := newMoveCooldown()
+	now := time.Now()
+	c.moved(&moveAction{ShardId: "s1", AddEndpoint: "c1"}, now.Add(-20*time.Second))
+	c.moved(&moveAction{ShardId: "s2", DropEndpoint: "c1", AddEndpoint: "c2"}, now)
+	// drop不记录
+	c.moved(&moveAction{ShardId: "s3", DropEndpoint: "c1"}, now)
+
+	cooling := c.cooling(10*time.Second, now)
+	if _, ok := cooling["s2"]; !ok || len(cooling) != 1 {
+		t.Errorf("unexpected cooling %v", cooling)
+	}
+	// 过期的记录被清理
+	if _, ok := c.movedAt["s1"]; ok {
+		t.Errorf("s1 should be removed")
+	}
+	if r := c.cooling(0, now); r != nil {
+		t.Errorf("unexpected cooling %v", r)
+	}
+}
+
+func Test_smShard_holdCooling(t *testing.T) {
+	ss := smShard{lg: ttLogger, appSpec: &smAppSpec{MoveCooldown: 60}, cooldown: newMoveCooldown()}
+	for _, id := range []string{"s1", "s2", "s3", "s4"} {
+		ss.cooldown.moved(&moveAction{ShardId: id, AddEndpoint: "c1"}, time.Now())
+	}
+
+	bg := newBalanceGroup()
+	bg.fixShardIdAndManualContainerId = ArmorMap{"s1": "", "s2": "", "s3": "c2", "s4": "", "s5": ""}
+	groups := map[string]*balancerGroup{"": bg}
+	hbShards := map[string]*temporary{
+		"s1": {curContainerId: "c1"},
+		// container已经丢失
+		"s2": {curContainerId: "c3"},
+		"s3": {curContainerId: "c1"},
+		"s5": {curContainerId: "c1"},
+	}
+	shardIdAndGroup := ArmorMap{"s1": "", "s2": "", "s3": "", "s4": "", "s5": ""}
+	ss.holdCooling(groups, ArmorMap{"c1": "", "c2": ""}, hbShards, shardIdAndGroup)
+
+	expect := ArmorMap{"s1": "c1", "s2": "", "s3": "c2", "s4": "", "s5": ""}
+	for id, v := range expect {
+		if bg.fixShardIdAndManualContainerId[id] != v {
+			t.Errorf("shard %s expect %q actual %q", id, v, bg.fixShardIdAndManualContainerId[id])
+		}
+	}
+}
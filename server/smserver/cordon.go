@@ -0,0 +1,147 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// cordonRecord cordon的container保留现有shard，rebalance时不再接收新的shard，类似kubectl cordon
+type cordonRecord struct {
+	// Timestamp cordon的时间，unix秒
+	Timestamp int64 `json:"timestamp"`
+}
+
+func (r *cordonRecord) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// cordonedContainers 最近一次balance时被cordon的container
+func (ss *smShard) cordonedContainers() map[string]struct{} {
+	ss.cordonMu.Lock()
+	defer ss.cordonMu.Unlock()
+	return ss.cordoned
+}
+
+// holdCordoned 从etcd加载被cordon的container，上面的shard固定在当前container上，
+// 人工指定container的shard不受影响，新的shard通过constraintFilter排除cordon的container
+func (ss *smShard) holdCordoned(ctx context.Context, groups map[string]*balancerGroup, aliveContainers ArmorMap, hbShards map[string]*temporary, shardIdAndGroup ArmorMap) error {
+	kvs, err := ss.container.Client.GetKVs(ctx, ss.container.nodeManager.nodeServiceCordon(ss.service))
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	cordoned := make(map[string]struct{})
+	for containerId := range kvs {
+		cordoned[containerId] = struct{}{}
+	}
+	// 熔断中的container和cordon一样保留现有shard，drop请求也会失败，cooldown结束后重新参与分配
+	for containerId := range ss.operator.suspectContainers() {
+		cordoned[containerId] = struct{}{}
+	}
+	ss.cordonMu.Lock()
+	ss.cordoned = cordoned
+	ss.cordonMu.Unlock()
+
+	for shardId, value := range hbShards {
+		if _, ok := cordoned[value.curContainerId]; !ok {
+			continue
+		}
+		if _, ok := aliveContainers[value.curContainerId]; !ok {
+			continue
+		}
+		group, ok := shardIdAndGroup[shardId]
+		if !ok {
+			continue
+		}
+		bg := groups[group]
+		if manual, ok := bg.fixShardIdAndManualContainerId[shardId]; !ok || manual != "" {
+			continue
+		}
+		bg.fixShardIdAndManualContainerId[shardId] = value.curContainerId
+	}
+	return nil
+}
+
+type cordonRequest struct {
+	Service string `json:"service" binding:"required"`
+
+	ContainerId string `json:"containerId" binding:"required"`
+}
+
+func (r *cordonRequest) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// @Description cordon container, the container keeps its shards but receives no new assignments during rebalance
+// @Tags  container
+// @Accept  json
+// @Produce  json
+// @Param param body cordonRequest true "param"
+// @success 200
+// @Router /sm/server/cordon-container [post]
+func (ss *smShardApi) GinCordonContainer(c *gin.Context) {
+	var req cordonRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	pfx := ss.container.nodeManager.nodeServiceCordon(req.Service) + req.ContainerId
+	record := cordonRecord{Timestamp: time.Now().Unix()}
+	if _, err := ss.container.Client.Put(context.TODO(), pfx, record.String()); err != nil {
+		ss.lg.Error("Put error", zap.String("pfx", pfx), zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	ss.container.events.append(eventCordon, req.Service, c.ClientIP(), "cordon "+req.ContainerId)
+	ss.lg.Info("container cordoned", zap.Reflect("req", req))
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// @Description uncordon container, the container receives new assignments again
+// @Tags  container
+// @Accept  json
+// @Produce  json
+// @Param param body cordonRequest true "param"
+// @success 200
+// @Router /sm/server/uncordon-container [post]
+func (ss *smShardApi) GinUncordonContainer(c *gin.Context) {
+	var req cordonRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	pfx := ss.container.nodeManager.nodeServiceCordon(req.Service) + req.ContainerId
+	if _, err := ss.container.Client.Delete(context.TODO(), pfx); err != nil {
+		ss.lg.Error("Delete error", zap.String("pfx", pfx), zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	ss.container.events.append(eventCordon, req.Service, c.ClientIP(), "uncordon "+req.ContainerId)
+	ss.lg.Info("container uncordoned", zap.Reflect("req", req))
+	c.JSON(http.StatusOK, gin.H{})
+}
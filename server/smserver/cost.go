@@ -0,0 +1,38 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"github.com/entertainment-venue/sm/pkg/apputil"
+)
+
+// costOf 返回按照shard id查询迁移代价的函数，没有设置的shard代价为0
+func costOf(shardIdAndShardSpec map[string]*apputil.ShardSpec) func(shardId string) int64 {
+	return func(shardId string) int64 {
+		if spec := shardIdAndShardSpec[shardId]; spec != nil && spec.MoveCost > 0 {
+			return spec.MoveCost
+		}
+		return 0
+	}
+}
+
+// applyReportedCosts container通过heartbeat上报的迁移代价覆盖spec中的静态值，spec是本次计算从etcd读取的，不影响存储
+func applyReportedCosts(shardIdAndShardSpec map[string]*apputil.ShardSpec, aliveShards map[string]*temporary) {
+	for shardId, tmp := range aliveShards {
+		if spec, ok := shardIdAndShardSpec[shardId]; ok && tmp.moveCost > 0 {
+			spec.MoveCost = tmp.moveCost
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+//go:embed dashboard/index.html
+var dashboardHTML []byte
+
+// moveRecord 一次move的执行结果
+type moveRecord struct {
+	*moveAction
+
+	Succ      bool  `json:"succ"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// moveRecorder 环形保存最近的move，只在内存中，leader切换后从新的leader查看
+type moveRecorder struct {
+	mu      sync.Mutex
+	size    int
+	records []*moveRecord
+}
+
+func newMoveRecorder(size int) *moveRecorder {
+	return &moveRecorder{size: size}
+}
+
+func (r *moveRecorder) record(mal moveActionList, succ bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().Unix()
+	for _, ma := range mal {
+		r.records = append(r.records, &moveRecord{moveAction: ma, Succ: succ, Timestamp: now})
+	}
+	if len(r.records) > r.size {
+		r.records = r.records[len(r.records)-r.size:]
+	}
+}
+
+// list 按照时间倒序返回
+func (r *moveRecorder) list() []*moveRecord {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []*moveRecord
+	for i := len(r.records) - 1; i >= 0; i-- {
+		result = append(result, r.records[i])
+	}
+	return result
+}
+
+type dashboardShard struct {
+	ShardId     string `json:"shardId"`
+	ContainerId string `json:"containerId"`
+	Load        string `json:"load"`
+
+	Stats *apputil.ShardLoad `json:"stats,omitempty"`
+}
+
+type dashboardService struct {
+	Service    string            `json:"service"`
+	Containers []string          `json:"containers"`
+	Shards     []*dashboardShard `json:"shards"`
+
+	// Suspect 连续add/drop失败被熔断的container，只有负责service的sm container有数据
+	Suspect []*suspectContainer `json:"suspect,omitempty"`
+}
+
+type clusterState struct {
+	Leader   string              `json:"leader"`
+	Services []*dashboardService `json:"services"`
+
+	// Moves 只有当前节点是leader时才有数据
+	Moves []*moveRecord `json:"moves"`
+}
+
+// @Description dashboard page
+// @Tags  dashboard
+// @Produce  html
+// @success 200
+// @Router /sm/dashboard [get]
+func (ss *smShardApi) GinDashboard(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+}
+
+// @Description cluster state for dashboard
+// @Tags  dashboard
+// @Produce  json
+// @success 200
+// @Router /sm/server/cluster-state [get]
+func (ss *smShardApi) GinClusterState(c *gin.Context) {
+	state, err := ss.clusterState(c)
+	if err != nil {
+		ss.lg.Error("clusterState error", zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, state)
+}
+
+func (ss *smShardApi) clusterState(c *gin.Context) (*clusterState, error) {
+	ctx := context.TODO()
+	nm := ss.container.nodeManager
+
+	var state clusterState
+
+	leader, err := ss.container.leader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if leader != "" {
+		state.Leader = leader
+		if leader == ss.container.Id() {
+			for _, record := range ss.container.moveRecorder.list() {
+				if authorized(c, record.Service) {
+					state.Moves = append(state.Moves, record)
+				}
+			}
+		}
+	}
+
+	// sm自身也作为一个service展示
+	services := []string{ss.container.Service()}
+	kvs, err := ss.container.Client.GetKVs(ctx, nm.nodeServiceShard(ss.container.Service(), ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var governed []string
+	for service := range kvs {
+		governed = append(governed, service)
+	}
+	sort.Strings(governed)
+	services = append(services, governed...)
+
+	for _, service := range services {
+		if !authorized(c, service) {
+			continue
+		}
+		ds, err := ss.serviceState(ctx, service)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		state.Services = append(state.Services, ds)
+	}
+	return &state, nil
+}
+
+func (ss *smShardApi) serviceState(ctx context.Context, service string) (*dashboardService, error) {
+	nm := ss.container.nodeManager
+	ds := dashboardService{Service: service}
+
+	var err error
+	ds.Containers, err = ss.aliveContainers(ctx, service)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	assignment, err := ss.shardHeartbeats(ctx, service)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	kvs, err := ss.container.Client.GetKVs(ctx, nm.nodeServiceShard(service, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	for shardId := range kvs {
+		shard := dashboardShard{ShardId: shardId}
+		if hb, ok := assignment[shardId]; ok {
+			shard.ContainerId = hb.ContainerId
+			shard.Load = hb.Load
+			shard.Stats = hb.Stats
+		}
+		ds.Shards = append(ds.Shards, &shard)
+	}
+	sort.Slice(ds.Shards, func(i, j int) bool {
+		return ds.Shards[i].ShardId < ds.Shards[j].ShardId
+	})
+
+	if shard, err := ss.container.GetShard(service); err == nil {
+		if s, ok := shard.(*smShard); ok {
+			ds.Suspect = s.operator.suspect()
+		}
+	}
+	return &ds, nil
+}
+
+// aliveContainers 有heartbeat的container
+func (ss *smShardApi) aliveContainers(ctx context.Context, service string) ([]string, error) {
+	// /sm/app/proxy.dev/containerhb/127.0.0.1:8801/694d7e3ff2d3a80c
+	resp, err := ss.container.Client.GetKV(ctx, ss.container.nodeManager.nodeServiceContainerHb(service), []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var containers []string
+	for _, kv := range resp.Kvs {
+		containers = append(containers, path.Base(path.Dir(string(kv.Key))))
+	}
+	sort.Strings(containers)
+	return containers, nil
+}
+
+// shardHeartbeats shard的分配关系通过shard的heartbeat确认，key是shard id
+func (ss *smShardApi) shardHeartbeats(ctx context.Context, service string) (map[string]*apputil.ShardHeartbeat, error) {
+	resp, err := ss.container.Client.GetKV(ctx, ss.container.nodeManager.nodeServiceShardHb(service), []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	assignment := make(map[string]*apputil.ShardHeartbeat)
+	for _, kv := range resp.Kvs {
+		// mutex刚创建的节点还没有写入heartbeat
+		if len(kv.Value) == 0 {
+			continue
+		}
+		var hb apputil.ShardHeartbeat
+		if err := json.Unmarshal(kv.Value, &hb); err != nil {
+			ss.lg.Warn(
+				"unexpected shard heartbeat",
+				zap.String("key", string(kv.Key)),
+				zap.Error(err),
+			)
+			continue
+		}
+		assignment[path.Base(path.Dir(string(kv.Key)))] = &hb
+	}
+	return assignment, nil
+}
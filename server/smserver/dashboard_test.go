@@ -0,0 +1,30 @@
+package smserver
+
+import (
+	"testing"
+)
+
+func Test_moveRecorder(t *testing.T) {
+	r := newMoveRecorder(2)
+	r.record(moveActionList{{ShardId: "1"}, {ShardId: "2"}}, true)
+	r.record(moveActionList{{ShardId: "3"}}, false)
+
+	records := r.list()
+	if len(records) != 2 {
+		t.Errorf("expect 2 records, actual %d", len(records))
+		t.SkipNow()
+	}
+	if records[0].ShardId != "3" || records[0].Succ {
+		t.Errorf("unexpected latest record %+v", records[0])
+	}
+	if records[1].ShardId != "2" || !records[1].Succ {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+
+	// operator在单测中没有recorder
+	var nilRecorder *moveRecorder
+	nilRecorder.record(moveActionList{{ShardId: "1"}}, true)
+	if nilRecorder.list() != nil {
+		t.Errorf("expect nil")
+	}
+}
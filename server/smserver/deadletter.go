@@ -0,0 +1,214 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// deadLetter 重试后仍然失败的move，等待人工确认后通过api重新入队
+type deadLetter struct {
+	Action *moveAction `json:"action"`
+
+	// Error 最后一次失败的原因
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+
+	// FailTime unix秒
+	FailTime int64 `json:"failTime"`
+}
+
+func (l *deadLetter) String() string {
+	b, _ := json.Marshal(l)
+	return string(b)
+}
+
+// deadLetterQueue 每个shard在etcd中保留最近一次失败的move
+type deadLetterQueue struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	nodeManager *nodeManager
+}
+
+func newDeadLetterQueue(lg *zap.Logger, client etcdutil.EtcdWrapper, nodeManager *nodeManager) *deadLetterQueue {
+	return &deadLetterQueue{lg: lg, client: client, nodeManager: nodeManager}
+}
+
+// add 写入失败只打印日志，下一轮rebalance仍然会修正shard的分配
+func (q *deadLetterQueue) add(ma *moveAction, attempts int, err error) {
+	if q == nil {
+		return
+	}
+	letter := deadLetter{Action: ma, Error: err.Error(), Attempts: attempts, FailTime: time.Now().Unix()}
+	key := q.nodeManager.nodeServiceDeadLetter(ma.Service) + ma.ShardId
+	if _, err := q.client.Put(context.TODO(), key, letter.String()); err != nil {
+		q.lg.Error(
+			"add dead letter error",
+			zap.String("key", key),
+			zap.Reflect("letter", letter),
+			zap.Error(err),
+		)
+	}
+}
+
+// list 按照shard id顺序返回
+func (q *deadLetterQueue) list(ctx context.Context, service string) ([]*deadLetter, error) {
+	pfx := q.nodeManager.nodeServiceDeadLetter(service)
+	resp, err := q.client.GetKV(ctx, pfx, []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var letters []*deadLetter
+	for _, kv := range resp.Kvs {
+		var letter deadLetter
+		if err := json.Unmarshal(kv.Value, &letter); err != nil {
+			q.lg.Warn(
+				"unexpected dead letter",
+				zap.String("key", string(kv.Key)),
+				zap.Error(err),
+			)
+			continue
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, nil
+}
+
+func (q *deadLetterQueue) remove(ctx context.Context, service string, shardId string) error {
+	_, err := q.client.Delete(ctx, q.nodeManager.nodeServiceDeadLetter(service)+shardId)
+	return errors.Wrap(err, "")
+}
+
+// @Description list moves which still failed after retry
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200
+// @Router /sm/server/dead-letters [get]
+func (ss *smShardApi) GinDeadLetters(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	letters, err := ss.container.deadLetters.list(context.TODO(), service)
+	if err != nil {
+		ss.lg.Error(
+			"list dead letters error",
+			zap.String("service", service),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deadLetters": letters})
+}
+
+type requeueRequest struct {
+	Service string `json:"service" binding:"required"`
+
+	// ShardIds 为空时重新入队service所有的dead letter
+	ShardIds []string `json:"shardIds"`
+}
+
+// @Description requeue dead letters to the move queue of the service
+// @Tags  shard
+// @Accept  json
+// @Produce  json
+// @Param param body requeueRequest true "param"
+// @success 200
+// @Router /sm/server/requeue-dead-letters [post]
+func (ss *smShardApi) GinRequeueDeadLetters(c *gin.Context) {
+	var req requeueRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	// move在负责service的sm container上执行
+	shard, err := ss.container.GetShard(req.Service)
+	if err != nil {
+		ss.lg.Error(
+			"shard not found",
+			zap.String("service", req.Service),
+		)
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", req.Service))
+		return
+	}
+	// 冻结期间不下发任何move，解冻后再重新入队
+	if shard.Frozen() {
+		apiErrorResponse(c, errCodeConflict, errors.Errorf("service[%s] frozen", req.Service))
+		return
+	}
+
+	letters, err := ss.container.deadLetters.list(context.TODO(), req.Service)
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	wanted := make(map[string]struct{})
+	for _, shardId := range req.ShardIds {
+		wanted[shardId] = struct{}{}
+	}
+	var (
+		mals     moveActionList
+		shardIds []string
+	)
+	for _, letter := range letters {
+		if _, ok := wanted[letter.Action.ShardId]; len(wanted) > 0 && !ok {
+			continue
+		}
+		// 不再属于原来的rebalance轮次
+		letter.Action.RoundId = ""
+		mals = append(mals, letter.Action)
+		shardIds = append(shardIds, letter.Action.ShardId)
+	}
+	if len(mals) == 0 {
+		c.JSON(http.StatusOK, gin.H{"requeued": shardIds})
+		return
+	}
+
+	// 先删除再入队，再次失败时operator会重新写入
+	for _, shardId := range shardIds {
+		if err := ss.container.deadLetters.remove(context.TODO(), req.Service, shardId); err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+	}
+	shard.Requeue(mals)
+	ss.container.events.append(eventMove, req.Service, c.ClientIP(), "requeue dead letters "+mals.String())
+	ss.lg.Info(
+		"requeue dead letters success",
+		zap.String("service", req.Service),
+		zap.Strings("shardIds", shardIds),
+	)
+	c.JSON(http.StatusOK, gin.H{"requeued": shardIds})
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+)
+
+// debugVars 在expvar的基础上增加sm内部的状态，排查长时间运行后的内存和goroutine增长
+type debugVars struct {
+	Goroutines int `json:"goroutines"`
+	// StopperGoroutines 通过 apputil.GoroutineStopper 启动且没有退出的goroutine
+	StopperGoroutines int64 `json:"stopperGoroutines"`
+	// WebhookQueue 等待投递的webhook事件
+	WebhookQueue int64 `json:"webhookQueue"`
+	// Etcd etcd client的重试计数
+	Etcd *etcdutil.EtcdClientStats `json:"etcd,omitempty"`
+	// Loops container和service的stopper中正在运行的goroutine，按照启动时间排序，排查泄漏的循环
+	Loops []apputil.GoroutineInfo `json:"loops,omitempty"`
+
+	// Services 当前container负责的service
+	Services map[string]*serviceDebugVars `json:"services"`
+}
+
+type serviceDebugVars struct {
+	// QueueDepth 等待执行的move任务
+	QueueDepth int64 `json:"queueDepth"`
+	// QueueClasses 按照优先级统计等待执行的move任务
+	QueueClasses map[string]int `json:"queueClasses,omitempty"`
+	// Goroutines smShard的stopper管理的goroutine
+	Goroutines      int64 `json:"goroutines"`
+	AliveContainers int   `json:"aliveContainers"`
+	AliveShards     int   `json:"aliveShards"`
+
+	// Panics、Errors和Restarts service的后台goroutine的异常计数，从成为governor开始累计
+	Panics   int64 `json:"panics"`
+	Errors   int64 `json:"errors"`
+	Restarts int64 `json:"restarts"`
+
+	// Drifts reconciler发现的实际分配和期望不一致的次数
+	Drifts int64 `json:"drifts"`
+
+	// Moves 按照原因统计的move次数
+	Moves map[moveReason]*moveReasonCount `json:"moves,omitempty"`
+}
+
+func (c *smContainer) debugVars() *debugVars {
+	r := debugVars{
+		Goroutines:        runtime.NumGoroutine(),
+		StopperGoroutines: apputil.StopperGoroutines(),
+		WebhookQueue:      c.webhooks.queueDepth(),
+		Services:          make(map[string]*serviceDebugVars),
+		Loops:             c.stopper.Goroutines(),
+	}
+	if c.Container != nil {
+		if client, ok := etcdutil.UnwrapEtcdClient(c.Client); ok {
+			stats := client.Stats()
+			r.Etcd = &stats
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for service, shard := range c.shards {
+		ss, ok := shard.(*smShard)
+		if !ok {
+			continue
+		}
+		v := serviceDebugVars{
+			QueueDepth: ss.QueueDepth(),
+			Goroutines: ss.stopper.Running(),
+			Panics:     atomic.LoadInt64(&ss.stats.panics),
+			Errors:     atomic.LoadInt64(&ss.stats.errors),
+			Restarts:   atomic.LoadInt64(&ss.stats.restarts),
+			Drifts:     atomic.LoadInt64(&ss.stats.drifts),
+		}
+		if ss.operator != nil {
+			v.Moves = ss.operator.reasons.snapshot()
+		}
+		if ss.queue != nil {
+			v.QueueClasses = ss.queue.depths()
+		}
+		if ss.mpr != nil {
+			v.AliveContainers = len(ss.mpr.AliveContainers())
+			v.AliveShards = len(ss.mpr.AliveShards())
+		}
+		r.Services[service] = &v
+	}
+	return &r
+}
+
+// debugHandlers 开启debug时挂载pprof和expvar
+func debugHandlers(container *smContainer) map[string]gin.HandlerFunc {
+	return map[string]gin.HandlerFunc{
+		"/debug/pprof/*name": ginPprof,
+		"/debug/vars":        ginDebugVars(container),
+	}
+}
+
+// ginPprof gin不能直接挂载DefaultServeMux中的pprof，按照名称分发到net/http/pprof的handler
+func ginPprof(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("name"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// Index 按照 /debug/pprof/ 之后的名称输出heap、goroutine等profile
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// ginDebugVars 输出格式和 expvar.Handler 一致，sm内部状态在 sm 字段中
+func ginDebugVars(container *smContainer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		vars := make(map[string]string)
+		var keys []string
+		expvar.Do(func(kv expvar.KeyValue) {
+			vars[kv.Key] = kv.Value.String()
+			keys = append(keys, kv.Key)
+		})
+		b, _ := json.Marshal(container.debugVars())
+		vars["sm"] = string(b)
+		keys = append(keys, "sm")
+		sort.Strings(keys)
+
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(c.Writer, "{\n")
+		for i, key := range keys {
+			if i > 0 {
+				fmt.Fprintf(c.Writer, ",\n")
+			}
+			fmt.Fprintf(c.Writer, "%q: %s", key, vars[key])
+		}
+		fmt.Fprintf(c.Writer, "\n}\n")
+	}
+}
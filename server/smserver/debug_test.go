@@ -0,0 +1,40 @@
+package smserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_debugHandlers(t *testing.T) {
+	container := &smContainer{lg: ttLogger, shards: make(map[string]Shard)}
+	container.shards["foo.bar"] = &smShard{service: "foo.bar", stopper: &apputil.GoroutineStopper{}, queued: 2}
+
+	router := gin.New()
+	for path, handler := range debugHandlers(container) {
+		router.GET(path, handler)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var vars struct {
+		Memstats json.RawMessage `json:"memstats"`
+		SM       debugVars       `json:"sm"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &vars))
+	assert.NotEmpty(t, vars.Memstats)
+	assert.True(t, vars.SM.Goroutines > 0)
+	assert.Equal(t, int64(2), vars.SM.Services["foo.bar"].QueueDepth)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "goroutine"))
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"go.uber.org/zap"
+)
+
+const (
+	// deploymentPolicySpread 同一个shard的副本分散到不同deployment，一个deployment发布失败不会影响shard的所有副本
+	deploymentPolicySpread = "spread"
+	// deploymentPolicyNewest shard集中到最新的deployment，blue/green发布时新deployment就绪后接管所有shard
+	deploymentPolicyNewest = "newest"
+)
+
+type containerDeployment struct {
+	deployment string
+	// startTime 进程启动的unix秒，没有上报时为0
+	startTime int64
+}
+
+// newestDeployment 以deployment中最早启动的container作为deployment的启动时间，返回最晚启动的deployment，
+// 只有一个deployment时返回空，不需要区分
+func newestDeployment(containers map[string]*containerDeployment) string {
+	started := make(map[string]int64)
+	for _, cd := range containers {
+		if t, ok := started[cd.deployment]; !ok || cd.startTime < t {
+			started[cd.deployment] = cd.startTime
+		}
+	}
+	if len(started) <= 1 {
+		return ""
+	}
+	var (
+		newest string
+		latest int64 = -1
+	)
+	for deployment, t := range started {
+		// 启动时间相同时按照名称选择，保证多次计算结果一致
+		if t > latest || (t == latest && deployment > newest) {
+			newest, latest = deployment, t
+		}
+	}
+	return newest
+}
+
+// applyDeploymentPolicy alive是参与分配的container到zone的映射：
+// spread时把zone替换为deployment，副本分散复用zone的逻辑；
+// newest时旧deployment的container按照draining处理，上面的shard迁移到最新的deployment
+func (ss *smShard) applyDeploymentPolicy(alive ArmorMap, draining map[string]struct{}) {
+	spec := ss.spec()
+	if spec == nil || spec.DeploymentPolicy == "" || ss.mpr == nil {
+		return
+	}
+	deployments := ss.mpr.ContainerDeployments()
+
+	switch spec.DeploymentPolicy {
+	case deploymentPolicySpread:
+		for id := range alive {
+			if cd, ok := deployments[id]; ok {
+				alive[id] = cd.deployment
+			} else {
+				alive[id] = ""
+			}
+		}
+	case deploymentPolicyNewest:
+		candidates := make(map[string]*containerDeployment)
+		for id := range alive {
+			if cd, ok := deployments[id]; ok {
+				candidates[id] = cd
+			}
+		}
+		newest := newestDeployment(candidates)
+		if newest == "" {
+			return
+		}
+		for id, cd := range candidates {
+			if cd.deployment == newest {
+				continue
+			}
+			ss.lg.Info(
+				"container of old deployment excluded",
+				zap.String("service", ss.service),
+				zap.String("containerId", id),
+				zap.String("deployment", cd.deployment),
+				zap.String("newest", newest),
+			)
+			delete(alive, id)
+			draining[id] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package smserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+)
+
+func Test_newestDeployment(t *testing.T) {
+	var tests = []struct {
+		containers map[string]*containerDeployment
+		expect     string
+	}{
+		// 只有一个deployment
+		{
+			containers: map[string]*containerDeployment{"c1": {deployment: "blue", startTime: 1}, "c2": {deployment: "blue", startTime: 5}},
+			expect:     "",
+		},
+		// 以deployment中最早启动的container为准，blue中c3重启不影响
+		{
+			containers: map[string]*containerDeployment{
+				"c1": {deployment: "blue", startTime: 1},
+				"c2": {deployment: "green", startTime: 3},
+				"c3": {deployment: "blue", startTime: 5},
+			},
+			expect: "green",
+		},
+		// 没有上报deployment的container作为单独的deployment
+		{
+			containers: map[string]*containerDeployment{"c1": {startTime: 1}, "c2": {deployment: "v2", startTime: 2}},
+			expect:     "v2",
+		},
+	}
+	for idx, tt := range tests {
+		if r := newestDeployment(tt.containers); r != tt.expect {
+			t.Errorf("idx: %d expect %s actual %s", idx, tt.expect, r)
+		}
+	}
+}
+
+func Test_smShard_applyDeploymentPolicy(t *testing.T) {
+	service := "foo.bar"
+	mpr := &mapper{lg: ttLogger, appSpec: &smAppSpec{Service: service}}
+	mpr.containerState = newMapperState(mpr, containerTrigger)
+	for id, cd := range map[string]*containerDeployment{"c1": {"blue", 1}, "c2": {"blue", 2}, "c3": {"green", 3}} {
+		hb := apputil.ContainerHeartbeat{Zone: "z1", Deployment: cd.deployment, Process: &apputil.ProcessStats{StartTime: cd.startTime}}
+		b, _ := json.Marshal(hb)
+		if err := mpr.containerState.Create(id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// spread时zone替换为deployment
+	ss := smShard{service: service, lg: ttLogger, mpr: mpr, appSpec: &smAppSpec{DeploymentPolicy: deploymentPolicySpread}}
+	alive := ArmorMap{"c1": "z1", "c2": "z1", "c3": "z1"}
+	draining := make(map[string]struct{})
+	ss.applyDeploymentPolicy(alive, draining)
+	if !reflect.DeepEqual(alive, ArmorMap{"c1": "blue", "c2": "blue", "c3": "green"}) || len(draining) != 0 {
+		t.Errorf("unexpected alive %v draining %v", alive, draining)
+	}
+
+	// newest时旧deployment的container按照draining处理
+	ss.appSpec.DeploymentPolicy = deploymentPolicyNewest
+	alive = ArmorMap{"c1": "z1", "c2": "z1", "c3": "z1"}
+	ss.applyDeploymentPolicy(alive, draining)
+	if !reflect.DeepEqual(alive, ArmorMap{"c3": "z1"}) || !reflect.DeepEqual(draining, map[string]struct{}{"c1": {}, "c2": {}}) {
+		t.Errorf("unexpected alive %v draining %v", alive, draining)
+	}
+
+	// 最新的deployment不可用时（例如探测不健康），不移动shard
+	alive = ArmorMap{"c1": "z1", "c2": "z1"}
+	draining = make(map[string]struct{})
+	ss.applyDeploymentPolicy(alive, draining)
+	if len(alive) != 2 || len(draining) != 0 {
+		t.Errorf("unexpected alive %v draining %v", alive, draining)
+	}
+}
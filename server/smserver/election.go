@@ -0,0 +1,110 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/entertainment-venue/sm/pkg/coordination"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// electionSession leader竞选使用独立于container heartbeat的session，竞选的lease短暂卡顿过期时只重新竞选，
+// 不影响heartbeat和sm持有的service的lock，heartbeat的session恢复也不会让leader失去身份
+type electionSession struct {
+	lg      *zap.Logger
+	backend coordination.Backend
+
+	// ttl 单位秒，决定leader异常后的failover时间
+	ttl int
+
+	mu      sync.Mutex
+	session coordination.Session
+}
+
+func newElectionSession(lg *zap.Logger, backend coordination.Backend, ttl int) *electionSession {
+	if ttl <= 0 {
+		ttl = defaultLeaderLeaseTTL
+	}
+	return &electionSession{lg: lg, backend: backend, ttl: ttl}
+}
+
+// get 返回没有过期的session，过期或者没有创建时创建新的session，keepalive跟随ctx
+func (e *electionSession) get(ctx context.Context) (coordination.Session, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+			e.lg.Warn("election session expired", zap.String("session", e.session.Id()))
+		default:
+			return e.session, nil
+		}
+	}
+	s, err := e.backend.NewSession(ctx, e.ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	e.session = s
+	e.lg.Info("election session opened", zap.String("session", s.Id()), zap.Int("ttl", e.ttl))
+	return s, nil
+}
+
+// current 没有参与竞选时返回nil
+func (e *electionSession) current() coordination.Session {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.session
+}
+
+// Close revoke lease，leader节点立即删除，其他container不需要等待ttl过期
+func (e *electionSession) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session == nil {
+		return
+	}
+	if err := e.session.Close(); err != nil {
+		e.lg.Warn("election session close error", zap.String("session", e.session.Id()), zap.Error(err))
+	}
+}
+
+// leaseHealth session失效为fail，剩余ttl不足一半说明续约卡顿，为warn
+func leaseHealth(ctx context.Context, name string, s coordination.Session) (string, string) {
+	select {
+	case <-s.Done():
+		return selfCheckFail, fmt.Sprintf("%s session %s expired", name, s.Id())
+	default:
+	}
+	ls, ok := s.(coordination.LeaseSession)
+	if !ok {
+		return selfCheckOk, fmt.Sprintf("%s session %s", name, s.Id())
+	}
+	remaining, granted, err := ls.TTL(ctx)
+	if err != nil {
+		return selfCheckWarn, fmt.Sprintf("%s session %s ttl error: %s", name, s.Id(), err.Error())
+	}
+	detail := fmt.Sprintf("%s session %s ttl %d/%ds", name, s.Id(), remaining, granted)
+	switch {
+	case remaining <= 0:
+		return selfCheckFail, detail
+	case remaining*2 < granted:
+		return selfCheckWarn, detail
+	}
+	return selfCheckOk, detail
+}
@@ -0,0 +1,87 @@
+package smserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/coordination"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type fakeLeaseSession struct {
+	id        string
+	donec     chan struct{}
+	remaining int64
+	granted   int64
+	err       error
+}
+
+func newFakeLeaseSession(id string, remaining, granted int64) *fakeLeaseSession {
+	return &fakeLeaseSession{id: id, donec: make(chan struct{}), remaining: remaining, granted: granted}
+}
+
+func (s *fakeLeaseSession) Id() string            { return s.id }
+func (s *fakeLeaseSession) Done() <-chan struct{} { return s.donec }
+func (s *fakeLeaseSession) Close() error          { return nil }
+func (s *fakeLeaseSession) TTL(_ context.Context) (int64, int64, error) {
+	return s.remaining, s.granted, s.err
+}
+
+// fakeElectionBackend 只实现NewSession
+type fakeElectionBackend struct {
+	coordination.Backend
+
+	sessions []*fakeLeaseSession
+}
+
+func (b *fakeElectionBackend) NewSession(_ context.Context, ttl int) (coordination.Session, error) {
+	s := newFakeLeaseSession(string(rune('a'+len(b.sessions))), int64(ttl), int64(ttl))
+	b.sessions = append(b.sessions, s)
+	return s, nil
+}
+
+func Test_leaseHealth(t *testing.T) {
+	ctx := context.TODO()
+
+	status, detail := leaseHealth(ctx, "election", newFakeLeaseSession("1", 4, 5))
+	assert.Equal(t, selfCheckOk, status)
+	assert.Equal(t, "election session 1 ttl 4/5s", detail)
+
+	// 续约卡顿
+	status, _ = leaseHealth(ctx, "election", newFakeLeaseSession("1", 2, 5))
+	assert.Equal(t, selfCheckWarn, status)
+
+	s := newFakeLeaseSession("1", 0, 5)
+	status, _ = leaseHealth(ctx, "election", s)
+	assert.Equal(t, selfCheckFail, status)
+
+	s.err = errors.New("timeout")
+	status, _ = leaseHealth(ctx, "election", s)
+	assert.Equal(t, selfCheckWarn, status)
+
+	close(s.donec)
+	status, detail = leaseHealth(ctx, "heartbeat", s)
+	assert.Equal(t, selfCheckFail, status)
+	assert.Equal(t, "heartbeat session 1 expired", detail)
+}
+
+func Test_electionSession_get(t *testing.T) {
+	backend := fakeElectionBackend{}
+	e := newElectionSession(zap.NewNop(), &backend, 0)
+	assert.Nil(t, e.current())
+
+	s1, err := e.get(context.TODO())
+	assert.Nil(t, err)
+	s2, _ := e.get(context.TODO())
+	assert.Equal(t, s1, s2)
+	assert.Equal(t, 1, len(backend.sessions))
+	assert.Equal(t, int64(defaultLeaderLeaseTTL), backend.sessions[0].granted)
+
+	// 过期后重新创建
+	close(backend.sessions[0].donec)
+	s3, _ := e.get(context.TODO())
+	assert.NotEqual(t, s1.Id(), s3.Id())
+	assert.Equal(t, s3, e.current())
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEmbeddedEtcdClientURL = "http://127.0.0.1:2379"
+	defaultEmbeddedEtcdPeerURL   = "http://127.0.0.1:2380"
+
+	// embeddedEtcdStartTimeout 等待内置etcd可以提供服务的最长时间，目录中数据较多时启动需要回放wal
+	embeddedEtcdStartTimeout = time.Minute
+)
+
+// embeddedEtcd 进程内的单节点etcd，去掉简单场景下对外部etcd集群的依赖
+type embeddedEtcd struct {
+	lg   *zap.Logger
+	etcd *embed.Etcd
+}
+
+func startEmbeddedEtcd(lg *zap.Logger, name string, dir string, clientURL string, peerURL string) (*embeddedEtcd, error) {
+	if clientURL == "" {
+		clientURL = defaultEmbeddedEtcdClientURL
+	}
+	if peerURL == "" {
+		peerURL = defaultEmbeddedEtcdPeerURL
+	}
+	curl, err := url.Parse(clientURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "clientURL")
+	}
+	purl, err := url.Parse(peerURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "peerURL")
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	if name != "" {
+		cfg.Name = name
+	}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*curl}, []url.URL{*curl}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*purl}, []url.URL{*purl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	cfg.ZapLoggerBuilder = embed.NewZapLoggerBuilder(lg.Named("etcd"))
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case err := <-e.Err():
+		e.Close()
+		return nil, errors.Wrap(err, "")
+	case <-time.After(embeddedEtcdStartTimeout):
+		e.Server.Stop()
+		e.Close()
+		return nil, errors.New("embedded etcd start timeout")
+	}
+	lg.Info(
+		"embedded etcd started",
+		zap.String("dir", dir),
+		zap.String("clientURL", clientURL),
+		zap.String("peerURL", peerURL),
+	)
+	return &embeddedEtcd{lg: lg, etcd: e}, nil
+}
+
+// endpoints sm和同一个etcd上的container使用的地址
+func (e *embeddedEtcd) endpoints() []string {
+	var r []string
+	for _, u := range e.etcd.Config().ACUrls {
+		r = append(r, u.String())
+	}
+	return r
+}
+
+func (e *embeddedEtcd) close() {
+	e.etcd.Close()
+	e.lg.Info("embedded etcd closed")
+}
+
+func (s *Server) closeEtcd() {
+	if s.etcd != nil {
+		s.etcd.close()
+	}
+}
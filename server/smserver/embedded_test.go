@@ -0,0 +1,50 @@
+package smserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func Test_startEmbeddedEtcd(t *testing.T) {
+	dir := t.TempDir()
+	clientURL := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+	peerURL := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+
+	e, err := startEmbeddedEtcd(ttLogger, "foo", dir, clientURL, peerURL)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{clientURL}, e.endpoints())
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: e.endpoints(), DialTimeout: 3 * time.Second})
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = client.Put(ctx, "/sm/foo", "bar")
+	assert.Nil(t, err)
+	client.Close()
+	e.close()
+
+	// 数据保存在目录中，重启后仍然存在
+	e, err = startEmbeddedEtcd(ttLogger, "foo", dir, clientURL, peerURL)
+	assert.Nil(t, err)
+	defer e.close()
+	client, err = clientv3.New(clientv3.Config{Endpoints: e.endpoints(), DialTimeout: 3 * time.Second})
+	assert.Nil(t, err)
+	defer client.Close()
+	resp, err := client.Get(ctx, "/sm/foo")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), resp.Count)
+	assert.Equal(t, "bar", string(resp.Kvs[0].Value))
+}
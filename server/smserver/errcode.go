@@ -0,0 +1,101 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// errCode 接口错误的机器可读标识，sdk根据code做分支判断，不依赖error的文案
+type errCode string
+
+const (
+	errCodeParam             errCode = "PARAM_ERROR"
+	errCodeReservedService   errCode = "RESERVED_SERVICE"
+	errCodeUnauthenticated   errCode = "UNAUTHENTICATED"
+	errCodeForbidden         errCode = "FORBIDDEN"
+	errCodeServiceNotFound   errCode = "SERVICE_NOT_FOUND"
+	errCodeShardNotFound     errCode = "SHARD_NOT_FOUND"
+	errCodeRoundNotFound     errCode = "REBALANCE_ROUND_NOT_FOUND"
+	errCodeServiceExists     errCode = "SERVICE_EXISTS"
+	errCodeShardExists       errCode = "SHARD_EXISTS"
+	errCodeInvalidTask       errCode = "INVALID_TASK"
+	errCodeConflict          errCode = "CONFLICT"
+	errCodeLeaderUnavailable errCode = "LEADER_UNAVAILABLE"
+	errCodeNotLeader         errCode = "NOT_LEADER"
+	errCodeRateLimited       errCode = "RATE_LIMITED"
+	errCodeQuotaExceeded     errCode = "QUOTA_EXCEEDED"
+	errCodeReadOnly          errCode = "READ_ONLY"
+	errCodeServiceHasShards  errCode = "SERVICE_HAS_SHARDS"
+	errCodeInternal          errCode = "INTERNAL_ERROR"
+)
+
+var errCodeStatus = map[errCode]int{
+	errCodeParam:             http.StatusBadRequest,
+	errCodeReservedService:   http.StatusBadRequest,
+	errCodeUnauthenticated:   http.StatusUnauthorized,
+	errCodeForbidden:         http.StatusForbidden,
+	errCodeServiceNotFound:   http.StatusNotFound,
+	errCodeShardNotFound:     http.StatusNotFound,
+	errCodeRoundNotFound:     http.StatusNotFound,
+	errCodeServiceExists:     http.StatusConflict,
+	errCodeShardExists:       http.StatusConflict,
+	errCodeInvalidTask:       http.StatusBadRequest,
+	errCodeConflict:          http.StatusConflict,
+	errCodeLeaderUnavailable: http.StatusServiceUnavailable,
+	errCodeNotLeader:         http.StatusConflict,
+	errCodeRateLimited:       http.StatusTooManyRequests,
+	errCodeQuotaExceeded:     http.StatusForbidden,
+	errCodeReadOnly:          http.StatusMethodNotAllowed,
+	errCodeServiceHasShards:  http.StatusConflict,
+	errCodeInternal:          http.StatusInternalServerError,
+}
+
+func (code errCode) status() int {
+	if status, ok := errCodeStatus[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// apiError 所有接口统一的错误返回格式，error保留原有的文案，兼容只看error的调用方
+type apiError struct {
+	Code  errCode `json:"code"`
+	Error string  `json:"error"`
+}
+
+// apiErrorResponse 按照code设置http状态码并终止后续的handler
+func apiErrorResponse(c *gin.Context, code errCode, err error) {
+	c.AbortWithStatusJSON(code.status(), apiError{Code: code, Error: err.Error()})
+}
+
+// etcdErrCode etcd操作的错误，exist是节点已存在时对应的code，不同接口的含义不同
+func etcdErrCode(err error, exist errCode) errCode {
+	switch errors.Cause(err) {
+	case etcdutil.ErrEtcdNodeExist:
+		return exist
+	case etcdutil.ErrEtcdValueExist, etcdutil.ErrEtcdValueNotMatch, etcdutil.ErrEtcdRevisionNotMatch:
+		return errCodeConflict
+	case rpctypes.ErrNoLeader, rpctypes.ErrLeaderChanged, rpctypes.ErrTimeout, rpctypes.ErrTimeoutDueToLeaderFail, context.DeadlineExceeded:
+		return errCodeLeaderUnavailable
+	}
+	return errCodeInternal
+}
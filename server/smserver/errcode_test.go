@@ -0,0 +1,47 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+func Test_etcdErrCode(t *testing.T) {
+	var tests = []struct {
+		err    error
+		exist  errCode
+		expect errCode
+		status int
+	}{
+		{err: errors.Wrap(etcdutil.ErrEtcdNodeExist, ""), exist: errCodeShardExists, expect: errCodeShardExists, status: http.StatusConflict},
+		{err: etcdutil.ErrEtcdValueNotMatch, exist: errCodeInternal, expect: errCodeConflict, status: http.StatusConflict},
+		{err: errors.Wrap(rpctypes.ErrNoLeader, ""), exist: errCodeInternal, expect: errCodeLeaderUnavailable, status: http.StatusServiceUnavailable},
+		{err: errors.New("unknown"), exist: errCodeInternal, expect: errCodeInternal, status: http.StatusInternalServerError},
+	}
+	for idx, tt := range tests {
+		code := etcdErrCode(tt.err, tt.exist)
+		if code != tt.expect {
+			t.Errorf("idx %d expect %s actual %s", idx, tt.expect, code)
+		}
+		if code.status() != tt.status {
+			t.Errorf("idx %d expect status %d actual %d", idx, tt.status, code.status())
+		}
+	}
+}
@@ -23,11 +23,14 @@ import (
 // nodeManager 管理sm的etcd prefix
 type nodeManager struct {
 	smService string
+
+	// etcdPath 每个sm实例独立的prefix，同一个进程中可以运行多个sm
+	etcdPath *apputil.EtcdPath
 }
 
 // /sm/app/foo.bar
 func (n *nodeManager) nodeSM() string {
-	return apputil.EtcdPathAppPrefix(n.smService)
+	return n.etcdPath.AppPrefix(n.smService)
 }
 
 // /sm/app/foo.bar/leader
@@ -35,6 +38,21 @@ func (n *nodeManager) nodeSMLeader() string {
 	return fmt.Sprintf("%s/leader", n.nodeSM())
 }
 
+// /sm/app/foo.bar/term 不能以leader开头，leader是按照前缀查询的
+func (n *nodeManager) nodeSMTerm() string {
+	return fmt.Sprintf("%s/term", n.nodeSM())
+}
+
+// /sm/app/foo.bar/pause 全局暂停调度，所有governor共享
+func (n *nodeManager) nodeSMPause() string {
+	return fmt.Sprintf("%s/pause", n.nodeSM())
+}
+
+// /sm/app/foo.bar/service/proxy.dev/ service的所有节点
+func (n *nodeManager) nodeService(appService string) string {
+	return fmt.Sprintf("%s/service/%s/", n.nodeSM(), appService)
+}
+
 // /sm/app/foo.bar/service/proxy.dev/spec
 func (n *nodeManager) nodeServiceSpec(appService string) string {
 	return fmt.Sprintf("%s/service/%s/spec", n.nodeSM(), appService)
@@ -45,12 +63,77 @@ func (n *nodeManager) nodeServiceShard(appService, shardId string) string {
 	return fmt.Sprintf("%s/service/%s/shard/%s", n.nodeSM(), appService, shardId)
 }
 
+// /sm/app/foo.bar/service/proxy.dev/maintenance
+func (n *nodeManager) nodeServiceMaintenance(appService string) string {
+	return fmt.Sprintf("%s/service/%s/maintenance", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/rebalance
+func (n *nodeManager) nodeServiceRebalance(appService string) string {
+	return fmt.Sprintf("%s/service/%s/rebalance", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/deadletter/
+func (n *nodeManager) nodeServiceDeadLetter(appService string) string {
+	return fmt.Sprintf("%s/service/%s/deadletter/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/task/
+func (n *nodeManager) nodeServiceTask(appService string) string {
+	return fmt.Sprintf("%s/service/%s/task/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/shardstate/
+func (n *nodeManager) nodeServiceShardState(appService string) string {
+	return fmt.Sprintf("%s/service/%s/shardstate/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/history/
+func (n *nodeManager) nodeServiceShardHistory(appService string) string {
+	return fmt.Sprintf("%s/service/%s/history/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/cordon/
+func (n *nodeManager) nodeServiceCordon(appService string) string {
+	return fmt.Sprintf("%s/service/%s/cordon/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/webhook/
+func (n *nodeManager) nodeServiceWebhook(appService string) string {
+	return fmt.Sprintf("%s/service/%s/webhook/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/service/proxy.dev/webhookstatus/
+func (n *nodeManager) nodeServiceWebhookStatus(appService string) string {
+	return fmt.Sprintf("%s/service/%s/webhookstatus/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/event/proxy.dev/
+func (n *nodeManager) nodeServiceEvent(appService string) string {
+	return fmt.Sprintf("%s/event/%s/", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/federation/proxy.dev/spec
+func (n *nodeManager) nodeFederationService(appService string) string {
+	return fmt.Sprintf("%s/federation/%s/spec", n.nodeSM(), appService)
+}
+
+// /sm/app/foo.bar/federation/proxy.dev/shard/s1
+func (n *nodeManager) nodeFederationShard(appService, shardId string) string {
+	return fmt.Sprintf("%s/federation/%s/shard/%s", n.nodeSM(), appService, shardId)
+}
+
 // /sm/app/proxy.dev/shardhb/
 func (n *nodeManager) nodeServiceShardHb(appService string) string {
-	return fmt.Sprintf("%s/shardhb/", apputil.EtcdPathAppPrefix(appService))
+	return fmt.Sprintf("%s/shardhb/", n.etcdPath.AppPrefix(appService))
 }
 
 // /sm/app/proxy.dev/containerhb/
 func (n *nodeManager) nodeServiceContainerHb(appService string) string {
-	return fmt.Sprintf("%s/containerhb/", apputil.EtcdPathAppPrefix(appService))
+	return fmt.Sprintf("%s/containerhb/", n.etcdPath.AppPrefix(appService))
+}
+
+// /sm/app/proxy.dev/config
+func (n *nodeManager) nodeServiceConfig(appService string) string {
+	return n.etcdPath.AppConfig(appService)
 }
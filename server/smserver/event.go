@@ -0,0 +1,188 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+type eventType string
+
+const (
+	eventMove          eventType = "move"
+	eventLeaderChange  eventType = "leaderChange"
+	eventSpecChange    eventType = "specChange"
+	eventContainerLost eventType = "containerLost"
+	eventMaintenance   eventType = "maintenance"
+	eventCordon        eventType = "cordon"
+	eventPause         eventType = "pause"
+	eventApiCall       eventType = "apiCall"
+
+	// defaultEventLimit 单次查询返回的最大事件数量
+	defaultEventLimit = 1000
+)
+
+// smEvent 审计日志中的一条记录
+type smEvent struct {
+	Type    eventType `json:"type"`
+	Service string    `json:"service"`
+
+	// Actor 触发事件的主体，api请求记录来源ip，sm内部记录container id
+	Actor  string `json:"actor"`
+	Detail string `json:"detail"`
+
+	// Timestamp 纳秒，和etcd中的key保持一致
+	Timestamp int64 `json:"timestamp"`
+}
+
+func (e *smEvent) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// eventLog 只追加的事件日志，存储在etcd中，按照service和时间组织key，方便按时间范围查询
+type eventLog struct {
+	lg *zap.Logger
+	c  *smContainer
+}
+
+func newEventLog(lg *zap.Logger, c *smContainer) *eventLog {
+	return &eventLog{lg: lg, c: c}
+}
+
+// append 写入失败只打印日志，审计不能影响sm的主流程，actor为空时是sm内部产生的事件
+func (l *eventLog) append(typ eventType, service string, actor string, detail string) {
+	if l == nil {
+		return
+	}
+	if actor == "" {
+		actor = l.c.Id()
+	}
+	ev := smEvent{
+		Type:      typ,
+		Service:   service,
+		Actor:     actor,
+		Detail:    detail,
+		Timestamp: time.Now().UnixNano(),
+	}
+	key := l.c.nodeManager.nodeServiceEvent(service) + eventKey(ev.Timestamp)
+	if _, err := l.c.Client.Put(context.TODO(), key, ev.String()); err != nil {
+		l.lg.Error(
+			"append event error",
+			zap.String("key", key),
+			zap.Reflect("event", ev),
+			zap.Error(err),
+		)
+	}
+}
+
+// list 返回since（纳秒）之后的事件，按时间正序
+func (l *eventLog) list(ctx context.Context, service string, since int64, limit int64) ([]*smEvent, error) {
+	if l == nil {
+		return nil, nil
+	}
+	pfx := l.c.nodeManager.nodeServiceEvent(service)
+	resp, err := l.c.Client.Get(
+		ctx,
+		pfx+eventKey(since),
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(pfx)),
+		clientv3.WithLimit(limit),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var events []*smEvent
+	for _, kv := range resp.Kvs {
+		var ev smEvent
+		if err := json.Unmarshal(kv.Value, &ev); err != nil {
+			l.lg.Warn(
+				"unexpected event",
+				zap.String("key", string(kv.Key)),
+				zap.Error(err),
+			)
+			continue
+		}
+		events = append(events, &ev)
+	}
+	return events, nil
+}
+
+// eventKey 补齐位数，保证etcd中key的字典序和时间序一致
+func eventKey(ts int64) string {
+	return fmt.Sprintf("%020d", ts)
+}
+
+// @Description query event history
+// @Tags  event
+// @Produce  json
+// @Param service query string true "param"
+// @Param since query int false "unix timestamp in seconds"
+// @Param limit query int false "max events returned"
+// @success 200
+// @Router /sm/server/events [get]
+func (ss *smShardApi) GinEvents(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	var (
+		since int64
+		limit int64 = defaultEventLimit
+		err   error
+	)
+	if v := c.Query("since"); v != "" {
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			apiErrorResponse(c, errCodeParam, err)
+			return
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 {
+			apiErrorResponse(c, errCodeParam, errors.New("limit error"))
+			return
+		}
+	}
+
+	events, err := ss.container.events.list(context.TODO(), service, time.Unix(since, 0).UnixNano(), limit)
+	if err != nil {
+		ss.lg.Error(
+			"list events error",
+			zap.String("service", service),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
@@ -0,0 +1,251 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var errShardNotFound = errors.New("shard not found")
+
+// placementRule 分配shard时生效的策略，来自service的spec和shard的spec
+type placementRule struct {
+	// Assignor binpack或者count，count是默认的按数量均衡
+	Assignor string `json:"assignor"`
+
+	// ManualContainerId 人工指定的container，不为空时其他规则不生效
+	ManualContainerId string `json:"manualContainerId,omitempty"`
+
+	Constraint            string             `json:"constraint,omitempty"`
+	Resources             *apputil.Resources `json:"resources,omitempty"`
+	SpreadPolicy          string             `json:"spreadPolicy,omitempty"`
+	DeploymentPolicy      string             `json:"deploymentPolicy,omitempty"`
+	MinimizeMovement      bool               `json:"minimizeMovement,omitempty"`
+	MaxShardsPerContainer int                `json:"maxShardsPerContainer,omitempty"`
+}
+
+// explainCandidate 存活的container能否接收shard，Reasons为空表示可以
+type explainCandidate struct {
+	ContainerId string   `json:"containerId"`
+	Current     bool     `json:"current,omitempty"`
+	Eligible    bool     `json:"eligible"`
+	Shards      int      `json:"shards"`
+	Reasons     []string `json:"reasons,omitempty"`
+}
+
+// shardExplanation shard为什么在当前的container上
+type shardExplanation struct {
+	Service string `json:"service"`
+	ShardId string `json:"shardId"`
+
+	// ContainerId shard当前所在的container，为空表示没有分配
+	ContainerId string `json:"containerId"`
+	Unassigned  bool   `json:"unassigned,omitempty"`
+
+	Rule *placementRule `json:"rule"`
+
+	// Trigger 最近一次分配的记录，包含触发move的原因和来源container
+	Trigger *shardHistoryEntry `json:"trigger,omitempty"`
+
+	// Holds 阻止shard被移动的原因，例如service冻结、移动冷却
+	Holds []string `json:"holds,omitempty"`
+
+	Candidates []*explainCandidate `json:"candidates"`
+}
+
+// Explain 按照leader当前的状态重新评估shard的分配，shardId可以是副本的id
+func (ss *smShard) Explain(ctx context.Context, shardId string) (*shardExplanation, error) {
+	baseId, _ := apputil.ParseReplicaShardId(shardId)
+	resp, err := ss.container.Client.GetKV(ctx, ss.container.nodeManager.nodeServiceShard(ss.service, baseId), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, errShardNotFound
+	}
+	var base apputil.ShardSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &base); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	specs := expandReplicas(baseId, &base)
+	spec, ok := specs[shardId]
+	if !ok {
+		return nil, errShardNotFound
+	}
+
+	r := shardExplanation{
+		Service: ss.service,
+		ShardId: shardId,
+		Rule: &placementRule{
+			Assignor:          "count",
+			ManualContainerId: spec.ManualContainerId,
+			Constraint:        spec.Constraint,
+			Resources:         spec.Resources,
+		},
+	}
+	if appSpec := ss.spec(); appSpec != nil {
+		if appSpec.Assignor != "" {
+			r.Rule.Assignor = appSpec.Assignor
+		}
+		r.Rule.SpreadPolicy = appSpec.SpreadPolicy
+		r.Rule.DeploymentPolicy = appSpec.DeploymentPolicy
+		r.Rule.MinimizeMovement = appSpec.MinimizeMovement
+		r.Rule.MaxShardsPerContainer = appSpec.MaxShardsPerContainer
+	}
+
+	entries, err := ss.container.history.get(ctx, ss.service, shardId)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if len(entries) > 0 {
+		r.Trigger = entries[len(entries)-1]
+	}
+	for _, id := range ss.UnassignedShards() {
+		if id == shardId {
+			r.Unassigned = true
+		}
+	}
+	r.Holds = ss.explainHolds(ctx, shardId)
+
+	aliveShards := ss.mpr.AliveShards()
+	counts := make(map[string]int)
+	for _, t := range aliveShards {
+		counts[t.curContainerId]++
+	}
+	if t, ok := aliveShards[shardId]; ok {
+		r.ContainerId = t.curContainerId
+	}
+	r.Candidates = ss.explainCandidates(shardId, specs, r.ContainerId, counts)
+	return &r, nil
+}
+
+// explainHolds 和balancePlan中固定shard的判断保持一致
+func (ss *smShard) explainHolds(ctx context.Context, shardId string) []string {
+	var holds []string
+	if ss.Frozen() {
+		holds = append(holds, "service frozen")
+	}
+	if ss.schedulerPaused(ctx) {
+		holds = append(holds, "scheduler paused")
+	}
+	appSpec := ss.spec()
+	if appSpec != nil && appSpec.MoveCooldown > 0 && ss.cooldown != nil {
+		if _, ok := ss.cooldown.cooling(time.Duration(appSpec.MoveCooldown)*time.Second, time.Now())[shardId]; ok {
+			holds = append(holds, "shard cooling")
+		}
+	}
+	if appSpec != nil && !inRebalanceWindow(appSpec.RebalanceWindows, time.Now()) {
+		holds = append(holds, "outside rebalance window")
+	}
+	return holds
+}
+
+// explainCandidates 每个存活container按照balancePlan的过滤顺序给出所有不能接收shard的原因
+func (ss *smShard) explainCandidates(shardId string, specs map[string]*apputil.ShardSpec, current string, counts map[string]int) []*explainCandidate {
+	alive := ss.mpr.AliveContainers()
+	unhealthy := ss.unhealthyContainers()
+	draining := ss.mpr.DrainingContainers()
+
+	// newest策略会排除旧deployment的container
+	deployed := make(ArmorMap)
+	for id, v := range alive {
+		deployed[id] = v
+	}
+	ss.applyDeploymentPolicy(deployed, make(map[string]struct{}))
+
+	filter := ss.constraintFilter(specs)
+	spec := specs[shardId]
+	maxShards := ss.maxShardsPerContainer()
+
+	var r []*explainCandidate
+	for id := range alive {
+		cand := explainCandidate{ContainerId: id, Current: id == current, Shards: counts[id]}
+		if spec.ManualContainerId != "" && spec.ManualContainerId != id {
+			cand.Reasons = append(cand.Reasons, "shard pinned to "+spec.ManualContainerId)
+		}
+		if _, ok := unhealthy[id]; ok {
+			cand.Reasons = append(cand.Reasons, "health probe failed")
+		}
+		if _, ok := draining[id]; ok {
+			cand.Reasons = append(cand.Reasons, "container draining")
+		}
+		if _, ok := deployed[id]; !ok {
+			cand.Reasons = append(cand.Reasons, "not in newest deployment")
+		}
+		if reason := filter.reject(id, shardId); reason != "" {
+			cand.Reasons = append(cand.Reasons, reason)
+		}
+		if maxShards > 0 && !cand.Current && cand.Shards >= maxShards {
+			cand.Reasons = append(cand.Reasons, "container full")
+		}
+		cand.Eligible = len(cand.Reasons) == 0
+		r = append(r, &cand)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ContainerId < r[j].ContainerId })
+	return r
+}
+
+// @Description explain why a shard is on its current container: the placement rule, the trigger of the last move and the candidates
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @Param shard query string true "param"
+// @success 200 {object} shardExplanation
+// @Router /sm/server/explain [get]
+func (ss *smShardApi) GinExplain(c *gin.Context) {
+	service := c.Query("service")
+	shardId := c.Query("shard")
+	if service == "" || shardId == "" {
+		err := errors.New("empty service or shard")
+		ss.lg.Error("param error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	shard, err := ss.container.GetShard(service)
+	if err != nil {
+		ss.lg.Error(
+			"shard not found",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", service))
+		return
+	}
+	r, err := shard.Explain(c.Request.Context(), shardId)
+	if err != nil {
+		if errors.Cause(err) == errShardNotFound {
+			apiErrorResponse(c, errCodeShardNotFound, errors.Errorf("shard[%s] not exist", shardId))
+			return
+		}
+		ss.lg.Error(
+			"explain error",
+			zap.String("service", service),
+			zap.String("shardId", shardId),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,62 @@
+package smserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+)
+
+func Test_smShard_explainCandidates(t *testing.T) {
+	service := "foo.bar"
+	mpr := &mapper{lg: ttLogger, appSpec: &smAppSpec{Service: service}}
+	mpr.containerState = newMapperState(mpr, containerTrigger)
+	for id, hb := range map[string]apputil.ContainerHeartbeat{
+		"c1": {Zone: "z1"},
+		"c2": {Zone: "z2"},
+		"c3": {Zone: "z1", Draining: true},
+		"c4": {Zone: "z1"},
+	} {
+		b, _ := json.Marshal(hb)
+		if err := mpr.containerState.Create(id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss := smShard{
+		service:  service,
+		lg:       ttLogger,
+		mpr:      mpr,
+		appSpec:  &smAppSpec{MaxShardsPerContainer: 1},
+		cordoned: map[string]struct{}{"c4": {}},
+	}
+	specs := map[string]*apputil.ShardSpec{"s1": {Service: service, Constraint: `container.zone == "z1"`}}
+	r := ss.explainCandidates("s1", specs, "c1", map[string]int{"c1": 1, "c2": 1})
+
+	expect := []*explainCandidate{
+		{ContainerId: "c1", Current: true, Eligible: true, Shards: 1},
+		{ContainerId: "c2", Shards: 1, Reasons: []string{"constraint not satisfied", "container full"}},
+		{ContainerId: "c3", Reasons: []string{"container draining"}},
+		{ContainerId: "c4", Reasons: []string{"container cordoned"}},
+	}
+	if !reflect.DeepEqual(r, expect) {
+		b, _ := json.Marshal(r)
+		t.Errorf("unexpected candidates %s", b)
+	}
+
+	// 人工指定container时其他container都不能接收
+	specs["s1"].ManualContainerId = "c1"
+	specs["s1"].Constraint = ""
+	ss.cordoned = nil
+	ss.appSpec.MaxShardsPerContainer = 0
+	r = ss.explainCandidates("s1", specs, "c1", nil)
+	for _, cand := range r {
+		if cand.Eligible != (cand.ContainerId == "c1") {
+			t.Errorf("unexpected candidate %+v", cand)
+		}
+	}
+	if r[1].Reasons[0] != "shard pinned to c1" {
+		t.Errorf("unexpected reasons %v", r[1].Reasons)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// specDocumentVersion 文档格式变化时递增，import拒绝不认识的版本
+const specDocumentVersion = 1
+
+// serviceDump 一个service的spec和所有shard的配置
+type serviceDump struct {
+	Spec *smAppSpec `json:"spec"`
+
+	// Shards key是shard id
+	Shards map[string]*apputil.ShardSpec `json:"shards"`
+}
+
+// specDocument export的输出和import的输入，用于灾备和环境复制
+type specDocument struct {
+	Version    int            `json:"version"`
+	ExportTime int64          `json:"exportTime"`
+	Services   []*serviceDump `json:"services"`
+}
+
+// serviceImportResult 已经存在的spec和shard保持不变
+type serviceImportResult struct {
+	Service       string `json:"service"`
+	SpecCreated   bool   `json:"specCreated"`
+	ShardsCreated int    `json:"shardsCreated"`
+	ShardsSkipped int    `json:"shardsSkipped"`
+}
+
+func (r *serviceImportResult) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// @Description export specs and shard definitions of the service and its child services, or all services when service is empty
+// @Tags  spec
+// @Produce  json
+// @Param service query string false "param"
+// @success 200
+// @Router /sm/server/export [get]
+func (ss *smShardApi) GinExport(c *gin.Context) {
+	ctx := context.TODO()
+
+	var services []string
+	if service := c.Query("service"); service != "" {
+		services = append(services, service)
+
+		// 子service跟随父service一起导出，父service在前，import时按顺序创建
+		tree, err := ss.serviceTree(ctx)
+		if err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		for _, child := range tree.descendants(service) {
+			if authorized(c, child) {
+				services = append(services, child)
+			}
+		}
+	} else {
+		// 每个service是sm的一个shard
+		kvs, err := ss.container.Client.GetKVs(ctx, ss.container.nodeManager.nodeServiceShard(ss.container.Service(), ""))
+		if err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		for service := range kvs {
+			// 开启鉴权时，只导出有权限的service
+			if authorized(c, service) {
+				services = append(services, service)
+			}
+		}
+		sort.Strings(services)
+	}
+
+	doc := specDocument{Version: specDocumentVersion, ExportTime: time.Now().Unix(), Services: make([]*serviceDump, 0)}
+	for _, service := range services {
+		dump, err := ss.dumpService(ctx, service)
+		if err != nil {
+			ss.lg.Error("dumpService error",
+				zap.String("service", service),
+				zap.Error(err),
+			)
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		if dump == nil {
+			if service == c.Query("service") {
+				apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not exist", service))
+				return
+			}
+			continue
+		}
+		doc.Services = append(doc.Services, dump)
+	}
+	ss.lg.Info("export success", zap.Strings("services", services))
+	c.JSON(http.StatusOK, doc)
+}
+
+// dumpService service不存在时返回nil
+func (ss *smShardApi) dumpService(ctx context.Context, service string) (*serviceDump, error) {
+	nm := ss.container.nodeManager
+	resp, err := ss.container.Client.GetKV(ctx, nm.nodeServiceSpec(service), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	var spec smAppSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &spec); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	// shardGroups已经展开成shard，import时不再重复创建
+	spec.ShardGroups = nil
+
+	kvs, err := ss.container.Client.GetKVs(ctx, nm.nodeServiceShard(service, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	dump := serviceDump{Spec: &spec, Shards: make(map[string]*apputil.ShardSpec)}
+	for shardId, value := range kvs {
+		var shardSpec apputil.ShardSpec
+		if err := json.Unmarshal([]byte(value), &shardSpec); err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		dump.Shards[shardId] = &shardSpec
+	}
+	return &dump, nil
+}
+
+// @Description import specs and shard definitions exported by /sm/server/export, existing specs and shards are kept
+// @Tags  spec
+// @Accept  json
+// @Produce  json
+// @Param param body specDocument true "param"
+// @success 200
+// @Router /sm/server/import [post]
+func (ss *smShardApi) GinImport(c *gin.Context) {
+	var doc specDocument
+	if err := c.ShouldBind(&doc); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if code, err := ss.validateDocument(c, &doc); err != nil {
+		ss.lg.Error("validateDocument err", zap.Error(err))
+		apiErrorResponse(c, code, err)
+		return
+	}
+
+	results := make([]*serviceImportResult, 0)
+	for _, dump := range doc.Services {
+		result, err := ss.importService(dump, requestTenant(c))
+		if err != nil {
+			ss.lg.Error("importService err",
+				zap.String("service", dump.Spec.Service),
+				zap.Error(err),
+			)
+			apiErrorResponse(c, quotaErrCode(err), err)
+			return
+		}
+		ss.container.events.append(eventSpecChange, result.Service, c.ClientIP(), "import "+result.String())
+		results = append(results, result)
+	}
+	ss.lg.Info("import success", zap.Reflect("results", results))
+	c.JSON(http.StatusOK, gin.H{"services": results})
+}
+
+// validateDocument 写入前校验整个文档，避免导入一半失败
+func (ss *smShardApi) validateDocument(c *gin.Context, doc *specDocument) (errCode, error) {
+	if doc.Version != specDocumentVersion {
+		return errCodeParam, errors.Errorf("unsupported version %d", doc.Version)
+	}
+	seen := make(map[string]struct{})
+	for _, dump := range doc.Services {
+		if dump.Spec == nil || dump.Spec.Service == "" {
+			return errCodeParam, errors.New("empty spec")
+		}
+		service := dump.Spec.Service
+		if service == ss.container.Service() {
+			return errCodeReservedService, errors.Errorf("same as shard manager's service")
+		}
+		if _, ok := seen[service]; ok {
+			return errCodeParam, errors.Errorf("duplicate service %s", service)
+		}
+		seen[service] = struct{}{}
+		if !authorized(c, service) {
+			return errCodeForbidden, errors.Errorf("forbidden service %s", service)
+		}
+		if err := dump.Spec.validateHeartbeat(); err != nil {
+			return errCodeParam, errors.Wrap(err, service)
+		}
+		if err := dump.Spec.validateSpreadPolicy(); err != nil {
+			return errCodeParam, errors.Wrap(err, service)
+		}
+		if err := dump.Spec.validateAssignor(); err != nil {
+			return errCodeParam, errors.Wrap(err, service)
+		}
+		if err := dump.Spec.validateShardDefaults(); err != nil {
+			return errCodeParam, errors.Wrap(err, service)
+		}
+		if err := dump.Spec.validateTaskSchema(); err != nil {
+			return errCodeParam, errors.Wrap(err, service)
+		}
+		for shardId, shardSpec := range dump.Shards {
+			if shardId == "" || shardSpec == nil {
+				return errCodeParam, errors.Errorf("service %s has empty shard", service)
+			}
+		}
+		if err := ss.validateShards(dump.Spec, dump.Shards); err != nil {
+			return errCodeInvalidTask, errors.Wrap(err, service)
+		}
+	}
+	return "", nil
+}
+
+func (ss *smShardApi) importService(dump *serviceDump, tenant string) (*serviceImportResult, error) {
+	spec := *dump.Spec
+	result := serviceImportResult{Service: spec.Service}
+
+	// 已经存在的service和shard会被跳过，quota按照上限估算
+	if ss.container.quotas.enabled() {
+		existing, err := ss.getAppSpec(context.TODO(), spec.Service)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		if existing == nil {
+			if err := ss.checkServiceQuota(context.TODO(), tenant, 1); err != nil {
+				return nil, errors.Wrap(err, spec.Service)
+			}
+		}
+		if err := ss.checkShardQuota(context.TODO(), tenant, spec.Service, len(dump.Shards)); err != nil {
+			return nil, errors.Wrap(err, spec.Service)
+		}
+	}
+
+	spec.CreateTime = time.Now().Unix()
+	spec.Revision = 0
+	spec.ShardGroups = nil
+	err := ss.createSpec(&spec, tenant)
+	switch {
+	case err == nil:
+		result.SpecCreated = true
+	case errors.Cause(err) != etcdutil.ErrEtcdNodeExist:
+		return nil, errors.Wrap(err, "")
+	}
+
+	// shard数量可能超过etcd单个txn的限制，逐个创建
+	for shardId, shardSpec := range dump.Shards {
+		shardSpec.Service = spec.Service
+		shardSpec.UpdateTime = time.Now().Unix()
+		// 导出时已经加密的task保持不变
+		if err := ss.container.encryptTask(shardSpec); err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		node := ss.container.nodeManager.nodeServiceShard(spec.Service, shardId)
+		err := ss.container.Client.CreateAndGet(context.Background(), []string{node}, []string{shardSpec.String()}, clientv3.NoLease)
+		switch {
+		case err == nil:
+			result.ShardsCreated++
+		case errors.Cause(err) == etcdutil.ErrEtcdNodeExist:
+			result.ShardsSkipped++
+		default:
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	return &result, nil
+}
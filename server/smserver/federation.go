@@ -0,0 +1,481 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// federationSpecRequest 在多个region的sm集群中创建service，Regions为空时使用所有region
+type federationSpecRequest struct {
+	Regions []string  `json:"regions"`
+	Spec    smAppSpec `json:"spec" binding:"required"`
+}
+
+// federationService 联邦service覆盖的region，存储在coordinator的etcd中
+type federationService struct {
+	Service    string   `json:"service"`
+	Regions    []string `json:"regions"`
+	CreateTime int64    `json:"createTime"`
+}
+
+func (s *federationService) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// federationShardRequest Region为空时分配到shard最少的region
+type federationShardRequest struct {
+	addShardRequest
+
+	Region string `json:"region"`
+}
+
+// federationShard shard所在的region，region内部的container分配和故障转移由region的sm负责
+type federationShard struct {
+	Region     string `json:"region"`
+	CreateTime int64  `json:"createTime"`
+}
+
+func (s *federationShard) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// federationRegionResult 单个region的接口返回
+type federationRegionResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// federationState 全局视图，State是region的 /sm/server/cluster-state
+type federationState struct {
+	Regions map[string]*federationRegionState `json:"regions"`
+	// Shards 指定service时返回shard所在的region
+	Shards map[string]string `json:"shards,omitempty"`
+}
+
+type federationRegionState struct {
+	Addr  string          `json:"addr"`
+	State json.RawMessage `json:"state,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// federator 作为全局coordinator，把service分配到各region的sm集群，shard按照region划分，
+// region内部的分配和故障转移不变，coordinator只记录shard所在的region并汇总各region的状态
+type federator struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	nodeManager *nodeManager
+
+	// regions region名称到该region任意sm节点地址的映射，region的sm需要开启leader forwarding
+	regions map[string]string
+	// insecure 允许通过明文http转发调用方的token
+	insecure bool
+
+	httpClient *http.Client
+}
+
+// newFederator tlsConfig为空时使用系统的ca校验https的region
+func newFederator(lg *zap.Logger, container *smContainer, regions map[string]string, tlsConfig *tls.Config, insecure bool) *federator {
+	httpClient := newHttpClient()
+	httpClient.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	return &federator{
+		lg:          lg,
+		client:      container.Client,
+		nodeManager: container.nodeManager,
+		regions:     regions,
+		insecure:    insecure,
+		httpClient:  httpClient,
+	}
+}
+
+// regionURL region地址可以带 http:// 或者 https:// ，不带时使用http，兼容之前只配置 host:port 的地址
+func regionURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid region address %s", addr)
+	}
+	return u, nil
+}
+
+func (f *federator) regionNames() []string {
+	var r []string
+	for name := range f.regions {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// call 调用region的sm接口，透传调用方的认证信息，region使用明文http时除非显式允许，否则拒绝转发认证信息
+func (f *federator) call(c *gin.Context, region string, method string, path string, body []byte) *federationRegionResult {
+	base, err := regionURL(f.regions[region])
+	if err != nil {
+		return &federationRegionResult{Error: err.Error()}
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), method, base.Scheme+"://"+base.Host+path, bytes.NewReader(body))
+	if err != nil {
+		return &federationRegionResult{Error: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range []string{headerToken, "Authorization"} {
+		if v := c.GetHeader(h); v != "" {
+			if base.Scheme != "https" && !f.insecure {
+				f.lg.Warn(
+					"refuse to forward credentials over plain http",
+					zap.String("region", region),
+					zap.String("path", path),
+				)
+				return &federationRegionResult{Error: fmt.Sprintf("region %s uses plain http, refuse to forward credentials", region)}
+			}
+			req.Header.Set(h, v)
+		}
+	}
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return &federationRegionResult{Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &federationRegionResult{Status: resp.StatusCode, Error: err.Error()}
+	}
+	r := federationRegionResult{Status: resp.StatusCode}
+	if json.Valid(b) {
+		r.Body = b
+	}
+	return &r
+}
+
+func (r *federationRegionResult) ok() bool {
+	return r.Error == "" && r.Status >= http.StatusOK && r.Status < http.StatusMultipleChoices
+}
+
+// relay 把region的返回原样交给调用方
+func (r *federationRegionResult) relay(c *gin.Context) {
+	if r.Error != "" {
+		apiErrorResponse(c, errCodeLeaderUnavailable, errors.New(r.Error))
+		return
+	}
+	c.Data(r.Status, "application/json; charset=utf-8", r.Body)
+}
+
+func (f *federator) service(ctx context.Context, service string) (*federationService, error) {
+	resp, err := f.client.GetKV(ctx, f.nodeManager.nodeFederationService(service), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	var fs federationService
+	if err := json.Unmarshal(resp.Kvs[0].Value, &fs); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &fs, nil
+}
+
+// shards 返回service的shard所在的region
+func (f *federator) shards(ctx context.Context, service string) (map[string]string, error) {
+	kvs, err := f.client.GetKVs(ctx, f.nodeManager.nodeFederationShard(service, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	r := make(map[string]string)
+	for shardId, value := range kvs {
+		var fs federationShard
+		if err := json.Unmarshal([]byte(value), &fs); err != nil {
+			return nil, errors.Wrap(err, value)
+		}
+		r[shardId] = fs.Region
+	}
+	return r, nil
+}
+
+// pickRegion 选择shard数量最少的region，数量相同按照名称
+func pickRegion(regions []string, shardIdAndRegion map[string]string) string {
+	counts := make(map[string]int)
+	for _, region := range shardIdAndRegion {
+		counts[region]++
+	}
+	var r string
+	for _, region := range regions {
+		if r == "" || counts[region] < counts[r] || (counts[region] == counts[r] && region < r) {
+			r = region
+		}
+	}
+	return r
+}
+
+// @Description create a service in the sm clusters of the regions it spans
+// @Tags  federation
+// @Accept  json
+// @Produce  json
+// @Param param body federationSpecRequest true "param"
+// @success 200
+// @Router /sm/server/federation/add-spec [post]
+func (f *federator) GinAddSpec(c *gin.Context) {
+	var req federationSpecRequest
+	if err := c.ShouldBind(&req); err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if req.Spec.Service == "" {
+		apiErrorResponse(c, errCodeParam, errors.New("service required"))
+		return
+	}
+	if len(req.Regions) == 0 {
+		req.Regions = f.regionNames()
+	}
+	for _, region := range req.Regions {
+		if _, ok := f.regions[region]; !ok {
+			apiErrorResponse(c, errCodeParam, errors.Errorf("unknown region %s", region))
+			return
+		}
+	}
+	sort.Strings(req.Regions)
+
+	fs := federationService{Service: req.Spec.Service, Regions: req.Regions, CreateTime: time.Now().Unix()}
+	if err := f.client.CreateAndGet(
+		context.TODO(),
+		[]string{f.nodeManager.nodeFederationService(fs.Service)},
+		[]string{fs.String()},
+		clientv3.NoLease,
+	); err != nil && err != etcdutil.ErrEtcdNodeExist {
+		apiErrorResponse(c, etcdErrCode(err, errCodeServiceExists), err)
+		return
+	}
+
+	// region中已经存在的service视为成功，重试时补齐失败的region
+	body, _ := json.Marshal(req.Spec)
+	results := make(map[string]*federationRegionResult)
+	status := http.StatusOK
+	for _, region := range req.Regions {
+		r := f.call(c, region, http.MethodPost, "/sm/server/add-spec", body)
+		results[region] = r
+		if !r.ok() && r.Status != http.StatusConflict {
+			status = http.StatusBadGateway
+		}
+	}
+	f.lg.Info(
+		"federation add spec",
+		zap.String("service", fs.Service),
+		zap.Strings("regions", fs.Regions),
+		zap.Int("status", status),
+	)
+	c.JSON(status, gin.H{"regions": results})
+}
+
+// @Description add a shard to the region given or the region with the fewest shards of the service
+// @Tags  federation
+// @Accept  json
+// @Produce  json
+// @Param param body federationShardRequest true "param"
+// @success 200
+// @Router /sm/server/federation/add-shard [post]
+func (f *federator) GinAddShard(c *gin.Context) {
+	var req federationShardRequest
+	if err := c.ShouldBind(&req); err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	ctx := context.TODO()
+	fs, err := f.service(ctx, req.Service)
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if fs == nil {
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("federation service %s not found", req.Service))
+		return
+	}
+	shardIdAndRegion, err := f.shards(ctx, req.Service)
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+
+	region, existed := shardIdAndRegion[req.ShardId]
+	switch {
+	case existed && req.Region != "" && req.Region != region:
+		apiErrorResponse(c, errCodeShardExists, errors.Errorf("shard %s exists in region %s", req.ShardId, region))
+		return
+	case existed:
+		// 重试时继续使用已经记录的region
+	case req.Region != "":
+		found := false
+		for _, name := range fs.Regions {
+			found = found || name == req.Region
+		}
+		if !found {
+			apiErrorResponse(c, errCodeParam, errors.Errorf("service %s not in region %s", req.Service, req.Region))
+			return
+		}
+		region = req.Region
+	default:
+		region = pickRegion(fs.Regions, shardIdAndRegion)
+	}
+
+	node := f.nodeManager.nodeFederationShard(req.Service, req.ShardId)
+	if !existed {
+		value := federationShard{Region: region, CreateTime: time.Now().Unix()}
+		if err := f.client.CreateAndGet(ctx, []string{node}, []string{value.String()}, clientv3.NoLease); err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeShardExists), err)
+			return
+		}
+	}
+
+	body, _ := json.Marshal(req.addShardRequest)
+	r := f.call(c, region, http.MethodPost, "/sm/server/add-shard", body)
+	if !r.ok() && !existed && r.Status != http.StatusConflict {
+		// region没有创建成功，撤销记录，调用方可以重新选择region
+		if _, err := f.client.Delete(ctx, node); err != nil {
+			f.lg.Error("delete federation shard error", zap.String("node", node), zap.Error(err))
+		}
+	}
+	f.lg.Info(
+		"federation add shard",
+		zap.String("service", req.Service),
+		zap.String("shardId", req.ShardId),
+		zap.String("region", region),
+		zap.Int("status", r.Status),
+		zap.String("error", r.Error),
+	)
+	c.Header("X-SM-Region", region)
+	r.relay(c)
+}
+
+// @Description delete a shard from the region it was added to
+// @Tags  federation
+// @Accept  json
+// @Produce  json
+// @Param param body delShardRequest true "param"
+// @success 200
+// @Router /sm/server/federation/del-shard [post]
+func (f *federator) GinDelShard(c *gin.Context) {
+	var req delShardRequest
+	if err := c.ShouldBind(&req); err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	ctx := context.TODO()
+	node := f.nodeManager.nodeFederationShard(req.Service, req.ShardId)
+	resp, err := f.client.GetKV(ctx, node, nil)
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if resp.Count == 0 {
+		apiErrorResponse(c, errCodeShardNotFound, errors.Errorf("federation shard %s not found", req.ShardId))
+		return
+	}
+	var fs federationShard
+	if err := json.Unmarshal(resp.Kvs[0].Value, &fs); err != nil {
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+
+	body, _ := json.Marshal(req)
+	r := f.call(c, fs.Region, http.MethodPost, "/sm/server/del-shard", body)
+	if r.ok() || r.Status == http.StatusNotFound {
+		if _, err := f.client.Delete(ctx, node); err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+	}
+	c.Header("X-SM-Region", fs.Region)
+	r.relay(c)
+}
+
+// @Description global view, cluster state of every region and the region of each shard when service is given
+// @Tags  federation
+// @Produce  json
+// @Param service query string false "service"
+// @success 200 {object} federationState
+// @Router /sm/server/federation/state [get]
+func (f *federator) GinState(c *gin.Context) {
+	ctx := context.TODO()
+	regions := f.regionNames()
+	state := federationState{Regions: make(map[string]*federationRegionState)}
+	if service := c.Query("service"); service != "" {
+		fs, err := f.service(ctx, service)
+		if err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		if fs == nil {
+			apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("federation service %s not found", service))
+			return
+		}
+		regions = fs.Regions
+		state.Shards, err = f.shards(ctx, service)
+		if err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+	}
+
+	// region之间互不影响，不可达的region只在结果中标记错误
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			rs := federationRegionState{Addr: f.regions[region]}
+			r := f.call(c, region, http.MethodGet, "/sm/server/cluster-state", nil)
+			switch {
+			case r.ok():
+				rs.State = r.Body
+			case r.Error != "":
+				rs.Error = r.Error
+			default:
+				rs.Error = fmt.Sprintf("status %d %s", r.Status, r.Body)
+			}
+			mu.Lock()
+			state.Regions[region] = &rs
+			mu.Unlock()
+		}(region)
+	}
+	wg.Wait()
+	c.JSON(http.StatusOK, state)
+}
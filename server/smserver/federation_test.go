@@ -0,0 +1,140 @@
+package smserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_pickRegion(t *testing.T) {
+	regions := []string{"dc1", "dc2"}
+	assert.Equal(t, "dc1", pickRegion(regions, nil))
+	assert.Equal(t, "dc2", pickRegion(regions, map[string]string{"s1": "dc1"}))
+	// 不在service的region列表中的记录不影响选择
+	assert.Equal(t, "dc1", pickRegion(regions, map[string]string{"s1": "dc3"}))
+}
+
+func Test_federator(t *testing.T) {
+	var added []string
+	dc1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sm/server/add-shard":
+			var req addShardRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			added = append(added, req.ShardId)
+			w.Write([]byte(`{}`))
+		case "/sm/server/cluster-state":
+			w.Write([]byte(`{"leader":"dc1-sm"}`))
+		}
+	}))
+	defer dc1.Close()
+	dc2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer dc2.Close()
+
+	fs := federationService{Service: "foo.bar", Regions: []string{"dc1", "dc2"}}
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("GetKV", mock.Anything, "/sm/app/foo/federation/foo.bar/spec", mock.Anything).Return(
+		&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(fs.String())}}}, nil)
+	mockedEtcdWrapper.On("GetKVs", mock.Anything, "/sm/app/foo/federation/foo.bar/shard/").Return(
+		map[string]string{"s0": (&federationShard{Region: "dc2"}).String()}, nil)
+	mockedEtcdWrapper.On("CreateAndGet", mock.Anything, []string{"/sm/app/foo/federation/foo.bar/shard/s1"}, mock.Anything, clientv3.NoLease).Return(nil)
+
+	container := &smContainer{
+		Container:   &apputil.Container{Client: mockedEtcdWrapper},
+		nodeManager: &nodeManager{smService: "foo", etcdPath: apputil.NewEtcdPath("")},
+	}
+	f := newFederator(ttLogger, container, map[string]string{
+		"dc1": strings.TrimPrefix(dc1.URL, "http://"),
+		"dc2": strings.TrimPrefix(dc2.URL, "http://"),
+	}, nil, false)
+	router := gin.New()
+	router.POST("/sm/server/federation/add-shard", f.GinAddShard)
+	router.GET("/sm/server/federation/state", f.GinState)
+
+	// dc2已经有一个shard，新shard分配到dc1
+	req := httptest.NewRequest(http.MethodPost, "/sm/server/federation/add-shard", bytes.NewBufferString(`{"service":"foo.bar","shardId":"s1"}`))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "dc1", w.Header().Get("X-SM-Region"))
+	assert.Equal(t, []string{"s1"}, added)
+
+	// 异常的region只标记错误，不影响全局视图
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sm/server/federation/state?service=foo.bar", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var state federationState
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &state))
+	assert.JSONEq(t, `{"leader":"dc1-sm"}`, string(state.Regions["dc1"].State))
+	assert.NotEmpty(t, state.Regions["dc2"].Error)
+	assert.Equal(t, map[string]string{"s0": "dc2"}, state.Shards)
+}
+
+func Test_federator_call(t *testing.T) {
+	var tokens []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get(headerToken))
+		w.Write([]byte(`{}`))
+	})
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(secure.Certificate())
+	regions := map[string]string{
+		"secure": secure.URL,
+		"plain":  strings.TrimPrefix(plain.URL, "http://"),
+	}
+	container := &smContainer{Container: &apputil.Container{}, nodeManager: &nodeManager{smService: "foo"}}
+
+	call := func(f *federator, region string) *federationRegionResult {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/sm/server/federation/state", nil)
+		c.Request.Header.Set(headerToken, "t1")
+		return f.call(c, region, http.MethodGet, "/sm/server/cluster-state", nil)
+	}
+
+	// https的region校验证书后转发token
+	f := newFederator(ttLogger, container, regions, &tls.Config{RootCAs: pool}, false)
+	assert.True(t, call(f, "secure").ok())
+	assert.Equal(t, []string{"t1"}, tokens)
+
+	// 明文http的region拒绝转发token，请求不会发出
+	r := call(f, "plain")
+	assert.False(t, r.ok())
+	assert.Contains(t, r.Error, "plain http")
+	assert.Equal(t, []string{"t1"}, tokens)
+
+	// 显式允许后通过明文http转发
+	f = newFederator(ttLogger, container, regions, nil, true)
+	assert.True(t, call(f, "plain").ok())
+	assert.Equal(t, []string{"t1", "t1"}, tokens)
+}
+
+func Test_regionURL(t *testing.T) {
+	u, err := regionURL("10.0.0.1:8888")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://10.0.0.1:8888", u.String())
+	u, err = regionURL("https://sm.dc1.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "https", u.Scheme)
+	_, err = regionURL("ftp://10.0.0.1")
+	assert.NotNil(t, err)
+}
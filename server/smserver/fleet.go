@@ -0,0 +1,147 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// containerStatus container最近一次heartbeat的内容，不需要额外的监控agent就可以看到整个service的container
+type containerStatus struct {
+	ContainerId string `json:"containerId"`
+
+	// Timestamp 最近一次heartbeat的时间
+	Timestamp int64 `json:"timestamp"`
+
+	Zone       string             `json:"zone,omitempty"`
+	Deployment string             `json:"deployment,omitempty"`
+	Capacity   int                `json:"capacity,omitempty"`
+	Resources  *apputil.Resources `json:"resources,omitempty"`
+	Labels     map[string]string  `json:"labels,omitempty"`
+	Watch      bool               `json:"watch"`
+	Draining   bool               `json:"draining"`
+
+	// CPUUsedPercent 和 MemUsedPercent 是container所在主机的使用率
+	CPUUsedPercent float64 `json:"cpuUsedPercent"`
+	MemUsedPercent float64 `json:"memUsedPercent"`
+
+	ShardCount int `json:"shardCount"`
+
+	// Process 老版本的container没有上报时为空
+	Process *apputil.ProcessStats `json:"process,omitempty"`
+}
+
+type serviceContainers struct {
+	Service    string             `json:"service"`
+	Containers []*containerStatus `json:"containers"`
+}
+
+// aggregateContainers kvs是containerhb下的节点，shard数量按照shard的heartbeat统计
+func aggregateContainers(service string, kvs []*mvccpb.KeyValue, assignment map[string]*apputil.ShardHeartbeat) (*serviceContainers, error) {
+	sc := serviceContainers{Service: service, Containers: make([]*containerStatus, 0)}
+
+	statuses := make(map[string]*containerStatus)
+	for _, kv := range kvs {
+		// mutex刚创建的节点还没有写入heartbeat，同一个id只有持有lock的节点有值
+		if len(kv.Value) == 0 {
+			continue
+		}
+		var hb apputil.ContainerHeartbeat
+		if err := json.Unmarshal(kv.Value, &hb); err != nil {
+			return nil, errors.Wrap(err, string(kv.Value))
+		}
+		id := path.Base(path.Dir(string(kv.Key)))
+		cs := containerStatus{
+			ContainerId:    id,
+			Timestamp:      hb.Timestamp,
+			Zone:           hb.Zone,
+			Deployment:     hb.Deployment,
+			Capacity:       hb.Capacity,
+			Resources:      hb.Resources,
+			Labels:         hb.Labels,
+			Watch:          hb.Watch,
+			Draining:       hb.Draining,
+			CPUUsedPercent: hb.CPUUsedPercent,
+			Process:        hb.Process,
+		}
+		if hb.VirtualMemoryStat != nil {
+			cs.MemUsedPercent = hb.VirtualMemoryStat.UsedPercent
+		}
+		statuses[id] = &cs
+	}
+	for _, hb := range assignment {
+		if cs, ok := statuses[hb.ContainerId]; ok {
+			cs.ShardCount++
+		}
+	}
+	for _, cs := range statuses {
+		sc.Containers = append(sc.Containers, cs)
+	}
+	sort.Slice(sc.Containers, func(i, j int) bool {
+		return sc.Containers[i].ContainerId < sc.Containers[j].ContainerId
+	})
+	return &sc, nil
+}
+
+func (ss *smShardApi) serviceContainers(ctx context.Context, service string) (*serviceContainers, error) {
+	resp, err := ss.container.Client.GetKV(ctx, ss.container.nodeManager.nodeServiceContainerHb(service), []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	assignment, err := ss.shardHeartbeats(ctx, service)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return aggregateContainers(service, resp.Kvs, assignment)
+}
+
+// @Description heartbeat and runtime stats of alive containers
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200 {object} serviceContainers
+// @Router /sm/server/containers [get]
+func (ss *smShardApi) GinContainers(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.New("empty service")
+		ss.lg.Error("param error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	sc, err := ss.serviceContainers(context.TODO(), service)
+	if err != nil {
+		ss.lg.Error(
+			"serviceContainers error",
+			zap.String("service", service),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, sc)
+}
@@ -0,0 +1,51 @@
+package smserver
+
+import (
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func Test_aggregateContainers(t *testing.T) {
+	c1 := apputil.ContainerHeartbeat{
+		Zone:              "z1",
+		CPUUsedPercent:    12,
+		VirtualMemoryStat: &mem.VirtualMemoryStat{UsedPercent: 40},
+		Process:           &apputil.ProcessStats{Goroutines: 10, RSS: 1024, Uptime: 60, Version: "v1.0.0"},
+	}
+	c1.Timestamp = 100
+	c2 := apputil.ContainerHeartbeat{Draining: true}
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/sm/app/foo.bar/containerhb/c2/2"), Value: []byte(c2.String())},
+		{Key: []byte("/sm/app/foo.bar/containerhb/c1/1"), Value: []byte(c1.String())},
+		// 等待lock的节点没有值
+		{Key: []byte("/sm/app/foo.bar/containerhb/c1/3")},
+	}
+	assignment := map[string]*apputil.ShardHeartbeat{
+		"s1": {ContainerId: "c1"},
+		"s2": {ContainerId: "c1"},
+		// containerhb已经过期的container不展示
+		"s3": {ContainerId: "c3"},
+	}
+
+	sc, err := aggregateContainers("foo.bar", kvs, assignment)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo.bar", sc.Service)
+	assert.Len(t, sc.Containers, 2)
+
+	s1, s2 := sc.Containers[0], sc.Containers[1]
+	assert.Equal(t, "c1", s1.ContainerId)
+	assert.Equal(t, int64(100), s1.Timestamp)
+	assert.Equal(t, 2, s1.ShardCount)
+	assert.Equal(t, float64(40), s1.MemUsedPercent)
+	assert.Equal(t, "v1.0.0", s1.Process.Version)
+	assert.Equal(t, "c2", s2.ContainerId)
+	assert.True(t, s2.Draining)
+	assert.Nil(t, s2.Process)
+
+	_, err = aggregateContainers("foo.bar", []*mvccpb.KeyValue{{Key: []byte("/sm/app/foo.bar/containerhb/c1/1"), Value: []byte("{")}}, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// forwardedHeader 标记请求已经被转发过，收到的节点直接处理，防止leader切换或者service迁移过程中出现循环转发
+const forwardedHeader = "X-SM-Forwarded-By"
+
+// leaderForwarder 写接口在非leader节点上收到请求时，转发给leader处理，
+// 调用方可以通过负载均衡访问任意sm节点
+type leaderForwarder struct {
+	lg        *zap.Logger
+	container *smContainer
+	// peers 判断连接的ip是否是sm节点，只信任sm节点转发的请求
+	peers func(ip string) bool
+}
+
+func newLeaderForwarder(lg *zap.Logger, container *smContainer, peers func(ip string) bool) *leaderForwarder {
+	return &leaderForwarder{lg: lg, container: container, peers: peers}
+}
+
+func (f *leaderForwarder) wrap(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if trustForwarded(f.lg, c, f.peers) {
+			handler(c)
+			return
+		}
+
+		leader, err := f.container.leader(context.TODO())
+		if err != nil {
+			f.lg.Error(
+				"get leader error",
+				zap.String("path", c.Request.URL.Path),
+				zap.Error(err),
+			)
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		if leader == "" {
+			apiErrorResponse(c, errCodeLeaderUnavailable, errors.New("leader not elected"))
+			return
+		}
+		if leader == f.container.Id() {
+			handler(c)
+			return
+		}
+
+		forward(f.lg, f.container, c, leader)
+	}
+}
+
+// governorForwarder 每个service由一个sm container负责rebalance（leader把service作为sm自身的shard分配），
+// 依赖smShard的接口在其他节点收到请求时，转发给负责该service的container
+type governorForwarder struct {
+	lg        *zap.Logger
+	container *smContainer
+	peers     func(ip string) bool
+}
+
+func newGovernorForwarder(lg *zap.Logger, container *smContainer, peers func(ip string) bool) *governorForwarder {
+	return &governorForwarder{lg: lg, container: container, peers: peers}
+}
+
+func (f *governorForwarder) wrap(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if trustForwarded(f.lg, c, f.peers) {
+			handler(c)
+			return
+		}
+
+		// 参数错误和service不存在都交给handler处理
+		service := requestService(c)
+		if service == "" {
+			handler(c)
+			return
+		}
+		if _, err := f.container.GetShard(service); err == nil {
+			handler(c)
+			return
+		}
+
+		governor, err := f.container.governor(context.TODO(), service)
+		if err != nil {
+			f.lg.Error(
+				"get governor error",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("service", service),
+				zap.Error(err),
+			)
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		if governor == "" || governor == f.container.Id() {
+			handler(c)
+			return
+		}
+		forward(f.lg, f.container, c, governor)
+	}
+}
+
+// trustForwarded 请求带有转发标记并且来自sm节点时直接处理，其他来源的标记是伪造的，删除后按照普通请求转发，
+// 否则任意调用方都可以让非leader执行写请求
+func trustForwarded(lg *zap.Logger, c *gin.Context, peers func(ip string) bool) bool {
+	by := c.GetHeader(forwardedHeader)
+	if by == "" {
+		return false
+	}
+	if host := remoteHost(c); host != "" && peers != nil && peers(host) {
+		return true
+	}
+	lg.Warn(
+		"forward header from non sm peer, ignored",
+		zap.String("path", c.Request.URL.Path),
+		zap.String("remote", c.Request.RemoteAddr),
+		zap.String("forwardedBy", by),
+	)
+	c.Request.Header.Del(forwardedHeader)
+	return false
+}
+
+// forward 把请求代理给target，target处理时不再转发
+func forward(lg *zap.Logger, container *smContainer, c *gin.Context, target string) {
+	lg.Info(
+		"forward request",
+		zap.String("path", c.Request.URL.Path),
+		zap.String("target", target),
+	)
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: target})
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		lg.Error(
+			"forward request error",
+			zap.String("path", r.URL.Path),
+			zap.String("target", target),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, errCodeLeaderUnavailable, err)
+	}
+	c.Request.Header.Set(forwardedHeader, container.Id())
+	apputil.InjectTraceHeader(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	proxy.ServeHTTP(c.Writer, c.Request)
+	c.Abort()
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_leaderForwarder(t *testing.T) {
+	// leader收到的请求带有转发标记
+	leaderSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("leader " + r.Header.Get(forwardedHeader)))
+	}))
+	defer leaderSrv.Close()
+	leader := strings.TrimPrefix(leaderSrv.URL, "http://")
+
+	var tests = []struct {
+		leader    string
+		forwarded string
+		peer      bool
+		expect    string
+	}{
+		{leader: leader, expect: "leader 127.0.0.1:8888"},
+		{leader: "127.0.0.1:8888", expect: "local"},
+		// 非sm节点伪造的转发标记被忽略，仍然转发给leader
+		{leader: leader, forwarded: "forged", expect: "leader 127.0.0.1:8888"},
+		// sm节点转发过来的请求直接处理
+		{leader: leader, forwarded: "127.0.0.1:9999", peer: true, expect: "local"},
+	}
+	for _, tt := range tests {
+		lv := leaderEtcdValue{ContainerId: tt.leader}
+		client := new(MockedEtcdWrapper)
+		client.On("GetKV", mock.Anything, mock.Anything, mock.Anything).Return(
+			&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Value: []byte(lv.String())}}},
+			nil,
+		)
+		container := &smContainer{
+			lg:          ttLogger,
+			Container:   &apputil.Container{Client: client},
+			nodeManager: &nodeManager{smService: "foo", etcdPath: apputil.NewEtcdPath("")},
+		}
+		container.SetId("127.0.0.1:8888")
+
+		router := gin.New()
+		peer := tt.peer
+		peers := func(ip string) bool { return peer && ip == "127.0.0.1" }
+		router.POST("/sm/server/add-shard", newLeaderForwarder(ttLogger, container, peers).wrap(func(c *gin.Context) {
+			c.String(http.StatusOK, "local")
+		}))
+		// ReverseProxy依赖CloseNotifier，ResponseRecorder没有实现，这里启动真实的http server
+		srv := httptest.NewServer(router)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/sm/server/add-shard", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		if tt.forwarded != "" {
+			req.Header.Set(forwardedHeader, tt.forwarded)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, tt.expect, string(b))
+	}
+}
+
+func Test_governorForwarder(t *testing.T) {
+	// 负责service的container收到转发的请求，body保持不变
+	governorSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("governor " + string(b)))
+	}))
+	defer governorSrv.Close()
+	governor := strings.TrimPrefix(governorSrv.URL, "http://")
+
+	var tests = []struct {
+		governor  string
+		forwarded string
+		expect    string
+	}{
+		{governor: governor, expect: `governor {"service":"foo.bar"}`},
+		{governor: governor, forwarded: "forged", expect: `governor {"service":"foo.bar"}`},
+		{governor: "127.0.0.1:8888", expect: "local foo.bar"},
+		{governor: "", expect: "local foo.bar"},
+	}
+	for _, tt := range tests {
+		resp := &clientv3.GetResponse{}
+		if tt.governor != "" {
+			hb := apputil.ShardHeartbeat{ContainerId: tt.governor}
+			resp.Kvs = []*mvccpb.KeyValue{{Value: []byte(hb.String())}}
+		}
+		client := new(MockedEtcdWrapper)
+		client.On("GetKV", mock.Anything, apputil.NewEtcdPath("").AppShardHbId("foo", "foo.bar"), mock.Anything).Return(resp, nil)
+		container := &smContainer{
+			lg:          ttLogger,
+			Container:   &apputil.Container{Client: client},
+			nodeManager: &nodeManager{smService: "foo", etcdPath: apputil.NewEtcdPath("")},
+		}
+		container.SetId("127.0.0.1:8888")
+		container.SetService("foo")
+
+		router := gin.New()
+		router.POST("/sm/server/update-spec", newGovernorForwarder(ttLogger, container, nil).wrap(func(c *gin.Context) {
+			var req smAppSpec
+			_ = c.ShouldBind(&req)
+			c.String(http.StatusOK, "local "+req.Service)
+		}))
+		srv := httptest.NewServer(router)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/sm/server/update-spec", strings.NewReader(`{"service":"foo.bar"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if tt.forwarded != "" {
+			req.Header.Set(forwardedHeader, tt.forwarded)
+		}
+		httpResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		srv.Close()
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		assert.Equal(t, tt.expect, string(b))
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type freezeRequest struct {
+	Service string `json:"service" binding:"required"`
+
+	// Frozen false时解冻，下一轮balance检查恢复move
+	Frozen bool `json:"frozen"`
+}
+
+// @Description freeze or unfreeze rebalance of the service and its child services, a frozen service keeps watching state but issues no moves
+// @Tags  spec
+// @Accept  json
+// @Produce  json
+// @Param param body freezeRequest true "param"
+// @success 200
+// @Router /sm/server/freeze [post]
+func (ss *smShardApi) GinFreeze(c *gin.Context) {
+	var req freezeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	if code, err := ss.freezeService(context.TODO(), req.Service, req.Frozen, c.ClientIP()); err != nil {
+		apiErrorResponse(c, code, err)
+		return
+	}
+
+	// 子service的冻结状态跟随父service
+	results, err := ss.cascade(c, req.Service, func(child string) interface{} {
+		return freezeRequest{Service: child, Frozen: req.Frozen}
+	}, func(ctx context.Context, child string) (errCode, error) {
+		return ss.freezeService(ctx, child, req.Frozen, c.ClientIP())
+	})
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if err := cascadeError(results); err != nil {
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cascade": results})
+}
+
+// freezeService 持久化service的冻结状态并同步到本节点负责该service的smShard
+func (ss *smShardApi) freezeService(ctx context.Context, service string, frozen bool, actor string) (errCode, error) {
+	shard, err := ss.container.GetShard(service)
+	if err != nil {
+		ss.lg.Error(
+			"shard not found",
+			zap.String("service", service),
+		)
+		return errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", service)
+	}
+
+	// 只修改frozen，其他配置保持不变，通过revision防止覆盖并发的update-spec
+	pfx := ss.container.nodeManager.nodeServiceSpec(service)
+	resp, err := ss.container.Client.GetKV(ctx, pfx, nil)
+	if err != nil {
+		return etcdErrCode(err, errCodeInternal), err
+	}
+	if resp.Count == 0 {
+		return errCodeServiceNotFound, errors.Errorf("service[%s] not exist", service)
+	}
+	var spec smAppSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &spec); err != nil {
+		return errCodeInternal, err
+	}
+	spec.Frozen = frozen
+	if err := ss.container.Client.UpdateKVWithRevision(ctx, pfx, spec.String(), resp.Kvs[0].ModRevision); err != nil {
+		ss.lg.Error("UpdateKVWithRevision err",
+			zap.String("pfx", pfx),
+			zap.Error(err),
+		)
+		return etcdErrCode(err, errCodeInternal), err
+	}
+	shard.SetFrozen(frozen)
+
+	ss.container.events.append(eventSpecChange, service, actor, fmt.Sprintf("frozen %t", frozen))
+	ss.lg.Info(
+		"freeze success",
+		zap.String("service", service),
+		zap.Bool("frozen", frozen),
+	)
+	return "", nil
+}
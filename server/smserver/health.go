@@ -0,0 +1,117 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultProbeFailures 连续探测失败的次数达到阈值，container被认为不健康
+	defaultProbeFailures = 3
+
+	defaultProbeTimeout = time.Second
+)
+
+// healthProber 通过http探测container是否可以正常工作，进程卡住时etcd的lease仍然可能正常续约
+type healthProber struct {
+	lg *zap.Logger
+
+	httpClient *http.Client
+
+	// probe 4 unit test
+	probe func(ctx context.Context, containerId string) error
+
+	mu sync.Mutex
+	// failures container连续探测失败的次数
+	failures map[string]int
+}
+
+func newHealthProber(lg *zap.Logger) *healthProber {
+	p := healthProber{
+		lg:         lg,
+		httpClient: newHttpClient(),
+		failures:   make(map[string]int),
+	}
+	p.probe = p.httpProbe
+	return &p
+}
+
+// httpProbe container的id就是container对外提供http服务的地址
+func (p *healthProber) httpProbe(ctx context.Context, containerId string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/sm/admin/health", containerId), nil)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// check 探测所有container，清理掉已经不存在的container
+func (p *healthProber) check(ctx context.Context, containerIds []string) {
+	result := make(map[string]error)
+	for _, id := range containerIds {
+		result[id] = p.probe(ctx, id)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	failures := make(map[string]int)
+	for id, err := range result {
+		if err == nil {
+			continue
+		}
+		failures[id] = p.failures[id] + 1
+		p.lg.Warn(
+			"probe failed",
+			zap.String("containerId", id),
+			zap.Int("failures", failures[id]),
+			zap.Error(err),
+		)
+	}
+	p.failures = failures
+}
+
+// unhealthy 返回连续探测失败达到阈值的container
+func (p *healthProber) unhealthy() map[string]struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := make(map[string]struct{})
+	for id, cnt := range p.failures {
+		if cnt >= defaultProbeFailures {
+			r[id] = struct{}{}
+		}
+	}
+	return r
+}
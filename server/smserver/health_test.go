@@ -0,0 +1,41 @@
+package smserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+func Test_healthProber(t *testing.T) {
+	lg, _ := zap.NewDevelopment()
+	p := newHealthProber(lg)
+	p.probe = func(ctx context.Context, containerId string) error {
+		if containerId == "c2" {
+			return errors.New("timeout")
+		}
+		return nil
+	}
+
+	for i := 0; i < defaultProbeFailures-1; i++ {
+		p.check(context.TODO(), []string{"c1", "c2"})
+	}
+	if len(p.unhealthy()) != 0 {
+		t.Errorf("expect no unhealthy container")
+		t.SkipNow()
+	}
+
+	p.check(context.TODO(), []string{"c1", "c2"})
+	if _, ok := p.unhealthy()["c2"]; !ok || len(p.unhealthy()) != 1 {
+		t.Errorf("expect c2 unhealthy, actual %v", p.unhealthy())
+		t.SkipNow()
+	}
+
+	// 恢复后重新参与分配
+	p.probe = func(ctx context.Context, containerId string) error { return nil }
+	p.check(context.TODO(), []string{"c1", "c2"})
+	if len(p.unhealthy()) != 0 {
+		t.Errorf("expect no unhealthy container")
+	}
+}
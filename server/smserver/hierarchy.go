@@ -0,0 +1,329 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+// cascadedHeader 父service的操作分发给子service的governor时设置，收到的节点只处理请求中的service，不再继续分发
+const cascadedHeader = "X-SM-Cascaded"
+
+// serviceTree 通过spec中的parent把多个service组织成树，一个产品由多个app组成时可以整体操作
+type serviceTree struct {
+	// parents key是service，value是spec中的parent，没有parent时为空
+	parents map[string]string
+
+	// children 只包含parent存在的service，parent被删除的service作为根节点
+	children map[string][]string
+}
+
+func newServiceTree(specs []*smAppSpec) *serviceTree {
+	t := serviceTree{parents: make(map[string]string), children: make(map[string][]string)}
+	for _, spec := range specs {
+		t.parents[spec.Service] = spec.Parent
+	}
+	for service, parent := range t.parents {
+		if _, ok := t.parents[parent]; ok && parent != service {
+			t.children[parent] = append(t.children[parent], service)
+		}
+	}
+	for _, children := range t.children {
+		sort.Strings(children)
+	}
+	return &t
+}
+
+// descendants 按层返回service的所有子孙，父service总是在子service之前，不包含service本身
+func (t *serviceTree) descendants(service string) []string {
+	var r []string
+	visited := map[string]struct{}{service: {}}
+	queue := []string{service}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, child := range t.children[cur] {
+			// 并发的update-spec可能短暂形成环
+			if _, ok := visited[child]; ok {
+				continue
+			}
+			visited[child] = struct{}{}
+			r = append(r, child)
+			queue = append(queue, child)
+		}
+	}
+	return r
+}
+
+// checkParent parent必须已经存在，并且不能是service自己或者service的子孙
+func (t *serviceTree) checkParent(service, parent string) error {
+	if parent == "" {
+		return nil
+	}
+	if parent == service {
+		return errors.Errorf("service[%s] can not be parent of itself", service)
+	}
+	if _, ok := t.parents[parent]; !ok {
+		return errors.Errorf("parent service[%s] not exist", parent)
+	}
+	visited := make(map[string]struct{})
+	for p := parent; p != ""; p = t.parents[p] {
+		if p == service {
+			return errors.Errorf("parent service[%s] is descendant of service[%s]", parent, service)
+		}
+		if _, ok := visited[p]; ok {
+			break
+		}
+		visited[p] = struct{}{}
+	}
+	return nil
+}
+
+// serviceSpecs 返回sm管理的所有service的spec，按照service排序
+func (ss *smShardApi) serviceSpecs(ctx context.Context) ([]*smAppSpec, error) {
+	// /sm/app/foo.bar/service/proxy.dev/spec
+	pfx := ss.container.nodeManager.nodeSM() + "/service/"
+	resp, err := ss.container.Client.GetKV(ctx, pfx, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	specs := make([]*smAppSpec, 0)
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if path.Base(key) != "spec" || path.Dir(path.Dir(key))+"/" != pfx {
+			continue
+		}
+		var spec smAppSpec
+		if err := json.Unmarshal(kv.Value, &spec); err != nil {
+			ss.lg.Warn("unexpected spec",
+				zap.String("key", key),
+				zap.Error(err),
+			)
+			continue
+		}
+		spec.Revision = kv.ModRevision
+		specs = append(specs, &spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Service < specs[j].Service })
+	return specs, nil
+}
+
+func (ss *smShardApi) serviceTree(ctx context.Context) (*serviceTree, error) {
+	specs, err := ss.serviceSpecs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newServiceTree(specs), nil
+}
+
+// checkParent add-spec和update-spec时校验parent，没有parent时不读取etcd
+func (ss *smShardApi) checkParent(ctx context.Context, spec *smAppSpec) (errCode, error) {
+	if spec.Parent == "" {
+		return "", nil
+	}
+	tree, err := ss.serviceTree(ctx)
+	if err != nil {
+		return etcdErrCode(err, errCodeInternal), err
+	}
+	if err := tree.checkParent(spec.Service, spec.Parent); err != nil {
+		return errCodeParam, err
+	}
+	return "", nil
+}
+
+// cascadeResult 父service的操作在一个子service上的结果
+type cascadeResult struct {
+	Service string `json:"service"`
+	Error   string `json:"error,omitempty"`
+}
+
+// cascadeError 汇总失败的子service，全部成功时返回nil
+func cascadeError(results []*cascadeResult) error {
+	var failed []string
+	for _, r := range results {
+		if r.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.Service, r.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.Errorf("cascade to children failed: %s", strings.Join(failed, "; "))
+}
+
+// cascade 在service的所有子孙上执行同一个操作，本节点负责的子service直接调用local，
+// 其他子service以body为请求体转发给各自的governor，请求是分发过来的时候不再继续分发
+func (ss *smShardApi) cascade(
+	c *gin.Context,
+	service string,
+	body func(child string) interface{},
+	local func(ctx context.Context, child string) (errCode, error)) ([]*cascadeResult, error) {
+	if c.GetHeader(cascadedHeader) != "" {
+		return nil, nil
+	}
+	ctx := c.Request.Context()
+	tree, err := ss.serviceTree(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*cascadeResult, 0)
+	for _, child := range tree.descendants(service) {
+		r := cascadeResult{Service: child}
+		results = append(results, &r)
+
+		// 开启鉴权时，子service也需要有权限
+		if !authorized(c, child) {
+			r.Error = "forbidden"
+			continue
+		}
+		if _, err := ss.container.GetShard(child); err == nil {
+			if _, err := local(ctx, child); err != nil {
+				r.Error = err.Error()
+			}
+			continue
+		}
+		if err := ss.cascadeRemote(c, child, body(child)); err != nil {
+			r.Error = err.Error()
+		}
+	}
+	ss.lg.Info(
+		"cascade to children",
+		zap.String("path", c.Request.URL.Path),
+		zap.String("service", service),
+		zap.Reflect("results", results),
+	)
+	return results, nil
+}
+
+// cascadeRemote 子service由其他sm container负责时，把请求发送给它的governor
+func (ss *smShardApi) cascadeRemote(c *gin.Context, child string, body interface{}) error {
+	governor, err := ss.container.governor(c.Request.Context(), child)
+	if err != nil {
+		return err
+	}
+	if governor == "" {
+		return errors.New("governor not found")
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	url := fmt.Sprintf("http://%s%s", governor, c.Request.URL.Path)
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range []string{headerToken, "Authorization"} {
+		if v := c.GetHeader(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set(cascadedHeader, ss.container.Id())
+	req.Header.Set(forwardedHeader, ss.container.Id())
+	apputil.InjectTraceHeader(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	resp, err := ss.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return nil
+	}
+	rb, _ := ioutil.ReadAll(resp.Body)
+	var apiErr apiError
+	if err := json.Unmarshal(rb, &apiErr); err == nil && apiErr.Error != "" {
+		return errors.New(apiErr.Error)
+	}
+	return errors.Errorf("governor %s status %d", governor, resp.StatusCode)
+}
+
+type drainServiceRequest struct {
+	Service string `json:"service" binding:"required"`
+}
+
+// @Description freeze the service and its child services and drop all assigned shards from containers, use freeze with frozen false to undo
+// @Tags  spec
+// @Accept  json
+// @Produce  json
+// @Param param body drainServiceRequest true "param"
+// @success 200
+// @Router /sm/server/drain-service [post]
+func (ss *smShardApi) GinDrainService(c *gin.Context) {
+	var req drainServiceRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	if code, err := ss.drainService(c.Request.Context(), req.Service, c.ClientIP()); err != nil {
+		apiErrorResponse(c, code, err)
+		return
+	}
+	results, err := ss.cascade(c, req.Service, func(child string) interface{} {
+		return drainServiceRequest{Service: child}
+	}, func(ctx context.Context, child string) (errCode, error) {
+		return ss.drainService(ctx, child, c.ClientIP())
+	})
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if err := cascadeError(results); err != nil {
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cascade": results})
+}
+
+// drainService 先持久化冻结状态，leader切换后也不会把drop的shard重新分配出去
+func (ss *smShardApi) drainService(ctx context.Context, service string, actor string) (errCode, error) {
+	if code, err := ss.freezeService(ctx, service, true, actor); err != nil {
+		return code, err
+	}
+	shard, err := ss.container.GetShard(service)
+	if err != nil {
+		return errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", service)
+	}
+	failed, err := shard.DropAll(ctx)
+	if err != nil {
+		return errCodeInternal, err
+	}
+	if len(failed) > 0 {
+		return errCodeInternal, errors.Errorf("service[%s] drop shards %v failed", service, failed)
+	}
+	ss.container.events.append(eventSpecChange, service, actor, "drain")
+	ss.lg.Info("drain success", zap.String("service", service))
+	return "", nil
+}
@@ -0,0 +1,31 @@
+package smserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_serviceTree(t *testing.T) {
+	tree := newServiceTree([]*smAppSpec{
+		{Service: "suite"},
+		{Service: "api", Parent: "suite"},
+		{Service: "worker", Parent: "suite"},
+		{Service: "cron", Parent: "worker"},
+		// parent被删除后作为根节点
+		{Service: "orphan", Parent: "deleted"},
+	})
+
+	assert.Equal(t, []string{"api", "worker", "cron"}, tree.descendants("suite"))
+	assert.Equal(t, []string{"cron"}, tree.descendants("worker"))
+	assert.Nil(t, tree.descendants("orphan"))
+	assert.Nil(t, tree.descendants("deleted"))
+
+	assert.Nil(t, tree.checkParent("new", ""))
+	assert.Nil(t, tree.checkParent("new", "cron"))
+	assert.Nil(t, tree.checkParent("orphan", "suite"))
+	assert.NotNil(t, tree.checkParent("new", "deleted"))
+	assert.NotNil(t, tree.checkParent("suite", "suite"))
+	assert.NotNil(t, tree.checkParent("suite", "cron"))
+	assert.NotNil(t, tree.checkParent("worker", "cron"))
+}
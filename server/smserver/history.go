@@ -0,0 +1,231 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// moveReason 触发move的原因，随move持久化，出现在分配历史、事件和 /debug/vars 中
+type moveReason string
+
+const (
+	// moveReasonContainerLost container丢失，shard重新分配
+	moveReasonContainerLost moveReason = "container-lost"
+	// moveReasonLoadImbalance container之间shard数量或者负载不均衡，从一个container迁移到另一个
+	moveReasonLoadImbalance moveReason = "load-imbalance"
+	// moveReasonManual 通过api指定container或者重新入队的move
+	moveReasonManual moveReason = "manual"
+	// moveReasonSpecChange shard新增或者删除
+	moveReasonSpecChange moveReason = "spec-change"
+	// moveReasonDrain container准备退出，shard迁移走
+	moveReasonDrain moveReason = "drain"
+	// moveReasonReconcile reconciler发现实际分配和期望不一致
+	moveReasonReconcile moveReason = "reconcile"
+)
+
+// classifyMove 根据触发move的事件和move本身判断原因，shard固定在目标container上时属于人工指定，
+// draining 是准备退出的container
+func classifyMove(typ workerEventType, ma *moveAction, draining map[string]struct{}) moveReason {
+	if ma.Spec != nil && ma.Spec.ManualContainerId != "" && ma.Spec.ManualContainerId == ma.AddEndpoint {
+		return moveReasonManual
+	}
+	switch typ {
+	case workerEventRequeue:
+		return moveReasonManual
+	case workerEventReconcile:
+		return moveReasonReconcile
+	}
+	if _, ok := draining[ma.DropEndpoint]; ok && ma.DropEndpoint != "" {
+		return moveReasonDrain
+	}
+	// 只有add或者只有drop：container丢失后shard没有所在的container，或者shard本身新增、删除
+	if ma.DropEndpoint == "" || ma.AddEndpoint == "" {
+		if typ == workerEventContainerChanged {
+			return moveReasonContainerLost
+		}
+		return moveReasonSpecChange
+	}
+	return moveReasonLoadImbalance
+}
+
+// moveReasonStats 按照原因统计成功和失败的move，通过 /debug/vars 查看
+type moveReasonStats struct {
+	mu    sync.Mutex
+	succ  map[moveReason]int64
+	fails map[moveReason]int64
+}
+
+func newMoveReasonStats() *moveReasonStats {
+	return &moveReasonStats{succ: make(map[moveReason]int64), fails: make(map[moveReason]int64)}
+}
+
+func (s *moveReasonStats) record(ma *moveAction, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.fails[ma.Reason]++
+	} else {
+		s.succ[ma.Reason]++
+	}
+}
+
+// snapshot 返回原因到成功和失败次数的映射
+func (s *moveReasonStats) snapshot() map[moveReason]*moveReasonCount {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make(map[moveReason]*moveReasonCount)
+	get := func(reason moveReason) *moveReasonCount {
+		c, ok := r[reason]
+		if !ok {
+			c = &moveReasonCount{}
+			r[reason] = c
+		}
+		return c
+	}
+	for reason, n := range s.succ {
+		get(reason).Succ = n
+	}
+	for reason, n := range s.fails {
+		get(reason).Fails = n
+	}
+	return r
+}
+
+type moveReasonCount struct {
+	Succ  int64 `json:"succ"`
+	Fails int64 `json:"fails"`
+}
+
+// shardHistoryEntry shard被分配到一个container的记录
+type shardHistoryEntry struct {
+	ContainerId string `json:"containerId"`
+
+	// From 分配之前所在的container，新分配的shard为空
+	From string `json:"from,omitempty"`
+
+	Reason moveReason `json:"reason"`
+
+	// Timestamp unix秒，add成功的时间
+	Timestamp int64 `json:"timestamp"`
+}
+
+// shardHistoryStore 记录shard分配过的container，每个shard一个节点，只保留最近size条，排查shard在container之间反复移动的问题
+type shardHistoryStore struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	nodeManager *nodeManager
+
+	// size 每个shard保留的记录数量
+	size int
+}
+
+func newShardHistoryStore(lg *zap.Logger, client etcdutil.EtcdWrapper, nodeManager *nodeManager) *shardHistoryStore {
+	return &shardHistoryStore{lg: lg, client: client, nodeManager: nodeManager, size: defaultShardHistorySize}
+}
+
+// setSize <=0时使用默认值
+func (s *shardHistoryStore) setSize(size int) {
+	if size <= 0 {
+		size = defaultShardHistorySize
+	}
+	s.size = size
+}
+
+// record move成功后调用，单纯的drop不记录，写入失败只打印日志，不影响move
+func (s *shardHistoryStore) record(ma *moveAction) {
+	if s == nil || ma.AddEndpoint == "" {
+		return
+	}
+	entries, err := s.get(context.TODO(), ma.Service, ma.ShardId)
+	if err != nil {
+		s.lg.Error("get shard history error", zap.String("shardId", ma.ShardId), zap.Error(err))
+		return
+	}
+	entries = append(entries, &shardHistoryEntry{
+		ContainerId: ma.AddEndpoint,
+		From:        ma.DropEndpoint,
+		Reason:      ma.Reason,
+		Timestamp:   time.Now().Unix(),
+	})
+	if len(entries) > s.size {
+		entries = entries[len(entries)-s.size:]
+	}
+
+	b, _ := json.Marshal(entries)
+	key := s.nodeManager.nodeServiceShardHistory(ma.Service) + ma.ShardId
+	if _, err := s.client.Put(context.TODO(), key, string(b)); err != nil {
+		s.lg.Error(
+			"put shard history error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+	}
+}
+
+// get 按照时间顺序返回，没有记录时返回nil
+func (s *shardHistoryStore) get(ctx context.Context, service string, shardId string) ([]*shardHistoryEntry, error) {
+	resp, err := s.client.GetKV(ctx, s.nodeManager.nodeServiceShardHistory(service)+shardId, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	var entries []*shardHistoryEntry
+	if err := json.Unmarshal(resp.Kvs[0].Value, &entries); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return entries, nil
+}
+
+// list 返回shard和副本的记录，key是shard id
+func (s *shardHistoryStore) list(ctx context.Context, service string, shardId string, spec *apputil.ShardSpec) (map[string][]*shardHistoryEntry, error) {
+	if s == nil {
+		return nil, nil
+	}
+	// expandReplicas会修改spec
+	cp := *spec
+	var ids []string
+	for id := range expandReplicas(shardId, &cp) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	r := make(map[string][]*shardHistoryEntry)
+	for _, id := range ids {
+		entries, err := s.get(ctx, service, id)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		r[id] = entries
+	}
+	return r, nil
+}
@@ -0,0 +1,71 @@
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/mock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_classifyMove(t *testing.T) {
+	draining := map[string]struct{}{"c3": {}}
+	var tests = []struct {
+		typ    workerEventType
+		ma     *moveAction
+		expect moveReason
+	}{
+		{typ: workerEventShardChanged, ma: &moveAction{AddEndpoint: "c1", Spec: &apputil.ShardSpec{}}, expect: moveReasonSpecChange},
+		{typ: workerEventShardChanged, ma: &moveAction{DropEndpoint: "c1"}, expect: moveReasonSpecChange},
+		{typ: workerEventShardChanged, ma: &moveAction{DropEndpoint: "c1", AddEndpoint: "c2"}, expect: moveReasonLoadImbalance},
+		{typ: workerEventContainerChanged, ma: &moveAction{AddEndpoint: "c1"}, expect: moveReasonContainerLost},
+		{typ: workerEventContainerChanged, ma: &moveAction{DropEndpoint: "c1", AddEndpoint: "c2"}, expect: moveReasonLoadImbalance},
+		{typ: workerEventContainerChanged, ma: &moveAction{DropEndpoint: "c3", AddEndpoint: "c2"}, expect: moveReasonDrain},
+		{typ: workerEventRequeue, ma: &moveAction{AddEndpoint: "c1"}, expect: moveReasonManual},
+		{typ: workerEventReconcile, ma: &moveAction{DropEndpoint: "c3"}, expect: moveReasonReconcile},
+		{typ: workerEventShardChanged, ma: &moveAction{AddEndpoint: "c1", Spec: &apputil.ShardSpec{ManualContainerId: "c1"}}, expect: moveReasonManual},
+	}
+	for idx, tt := range tests {
+		if r := classifyMove(tt.typ, tt.ma, draining); r != tt.expect {
+			t.Errorf("idx: %d expect %s actual %s", idx, tt.expect, r)
+		}
+	}
+}
+
+func Test_shardHistoryStore(t *testing.T) {
+	nm := &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")}
+	client := new(MockedEtcdWrapper)
+	resp := memShardState(client)
+	s := newShardHistoryStore(ttLogger, client, nm)
+	s.setSize(2)
+
+	// drop不记录
+	s.record(&moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c1"})
+	if resp.Count != 0 {
+		t.Errorf("drop should not be recorded")
+	}
+
+	s.record(&moveAction{Service: "foo.bar", ShardId: "s1", AddEndpoint: "c1", Reason: moveReasonLoadImbalance})
+	s.record(&moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2", Reason: moveReasonContainerLost})
+	s.record(&moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c2", AddEndpoint: "c1", Reason: moveReasonManual})
+
+	// 只保留最近2条
+	var entries []*shardHistoryEntry
+	_ = json.Unmarshal(resp.Kvs[0].Value, &entries)
+	if len(entries) != 2 || entries[0].ContainerId != "c2" || entries[0].Reason != moveReasonContainerLost || entries[1].From != "c2" || entries[1].Reason != moveReasonManual {
+		t.Errorf("unexpected entries %v", string(resp.Kvs[0].Value))
+	}
+	if string(resp.Kvs[0].Key) != "/sm/app/sm/service/foo.bar/history/s1" {
+		t.Errorf("unexpected key %s", resp.Kvs[0].Key)
+	}
+
+	// 没有记录的副本返回nil
+	s = newShardHistoryStore(ttLogger, new(MockedEtcdWrapper), nm)
+	s.client.(*MockedEtcdWrapper).On("GetKV", mock.Anything, mock.Anything, mock.Anything).Return(&clientv3.GetResponse{}, nil)
+	list, err := s.list(context.TODO(), "foo.bar", "s2", &apputil.ShardSpec{ReplicaCount: 2})
+	if err != nil || len(list) != 2 || list["s2"] != nil {
+		t.Errorf("unexpected list %v err %v", list, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+
+	// headerIdempotentReplayed 返回缓存结果时设置，调用方可以区分首次执行和重放
+	headerIdempotentReplayed = "Idempotent-Replayed"
+
+	// defaultIdempotencyWindow 相同key的请求在这个时间内返回第一次的结果
+	defaultIdempotencyWindow = time.Hour
+
+	// maxIdempotencyKeys 记录的key数量超过后先清理过期的，仍然超过时拒绝新的key，防止撑大内存
+	maxIdempotencyKeys = 10000
+)
+
+// idempotencyEntry 第一次请求的payload摘要和返回，done为false时第一次请求还在执行
+type idempotencyEntry struct {
+	digest   string
+	done     bool
+	status   int
+	header   http.Header
+	body     []byte
+	expireAt time.Time
+}
+
+// apiIdempotency 带 Idempotency-Key 的修改类请求在window内只执行一次，重试时返回第一次的结果，
+// 在leader转发之后执行，开启leader forwarding时所有节点收到的重试都由leader判断
+type apiIdempotency struct {
+	lg     *zap.Logger
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+func newApiIdempotency(lg *zap.Logger, window time.Duration) *apiIdempotency {
+	if window <= 0 {
+		window = defaultIdempotencyWindow
+	}
+	return &apiIdempotency{lg: lg, window: window, entries: make(map[string]*idempotencyEntry)}
+}
+
+func (a *apiIdempotency) wrap(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(headerIdempotencyKey)
+		if key == "" {
+			handler(c)
+			return
+		}
+		// 不同调用方使用相同的key互不影响
+		key = apiCaller(c) + "|" + c.Request.URL.Path + "|" + key
+		digest := payloadDigest(c)
+
+		entry, err := a.begin(key, digest, time.Now())
+		if err != nil {
+			a.lg.Warn(
+				"idempotency key rejected",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("key", c.GetHeader(headerIdempotencyKey)),
+				zap.Error(err),
+			)
+			apiErrorResponse(c, errCodeConflict, err)
+			return
+		}
+		if entry != nil {
+			for k, v := range entry.header {
+				c.Writer.Header()[k] = v
+			}
+			c.Header(headerIdempotentReplayed, "true")
+			c.Status(entry.status)
+			c.Writer.Write(entry.body)
+			return
+		}
+
+		w := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		// handler panic时gin的recovery会返回500，key不能一直停留在执行中的状态，按照5xx删除允许重试
+		finished := false
+		defer func() {
+			if !finished {
+				c.Writer = w.ResponseWriter
+				a.finish(key, http.StatusInternalServerError, nil, nil, time.Now())
+			}
+		}()
+		handler(c)
+		finished = true
+		c.Writer = w.ResponseWriter
+		a.finish(key, w.Status(), w.Header().Clone(), w.body.Bytes(), time.Now())
+	}
+}
+
+// begin 第一次出现的key返回nil，调用方执行请求后调用finish，已经完成的key返回第一次的结果
+func (a *apiIdempotency) begin(key string, digest string, now time.Time) (*idempotencyEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if entry, ok := a.entries[key]; ok && now.Before(entry.expireAt) {
+		if entry.digest != digest {
+			return nil, errors.New("idempotency key reused with a different payload")
+		}
+		if !entry.done {
+			return nil, errors.New("request with the same idempotency key in progress")
+		}
+		return entry, nil
+	}
+
+	if len(a.entries) >= maxIdempotencyKeys {
+		for k, entry := range a.entries {
+			if entry.done && !now.Before(entry.expireAt) {
+				delete(a.entries, k)
+			}
+		}
+		if len(a.entries) >= maxIdempotencyKeys {
+			return nil, errors.New("too many idempotency keys")
+		}
+	}
+	a.entries[key] = &idempotencyEntry{digest: digest, expireAt: now.Add(a.window)}
+	return nil, nil
+}
+
+// finish 5xx代表请求没有确定的结果，删除key允许重试重新执行
+func (a *apiIdempotency) finish(key string, status int, header http.Header, body []byte, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if status >= http.StatusInternalServerError {
+		delete(a.entries, key)
+		return
+	}
+	entry, ok := a.entries[key]
+	if !ok {
+		return
+	}
+	entry.done = true
+	entry.status = status
+	entry.header = header
+	entry.body = body
+	entry.expireAt = now.Add(a.window)
+}
+
+// responseRecorder 写给客户端的同时保存body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,92 @@
+package smserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_apiIdempotency_wrap(t *testing.T) {
+	var calls int
+	status := http.StatusOK
+	router := gin.New()
+	router.POST("/sm/server/add-shard", newApiIdempotency(ttLogger, 0).wrap(func(c *gin.Context) {
+		calls++
+		c.JSON(status, gin.H{"calls": calls})
+	}))
+
+	do := func(key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set(headerIdempotencyKey, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 相同key和payload的重试返回第一次的结果，不再执行
+	w := do("k1", `{"service":"foo"}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"calls":1}` {
+		t.Errorf("unexpected first response %d %s", w.Code, w.Body.String())
+		t.SkipNow()
+	}
+	w = do("k1", `{"service":"foo"}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"calls":1}` || w.Header().Get(headerIdempotentReplayed) != "true" {
+		t.Errorf("expect replay, actual %d %s", w.Code, w.Body.String())
+		t.SkipNow()
+	}
+
+	// 相同key不同payload拒绝
+	if w = do("k1", `{"service":"bar"}`); w.Code != http.StatusConflict {
+		t.Errorf("expect conflict, actual %d", w.Code)
+		t.SkipNow()
+	}
+
+	// 没有key每次都执行
+	do("", `{"service":"foo"}`)
+	if calls != 2 {
+		t.Errorf("expect 2 calls, actual %d", calls)
+		t.SkipNow()
+	}
+
+	// 5xx不缓存，重试重新执行
+	status = http.StatusInternalServerError
+	do("k2", `{"service":"foo"}`)
+	status = http.StatusOK
+	if w = do("k2", `{"service":"foo"}`); w.Code != http.StatusOK || calls != 4 {
+		t.Errorf("expect retried after 5xx, actual %d calls %d", w.Code, calls)
+	}
+}
+
+func Test_apiIdempotency_panic(t *testing.T) {
+	var calls int
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.POST("/sm/server/add-shard", newApiIdempotency(ttLogger, 0).wrap(func(c *gin.Context) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		c.JSON(http.StatusOK, gin.H{"calls": calls})
+	}))
+
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/sm/server/add-shard", bytes.NewBufferString(`{"service":"foo"}`))
+		req.Header.Set(headerIdempotencyKey, "k1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(); w.Code != http.StatusInternalServerError {
+		t.Errorf("expect 500, actual %d", w.Code)
+	}
+	// panic之后key不能停留在执行中，重试重新执行
+	if w := do(); w.Code != http.StatusOK || calls != 2 {
+		t.Errorf("expect retry executed, actual %d calls %d", w.Code, calls)
+	}
+}
@@ -1,6 +1,7 @@
 package smserver
 
 import (
+	"context"
 	"io"
 
 	"github.com/entertainment-venue/sm/pkg/apputil"
@@ -11,6 +12,12 @@ type ShardWrapper interface {
 	NewShard(c *smContainer, spec *apputil.ShardSpec) (Shard, error)
 }
 
+// TaskUpdater Shard可选实现，task变更时在运行中更新，不需要Close后重新创建，
+// 返回错误时container回退到Close后重新创建
+type TaskUpdater interface {
+	UpdateTask(task string) error
+}
+
 // Shard 4 unit test
 type Shard interface {
 	io.Closer
@@ -21,4 +28,42 @@ type Shard interface {
 	// 下面是SM的Shard特定的
 	SetMaxShardCount(maxShardCount int)
 	SetMaxRecoveryTime(maxRecoveryTime int)
+	SetMinimizeMovement(minimizeMovement bool)
+	SetMaxShardsPerContainer(maxShardsPerContainer int)
+	SetHealthProbe(healthProbe bool)
+	SetSpreadPolicy(spreadPolicy string)
+	SetDeploymentPolicy(deploymentPolicy string)
+	SetFrozen(frozen bool)
+	SetAssignor(assignor string)
+	SetMoveConcurrency(moveConcurrency int)
+	SetCanary(canary *canarySpec)
+	SetWarmup(warmup *warmupSpec)
+	SetMoveCooldown(moveCooldown int)
+	SetRebalanceInterval(rebalanceInterval int)
+	SetRebalanceDebounce(rebalanceDebounce int)
+	SetRebalanceWindows(rebalanceWindows []string)
+
+	// Frozen 冻结的service不下发move
+	Frozen() bool
+
+	// RebalancePlan 计算当前需要的shard移动，不执行
+	RebalancePlan(ctx context.Context) (moveActionList, error)
+
+	// UnassignedShards 因为container上限没有分配出去的shard
+	UnassignedShards() []string
+
+	// Reservations container声明的资源和shard预留的资源
+	Reservations() *serviceReservations
+
+	// Explain shard为什么在当前的container上
+	Explain(ctx context.Context, shardId string) (*shardExplanation, error)
+
+	// Requeue 重新执行dead letter中的move
+	Requeue(mals moveActionList)
+
+	// TriggerRebalance 立即执行一次rebalance检查，不等待周期
+	TriggerRebalance(ctx context.Context) error
+
+	// DropAll 删除service之前把shard从container上drop，返回drop失败的shard
+	DropAll(ctx context.Context) ([]string, error)
 }
@@ -0,0 +1,247 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// orphanHeartbeat 没有绑定lease的containerhb/shardhb节点，lease过期时不会被etcd删除
+	orphanHeartbeat = "heartbeat"
+	// orphanAssignment watch模式下已经不存活的container的assignment节点
+	orphanAssignment = "assignment"
+	// orphanService 已经删除spec的service残留的节点
+	orphanService = "service"
+)
+
+// janitorStats 当前leader任期内的清理结果
+type janitorStats struct {
+	// LastSweep 最近一次扫描的时间，unix秒
+	LastSweep int64 `json:"lastSweep"`
+	// Pending 已经发现但还没有达到maxAge的孤儿节点数量
+	Pending int `json:"pending"`
+	// Reclaimed 按照类型统计删除的节点数量
+	Reclaimed map[string]int64 `json:"reclaimed"`
+}
+
+// janitor leader定期清理etcd中的孤儿节点，节点第一次被发现后持续maxAge仍然是孤儿才删除，
+// 发现时间只保存在内存中，leader切换后重新计时，宁可晚删不误删
+type janitor struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	nodeManager *nodeManager
+
+	mu sync.Mutex
+	// maxAge 为0时不清理
+	maxAge time.Duration
+	// seen 孤儿节点第一次被发现的时间
+	seen  map[string]time.Time
+	stats janitorStats
+}
+
+func newJanitor(lg *zap.Logger, client etcdutil.EtcdWrapper, nodeManager *nodeManager) *janitor {
+	return &janitor{
+		lg:          lg,
+		client:      client,
+		nodeManager: nodeManager,
+		seen:        make(map[string]time.Time),
+		stats:       janitorStats{Reclaimed: make(map[string]int64)},
+	}
+}
+
+func (j *janitor) setMaxAge(maxAge time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.maxAge = maxAge
+}
+
+// sweep 扫描所有service的节点，删除超过maxAge的孤儿节点，单个节点删除失败不影响其他节点
+func (j *janitor) sweep(ctx context.Context) error {
+	j.mu.Lock()
+	maxAge := j.maxAge
+	j.mu.Unlock()
+	if maxAge <= 0 {
+		return nil
+	}
+
+	appPfx := j.nodeManager.etcdPath.AppPrefix("")
+	resp, err := j.client.GetKV(ctx, appPfx, []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithKeysOnly()})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	orphans := findOrphans(resp.Kvs, appPfx, j.nodeManager.smService)
+
+	for key, kind := range j.due(orphans, maxAge, time.Now()) {
+		if _, err := j.client.Delete(ctx, key); err != nil {
+			j.lg.Error(
+				"delete orphan error",
+				zap.String("key", key),
+				zap.String("kind", kind),
+				zap.Error(err),
+			)
+			continue
+		}
+		j.reclaimed(key, kind)
+		j.lg.Info(
+			"orphan reclaimed",
+			zap.String("key", key),
+			zap.String("kind", kind),
+		)
+	}
+	return nil
+}
+
+// due 记录新发现的孤儿节点，返回持续时间超过maxAge的节点，不再是孤儿的节点重新计时
+func (j *janitor) due(orphans map[string]string, maxAge time.Duration, now time.Time) map[string]string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for key := range j.seen {
+		if _, ok := orphans[key]; !ok {
+			delete(j.seen, key)
+		}
+	}
+	r := make(map[string]string)
+	for key, kind := range orphans {
+		first, ok := j.seen[key]
+		if !ok {
+			j.seen[key] = now
+			continue
+		}
+		if now.Sub(first) >= maxAge {
+			r[key] = kind
+		}
+	}
+	j.stats.LastSweep = now.Unix()
+	j.stats.Pending = len(j.seen) - len(r)
+	return r
+}
+
+func (j *janitor) reclaimed(key, kind string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.seen, key)
+	j.stats.Reclaimed[kind]++
+}
+
+func (j *janitor) snapshot() janitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r := j.stats
+	r.Reclaimed = make(map[string]int64, len(j.stats.Reclaimed))
+	for kind, n := range j.stats.Reclaimed {
+		r.Reclaimed[kind] = n
+	}
+	return r
+}
+
+// findOrphans 根据 /sm/app/ 下所有的key判断孤儿节点，返回key到孤儿类型的映射:
+// 1 containerhb/shardhb下没有lease的节点
+// 2 assignment下container已经没有heartbeat的节点
+// 3 sm的service目录下没有spec的service，以及没有spec的service在app目录下没有lease的节点，
+// 存在leader节点的app目录属于sm部署（包括共用prefix的其他sm），只参考其中的spec，不做处理
+func findOrphans(kvs []*mvccpb.KeyValue, appPfx string, smService string) map[string]string {
+	// specs 所有sm部署中的service，ownSpecs 当前sm中的service
+	specs := make(map[string]struct{})
+	ownSpecs := make(map[string]struct{})
+	leaders := make(map[string]struct{})
+	alive := make(map[string]struct{})
+	for _, kv := range kvs {
+		svc, kind, rest := splitAppKey(string(kv.Key), appPfx)
+		switch kind {
+		case "leader":
+			leaders[svc] = struct{}{}
+		case "service":
+			parts := strings.Split(rest, "/")
+			if len(parts) == 2 && parts[1] == "spec" {
+				specs[parts[0]] = struct{}{}
+				if svc == smService {
+					ownSpecs[parts[0]] = struct{}{}
+				}
+			}
+		case "containerhb":
+			if kv.Lease != 0 {
+				alive[svc+"/"+strings.SplitN(rest, "/", 2)[0]] = struct{}{}
+			}
+		}
+	}
+
+	r := make(map[string]string)
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		svc, kind, rest := splitAppKey(key, appPfx)
+		if svc == smService {
+			// sm自己的目录下只清理已删除service的残留
+			if kind == "service" {
+				service := strings.SplitN(rest, "/", 2)[0]
+				if _, ok := ownSpecs[service]; !ok {
+					r[key] = orphanService
+				}
+			}
+			continue
+		}
+		if _, ok := leaders[svc]; ok {
+			continue
+		}
+
+		switch kind {
+		case "containerhb", "shardhb":
+			if kv.Lease == 0 {
+				r[key] = orphanHeartbeat
+			}
+			continue
+		case "assignment":
+			containerId := strings.SplitN(rest, "/", 2)[0]
+			if _, ok := alive[svc+"/"+containerId]; !ok {
+				r[key] = orphanAssignment
+			}
+			continue
+		}
+		if _, ok := specs[svc]; !ok && kv.Lease == 0 {
+			r[key] = orphanService
+		}
+	}
+	return r
+}
+
+// splitAppKey /sm/app/proxy.dev/assignment/c1/s1 拆分为 proxy.dev、assignment、c1/s1
+func splitAppKey(key string, appPfx string) (string, string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(key, appPfx), "/", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// @Description get what the janitor of the leader reclaimed from etcd
+// @Tags  leader
+// @Produce  json
+// @success 200
+// @Router /sm/server/janitor [get]
+func (ss *smShardApi) GinJanitor(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"janitor": ss.container.janitor.snapshot()})
+}
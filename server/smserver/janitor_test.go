@@ -0,0 +1,70 @@
+package smserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_janitor_sweep(t *testing.T) {
+	client := new(MockedEtcdWrapper)
+	nm := &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")}
+	j := newJanitor(ttLogger, client, nm)
+	j.setMaxAge(time.Minute)
+
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/sm/app/sm/leader/1"), Lease: 1},
+		{Key: []byte("/sm/app/sm/service/foo/spec")},
+		{Key: []byte("/sm/app/sm/service/foo/shard/s1")},
+		{Key: []byte("/sm/app/sm/service/bar/deadletter/s1")},
+		{Key: []byte("/sm/app/sm/containerhb/c0/1")},
+		// 共用prefix的其他sm部署
+		{Key: []byte("/sm/app/sm2/leader/2"), Lease: 2},
+		{Key: []byte("/sm/app/sm2/service/baz/spec")},
+		{Key: []byte("/sm/app/baz/config")},
+		{Key: []byte("/sm/app/foo/config")},
+		{Key: []byte("/sm/app/foo/containerhb/c1/3"), Lease: 3},
+		{Key: []byte("/sm/app/foo/containerhb/c2/4")},
+		{Key: []byte("/sm/app/foo/shardhb/s1/3"), Lease: 3},
+		{Key: []byte("/sm/app/foo/assignment/c1/s1")},
+		{Key: []byte("/sm/app/foo/assignment/c2/s2")},
+		{Key: []byte("/sm/app/bar/config")},
+		{Key: []byte("/sm/app/bar/containerhb/c3/5"), Lease: 5},
+	}
+	orphans := findOrphans(kvs, nm.etcdPath.AppPrefix(""), nm.smService)
+	assert.Equal(t, map[string]string{
+		"/sm/app/sm/service/bar/deadletter/s1": orphanService,
+		"/sm/app/foo/containerhb/c2/4":         orphanHeartbeat,
+		"/sm/app/foo/assignment/c2/s2":         orphanAssignment,
+		"/sm/app/bar/config":                   orphanService,
+	}, orphans)
+
+	client.On("GetKV", mock.Anything, "/sm/app/", mock.Anything).Return(&clientv3.GetResponse{Count: int64(len(kvs)), Kvs: kvs}, nil)
+	client.On("Delete", mock.Anything, mock.Anything, mock.Anything).Return(&clientv3.DeleteResponse{Deleted: 1}, nil)
+
+	// 第一次发现只记录时间
+	assert.Nil(t, j.sweep(context.TODO()))
+	client.AssertNumberOfCalls(t, "Delete", 0)
+	assert.Equal(t, 4, j.snapshot().Pending)
+
+	for key := range j.seen {
+		j.seen[key] = time.Now().Add(-2 * time.Minute)
+	}
+	assert.Nil(t, j.sweep(context.TODO()))
+	client.AssertNumberOfCalls(t, "Delete", 4)
+	stats := j.snapshot()
+	assert.Equal(t, 0, stats.Pending)
+	assert.Equal(t, int64(2), stats.Reclaimed[orphanService])
+	assert.Equal(t, int64(1), stats.Reclaimed[orphanAssignment])
+
+	// 不再是孤儿的节点重新计时
+	j.due(map[string]string{"/sm/app/foo/assignment/c2/s2": orphanAssignment}, time.Minute, time.Now())
+	j.due(map[string]string{}, time.Minute, time.Now())
+	assert.Empty(t, j.seen)
+}
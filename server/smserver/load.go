@@ -0,0 +1,120 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type shardLoad struct {
+	ShardId     string `json:"shardId"`
+	ContainerId string `json:"containerId"`
+
+	// Load shard没有上报结构化的负载时为空
+	Load *apputil.ShardLoad `json:"load,omitempty"`
+}
+
+type containerLoad struct {
+	ContainerId string `json:"containerId"`
+	ShardCount  int    `json:"shardCount"`
+
+	// Load container上所有shard负载的累加
+	Load *apputil.ShardLoad `json:"load"`
+}
+
+type serviceLoad struct {
+	Service    string           `json:"service"`
+	Containers []*containerLoad `json:"containers"`
+	Shards     []*shardLoad     `json:"shards"`
+}
+
+// aggregateLoad 按照container累加shard的负载，没有shard的container负载为0，也是分配shard时优先考虑的container
+func aggregateLoad(service string, containers []string, assignment map[string]*apputil.ShardHeartbeat) *serviceLoad {
+	sl := serviceLoad{Service: service}
+
+	loads := make(map[string]*containerLoad)
+	for _, id := range containers {
+		loads[id] = &containerLoad{ContainerId: id, Load: &apputil.ShardLoad{}}
+	}
+	for shardId, hb := range assignment {
+		sl.Shards = append(sl.Shards, &shardLoad{ShardId: shardId, ContainerId: hb.ContainerId, Load: hb.Stats})
+
+		// containerhb过期，shardhb还没有过期的场景，container也要展示出来
+		cl, ok := loads[hb.ContainerId]
+		if !ok {
+			cl = &containerLoad{ContainerId: hb.ContainerId, Load: &apputil.ShardLoad{}}
+			loads[hb.ContainerId] = cl
+		}
+		cl.ShardCount++
+		cl.Load.Add(hb.Stats)
+	}
+	for _, cl := range loads {
+		sl.Containers = append(sl.Containers, cl)
+	}
+	sort.Slice(sl.Containers, func(i, j int) bool {
+		return sl.Containers[i].ContainerId < sl.Containers[j].ContainerId
+	})
+	sort.Slice(sl.Shards, func(i, j int) bool {
+		return sl.Shards[i].ShardId < sl.Shards[j].ShardId
+	})
+	return &sl
+}
+
+func (ss *smShardApi) serviceLoad(ctx context.Context, service string) (*serviceLoad, error) {
+	containers, err := ss.aliveContainers(ctx, service)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	assignment, err := ss.shardHeartbeats(ctx, service)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return aggregateLoad(service, containers, assignment), nil
+}
+
+// @Description aggregated load of containers and shards
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200 {object} serviceLoad
+// @Router /sm/server/load [get]
+func (ss *smShardApi) GinLoad(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.New("empty service")
+		ss.lg.Error("param error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	sl, err := ss.serviceLoad(context.TODO(), service)
+	if err != nil {
+		ss.lg.Error(
+			"serviceLoad error",
+			zap.String("service", service),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	c.JSON(http.StatusOK, sl)
+}
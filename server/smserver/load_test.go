@@ -0,0 +1,34 @@
+package smserver
+
+import (
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_aggregateLoad(t *testing.T) {
+	assignment := map[string]*apputil.ShardHeartbeat{
+		"s1": {ContainerId: "c1", Stats: &apputil.ShardLoad{CPU: 10, QPS: 100}},
+		"s2": {ContainerId: "c1", Stats: &apputil.ShardLoad{CPU: 5, QPS: 50, Gauges: map[string]float64{"lag": 1}}},
+		// 没有上报结构化负载的shard只计数
+		"s3": {ContainerId: "c3", Load: "foo"},
+	}
+	sl := aggregateLoad("foo.bar", []string{"c1", "c2"}, assignment)
+
+	assert.Equal(t, "foo.bar", sl.Service)
+	assert.Len(t, sl.Shards, 3)
+	assert.Equal(t, "s1", sl.Shards[0].ShardId)
+	assert.Nil(t, sl.Shards[2].Load)
+
+	assert.Len(t, sl.Containers, 3)
+	c1, c2, c3 := sl.Containers[0], sl.Containers[1], sl.Containers[2]
+	assert.Equal(t, 2, c1.ShardCount)
+	assert.Equal(t, float64(15), c1.Load.CPU)
+	assert.Equal(t, float64(150), c1.Load.QPS)
+	assert.Equal(t, float64(1), c1.Load.Gauges["lag"])
+	assert.Equal(t, 0, c2.ShardCount)
+	assert.Equal(t, float64(0), c2.Load.CPU)
+	assert.Equal(t, "c3", c3.ContainerId)
+	assert.Equal(t, 1, c3.ShardCount)
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultMaintenanceGracePeriod container在维护窗口内重启的最长时间，超过后shard重新分配
+	defaultMaintenanceGracePeriod = 2 * time.Minute
+
+	// maxMaintenanceDuration 防止忘记结束的维护窗口长期影响shard的分配
+	maxMaintenanceDuration = 24 * time.Hour
+)
+
+// maintenanceWindow 滚动重启期间，重启中的container上的shard暂停分配，等待container回来
+type maintenanceWindow struct {
+	// Until 窗口结束时间，unix秒
+	Until int64 `json:"until"`
+
+	// GracePeriod 单个container重启的最长等待时间，单位秒
+	GracePeriod int `json:"gracePeriod"`
+}
+
+func (w *maintenanceWindow) String() string {
+	b, _ := json.Marshal(w)
+	return string(b)
+}
+
+func (w *maintenanceWindow) active(now time.Time) bool {
+	return w != nil && now.Unix() < w.Until
+}
+
+func (w *maintenanceWindow) gracePeriod() time.Duration {
+	if w.GracePeriod <= 0 {
+		return defaultMaintenanceGracePeriod
+	}
+	return time.Duration(w.GracePeriod) * time.Second
+}
+
+type parkedShard struct {
+	containerId string
+	since       time.Time
+}
+
+// shardParker 记录shard最后所在的container，维护窗口内container下线时shard暂停分配，
+// container在grace period内回来时shard回到原来的container
+type shardParker struct {
+	mu sync.Mutex
+	// lastAssignment shard最后一次存活时所在的container
+	lastAssignment map[string]string
+	// parked 所在container下线，等待container回来的shard
+	parked map[string]*parkedShard
+}
+
+func newShardParker() *shardParker {
+	return &shardParker{
+		lastAssignment: make(map[string]string),
+		parked:         make(map[string]*parkedShard),
+	}
+}
+
+// clone rebalance的dry-run在副本上执行plan，不修改正在使用的记录
+func (p *shardParker) clone() *shardParker {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := newShardParker()
+	for shardId, containerId := range p.lastAssignment {
+		c.lastAssignment[shardId] = containerId
+	}
+	for shardId, parked := range p.parked {
+		v := *parked
+		c.parked[shardId] = &v
+	}
+	return c
+}
+
+// plan 返回本轮不参与分配的shard，以及需要回到原container的shard
+func (p *shardParker) plan(window *maintenanceWindow, now time.Time, shardIds map[string]struct{}, aliveContainers ArmorMap, aliveShards map[string]*temporary) (map[string]struct{}, map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for shardId := range p.lastAssignment {
+		if _, ok := shardIds[shardId]; !ok {
+			delete(p.lastAssignment, shardId)
+		}
+	}
+	for shardId, value := range aliveShards {
+		p.lastAssignment[shardId] = value.curContainerId
+		delete(p.parked, shardId)
+	}
+	if !window.active(now) {
+		p.parked = make(map[string]*parkedShard)
+		return nil, nil
+	}
+
+	skip := make(map[string]struct{})
+	prefer := make(map[string]string)
+	for shardId, containerId := range p.lastAssignment {
+		if _, ok := aliveShards[shardId]; ok {
+			continue
+		}
+		// container已经回来
+		if _, ok := aliveContainers[containerId]; ok {
+			prefer[shardId] = containerId
+			delete(p.parked, shardId)
+			continue
+		}
+		parked, ok := p.parked[shardId]
+		if !ok || parked.containerId != containerId {
+			parked = &parkedShard{containerId: containerId, since: now}
+			p.parked[shardId] = parked
+		}
+		if now.Sub(parked.since) < window.gracePeriod() {
+			skip[shardId] = struct{}{}
+		}
+	}
+	return skip, prefer
+}
+
+// maintenanceWindow 没有维护窗口时返回nil
+func (ss *smShard) maintenanceWindow(ctx context.Context) (*maintenanceWindow, error) {
+	resp, err := ss.container.Client.GetKV(ctx, ss.container.nodeManager.nodeServiceMaintenance(ss.service), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	var window maintenanceWindow
+	if err := json.Unmarshal(resp.Kvs[0].Value, &window); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &window, nil
+}
+
+type maintenanceRequest struct {
+	Service string `json:"service" binding:"required"`
+
+	// Duration 维护窗口的持续时间，单位秒，<=0结束维护窗口
+	Duration int `json:"duration"`
+
+	// GracePeriod 单个container重启的最长等待时间，单位秒，默认120秒
+	GracePeriod int `json:"gracePeriod"`
+}
+
+func (r *maintenanceRequest) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// @Description start or end the maintenance window of service, shards of restarting container wait for it in the window
+// @Tags  spec
+// @Accept  json
+// @Produce  json
+// @Param param body maintenanceRequest true "param"
+// @success 200
+// @Router /sm/server/maintenance [post]
+func (ss *smShardApi) GinMaintenance(c *gin.Context) {
+	var req maintenanceRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if time.Duration(req.Duration)*time.Second > maxMaintenanceDuration {
+		err := errors.Errorf("duration should not exceed %s", maxMaintenanceDuration)
+		ss.lg.Error("param error", zap.Reflect("req", req), zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	pfx := ss.container.nodeManager.nodeServiceMaintenance(req.Service)
+	if req.Duration <= 0 {
+		if _, err := ss.container.Client.Delete(context.TODO(), pfx); err != nil {
+			ss.lg.Error("Delete error", zap.String("pfx", pfx), zap.Error(err))
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		ss.container.events.append(eventMaintenance, req.Service, c.ClientIP(), "end maintenance")
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	window := maintenanceWindow{
+		Until:       time.Now().Add(time.Duration(req.Duration) * time.Second).Unix(),
+		GracePeriod: req.GracePeriod,
+	}
+	if _, err := ss.container.Client.Put(context.TODO(), pfx, window.String()); err != nil {
+		ss.lg.Error("Put error", zap.String("pfx", pfx), zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	ss.container.events.append(eventMaintenance, req.Service, c.ClientIP(), fmt.Sprintf("start maintenance %s", window.String()))
+	ss.lg.Info("maintenance started", zap.Reflect("req", req))
+	c.JSON(http.StatusOK, gin.H{"window": window})
+}
+
+// park 从待分配的shard中去掉等待container回来的shard，container已经回来的shard固定到原来的container
+func (ss *smShard) park(ctx context.Context, groups map[string]*balancerGroup, shardIdAndShardSpec map[string]*apputil.ShardSpec, aliveContainers ArmorMap, aliveShards map[string]*temporary) error {
+	window, err := ss.maintenanceWindow(ctx)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	shardIds := make(map[string]struct{})
+	for id := range shardIdAndShardSpec {
+		shardIds[id] = struct{}{}
+	}
+	skip, prefer := ss.parker.plan(window, time.Now(), shardIds, aliveContainers, aliveShards)
+	for id := range skip {
+		delete(groups[shardIdAndShardSpec[id].Group].fixShardIdAndManualContainerId, id)
+	}
+	for id, containerId := range prefer {
+		bg := groups[shardIdAndShardSpec[id].Group]
+		// 手动指定的container优先
+		if bg.fixShardIdAndManualContainerId[id] == "" {
+			bg.fixShardIdAndManualContainerId[id] = containerId
+		}
+	}
+	if len(skip) > 0 || len(prefer) > 0 {
+		ss.lg.Info(
+			"maintenance window",
+			zap.String("service", ss.service),
+			zap.Reflect("parked", skip),
+			zap.Reflect("returned", prefer),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_shardParker(t *testing.T) {
+	p := newShardParker()
+	now := time.Now()
+	window := &maintenanceWindow{Until: now.Add(time.Hour).Unix(), GracePeriod: 60}
+	shardIds := map[string]struct{}{"s1": {}, "s2": {}}
+
+	// 记录分配关系
+	skip, prefer := p.plan(
+		window,
+		now,
+		shardIds,
+		ArmorMap{"c1": "", "c2": ""},
+		map[string]*temporary{"s1": {curContainerId: "c1"}, "s2": {curContainerId: "c2"}},
+	)
+	if len(skip) != 0 || len(prefer) != 0 {
+		t.Errorf("expect nothing parked, skip %v prefer %v", skip, prefer)
+		t.SkipNow()
+	}
+
+	// c1重启，s1等待c1回来
+	skip, _ = p.plan(window, now.Add(10*time.Second), shardIds, ArmorMap{"c2": ""}, map[string]*temporary{"s2": {curContainerId: "c2"}})
+	if !reflect.DeepEqual(skip, map[string]struct{}{"s1": {}}) {
+		t.Errorf("expect s1 parked, actual %v", skip)
+		t.SkipNow()
+	}
+
+	// c1在grace period内回来，s1回到c1
+	skip, prefer = p.plan(window, now.Add(30*time.Second), shardIds, ArmorMap{"c1": "", "c2": ""}, map[string]*temporary{"s2": {curContainerId: "c2"}})
+	if len(skip) != 0 || !reflect.DeepEqual(prefer, map[string]string{"s1": "c1"}) {
+		t.Errorf("expect s1 returned to c1, skip %v prefer %v", skip, prefer)
+		t.SkipNow()
+	}
+
+	// c2超过grace period没有回来，s2重新分配
+	p.plan(window, now.Add(40*time.Second), shardIds, ArmorMap{"c1": ""}, map[string]*temporary{"s1": {curContainerId: "c1"}})
+	skip, prefer = p.plan(window, now.Add(110*time.Second), shardIds, ArmorMap{"c1": ""}, map[string]*temporary{"s1": {curContainerId: "c1"}})
+	if len(skip) != 0 || len(prefer) != 0 {
+		t.Errorf("expect s2 redistributed, skip %v prefer %v", skip, prefer)
+		t.SkipNow()
+	}
+
+	// 没有维护窗口
+	skip, prefer = p.plan(nil, now, shardIds, ArmorMap{"c1": ""}, map[string]*temporary{"s1": {curContainerId: "c1"}})
+	if skip != nil || prefer != nil {
+		t.Errorf("expect no maintenance, skip %v prefer %v", skip, prefer)
+	}
+}
+
+func Test_smShard_dryRunShard(t *testing.T) {
+	ss := &smShard{lg: ttLogger, service: "foo", parker: newShardParker(), cordoned: map[string]struct{}{"c1": {}}}
+	ledger := &reservationLedger{}
+	ss.setReservations(ledger)
+	now := time.Now()
+	window := &maintenanceWindow{Until: now.Add(time.Hour).Unix(), GracePeriod: 60}
+	shardIds := map[string]struct{}{"s1": {}}
+	ss.parker.plan(window, now, shardIds, ArmorMap{"c1": ""}, map[string]*temporary{"s1": {curContainerId: "c1"}})
+
+	// dry-run中balancePlan会修改的状态都在副本上
+	dry := ss.dryRunShard()
+	dry.setReservations(&reservationLedger{})
+	dry.setRefused(dry.currentReservations(), []string{"s1"})
+	dry.cordoned = map[string]struct{}{}
+	dry.unassigned = []string{"s1"}
+	dry.parker.plan(window, now.Add(10*time.Second), shardIds, ArmorMap{}, map[string]*temporary{})
+
+	if ss.currentReservations() != ledger || ledger.refused != nil {
+		t.Errorf("expect reservations untouched")
+	}
+	if _, ok := ss.cordonedContainers()["c1"]; !ok {
+		t.Errorf("expect cordoned untouched")
+	}
+	if len(ss.UnassignedShards()) != 0 {
+		t.Errorf("expect unassigned untouched")
+	}
+	if len(ss.parker.parked) != 0 || ss.parker.lastAssignment["s1"] != "c1" {
+		t.Errorf("expect parker untouched, parked %v", ss.parker.parked)
+	}
+	if len(dry.parker.parked) != 1 {
+		t.Errorf("expect s1 parked in dry run")
+	}
+}
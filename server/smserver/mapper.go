@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/entertainment-venue/sm/pkg/apputil"
@@ -58,14 +59,35 @@ type mapper struct {
 
 	// stopper 管理watch goroutine
 	stopper *apputil.GoroutineStopper
+
+	// standby 非leader预热的mapper，只维护内存状态，不写审计事件
+	standby bool
+
+	// onChange container加入或丢失时回调，smShard用于触发rebalance
+	onChange func()
 }
 
 func newMapper(lg *zap.Logger, container *smContainer, appSpec *smAppSpec) (*mapper, error) {
+	return startMapper(lg, container, appSpec, false)
+}
+
+// newStandbyMapper 非leader的smserver使用，当选leader后通过 promote 接管
+func newStandbyMapper(lg *zap.Logger, container *smContainer, appSpec *smAppSpec) (*mapper, error) {
+	return startMapper(lg, container, appSpec, true)
+}
+
+func startMapper(lg *zap.Logger, container *smContainer, appSpec *smAppSpec, standby bool) (*mapper, error) {
+	// standby的mapper不属于任何service，挂在container下，container关闭时一起退出
+	var parent *apputil.GoroutineStopper
+	if container != nil {
+		parent = container.stopper
+	}
 	mpr := mapper{
 		lg:        lg,
 		container: container,
 		appSpec:   appSpec,
-		stopper:   &apputil.GoroutineStopper{},
+		stopper:   parent.NewChild("mapper:" + appSpec.Service),
+		standby:   standby,
 	}
 	mpr.containerState = newMapperState(&mpr, containerTrigger)
 	mpr.shardState = newMapperState(&mpr, shardTrigger)
@@ -78,11 +100,7 @@ func newMapper(lg *zap.Logger, container *smContainer, appSpec *smAppSpec) (*map
 	_ = mpr.trigger.Register(containerTrigger, mpr.UpdateState)
 	_ = mpr.trigger.Register(shardTrigger, mpr.UpdateState)
 
-	if mpr.appSpec.MaxRecoveryTime <= 0 || time.Duration(mpr.appSpec.MaxRecoveryTime)*time.Second > maxRecoveryWaitTime {
-		mpr.maxRecoveryTime = defaultMaxRecoveryTime
-	} else {
-		mpr.maxRecoveryTime = time.Duration(mpr.appSpec.MaxRecoveryTime) * time.Second
-	}
+	mpr.maxRecoveryTime = recoveryTime(appSpec)
 
 	if err := mpr.initAndWatch(containerTrigger); err != nil {
 		return nil, errors.Wrap(err, "")
@@ -94,11 +112,61 @@ func newMapper(lg *zap.Logger, container *smContainer, appSpec *smAppSpec) (*map
 	mpr.lg.Info(
 		"mapper started",
 		zap.String("service", mpr.appSpec.Service),
+		zap.Bool("standby", standby),
 	)
 
 	return &mpr, nil
 }
 
+func recoveryTime(appSpec *smAppSpec) time.Duration {
+	if appSpec.MaxRecoveryTime <= 0 || time.Duration(appSpec.MaxRecoveryTime)*time.Second > maxRecoveryWaitTime {
+		return defaultMaxRecoveryTime
+	}
+	return time.Duration(appSpec.MaxRecoveryTime) * time.Second
+}
+
+// promote standby的mapper被leader接管，恢复事件记录，并使用leader读到的最新appSpec
+func (lm *mapper) promote(appSpec *smAppSpec) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.standby = false
+	lm.setMaxRecoveryTime(recoveryTime(appSpec))
+}
+
+// recoveryWait update-spec和事件处理并发读写maxRecoveryTime，Wait持有mu等待，这里不能使用mu
+func (lm *mapper) recoveryWait() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&lm.maxRecoveryTime)))
+}
+
+func (lm *mapper) setMaxRecoveryTime(d time.Duration) {
+	atomic.StoreInt64((*int64)(&lm.maxRecoveryTime), int64(d))
+}
+
+func (lm *mapper) setOnChange(fn func()) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	lm.onChange = fn
+}
+
+// changed 只关注container，shard的heartbeat变化由周期检查处理
+func (lm *mapper) changed(key string) {
+	if key != containerTrigger {
+		return
+	}
+	lm.mu.Lock()
+	fn := lm.onChange
+	lm.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+func (lm *mapper) isStandby() bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return lm.standby
+}
+
 func (lm *mapper) extractId(key string) string {
 	// https://github.com/entertainment-venue/sm/commit/77c6ba8d36196b6fa5a115483083ae9777f70c7d
 	// 目录结构引入mutex，导致有变化，id在倒数第二段
@@ -161,19 +229,103 @@ func (lm *mapper) initAndWatch(typ string) error {
 	return nil
 }
 
+// AliveContainers 返回存活container到所在zone的映射
 func (lm *mapper) AliveContainers() ArmorMap {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
 	r := make(ArmorMap)
 	collectId := func(id string, tmp *temporary) error {
-		r[id] = ""
+		r[id] = tmp.zone
 		return nil
 	}
 	_ = lm.containerState.ForEach(collectId)
 	return r
 }
 
+// ContainerResources 返回存活container声明的资源，没有声明的container不在结果中
+func (lm *mapper) ContainerResources() map[string]*apputil.Resources {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	r := make(map[string]*apputil.Resources)
+	collect := func(id string, tmp *temporary) error {
+		if tmp.resources != nil {
+			r[id] = tmp.resources
+		}
+		return nil
+	}
+	_ = lm.containerState.ForEach(collect)
+	return r
+}
+
+// ContainerCapacities 返回存活container声明的capacity，没有声明的container不在结果中
+func (lm *mapper) ContainerCapacities() map[string]int {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	r := make(map[string]int)
+	collect := func(id string, tmp *temporary) error {
+		if tmp.capacity > 0 {
+			r[id] = tmp.capacity
+		}
+		return nil
+	}
+	_ = lm.containerState.ForEach(collect)
+	return r
+}
+
+// ContainerDeployments 返回存活container所属的deployment和进程启动时间
+func (lm *mapper) ContainerDeployments() map[string]*containerDeployment {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	r := make(map[string]*containerDeployment)
+	collect := func(id string, tmp *temporary) error {
+		r[id] = &containerDeployment{deployment: tmp.deployment, startTime: tmp.startTime}
+		return nil
+	}
+	_ = lm.containerState.ForEach(collect)
+	return r
+}
+
+// DrainingContainers 返回准备退出的container
+func (lm *mapper) DrainingContainers() map[string]struct{} {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	r := make(map[string]struct{})
+	collect := func(id string, tmp *temporary) error {
+		if tmp.draining {
+			r[id] = struct{}{}
+		}
+		return nil
+	}
+	_ = lm.containerState.ForEach(collect)
+	return r
+}
+
+// ContainerAttributes 返回存活container在placement约束中可以引用的属性
+func (lm *mapper) ContainerAttributes() map[string]*containerAttributes {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	r := make(map[string]*containerAttributes)
+	collect := func(id string, tmp *temporary) error {
+		r[id] = &containerAttributes{
+			id:       id,
+			zone:     tmp.zone,
+			capacity: tmp.capacity,
+			labels:   tmp.labels,
+			cpu:      tmp.cpu,
+			mem:      tmp.mem,
+		}
+		return nil
+	}
+	_ = lm.containerState.ForEach(collect)
+	return r
+}
+
 func (lm *mapper) AliveShards() map[string]*temporary {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
@@ -187,6 +339,27 @@ func (lm *mapper) AliveShards() map[string]*temporary {
 	return r
 }
 
+// IsWatchContainer container通过watch etcd接收shard，不提供http接口
+func (lm *mapper) IsWatchContainer(id string) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	tmp, ok := lm.containerState.alive[id]
+	return ok && tmp.watch
+}
+
+// GrpcEndpoint container开启grpc时返回grpc地址，否则为空
+func (lm *mapper) GrpcEndpoint(id string) string {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	tmp, ok := lm.containerState.alive[id]
+	if !ok {
+		return ""
+	}
+	return tmp.grpcAddr
+}
+
 func (lm *mapper) Close() {
 	if lm.stopper != nil {
 		lm.stopper.Close()
@@ -201,7 +374,13 @@ func (lm *mapper) UpdateState(key string, value interface{}) error {
 	ops := lm.getStateOps(key)
 	if event.IsCreate() || event.IsModify() {
 		// 需要更新container或者shard的存活事件
-		return ops.Refresh(id, event.Kv.Value)
+		if err := ops.Refresh(id, event.Kv.Value); err != nil {
+			return err
+		}
+		if event.IsCreate() {
+			lm.changed(key)
+		}
+		return nil
 	}
 
 	if event.Type != mvccpb.DELETE {
@@ -242,7 +421,14 @@ func (lm *mapper) UpdateState(key string, value interface{}) error {
 		return nil
 	}
 
-	return ops.Delete(id)
+	if err := ops.Delete(id); err != nil {
+		return err
+	}
+	if key == containerTrigger && lm.container != nil && !lm.isStandby() {
+		lm.container.events.append(eventContainerLost, lm.appSpec.Service, "", fmt.Sprintf("container %s lost", id))
+	}
+	lm.changed(key)
+	return nil
 }
 
 func (lm *mapper) getStateOps(key string) stateOps {
@@ -284,6 +470,56 @@ type temporary struct {
 
 	// curContainerId 针对shard场景，需要存储当前所属containerId，用于做rb
 	curContainerId string
+
+	// moveCost 针对shard场景，container上报的迁移代价，为0没有上报
+	moveCost int64
+
+	// watch 针对container场景，标记container通过watch etcd接收shard
+	watch bool
+
+	// grpcAddr 针对container场景，不为空时可以通过grpc下发add/drop
+	grpcAddr string
+
+	// zone 针对container场景，container所在的可用区
+	zone string
+
+	// deployment和startTime 针对container场景，container所属的部署和进程启动的unix秒
+	deployment string
+	startTime  int64
+
+	// capacity 针对container场景，container声明的负载单位，为0表示没有声明
+	capacity int
+
+	// resources 针对container场景，container声明可以预留给shard的资源，为空表示没有声明
+	resources *apputil.Resources
+
+	// draining 针对container场景，container准备退出，需要把shard移走
+	draining bool
+
+	// labels、cpu和mem 针对container场景，shard的placement约束使用，cpu和mem是[0, 1]的使用比例
+	labels map[string]string
+	cpu    float64
+	mem    float64
+}
+
+// setContainerHeartbeat create和Refresh共用
+func (t *temporary) setContainerHeartbeat(hb *apputil.ContainerHeartbeat) {
+	t.watch = hb.Watch
+	t.grpcAddr = hb.GrpcAddr
+	t.zone = hb.Zone
+	t.deployment = hb.Deployment
+	if hb.Process != nil {
+		t.startTime = hb.Process.StartTime
+	}
+	t.capacity = hb.Capacity
+	t.resources = hb.Resources
+	t.draining = hb.Draining
+	t.labels = hb.Labels
+	t.cpu = hb.CPUUsedPercent / 100
+	t.mem = 0
+	if hb.VirtualMemoryStat != nil {
+		t.mem = hb.VirtualMemoryStat.UsedPercent / 100
+	}
 }
 
 func newTemporary(t int64) *temporary {
@@ -324,12 +560,14 @@ func (s *mapperState) create(id string, value []byte) error {
 		}
 		s.alive[id] = newTemporary(t.Timestamp)
 		s.alive[id].curContainerId = t.ContainerId
+		s.alive[id].moveCost = t.MoveCost
 	default:
-		var t apputil.Heartbeat
+		var t apputil.ContainerHeartbeat
 		if err := json.Unmarshal(value, &t); err != nil {
 			return errors.Wrap(err, string(value))
 		}
 		s.alive[id] = newTemporary(t.Timestamp)
+		s.alive[id].setContainerHeartbeat(&t)
 	}
 
 	s.mpr.lg.Info(
@@ -379,8 +617,9 @@ func (s *mapperState) Refresh(id string, d []byte) error {
 			cur.lastHeartbeatTime = time.Unix(t.Timestamp, 0)
 		}
 		cur.curContainerId = t.ContainerId
+		cur.moveCost = t.MoveCost
 	default:
-		var t apputil.Heartbeat
+		var t apputil.ContainerHeartbeat
 		if err := json.Unmarshal(d, &t); err != nil {
 			return errors.Wrap(err, "")
 		}
@@ -389,6 +628,7 @@ func (s *mapperState) Refresh(id string, d []byte) error {
 		} else {
 			cur.lastHeartbeatTime = time.Unix(t.Timestamp, 0)
 		}
+		cur.setContainerHeartbeat(&t)
 	}
 
 	s.mpr.lg.Debug(
@@ -427,13 +667,13 @@ func (s *mapperState) Wait(id string) error {
 
 	// 判断是否需要等待一会再处理该事件，队列中的事件在第一个等待事件完结后，可能都已经达到需要被处理的时间点
 	timeElapsed := time.Since(cur.lastHeartbeatTime)
-	waitTime := s.mpr.maxRecoveryTime - timeElapsed
+	waitTime := s.mpr.recoveryWait() - timeElapsed
 	if waitTime > 0 {
 		s.mpr.lg.Info(
 			"wait until timeout",
 			zap.String("service", s.mpr.appSpec.Service),
 			zap.String("id", id),
-			zap.Duration("maxRecoveryTime", s.mpr.maxRecoveryTime),
+			zap.Duration("maxRecoveryTime", s.mpr.recoveryWait()),
 			zap.Duration("timeElapsed", time.Since(cur.lastHeartbeatTime)),
 		)
 		time.Sleep(waitTime)
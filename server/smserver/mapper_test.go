@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/zd3tl/evtrigger"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 	"testing"
 	"time"
@@ -99,3 +102,41 @@ func Test_mapperState_Wait(t *testing.T) {
 
 	mprs.Wait("foo")
 }
+
+func Test_mapper_onChange(t *testing.T) {
+	mpr := &mapper{lg: ttLogger, appSpec: &smAppSpec{Service: "test"}}
+	mpr.containerState = newMapperState(mpr, containerTrigger)
+	mpr.shardState = newMapperState(mpr, shardTrigger)
+	mpr.trigger, _ = evtrigger.NewTrigger(evtrigger.WithLogger(ttLogger))
+	defer mpr.trigger.Close()
+
+	var changes int
+	mpr.setOnChange(func() { changes++ })
+
+	hb := apputil.ContainerHeartbeat{Heartbeat: apputil.Heartbeat{Timestamp: time.Now().Add(-time.Minute).Unix()}}
+	key := "/sm/app/test/containerhb/c1/694d7d"
+	var tests = []struct {
+		key    string
+		ev     *clientv3.Event
+		expect int
+	}{
+		// container加入
+		{key: containerTrigger, ev: &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(hb.String()), CreateRevision: 1, ModRevision: 1, Version: 1}}, expect: 1},
+		// heartbeat刷新
+		{key: containerTrigger, ev: &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(hb.String()), CreateRevision: 1, ModRevision: 2, Version: 2}}, expect: 1},
+		// shard不触发
+		{key: shardTrigger, ev: &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/sm/app/test/shardhb/s1/694d7d"), Value: []byte(`{"containerId":"c1"}`), CreateRevision: 3, ModRevision: 3, Version: 1}}, expect: 1},
+		// container丢失
+		{key: containerTrigger, ev: &clientv3.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(key)}}, expect: 2},
+	}
+	for idx, tt := range tests {
+		if err := mpr.UpdateState(tt.key, tt.ev); err != nil {
+			t.Errorf("idx %d err: %+v", idx, err)
+			t.SkipNow()
+		}
+		if changes != tt.expect {
+			t.Errorf("idx %d expect %d actual %d", idx, tt.expect, changes)
+			t.SkipNow()
+		}
+	}
+}
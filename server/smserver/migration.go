@@ -0,0 +1,88 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"net/http"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var errNotDualWrite = errors.New("etcd dual write not enabled")
+
+// dualWrite 通过 WithMirrorEndpoints 开启双写时返回双写的client
+func (c *smContainer) dualWrite() (*etcdutil.DualWriteClient, error) {
+	if c.Container == nil {
+		return nil, errNotDualWrite
+	}
+	w, ok := c.Client.(*etcdutil.DualWriteClient)
+	if !ok {
+		return nil, errNotDualWrite
+	}
+	return w, nil
+}
+
+// @Description get the progress of the etcd migration of this instance
+// @Tags  etcd
+// @Produce  json
+// @success 200
+// @Router /sm/server/etcd-migration [get]
+func (ss *smShardApi) GinEtcdMigration(c *gin.Context) {
+	w, err := ss.container.dualWrite()
+	if err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": w.Status()})
+}
+
+// @Description copy the keys without lease from the primary etcd cluster to the secondary
+// @Tags  etcd
+// @Produce  json
+// @success 200
+// @Router /sm/server/etcd-migration/sync [post]
+func (ss *smShardApi) GinEtcdSync(c *gin.Context) {
+	w, err := ss.container.dualWrite()
+	if err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	n, err := w.Sync(c.Request.Context(), ss.container.nodeManager.etcdPath.Prefix())
+	if err != nil {
+		ss.lg.Error("etcd sync error", zap.Int("count", n), zap.Error(err))
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": n, "status": w.Status()})
+}
+
+// @Description swap the primary and the secondary etcd cluster of this instance, call again to roll back
+// @Tags  etcd
+// @Produce  json
+// @success 200
+// @Router /sm/server/etcd-migration/cutover [post]
+func (ss *smShardApi) GinEtcdCutover(c *gin.Context) {
+	w, err := ss.container.dualWrite()
+	if err != nil {
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	w.Cutover()
+	ss.lg.Info("etcd cutover success", zap.String("id", ss.container.Id()), zap.Reflect("status", w.Status()))
+	c.JSON(http.StatusOK, gin.H{"status": w.Status()})
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"container/heap"
+	"strconv"
+	"sync"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"go.uber.org/zap"
+)
+
+// movePriority 值越大越先执行，同一个优先级内先入队的先执行
+type movePriority int
+
+const (
+	// movePriorityRebalance 负载均衡和reconciler的修正，shard仍然有container负责
+	movePriorityRebalance movePriority = iota + 1
+	// movePriorityManual api触发的操作：add-shard、del-shard、pin和dead letter重新入队
+	movePriorityManual
+	// movePriorityFailover container丢失或者退出，shard没有container负责
+	movePriorityFailover
+)
+
+// movePrioritySpan 同一个优先级内按照入队顺序排序占用的区间
+const movePrioritySpan = int64(1) << 48
+
+func (p movePriority) String() string {
+	switch p {
+	case movePriorityFailover:
+		return "failover"
+	case movePriorityManual:
+		return "manual"
+	default:
+		return "rebalance"
+	}
+}
+
+// classifyPriority 一组move中任意一个shard需要故障转移时整组按照故障转移处理
+func classifyPriority(mals moveActionList) movePriority {
+	r := movePriorityRebalance
+	for _, ma := range mals {
+		var p movePriority
+		switch ma.Reason {
+		case moveReasonContainerLost, moveReasonDrain:
+			p = movePriorityFailover
+		case moveReasonManual, moveReasonSpecChange:
+			p = movePriorityManual
+		default:
+			p = movePriorityRebalance
+		}
+		if p > r {
+			r = p
+		}
+	}
+	return r
+}
+
+// moveQueue 替代FIFO的evtrigger，单个worker按照优先级处理move事件，故障转移不会等在例行的rebalance之后，
+// 关闭时没有处理的事件保留在etcd中，由下一个governor回放
+type moveQueue struct {
+	lg      *zap.Logger
+	handler func(key string, value interface{}) error
+
+	mu     sync.Mutex
+	pq     apputil.PriorityQueue
+	events map[string]*workerTriggerEvent
+	seq    int64
+	closed bool
+
+	notify chan struct{}
+	stopc  chan struct{}
+	donec  chan struct{}
+}
+
+func newMoveQueue(lg *zap.Logger, handler func(key string, value interface{}) error) *moveQueue {
+	q := &moveQueue{
+		lg:      lg,
+		handler: handler,
+		events:  make(map[string]*workerTriggerEvent),
+		notify:  make(chan struct{}, 1),
+		stopc:   make(chan struct{}),
+		donec:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// put 关闭之后返回false
+func (q *moveQueue) put(ev *workerTriggerEvent) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.seq++
+	id := strconv.FormatInt(q.seq, 10)
+	q.events[id] = ev
+	heap.Push(&q.pq, &apputil.Item{Value: id, Priority: int64(ev.Priority)*movePrioritySpan - q.seq})
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (q *moveQueue) pop() *workerTriggerEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pq.Len() == 0 {
+		return nil
+	}
+	item := heap.Pop(&q.pq).(*apputil.Item)
+	ev := q.events[item.Value]
+	delete(q.events, item.Value)
+	return ev
+}
+
+// depths 按照优先级统计等待中的事件数量
+func (q *moveQueue) depths() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r := make(map[string]int)
+	for _, ev := range q.events {
+		r[ev.Priority.String()]++
+	}
+	return r
+}
+
+func (q *moveQueue) run() {
+	defer close(q.donec)
+	for {
+		select {
+		case <-q.stopc:
+			return
+		default:
+		}
+		ev := q.pop()
+		if ev == nil {
+			select {
+			case <-q.stopc:
+				return
+			case <-q.notify:
+			}
+			continue
+		}
+		if err := q.handler(workerTrigger, ev); err != nil {
+			q.lg.Error(
+				"handle move event error",
+				zap.String("service", ev.Service),
+				zap.String("priority", ev.Priority.String()),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// close 等待正在处理的事件结束
+func (q *moveQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	q.mu.Unlock()
+	close(q.stopc)
+	<-q.donec
+}
@@ -0,0 +1,56 @@
+package smserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_classifyPriority(t *testing.T) {
+	assert.Equal(t, movePriorityRebalance, classifyPriority(nil))
+	assert.Equal(t, movePriorityRebalance, classifyPriority(moveActionList{{Reason: moveReasonLoadImbalance}, {Reason: moveReasonReconcile}}))
+	assert.Equal(t, movePriorityManual, classifyPriority(moveActionList{{Reason: moveReasonLoadImbalance}, {Reason: moveReasonSpecChange}}))
+	assert.Equal(t, movePriorityFailover, classifyPriority(moveActionList{{Reason: moveReasonManual}, {Reason: moveReasonContainerLost}}))
+	assert.Equal(t, movePriorityFailover, classifyPriority(moveActionList{{Reason: moveReasonDrain}}))
+}
+
+func Test_moveQueue(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handled := make(chan string, 10)
+	q := newMoveQueue(ttLogger, func(key string, value interface{}) error {
+		ev := value.(*workerTriggerEvent)
+		if ev.Service == "blocker" {
+			close(started)
+			<-release
+		}
+		handled <- ev.Service
+		return nil
+	})
+	defer q.close()
+
+	// 第一个事件处理中，后面的事件在队列中按照优先级排序
+	q.put(&workerTriggerEvent{Service: "blocker", Priority: movePriorityRebalance})
+	<-started
+	q.put(&workerTriggerEvent{Service: "rebalance-1", Priority: movePriorityRebalance})
+	q.put(&workerTriggerEvent{Service: "manual", Priority: movePriorityManual})
+	q.put(&workerTriggerEvent{Service: "rebalance-2", Priority: movePriorityRebalance})
+	q.put(&workerTriggerEvent{Service: "failover", Priority: movePriorityFailover})
+	assert.Equal(t, map[string]int{"rebalance": 2, "manual": 1, "failover": 1}, q.depths())
+	close(release)
+
+	var order []string
+	for i := 0; i < 5; i++ {
+		select {
+		case service := <-handled:
+			order = append(order, service)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout, handled %v", order)
+		}
+	}
+	assert.Equal(t, []string{"blocker", "failover", "manual", "rebalance-1", "rebalance-2"}, order)
+
+	q.close()
+	assert.False(t, q.put(&workerTriggerEvent{Service: "closed"}))
+}
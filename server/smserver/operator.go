@@ -16,14 +16,22 @@ package smserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/chaos"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
 	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
@@ -36,6 +44,15 @@ type moveAction struct {
 
 	// Spec 存储分片具体信息
 	Spec *apputil.ShardSpec `json:"spec"`
+
+	// TraceContext rebalance时生成的span，operator和目标container继续这个trace
+	TraceContext apputil.TraceContext `json:"traceContext,omitempty"`
+
+	// RoundId 所属的rebalance轮次，api触发的move为空
+	RoundId string `json:"roundId,omitempty"`
+
+	// Reason 触发move的原因，入队时设置，记录在shard的分配历史中
+	Reason moveReason `json:"reason,omitempty"`
 }
 
 func (action *moveAction) String() string {
@@ -67,13 +84,124 @@ type operator struct {
 	service string
 
 	httpClient *http.Client
+
+	// client watch模式的container通过etcd下发shard
+	client etcdutil.EtcdWrapper
+	// etcdPath 和sm使用相同的prefix
+	etcdPath *apputil.EtcdPath
+	// isWatch 判断container是否为watch模式
+	isWatch func(containerId string) bool
+
+	// grpc sm开启grpc下发时不为空
+	grpc *shardGrpcPool
+	// grpcEndpoint 返回container的grpc地址，为空时container只支持http
+	grpcEndpoint func(containerId string) string
+
+	// reroute shard被container拒绝后选择其他container，第二个参数是已经拒绝的container，返回空表示没有可选的container
+	reroute func(ma *moveAction, refused map[string]struct{}) string
+
+	// recorder 记录最近的move，提供给dashboard展示
+	recorder *moveRecorder
+
+	// events 持久化move到审计日志
+	events *eventLog
+
+	// rounds 记录rebalance每轮的执行进度
+	rounds *roundTracker
+
+	// deadLetters 重试后仍然失败的move
+	deadLetters *deadLetterQueue
+
+	// webhooks 通知service注册的webhook
+	webhooks *webhookNotifier
+
+	// states move前后转换shard的生命周期状态
+	states *shardStateStore
+
+	// history 记录shard分配过的container
+	history *shardHistoryStore
+
+	// cooldown 记录shard最近一次移动的时间
+	cooldown *moveCooldown
+
+	// reasons 按照原因统计move
+	reasons *moveReasonStats
+
+	// moveRetry 单个move失败后的重试次数
+	moveRetry int
+	// moveBackoff 第一次重试前的等待时间，之后每次翻倍
+	moveBackoff time.Duration
+
+	// breaker 连续失败的container在cooldown期间不再请求，为nil时不熔断
+	breaker *containerBreaker
+
+	// handoverTimeout 等待旧container确认drop的最长时间，超时后继续add，防止move卡死
+	handoverTimeout time.Duration
+
+	mu sync.Mutex
+	// concurrency 同一个container同时处理的add/drop请求数量，大规模rebalance时防止压垮container，
+	// 不同container之间的请求仍然并行
+	concurrency int
+	// endpoints 正在被请求的container的信号量，没有请求后删除
+	endpoints map[string]*endpointSemaphore
+}
+
+type endpointSemaphore struct {
+	ch   chan struct{}
+	refs int
 }
 
 func newOperator(lg *zap.Logger, service string) *operator {
 	return &operator{
-		lg:         lg,
-		service:    service,
-		httpClient: newHttpClient(),
+		lg:              lg,
+		service:         service,
+		httpClient:      newHttpClient(),
+		handoverTimeout: defaultHandoverTimeout,
+		moveRetry:       defaultMoveRetry,
+		moveBackoff:     defaultMoveBackoff,
+		concurrency:     defaultMoveConcurrency,
+		reasons:         newMoveReasonStats(),
+	}
+}
+
+// setConcurrency <=0使用默认值，已经在执行的请求不受影响
+func (o *operator) setConcurrency(n int) {
+	if n <= 0 {
+		n = defaultMoveConcurrency
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.concurrency = n
+}
+
+// acquire 等待endpoint的并发额度，返回的函数用于释放
+func (o *operator) acquire(endpoint string) func() {
+	o.mu.Lock()
+	if o.endpoints == nil {
+		o.endpoints = make(map[string]*endpointSemaphore)
+	}
+	n := o.concurrency
+	if n <= 0 {
+		n = defaultMoveConcurrency
+	}
+	sem, ok := o.endpoints[endpoint]
+	if !ok || cap(sem.ch) != n {
+		// 并发数调整后新的请求使用新的信号量，旧的信号量在持有者释放后废弃
+		sem = &endpointSemaphore{ch: make(chan struct{}, n)}
+		o.endpoints[endpoint] = sem
+	}
+	sem.refs++
+	o.mu.Unlock()
+
+	sem.ch <- struct{}{}
+	return func() {
+		<-sem.ch
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		sem.refs--
+		if sem.refs == 0 && o.endpoints[endpoint] == sem {
+			delete(o.endpoints, endpoint)
+		}
 	}
 }
 
@@ -84,55 +212,112 @@ func (o *operator) move(mal moveActionList) error {
 		zap.Reflect("mal", mal),
 	)
 
-	var (
-		// 增加重试机制
-		retry   = 1
-		counter = 0
-		succ    bool
-	)
-	for counter <= retry {
-		if counter > 0 {
-			time.Sleep(defaultSleepTimeout)
-		}
+	if len(mal) > 0 {
+		o.rounds.running(mal[0].RoundId)
+	}
 
-		g := new(errgroup.Group)
-		for _, ma := range mal {
-			ma := ma
-			g.Go(func() error {
-				return o.dropOrAdd(ma)
-			})
-		}
-		if err := g.Wait(); err != nil {
-			o.lg.Error(
-				"Wait err",
-				zap.Error(err),
-			)
-			counter++
-		} else {
-			succ = true
-			break
-		}
+	// 每个move独立重试，互不影响
+	errs := make([]error, len(mal))
+	g := new(errgroup.Group)
+	for idx, ma := range mal {
+		idx, ma := idx, ma
+		g.Go(func() error {
+			o.states.beforeMove(ma)
+			attempts, err := o.dropOrAddWithRetry(ma)
+			errs[idx] = err
+			o.states.afterMove(ma, err)
+			o.rounds.done(ma.RoundId, ma.ShardId, err)
+			o.reasons.record(ma, err)
+			if err != nil {
+				o.deadLetters.add(ma, attempts, err)
+			} else {
+				o.history.record(ma)
+				o.cooldown.moved(ma, time.Now())
+				o.webhooks.notify(ma)
+			}
+			return err
+		})
 	}
+	succ := g.Wait() == nil
 
 	o.lg.Info(
 		"complete move",
 		zap.Bool("succ", succ),
 		zap.Reflect("mal", mal),
 	)
+	o.recorder.record(mal, succ)
+	for idx, ma := range mal {
+		o.events.append(eventMove, ma.Service, "", fmt.Sprintf("move %s reason %s succ %t", ma.String(), ma.Reason, errs[idx] == nil))
+	}
 	return nil
 }
 
+// dropOrAddWithRetry 失败后按照指数退避重试，返回执行的次数和最后一次的错误
+func (o *operator) dropOrAddWithRetry(ma *moveAction) (int, error) {
+	backoff := o.moveBackoff
+	for attempt := 1; ; attempt++ {
+		err := o.dropOrAdd(ma)
+		if err == nil || attempt > o.moveRetry {
+			return attempt, err
+		}
+		// 所有container都拒绝，重试没有意义
+		if _, ok := apputil.IsShardRefusal(err); ok {
+			return attempt, err
+		}
+		// 熔断期间重试会直接失败
+		if errors.Cause(err) == errCircuitOpen {
+			return attempt, err
+		}
+		o.lg.Warn(
+			"dropOrAdd error, retry later",
+			zap.Reflect("ma", ma),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxMoveBackoff {
+			backoff = maxMoveBackoff
+		}
+	}
+}
+
 func (o *operator) dropOrAdd(ma *moveAction) error {
+	ctx, span := apputil.Tracer().Start(
+		ma.TraceContext.Extract(context.Background()),
+		"operator.dropOrAdd",
+		trace.WithAttributes(attribute.String("service", ma.Service), attribute.String("shardId", ma.ShardId)),
+	)
+	defer span.End()
+
+	if err := chaos.MoveAction(ma.ShardId); err != nil {
+		span.RecordError(err)
+		return errors.Wrap(err, "")
+	}
+
 	if ma.DropEndpoint != "" {
-		if err := o.send(ma.ShardId, ma.Spec, ma.DropEndpoint, "drop"); err != nil {
+		if err := o.dispatch(ctx, ma, ma.DropEndpoint, "drop"); err != nil {
+			span.RecordError(err)
 			return errors.Wrap(err, "")
 		}
 	}
 
+	// 两阶段交接：旧container确认drop后再add，避免两个container同时处理一个shard
+	if ma.DropEndpoint != "" && ma.AddEndpoint != "" {
+		o.waitDropAck(ma)
+	}
+
 	if ma.AddEndpoint != "" {
-		if err := o.send(ma.ShardId, ma.Spec, ma.AddEndpoint, "add"); err != nil {
+		if err := o.addOrReroute(ctx, ma); err != nil {
+			span.RecordError(err)
 			return errors.Wrap(err, "")
 		}
+	} else if o.client != nil {
+		// 只drop不add时shard（例如减少的secondary副本）不再有owner，fencing节点没有继续保留的必要，
+		// 之后重新分配会再次写入，删除失败不影响这次移动
+		if err := unfence(ctx, o.client, o.etcdPath, ma.Service, ma.ShardId, false); err != nil {
+			o.lg.Warn("unfence error", zap.Reflect("ma", ma), zap.Error(err))
+		}
 	}
 
 	o.lg.Info(
@@ -142,19 +327,260 @@ func (o *operator) dropOrAdd(ma *moveAction) error {
 	return nil
 }
 
-func (o *operator) send(id string, spec *apputil.ShardSpec, endpoint string, action string) error {
-	msg := apputil.ShardMessage{Id: id, Spec: spec}
+// addOrReroute container拒绝shard时换一个container重新add，每个container只尝试一次
+func (o *operator) addOrReroute(ctx context.Context, ma *moveAction) error {
+	refused := make(map[string]struct{})
+	for {
+		if err := o.fence(ctx, ma); err != nil {
+			return errors.Wrap(err, "")
+		}
+		err := o.dispatch(ctx, ma, ma.AddEndpoint, "add")
+		refusal, ok := apputil.IsShardRefusal(err)
+		if !ok {
+			return errors.Wrap(err, "")
+		}
+
+		refused[ma.AddEndpoint] = struct{}{}
+		var next string
+		if o.reroute != nil {
+			next = o.reroute(ma, refused)
+		}
+		o.lg.Warn(
+			"shard refused, reroute",
+			zap.String("service", ma.Service),
+			zap.String("shardId", ma.ShardId),
+			zap.String("containerId", ma.AddEndpoint),
+			zap.String("reason", refusal.Reason),
+			zap.String("next", next),
+		)
+		o.events.append(eventMove, ma.Service, "", fmt.Sprintf("shard %s refused by %s: %s, reroute to %q", ma.ShardId, ma.AddEndpoint, refusal.Reason, next))
+		if next == "" {
+			return errors.Wrapf(err, "no container accepts shard %s", ma.ShardId)
+		}
+		ma.AddEndpoint = next
+	}
+}
+
+// fence 每次add之前重写shard的fencing节点，用etcd返回的revision作为fencing token随spec下发，
+// revision全局递增，旧container持有的token一定更小，迁移过程中出现两个owner时业务可以拒绝旧owner的写入
+func (o *operator) fence(ctx context.Context, ma *moveAction) error {
+	if o.client == nil || ma.Spec == nil {
+		return nil
+	}
+	resp, err := o.client.Put(ctx, o.etcdPath.AppFencing(ma.Service, ma.ShardId), ma.AddEndpoint)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if resp.Header != nil {
+		ma.Spec.FencingToken = resp.Header.Revision
+	}
+	return nil
+}
+
+// unfence 删除shard的fencing节点，replicas为true时一起删除secondary副本的节点。
+// 节点删除后仍然持有token的旧owner在 CheckFencingToken 中被视为过期
+func unfence(ctx context.Context, client etcdutil.EtcdWrapper, etcdPath *apputil.EtcdPath, service string, shardId string, replicas bool) error {
+	if _, err := client.Delete(ctx, etcdPath.AppFencing(service, shardId)); err != nil {
+		return errors.Wrap(err, "")
+	}
+	if replicas {
+		if _, err := client.Delete(ctx, etcdPath.AppFencing(service, apputil.ReplicaShardIdPrefix(shardId)), clientv3.WithPrefix()); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	return nil
+}
+
+// dispatch 区分container接收shard的方式，watch模式写etcd，否则走http
+func (o *operator) dispatch(ctx context.Context, ma *moveAction, endpoint string, action string) error {
+	ctx, span := apputil.Tracer().Start(
+		ctx,
+		"operator."+action,
+		trace.WithAttributes(attribute.String("endpoint", endpoint)),
+	)
+	defer span.End()
+
+	if o.client != nil {
+		node := fmt.Sprintf("%s/%s", o.etcdPath.AppAssignment(ma.Service, endpoint), ma.ShardId)
+
+		// drop时无论container是否存活，都清理掉assignment节点，防止container重启后拿到过期的shard
+		if action == "drop" {
+			if _, err := o.client.Delete(context.TODO(), node); err != nil {
+				return errors.Wrap(err, "")
+			}
+		}
+
+		if o.isWatch != nil && o.isWatch(endpoint) {
+			if action == "add" {
+				msg := apputil.ShardMessage{Id: ma.ShardId, Spec: ma.Spec, TraceContext: apputil.InjectTraceContext(ctx)}
+				b, err := json.Marshal(msg)
+				if err != nil {
+					return errors.Wrap(err, "")
+				}
+				if _, err := o.client.Put(context.TODO(), node, string(b)); err != nil {
+					return errors.Wrap(err, "")
+				}
+			}
+			o.lg.Info(
+				"assign success",
+				zap.String("node", node),
+				zap.String("action", action),
+			)
+			return nil
+		}
+	}
+
+	if err := o.breaker.allow(endpoint, time.Now()); err != nil {
+		return err
+	}
+	err := o.call(ctx, ma, endpoint, action)
+	// container拒绝shard说明container可以正常响应，不计入失败
+	_, refused := apputil.IsShardRefusal(err)
+	if o.breaker.done(endpoint, err == nil || refused, time.Now()) {
+		o.events.append(eventMove, ma.Service, "", fmt.Sprintf("circuit open for container %s: %s", endpoint, err.Error()))
+	}
+	return err
+}
+
+// call 通过grpc或者http请求container
+func (o *operator) call(ctx context.Context, ma *moveAction, endpoint string, action string) error {
+	release := o.acquire(endpoint)
+	defer release()
+	if o.grpc != nil && o.grpcEndpoint != nil {
+		if addr := o.grpcEndpoint(endpoint); addr != "" {
+			return o.sendGrpc(ctx, ma.ShardId, ma.Spec, endpoint, addr, action)
+		}
+	}
+	return o.send(ctx, ma.ShardId, ma.Spec, endpoint, action)
+}
+
+func (o *operator) suspect() []*suspectContainer {
+	if o == nil {
+		return nil
+	}
+	return o.breaker.suspect(time.Now())
+}
+
+// suspectContainers 熔断中的container，balance时和cordon一样保留现有shard，不接收新的shard
+func (o *operator) suspectContainers() map[string]struct{} {
+	r := make(map[string]struct{})
+	for _, s := range o.suspect() {
+		r[s.ContainerId] = struct{}{}
+	}
+	return r
+}
+
+// waitDropAck 旧container完成drop后会删除shard的heartbeat节点（释放lock），以此作为drop的确认
+func (o *operator) waitDropAck(ma *moveAction) {
+	if o.client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), o.handoverTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(defaultHandoverCheckInterval)
+	defer ticker.Stop()
+	for {
+		acked, err := o.dropAcked(ctx, ma)
+		if err != nil {
+			o.lg.Error(
+				"dropAcked error",
+				zap.Reflect("ma", ma),
+				zap.Error(err),
+			)
+		}
+		if acked {
+			o.lg.Info(
+				"drop acked",
+				zap.Reflect("ma", ma),
+			)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			o.lg.Warn(
+				"drop ack timeout, continue add",
+				zap.Reflect("ma", ma),
+				zap.Duration("timeout", o.handoverTimeout),
+			)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *operator) dropAcked(ctx context.Context, ma *moveAction) (bool, error) {
+	pfx := o.etcdPath.AppShardHbId(ma.Service, ma.ShardId)
+	resp, err := o.client.GetKV(ctx, pfx, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	for _, kv := range resp.Kvs {
+		// mutex刚创建的节点还没有写入heartbeat，无法判断归属
+		if len(kv.Value) == 0 {
+			continue
+		}
+		var hb apputil.ShardHeartbeat
+		if err := json.Unmarshal(kv.Value, &hb); err != nil {
+			return false, errors.Wrap(err, string(kv.Value))
+		}
+		if hb.ContainerId == ma.DropEndpoint {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sendGrpc 和send语义相同，ctx的deadline传递给container，container超时后放弃add
+func (o *operator) sendGrpc(ctx context.Context, id string, spec *apputil.ShardSpec, endpoint string, addr string, action string) error {
+	client, err := o.grpc.get(addr)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.grpc.timeout)
+		defer cancel()
+	}
+
+	msg := apputil.ShardMessage{Id: id, Spec: spec, TraceContext: apputil.InjectTraceContext(ctx)}
+	if action == "add" {
+		err = client.Add(ctx, &msg)
+	} else {
+		err = client.Drop(ctx, &msg)
+	}
+	if refusal, ok := apputil.IsShardRefusal(err); ok {
+		refusal.ContainerId = endpoint
+		return refusal
+	}
+	if err != nil {
+		o.grpc.evict(addr, client)
+		return errors.Wrapf(err, "FAILED to %s move shard %s", action, id)
+	}
+
+	o.lg.Info(
+		"send success",
+		zap.String("grpcAddr", addr),
+		zap.Reflect("msg", msg),
+	)
+	return nil
+}
+
+func (o *operator) send(ctx context.Context, id string, spec *apputil.ShardSpec, endpoint string, action string) error {
+	msg := apputil.ShardMessage{Id: id, Spec: spec, TraceContext: apputil.InjectTraceContext(ctx)}
 	b, err := json.Marshal(msg)
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
 
 	urlStr := fmt.Sprintf("http://%s/sm/admin/%s-shard", endpoint, action)
-	req, err := http.NewRequest(http.MethodPost, urlStr, bytes.NewBuffer(b))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewBuffer(b))
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
 	req.Header.Add("Content-Type", "application/json")
+	apputil.InjectTraceHeader(ctx, propagation.HeaderCarrier(req.Header))
 
 	resp, err := o.httpClient.Do(req)
 	if err != nil {
@@ -163,6 +589,15 @@ func (o *operator) send(id string, spec *apputil.ShardSpec, endpoint string, act
 	defer resp.Body.Close()
 	rb, _ := ioutil.ReadAll(resp.Body)
 
+	if resp.StatusCode == http.StatusConflict && action == "add" {
+		var refusal struct {
+			Code   string `json:"code"`
+			Reason string `json:"reason"`
+		}
+		if err := json.Unmarshal(rb, &refusal); err == nil && refusal.Code == apputil.ShardRefusedCode {
+			return &apputil.ShardRefusal{ContainerId: endpoint, Reason: refusal.Reason, Time: time.Now().Unix()}
+		}
+	}
 	if resp.StatusCode != http.StatusOK {
 		return errors.Errorf("FAILED to %s move shard %s, not 200", action, id)
 	}
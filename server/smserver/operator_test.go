@@ -15,14 +15,25 @@
 package smserver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 )
 
@@ -101,7 +112,7 @@ func Test_operator_send(t *testing.T) {
 	o := operator{lg: ttLogger}
 	o.httpClient = newHttpClient()
 
-	if err := o.send("1", &apputil.ShardSpec{}, "127.0.0.1:8889", "add"); err != nil {
+	if err := o.send(context.TODO(), "1", &apputil.ShardSpec{}, "127.0.0.1:8889", "add"); err != nil {
 		t.Errorf("err: %+v", err)
 		t.SkipNow()
 	}
@@ -109,3 +120,255 @@ func Test_operator_send(t *testing.T) {
 	stopch := make(chan struct{})
 	<-stopch
 }
+
+func Test_operator_waitDropAck(t *testing.T) {
+	ma := moveAction{
+		Service:      "foo.bar",
+		ShardId:      "s1",
+		DropEndpoint: "127.0.0.1:8888",
+		AddEndpoint:  "127.0.0.1:8889",
+	}
+	hb := apputil.ShardHeartbeat{ContainerId: ma.DropEndpoint}
+	held := &clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Value: []byte(hb.String())}}}
+	released := &clientv3.GetResponse{}
+
+	// 旧container释放lock后立即继续
+	client := new(MockedEtcdWrapper)
+	client.On("GetKV", mock.Anything, apputil.EtcdPathAppShardHbId(ma.Service, ma.ShardId), mock.Anything).Return(held, nil).Once()
+	client.On("GetKV", mock.Anything, apputil.EtcdPathAppShardHbId(ma.Service, ma.ShardId), mock.Anything).Return(released, nil)
+	o := operator{lg: ttLogger, client: client, etcdPath: apputil.NewEtcdPath(""), handoverTimeout: time.Second}
+	start := time.Now()
+	o.waitDropAck(&ma)
+	if time.Since(start) >= time.Second {
+		t.Errorf("expect acked before timeout")
+		t.SkipNow()
+	}
+	client.AssertNumberOfCalls(t, "GetKV", 2)
+
+	// 旧container一直没有确认，超时后继续
+	client = new(MockedEtcdWrapper)
+	client.On("GetKV", mock.Anything, mock.Anything, mock.Anything).Return(held, nil)
+	o = operator{lg: ttLogger, client: client, etcdPath: apputil.NewEtcdPath(""), handoverTimeout: 500 * time.Millisecond}
+	start = time.Now()
+	o.waitDropAck(&ma)
+	if time.Since(start) < 500*time.Millisecond {
+		t.Errorf("expect wait until timeout")
+	}
+}
+
+func Test_operator_dropOrAddWithRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 前两次失败
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ma := moveAction{
+		Service:     "foo.bar",
+		ShardId:     "s1",
+		AddEndpoint: strings.TrimPrefix(srv.URL, "http://"),
+	}
+	o := operator{lg: ttLogger, httpClient: newHttpClient(), moveRetry: 3, moveBackoff: 10 * time.Millisecond}
+	attempts, err := o.dropOrAddWithRetry(&ma)
+	if err != nil || attempts != 3 {
+		t.Errorf("expect success at 3rd attempt, attempts %d err %v", attempts, err)
+		t.SkipNow()
+	}
+
+	// 超过重试次数后返回最后一次的错误
+	atomic.StoreInt32(&calls, 0)
+	o.moveRetry = 1
+	attempts, err = o.dropOrAddWithRetry(&ma)
+	if err == nil || attempts != 2 {
+		t.Errorf("expect failure after 2 attempts, attempts %d err %v", attempts, err)
+	}
+
+	// 熔断打开后不再请求container，也不再重试
+	atomic.StoreInt32(&calls, 0)
+	o.moveRetry = 3
+	o.breaker = newContainerBreaker(ttLogger, 2, time.Minute)
+	attempts, err = o.dropOrAddWithRetry(&ma)
+	if errors.Cause(err) != errCircuitOpen || attempts != 3 || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expect circuit open at 3rd attempt, attempts %d calls %d err %v", attempts, atomic.LoadInt32(&calls), err)
+	}
+}
+
+func Test_operator_acquire(t *testing.T) {
+	newServer := func(inflight, peak *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(inflight, 1)
+			for {
+				p := atomic.LoadInt32(peak)
+				if n <= p || atomic.CompareAndSwapInt32(peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(inflight, -1)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	var inflight1, peak1, inflight2, peak2 int32
+	srv1 := newServer(&inflight1, &peak1)
+	defer srv1.Close()
+	srv2 := newServer(&inflight2, &peak2)
+	defer srv2.Close()
+
+	run := func(o *operator) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			for _, srv := range []*httptest.Server{srv1, srv2} {
+				ma := moveAction{Service: "foo.bar", ShardId: fmt.Sprintf("s%d", i), AddEndpoint: strings.TrimPrefix(srv.URL, "http://")}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := o.dropOrAdd(&ma); err != nil {
+						t.Errorf("err: %+v", err)
+					}
+				}()
+			}
+		}
+		wg.Wait()
+	}
+
+	o := newOperator(ttLogger, "foo.bar")
+	run(o)
+	if peak1 != 1 || peak2 != 1 {
+		t.Errorf("expect 1 request per container, got %d %d", peak1, peak2)
+	}
+	if len(o.endpoints) != 0 {
+		t.Errorf("expect endpoints released, got %d", len(o.endpoints))
+	}
+
+	atomic.StoreInt32(&peak1, 0)
+	atomic.StoreInt32(&peak2, 0)
+	o.setConcurrency(2)
+	run(o)
+	if peak1 != 2 || peak2 != 2 {
+		t.Errorf("expect 2 requests per container, got %d %d", peak1, peak2)
+	}
+}
+
+func Test_deadLetterQueue(t *testing.T) {
+	nm := &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")}
+	ma := &moveAction{Service: "foo.bar", ShardId: "s1", AddEndpoint: "c1"}
+	key := nm.nodeServiceDeadLetter("foo.bar") + "s1"
+
+	client := new(MockedEtcdWrapper)
+	client.On("Put", mock.Anything, key, mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	q := newDeadLetterQueue(ttLogger, client, nm)
+	q.add(ma, 4, errors.New("fake"))
+	client.AssertCalled(t, "Put", mock.Anything, key, mock.Anything, mock.Anything)
+
+	letter := deadLetter{Action: ma, Error: "fake", Attempts: 4}
+	resp := &clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte(key), Value: []byte(letter.String())}}}
+	client.On("GetKV", mock.Anything, nm.nodeServiceDeadLetter("foo.bar"), mock.Anything).Return(resp, nil)
+	letters, err := q.list(context.TODO(), "foo.bar")
+	if err != nil || len(letters) != 1 || !reflect.DeepEqual(letters[0].Action, ma) {
+		t.Errorf("unexpected letters %v err %v", letters, err)
+	}
+}
+
+func Test_webhookNotifier_deliver(t *testing.T) {
+	var calls int
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		signature = r.Header.Get(webhookSignatureHeader)
+	}))
+	defer srv.Close()
+
+	n := newWebhookNotifier(ttLogger, new(MockedEtcdWrapper), &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")})
+	defer n.Close()
+	n.backoff = time.Millisecond
+
+	hook := &webhook{Id: "1", Service: "foo.bar", URL: srv.URL, Secret: "secret"}
+	ev := newWebhookEvent(&moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2"})
+	if ev.Type != webhookEventMoved {
+		t.Errorf("unexpected event type %s", ev.Type)
+	}
+	attempts, code, err := n.deliver(hook, ev)
+	if err != nil || attempts != 2 || code != http.StatusOK {
+		t.Errorf("unexpected attempts %d code %d err %v", attempts, code, err)
+	}
+	body, _ := json.Marshal(ev)
+	if signature != webhookSignature("secret", body) {
+		t.Errorf("unexpected signature %s", signature)
+	}
+}
+
+func Test_webhookNotifier_updateStatus(t *testing.T) {
+	nm := &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")}
+	key := nm.nodeServiceWebhookStatus("foo.bar") + "1"
+	old := webhookStatus{Delivered: 1}
+
+	client := new(MockedEtcdWrapper)
+	client.On("GetKV", mock.Anything, key, mock.Anything).Return(&clientv3.GetResponse{Count: 1, Kvs: []*mvccpb.KeyValue{{Key: []byte(key), Value: []byte(old.String())}}}, nil)
+	client.On("Put", mock.Anything, key, mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	n := newWebhookNotifier(ttLogger, client, nm)
+	defer n.Close()
+
+	hook := &webhook{Id: "1", Service: "foo.bar"}
+	ev := newWebhookEvent(&moveAction{Service: "foo.bar", ShardId: "s1", AddEndpoint: "c2"})
+	if err := n.updateStatus(hook, ev, 4, 0, errors.New("fake")); err != nil {
+		t.Fatal(err)
+	}
+	expect := webhookStatus{LastEvent: ev, LastError: "fake", LastAttempts: 4, Delivered: 1, Failed: 1}
+	client.AssertCalled(t, "Put", mock.Anything, key, mock.MatchedBy(func(val string) bool {
+		var status webhookStatus
+		_ = json.Unmarshal([]byte(val), &status)
+		status.LastDeliveryTime = 0
+		return reflect.DeepEqual(status, expect)
+	}), mock.Anything)
+}
+
+func Test_operator_fence(t *testing.T) {
+	key := apputil.EtcdPathAppFencing("foo.bar", "s1")
+	client := new(MockedEtcdWrapper)
+	client.On("Put", mock.Anything, key, "c2", mock.Anything).Return(&clientv3.PutResponse{Header: &etcdserverpb.ResponseHeader{Revision: 42}}, nil)
+	o := operator{lg: ttLogger, client: client, etcdPath: apputil.NewEtcdPath("")}
+
+	ma := moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2", Spec: &apputil.ShardSpec{Id: "s1"}}
+	if err := o.fence(context.TODO(), &ma); err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+	if ma.Spec.FencingToken != 42 {
+		t.Errorf("expect token 42, actual %d", ma.Spec.FencingToken)
+	}
+	client.AssertCalled(t, "Put", mock.Anything, key, "c2", mock.Anything)
+}
+
+func Test_operator_unfence(t *testing.T) {
+	service := "foo.bar"
+	ma := moveAction{Service: service, ShardId: apputil.ReplicaShardId("s1", 1), DropEndpoint: "c1"}
+	assignment := apputil.EtcdPathAppAssignment(service, "c1") + "/" + ma.ShardId
+
+	// 只drop的副本删除自己的fencing节点
+	client := new(MockedEtcdWrapper)
+	client.On("Delete", mock.Anything, assignment, mock.Anything).Return(&clientv3.DeleteResponse{Deleted: 1}, nil)
+	client.On("Delete", mock.Anything, apputil.EtcdPathAppFencing(service, "s1#1"), mock.Anything).Return(&clientv3.DeleteResponse{Deleted: 1}, nil)
+	o := operator{lg: ttLogger, client: client, etcdPath: apputil.NewEtcdPath(""), isWatch: func(string) bool { return true }}
+	if err := o.dropOrAdd(&ma); err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+	client.AssertExpectations(t)
+	client.AssertNumberOfCalls(t, "Delete", 2)
+
+	// 删除shard时一起删除secondary副本的fencing节点
+	client = new(MockedEtcdWrapper)
+	client.On("Delete", mock.Anything, apputil.EtcdPathAppFencing(service, "s1"), mock.Anything).Return(&clientv3.DeleteResponse{Deleted: 1}, nil)
+	client.On("Delete", mock.Anything, apputil.EtcdPathAppFencing(service, "s1#"), mock.Anything).Return(&clientv3.DeleteResponse{Deleted: 2}, nil)
+	if err := unfence(context.TODO(), client, apputil.NewEtcdPath(""), service, "s1", true); err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+	client.AssertExpectations(t)
+}
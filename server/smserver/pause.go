@@ -0,0 +1,193 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxPauseDuration 暂停必须设置过期时间，防止忘记恢复的暂停长期影响调度
+	maxPauseDuration = 24 * time.Hour
+
+	// pauseCheckInterval 暂停期间等待执行的move检查是否已经恢复的间隔
+	pauseCheckInterval = time.Second
+)
+
+// errSchedulerPaused 暂停期间手动触发rebalance返回
+var errSchedulerPaused = errors.New("scheduler paused")
+
+// schedulerPause 全局暂停调度，暂停期间所有governor不计算rebalance、不执行move、不修正drift，leader不清理孤儿节点，
+// 用于etcd维护窗口等不希望有写入的场景，到期后自动恢复，不需要再写etcd
+type schedulerPause struct {
+	// Until 暂停结束时间，unix秒
+	Until int64 `json:"until"`
+
+	Reason string `json:"reason,omitempty"`
+
+	// Actor 发起暂停的来源ip
+	Actor string `json:"actor,omitempty"`
+
+	// CreateTime 发起暂停的时间，unix秒
+	CreateTime int64 `json:"createTime"`
+}
+
+func (p *schedulerPause) String() string {
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func (p *schedulerPause) active(now time.Time) bool {
+	return p != nil && now.Unix() < p.Until
+}
+
+// schedulerPause 没有暂停时返回nil，已经过期的暂停原样返回，由调用方判断
+func (c *smContainer) schedulerPause(ctx context.Context) (*schedulerPause, error) {
+	resp, err := c.Client.GetKV(ctx, c.nodeManager.nodeSMPause(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	var p schedulerPause
+	if err := json.Unmarshal(resp.Kvs[0].Value, &p); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &p, nil
+}
+
+// schedulerPaused 读取失败时按照暂停处理，etcd不可用时不继续调度
+func (c *smContainer) schedulerPaused(ctx context.Context) bool {
+	p, err := c.schedulerPause(ctx)
+	if err != nil {
+		c.lg.Error("get scheduler pause error", zap.Error(err))
+		return true
+	}
+	return p.active(time.Now())
+}
+
+// schedulerPaused container为空的场景 4 unit test
+func (ss *smShard) schedulerPaused(ctx context.Context) bool {
+	return ss.container != nil && ss.container.schedulerPaused(ctx)
+}
+
+// waitResume 暂停期间move在worker中等待，恢复后继续执行，smShard关闭时返回false
+func (ss *smShard) waitResume() bool {
+	logged := false
+	for ss.schedulerPaused(context.TODO()) {
+		if !logged {
+			ss.lg.Warn("scheduler paused, move waiting", zap.String("service", ss.service))
+			logged = true
+		}
+		select {
+		case <-ss.closing:
+			return false
+		case <-time.After(pauseCheckInterval):
+		}
+	}
+	return true
+}
+
+type pauseRequest struct {
+	// Duration 暂停的时长，单位秒，不超过24小时，到期自动恢复
+	Duration int `json:"duration" binding:"required"`
+
+	// Reason 记录在事件和暂停状态中，方便其他人了解暂停的原因
+	Reason string `json:"reason"`
+}
+
+// @Description pause leader-driven scheduling of all services until the duration expires
+// @Tags  leader
+// @Accept  json
+// @Produce  json
+// @Param param body pauseRequest true "param"
+// @success 200
+// @Router /sm/server/pause [post]
+func (ss *smShardApi) GinPause(c *gin.Context) {
+	var req pauseRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	if req.Duration <= 0 || time.Duration(req.Duration)*time.Second > maxPauseDuration {
+		err := errors.Errorf("duration should be in (0, %s]", maxPauseDuration)
+		ss.lg.Error("param error", zap.Reflect("req", req), zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	now := time.Now()
+	p := schedulerPause{
+		Until:      now.Add(time.Duration(req.Duration) * time.Second).Unix(),
+		Reason:     req.Reason,
+		Actor:      c.ClientIP(),
+		CreateTime: now.Unix(),
+	}
+	pfx := ss.container.nodeManager.nodeSMPause()
+	if _, err := ss.container.Client.Put(context.TODO(), pfx, p.String()); err != nil {
+		ss.lg.Error("Put error", zap.String("pfx", pfx), zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	ss.container.events.append(eventPause, ss.container.Service(), c.ClientIP(), fmt.Sprintf("pause scheduler %s", p.String()))
+	ss.lg.Info("scheduler paused", zap.Reflect("pause", p))
+	c.JSON(http.StatusOK, gin.H{"pause": p})
+}
+
+// @Description resume leader-driven scheduling paused by the pause api
+// @Tags  leader
+// @Produce  json
+// @success 200
+// @Router /sm/server/resume [post]
+func (ss *smShardApi) GinResume(c *gin.Context) {
+	pfx := ss.container.nodeManager.nodeSMPause()
+	if _, err := ss.container.Client.Delete(context.TODO(), pfx); err != nil {
+		ss.lg.Error("Delete error", zap.String("pfx", pfx), zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	ss.container.events.append(eventPause, ss.container.Service(), c.ClientIP(), "resume scheduler")
+	ss.lg.Info("scheduler resumed")
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// @Description whether leader-driven scheduling is paused
+// @Tags  leader
+// @Produce  json
+// @success 200
+// @Router /sm/server/pause-status [get]
+func (ss *smShardApi) GinPauseStatus(c *gin.Context) {
+	p, err := ss.container.schedulerPause(context.TODO())
+	if err != nil {
+		ss.lg.Error("schedulerPause error", zap.Error(err))
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	// 过期的暂停不再展示
+	if !p.active(time.Now()) {
+		p = nil
+	}
+	c.JSON(http.StatusOK, gin.H{"paused": p != nil, "pause": p})
+}
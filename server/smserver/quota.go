@@ -0,0 +1,151 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota 限制注册的service数量和单个service的shard数量，防止失控的自动化脚本打满etcd和leader，<=0不限制
+type Quota struct {
+	// MaxServices 注册的service数量上限，租户的quota只统计该租户创建的service
+	MaxServices int `json:"maxServices" yaml:"maxServices"`
+
+	// MaxShardsPerService 单个service的shard数量上限
+	MaxShardsPerService int `json:"maxShardsPerService" yaml:"maxShardsPerService"`
+}
+
+// quotaChecker 全局quota和租户quota同时生效，租户是鉴权的identity（token）
+type quotaChecker struct {
+	global  Quota
+	tenants map[string]Quota
+}
+
+// newQuotaChecker tenants的key是token，转换成和鉴权相同的identity
+func newQuotaChecker(global Quota, tenants map[string]Quota) *quotaChecker {
+	q := quotaChecker{global: global, tenants: make(map[string]Quota)}
+	for key, tq := range tenants {
+		q.tenants[key] = tq
+		q.tenants[tokenIdentity(key)] = tq
+	}
+	return &q
+}
+
+func (q *quotaChecker) enabled() bool {
+	if q == nil {
+		return false
+	}
+	if q.global.MaxServices > 0 || q.global.MaxShardsPerService > 0 {
+		return true
+	}
+	return len(q.tenants) > 0
+}
+
+// maxShards 全局和租户的上限取较小的一个，0表示不限制
+func (q *quotaChecker) maxShards(tenant string) int {
+	limit := q.global.MaxShardsPerService
+	if tq, ok := q.tenants[tenant]; ok && tq.MaxShardsPerService > 0 && (limit <= 0 || tq.MaxShardsPerService < limit) {
+		limit = tq.MaxShardsPerService
+	}
+	return limit
+}
+
+// checkServiceQuota 新增adding个service之前检查全局和租户的service数量
+func (ss *smShardApi) checkServiceQuota(ctx context.Context, tenant string, adding int) error {
+	q := ss.container.quotas
+	if !q.enabled() {
+		return nil
+	}
+	tq := q.tenants[tenant]
+	if q.global.MaxServices <= 0 && tq.MaxServices <= 0 {
+		return nil
+	}
+
+	// sm自身的shard就是注册的service，task中记录了创建service的租户
+	pfx := ss.container.nodeManager.nodeServiceShard(ss.container.Service(), "")
+	resp, err := ss.container.Client.GetKV(ctx, pfx, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if q.global.MaxServices > 0 && int(resp.Count)+adding > q.global.MaxServices {
+		return errors.Wrapf(errQuotaExceeded, "services %d, max %d", resp.Count, q.global.MaxServices)
+	}
+	if tq.MaxServices <= 0 {
+		return nil
+	}
+	var owned int
+	for _, kv := range resp.Kvs {
+		var spec apputil.ShardSpec
+		if err := json.Unmarshal(kv.Value, &spec); err != nil {
+			return errors.Wrap(err, string(kv.Value))
+		}
+		var st shardTask
+		if err := json.Unmarshal([]byte(spec.Task), &st); err != nil {
+			return errors.Wrap(err, spec.Task)
+		}
+		if st.Owner == tenant {
+			owned++
+		}
+	}
+	if owned+adding > tq.MaxServices {
+		return errors.Wrapf(errQuotaExceeded, "tenant services %d, max %d", owned, tq.MaxServices)
+	}
+	return nil
+}
+
+// checkShardQuota 给service新增adding个shard之前检查shard数量
+func (ss *smShardApi) checkShardQuota(ctx context.Context, tenant string, service string, adding int) error {
+	q := ss.container.quotas
+	if !q.enabled() {
+		return nil
+	}
+	limit := q.maxShards(tenant)
+	if limit <= 0 {
+		return nil
+	}
+	if adding > limit {
+		return errors.Wrapf(errQuotaExceeded, "service %s adding shards %d, max %d", service, adding, limit)
+	}
+	pfx := ss.container.nodeManager.nodeServiceShard(service, "")
+	resp, err := ss.container.Client.GetKV(ctx, pfx, []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCountOnly()})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if int(resp.Count)+adding > limit {
+		return errors.Wrapf(errQuotaExceeded, "service %s shards %d, max %d", service, resp.Count, limit)
+	}
+	return nil
+}
+
+// quotaErrCode quota检查的错误区分超限和etcd错误
+func quotaErrCode(err error) errCode {
+	if errors.Cause(err) == errQuotaExceeded {
+		return errCodeQuotaExceeded
+	}
+	return etcdErrCode(err, errCodeInternal)
+}
+
+// requestTenant 鉴权通过的identity，未开启鉴权时为空，只受全局quota限制
+func requestTenant(c *gin.Context) string {
+	return c.GetString(ctxKeyAuthIdentity)
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxRateLimitClients 记录的client数量超过后淘汰最久没有请求的client，防止大量不同ip撑大内存
+	maxRateLimitClients = 10000
+
+	// peerRefreshInterval sm节点列表的缓存时间，节点上下线之后最多延迟这么久生效
+	peerRefreshInterval = 5 * time.Second
+)
+
+// tokenBucket 按照rate持续补充token，最多积累burst个，每个请求消耗一个
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// allow 拒绝时返回下一个token可用的等待时间
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// clientBucket lru中的节点
+type clientBucket struct {
+	client string
+	bucket *tokenBucket
+}
+
+// apiRateLimiter 对 /sm/server 下的接口限流，per-client防止单个自动化脚本刷接口，
+// global保护leader的etcd带宽，任一限制触发都返回429
+type apiRateLimiter struct {
+	lg *zap.Logger
+
+	// auth 区分client使用鉴权通过的identity，未通过鉴权的token不能用来换新的桶
+	auth *apiAuth
+
+	// peers 判断带转发header的请求是否来自sm节点，为nil时不信任转发header
+	peers func(ip string) bool
+
+	mu sync.Mutex
+
+	// global 所有请求共享，rate<=0时为nil
+	global *tokenBucket
+
+	// clientRate 和 clientBurst 每个client单独的桶，clientRate<=0时不限制
+	clientRate  float64
+	clientBurst int
+	// clients 和 lru 最多记录 maxRateLimitClients 个client，lru头部是最近有请求的client
+	clients map[string]*list.Element
+	lru     *list.List
+}
+
+func newApiRateLimiter(lg *zap.Logger, auth *apiAuth, peers func(ip string) bool, globalRate float64, globalBurst int, clientRate float64, clientBurst int) *apiRateLimiter {
+	l := apiRateLimiter{
+		lg:          lg,
+		auth:        auth,
+		peers:       peers,
+		clientRate:  clientRate,
+		clientBurst: clientBurst,
+		clients:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+	if globalRate > 0 {
+		l.global = newTokenBucket(globalRate, globalBurst, time.Now())
+	}
+	return &l
+}
+
+func (l *apiRateLimiter) enabled() bool {
+	return l != nil && (l.global != nil || l.clientRate > 0)
+}
+
+// wrap 在鉴权之前执行，被限流的请求不会访问etcd
+func (l *apiRateLimiter) wrap(handler func(c *gin.Context)) func(c *gin.Context) {
+	if !l.enabled() {
+		return handler
+	}
+	return func(c *gin.Context) {
+		// sm节点转发过来的请求在转发节点上已经做过per-client的限制，这里只计入global，
+		// 其他来源的转发header是伪造的，按照普通请求处理
+		client := ""
+		if c.GetHeader(forwardedHeader) == "" || !l.fromPeer(c) {
+			client = l.client(c)
+		}
+		ok, wait := l.allow(client, time.Now())
+		if !ok {
+			l.lg.Warn(
+				"request rate limited",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("client", client),
+				zap.Duration("wait", wait),
+			)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			apiErrorResponse(c, errCodeRateLimited, errors.New("rate limited"))
+			return
+		}
+		handler(c)
+	}
+}
+
+// allow client为空时只检查global，client被拒绝时不消耗global的token
+func (l *apiRateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if client != "" && l.clientRate > 0 {
+		if ok, wait := l.clientBucket(client, now).allow(now); !ok {
+			return false, wait
+		}
+	}
+	if l.global != nil {
+		return l.global.allow(now)
+	}
+	return true, 0
+}
+
+// clientBucket 超过 maxRateLimitClients 时淘汰最久没有请求的client，被淘汰的client重新创建满的桶，
+// 只影响长时间不活跃的client
+func (l *apiRateLimiter) clientBucket(client string, now time.Time) *tokenBucket {
+	if e, ok := l.clients[client]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*clientBucket).bucket
+	}
+	for l.lru.Len() >= maxRateLimitClients {
+		e := l.lru.Back()
+		l.lru.Remove(e)
+		delete(l.clients, e.Value.(*clientBucket).client)
+	}
+	cb := &clientBucket{client: client, bucket: newTokenBucket(l.clientRate, l.clientBurst, now)}
+	l.clients[client] = l.lru.PushFront(cb)
+	return cb.bucket
+}
+
+// client 鉴权通过的请求按照identity区分client，同一个ip上的多个租户互不影响，否则按照连接的ip区分，
+// 日志中会记录client，identity使用hash
+func (l *apiRateLimiter) client(c *gin.Context) string {
+	if l.auth.enabled() {
+		if identity, _, ok := l.auth.identify(c); ok {
+			sum := sha256.Sum256([]byte(identity))
+			return "identity:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	return "ip:" + remoteHost(c)
+}
+
+// fromPeer 使用连接的地址判断
+func (l *apiRateLimiter) fromPeer(c *gin.Context) bool {
+	if l.peers == nil {
+		return false
+	}
+	host := remoteHost(c)
+	return host != "" && l.peers(host)
+}
+
+// remoteHost 连接的ip，不能使用 ClientIP ，engine没有配置可信代理时 X-Forwarded-For 可以任意伪造
+func remoteHost(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// smPeers sm集群中各节点的ip，从sm自己的container heartbeat中获取，container id是节点的 host:port
+type smPeers struct {
+	lg        *zap.Logger
+	container *smContainer
+
+	mu     sync.Mutex
+	ips    map[string]struct{}
+	loaded time.Time
+	// refreshing 同时只有一个请求刷新列表
+	refreshing bool
+}
+
+func newSMPeers(lg *zap.Logger, container *smContainer) *smPeers {
+	return &smPeers{lg: lg, container: container}
+}
+
+// contains 列表过期时在后台刷新，请求不等待etcd和dns，只有第一次加载时同步等待
+func (p *smPeers) contains(ip string) bool {
+	p.mu.Lock()
+	refresh := !p.refreshing && time.Since(p.loaded) > peerRefreshInterval
+	first := p.loaded.IsZero()
+	if refresh {
+		p.refreshing = true
+	}
+	p.mu.Unlock()
+
+	if refresh {
+		if first {
+			p.refresh()
+		} else {
+			go p.refresh()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.ips[ip]
+	return ok
+}
+
+// refresh 在锁外读取etcd和解析域名
+func (p *smPeers) refresh() {
+	ips, err := p.load()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshing = false
+	if err != nil {
+		// 读取失败时沿用之前的列表，这段时间新加入的节点转发的请求按照普通请求处理
+		p.lg.Warn("load sm peers error", zap.Error(err))
+		return
+	}
+	p.ips = ips
+	p.loaded = time.Now()
+}
+
+func (p *smPeers) load() (map[string]struct{}, error) {
+	pfx := p.container.nodeManager.nodeServiceContainerHb(p.container.Service())
+	resp, err := p.container.Client.GetKV(context.TODO(), pfx, []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithKeysOnly()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	ips := make(map[string]struct{})
+	for _, kv := range resp.Kvs {
+		// key: <pfx><container id>/<lease>
+		id := strings.TrimPrefix(string(kv.Key), pfx)
+		if idx := strings.LastIndex(id, "/"); idx > 0 {
+			id = id[:idx]
+		}
+		host, _, err := net.SplitHostPort(id)
+		if err != nil {
+			host = id
+		}
+		if net.ParseIP(host) != nil {
+			ips[host] = struct{}{}
+			continue
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			p.lg.Warn("lookup sm peer error", zap.String("host", host), zap.Error(err))
+			continue
+		}
+		for _, addr := range addrs {
+			ips[addr] = struct{}{}
+		}
+	}
+	return ips, nil
+}
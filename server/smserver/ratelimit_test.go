@@ -0,0 +1,195 @@
+package smserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_apiRateLimiter_allow(t *testing.T) {
+	now := time.Now()
+	l := newApiRateLimiter(ttLogger, nil, nil, 3, 3, 1, 2)
+
+	// 单个client超过burst后被拒绝，不影响其他client
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Errorf("expect allowed at %d", i)
+			t.SkipNow()
+		}
+	}
+	if ok, wait := l.allow("a", now); ok || wait != time.Second {
+		t.Errorf("expect client limited, wait %s", wait)
+		t.SkipNow()
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Errorf("expect other client allowed")
+		t.SkipNow()
+	}
+
+	// global的token已经用完
+	if ok, _ := l.allow("c", now); ok {
+		t.Errorf("expect global limited")
+		t.SkipNow()
+	}
+
+	// token按照rate补充
+	if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+		t.Errorf("expect allowed after refill")
+	}
+}
+
+func Test_apiRateLimiter_wrap(t *testing.T) {
+	router := gin.New()
+	l := newApiRateLimiter(ttLogger, nil, nil, 0, 0, 1, 1)
+	router.GET("/sm/server/get-spec", l.wrap(func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) }))
+
+	codes := make([]int, 0, 2)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/sm/server/get-spec", nil)
+		req.Header.Set(headerToken, "t1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("unexpected Retry-After %s", w.Header().Get("Retry-After"))
+		}
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("unexpected codes %v", codes)
+	}
+
+	// 不在sm节点列表中的转发header不能绕过per-client的限制
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/get-spec", nil)
+	req.Header.Set(forwardedHeader, "127.0.0.1:8888")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expect forged forward limited, actual %d", w.Code)
+	}
+
+	// 未配置时不限流
+	if newApiRateLimiter(ttLogger, nil, nil, 0, 0, 0, 0).enabled() {
+		t.Errorf("expect disabled")
+	}
+}
+
+func Test_apiRateLimiter_client(t *testing.T) {
+	auth := newApiAuth(ttLogger, map[string][]string{"t1": {"foo"}})
+	peers := func(ip string) bool { return ip == "10.0.0.1" }
+	l := newApiRateLimiter(ttLogger, auth, peers, 0, 0, 1, 1)
+
+	var tests = []struct {
+		token    string
+		remote   string
+		xff      string
+		forward  bool
+		expected string
+	}{
+		// 无效的token按照ip区分，更换token不能获取新的桶
+		{token: "junk-1", remote: "192.0.2.1:1234", expected: "ip:192.0.2.1"},
+		{token: "junk-2", remote: "192.0.2.1:1234", expected: "ip:192.0.2.1"},
+		{token: "", remote: "192.0.2.1:1234", expected: "ip:192.0.2.1"},
+		// 伪造的 X-Forwarded-For 不能获取新的桶
+		{token: "", remote: "192.0.2.1:1234", xff: "198.51.100.7", expected: "ip:192.0.2.1"},
+	}
+	for idx, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/sm/server/get-spec", nil)
+		c.Request.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			c.Request.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.token != "" {
+			c.Request.Header.Set(headerToken, tt.token)
+		}
+		if actual := l.client(c); actual != tt.expected {
+			t.Errorf("idx %d expect %s actual %s", idx, tt.expected, actual)
+		}
+	}
+
+	// 有效token按照identity区分，不包含token本身
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/sm/server/get-spec", nil)
+	c.Request.Header.Set(headerToken, "t1")
+	if actual := l.client(c); !strings.HasPrefix(actual, "identity:") || strings.Contains(actual, "t1") {
+		t.Errorf("unexpected client %s", actual)
+	}
+
+	c.Request.RemoteAddr = "10.0.0.1:5678"
+	if !l.fromPeer(c) {
+		t.Errorf("expect peer")
+	}
+	c.Request.RemoteAddr = "10.0.0.2:5678"
+	if l.fromPeer(c) {
+		t.Errorf("expect not peer")
+	}
+}
+
+func Test_apiRateLimiter_lru(t *testing.T) {
+	now := time.Now()
+	l := newApiRateLimiter(ttLogger, nil, nil, 0, 0, 1, 1)
+	for i := 0; i < maxRateLimitClients+10; i++ {
+		l.allow(fmt.Sprintf("ip:%d", i), now)
+	}
+	if len(l.clients) != maxRateLimitClients || l.lru.Len() != maxRateLimitClients {
+		t.Errorf("unexpected clients %d", len(l.clients))
+	}
+	// 最早的client被淘汰
+	if _, ok := l.clients["ip:0"]; ok {
+		t.Errorf("expect evicted")
+	}
+	if _, ok := l.clients[fmt.Sprintf("ip:%d", maxRateLimitClients+9)]; !ok {
+		t.Errorf("expect kept")
+	}
+}
+
+func Test_smPeers_contains(t *testing.T) {
+	container := &smContainer{
+		Container:   &apputil.Container{},
+		nodeManager: &nodeManager{smService: "foo", etcdPath: apputil.NewEtcdPath("")},
+	}
+	pfx := container.nodeManager.nodeServiceContainerHb(container.Service())
+	resp := &clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte(pfx + "10.0.0.1:8888/7")}}}
+
+	// 第一次同步加载
+	client := new(MockedEtcdWrapper)
+	client.On("GetKV", mock.Anything, pfx, mock.Anything).Return(resp, nil).Once()
+	container.Client = client
+	p := newSMPeers(ttLogger, container)
+	if !p.contains("10.0.0.1") || p.contains("10.0.0.2") {
+		t.Fatalf("unexpected peers %v", p.ips)
+	}
+
+	// 过期后在后台刷新，刷新阻塞时请求使用之前的列表
+	block := make(chan struct{})
+	refreshed := &clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte(pfx + "10.0.0.2:8888/8")}}}
+	client.On("GetKV", mock.Anything, pfx, mock.Anything).Run(func(mock.Arguments) { <-block }).Return(refreshed, nil).Once()
+	p.mu.Lock()
+	p.loaded = time.Now().Add(-2 * peerRefreshInterval)
+	p.mu.Unlock()
+
+	done := make(chan bool)
+	go func() { done <- p.contains("10.0.0.1") }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("expect previous peers")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("contains blocked by refresh")
+	}
+
+	close(block)
+	assert.Eventually(t, func() bool { return p.contains("10.0.0.2") }, time.Second, 10*time.Millisecond)
+	client.AssertNumberOfCalls(t, "GetKV", 2)
+}
@@ -0,0 +1,404 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/coordination"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultCacheWatchBuffer 每个watcher缓冲的watch response，消费跟不上时关闭watcher，客户端重连即可
+	defaultCacheWatchBuffer = 128
+
+	// defaultCacheReloadBackoff watch中断后重新全量加载的间隔
+	defaultCacheReloadBackoff = time.Second
+
+	// defaultReplicaShutdownTimeout 只读副本关闭http server时等待进行中请求的时间
+	defaultReplicaShutdownTimeout = 10 * time.Second
+)
+
+var errReadOnly = errors.New("read-only replica")
+
+// rejectReadOnly 只读副本上的写接口直接返回 READ_ONLY，需要调用leader或者普通的smserver
+func rejectReadOnly(_ gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiErrorResponse(c, errCodeReadOnly, errReadOnly)
+	}
+}
+
+// cacheWatcher 订阅缓存中[key, end)范围内的变化，end为空时只订阅key
+type cacheWatcher struct {
+	key string
+	end string
+	ch  chan clientv3.WatchResponse
+}
+
+// readCache 只读副本使用的etcd缓存，启动时全量加载prefix下的kv，之后通过一个watch保持更新，
+// GetKV、GetKVs和Watch从缓存返回，写操作返回 errReadOnly，带revision的读和Get透传给etcd
+type readCache struct {
+	lg     *zap.Logger
+	client etcdutil.EtcdWrapper
+	pfx    string
+
+	stopper *apputil.GoroutineStopper
+
+	mu  sync.RWMutex
+	kvs map[string]*mvccpb.KeyValue
+	rev int64
+	// synced watch中断后到重新加载完成之前为false，期间返回的是旧数据
+	synced      bool
+	unsyncedErr error
+	watchers    map[*cacheWatcher]struct{}
+}
+
+// newReadCache 完成第一次全量加载后返回，之后在后台watch
+func newReadCache(lg *zap.Logger, client etcdutil.EtcdWrapper, pfx string) (*readCache, error) {
+	c := readCache{
+		lg:       lg,
+		client:   client,
+		pfx:      pfx,
+		stopper:  apputil.NewGoroutineStopper("readCache"),
+		kvs:      make(map[string]*mvccpb.KeyValue),
+		watchers: make(map[*cacheWatcher]struct{}),
+	}
+	if err := c.load(context.TODO()); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	c.stopper.Wrap(c.run)
+	return &c, nil
+}
+
+// load 全量加载prefix，已有的watcher可能错过了中间的事件，全部关闭
+func (c *readCache) load(ctx context.Context) error {
+	resp, err := c.client.GetKV(ctx, c.pfx, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	kvs := make(map[string]*mvccpb.KeyValue, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = kv
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kvs = kvs
+	c.rev = resp.Header.GetRevision()
+	c.synced = true
+	c.unsyncedErr = nil
+	for w := range c.watchers {
+		close(w.ch)
+		delete(c.watchers, w)
+	}
+	return nil
+}
+
+// run watch从上次加载的revision开始，revision被compact或者watch中断时重新全量加载
+func (c *readCache) run(ctx context.Context) {
+	for {
+		c.mu.RLock()
+		rev := c.rev
+		c.mu.RUnlock()
+
+		wc := c.client.Watch(ctx, c.pfx, clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithRev(rev+1))
+		var err error
+		for wr := range wc {
+			if err = wr.Err(); err != nil {
+				break
+			}
+			c.apply(&wr)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("watch closed")
+		}
+		c.lg.Warn(
+			"read cache watch stopped, reload",
+			zap.String("pfx", c.pfx),
+			zap.Int64("rev", rev),
+			zap.Error(err),
+		)
+		c.mu.Lock()
+		c.synced = false
+		c.unsyncedErr = err
+		c.mu.Unlock()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(defaultCacheReloadBackoff):
+			}
+			if err := c.load(ctx); err != nil {
+				c.lg.Error(
+					"read cache reload error",
+					zap.String("pfx", c.pfx),
+					zap.Error(err),
+				)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// apply 更新缓存并通知订阅了对应key的watcher
+func (c *readCache) apply(wr *clientv3.WatchResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ev := range wr.Events {
+		key := string(ev.Kv.Key)
+		if ev.Type == mvccpb.DELETE {
+			delete(c.kvs, key)
+		} else {
+			c.kvs[key] = ev.Kv
+		}
+	}
+	if wr.Header.GetRevision() > c.rev {
+		c.rev = wr.Header.GetRevision()
+	}
+
+	for w := range c.watchers {
+		var events []*clientv3.Event
+		for _, ev := range wr.Events {
+			if inKeyRange(string(ev.Kv.Key), w.key, w.end) {
+				events = append(events, ev)
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		select {
+		case w.ch <- clientv3.WatchResponse{Header: wr.Header, Events: events}:
+		default:
+			c.lg.Warn(
+				"slow cache watcher closed",
+				zap.String("key", w.key),
+			)
+			close(w.ch)
+			delete(c.watchers, w)
+		}
+	}
+}
+
+// check health接口使用，watch中断期间为warn
+func (c *readCache) check() (string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.synced {
+		return selfCheckWarn, fmt.Sprintf("reloading after revision %d: %v", c.rev, c.unsyncedErr)
+	}
+	return selfCheckOk, fmt.Sprintf("revision %d, %d keys", c.rev, len(c.kvs))
+}
+
+func (c *readCache) Close() {
+	c.stopper.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for w := range c.watchers {
+		close(w.ch)
+		delete(c.watchers, w)
+	}
+}
+
+// inKeyRange 和etcd的range语义一致，end为"\x00"时表示key之后的所有key
+func inKeyRange(k, key, end string) bool {
+	if end == "" {
+		return k == key
+	}
+	return k >= key && (end == "\x00" || k < end)
+}
+
+func (c *readCache) GetKV(ctx context.Context, node string, opts []clientv3.OpOption) (*clientv3.GetResponse, error) {
+	op := clientv3.OpGet(node, opts...)
+	if op.Rev() != 0 || !strings.HasPrefix(node, c.pfx) {
+		return c.client.GetKV(ctx, node, opts)
+	}
+	key, end := string(op.KeyBytes()), string(op.RangeBytes())
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resp := clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: c.rev}}
+	for k, kv := range c.kvs {
+		if !inKeyRange(k, key, end) {
+			continue
+		}
+		resp.Count++
+		if op.IsCountOnly() {
+			continue
+		}
+		if op.IsKeysOnly() {
+			kv = &mvccpb.KeyValue{Key: kv.Key, CreateRevision: kv.CreateRevision, ModRevision: kv.ModRevision, Version: kv.Version, Lease: kv.Lease}
+		}
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key) })
+	return &resp, nil
+}
+
+func (c *readCache) GetKVs(ctx context.Context, prefix string) (map[string]string, error) {
+	resp, err := c.GetKV(ctx, prefix, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrapf(err, "FAILED to GetKV prefix %s", prefix)
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	r := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		_, file := filepath.Split(string(kv.Key))
+		r[file] = string(kv.Value)
+	}
+	return r, nil
+}
+
+// Watch 从缓存订阅变化，不支持指定revision，事件总是带有PrevKv，缓存重新加载时channel被关闭
+func (c *readCache) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	w := cacheWatcher{key: string(op.KeyBytes()), end: string(op.RangeBytes()), ch: make(chan clientv3.WatchResponse, defaultCacheWatchBuffer)}
+	c.mu.Lock()
+	c.watchers[&w] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.watchers[&w]; ok {
+			close(w.ch)
+			delete(c.watchers, &w)
+		}
+	}()
+	return w.ch
+}
+
+func (c *readCache) Ctx() context.Context {
+	return c.client.Ctx()
+}
+
+func (c *readCache) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return c.client.Get(ctx, key, opts...)
+}
+
+func (c *readCache) UpdateKV(_ context.Context, _ string, _ string) error {
+	return errReadOnly
+}
+
+func (c *readCache) UpdateKVWithRevision(_ context.Context, _ string, _ string, _ int64) error {
+	return errReadOnly
+}
+
+func (c *readCache) DelKV(_ context.Context, _ string) error {
+	return errReadOnly
+}
+
+func (c *readCache) CreateAndGet(_ context.Context, _ []string, _ []string, _ clientv3.LeaseID) error {
+	return errReadOnly
+}
+
+func (c *readCache) CompareAndSwap(_ context.Context, _ string, _ string, _ string, _ clientv3.LeaseID) (string, error) {
+	return "", errReadOnly
+}
+
+func (c *readCache) Put(_ context.Context, _, _ string, _ ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	return nil, errReadOnly
+}
+
+func (c *readCache) Delete(_ context.Context, _ string, _ ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	return nil, errReadOnly
+}
+
+// readReplica 只读模式的smserver，不注册为sm的container，不参与leader竞选和service的管理
+type readReplica struct {
+	lg     *zap.Logger
+	client *etcdutil.EtcdClient
+	cache  *readCache
+	srv    *http.Server
+}
+
+func (s *Server) runReadOnly() error {
+	client, etcdPath, err := newOptionsEtcdClient(s.opts)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	cache, err := newReadCache(s.opts.lg, client, etcdPath.Prefix()+"/")
+	if err != nil {
+		client.Close()
+		return errors.Wrap(err, "")
+	}
+
+	// leader的查询依赖etcd的排序，直接使用etcd
+	container := apputil.NewReadOnlyContainer(s.opts.id, s.opts.service, cache, coordination.NewEtcdBackend(client), etcdPath, s.opts.lg)
+	smContainer := initSMContainer(s.opts.lg, container, s.opts.stabilizationDelay)
+	smContainer.cache = cache
+	smContainer.history.setSize(s.opts.shardHistorySize)
+	smContainer.taskKey = s.opts.taskKey
+	s.smContainer = smContainer
+
+	router := gin.Default()
+	for route, handler := range s.getHandlers(smContainer) {
+		router.Any(route, handler)
+	}
+	srv := &http.Server{Addr: s.opts.addr, Handler: router}
+	s.replica = &readReplica{lg: s.opts.lg, client: client, cache: cache, srv: srv}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.opts.lg.Panic(
+				"failed to listen",
+				zap.Error(err),
+				zap.String("addr", s.opts.addr),
+			)
+		}
+	}()
+	s.opts.lg.Info(
+		"read-only replica started",
+		zap.String("id", s.opts.id),
+		zap.String("addr", s.opts.addr),
+	)
+	return nil
+}
+
+func (r *readReplica) close(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultReplicaShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := r.srv.Shutdown(ctx); err != nil {
+		r.lg.Warn("shutdown http server error", zap.Error(err))
+	}
+	r.cache.Close()
+	r.client.Close()
+}
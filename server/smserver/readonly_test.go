@@ -0,0 +1,62 @@
+package smserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_readCache(t *testing.T) {
+	c := &readCache{
+		lg:       ttLogger,
+		pfx:      "/sm/",
+		kvs:      make(map[string]*mvccpb.KeyValue),
+		watchers: make(map[*cacheWatcher]struct{}),
+		synced:   true,
+	}
+	put := func(rev int64, key, value string) *clientv3.WatchResponse {
+		return &clientv3.WatchResponse{
+			Header: etcdserverpb.ResponseHeader{Revision: rev},
+			Events: []*clientv3.Event{{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: rev}}},
+		}
+	}
+	c.apply(put(2, "/sm/app/foo/shard/s2", "b"))
+	c.apply(put(3, "/sm/app/foo/shard/s1", "a"))
+	c.apply(put(4, "/sm/app/bar/shard/s1", "c"))
+
+	resp, err := c.GetKV(context.TODO(), "/sm/app/foo/shard/", []clientv3.OpOption{clientv3.WithPrefix()})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), resp.Count)
+	assert.Equal(t, int64(4), resp.Header.Revision)
+	assert.Equal(t, "/sm/app/foo/shard/s1", string(resp.Kvs[0].Key))
+
+	resp, _ = c.GetKV(context.TODO(), "/sm/app/", []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCountOnly()})
+	assert.Equal(t, int64(3), resp.Count)
+	assert.Empty(t, resp.Kvs)
+
+	kvs, _ := c.GetKVs(context.TODO(), "/sm/app/foo/shard/")
+	assert.Equal(t, map[string]string{"s1": "a", "s2": "b"}, kvs)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	wc := c.Watch(ctx, "/sm/app/bar/", clientv3.WithPrefix())
+	c.apply(put(5, "/sm/app/foo/shard/s3", "d"))
+	c.apply(&clientv3.WatchResponse{
+		Header: etcdserverpb.ResponseHeader{Revision: 6},
+		Events: []*clientv3.Event{{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte("/sm/app/bar/shard/s1"), ModRevision: 6}}},
+	})
+	wr := <-wc
+	assert.Len(t, wr.Events, 1)
+	assert.Equal(t, int64(6), wr.Header.Revision)
+	resp, _ = c.GetKV(context.TODO(), "/sm/app/bar/shard/s1", nil)
+	assert.Equal(t, int64(0), resp.Count)
+
+	cancel()
+	_, ok := <-wc
+	assert.False(t, ok)
+
+	assert.Equal(t, errReadOnly, c.UpdateKV(context.TODO(), "/sm/foo", "bar"))
+}
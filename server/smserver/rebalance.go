@@ -0,0 +1,265 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type roundState string
+
+const (
+	// roundPlanned move已经计算出来，在队列中等待执行
+	roundPlanned roundState = "planned"
+	// roundRunning operator正在执行move
+	roundRunning roundState = "running"
+	// roundCompleted 所有move执行成功
+	roundCompleted roundState = "completed"
+	// roundFailed 所有move执行结束，存在重试后仍然失败的move
+	roundFailed roundState = "failed"
+)
+
+// rebalanceRound balanceChecker每次产生move时开始新的一轮，etcd中只保留service最近的一轮
+type rebalanceRound struct {
+	Id      string     `json:"id"`
+	Service string     `json:"service"`
+	State   roundState `json:"state"`
+
+	// Planned 本轮计划的move
+	Planned moveActionList `json:"planned"`
+
+	// Completed 执行成功的shard
+	Completed []string `json:"completed"`
+
+	// Failed 重试后仍然失败的shard
+	Failed []string `json:"failed"`
+
+	// StartTime 和UpdateTime都是unix秒
+	StartTime  int64 `json:"startTime"`
+	UpdateTime int64 `json:"updateTime"`
+}
+
+func (r *rebalanceRound) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// roundTracker 记录service当前一轮rebalance的进度，每次变化写入etcd，leader切换后从新的一轮开始记录
+type roundTracker struct {
+	lg      *zap.Logger
+	service string
+
+	// persist 写入存储，4 unit test
+	persist func(round *rebalanceRound)
+
+	mu    sync.Mutex
+	round *rebalanceRound
+}
+
+func newRoundTracker(lg *zap.Logger, service string, persist func(round *rebalanceRound)) *roundTracker {
+	return &roundTracker{lg: lg, service: service, persist: persist}
+}
+
+// start 开始新的一轮，返回round id，上一轮没有执行完的move不再记录
+func (t *roundTracker) start(mals moveActionList) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.round = &rebalanceRound{
+		Id:         strconv.FormatInt(now.UnixNano(), 10),
+		Service:    t.service,
+		State:      roundPlanned,
+		Planned:    mals,
+		StartTime:  now.Unix(),
+		UpdateTime: now.Unix(),
+	}
+	t.persist(t.round)
+	return t.round.Id
+}
+
+// running operator开始执行id对应的move
+func (t *roundTracker) running(id string) {
+	t.update(id, func(round *rebalanceRound) {
+		if round.State == roundPlanned {
+			round.State = roundRunning
+		}
+	})
+}
+
+// done 记录单个move的执行结果，失败的move在operator重试结束后才记录
+func (t *roundTracker) done(id string, shardId string, err error) {
+	t.update(id, func(round *rebalanceRound) {
+		round.Completed = removeString(round.Completed, shardId)
+		round.Failed = removeString(round.Failed, shardId)
+		if err != nil {
+			round.Failed = append(round.Failed, shardId)
+		} else {
+			round.Completed = append(round.Completed, shardId)
+		}
+
+		switch {
+		case len(round.Completed)+len(round.Failed) < len(round.Planned):
+			round.State = roundRunning
+		case len(round.Failed) > 0:
+			round.State = roundFailed
+		default:
+			round.State = roundCompleted
+		}
+	})
+}
+
+func (t *roundTracker) update(id string, fn func(round *rebalanceRound)) {
+	if t == nil || id == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// 已经开始新的一轮
+	if t.round == nil || t.round.Id != id {
+		return
+	}
+	fn(t.round)
+	t.round.UpdateTime = time.Now().Unix()
+	t.persist(t.round)
+}
+
+func removeString(arr []string, s string) []string {
+	var r []string
+	for _, v := range arr {
+		if v != s {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// persistRound 写入失败只打印日志，不影响move的执行
+func (ss *smShard) persistRound(round *rebalanceRound) {
+	key := ss.container.nodeManager.nodeServiceRebalance(ss.service)
+	if _, err := ss.container.Client.Put(context.TODO(), key, round.String()); err != nil {
+		ss.lg.Error(
+			"persist rebalance round error",
+			zap.String("key", key),
+			zap.String("round", round.Id),
+			zap.Error(err),
+		)
+	}
+}
+
+// @Description evaluate the rebalance of the service immediately instead of waiting for the periodic check
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200
+// @Router /sm/server/trigger-rebalance [post]
+func (ss *smShardApi) GinTriggerRebalance(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	shard, err := ss.container.GetShard(service)
+	if err != nil {
+		ss.lg.Error(
+			"shard not found",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", service))
+		return
+	}
+	if err := shard.TriggerRebalance(c.Request.Context()); err != nil {
+		ss.lg.Error(
+			"TriggerRebalance error",
+			zap.String("service", service),
+			zap.Error(err),
+		)
+		code := etcdErrCode(err, errCodeInternal)
+		if errors.Cause(err) == errSchedulerPaused {
+			code = errCodeConflict
+		}
+		apiErrorResponse(c, code, err)
+		return
+	}
+
+	ss.lg.Info("trigger rebalance success", zap.String("service", service))
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// @Description get the state of the latest rebalance round
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200
+// @Router /sm/server/rebalance-status [get]
+func (ss *smShardApi) GinRebalanceStatus(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	// 进度持久化在etcd中，任意sm container都可以查询
+	key := ss.container.nodeManager.nodeServiceRebalance(service)
+	resp, err := ss.container.Client.GetKV(context.TODO(), key, nil)
+	if err != nil {
+		ss.lg.Error(
+			"GetKV error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	if resp.Count == 0 {
+		apiErrorResponse(c, errCodeRoundNotFound, errors.Errorf("no rebalance round for service[%s]", service))
+		return
+	}
+	var round rebalanceRound
+	if err := json.Unmarshal(resp.Kvs[0].Value, &round); err != nil {
+		ss.lg.Error(
+			"Unmarshal error",
+			zap.ByteString("value", resp.Kvs[0].Value),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, errCodeInternal, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"round": &round})
+}
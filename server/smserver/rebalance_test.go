@@ -0,0 +1,83 @@
+package smserver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+func Test_roundTracker(t *testing.T) {
+	var persisted []roundState
+	tracker := newRoundTracker(zap.NewNop(), "foo.bar", func(round *rebalanceRound) {
+		persisted = append(persisted, round.State)
+	})
+
+	mals := moveActionList{
+		&moveAction{Service: "foo.bar", ShardId: "s1", AddEndpoint: "c1"},
+		&moveAction{Service: "foo.bar", ShardId: "s2", AddEndpoint: "c2"},
+	}
+	id := tracker.start(mals)
+	if id == "" {
+		t.Error("expect round id")
+		t.SkipNow()
+	}
+
+	tracker.running(id)
+	tracker.done(id, "s1", nil)
+	// 不属于当前轮次的move不记录
+	tracker.done("other", "s2", nil)
+	tracker.done(id, "s2", errors.New("fake"))
+	expect := []roundState{roundPlanned, roundRunning, roundRunning, roundFailed}
+	if !reflect.DeepEqual(persisted, expect) {
+		t.Errorf("actual %v expect %v", persisted, expect)
+		t.SkipNow()
+	}
+
+	// 重试成功后从失败中移除
+	tracker.done(id, "s2", nil)
+	if tracker.round.State != roundCompleted || len(tracker.round.Failed) != 0 || !reflect.DeepEqual(tracker.round.Completed, []string{"s1", "s2"}) {
+		t.Errorf("unexpected round %s", tracker.round.String())
+		t.SkipNow()
+	}
+
+	// 新的一轮开始后，上一轮的move不再记录
+	newId := tracker.start(mals[:1])
+	tracker.done(id, "s1", nil)
+	if tracker.round.Id != newId || tracker.round.State != roundPlanned {
+		t.Errorf("unexpected round %s", tracker.round.String())
+	}
+}
+
+func Test_smShard_TriggerRebalance(t *testing.T) {
+	mpr := &mapper{lg: ttLogger, appSpec: &smAppSpec{Service: "foo.bar"}}
+	mpr.containerState = newMapperState(mpr, containerTrigger)
+	mpr.shardState = newMapperState(mpr, shardTrigger)
+	ss := smShard{
+		service:    "foo.bar",
+		lg:         ttLogger,
+		mpr:        mpr,
+		appSpec:    &smAppSpec{Frozen: true},
+		closing:    make(chan struct{}),
+		rebalancec: make(chan chan error),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exitc := make(chan struct{})
+	go func() {
+		ss.balanceLoop(ctx)
+		close(exitc)
+	}()
+	if err := ss.TriggerRebalance(context.Background()); err != nil {
+		t.Errorf("unexpected err %v", err)
+	}
+
+	cancel()
+	<-exitc
+	close(ss.closing)
+	if err := ss.TriggerRebalance(context.Background()); err == nil {
+		t.Error("expect err after close")
+	}
+}
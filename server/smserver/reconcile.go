@@ -0,0 +1,226 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+type driftKind string
+
+const (
+	// driftWrongContainer shard在和状态记录不一致的container上运行
+	driftWrongContainer driftKind = "wrongContainer"
+	// driftZombie shard配置已经删除，或者除了运行的container之外还有container在等待shard的lock
+	driftZombie driftKind = "zombie"
+	// driftStaleState 状态记录中的container已经不存在，shard只在一个container上运行，修正状态记录
+	driftStaleState driftKind = "staleState"
+)
+
+// drift etcd中期望的分配和container通过shardhb上报的实际分配之间的差异
+type drift struct {
+	Kind    driftKind `json:"kind"`
+	ShardId string    `json:"shardId"`
+
+	// ContainerId 实际运行或者等待shard的container
+	ContainerId string `json:"containerId"`
+	// Expected 状态记录中shard所在的container
+	Expected string `json:"expected,omitempty"`
+}
+
+func (d *drift) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s", d.Kind, d.ShardId, d.ContainerId, d.Expected)
+}
+
+// shardOwner shardhb中的一个节点，holder是持有lock并写入heartbeat的container，其他是在等待lock的container
+type shardOwner struct {
+	containerId string
+	holder      bool
+}
+
+// detectDrift 对比shard配置、状态记录和shardhb，只处理状态是Running的shard，其他状态的move还在进行中或者由balanceChecker处理
+func detectDrift(specs map[string]struct{}, states map[string]*shardStateRecord, owners map[string][]*shardOwner, alive ArmorMap) []*drift {
+	var r []*drift
+	for shardId, os := range owners {
+		if _, ok := specs[shardId]; !ok {
+			// 持有lock的container由balanceChecker drop，等待lock的container不在shardhb中体现
+			for _, o := range os {
+				if !o.holder {
+					r = append(r, &drift{Kind: driftZombie, ShardId: shardId, ContainerId: o.containerId})
+				}
+			}
+			continue
+		}
+
+		record := states[shardId]
+		if record == nil || record.State != shardStateRunning {
+			continue
+		}
+		var holder string
+		for _, o := range os {
+			if o.holder {
+				holder = o.containerId
+				continue
+			}
+			if o.containerId != record.ContainerId {
+				r = append(r, &drift{Kind: driftZombie, ShardId: shardId, ContainerId: o.containerId, Expected: record.ContainerId})
+			}
+		}
+		if holder == "" || holder == record.ContainerId {
+			continue
+		}
+		if _, ok := alive[record.ContainerId]; ok {
+			r = append(r, &drift{Kind: driftWrongContainer, ShardId: shardId, ContainerId: holder, Expected: record.ContainerId})
+		} else {
+			r = append(r, &drift{Kind: driftStaleState, ShardId: shardId, ContainerId: holder, Expected: record.ContainerId})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].key() < r[j].key() })
+	return r
+}
+
+// shardOwners 从shardhb中读取shard所在的container，等待lock的节点没有内容，通过lease对应到containerhb中的container
+func (ss *smShard) shardOwners(ctx context.Context) (map[string][]*shardOwner, error) {
+	resp, err := ss.container.Client.Get(ctx, ss.container.nodeManager.nodeServiceContainerHb(ss.service), clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	leaseContainers := make(map[int64]string)
+	for _, kv := range resp.Kvs {
+		leaseContainers[kv.Lease] = heartbeatId(string(kv.Key))
+	}
+
+	pfx := ss.container.nodeManager.nodeServiceShardHb(ss.service)
+	resp, err = ss.container.Client.Get(ctx, pfx, clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	r := make(map[string][]*shardOwner)
+	for _, kv := range resp.Kvs {
+		shardId := strings.SplitN(strings.TrimPrefix(string(kv.Key), pfx), "/", 2)[0]
+		if len(kv.Value) == 0 {
+			if containerId, ok := leaseContainers[kv.Lease]; ok {
+				r[shardId] = append(r[shardId], &shardOwner{containerId: containerId})
+			}
+			continue
+		}
+		var hb apputil.ShardHeartbeat
+		if err := json.Unmarshal(kv.Value, &hb); err != nil {
+			return nil, errors.Wrap(err, string(kv.Value))
+		}
+		r[shardId] = append(r[shardId], &shardOwner{containerId: hb.ContainerId, holder: true})
+	}
+	return r, nil
+}
+
+// reconcileState 读取etcd中的shard配置（展开副本）和状态记录
+func (ss *smShard) reconcileState(ctx context.Context) (map[string]*apputil.ShardSpec, map[string]*shardStateRecord, error) {
+	kvs, err := ss.container.Client.GetKVs(ctx, ss.container.nodeManager.nodeServiceShard(ss.service, ""))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
+	}
+	specs := make(map[string]*apputil.ShardSpec)
+	for shardId, value := range kvs {
+		var spec apputil.ShardSpec
+		if err := json.Unmarshal([]byte(value), &spec); err != nil {
+			return nil, nil, errors.Wrap(err, "")
+		}
+		for id, s := range expandReplicas(shardId, &spec) {
+			specs[id] = s
+		}
+	}
+
+	kvs, err = ss.container.Client.GetKVs(ctx, ss.container.nodeManager.nodeServiceShardState(ss.service))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
+	}
+	states := make(map[string]*shardStateRecord)
+	for shardId, value := range kvs {
+		var record shardStateRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			return nil, nil, errors.Wrap(err, "")
+		}
+		states[shardId] = &record
+	}
+	return specs, states, nil
+}
+
+// reconcile 连续两次检查都存在的差异才修正，排除move执行过程中的中间状态
+func (ss *smShard) reconcile(ctx context.Context) error {
+	if ss.Frozen() || ss.schedulerPaused(ctx) {
+		return nil
+	}
+	specs, states, err := ss.reconcileState(ctx)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	owners, err := ss.shardOwners(ctx)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	specIds := make(map[string]struct{})
+	for id := range specs {
+		specIds[id] = struct{}{}
+	}
+	drifts := detectDrift(specIds, states, owners, ss.mpr.AliveContainers())
+
+	detected := make(map[string]struct{})
+	var (
+		mals      moveActionList
+		confirmed []*drift
+	)
+	for _, d := range drifts {
+		detected[d.key()] = struct{}{}
+		if _, ok := ss.drifts[d.key()]; !ok {
+			continue
+		}
+		confirmed = append(confirmed, d)
+		switch d.Kind {
+		case driftStaleState:
+			ss.container.states.transition(ss.service, &shardStateRecord{ShardId: d.ShardId, State: shardStateRunning, ContainerId: d.ContainerId})
+		case driftWrongContainer:
+			mals = append(mals, &moveAction{Service: ss.service, ShardId: d.ShardId, DropEndpoint: d.ContainerId, AddEndpoint: d.Expected, Spec: specs[d.ShardId]})
+		case driftZombie:
+			mals = append(mals, &moveAction{Service: ss.service, ShardId: d.ShardId, DropEndpoint: d.ContainerId, Spec: specs[d.ShardId]})
+		}
+	}
+	ss.drifts = detected
+	if len(confirmed) == 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&ss.stats.drifts, int64(len(confirmed)))
+	ss.lg.Warn(
+		"assignment drift",
+		zap.String("service", ss.service),
+		zap.Reflect("drifts", confirmed),
+	)
+	b, _ := json.Marshal(confirmed)
+	ss.container.events.append(eventMove, ss.service, "", "reconcile drift "+string(b))
+	if len(mals) > 0 {
+		ss.enqueue(workerEventReconcile, mals)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package smserver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_detectDrift(t *testing.T) {
+	specs := map[string]struct{}{"s1": {}, "s2": {}, "s3": {}, "s4": {}, "s5": {}}
+	states := map[string]*shardStateRecord{
+		"s1": {State: shardStateRunning, ContainerId: "c1"},
+		"s2": {State: shardStateRunning, ContainerId: "c1"},
+		"s3": {State: shardStateRunning, ContainerId: "c3"},
+		"s4": {State: shardStateRunning, ContainerId: "c1"},
+		// move进行中不处理
+		"s5": {State: shardStateMigrating, From: "c1", To: "c2"},
+	}
+	owners := map[string][]*shardOwner{
+		"s1": {{containerId: "c1", holder: true}},
+		"s2": {{containerId: "c2", holder: true}},
+		"s3": {{containerId: "c2", holder: true}},
+		"s4": {{containerId: "c1", holder: true}, {containerId: "c2"}},
+		"s5": {{containerId: "c1", holder: true}, {containerId: "c2"}},
+		// 配置已经删除
+		"s6": {{containerId: "c1", holder: true}, {containerId: "c2"}},
+	}
+	r := detectDrift(specs, states, owners, ArmorMap{"c1": "", "c2": ""})
+	expect := []*drift{
+		{Kind: driftStaleState, ShardId: "s3", ContainerId: "c2", Expected: "c3"},
+		{Kind: driftWrongContainer, ShardId: "s2", ContainerId: "c2", Expected: "c1"},
+		{Kind: driftZombie, ShardId: "s4", ContainerId: "c2", Expected: "c1"},
+		{Kind: driftZombie, ShardId: "s6", ContainerId: "c2"},
+	}
+	if !reflect.DeepEqual(r, expect) {
+		for _, d := range r {
+			t.Errorf("unexpected drift %+v", d)
+		}
+	}
+}
+
+func Test_smShard_shardOwners(t *testing.T) {
+	client := new(MockedEtcdWrapper)
+	client.On("Get", mock.Anything, "/sm/app/foo.bar/containerhb/", mock.Anything).Return(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{
+		{Key: []byte("/sm/app/foo.bar/containerhb/c1/1a"), Lease: 0x1a},
+		{Key: []byte("/sm/app/foo.bar/containerhb/c2/2b"), Lease: 0x2b},
+	}}, nil)
+	client.On("Get", mock.Anything, "/sm/app/foo.bar/shardhb/", mock.Anything).Return(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{
+		{Key: []byte("/sm/app/foo.bar/shardhb/s1/1a"), Lease: 0x1a, Value: []byte(`{"containerId":"c1"}`)},
+		// 等待lock的container
+		{Key: []byte("/sm/app/foo.bar/shardhb/s1/2b"), Lease: 0x2b},
+		// 未知的lease忽略
+		{Key: []byte("/sm/app/foo.bar/shardhb/s1/3c"), Lease: 0x3c},
+	}}, nil)
+	container := &smContainer{
+		Container:   &apputil.Container{Client: client},
+		nodeManager: &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")},
+	}
+	ss := smShard{service: "foo.bar", lg: ttLogger, container: container}
+
+	r, err := ss.shardOwners(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][]*shardOwner{"s1": {{containerId: "c1", holder: true}, {containerId: "c2"}}}
+	if !reflect.DeepEqual(r, expect) {
+		t.Errorf("unexpected owners %v", r)
+	}
+}
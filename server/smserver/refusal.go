@@ -0,0 +1,122 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// defaultRefusalTTL container拒绝shard之后，在这段时间内不再把这个shard分配给它，container恢复后可以重新接受
+const defaultRefusalTTL = 10 * time.Minute
+
+// refusals 读取container写入的refusal节点，返回shard id到拒绝过的container的映射，
+// 节点随container的session删除，超过defaultRefusalTTL的拒绝不再生效
+func (ss *smShard) refusals(ctx context.Context) map[string]map[string]struct{} {
+	if ss.mpr == nil || ss.container == nil || ss.container.Container == nil || ss.container.Client == nil {
+		return nil
+	}
+	pfx := ss.container.nodeManager.etcdPath.AppRefusal(ss.service, "")
+	resp, err := ss.container.Client.GetKV(ctx, pfx, []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		ss.lg.Error(
+			"get refusals error",
+			zap.String("service", ss.service),
+			zap.Error(err),
+		)
+		return nil
+	}
+	return parseRefusals(resp.Kvs, pfx, time.Now())
+}
+
+func parseRefusals(kvs []*mvccpb.KeyValue, pfx string, now time.Time) map[string]map[string]struct{} {
+	r := make(map[string]map[string]struct{})
+	for _, kv := range kvs {
+		parts := strings.SplitN(strings.TrimPrefix(string(kv.Key), pfx), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var refusal apputil.ShardRefusal
+		if err := json.Unmarshal(kv.Value, &refusal); err != nil {
+			continue
+		}
+		if now.Sub(time.Unix(refusal.Time, 0)) > defaultRefusalTTL {
+			continue
+		}
+		if r[parts[0]] == nil {
+			r[parts[0]] = make(map[string]struct{})
+		}
+		r[parts[0]][parts[1]] = struct{}{}
+	}
+	return r
+}
+
+// reroute shard被container拒绝后，在存活、没有退出、没有cordon、满足约束并且没有拒绝过的container中选择shard最少的一个，
+// 没有可选的container时返回空
+func (ss *smShard) reroute(ma *moveAction, refused map[string]struct{}) string {
+	if ss.mpr == nil {
+		return ""
+	}
+	candidates := ss.mpr.AliveContainers().KeyMap()
+	for id := range ss.mpr.DrainingContainers() {
+		delete(candidates, id)
+	}
+	for id := range ss.unhealthyContainers() {
+		delete(candidates, id)
+	}
+	for id := range ss.operator.suspectContainers() {
+		delete(candidates, id)
+	}
+	for id := range refused {
+		delete(candidates, id)
+	}
+	delete(candidates, ma.DropEndpoint)
+
+	counts := make(map[string]int)
+	for _, tmp := range ss.mpr.AliveShards() {
+		counts[tmp.curContainerId]++
+	}
+	capacities := ss.mpr.ContainerCapacities()
+	filter := ss.constraintFilter(map[string]*apputil.ShardSpec{ma.ShardId: ma.Spec})
+
+	var ids []string
+	for id := range candidates {
+		if c, ok := capacities[id]; ok && counts[id] >= c {
+			continue
+		}
+		if !filter.allowed(id, ma.ShardId) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if counts[ids[i]] != counts[ids[j]] {
+			return counts[ids[i]] < counts[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids[0]
+}
@@ -0,0 +1,32 @@
+package smserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func Test_parseRefusals(t *testing.T) {
+	now := time.Now()
+	kv := func(key string, at time.Time) *mvccpb.KeyValue {
+		b, _ := json.Marshal(&apputil.ShardRefusal{Reason: "busy", Time: at.Unix()})
+		return &mvccpb.KeyValue{Key: []byte(key), Value: b}
+	}
+
+	pfx := "/sm/app/foo/refusal/"
+	r := parseRefusals([]*mvccpb.KeyValue{
+		kv(pfx+"s1/c1", now),
+		kv(pfx+"s1/c2", now.Add(-time.Minute)),
+		kv(pfx+"s2/c1", now.Add(-defaultRefusalTTL-time.Minute)),
+		kv(pfx+"s3", now),
+		{Key: []byte(pfx + "s4/c1"), Value: []byte("bad")},
+	}, pfx, now)
+
+	assert.Equal(t, map[string]map[string]struct{}{
+		"s1": {"c1": {}, "c2": {}},
+	}, r)
+}
@@ -0,0 +1,330 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// validateResources 为空代表shard不预留资源
+func validateResources(r *apputil.Resources) error {
+	if r == nil {
+		return nil
+	}
+	if r.Cpu < 0 || r.Mem < 0 {
+		return errors.Errorf("resources cpu %d and mem %d should not be negative", r.Cpu, r.Mem)
+	}
+	return nil
+}
+
+// reservationLedger 按照shard声明的Resources统计container上已经预留的资源，leader据此拒绝让container超卖的分配，
+// 没有声明资源的container不做限制
+type reservationLedger struct {
+	// capacities container声明可以预留的资源
+	capacities map[string]*apputil.Resources
+
+	// reserved container上shard预留的资源之和
+	reserved map[string]*apputil.Resources
+
+	// placement shard当前所在的container
+	placement map[string]string
+
+	specs map[string]*apputil.ShardSpec
+
+	updateTime time.Time
+
+	// refused 因为资源不足被拒绝分配的shard
+	refused []string
+}
+
+func newReservationLedger(capacities map[string]*apputil.Resources, alive map[string]*temporary, specs map[string]*apputil.ShardSpec) *reservationLedger {
+	l := reservationLedger{
+		capacities: capacities,
+		reserved:   make(map[string]*apputil.Resources),
+		placement:  make(map[string]string),
+		specs:      specs,
+		updateTime: time.Now(),
+	}
+	for shardId, t := range alive {
+		l.reserve(t.curContainerId, shardId)
+	}
+	return &l
+}
+
+// request 没有配置或者已经删除的shard不预留资源
+func (l *reservationLedger) request(shardId string) apputil.Resources {
+	if spec := l.specs[shardId]; spec != nil && spec.Resources != nil {
+		return *spec.Resources
+	}
+	return apputil.Resources{}
+}
+
+func (l *reservationLedger) reserve(containerId string, shardId string) {
+	req := l.request(shardId)
+	used := l.reserved[containerId]
+	if used == nil {
+		used = &apputil.Resources{}
+		l.reserved[containerId] = used
+	}
+	used.Cpu += req.Cpu
+	used.Mem += req.Mem
+	l.placement[shardId] = containerId
+}
+
+// release shard不在container上时忽略
+func (l *reservationLedger) release(containerId string, shardId string) {
+	if containerId == "" || l.placement[shardId] != containerId {
+		return
+	}
+	req := l.request(shardId)
+	if used := l.reserved[containerId]; used != nil {
+		used.Cpu -= req.Cpu
+		used.Mem -= req.Mem
+	}
+	delete(l.placement, shardId)
+}
+
+// fits shard放到container后预留的资源是否超过container声明的资源，shard已经在container上时不重复计算
+func (l *reservationLedger) fits(containerId string, shardId string) bool {
+	if l == nil {
+		return true
+	}
+	capacity := l.capacities[containerId]
+	if capacity == nil || l.placement[shardId] == containerId {
+		return true
+	}
+	req := l.request(shardId)
+	used := apputil.Resources{}
+	if v := l.reserved[containerId]; v != nil {
+		used = *v
+	}
+	if capacity.Cpu > 0 && used.Cpu+req.Cpu > capacity.Cpu {
+		return false
+	}
+	if capacity.Mem > 0 && used.Mem+req.Mem > capacity.Mem {
+		return false
+	}
+	return true
+}
+
+// clone admit修改副本，发布出去的ledger只读
+func (l *reservationLedger) clone() *reservationLedger {
+	c := reservationLedger{
+		capacities: l.capacities,
+		reserved:   make(map[string]*apputil.Resources),
+		placement:  make(map[string]string),
+		specs:      l.specs,
+		updateTime: l.updateTime,
+	}
+	for id, r := range l.reserved {
+		v := *r
+		c.reserved[id] = &v
+	}
+	for shardId, containerId := range l.placement {
+		c.placement[shardId] = containerId
+	}
+	return &c
+}
+
+// admit 按照计划执行mals后的状态拒绝超卖的add，被拒绝的move从结果中去掉，shard保持在原来的container上或者保持未分配:
+// 1 只有drop的move先执行，释放资源
+// 2 分配到manualContainerId指定container的move不拒绝，和binpack中capacity的处理一致
+// 3 add可能依赖其他move释放的资源，循环直到没有新的move被接受
+func (l *reservationLedger) admit(lg *zap.Logger, service string, mals moveActionList) moveActionList {
+	admitted := make([]bool, len(mals))
+	for i, ma := range mals {
+		if ma.AddEndpoint == "" {
+			l.release(ma.DropEndpoint, ma.ShardId)
+			admitted[i] = true
+		}
+	}
+	for i, ma := range mals {
+		if !admitted[i] && ma.Spec != nil && ma.Spec.ManualContainerId == ma.AddEndpoint {
+			l.release(ma.DropEndpoint, ma.ShardId)
+			l.reserve(ma.AddEndpoint, ma.ShardId)
+			admitted[i] = true
+		}
+	}
+	for progress := true; progress; {
+		progress = false
+		for i, ma := range mals {
+			if admitted[i] || !l.fits(ma.AddEndpoint, ma.ShardId) {
+				continue
+			}
+			l.release(ma.DropEndpoint, ma.ShardId)
+			l.reserve(ma.AddEndpoint, ma.ShardId)
+			admitted[i] = true
+			progress = true
+		}
+	}
+
+	var r moveActionList
+	for i, ma := range mals {
+		if admitted[i] {
+			r = append(r, ma)
+			continue
+		}
+		l.refused = append(l.refused, ma.ShardId)
+		lg.Warn(
+			"assignment refused, container resources oversubscribed",
+			zap.String("service", service),
+			zap.String("shardId", ma.ShardId),
+			zap.String("containerId", ma.AddEndpoint),
+			zap.Reflect("request", l.request(ma.ShardId)),
+			zap.Reflect("capacity", l.capacities[ma.AddEndpoint]),
+			zap.Reflect("reserved", l.reserved[ma.AddEndpoint]),
+		)
+	}
+	return r
+}
+
+type containerReservation struct {
+	ContainerId string `json:"containerId"`
+
+	// Capacity container声明的资源，为空表示不限制
+	Capacity *apputil.Resources `json:"capacity,omitempty"`
+
+	// Reserved container上shard预留的资源之和
+	Reserved apputil.Resources `json:"reserved"`
+
+	// CpuUtilization 和 MemUtilization 是Reserved占Capacity的比例，Capacity没有声明这一项时为0
+	CpuUtilization float64 `json:"cpuUtilization"`
+	MemUtilization float64 `json:"memUtilization"`
+
+	ShardCount int `json:"shardCount"`
+
+	// Oversubscribed 预留超过声明的资源，一般是container调低了声明的资源或者shard人工指定了container
+	Oversubscribed bool `json:"oversubscribed"`
+}
+
+type serviceReservations struct {
+	Service string `json:"service"`
+
+	// UpdateTime 统计对应的rebalance轮次，单位秒，为0表示leader还没有完成统计
+	UpdateTime int64 `json:"updateTime"`
+
+	Containers []*containerReservation `json:"containers"`
+
+	// Refused 最近一轮因为资源不足被拒绝分配的shard
+	Refused []string `json:"refused"`
+}
+
+func utilization(reserved, capacity int) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return float64(reserved) / float64(capacity)
+}
+
+func (l *reservationLedger) report(service string) *serviceReservations {
+	sr := serviceReservations{Service: service, Containers: make([]*containerReservation, 0), Refused: make([]string, 0)}
+	if l == nil {
+		return &sr
+	}
+	sr.UpdateTime = l.updateTime.Unix()
+	sr.Refused = append(sr.Refused, l.refused...)
+	sort.Strings(sr.Refused)
+
+	crs := make(map[string]*containerReservation)
+	get := func(containerId string) *containerReservation {
+		cr, ok := crs[containerId]
+		if !ok {
+			cr = &containerReservation{ContainerId: containerId, Capacity: l.capacities[containerId]}
+			if used := l.reserved[containerId]; used != nil {
+				cr.Reserved = *used
+			}
+			crs[containerId] = cr
+		}
+		return cr
+	}
+	for containerId := range l.capacities {
+		get(containerId)
+	}
+	for _, containerId := range l.placement {
+		get(containerId).ShardCount++
+	}
+	for _, cr := range crs {
+		if cr.Capacity != nil {
+			cr.CpuUtilization = utilization(cr.Reserved.Cpu, cr.Capacity.Cpu)
+			cr.MemUtilization = utilization(cr.Reserved.Mem, cr.Capacity.Mem)
+			cr.Oversubscribed = cr.CpuUtilization > 1 || cr.MemUtilization > 1
+		}
+		sr.Containers = append(sr.Containers, cr)
+	}
+	sort.Slice(sr.Containers, func(i, j int) bool {
+		return sr.Containers[i].ContainerId < sr.Containers[j].ContainerId
+	})
+	return &sr
+}
+
+// setReservations balancePlan每一轮开始时发布当前的预留，constraintFilter和api读取
+func (ss *smShard) setReservations(l *reservationLedger) {
+	ss.reservationsMu.Lock()
+	defer ss.reservationsMu.Unlock()
+	ss.reservations = l
+}
+
+// setRefused admit在副本上进行，结束后把被拒绝的shard记录到发布的ledger
+func (ss *smShard) setRefused(l *reservationLedger, refused []string) {
+	ss.reservationsMu.Lock()
+	defer ss.reservationsMu.Unlock()
+	l.refused = refused
+}
+
+func (ss *smShard) currentReservations() *reservationLedger {
+	ss.reservationsMu.Lock()
+	defer ss.reservationsMu.Unlock()
+	return ss.reservations
+}
+
+func (ss *smShard) Reservations() *serviceReservations {
+	ss.reservationsMu.Lock()
+	defer ss.reservationsMu.Unlock()
+	return ss.reservations.report(ss.service)
+}
+
+// @Description reserved cpu/mem units of containers against their declared resources
+// @Tags  shard
+// @Produce  json
+// @Param service query string true "param"
+// @success 200 {object} serviceReservations
+// @Router /sm/server/utilization [get]
+func (ss *smShardApi) GinUtilization(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.New("empty service")
+		ss.lg.Error("param error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	shard, err := ss.container.GetShard(service)
+	if err != nil {
+		ss.lg.Error(
+			"shard not found",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeServiceNotFound, errors.Errorf("service[%s] not managed by this container", service))
+		return
+	}
+	c.JSON(http.StatusOK, shard.Reservations())
+}
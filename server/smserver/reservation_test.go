@@ -0,0 +1,96 @@
+package smserver
+
+import (
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func testReservationLedger() *reservationLedger {
+	specs := map[string]*apputil.ShardSpec{
+		"s1": {Resources: &apputil.Resources{Cpu: 600, Mem: 100}},
+		"s2": {Resources: &apputil.Resources{Cpu: 300}},
+		"s3": {Resources: &apputil.Resources{Cpu: 500}},
+		"s4": {ManualContainerId: "c1", Resources: &apputil.Resources{Cpu: 500}},
+		"s5": {},
+	}
+	capacities := map[string]*apputil.Resources{
+		"c1": {Cpu: 1000},
+		"c2": {Cpu: 800, Mem: 100},
+	}
+	alive := map[string]*temporary{
+		"s1": {curContainerId: "c1"},
+		"s2": {curContainerId: "c1"},
+	}
+	return newReservationLedger(capacities, alive, specs)
+}
+
+func Test_reservationLedger_fits(t *testing.T) {
+	l := testReservationLedger()
+
+	// 已经在container上的shard不重复计算
+	assert.True(t, l.fits("c1", "s1"))
+	assert.False(t, l.fits("c1", "s3"))
+	assert.True(t, l.fits("c2", "s3"))
+	// 没有声明资源的shard和container不限制
+	assert.True(t, l.fits("c1", "s5"))
+	assert.True(t, l.fits("c3", "s3"))
+
+	var nl *reservationLedger
+	assert.True(t, nl.fits("c1", "s3"))
+}
+
+func Test_reservationLedger_admit(t *testing.T) {
+	l := testReservationLedger()
+	admission := l.clone()
+
+	mals := moveActionList{
+		// c1剩余100，s3需要等s1移走后才能放下
+		{ShardId: "s3", AddEndpoint: "c1", Spec: l.specs["s3"]},
+		{ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2", Spec: l.specs["s1"]},
+		// c2已经放不下s2
+		{ShardId: "s2", DropEndpoint: "c1", AddEndpoint: "c2", Spec: l.specs["s2"]},
+	}
+	r := admission.admit(ttLogger, "foo", mals)
+
+	var admitted []string
+	for _, ma := range r {
+		admitted = append(admitted, ma.ShardId)
+	}
+	assert.Equal(t, []string{"s3", "s1"}, admitted)
+	assert.Equal(t, []string{"s2"}, admission.refused)
+	assert.Equal(t, apputil.Resources{Cpu: 800}, *admission.reserved["c1"])
+	assert.Equal(t, apputil.Resources{Cpu: 600, Mem: 100}, *admission.reserved["c2"])
+
+	// 人工指定的container不拒绝
+	r = admission.admit(ttLogger, "foo", moveActionList{{ShardId: "s4", AddEndpoint: "c1", Spec: l.specs["s4"]}})
+	assert.Len(t, r, 1)
+	assert.Equal(t, apputil.Resources{Cpu: 1300}, *admission.reserved["c1"])
+
+	// 发布的ledger不受影响
+	assert.Equal(t, apputil.Resources{Cpu: 900, Mem: 100}, *l.reserved["c1"])
+}
+
+func Test_reservationLedger_report(t *testing.T) {
+	l := testReservationLedger()
+	l.refused = []string{"s3"}
+
+	sr := l.report("foo")
+	assert.Equal(t, []string{"s3"}, sr.Refused)
+	assert.Len(t, sr.Containers, 2)
+
+	c1 := sr.Containers[0]
+	assert.Equal(t, "c1", c1.ContainerId)
+	assert.Equal(t, 2, c1.ShardCount)
+	assert.Equal(t, 0.9, c1.CpuUtilization)
+	assert.Equal(t, float64(0), c1.MemUtilization)
+	assert.False(t, c1.Oversubscribed)
+
+	c2 := sr.Containers[1]
+	assert.Equal(t, "c2", c2.ContainerId)
+	assert.Equal(t, 0, c2.ShardCount)
+
+	var nl *reservationLedger
+	assert.Empty(t, nl.report("foo").Containers)
+}
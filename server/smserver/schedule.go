@@ -0,0 +1,190 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// cronTZPrefix 表达式前加 CRON_TZ=Asia/Shanghai 指定时区，默认使用sm的本地时间
+	cronTZPrefix = "CRON_TZ="
+
+	// maxRebalanceWindowDuration 单个窗口的最长持续时间，判断窗口时按照分钟向前回溯
+	maxRebalanceWindowDuration = 24 * time.Hour
+)
+
+// cronBounds 分、时、日、月、星期的取值范围，星期的7和0都代表周日
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// rebalanceWindow 在cron表达式匹配的分钟开始，持续duration的时间窗口
+type rebalanceWindow struct {
+	// fields 每一段允许的取值，下标是取值
+	fields [5][]bool
+	// domAny 和 dowAny 标准cron语义，日和星期都有限制时满足任意一个即可
+	domAny   bool
+	dowAny   bool
+	duration time.Duration
+	loc      *time.Location
+}
+
+// parseRebalanceWindow 格式为 [CRON_TZ=<zone> ]<minute> <hour> <day of month> <month> <day of week> <duration>，
+// 例如 "0 2 * * 1-5 2h" 工作日凌晨2点开始的2小时
+func parseRebalanceWindow(s string) (*rebalanceWindow, error) {
+	w := rebalanceWindow{loc: time.Local}
+	parts := strings.Fields(s)
+	if len(parts) > 0 && strings.HasPrefix(parts[0], cronTZPrefix) {
+		loc, err := time.LoadLocation(strings.TrimPrefix(parts[0], cronTZPrefix))
+		if err != nil {
+			return nil, errors.Wrap(err, s)
+		}
+		w.loc = loc
+		parts = parts[1:]
+	}
+	if len(parts) != 6 {
+		return nil, errors.Errorf("window %q should be 5 cron fields and a duration", s)
+	}
+
+	for i := 0; i < 5; i++ {
+		field, err := parseCronField(parts[i], cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, errors.Wrap(err, s)
+		}
+		w.fields[i] = field
+	}
+	// 星期的7转换为0
+	if w.fields[4][7] {
+		w.fields[4][0] = true
+	}
+	w.domAny = parts[2] == "*"
+	w.dowAny = parts[4] == "*"
+
+	d, err := time.ParseDuration(parts[5])
+	if err != nil {
+		return nil, errors.Wrap(err, s)
+	}
+	if d < time.Minute || d > maxRebalanceWindowDuration {
+		return nil, errors.Errorf("window %q duration should be between 1m and %s", s, maxRebalanceWindowDuration)
+	}
+	w.duration = d
+	return &w, nil
+}
+
+// parseCronField 支持 *、数字、范围a-b、步长*/n或a-b/n，以及逗号分隔的列表
+func parseCronField(s string, min, max int) ([]bool, error) {
+	r := make([]bool, max+1)
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if idx := strings.Index(item, "/"); idx >= 0 {
+			v, err := strconv.Atoi(item[idx+1:])
+			if err != nil || v <= 0 {
+				return nil, errors.Errorf("invalid step %q", item)
+			}
+			step = v
+			item = item[:idx]
+		}
+
+		lo, hi := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			v, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.Errorf("invalid value %q", item)
+			}
+			lo, hi = v, v
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.Errorf("invalid value %q", item)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, errors.Errorf("value %q out of range %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			r[v] = true
+		}
+	}
+	return r, nil
+}
+
+// match t所在的分钟是否匹配cron表达式
+func (w *rebalanceWindow) match(t time.Time) bool {
+	if !w.fields[0][t.Minute()] || !w.fields[1][t.Hour()] || !w.fields[3][int(t.Month())] {
+		return false
+	}
+	dom := w.fields[2][t.Day()]
+	dow := w.fields[4][int(t.Weekday())]
+	if w.domAny || w.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// active now是否在某次窗口内，向前回溯duration内的每一分钟，找到匹配的开始时间
+func (w *rebalanceWindow) active(now time.Time) bool {
+	now = now.In(w.loc)
+	start := now.Truncate(time.Minute)
+	for now.Sub(start) < w.duration {
+		if w.match(start) {
+			return true
+		}
+		start = start.Add(-time.Minute)
+	}
+	return false
+}
+
+func validateRebalanceWindows(windows []string) error {
+	for _, s := range windows {
+		if _, err := parseRebalanceWindow(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inRebalanceWindow 没有配置窗口时不限制，非法的窗口在写入spec时已经校验过，这里忽略
+func inRebalanceWindow(windows []string, now time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, s := range windows {
+		w, err := parseRebalanceWindow(s)
+		if err != nil {
+			continue
+		}
+		if w.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// holdOutsideWindow 配置了RebalanceWindows时，窗口之外存活container上的shard都固定在当前container上，
+// 只分配新增的shard以及丢失、不健康和draining的container上的shard，故障转移不等待窗口
+func (ss *smShard) holdOutsideWindow(groups map[string]*balancerGroup, aliveContainers ArmorMap, hbShards map[string]*temporary, shardIdAndGroup ArmorMap) {
+	if spec := ss.spec(); spec == nil || inRebalanceWindow(spec.RebalanceWindows, time.Now()) {
+		return
+	}
+	shardIds := make(map[string]struct{})
+	for shardId := range hbShards {
+		shardIds[shardId] = struct{}{}
+	}
+	ss.holdShards(shardIds, groups, aliveContainers, hbShards, shardIdAndGroup, "outside rebalance window, hold on current container")
+}
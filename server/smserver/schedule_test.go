@@ -0,0 +1,80 @@
+package smserver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseRebalanceWindow(t *testing.T) {
+	for _, s := range []string{
+		"0 2 * * *",
+		"0 2 * * * 0s",
+		"0 2 * * * 25h",
+		"60 2 * * * 1h",
+		"0 2-1 * * * 1h",
+		"0 */0 * * * 1h",
+		"CRON_TZ=Nowhere/City 0 2 * * * 1h",
+	} {
+		if _, err := parseRebalanceWindow(s); err == nil {
+			t.Errorf("expect error for %q", s)
+		}
+	}
+
+	loc := time.UTC
+	// 2022-04-18 是周一
+	monday := func(hour, minute int) time.Time { return time.Date(2022, 4, 18, hour, minute, 0, 0, loc) }
+	var tests = []struct {
+		window string
+		now    time.Time
+		expect bool
+	}{
+		{window: "CRON_TZ=UTC 0 2 * * 1-5 2h", now: monday(2, 0), expect: true},
+		{window: "CRON_TZ=UTC 0 2 * * 1-5 2h", now: monday(3, 59), expect: true},
+		{window: "CRON_TZ=UTC 0 2 * * 1-5 2h", now: monday(4, 0), expect: false},
+		{window: "CRON_TZ=UTC 0 2 * * 1-5 2h", now: monday(1, 59), expect: false},
+		{window: "CRON_TZ=UTC 0 2 * * 6,7 2h", now: monday(2, 30), expect: false},
+		// 跨天的窗口
+		{window: "CRON_TZ=UTC 0 23 * * 0 3h", now: monday(1, 0), expect: true},
+		// 日和星期都有限制时满足任意一个
+		{window: "CRON_TZ=UTC */30 * 1 * 1 10m", now: monday(10, 35), expect: true},
+		{window: "CRON_TZ=UTC */30 * 1 * 2 10m", now: monday(10, 35), expect: false},
+	}
+	for idx, tt := range tests {
+		w, err := parseRebalanceWindow(tt.window)
+		if err != nil {
+			t.Errorf("idx %d err %s", idx, err)
+			continue
+		}
+		if actual := w.active(tt.now); actual != tt.expect {
+			t.Errorf("idx %d %q at %s expect %t actual %t", idx, tt.window, tt.now, tt.expect, actual)
+		}
+	}
+
+	if !inRebalanceWindow(nil, monday(12, 0)) {
+		t.Error("no window should not restrict")
+	}
+}
+
+func Test_smShard_holdOutsideWindow(t *testing.T) {
+	// 窗口之外的时间
+	now := time.Now().UTC()
+	window := "CRON_TZ=UTC 0 " + now.Add(2*time.Hour).Format("15") + " * * * 1m"
+	ss := smShard{lg: ttLogger, appSpec: &smAppSpec{RebalanceWindows: []string{window}}}
+
+	bg := newBalanceGroup()
+	bg.fixShardIdAndManualContainerId = ArmorMap{"s1": "", "s2": "", "s3": ""}
+	groups := map[string]*balancerGroup{"": bg}
+	hbShards := map[string]*temporary{
+		"s1": {curContainerId: "c1"},
+		// container丢失，故障转移不受窗口限制
+		"s2": {curContainerId: "c3"},
+	}
+	ss.holdOutsideWindow(groups, ArmorMap{"c1": "", "c2": ""}, hbShards, ArmorMap{"s1": "", "s2": "", "s3": ""})
+
+	expect := ArmorMap{"s1": "c1", "s2": "", "s3": ""}
+	for id, v := range expect {
+		if bg.fixShardIdAndManualContainerId[id] != v {
+			t.Errorf("shard %s expect %q actual %q", id, v, bg.fixShardIdAndManualContainerId[id])
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/coordination"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	selfCheckOk   = "ok"
+	selfCheckWarn = "warn"
+	selfCheckFail = "fail"
+
+	// defaultSelfCheckTimeout 单项检查的超时时间
+	defaultSelfCheckTimeout = 5 * time.Second
+
+	// maxSelfCheckDetails detail中列出的问题数量上限，防止报告过大
+	maxSelfCheckDetails = 10
+)
+
+// SelfCheckItem 单项检查的结果，Status是ok、warn或者fail
+type SelfCheckItem struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	ElapsedMs int64  `json:"elapsedMs"`
+}
+
+// SelfCheckReport 没有fail的检查项时Ok为true，warn不影响启动
+type SelfCheckReport struct {
+	Ok    bool             `json:"ok"`
+	Time  int64            `json:"time"`
+	Items []*SelfCheckItem `json:"items"`
+}
+
+func (r *SelfCheckReport) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// selfChecker 启动前或者运行中检查etcd连通性、prefix权限、spec一致性、孤儿节点和leader可达性，只依赖etcd client，
+// 不创建session，不影响集群
+type selfChecker struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	backend     coordination.Backend
+	nodeManager *nodeManager
+
+	// probeId 权限检查写入的临时节点，区分不同的检查方
+	probeId string
+
+	httpClient *http.Client
+}
+
+func newSelfChecker(lg *zap.Logger, client etcdutil.EtcdWrapper, backend coordination.Backend, nodeManager *nodeManager, probeId string) *selfChecker {
+	return &selfChecker{
+		lg:          lg,
+		client:      client,
+		backend:     backend,
+		nodeManager: nodeManager,
+		probeId:     probeId,
+		httpClient:  &http.Client{Timeout: defaultSelfCheckTimeout},
+	}
+}
+
+func (sc *selfChecker) run(ctx context.Context) *SelfCheckReport {
+	checks := []struct {
+		name string
+		fn   func(ctx context.Context) (string, string)
+	}{
+		{name: "etcd", fn: sc.checkEtcd},
+		{name: "permission", fn: sc.checkPermission},
+		{name: "spec", fn: sc.checkSpec},
+		{name: "orphans", fn: sc.checkOrphans},
+		{name: "leader", fn: sc.checkLeader},
+	}
+
+	report := SelfCheckReport{Ok: true, Time: time.Now().Unix()}
+	for _, check := range checks {
+		start := time.Now()
+		checkCtx, cancel := context.WithTimeout(ctx, defaultSelfCheckTimeout)
+		status, detail := check.fn(checkCtx)
+		cancel()
+
+		item := SelfCheckItem{Name: check.name, Status: status, Detail: detail, ElapsedMs: time.Since(start).Milliseconds()}
+		report.Items = append(report.Items, &item)
+		if status == selfCheckFail {
+			report.Ok = false
+		}
+		sc.lg.Info(
+			"self check",
+			zap.String("name", item.Name),
+			zap.String("status", item.Status),
+			zap.String("detail", item.Detail),
+		)
+
+		// etcd不通时后面的检查没有意义
+		if check.name == "etcd" && status == selfCheckFail {
+			break
+		}
+	}
+	return &report
+}
+
+// checkEtcd sm的spec节点可读
+func (sc *selfChecker) checkEtcd(ctx context.Context) (string, string) {
+	resp, err := sc.client.GetKV(ctx, sc.nodeManager.nodeServiceSpec(sc.nodeManager.smService), nil)
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+	if resp.Count == 0 {
+		return selfCheckWarn, "spec of sm not created yet, created when sm starts"
+	}
+	return selfCheckOk, fmt.Sprintf("revision %d", resp.Header.GetRevision())
+}
+
+// checkPermission 在sm的prefix下写入并删除临时节点，etcd开启认证时验证角色的读写权限
+func (sc *selfChecker) checkPermission(ctx context.Context) (string, string) {
+	key := fmt.Sprintf("%s/selfcheck/%s", sc.nodeManager.nodeSM(), sc.probeId)
+	if _, err := sc.client.Put(ctx, key, time.Now().String()); err != nil {
+		return selfCheckFail, errors.Wrap(err, "put "+key).Error()
+	}
+	if _, err := sc.client.Delete(ctx, key); err != nil {
+		return selfCheckFail, errors.Wrap(err, "delete "+key).Error()
+	}
+	return selfCheckOk, ""
+}
+
+// checkSpec sm中注册的service都有spec，有spec的service都已经注册
+func (sc *selfChecker) checkSpec(ctx context.Context) (string, string) {
+	pfx := sc.nodeManager.nodeSM() + "/service/"
+	resp, err := sc.client.GetKV(ctx, pfx, []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithKeysOnly()})
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+
+	specs := make(map[string]struct{})
+	registered := make(map[string]struct{})
+	for _, kv := range resp.Kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), pfx), "/")
+		switch {
+		case len(parts) == 2 && parts[1] == "spec":
+			specs[parts[0]] = struct{}{}
+		case len(parts) == 3 && parts[0] == sc.nodeManager.smService && parts[1] == "shard":
+			registered[parts[2]] = struct{}{}
+		}
+	}
+
+	var problems []string
+	for service := range registered {
+		if _, ok := specs[service]; !ok {
+			problems = append(problems, fmt.Sprintf("service %s registered without spec", service))
+		}
+	}
+	for service := range specs {
+		if _, ok := registered[service]; !ok && service != sc.nodeManager.smService {
+			problems = append(problems, fmt.Sprintf("service %s has spec but not registered", service))
+		}
+	}
+	if len(problems) > 0 {
+		return selfCheckFail, joinProblems(problems)
+	}
+	return selfCheckOk, fmt.Sprintf("%d services", len(registered))
+}
+
+// checkOrphans 和janitor使用相同的规则，孤儿节点不影响启动，开启janitor后由leader清理
+func (sc *selfChecker) checkOrphans(ctx context.Context) (string, string) {
+	appPfx := sc.nodeManager.etcdPath.AppPrefix("")
+	resp, err := sc.client.GetKV(ctx, appPfx, []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithKeysOnly()})
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+	orphans := findOrphans(resp.Kvs, appPfx, sc.nodeManager.smService)
+	if len(orphans) == 0 {
+		return selfCheckOk, ""
+	}
+	kinds := make(map[string]int)
+	for _, kind := range orphans {
+		kinds[kind]++
+	}
+	var problems []string
+	for kind, n := range kinds {
+		problems = append(problems, fmt.Sprintf("%s: %d", kind, n))
+	}
+	return selfCheckWarn, joinProblems(problems)
+}
+
+// checkLeader 存在leader时通过http访问leader，没有leader时只提示，第一个启动的sm不会有leader
+func (sc *selfChecker) checkLeader(ctx context.Context) (string, string) {
+	value, err := sc.backend.Leader(ctx, sc.nodeManager.nodeSMLeader())
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+	if value == "" {
+		return selfCheckWarn, "no leader elected"
+	}
+	var lv leaderEtcdValue
+	if err := json.Unmarshal([]byte(value), &lv); err != nil {
+		return selfCheckFail, errors.Wrap(err, value).Error()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/sm/admin/health", lv.ContainerId), nil)
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+	resp, err := sc.httpClient.Do(req)
+	if err != nil {
+		return selfCheckFail, errors.Wrap(err, "leader "+lv.ContainerId).Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return selfCheckFail, fmt.Sprintf("leader %s health status %d", lv.ContainerId, resp.StatusCode)
+	}
+	return selfCheckOk, "leader " + lv.ContainerId
+}
+
+func joinProblems(problems []string) string {
+	sort.Strings(problems)
+	if len(problems) > maxSelfCheckDetails {
+		problems = append(problems[:maxSelfCheckDetails], fmt.Sprintf("and %d more", len(problems)-maxSelfCheckDetails))
+	}
+	return strings.Join(problems, "; ")
+}
+
+// SelfCheck 使用和 NewServer 相同的选项，在启动之前检查部署环境，只创建etcd client，检查后关闭
+func SelfCheck(fn ...ServerOption) (*SelfCheckReport, error) {
+	ops := serverOptions{}
+	for _, f := range fn {
+		f(&ops)
+	}
+	client, etcdPath, err := newOptionsEtcdClient(&ops)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	defer client.Close()
+
+	probeId := ops.id
+	if probeId == "" {
+		probeId = GetLocalIP()
+	}
+	nm := &nodeManager{smService: ops.service, etcdPath: etcdPath}
+	sc := newSelfChecker(ops.lg, client, coordination.NewEtcdBackend(client), nm, probeId)
+	return sc.run(context.Background()), nil
+}
+
+// newOptionsEtcdClient 不启动server的命令（check、restore）按照server的选项创建etcd client
+func newOptionsEtcdClient(ops *serverOptions) (*etcdutil.EtcdClient, *apputil.EtcdPath, error) {
+	if ops.service == "" {
+		return nil, nil, errors.New("service err")
+	}
+	if len(ops.endpoints) == 0 {
+		return nil, nil, errors.New("endpoints err")
+	}
+	if ops.lg == nil {
+		return nil, nil, errors.New("logger err")
+	}
+
+	etcdOpts := []etcdutil.EtcdClientOption{
+		etcdutil.EtcdClientWithDialTimeout(ops.etcdDialTimeout),
+		etcdutil.EtcdClientWithKeepAlive(ops.etcdKeepAliveTime, ops.etcdKeepAliveTimeout),
+		etcdutil.EtcdClientWithRetry(ops.etcdMaxRetries, ops.etcdRetryBackoff),
+		etcdutil.EtcdClientWithOpTimeout(ops.etcdReadTimeout, ops.etcdWriteTimeout),
+	}
+	if ops.etcdUsername != "" {
+		etcdOpts = append(etcdOpts, etcdutil.EtcdClientWithAuth(ops.etcdUsername, ops.etcdPassword))
+	}
+	if ops.etcdCAFile != "" || ops.etcdCertFile != "" || ops.etcdKeyFile != "" {
+		etcdOpts = append(etcdOpts, etcdutil.EtcdClientWithTLS(ops.etcdCAFile, ops.etcdCertFile, ops.etcdKeyFile))
+	}
+	etcdPath := apputil.NewEtcdPath(ops.etcdPrefix)
+	if ops.etcdNamespace != "" {
+		etcdOpts = append(etcdOpts, etcdutil.EtcdClientWithNamespace(ops.etcdNamespace))
+		etcdPath = apputil.NewNamespacedEtcdPath()
+	}
+	client, err := etcdutil.NewEtcdClient(ops.endpoints, ops.lg, etcdOpts...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
+	}
+	return client, etcdPath, nil
+}
+
+// @Description check etcd connectivity, prefix permission, spec consistency, orphaned keys and leader reachability
+// @Tags  leader
+// @Produce  json
+// @success 200 {object} SelfCheckReport
+// @Router /sm/server/selfcheck [get]
+func (ss *smShardApi) GinSelfCheck(c *gin.Context) {
+	sc := newSelfChecker(ss.lg, ss.container.Client, ss.container.Backend(), ss.container.nodeManager, ss.container.Id())
+	report := sc.run(c.Request.Context())
+	status := http.StatusOK
+	if !report.Ok {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
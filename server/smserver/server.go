@@ -15,12 +15,19 @@
 package smserver
 
 import (
+	"crypto/tls"
+	"strings"
+	"time"
+
 	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/chaos"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
 	_ "github.com/entertainment-venue/sm/server/docs"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	swaggerfiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
 	"go.uber.org/zap"
 )
 
@@ -28,6 +35,12 @@ type Server struct {
 	shardServer *apputil.ShardServer
 	smContainer *smContainer
 
+	// etcd 开启内置etcd时在所有组件关闭之后关闭
+	etcd *embeddedEtcd
+
+	// replica 只读模式下代替shardServer提供http接口
+	replica *readReplica
+
 	opts  *serverOptions
 	donec chan struct{}
 }
@@ -48,8 +61,123 @@ type serverOptions struct {
 	lg *zap.Logger
 
 	// etcdPrefix 这个路径是etcd中开辟出来给sm使用的，etcd可能是多个组件公用
-	// TODO 要有用户名和密码限制
 	etcdPrefix string
+
+	// mirrorEndpoints 迁移etcd集群时的新集群，sm的写入同步到新集群
+	mirrorEndpoints []string
+
+	// etcdNamespace 通过clientv3的namespace隔离sm的数据，多个sm部署可以共用一个etcd集群，设置后etcdPrefix不再生效
+	etcdNamespace string
+
+	// etcdUsername 和 etcdPassword 在etcd开启认证时使用，配合etcdPrefix做acl限制
+	etcdUsername string
+	etcdPassword string
+
+	// etcd开启tls时需要的证书
+	etcdCAFile   string
+	etcdCertFile string
+	etcdKeyFile  string
+
+	// etcd client的超时、keepalive和重试策略，为0使用 etcdutil 的默认值
+	etcdDialTimeout      time.Duration
+	etcdKeepAliveTime    time.Duration
+	etcdKeepAliveTimeout time.Duration
+	etcdMaxRetries       int
+	etcdRetryBackoff     time.Duration
+	etcdReadTimeout      time.Duration
+	etcdWriteTimeout     time.Duration
+
+	// apiTokens 开启 /sm/server 接口的鉴权，token到可操作service的映射
+	apiTokens map[string][]string
+
+	// leaderLeaseTTL leader竞选session的ttl，单位秒，决定leader异常后的failover时间
+	leaderLeaseTTL int
+
+	// heartbeatLeaseTTL sm container heartbeat和service lock使用的session ttl，单位秒，为0时和leaderLeaseTTL相同
+	heartbeatLeaseTTL int
+
+	// stabilizationDelay 竞选leader成功后等待一段时间再开始管理shard，等待集群中container的heartbeat稳定下来
+	stabilizationDelay time.Duration
+
+	// dbPath sm自身shard的本地存储，同一个进程中运行多个sm时需要区分
+	dbPath string
+
+	// leaderForwarding 写接口转发给leader处理
+	leaderForwarding bool
+
+	// apiRate 和 apiBurst 每个client的 /sm/server 接口限流，token/s，<=0不限制
+	apiRate  float64
+	apiBurst int
+
+	// apiGlobalRate 和 apiGlobalBurst 所有client共享的 /sm/server 接口限流，token/s，<=0不限制
+	apiGlobalRate  float64
+	apiGlobalBurst int
+
+	// apiAudit 修改类的 /sm/server 请求写入事件日志
+	apiAudit bool
+
+	// federationRegions 不为空时作为联邦的coordinator，key是region名称，value是region中sm节点的地址，
+	// 地址可以带 https:// ，federationCAFile 校验region的证书，federationInsecure 允许通过明文http转发调用方的token
+	federationRegions  map[string]string
+	federationCAFile   string
+	federationInsecure bool
+	federationTLS      *tls.Config
+
+	// idempotencyWindow 带 Idempotency-Key 的请求重放时返回第一次结果的时间窗口，为0使用默认的1h
+	idempotencyWindow time.Duration
+
+	// drainTimeout 主动关闭时等待shard移交给其他sm container的最长时间，为0直接关闭
+	drainTimeout time.Duration
+
+	// shutdownTimeout 关闭http server时等待进行中请求完成的最长时间，为0使用默认的10s
+	shutdownTimeout time.Duration
+
+	// janitorMaxAge etcd中的孤儿节点持续超过这个时间后被leader删除，为0不清理
+	janitorMaxAge time.Duration
+
+	// backupDir leader把etcd prefix下的key备份到这个目录，backupInterval为0时只能通过api触发，
+	// backupKeep 目录中保留的备份数量，<=0使用默认值
+	backupDir      string
+	backupInterval time.Duration
+	backupKeep     int
+
+	// debug 挂载 /debug/pprof 和 /debug/vars，排查问题时开启
+	debug bool
+
+	// readOnly 只读副本，不注册为sm的container，从watch维护的缓存提供查询接口并拒绝写接口
+	readOnly bool
+
+	// embeddedEtcdDir 不为空时在进程内启动单节点etcd，数据保存在这个目录，endpoints为空时连接内置的etcd，
+	// embeddedEtcdClientURL 和 embeddedEtcdPeerURL 为空使用 http://127.0.0.1:2379 和 http://127.0.0.1:2380
+	embeddedEtcdDir       string
+	embeddedEtcdClientURL string
+	embeddedEtcdPeerURL   string
+
+	// shardValidators add shard、add spec、import写入shard之前执行
+	shardValidators []ShardValidator
+
+	// shardHistorySize 每个shard保留的分配记录数量，<=0使用默认值
+	shardHistorySize int
+
+	// taskKey shard的Task写入etcd之前使用AES-GCM加密，为空时从环境变量 SM_TASK_KEY 读取，都没有时不加密
+	taskKey []byte
+
+	// quota 和 tenantQuotas 限制service和shard数量，tenantQuotas的key是token
+	quota        Quota
+	tenantQuotas map[string]Quota
+
+	// shardGrpc 向开启grpc的container通过grpc下发add/drop，没有开启grpc的container仍然使用http，
+	// shardGrpcCAFile、shardGrpcCertFile 和 shardGrpcKeyFile 是双向认证的证书，shardGrpcInsecure 显式开启明文
+	shardGrpc         bool
+	shardGrpcCAFile   string
+	shardGrpcCertFile string
+	shardGrpcKeyFile  string
+	shardGrpcInsecure bool
+	shardGrpcTLS      *tls.Config
+
+	// breakerThreshold 和 breakerCooldown operator对container连续add/drop失败的熔断，threshold为负数时关闭
+	breakerThreshold int
+	breakerCooldown  time.Duration
 }
 
 type ServerOption func(options *serverOptions)
@@ -90,6 +218,266 @@ func WithEtcdPrefix(v string) ServerOption {
 	}
 }
 
+// WithMirrorEndpoints 开启双写，读取走endpoints，写入同步到mirror集群，通过 /sm/server/etcd-migration/cutover 切换
+func WithMirrorEndpoints(v []string) ServerOption {
+	return func(options *serverOptions) {
+		options.mirrorEndpoints = v
+	}
+}
+
+func WithEtcdNamespace(v string) ServerOption {
+	return func(options *serverOptions) {
+		options.etcdNamespace = v
+	}
+}
+
+func WithDbPath(v string) ServerOption {
+	return func(options *serverOptions) {
+		options.dbPath = v
+	}
+}
+
+func WithLeaderForwarding(v bool) ServerOption {
+	return func(options *serverOptions) {
+		options.leaderForwarding = v
+	}
+}
+
+func WithEtcdAuth(username, password string) ServerOption {
+	return func(options *serverOptions) {
+		options.etcdUsername = username
+		options.etcdPassword = password
+	}
+}
+
+func WithEtcdTLS(caFile, certFile, keyFile string) ServerOption {
+	return func(options *serverOptions) {
+		options.etcdCAFile = caFile
+		options.etcdCertFile = certFile
+		options.etcdKeyFile = keyFile
+	}
+}
+
+// WithEtcdDialTimeout 和etcd建立连接的超时时间，默认3秒
+func WithEtcdDialTimeout(v time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.etcdDialTimeout = v
+	}
+}
+
+// WithEtcdKeepAlive etcd连接keepalive探测的间隔和超时时间，etcd节点异常时尽快切换
+func WithEtcdKeepAlive(interval, timeout time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.etcdKeepAliveTime = interval
+		options.etcdKeepAliveTimeout = timeout
+	}
+}
+
+// WithEtcdRetry etcd短暂不可用时幂等操作的重试次数和第一次重试前的等待时间，maxRetries小于0不重试
+func WithEtcdRetry(maxRetries int, backoff time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.etcdMaxRetries = maxRetries
+		options.etcdRetryBackoff = backoff
+	}
+}
+
+// WithEtcdOpTimeout etcd读和写操作各自的超时时间，防止etcd抖动时leader长时间阻塞
+func WithEtcdOpTimeout(read, write time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.etcdReadTimeout = read
+		options.etcdWriteTimeout = write
+	}
+}
+
+func WithApiTokens(v map[string][]string) ServerOption {
+	return func(options *serverOptions) {
+		options.apiTokens = v
+	}
+}
+
+func WithLeaderLeaseTTL(v int) ServerOption {
+	return func(options *serverOptions) {
+		options.leaderLeaseTTL = v
+	}
+}
+
+// WithHeartbeatLeaseTTL heartbeat的session和竞选的session分开续约，一个过期不影响另一个
+func WithHeartbeatLeaseTTL(v int) ServerOption {
+	return func(options *serverOptions) {
+		options.heartbeatLeaseTTL = v
+	}
+}
+
+func WithStabilizationDelay(v time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.stabilizationDelay = v
+	}
+}
+
+// WithApiRateLimit 每个client（带token时按照token，否则按照ip）的接口限流，burst<=0时等于rate
+func WithApiRateLimit(rate float64, burst int) ServerOption {
+	return func(options *serverOptions) {
+		options.apiRate = rate
+		options.apiBurst = burst
+	}
+}
+
+// WithApiGlobalRateLimit 所有client共享的接口限流，防止leader的etcd带宽被耗尽
+func WithApiGlobalRateLimit(rate float64, burst int) ServerOption {
+	return func(options *serverOptions) {
+		options.apiGlobalRate = rate
+		options.apiGlobalBurst = burst
+	}
+}
+
+// WithApiAudit 修改类的接口调用同时写入事件日志，通过events接口查询
+func WithApiAudit(v bool) ServerOption {
+	return func(options *serverOptions) {
+		options.apiAudit = v
+	}
+}
+
+// WithDrainTimeout 计划内重启时，关闭前继续工作，等待leader把shard移走，超时后再关闭
+func WithDrainTimeout(v time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.drainTimeout = v
+	}
+}
+
+// WithShutdownTimeout 关闭时http server停止接收新请求，等待进行中的请求完成，超时后强制断开
+func WithShutdownTimeout(v time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.shutdownTimeout = v
+	}
+}
+
+// WithFederationRegions 开启联邦接口，把service分配到多个region的sm集群，region的sm需要开启leader forwarding
+func WithFederationRegions(v map[string]string) ServerOption {
+	return func(options *serverOptions) {
+		options.federationRegions = v
+	}
+}
+
+// WithFederationTLS region地址使用 https:// 时用caFile校验region的证书，为空时使用系统的ca
+func WithFederationTLS(caFile string) ServerOption {
+	return func(options *serverOptions) {
+		options.federationCAFile = caFile
+	}
+}
+
+// WithFederationInsecure 允许通过明文http向region转发调用方的token，只用于开发和测试环境
+func WithFederationInsecure(v bool) ServerOption {
+	return func(options *serverOptions) {
+		options.federationInsecure = v
+	}
+}
+
+// WithIdempotencyWindow add-spec、add-shard和del-shard的 Idempotency-Key 的有效时间
+func WithIdempotencyWindow(v time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.idempotencyWindow = v
+	}
+}
+
+// WithJanitorMaxAge 开启leader对etcd中残留的heartbeat、assignment和已删除service节点的清理
+func WithJanitorMaxAge(v time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.janitorMaxAge = v
+	}
+}
+
+// WithBackup 开启etcd prefix的备份，interval为0时只能通过 /sm/server/backup 触发
+func WithBackup(dir string, interval time.Duration, keep int) ServerOption {
+	return func(options *serverOptions) {
+		options.backupDir = dir
+		options.backupInterval = interval
+		options.backupKeep = keep
+	}
+}
+
+// WithReadOnly 以只读副本运行，分担dashboard等查询流量，不参与leader竞选和service的管理
+func WithReadOnly(v bool) ServerOption {
+	return func(options *serverOptions) {
+		options.readOnly = v
+	}
+}
+
+// WithEmbeddedEtcd 在进程内启动单节点etcd，适用于开发、演示和单节点部署，多个sm节点时应该使用独立的etcd集群
+func WithEmbeddedEtcd(dir string, clientURL string, peerURL string) ServerOption {
+	return func(options *serverOptions) {
+		options.embeddedEtcdDir = dir
+		options.embeddedEtcdClientURL = clientURL
+		options.embeddedEtcdPeerURL = peerURL
+	}
+}
+
+// WithShardHistorySize 每个shard在etcd中保留的分配记录数量
+func WithShardHistorySize(v int) ServerOption {
+	return func(options *serverOptions) {
+		options.shardHistorySize = v
+	}
+}
+
+// WithDebug 开启pprof和expvar接口，开启api鉴权时同样需要token或者证书
+func WithDebug(v bool) ServerOption {
+	return func(options *serverOptions) {
+		options.debug = v
+	}
+}
+
+// WithShardValidator 注册shard校验函数，可以多次调用，按照注册顺序执行
+func WithShardValidator(v ShardValidator) ServerOption {
+	return func(options *serverOptions) {
+		options.shardValidators = append(options.shardValidators, v)
+	}
+}
+
+// WithTaskKey task中包含密码等敏感信息时开启加密，key长度16、24或者32字节，sharded application需要使用相同的key
+func WithTaskKey(v []byte) ServerOption {
+	return func(options *serverOptions) {
+		options.taskKey = v
+	}
+}
+
+// WithQuota 全局的service数量和单个service的shard数量上限，<=0不限制
+func WithQuota(v Quota) ServerOption {
+	return func(options *serverOptions) {
+		options.quota = v
+	}
+}
+
+// WithTenantQuotas 租户的quota，key是鉴权使用的token，和全局quota同时生效
+func WithTenantQuotas(v map[string]Quota) ServerOption {
+	return func(options *serverOptions) {
+		options.tenantQuotas = v
+	}
+}
+
+// WithMoveCircuitBreaker 同一个container连续失败threshold次后，cooldown期间不再下发add/drop，为0使用默认值
+func WithMoveCircuitBreaker(threshold int, cooldown time.Duration) ServerOption {
+	return func(options *serverOptions) {
+		options.breakerThreshold = threshold
+		options.breakerCooldown = cooldown
+	}
+}
+
+// WithShardGrpc 开启grpc下发add/drop，证书需要和container的 apputil.ShardServerWithGrpc 使用相同的ca
+func WithShardGrpc(enabled bool, caFile, certFile, keyFile string) ServerOption {
+	return func(options *serverOptions) {
+		options.shardGrpc = enabled
+		options.shardGrpcCAFile = caFile
+		options.shardGrpcCertFile = certFile
+		options.shardGrpcKeyFile = keyFile
+	}
+}
+
+// WithShardGrpcInsecure 没有证书时使用明文grpc，只用于开发和测试环境，container需要使用 apputil.ShardServerWithInsecureGrpc
+func WithShardGrpcInsecure(v bool) ServerOption {
+	return func(options *serverOptions) {
+		options.shardGrpcInsecure = v
+	}
+}
+
 func NewServer(fn ...ServerOption) (*Server, error) {
 	ops := serverOptions{}
 	for _, f := range fn {
@@ -105,16 +493,67 @@ func NewServer(fn ...ServerOption) (*Server, error) {
 	if ops.addr == "" {
 		return nil, errors.New("addr err")
 	}
-	if len(ops.endpoints) == 0 {
+	if len(ops.endpoints) == 0 && ops.embeddedEtcdDir == "" {
 		return nil, errors.New("endpoints err")
 	}
 	if ops.lg == nil {
 		return nil, errors.New("logger err")
 	}
-	apputil.InitEtcdPrefix(ops.etcdPrefix)
-
+	if ops.taskKey == nil {
+		key, err := apputil.TaskKeyFromEnv()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		ops.taskKey = key
+	}
+	if ops.taskKey != nil {
+		if err := apputil.ValidateTaskKey(ops.taskKey); err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	if ops.shardGrpc && (ops.shardGrpcCAFile != "" || ops.shardGrpcCertFile != "" || ops.shardGrpcKeyFile != "") {
+		tlsConfig, err := apputil.NewMutualTLSConfig(ops.shardGrpcCAFile, ops.shardGrpcCertFile, ops.shardGrpcKeyFile, false)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		ops.shardGrpcTLS = tlsConfig
+	}
+	if ops.shardGrpc && ops.shardGrpcTLS == nil && !ops.shardGrpcInsecure {
+		return nil, errors.New("shard grpc requires tls, use WithShardGrpcInsecure for plaintext")
+	}
+	for region, addr := range ops.federationRegions {
+		if _, err := regionURL(addr); err != nil {
+			return nil, errors.Wrapf(err, "region %s", region)
+		}
+	}
+	if ops.federationCAFile != "" {
+		tlsConfig, err := (transport.TLSInfo{TrustedCAFile: ops.federationCAFile}).ClientConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		ops.federationTLS = tlsConfig
+	}
 	srv := Server{opts: &ops, donec: make(chan struct{})}
+	if ops.embeddedEtcdDir != "" {
+		etcd, err := startEmbeddedEtcd(ops.lg, ops.id, ops.embeddedEtcdDir, ops.embeddedEtcdClientURL, ops.embeddedEtcdPeerURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		srv.etcd = etcd
+		if len(ops.endpoints) == 0 {
+			ops.endpoints = etcd.endpoints()
+		}
+	}
+	// 只读副本没有session，缓存自己处理watch的中断，不需要重启
+	if ops.readOnly {
+		if err := srv.runReadOnly(); err != nil {
+			srv.closeEtcd()
+			return nil, err
+		}
+		return &srv, nil
+	}
 	if err := srv.run(); err != nil {
+		srv.closeEtcd()
 		return nil, err
 	}
 
@@ -163,21 +602,58 @@ func NewServer(fn ...ServerOption) (*Server, error) {
 }
 
 func (s *Server) run() error {
-	container, err := apputil.NewContainer(
+	heartbeatLeaseTTL := s.opts.heartbeatLeaseTTL
+	if heartbeatLeaseTTL <= 0 {
+		heartbeatLeaseTTL = s.opts.leaderLeaseTTL
+	}
+	opts := []apputil.ContainerOption{
 		apputil.ContainerWithService(s.opts.service),
 		apputil.ContainerWithId(s.opts.id),
 		apputil.ContainerWithEndpoints(s.opts.endpoints),
-		apputil.ContainerWithLogger(s.opts.lg))
+		apputil.ContainerWithLogger(s.opts.lg),
+		apputil.ContainerWithSessionTTL(heartbeatLeaseTTL),
+		// heartbeat的session过期后重建，不重启整个server，竞选的session不受影响
+		apputil.ContainerWithSessionRecovery(defaultSessionRecoveryBackoff, 0),
+		apputil.ContainerWithEtcdPrefix(s.opts.etcdPrefix),
+		apputil.ContainerWithEtcdNamespace(s.opts.etcdNamespace),
+		apputil.ContainerWithEtcdClientOptions(
+			etcdutil.EtcdClientWithDialTimeout(s.opts.etcdDialTimeout),
+			etcdutil.EtcdClientWithKeepAlive(s.opts.etcdKeepAliveTime, s.opts.etcdKeepAliveTimeout),
+			etcdutil.EtcdClientWithRetry(s.opts.etcdMaxRetries, s.opts.etcdRetryBackoff),
+			etcdutil.EtcdClientWithOpTimeout(s.opts.etcdReadTimeout, s.opts.etcdWriteTimeout),
+		),
+	}
+	if len(s.opts.mirrorEndpoints) > 0 {
+		opts = append(opts, apputil.ContainerWithMirrorEndpoints(s.opts.mirrorEndpoints))
+	}
+	if s.opts.etcdUsername != "" {
+		opts = append(opts, apputil.ContainerWithEtcdAuth(s.opts.etcdUsername, s.opts.etcdPassword))
+	}
+	if s.opts.etcdCAFile != "" || s.opts.etcdCertFile != "" || s.opts.etcdKeyFile != "" {
+		opts = append(opts, apputil.ContainerWithEtcdTLS(s.opts.etcdCAFile, s.opts.etcdCertFile, s.opts.etcdKeyFile))
+	}
+	container, err := apputil.NewContainer(opts...)
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
 
-	smContainer, err := newSMContainer(s.opts.lg, container)
+	smContainer, err := newSMContainer(s.opts.lg, container, s.opts.stabilizationDelay, s.opts.leaderLeaseTTL)
 	if err != nil {
 		container.Close()
 		return errors.Wrap(err, "")
 	}
 	s.smContainer = smContainer
+	smContainer.janitor.setMaxAge(s.opts.janitorMaxAge)
+	smContainer.backuper.setStore(s.opts.backupDir, s.opts.backupInterval, s.opts.backupKeep)
+	smContainer.shardValidators = s.opts.shardValidators
+	smContainer.history.setSize(s.opts.shardHistorySize)
+	smContainer.taskKey = s.opts.taskKey
+	if s.opts.shardGrpc {
+		smContainer.shardGrpc = newShardGrpcPool(s.opts.lg, s.opts.shardGrpcTLS)
+	}
+	smContainer.breakerThreshold = s.opts.breakerThreshold
+	smContainer.breakerCooldown = s.opts.breakerCooldown
+	smContainer.quotas = newQuotaChecker(s.opts.quota, s.opts.tenantQuotas)
 
 	ss, err := apputil.NewShardServer(
 		apputil.ShardServerWithAddr(s.opts.addr),
@@ -185,13 +661,16 @@ func (s *Server) run() error {
 		apputil.ShardServerWithApiHandler(s.getHandlers(smContainer)),
 		apputil.ShardServerWithShardImplementation(smContainer),
 		apputil.ShardServerWithLogger(s.opts.lg),
-		apputil.ShardServerWithEtcdPrefix(s.opts.etcdPrefix))
+		apputil.ShardServerWithEtcdPrefix(s.opts.etcdPrefix),
+		apputil.ShardServerWithDbPath(s.opts.dbPath),
+		apputil.ShardServerWithShutdownTimeout(s.opts.shutdownTimeout))
 	if err != nil {
 		container.Close()
 		smContainer.Close()
 		return errors.Wrap(err, "new shard server failed")
 	}
 	s.shardServer = ss
+	smContainer.shardServerDone = ss.Done()
 	return nil
 }
 
@@ -199,6 +678,18 @@ func (s *Server) run() error {
 // shardServer的Close是threadsafe的，但是shardServer的Done先触发被动关闭，close方法会被调用两次，
 // 虽然smContainer的Close是threadsafe，但两个组件会被关闭两次，请发发生比较少
 func (s *Server) Close() {
+	if s.replica != nil {
+		s.replica.close(s.opts.shutdownTimeout)
+		close(s.donec)
+		s.closeEtcd()
+		return
+	}
+
+	// 关闭shardServer会立即drop所有shard，先等待leader把shard移交出去
+	if s.opts.drainTimeout > 0 && s.smContainer != nil {
+		s.smContainer.drain(s.opts.drainTimeout)
+	}
+
 	// 主动关闭: 需要关闭shardServer
 	// shardServer的关闭会触发NewServer中的goroutine被动关闭
 	s.shardServer.Close()
@@ -206,7 +697,12 @@ func (s *Server) Close() {
 	// 通知调用方，因为是主动关闭
 	close(s.donec)
 
-	// 关闭后，进程退出，至于smContainer的关闭依赖shardServer即可
+	// 关闭后，进程退出，至于smContainer的关闭依赖shardServer即可，
+	// 内置etcd需要等smContainer释放session之后再关闭
+	if s.etcd != nil {
+		s.close()
+		s.closeEtcd()
+	}
 }
 
 func (s *Server) close() {
@@ -220,14 +716,99 @@ func (s *Server) Done() <-chan struct{} {
 
 func (s *Server) getHandlers(container *smContainer) map[string]func(c *gin.Context) {
 	apiSrv := newSMShardApi(container)
+	auth := newApiAuth(s.opts.lg, s.opts.apiTokens)
+	accessLog := newApiAccessLog(s.opts.lg, container, s.opts.apiAudit)
+	idempotent := newApiIdempotency(s.opts.lg, s.opts.idempotencyWindow).wrap
+	peers := newSMPeers(s.opts.lg, container)
+	limiter := newApiRateLimiter(s.opts.lg, auth, peers.contains, s.opts.apiGlobalRate, s.opts.apiGlobalBurst, s.opts.apiRate, s.opts.apiBurst)
+
+	// 写接口在leader上执行，鉴权在转发之前完成
+	write := func(handler gin.HandlerFunc) gin.HandlerFunc { return handler }
+	// 依赖smShard的接口在负责service的container上执行
+	governed := func(handler gin.HandlerFunc) gin.HandlerFunc { return handler }
+	if s.opts.leaderForwarding {
+		write = newLeaderForwarder(s.opts.lg, container, peers.contains).wrap
+		governed = newGovernorForwarder(s.opts.lg, container, peers.contains).wrap
+	}
+	// 只读副本拒绝所有写接口以及需要governor执行的接口
+	if s.opts.readOnly {
+		write = rejectReadOnly
+		governed = rejectReadOnly
+	}
+
 	handlers := make(map[string]func(c *gin.Context))
-	handlers["/sm/server/add-spec"] = apiSrv.GinAddSpec
-	handlers["/sm/server/del-spec"] = apiSrv.GinDelSpec
-	handlers["/sm/server/get-spec"] = apiSrv.GinGetSpec
-	handlers["/sm/server/update-spec"] = apiSrv.GinUpdateSpec
-	handlers["/sm/server/add-shard"] = apiSrv.GinAddShard
-	handlers["/sm/server/del-shard"] = apiSrv.GinDelShard
-	handlers["/sm/server/get-shard"] = apiSrv.GinGetShard
+	handlers["/sm/server/add-spec"] = auth.wrap(write(idempotent(apiSrv.GinAddSpec)))
+	handlers["/sm/server/del-spec"] = auth.wrap(governed(apiSrv.GinDelSpec))
+	handlers["/sm/server/get-spec"] = auth.wrap(apiSrv.GinGetSpec)
+	handlers["/sm/server/list-services"] = auth.wrap(apiSrv.GinListServices)
+	handlers["/sm/server/export"] = auth.wrap(apiSrv.GinExport)
+	handlers["/sm/server/import"] = auth.admin(write(apiSrv.GinImport))
+	handlers["/sm/server/clone-service"] = auth.wrap(write(apiSrv.GinCloneService))
+	handlers["/sm/server/update-spec"] = auth.wrap(governed(apiSrv.GinUpdateSpec))
+	handlers["/sm/server/add-shard"] = auth.wrap(write(idempotent(apiSrv.GinAddShard)))
+	handlers["/sm/server/del-shard"] = auth.wrap(write(idempotent(apiSrv.GinDelShard)))
+	handlers["/sm/server/get-shard"] = auth.wrap(apiSrv.GinGetShard)
+	handlers["/sm/server/add-shard-group"] = auth.wrap(governed(apiSrv.GinAddShardGroup))
+	handlers["/sm/server/pin-shard"] = auth.wrap(write(apiSrv.GinPinShard))
+	handlers["/sm/server/unpin-shard"] = auth.wrap(write(apiSrv.GinUnpinShard))
+	handlers["/sm/server/maintenance"] = auth.wrap(write(apiSrv.GinMaintenance))
+	handlers["/sm/server/cordon-container"] = auth.wrap(write(apiSrv.GinCordonContainer))
+	handlers["/sm/server/uncordon-container"] = auth.wrap(write(apiSrv.GinUncordonContainer))
+	handlers["/sm/server/freeze"] = auth.wrap(governed(apiSrv.GinFreeze))
+	handlers["/sm/server/drain-service"] = auth.wrap(governed(apiSrv.GinDrainService))
+	handlers["/sm/server/leader"] = auth.wrap(apiSrv.GinLeader)
+	handlers["/sm/server/janitor"] = auth.admin(write(apiSrv.GinJanitor))
+	handlers["/sm/server/selfcheck"] = auth.wrap(apiSrv.GinSelfCheck)
+	handlers["/sm/server/backup"] = auth.admin(write(apiSrv.GinBackup))
+	// 负载均衡的健康检查不带认证信息
+	handlers["/sm/server/health"] = apiSrv.GinHealth
+	handlers["/sm/server/etcd-migration"] = auth.wrap(apiSrv.GinEtcdMigration)
+	handlers["/sm/server/etcd-migration/sync"] = auth.admin(write(apiSrv.GinEtcdSync))
+	handlers["/sm/server/etcd-migration/cutover"] = auth.admin(write(apiSrv.GinEtcdCutover))
+	handlers["/sm/server/resign-leader"] = auth.admin(write(apiSrv.GinResignLeader))
+	handlers["/sm/server/pause"] = auth.admin(write(apiSrv.GinPause))
+	handlers["/sm/server/resume"] = auth.admin(write(apiSrv.GinResume))
+	handlers["/sm/server/pause-status"] = auth.wrap(apiSrv.GinPauseStatus)
+	handlers["/sm/server/rebalance-plan"] = auth.wrap(governed(apiSrv.GinRebalancePlan))
+	handlers["/sm/server/rebalance-status"] = auth.wrap(apiSrv.GinRebalanceStatus)
+	handlers["/sm/server/trigger-rebalance"] = auth.wrap(governed(apiSrv.GinTriggerRebalance))
+	handlers["/sm/server/watch"] = auth.wrap(apiSrv.GinWatch)
+	handlers["/sm/server/dead-letters"] = auth.wrap(apiSrv.GinDeadLetters)
+	handlers["/sm/server/add-webhook"] = auth.wrap(write(apiSrv.GinAddWebhook))
+	handlers["/sm/server/del-webhook"] = auth.wrap(write(apiSrv.GinDelWebhook))
+	handlers["/sm/server/webhooks"] = auth.wrap(apiSrv.GinWebhooks)
+	handlers["/sm/server/requeue-dead-letters"] = auth.wrap(governed(apiSrv.GinRequeueDeadLetters))
+	handlers["/sm/server/unassigned-shards"] = auth.wrap(governed(apiSrv.GinUnassignedShards))
+	handlers["/sm/server/utilization"] = auth.wrap(governed(apiSrv.GinUtilization))
+	handlers["/sm/server/explain"] = auth.wrap(governed(apiSrv.GinExplain))
+	handlers["/sm/server/events"] = auth.wrap(apiSrv.GinEvents)
+	handlers["/sm/server/cluster-state"] = auth.wrap(apiSrv.GinClusterState)
+	handlers["/sm/server/load"] = auth.wrap(apiSrv.GinLoad)
+	handlers["/sm/server/containers"] = auth.wrap(apiSrv.GinContainers)
+	handlers["/sm/dashboard"] = apiSrv.GinDashboard
+	if len(s.opts.federationRegions) > 0 {
+		fed := newFederator(s.opts.lg, container, s.opts.federationRegions, s.opts.federationTLS, s.opts.federationInsecure)
+		handlers["/sm/server/federation/add-spec"] = auth.wrap(write(fed.GinAddSpec))
+		handlers["/sm/server/federation/add-shard"] = auth.wrap(write(idempotent(fed.GinAddShard)))
+		handlers["/sm/server/federation/del-shard"] = auth.wrap(write(fed.GinDelShard))
+		handlers["/sm/server/federation/state"] = auth.wrap(fed.GinState)
+	}
+	// 故障注入只作用于当前进程，不经过leader转发
+	if chaos.Enabled {
+		handlers["/sm/server/chaos"] = auth.admin(apiSrv.GinChaos)
+		handlers["/sm/server/set-chaos"] = auth.admin(apiSrv.GinSetChaos)
+	}
+	if s.opts.debug {
+		for path, handler := range debugHandlers(container) {
+			handlers[path] = auth.admin(handler)
+		}
+	}
 	handlers["/swagger/*any"] = ginSwagger.WrapHandler(swaggerfiles.Handler)
+
+	for path, handler := range handlers {
+		if strings.HasPrefix(path, "/sm/server/") {
+			handlers[path] = traceHandler(path, accessLog.wrap(limiter.wrap(handler)))
+		}
+	}
 	return handlers
 }
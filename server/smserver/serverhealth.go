@@ -0,0 +1,201 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	healthOk       = "ok"
+	healthDegraded = "degraded"
+	healthFail     = "fail"
+
+	// defaultHealthQueueWarn service的move队列超过该长度时为warn，leader处理不过来或者container大面积异常
+	defaultHealthQueueWarn = 1000
+)
+
+// HealthComponent 单个组件的健康状态，Status是ok、warn或者fail
+type HealthComponent struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ServerHealth 没有warn和fail时Status为ok，只有warn时为degraded，存在fail时为fail
+type ServerHealth struct {
+	Status     string             `json:"status"`
+	Time       int64              `json:"time"`
+	Components []*HealthComponent `json:"components"`
+}
+
+// health 汇总session、leader选举、move队列、shard server以及每个service的worker状态，
+// 只读取内存和leader节点，给负载均衡的健康检查使用
+func (c *smContainer) health(ctx context.Context) *ServerHealth {
+	r := ServerHealth{Status: healthOk, Time: time.Now().Unix()}
+	add := func(name, status, detail string) {
+		r.Components = append(r.Components, &HealthComponent{Name: name, Status: status, Detail: detail})
+		switch {
+		case status == selfCheckFail:
+			r.Status = healthFail
+		case status == selfCheckWarn && r.Status == healthOk:
+			r.Status = healthDegraded
+		}
+	}
+
+	// 只读副本没有session和shard server，只关注缓存是否和etcd同步
+	if c.cache != nil {
+		status, detail := c.cache.check()
+		add("cache", status, detail)
+	} else {
+		sessionCtx, cancel := context.WithTimeout(ctx, defaultSelfCheckTimeout)
+		status, detail := c.checkSession(sessionCtx)
+		add("session", status, detail)
+		status, detail = c.checkElectionSession(sessionCtx)
+		add("electionSession", status, detail)
+		cancel()
+	}
+
+	leaderCtx, cancel := context.WithTimeout(ctx, defaultSelfCheckTimeout)
+	status, detail := c.checkLeader(leaderCtx)
+	cancel()
+	add("leader", status, detail)
+
+	if c.cache == nil {
+		status, detail = c.checkShardServer()
+		add("shardServer", status, detail)
+	}
+
+	status, detail, workers := c.checkWorkers()
+	add("queue", status, detail)
+	for _, w := range workers {
+		add(w.Name, w.Status, w.Detail)
+	}
+	return &r
+}
+
+// checkSession heartbeat的session失效后container上的shard会丢失，重建之前为fail
+func (c *smContainer) checkSession(ctx context.Context) (string, string) {
+	if c.Container == nil || c.Session == nil {
+		return selfCheckFail, "session not created"
+	}
+	return leaseHealth(ctx, "heartbeat", c.BackendSession())
+}
+
+// checkElectionSession 竞选的session失效后leader身份会丢失，campaign用新的session重新竞选
+func (c *smContainer) checkElectionSession(ctx context.Context) (string, string) {
+	if c.election == nil || c.election.current() == nil {
+		return selfCheckWarn, "election session not created"
+	}
+	return leaseHealth(ctx, "election", c.election.current())
+}
+
+// checkLeader 选举中没有leader时为warn，第一个启动的sm也会短暂没有leader
+func (c *smContainer) checkLeader(ctx context.Context) (string, string) {
+	info, err := c.leaderInfo(ctx)
+	if err != nil {
+		return selfCheckFail, err.Error()
+	}
+	if info == nil {
+		return selfCheckWarn, "no leader elected"
+	}
+	if info.ContainerId == c.Id() {
+		return selfCheckOk, fmt.Sprintf("leader self, term %d", info.Term)
+	}
+	return selfCheckOk, fmt.Sprintf("leader %s, term %d", info.ContainerId, info.Term)
+}
+
+// checkShardServer shard server退出或者container开始关闭后，负载均衡应该摘掉当前实例
+func (c *smContainer) checkShardServer() (string, string) {
+	if c.shardServerDone == nil {
+		return selfCheckWarn, "shard server not started"
+	}
+	select {
+	case <-c.shardServerDone:
+		return selfCheckFail, "shard server closed"
+	default:
+	}
+
+	c.mu.Lock()
+	closing := c.closing
+	c.mu.Unlock()
+	if closing {
+		return selfCheckFail, "container closing"
+	}
+	return selfCheckOk, fmt.Sprintf("%d services", c.shardCount())
+}
+
+// checkWorkers 返回move队列的汇总状态和每个service的worker状态，worker全部退出时为fail，发生过panic时为warn
+func (c *smContainer) checkWorkers() (string, string, []*HealthComponent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		depth   int64
+		backlog []string
+		workers []*HealthComponent
+	)
+	for service, shard := range c.shards {
+		ss, ok := shard.(*smShard)
+		if !ok {
+			continue
+		}
+		n := ss.QueueDepth()
+		depth += n
+		if n > defaultHealthQueueWarn {
+			backlog = append(backlog, fmt.Sprintf("service %s queue %d", service, n))
+		}
+
+		w := HealthComponent{Name: "worker:" + service, Status: selfCheckOk}
+		panics := atomic.LoadInt64(&ss.stats.panics)
+		restarts := atomic.LoadInt64(&ss.stats.restarts)
+		switch {
+		case ss.stopper.Running() == 0:
+			w.Status, w.Detail = selfCheckFail, "no worker running"
+		case panics > 0:
+			w.Status, w.Detail = selfCheckWarn, fmt.Sprintf("%d panics, %d restarts", panics, restarts)
+		default:
+			w.Detail = fmt.Sprintf("%d goroutines", ss.stopper.Running())
+		}
+		workers = append(workers, &w)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Name < workers[j].Name })
+
+	if len(backlog) > 0 {
+		return selfCheckWarn, joinProblems(backlog), workers
+	}
+	return selfCheckOk, fmt.Sprintf("depth %d", depth), workers
+}
+
+// @Description health of etcd session, leader election, move queue, shard server and per-service workers, 503 when a component failed
+// @Tags  leader
+// @Produce  json
+// @success 200 {object} ServerHealth
+// @Router /sm/server/health [get]
+func (ss *smShardApi) GinHealth(c *gin.Context) {
+	r := ss.container.health(c.Request.Context())
+	status := http.StatusOK
+	if r.Status == healthFail {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, r)
+}
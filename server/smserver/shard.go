@@ -21,12 +21,14 @@ import (
 	"math"
 	"reflect"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/entertainment-venue/sm/pkg/apputil"
 	"github.com/pkg/errors"
-	"github.com/zd3tl/evtrigger"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
@@ -39,6 +41,10 @@ type workerEventType int
 const (
 	workerEventShardChanged workerEventType = iota + 1
 	workerEventContainerChanged
+	// workerEventRequeue 通过api重新入队的dead letter
+	workerEventRequeue
+	// workerEventReconcile reconciler修正分配的差异
+	workerEventReconcile
 
 	workerTrigger = "workerTrigger"
 
@@ -57,6 +63,12 @@ type workerTriggerEvent struct {
 
 	// Value 存储moveActionList
 	Value []byte `json:"value"`
+
+	// Priority 事件中move的优先级，故障转移优先于人工操作，人工操作优先于rebalance
+	Priority movePriority `json:"priority,omitempty"`
+
+	// TaskKey 事件在etcd中持久化的key，处理完成后删除，为空表示没有持久化
+	TaskKey string `json:"-"`
 }
 
 // smShardWrapper 实现 ShardWrapper，4 unit test
@@ -71,6 +83,9 @@ func (s *smShardWrapper) NewShard(c *smContainer, spec *apputil.ShardSpec) (Shar
 // sm的任务: 管理governedService的container和shard监控
 type shardTask struct {
 	GovernedService string `json:"governedService"`
+
+	// Owner 创建service的租户（鉴权的identity），租户quota统计使用
+	Owner string `json:"owner,omitempty"`
 }
 
 func (t *shardTask) String() string {
@@ -90,26 +105,82 @@ type smShard struct {
 
 	// service 从属于leader或者sm smShard，service和container不一定一样
 	service string
-	// appSpec 需要通过配置影响balance算法
-	appSpec *smAppSpec
+	// appSpec 需要通过配置影响balance算法，update-spec、freeze等接口和balanceLoop并发读写，
+	// 通过 spec 读取，通过 updateSpec 修改副本后整体替换，读到的appSpec不会再被修改
+	appSpec   *smAppSpec
+	appSpecMu sync.RWMutex
 	// shardSpec 分片的配置信息
 	shardSpec *apputil.ShardSpec
 
 	// mpr 存储当前存活的container和shard信息，代理etcd访问
 	mpr *mapper
 
-	// trigger 负责分片移动任务的任务提交和处理
-	trigger *evtrigger.Trigger
+	// queue 负责分片移动任务的任务提交和处理，按照优先级处理
+	queue *moveQueue
 	// operator 对接接入方，通过http请求下发shard move指令
 	operator *operator
+
+	// unassignedMu 保护unassigned，balanceChecker和api并发访问
+	unassignedMu sync.Mutex
+	// unassigned 最近一次balance后因为container上限没有分配的shard
+	unassigned []string
+
+	// reservationsMu 保护reservations，balanceChecker和api并发访问
+	reservationsMu sync.Mutex
+	// reservations 最近一轮balance开始时container上shard预留的资源
+	reservations *reservationLedger
+
+	// prober 开启HealthProbe后探测container的健康状态
+	prober *healthProber
+
+	// parker 维护窗口内暂停分配重启中container上的shard
+	parker *shardParker
+
+	// rounds 记录最近一轮rebalance的进度
+	rounds *roundTracker
+
+	// cooldown 记录shard最近一次移动的时间，开启MoveCooldown时使用
+	cooldown *moveCooldown
+
+	// warmup 新启动的container分批接收shard，开启Warmup时使用
+	warmup *warmupThrottle
+
+	// cordonMu 保护cordoned，balanceChecker和api并发访问
+	cordonMu sync.Mutex
+	// cordoned 最近一次balance时被cordon的container
+	cordoned map[string]struct{}
+
+	// queued trigger中等待执行的move任务数量，debug使用
+	queued int64
+
+	// rebalancec 接收立即执行balanceChecker的请求，处理结果通过请求中的channel返回
+	rebalancec chan chan error
+
+	// changec mapper发现container加入或丢失时通知balanceLoop，开启RebalanceDebounce时使用
+	changec chan struct{}
+
+	// drifts reconciler上一次检查发现的差异，连续两次发现才修正
+	drifts map[string]struct{}
+
+	// stats 后台goroutine的panic和错误计数
+	stats workerStats
+	// workerBackoff panic后重启的初始等待时间，为0使用默认值，4 unit test
+	workerBackoff time.Duration
+
+	// closing Close时关闭，结束canary的观察窗口，防止Close被阻塞
+	closing chan struct{}
 }
 
 func newSMShard(container *smContainer, shardSpec *apputil.ShardSpec) (*smShard, error) {
 	ss := &smShard{
 		container: container,
 		shardSpec: shardSpec,
-		stopper:   &apputil.GoroutineStopper{},
+		stopper:   container.stopper.NewChild("service:" + shardSpec.Service),
 		lg:        container.lg,
+		closing:   make(chan struct{}),
+
+		rebalancec: make(chan chan error),
+		changec:    make(chan struct{}, 1),
 	}
 
 	// 解析任务中需要负责的service
@@ -140,31 +211,93 @@ func newSMShard(container *smContainer, shardSpec *apputil.ShardSpec) (*smShard,
 	ss.appSpec = &appSpec
 
 	// 封装事件异步处理
-	trigger, _ := evtrigger.NewTrigger(
-		evtrigger.WithLogger(ss.lg),
-		evtrigger.WithWorkerSize(1),
-	)
-	_ = trigger.Register(workerTrigger, ss.processEvent)
-	ss.trigger = trigger
+	ss.queue = newMoveQueue(ss.lg, ss.handleEvent)
 	ss.operator = newOperator(ss.lg, shardSpec.Service)
+	ss.operator.setConcurrency(appSpec.MoveConcurrency)
 
 	// TODO 参数传递的有些冗余，需要重新梳理
-	ss.mpr, err = newMapper(ss.lg, container, &appSpec)
-	if err != nil {
-		return nil, errors.Wrap(err, "")
+	// leader管理sm自身时优先接管standby期间预热的mapper
+	if container.warm != nil {
+		ss.mpr = container.warm.take(ss.service, &appSpec)
+	}
+	if ss.mpr == nil {
+		ss.mpr, err = newMapper(ss.lg, container, &appSpec)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	// watch模式的container需要通过etcd下发shard
+	ss.operator.client = container.Client
+	ss.operator.etcdPath = container.nodeManager.etcdPath
+	ss.operator.isWatch = ss.mpr.IsWatchContainer
+	ss.operator.grpc = container.shardGrpc
+	ss.operator.breaker = newContainerBreaker(ss.lg, container.breakerThreshold, container.breakerCooldown)
+	ss.operator.grpcEndpoint = ss.mpr.GrpcEndpoint
+	ss.operator.reroute = ss.reroute
+	ss.operator.recorder = container.moveRecorder
+	ss.operator.events = container.events
+	ss.rounds = newRoundTracker(ss.lg, ss.service, ss.persistRound)
+	ss.operator.rounds = ss.rounds
+	ss.operator.deadLetters = container.deadLetters
+	ss.operator.states = container.states
+	ss.operator.history = container.history
+	ss.cooldown = newMoveCooldown()
+	ss.operator.cooldown = ss.cooldown
+	ss.warmup = newWarmupThrottle()
+	ss.operator.webhooks = container.webhooks
+	ss.prober = newHealthProber(ss.lg)
+	ss.parker = newShardParker()
+
+	ss.mpr.setOnChange(ss.containerChanged)
+
+	// 上一个负责该service的container没有处理完的task，先于balanceChecker下发
+	if err := ss.replayTasks(context.TODO()); err != nil {
+		ss.lg.Error(
+			"replay tasks error",
+			zap.String("service", ss.service),
+			zap.Error(err),
+		)
 	}
 
+	// 每个goroutine独立recover，一个service的panic不影响其他service和leader
 	ss.stopper.Wrap(
 		func(ctx context.Context) {
-			apputil.TickerLoop(
-				ctx,
-				ss.lg,
-				defaultLoopInterval,
-				fmt.Sprintf("balanceChecker exit, service %s ", ss.service),
-				func(ctx context.Context) error {
-					return ss.balanceChecker(ctx)
-				},
-			)
+			ss.supervise(ctx, "balanceChecker", ss.balanceLoop)
+		},
+	)
+	ss.stopper.Wrap(
+		func(ctx context.Context) {
+			ss.supervise(ctx, "healthChecker", func(ctx context.Context) {
+				apputil.TickerLoop(
+					ctx,
+					ss.lg,
+					defaultLoopInterval,
+					fmt.Sprintf("healthChecker exit, service %s ", ss.service),
+					func(ctx context.Context) error {
+						err := ss.healthChecker(ctx)
+						ss.workerError(err)
+						return err
+					},
+				)
+			})
+		},
+	)
+
+	ss.stopper.Wrap(
+		func(ctx context.Context) {
+			ss.supervise(ctx, "reconciler", func(ctx context.Context) {
+				apputil.TickerLoop(
+					ctx,
+					ss.lg,
+					defaultReconcileInterval,
+					fmt.Sprintf("reconciler exit, service %s ", ss.service),
+					func(ctx context.Context) error {
+						err := ss.reconcile(ctx)
+						ss.workerError(err)
+						return err
+					},
+				)
+			})
 		},
 	)
 
@@ -172,16 +305,181 @@ func newSMShard(container *smContainer, shardSpec *apputil.ShardSpec) (*smShard,
 	return ss, nil
 }
 
+// spec 当前的appSpec，返回的对象不会再被修改，调用方不需要持有锁
+func (ss *smShard) spec() *smAppSpec {
+	ss.appSpecMu.RLock()
+	defer ss.appSpecMu.RUnlock()
+	return ss.appSpec
+}
+
+// updateSpec copy-on-write，在appSpec的副本上修改，正在使用旧appSpec的balancePlan不受影响
+func (ss *smShard) updateSpec(fn func(spec *smAppSpec)) {
+	ss.appSpecMu.Lock()
+	defer ss.appSpecMu.Unlock()
+	var v smAppSpec
+	if ss.appSpec != nil {
+		v = *ss.appSpec
+	}
+	fn(&v)
+	ss.appSpec = &v
+}
+
 func (ss *smShard) SetMaxShardCount(maxShardCount int) {
 	if maxShardCount > 0 {
-		ss.appSpec.MaxShardCount = maxShardCount
+		ss.updateSpec(func(spec *smAppSpec) { spec.MaxShardCount = maxShardCount })
 	}
 }
 
 func (ss *smShard) SetMaxRecoveryTime(maxRecoveryTime int) {
 	if maxRecoveryTime > 0 && time.Duration(maxRecoveryTime)*time.Second <= maxRecoveryWaitTime {
-		ss.mpr.maxRecoveryTime = time.Duration(maxRecoveryTime) * time.Second
+		ss.mpr.setMaxRecoveryTime(time.Duration(maxRecoveryTime) * time.Second)
+	}
+}
+
+func (ss *smShard) SetMinimizeMovement(minimizeMovement bool) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.MinimizeMovement = minimizeMovement })
+}
+
+func (ss *smShard) SetMaxShardsPerContainer(maxShardsPerContainer int) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.MaxShardsPerContainer = maxShardsPerContainer })
+}
+
+func (ss *smShard) SetSpreadPolicy(spreadPolicy string) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.SpreadPolicy = spreadPolicy })
+}
+
+func (ss *smShard) SetDeploymentPolicy(deploymentPolicy string) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.DeploymentPolicy = deploymentPolicy })
+}
+
+func (ss *smShard) SetFrozen(frozen bool) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.Frozen = frozen })
+}
+
+func (ss *smShard) SetAssignor(assignor string) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.Assignor = assignor })
+}
+
+func (ss *smShard) SetMoveConcurrency(moveConcurrency int) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.MoveConcurrency = moveConcurrency })
+	ss.operator.setConcurrency(moveConcurrency)
+}
+
+func (ss *smShard) SetMoveCooldown(moveCooldown int) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.MoveCooldown = moveCooldown })
+}
+
+func (ss *smShard) SetCanary(canary *canarySpec) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.Canary = canary })
+}
+
+func (ss *smShard) SetWarmup(warmup *warmupSpec) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.Warmup = warmup })
+}
+
+func (ss *smShard) SetRebalanceInterval(rebalanceInterval int) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.RebalanceInterval = rebalanceInterval })
+}
+
+func (ss *smShard) SetRebalanceDebounce(rebalanceDebounce int) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.RebalanceDebounce = rebalanceDebounce })
+}
+
+func (ss *smShard) SetRebalanceWindows(rebalanceWindows []string) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.RebalanceWindows = rebalanceWindows })
+}
+
+// rebalanceInterval appSpec为空的场景 4 unit test
+func (ss *smShard) rebalanceInterval() time.Duration {
+	spec := ss.spec()
+	if spec == nil || spec.RebalanceInterval <= 0 {
+		return defaultLoopInterval
+	}
+	return time.Duration(spec.RebalanceInterval) * time.Second
+}
+
+// rebalanceDebounce 为0时container变化不触发rebalance
+func (ss *smShard) rebalanceDebounce() time.Duration {
+	spec := ss.spec()
+	if spec == nil || spec.RebalanceDebounce <= 0 {
+		return 0
+	}
+	return time.Duration(spec.RebalanceDebounce) * time.Millisecond
+}
+
+// containerChanged mapper的回调，不阻塞mapper的事件处理，balanceLoop还没处理的通知直接合并
+func (ss *smShard) containerChanged() {
+	select {
+	case ss.changec <- struct{}{}:
+	default:
+	}
+}
+
+// binpacking appSpec为空的场景 4 unit test
+func (ss *smShard) binpacking() bool {
+	spec := ss.spec()
+	return spec != nil && spec.Assignor == assignorBinpack
+}
+
+// Frozen appSpec为空的场景 4 unit test
+func (ss *smShard) Frozen() bool {
+	spec := ss.spec()
+	return spec != nil && spec.Frozen
+}
+
+// spreadByZone appSpec为空的场景 4 unit test，deployment的spread复用zone的逻辑，zone替换为deployment
+func (ss *smShard) spreadByZone() bool {
+	spec := ss.spec()
+	return spec != nil && (spec.SpreadPolicy == spreadPolicyZone || spec.DeploymentPolicy == deploymentPolicySpread)
+}
+
+// maxShardsPerContainer appSpec为空的场景 4 unit test
+func (ss *smShard) maxShardsPerContainer() int {
+	spec := ss.spec()
+	if spec == nil {
+		return 0
+	}
+	return spec.MaxShardsPerContainer
+}
+
+func (ss *smShard) SetHealthProbe(healthProbe bool) {
+	ss.updateSpec(func(spec *smAppSpec) { spec.HealthProbe = healthProbe })
+}
+
+// healthChecker watch模式的container没有http接口，不做探测
+func (ss *smShard) healthChecker(ctx context.Context) error {
+	if spec := ss.spec(); spec == nil || !spec.HealthProbe {
+		return nil
+	}
+	var containerIds []string
+	for id := range ss.mpr.AliveContainers() {
+		if ss.mpr.IsWatchContainer(id) {
+			continue
+		}
+		containerIds = append(containerIds, id)
+	}
+	ss.prober.check(ctx, containerIds)
+	return nil
+}
+
+// unhealthyContainers 没有开启HealthProbe时所有存活的container都参与分配
+func (ss *smShard) unhealthyContainers() map[string]struct{} {
+	if spec := ss.spec(); ss.prober == nil || spec == nil || !spec.HealthProbe {
+		return nil
 	}
+	return ss.prober.unhealthy()
+}
+
+func (ss *smShard) UnassignedShards() []string {
+	ss.unassignedMu.Lock()
+	defer ss.unassignedMu.Unlock()
+	return ss.unassigned
+}
+
+// minimizeMovement appSpec为空的场景 4 unit test
+func (ss *smShard) minimizeMovement() bool {
+	spec := ss.spec()
+	return spec != nil && spec.MinimizeMovement
 }
 
 func (ss *smShard) Load() string {
@@ -196,12 +494,30 @@ func (ss *smShard) Spec() *apputil.ShardSpec {
 	return ss.shardSpec
 }
 
+// UpdateTask governedService不变时（例如只修改了owner）直接替换spec，其他变更需要重新创建smShard
+func (ss *smShard) UpdateTask(task string) error {
+	var st shardTask
+	if err := json.Unmarshal([]byte(task), &st); err != nil {
+		return errors.Wrap(err, "")
+	}
+	if !st.Validate() || st.GovernedService != ss.service {
+		return errTaskUpdateUnsupported
+	}
+	spec := *ss.shardSpec
+	spec.Task = task
+	ss.shardSpec = &spec
+	return nil
+}
+
 func (ss *smShard) Close() error {
+	if ss.closing != nil {
+		close(ss.closing)
+	}
 	ss.mpr.Close()
 
-	ss.trigger.Close()
+	ss.queue.close()
 	ss.lg.Info(
-		"trigger closing",
+		"queue closing",
 		zap.String("service", ss.service),
 	)
 
@@ -213,20 +529,310 @@ func (ss *smShard) Close() error {
 	return nil
 }
 
+// balanceEvent balancePlan 计算出的一批move，对应一个worker事件
+type balanceEvent struct {
+	typ  workerEventType
+	mals moveActionList
+}
+
 // 1 smContainer 的增加/减少是优先级最高，目前可能涉及大量shard move
 // 2 smShard 被漏掉作为container检测的补充，最后校验，这种情况只涉及到漏掉的shard任务下发下去
+// balanceLoop 周期执行balanceChecker，api触发时立即执行，同一时间只有一个balanceChecker在运行，
+// 开启RebalanceDebounce时container变化后等待debounce窗口再执行，窗口内的变化只触发一次
+func (ss *smShard) balanceLoop(ctx context.Context) {
+	timer := time.NewTimer(ss.rebalanceInterval())
+	defer timer.Stop()
+	var debounce <-chan time.Time
+	for {
+		var donec chan error
+		select {
+		case <-timer.C:
+		case <-ss.changec:
+			if d := ss.rebalanceDebounce(); d > 0 && debounce == nil {
+				debounce = time.After(d)
+			}
+			continue
+		case <-debounce:
+		case donec = <-ss.rebalancec:
+		case <-ctx.Done():
+			ss.lg.Info("balanceChecker exit", zap.String("service", ss.service))
+			return
+		}
+		debounce = nil
+		// 间隔通过update-spec修改后，下一个周期生效
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(ss.rebalanceInterval())
+
+		err := ss.balanceChecker(ctx)
+		ss.workerError(err)
+		if err != nil {
+			ss.lg.Error("balanceChecker error", zap.String("service", ss.service), zap.Error(err))
+		}
+		if donec != nil {
+			donec <- err
+		}
+	}
+}
+
+// TriggerRebalance 不等待下一个周期，立即执行一次balanceChecker，move入队后返回
+func (ss *smShard) TriggerRebalance(ctx context.Context) error {
+	if ss.schedulerPaused(ctx) {
+		return errSchedulerPaused
+	}
+	donec := make(chan error, 1)
+	select {
+	case ss.rebalancec <- donec:
+	case <-ss.closing:
+		return errors.New("shard closing")
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "")
+	}
+	select {
+	case err := <-donec:
+		return errors.Wrap(err, "")
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "")
+	}
+}
+
 func (ss *smShard) balanceChecker(ctx context.Context) error {
+	// 全局暂停期间不计算也不下发move，恢复后的下一轮检查补齐
+	if ss.schedulerPaused(ctx) {
+		ss.lg.Warn("scheduler paused, skip balance check", zap.String("service", ss.service))
+		return nil
+	}
+
+	// 过期的shard在balancePlan中已经按照删除处理，这里清理etcd中的配置，冻结时保留
+	if !ss.Frozen() {
+		ss.expireShards(ctx)
+	}
+
+	events, err := ss.balancePlan(ctx)
+	if err != nil {
+		return err
+	}
+	// 清理已经下线的container的熔断记录，dry-run不执行
+	if ss.operator != nil && ss.mpr != nil {
+		ss.operator.breaker.retain(ss.mpr.AliveContainers().KeyMap())
+	}
+
+	// 冻结时只计算不执行，日志中可以看到被跳过的move
+	if ss.Frozen() {
+		for _, be := range events {
+			ss.lg.Warn(
+				"service frozen, skip moves",
+				zap.String("service", ss.service),
+				zap.Reflect("mals", be.mals),
+			)
+		}
+		return nil
+	}
+
+	// 新启动的container分批接收shard，推迟的move下一轮重新计算
+	events = ss.staggerWarmup(events, time.Now())
+
+	// 同一次检查产生的move属于同一轮rebalance
+	if len(events) > 0 {
+		var all moveActionList
+		for _, be := range events {
+			all = append(all, be.mals...)
+		}
+		roundId := ss.rounds.start(all)
+		for _, ma := range all {
+			ma.RoundId = roundId
+		}
+	}
+	for _, be := range events {
+		traceMoves(ctx, ss.service, be.mals)
+		ss.enqueue(be.typ, be.mals)
+	}
+	return nil
+}
+
+// DropAll 删除service之前冻结rebalance，把所有分配出去的shard从container上drop，返回drop失败的shard，
+// 有失败时恢复之前的冻结状态，调用方可以重试
+func (ss *smShard) DropAll(ctx context.Context) ([]string, error) {
+	frozen := ss.Frozen()
+	ss.SetFrozen(true)
+
+	var mals moveActionList
+	for shardId, t := range ss.mpr.AliveShards() {
+		if t.curContainerId == "" {
+			continue
+		}
+		mals = append(mals, &moveAction{Service: ss.service, ShardId: shardId, DropEndpoint: t.curContainerId, Reason: moveReasonManual})
+	}
+
+	var (
+		mu     sync.Mutex
+		failed []string
+	)
+	g := new(errgroup.Group)
+	for _, ma := range mals {
+		ma := ma
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return errors.Wrap(err, "")
+			}
+			if err := ss.operator.dropOrAdd(ma); err != nil {
+				ss.lg.Error(
+					"drop shard error",
+					zap.String("service", ss.service),
+					zap.Reflect("ma", ma),
+					zap.Error(err),
+				)
+				mu.Lock()
+				failed = append(failed, ma.ShardId)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		ss.SetFrozen(frozen)
+		return nil, err
+	}
+	if len(failed) > 0 {
+		ss.SetFrozen(frozen)
+		sort.Strings(failed)
+	}
+	ss.lg.Info(
+		"drop all shards",
+		zap.String("service", ss.service),
+		zap.Int("shards", len(mals)),
+		zap.Strings("failed", failed),
+	)
+	return failed, nil
+}
+
+func (ss *smShard) Requeue(mals moveActionList) {
+	ss.enqueue(workerEventRequeue, mals)
+}
+
+func (ss *smShard) enqueue(typ workerEventType, mals moveActionList) {
+	var draining map[string]struct{}
+	if ss.mpr != nil {
+		draining = ss.mpr.DrainingContainers()
+	}
+	for _, ma := range mals {
+		ma.Reason = classifyMove(typ, ma, draining)
+	}
+	ev := workerTriggerEvent{
+		Service:     ss.service,
+		Type:        typ,
+		EnqueueTime: time.Now().Unix(),
+		Value:       []byte(mals.String()),
+		Priority:    classifyPriority(mals),
+	}
+	ev.TaskKey = ss.persistTask(&ev)
+	ss.put(&ev)
+	ss.lg.Info("event enqueue",
+		zap.String("service", ss.service),
+		zap.Reflect("event", ev),
+	)
+}
+
+// put 和 processEvent 一起维护队列长度
+func (ss *smShard) put(ev *workerTriggerEvent) {
+	// 升级前持久化的task没有优先级，按照其中的move重新计算
+	if ev.Priority == 0 {
+		var mals moveActionList
+		_ = json.Unmarshal(ev.Value, &mals)
+		ev.Priority = classifyPriority(mals)
+	}
+	if ss.queue.put(ev) {
+		atomic.AddInt64(&ss.queued, 1)
+	}
+}
+
+// QueueDepth 等待执行的move任务数量
+func (ss *smShard) QueueDepth() int64 {
+	return atomic.LoadInt64(&ss.queued)
+}
+
+// RebalancePlan 计算当前需要的shard移动，不下发，提供给dry-run接口，
+// 在 dryRunShard 上计算，balancePlan发布的预留、cordon、未分配以及维护窗口的记录都不影响当前的smShard
+func (ss *smShard) RebalancePlan(ctx context.Context) (moveActionList, error) {
+	events, err := ss.dryRunShard().balancePlan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var r moveActionList
+	for _, be := range events {
+		r = append(r, be.mals...)
+	}
+	return r, nil
+}
+
+// dryRunShard balancePlan中会修改的状态使用副本，其他只读的依赖和当前smShard共享
+func (ss *smShard) dryRunShard() *smShard {
+	// appSpec只会被整体替换，副本可以直接引用当前的appSpec
+	appSpec := ss.spec()
+
+	return &smShard{
+		container: ss.container,
+		lg:        ss.lg,
+		stopper:   ss.stopper,
+		service:   ss.service,
+		appSpec:   appSpec,
+		shardSpec: ss.shardSpec,
+		mpr:       ss.mpr,
+		queue:     ss.queue,
+		operator:  ss.operator,
+		prober:    ss.prober,
+		rounds:    ss.rounds,
+		cooldown:  ss.cooldown,
+		warmup:    ss.warmup,
+		closing:   ss.closing,
+
+		unassigned:   ss.UnassignedShards(),
+		reservations: ss.currentReservations(),
+		cordoned:     ss.cordonedContainers(),
+		parker:       ss.parker.clone(),
+	}
+}
+
+// balancePlan 根据存活的container和shard计算需要的move，只计算不执行
+func (ss *smShard) balancePlan(ctx context.Context) ([]*balanceEvent, error) {
 	// 现有存活containers
 	etcdHbContainerIdAndAny := ss.mpr.AliveContainers()
+	// 探测不健康的container不参与分配，上面的shard当作未分配处理
+	unhealthy := ss.unhealthyContainers()
+	for id := range unhealthy {
+		ss.lg.Warn(
+			"unhealthy container excluded",
+			zap.String("service", ss.service),
+			zap.String("containerId", id),
+		)
+		delete(etcdHbContainerIdAndAny, id)
+	}
+	// 准备退出的container不参与分配，上面的shard按照未分配处理，分配到其他container时再从这个container drop
+	draining := ss.mpr.DrainingContainers()
+	for id := range draining {
+		ss.lg.Info(
+			"draining container excluded",
+			zap.String("service", ss.service),
+			zap.String("containerId", id),
+		)
+		delete(etcdHbContainerIdAndAny, id)
+	}
+	ss.applyDeploymentPolicy(etcdHbContainerIdAndAny, draining)
 	// 没有存活的container，不需要做shard移动
 	if len(etcdHbContainerIdAndAny) == 0 {
 		ss.lg.Warn(
 			"no survive container",
 			zap.String("service", ss.service),
 		)
-		return nil
+		return nil, nil
 	}
 
+	var events []*balanceEvent
+
 	groups := make(map[string]*balancerGroup)
 
 	// 获取当前所有shard配置
@@ -237,32 +843,65 @@ func (ss *smShard) balanceChecker(ctx context.Context) error {
 	shardKey := ss.container.nodeManager.nodeServiceShard(ss.service, "")
 	etcdShardIdAndAny, err = ss.container.Client.GetKVs(ctx, shardKey)
 	if err != nil {
-		return errors.Wrap(err, "")
+		return nil, errors.Wrap(err, "")
 	}
 	// 支持手动指定container
 	shardIdAndGroup := make(ArmorMap)
 	// 提供给 moveAction，做内容下发，防止sdk再次获取，sdk不会有sm空间的访问权限
 	shardIdAndShardSpec := make(map[string]*apputil.ShardSpec)
-	for id, value := range etcdShardIdAndAny {
-		var ss apputil.ShardSpec
-		if err := json.Unmarshal([]byte(value), &ss); err != nil {
-			return errors.Wrap(err, "")
+	now := time.Now()
+	for shardId, value := range etcdShardIdAndAny {
+		var spec apputil.ShardSpec
+		if err := json.Unmarshal([]byte(value), &spec); err != nil {
+			return nil, errors.Wrap(err, "")
 		}
-		shardIdAndShardSpec[id] = &ss
-
-		// 按照group聚合
-		bg := groups[ss.Group]
-		if bg == nil {
-			groups[ss.Group] = newBalanceGroup()
+		// 过期的shard和删除的shard一样，存活的副本会被drop
+		if spec.Expired(now) {
+			delete(etcdShardIdAndAny, shardId)
+			continue
 		}
-		groups[ss.Group].fixShardIdAndManualContainerId[id] = ss.ManualContainerId
 
-		// 建立index
-		shardIdAndGroup[id] = ss.Group
+		// 开启副本的shard，每个副本作为独立的shard参与分配
+		for id, ss := range expandReplicas(shardId, &spec) {
+			shardIdAndShardSpec[id] = ss
+
+			// 按照group聚合
+			bg := groups[ss.Group]
+			if bg == nil {
+				groups[ss.Group] = newBalanceGroup()
+			}
+			groups[ss.Group].fixShardIdAndManualContainerId[id] = ss.ManualContainerId
+
+			// 建立index
+			shardIdAndGroup[id] = ss.Group
+		}
 	}
 
 	// 获取当前存活shard，存活shard的container分配关系如果命中可以不生产moveAction
 	etcdHbShardIdAndValue := ss.mpr.AliveShards()
+	applyReportedCosts(shardIdAndShardSpec, etcdHbShardIdAndValue)
+	// 按照当前的分配统计预留的资源，分配过程中排除剩余资源不足的container，最后再按照drop和add的顺序拒绝超卖的move
+	reservations := newReservationLedger(ss.mpr.ContainerResources(), etcdHbShardIdAndValue, shardIdAndShardSpec)
+	ss.setReservations(reservations)
+	admission := reservations.clone()
+	drainFrom := make(map[string]string)
+	for shardId, value := range etcdHbShardIdAndValue {
+		if _, ok := unhealthy[value.curContainerId]; ok {
+			delete(etcdHbShardIdAndValue, shardId)
+		}
+		if _, ok := draining[value.curContainerId]; ok {
+			// 删除的shard在下面直接从draining container上drop
+			if _, ok := shardIdAndShardSpec[shardId]; ok {
+				drainFrom[shardId] = value.curContainerId
+				delete(etcdHbShardIdAndValue, shardId)
+			}
+		}
+	}
+
+	// 维护窗口内，重启中的container上的shard不分配，container回来后回到原来的container
+	if err := ss.park(ctx, groups, shardIdAndShardSpec, etcdHbContainerIdAndAny, etcdHbShardIdAndValue); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
 	for shardId, value := range etcdHbShardIdAndValue {
 		group, ok := shardIdAndGroup[shardId]
 		if !ok {
@@ -276,12 +915,18 @@ func (ss *smShard) balanceChecker(ctx context.Context) error {
 		// shard配置中存在group
 		groups[group].hbShardIdAndContainerId[shardId] = value.curContainerId
 	}
+	ss.holdCooling(groups, etcdHbContainerIdAndAny, etcdHbShardIdAndValue, shardIdAndGroup)
+	ss.holdOutsideWindow(groups, etcdHbContainerIdAndAny, etcdHbShardIdAndValue, shardIdAndGroup)
+	// cordon的container保留现有shard，不再接收新的shard
+	if err := ss.holdCordoned(ctx, groups, etcdHbContainerIdAndAny, etcdHbShardIdAndValue, shardIdAndGroup); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
 
 	// shard被清除的场景，从rebalance方法中提前到这里，应对完全不配置shard，且sdk本地存活的场景
 	// 提取需要被移除的shard
 	var mals moveActionList
 	for hbShardId, value := range etcdHbShardIdAndValue {
-		if _, ok := etcdShardIdAndAny[hbShardId]; !ok {
+		if _, ok := shardIdAndShardSpec[hbShardId]; !ok {
 			mals = append(
 				mals,
 				&moveAction{
@@ -294,17 +939,7 @@ func (ss *smShard) balanceChecker(ctx context.Context) error {
 		}
 	}
 	if len(mals) > 0 {
-		ev := workerTriggerEvent{
-			Service:     ss.service,
-			Type:        workerEventShardChanged,
-			EnqueueTime: time.Now().Unix(),
-			Value:       []byte(mals.String()),
-		}
-		_ = ss.trigger.Put(&evtrigger.TriggerEvent{Key: workerTrigger, Value: &ev})
-		ss.lg.Info("delete shard event enqueue",
-			zap.String("service", ss.service),
-			zap.Reflect("event", ev),
-		)
+		events = append(events, &balanceEvent{typ: workerEventShardChanged, mals: mals})
 	}
 	if len(etcdShardIdAndAny) == 0 {
 		ss.lg.Info(
@@ -312,103 +947,182 @@ func (ss *smShard) balanceChecker(ctx context.Context) error {
 			zap.String("service", ss.service),
 			zap.Reflect("mals", mals),
 		)
-		return nil
+		return events, nil
 	}
 
 	// 增加阈值限制，防止单进程过载导致雪崩
-	maxHold := ss.maxHold(len(etcdHbContainerIdAndAny), len(etcdShardIdAndAny))
-	if maxHold > ss.appSpec.MaxShardCount {
+	// 设置了MaxShardsPerContainer时，超出上限的shard不分配，不需要整体拒绝
+	maxHold := ss.maxHold(len(etcdHbContainerIdAndAny), len(shardIdAndShardSpec))
+	if ss.maxShardsPerContainer() <= 0 && maxHold > ss.spec().MaxShardCount {
 		err := errors.New("MaxShardCount exceeded")
 		ss.lg.Error(
 			err.Error(),
 			zap.String("service", ss.service),
 			zap.Int("maxHold", maxHold),
 			zap.Int("containerCnt", len(etcdHbContainerIdAndAny)),
-			zap.Int("shardCnt", len(etcdShardIdAndAny)),
+			zap.Int("shardCnt", len(shardIdAndShardSpec)),
 			zap.Error(err),
 		)
-		return err
+		return nil, err
 	}
 
-	// 现存shard的分配
-	for group, bg := range groups {
-		hbContainerIds := etcdHbContainerIdAndAny.KeyList()
-		fixShardIds := bg.fixShardIdAndManualContainerId.KeyList()
-		hbShardIds := bg.hbShardIdAndContainerId.KeyList()
-		// 没有存活分片，且没有分片待分配
-		if len(fixShardIds) == 0 && len(hbShardIds) == 0 {
+	// 记录没有分配出去的shard
+	var unassigned []string
+	defer func() {
+		ss.setRefused(reservations, admission.refused)
+		sort.Strings(unassigned)
+		ss.unassignedMu.Lock()
+		ss.unassigned = unassigned
+		ss.unassignedMu.Unlock()
+		if len(unassigned) > 0 {
 			ss.lg.Warn(
-				"no survive shard",
-				zap.String("group", group),
+				"unassigned shards",
 				zap.String("service", ss.service),
+				zap.Strings("unassigned", unassigned),
 			)
-			continue
 		}
+	}()
 
-		containerChanged := ss.changed(hbContainerIds, bg.hbShardIdAndContainerId.ValueList())
-		shardChanged := ss.changed(fixShardIds, hbShardIds)
-		if !containerChanged && !shardChanged {
-			// 需要探测是否有某个container过载，即超过应该容纳的shard数量
-			var exist bool
-			maxHold := ss.maxHold(len(hbContainerIds), len(fixShardIds))
-			kv := bg.hbShardIdAndContainerId.SwapKV()
-			for _, shardIds := range kv {
-				if len(shardIds) > maxHold {
-					exist = true
-					break
-				}
-			}
-			if !exist {
-				continue
-			}
+	// 现存shard的分配
+	for group, bg := range groups {
+		typ, r, planned := ss.planGroup(group, bg, etcdHbContainerIdAndAny, shardIdAndShardSpec)
+		if !planned {
+			continue
+		}
+		withDrainEndpoints(r, drainFrom)
+		r = admission.admit(ss.lg, ss.service, r)
+		unassigned = append(unassigned, unassignedShards(bg, r)...)
+		if len(r) > 0 {
+			events = append(events, &balanceEvent{typ: typ, mals: r})
 		}
+	}
+	return events, nil
+}
 
-		ss.lg.Info(
-			"changed",
+// planGroup 计算一个group需要的move，group没有变化并且已经均衡时planned为false，balancePlan和sm-sim共用
+func (ss *smShard) planGroup(group string, bg *balancerGroup, etcdHbContainerIdAndAny ArmorMap, shardIdAndShardSpec map[string]*apputil.ShardSpec) (workerEventType, moveActionList, bool) {
+	hbContainerIds := etcdHbContainerIdAndAny.KeyList()
+	fixShardIds := bg.fixShardIdAndManualContainerId.KeyList()
+	hbShardIds := bg.hbShardIdAndContainerId.KeyList()
+	// 没有存活分片，且没有分片待分配
+	if len(fixShardIds) == 0 && len(hbShardIds) == 0 {
+		ss.lg.Warn(
+			"no survive shard",
 			zap.String("group", group),
 			zap.String("service", ss.service),
-			zap.Bool("containerChanged", containerChanged),
-			zap.Bool("shardChanged", shardChanged),
 		)
+		return 0, nil, false
+	}
 
-		// 需要保证在变更的情况下是有container可以接受分配的
-		if len(etcdHbContainerIdAndAny) == 0 {
-			continue
-		}
-		var typ workerEventType
+	containerChanged := ss.changed(hbContainerIds, bg.hbShardIdAndContainerId.ValueList())
+	shardChanged := ss.changed(fixShardIds, hbShardIds)
+
+	// binpack的结果由capacity和loadEstimate决定，数量上的均衡检查不适用，直接计算，没有move说明已经均衡
+	if ss.binpacking() {
+		typ := workerEventShardChanged
 		if containerChanged {
 			typ = workerEventContainerChanged
-		} else {
-			typ = workerEventShardChanged
 		}
-
-		r := ss.rebalance(bg.fixShardIdAndManualContainerId, etcdHbContainerIdAndAny, bg.hbShardIdAndContainerId, shardIdAndShardSpec)
+		r := ss.binpack(bg.fixShardIdAndManualContainerId, etcdHbContainerIdAndAny, bg.hbShardIdAndContainerId, shardIdAndShardSpec, ss.mpr.ContainerCapacities())
 		if len(r) > 0 {
-			ev := workerTriggerEvent{
-				Service:     ss.service,
-				Type:        typ,
-				EnqueueTime: time.Now().Unix(),
-				Value:       []byte(r.String()),
-			}
-			_ = ss.trigger.Put(&evtrigger.TriggerEvent{Key: workerTrigger, Value: &ev})
-			ss.lg.Info("event enqueue",
+			ss.lg.Info(
+				"binpack changed",
+				zap.String("group", group),
 				zap.String("service", ss.service),
-				zap.Reflect("event", ev),
+				zap.Bool("containerChanged", containerChanged),
+				zap.Bool("shardChanged", shardChanged),
 			)
-			continue
 		}
-		// 当survive的container为nil的时候，不能形成有效的分配，直接返回即可
-		ss.lg.Warn("can not rebalance",
-			zap.String("service", ss.service),
-			zap.Bool("container-changed", containerChanged),
-			zap.Bool("shard-changed", shardChanged),
-			zap.String("group", group),
-			zap.Reflect("shardIdAndManualContainerId", bg.fixShardIdAndManualContainerId),
-			zap.Strings("etcdHbContainerIds", etcdHbContainerIdAndAny.KeyList()),
-			zap.Reflect("hbShardIdAndContainerId", bg.hbShardIdAndContainerId),
-		)
+		return typ, r, true
 	}
-	return nil
+
+	if !containerChanged && !shardChanged {
+		// 需要探测是否有某个container过载，即超过应该容纳的shard数量
+		var exist bool
+		// 设置weight时按照weight之和检查
+		weightOf := weightOf(shardIdAndShardSpec)
+		kv := bg.hbShardIdAndContainerId.SwapKV()
+		// cordon的container和上面的shard不参与均衡检查
+		cordoned := ss.cordonedContainers()
+		containerCnt := len(hbContainerIds)
+		weight := totalWeight(fixShardIds, weightOf)
+		for containerId := range cordoned {
+			if _, ok := etcdHbContainerIdAndAny[containerId]; ok {
+				containerCnt--
+				weight -= totalWeight(kv[containerId], weightOf)
+			}
+		}
+		if containerCnt == 0 {
+			return 0, nil, false
+		}
+		maxHold := ss.maxHold(containerCnt, weight)
+		// minimize movement模式下，container持有的shard数量低于平均值也需要rebalance
+		minHold := weight / containerCnt
+		for containerId, shardIds := range kv {
+			if _, ok := cordoned[containerId]; ok {
+				continue
+			}
+			if overweight(shardIds, weightOf, maxHold) {
+				exist = true
+				break
+			}
+			if ss.minimizeMovement() && totalWeight(shardIds, weightOf) < minHold {
+				exist = true
+				break
+			}
+			// 同一个shard的副本不能在同一个container上
+			if replicaConflicted(shardIds) {
+				exist = true
+				break
+			}
+		}
+		// 同一个shard的副本需要分散到不同的zone
+		if !exist && ss.spreadByZone() && zoneConflicted(bg, etcdHbContainerIdAndAny) {
+			exist = true
+		}
+		// container的属性变化后，已经分配的shard不再满足placement约束
+		if !exist && len(ss.constraintFilter(shardIdAndShardSpec).violated(bg.hbShardIdAndContainerId, bg.fixShardIdAndManualContainerId)) > 0 {
+			exist = true
+		}
+		if !exist {
+			return 0, nil, false
+		}
+	}
+
+	ss.lg.Info(
+		"changed",
+		zap.String("group", group),
+		zap.String("service", ss.service),
+		zap.Bool("containerChanged", containerChanged),
+		zap.Bool("shardChanged", shardChanged),
+	)
+
+	// 需要保证在变更的情况下是有container可以接受分配的
+	if len(etcdHbContainerIdAndAny) == 0 {
+		return 0, nil, false
+	}
+	var typ workerEventType
+	if containerChanged {
+		typ = workerEventContainerChanged
+	} else {
+		typ = workerEventShardChanged
+	}
+
+	r := ss.rebalance(bg.fixShardIdAndManualContainerId, etcdHbContainerIdAndAny, bg.hbShardIdAndContainerId, shardIdAndShardSpec)
+	if len(r) > 0 {
+		return typ, r, true
+	}
+	// 当survive的container为nil的时候，不能形成有效的分配，直接返回即可
+	ss.lg.Warn("can not rebalance",
+		zap.String("service", ss.service),
+		zap.Bool("container-changed", containerChanged),
+		zap.Bool("shard-changed", shardChanged),
+		zap.String("group", group),
+		zap.Reflect("shardIdAndManualContainerId", bg.fixShardIdAndManualContainerId),
+		zap.Strings("etcdHbContainerIds", etcdHbContainerIdAndAny.KeyList()),
+		zap.Reflect("hbShardIdAndContainerId", bg.hbShardIdAndContainerId),
+	)
+	return typ, r, true
 }
 
 func (ss *smShard) changed(a []string, b []string) bool {
@@ -439,10 +1153,20 @@ func (ss *smShard) rebalance(fixShardIdAndManualContainerId ArmorMap, hbContaine
 		adding []string
 
 		br = &balancer{
-			bcs: make(map[string]*balancerContainer),
+			bcs:    make(map[string]*balancerContainer),
+			filter: ss.constraintFilter(shardIdAndShardSpec),
+			costOf: costOf(shardIdAndShardSpec),
 		}
 	)
 
+	priorityOf := func(shardId string) int {
+		if spec := shardIdAndShardSpec[shardId]; spec != nil {
+			return spec.Priority
+		}
+		return 0
+	}
+	weightOf := weightOf(shardIdAndShardSpec)
+
 	// 构建container和shard的关系
 	for fixShardId, manualContainerId := range fixShardIdAndManualContainerId {
 		// 不在container上，可能是新增，确定需要被分配
@@ -461,7 +1185,7 @@ func (ss *smShard) rebalance(fixShardIdAndManualContainerId ArmorMap, hbContaine
 				)
 
 				// 确定的指令，要对当前的csm有影响
-				br.put(manualContainerId, fixShardId, true)
+				br.put(manualContainerId, fixShardId, true, priorityOf(fixShardId), weightOf(fixShardId))
 			} else {
 				adding = append(adding, fixShardId)
 			}
@@ -484,15 +1208,22 @@ func (ss *smShard) rebalance(fixShardIdAndManualContainerId ArmorMap, hbContaine
 				)
 
 				// 确定的指令，要对当前的csm有影响
-				br.put(manualContainerId, fixShardId, true)
+				br.put(manualContainerId, fixShardId, true, priorityOf(fixShardId), weightOf(fixShardId))
 			} else {
 				// 命中manual是不能被移动的
-				br.put(currentContainerId, fixShardId, true)
+				br.put(currentContainerId, fixShardId, true, priorityOf(fixShardId), weightOf(fixShardId))
 			}
 			continue
 		}
 
-		br.put(currentContainerId, fixShardId, false)
+		// cordon的container上的shard保持不动
+		br.put(currentContainerId, fixShardId, br.filter.cordonedContainer(currentContainerId), priorityOf(fixShardId), weightOf(fixShardId))
+	}
+
+	// unassigned 不在任何container上的shard，优先分配到声明的preferred container
+	unassigned := make(map[string]struct{})
+	for _, shardId := range adding {
+		unassigned[shardId] = struct{}{}
 	}
 
 	// 处理新增container
@@ -502,82 +1233,266 @@ func (ss *smShard) rebalance(fixShardIdAndManualContainerId ArmorMap, hbContaine
 			br.addContainer(hbContainerId)
 		}
 	}
+	br.setZones(hbContainerIdAndAny)
 
 	shardLen := len(fixShardIdAndManualContainerId)
 	containerLen := len(hbContainerIdAndAny)
+	// weightLen 均衡按照weight计算，没有设置weight时等于shardLen
+	weightLen := totalWeight(fixShardIdAndManualContainerId.KeyList(), weightOf)
+	// cordon的container上的shard固定不动，container和shard都不参与均衡计算
+	for containerId := range hbContainerIdAndAny {
+		if bc, ok := br.bcs[containerId]; ok && br.filter.cordonedContainer(containerId) {
+			containerLen--
+			shardLen -= len(bc.shards)
+			weightLen -= bc.load()
+		}
+	}
+
+	// container容量不足时，已经分配的低优先级shard需要移走，给等待分配的高优先级shard腾出位置，
+	// 等待分配的shard按照优先级从高到低分配，分配不下的低优先级shard保持未分配状态
+	if limit := ss.maxShardsPerContainer(); limit > 0 && shardLen > limit*containerLen {
+		for shardId, containerId := range evictShards(br, adding, priorityOf, limit*containerLen) {
+			delete(br.bcs[containerId].shards, shardId)
+			mals = append(
+				mals,
+				&moveAction{
+					Service:      ss.service,
+					ShardId:      shardId,
+					DropEndpoint: containerId,
+				},
+			)
+			shardLen--
+			weightLen -= weightOf(shardId)
+			ss.lg.Warn(
+				"low priority shard evicted",
+				zap.String("service", ss.service),
+				zap.String("shardId", shardId),
+				zap.String("containerId", containerId),
+			)
+		}
+	}
+
+	// 每个container最少包含多少shard，设置weight时为weight之和
+	maxHold := ss.maxHold(containerLen, weightLen)
+
+	// limitQuota 不能超过service配置的单container上限
+	limitQuota := func(q func(bc *balancerContainer) int) func(bc *balancerContainer) int {
+		limit := ss.maxShardsPerContainer()
+		if limit <= 0 {
+			return q
+		}
+		return func(bc *balancerContainer) int {
+			if v := q(bc); v < limit {
+				return v
+			}
+			return limit
+		}
+	}
 
-	// 每个container最少包含多少shard
-	maxHold := ss.maxHold(containerLen, shardLen)
+	// quota 每个container均衡后可以持有的shard数量，默认都按照maxHold计算
+	quota := limitQuota(func(bc *balancerContainer) int { return maxHold })
+	visit := br.forEach
+	if ss.minimizeMovement() {
+		targets := ss.stickyTargets(br, weightLen)
+		quota = limitQuota(func(bc *balancerContainer) int { return targets[bc.id] })
+		// 保证每轮计算结果稳定，防止相同的状态下产生不同的move
+		visit = br.forEachSorted
+	}
 
 	dropFroms := make(map[string]string)
+
+	// 不满足placement约束的shard需要重新分配，例如container的label或者负载发生变化
+	visit(func(bc *balancerContainer) {
+		for _, bs := range bc.sortedShards() {
+			if !bs.isManual && !br.allowed(bc, bs.id) {
+				dropFroms[bs.id] = bc.id
+				delete(bc.shards, bs.id)
+			}
+		}
+	})
+
+	// 同一个shard的多个副本在同一个container上，多余的副本需要重新分配
+	visit(func(bc *balancerContainer) {
+		for _, bs := range bc.replicaConflicts() {
+			dropFroms[bs.id] = bc.id
+			delete(bc.shards, bs.id)
+		}
+	})
+
+	// 同一个shard的多个副本在同一个zone，并且有其他zone可以接收，多余的副本需要重新分配
+	if ss.spreadByZone() {
+		for shardId, containerId := range br.zoneConflicts() {
+			dropFroms[shardId] = containerId
+			delete(br.bcs[containerId].shards, shardId)
+		}
+	}
+
 	getDrops := func(bc *balancerContainer) {
-		dropCnt := len(bc.shards) - maxHold
+		dropCnt := bc.load() - quota(bc)
 		if dropCnt <= 0 {
 			return
 		}
 
-		for _, bs := range bc.shards {
-			// 不能变动的shard
-			if bs.isManual {
+		for _, bs := range bc.sortedShards() {
+			// 不能变动的shard，weight超过需要移走的部分的shard移走后也不能均衡
+			if bs.isManual || bs.weight > dropCnt {
 				continue
 			}
 			dropFroms[bs.id] = bc.id
 			delete(bc.shards, bs.id)
-			dropCnt--
+			dropCnt -= bs.weight
 			if dropCnt == 0 {
 				break
 			}
 		}
 	}
-	br.forEach(getDrops)
+	visit(getDrops)
 
-	// 可以移动的shard，补充到待分配中
+	// 可以移动的shard，补充到待分配中，优先级高的shard先分配，相同优先级weight大的shard先分配
 	for drop := range dropFroms {
 		adding = append(adding, drop)
 	}
+	sort.Slice(adding, func(i, j int) bool {
+		if pi, pj := priorityOf(adding[i]), priorityOf(adding[j]); pi != pj {
+			return pi > pj
+		}
+		if wi, wj := weightOf(adding[i]), weightOf(adding[j]); wi != wj {
+			return wi > wj
+		}
+		return adding[i] < adding[j]
+	})
 	if len(adding) > 0 {
+		place := func(bc *balancerContainer, shardId string) {
+			bc.shards[shardId] = &balancerShard{id: shardId, priority: priorityOf(shardId), weight: weightOf(shardId), cost: br.cost(shardId)}
+
+			spec := shardIdAndShardSpec[shardId]
+			from, ok := dropFroms[shardId]
+			if ok {
+				// 回到原来的container，不需要移动
+				if from == bc.id {
+					return
+				}
+				mals = append(
+					mals,
+					&moveAction{
+						Service:      ss.service,
+						ShardId:      shardId,
+						DropEndpoint: from,
+						AddEndpoint:  bc.id,
+						Spec:         spec,
+					},
+				)
+				return
+			}
+			mals = append(
+				mals,
+				&moveAction{
+					Service:     ss.service,
+					ShardId:     shardId,
+					AddEndpoint: bc.id,
+					Spec:        spec,
+				},
+			)
+		}
+
 		add := func(bc *balancerContainer) {
-			addCnt := maxHold - len(bc.shards)
+			addCnt := quota(bc) - bc.load()
 			if addCnt <= 0 {
 				return
 			}
 
-			idx := 0
-			for {
-				if idx == addCnt || idx == len(adding) {
-					break
+			var rest []string
+			for _, shardId := range adding {
+				// 同一个shard的副本不能分配到同一个container，不满足placement约束的container跳过
+				if weightOf(shardId) > addCnt || bc.hasReplica(shardId) || !br.allowed(bc, shardId) {
+					rest = append(rest, shardId)
+					continue
 				}
-
-				shardId := adding[idx]
-				spec := shardIdAndShardSpec[shardId]
-				from, ok := dropFroms[shardId]
-				if ok {
-					mals = append(
-						mals,
-						&moveAction{
-							Service:      ss.service,
-							ShardId:      adding[idx],
-							DropEndpoint: from,
-							AddEndpoint:  bc.id,
-							Spec:         spec,
-						},
-					)
-				} else {
-					mals = append(
-						mals,
-						&moveAction{
-							Service:     ss.service,
-							ShardId:     adding[idx],
-							AddEndpoint: bc.id,
-							Spec:        spec,
-						},
-					)
+				place(bc, shardId)
+				addCnt -= weightOf(shardId)
+			}
+			adding = rest
+		}
+		// 故障转移的shard按照声明的顺序尝试preferred container，都不能接收时走通用的分配
+		var rest []string
+		for _, shardId := range adding {
+			if _, ok := unassigned[shardId]; ok {
+				if spec := shardIdAndShardSpec[shardId]; spec != nil && len(spec.PreferredContainers) > 0 {
+					if bc := br.preferredContainer(shardId, spec.PreferredContainers, quota); bc != nil {
+						place(bc, shardId)
+						continue
+					}
 				}
-				idx++
 			}
-			adding = adding[idx:]
+			rest = append(rest, shardId)
+		}
+		adding = rest
+
+		assign := func() { visit(add) }
+		if ss.spreadByZone() {
+			// zone策略下以shard为单位选择container
+			assign = func() {
+				// quota在本轮分配开始时确定，防止按照len(bc.shards)计算的quota随分配增长
+				limits := make(map[string]int)
+				br.forEach(func(bc *balancerContainer) { limits[bc.id] = quota(bc) })
+				limit := func(bc *balancerContainer) int { return limits[bc.id] }
+
+				var rest []string
+				for _, shardId := range adding {
+					bc := br.pickContainer(shardId, dropFroms[shardId], limit)
+					if bc == nil {
+						rest = append(rest, shardId)
+						continue
+					}
+					place(bc, shardId)
+				}
+				adding = rest
+			}
+		} else if weighted(fixShardIdAndManualContainerId.KeyList(), weightOf) {
+			// weight不同的shard按照数量填充container会导致weight不均衡，按照weight从大到小逐个放到weight之和最小的container
+			assign = func() {
+				var rest []string
+				for _, shardId := range adding {
+					bc := br.lightest(shardId, weightOf(shardId), ss.maxShardsPerContainer())
+					if bc == nil {
+						rest = append(rest, shardId)
+						continue
+					}
+					place(bc, shardId)
+				}
+				adding = rest
+			}
+		}
+		assign()
+
+		// 副本的限制导致部分shard按照quota分配不出去，每轮给每个container多分配一个，直到无法分配
+		for len(adding) > 0 {
+			remain := len(adding)
+			quota = limitQuota(func(bc *balancerContainer) int { return bc.load() + 1 })
+			assign()
+			if len(adding) == remain {
+				ss.lg.Warn(
+					"not enough container for shards",
+					zap.String("service", ss.service),
+					zap.Strings("adding", adding),
+				)
+				break
+			}
+		}
+	}
+
+	// 没有分配出去的shard，如果是从container上移走的，需要下发drop
+	for _, shardId := range adding {
+		if from, ok := dropFroms[shardId]; ok {
+			mals = append(
+				mals,
+				&moveAction{
+					Service:      ss.service,
+					ShardId:      shardId,
+					DropEndpoint: from,
+				},
+			)
 		}
-		br.forEach(add)
 	}
 
 	ss.lg.Info(
@@ -591,6 +1506,123 @@ func (ss *smShard) rebalance(fixShardIdAndManualContainerId ArmorMap, hbContaine
 	return mals
 }
 
+// evictShards 容量为capacity时，找出需要给等待分配的高优先级shard让位的已分配shard，manual shard不参与，
+// 只有优先级严格更低时才移动，返回shard到所在container的映射
+func evictShards(br *balancer, adding []string, priorityOf func(shardId string) int, capacity int) map[string]string {
+	type assigned struct {
+		shardId     string
+		containerId string
+		priority    int
+	}
+	var (
+		candidates []*assigned
+		used       int
+	)
+	br.forEach(func(bc *balancerContainer) {
+		for _, bs := range bc.shards {
+			used++
+			if bs.isManual {
+				continue
+			}
+			candidates = append(candidates, &assigned{shardId: bs.id, containerId: bc.id, priority: bs.priority})
+		}
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+		return candidates[i].shardId > candidates[j].shardId
+	})
+
+	waiting := make([]string, len(adding))
+	copy(waiting, adding)
+	sort.Slice(waiting, func(i, j int) bool {
+		if pi, pj := priorityOf(waiting[i]), priorityOf(waiting[j]); pi != pj {
+			return pi > pj
+		}
+		return waiting[i] < waiting[j]
+	})
+	free := capacity - used
+	if free < 0 {
+		free = 0
+	}
+	if free >= len(waiting) {
+		return nil
+	}
+
+	r := make(map[string]string)
+	for _, shardId := range waiting[free:] {
+		if len(candidates) == 0 || candidates[0].priority >= priorityOf(shardId) {
+			break
+		}
+		r[candidates[0].shardId] = candidates[0].containerId
+		candidates = candidates[1:]
+	}
+	return r
+}
+
+// unassignedShards 根据rebalance的结果计算group中没有分配的shard
+// withDrainEndpoints 分配到其他container的shard需要从draining container上drop，保证同一时间只有一个container持有shard，
+// 没有分配出去的shard继续留在draining container上
+func withDrainEndpoints(mals moveActionList, drainFrom map[string]string) {
+	for _, ma := range mals {
+		if ma.DropEndpoint == "" && ma.AddEndpoint != "" {
+			ma.DropEndpoint = drainFrom[ma.ShardId]
+		}
+	}
+}
+
+func unassignedShards(bg *balancerGroup, mals moveActionList) []string {
+	unassigned := make(map[string]struct{})
+	for shardId := range bg.fixShardIdAndManualContainerId {
+		if _, ok := bg.hbShardIdAndContainerId[shardId]; !ok {
+			unassigned[shardId] = struct{}{}
+		}
+	}
+	for _, ma := range mals {
+		if ma.AddEndpoint != "" {
+			delete(unassigned, ma.ShardId)
+		} else if ma.DropEndpoint != "" {
+			unassigned[ma.ShardId] = struct{}{}
+		}
+	}
+	var r []string
+	for shardId := range unassigned {
+		r = append(r, shardId)
+	}
+	return r
+}
+
+// expandReplicas 开启副本的shard展开成多个独立分配的shard，
+// secondary不继承ManualContainerId，防止和primary分配到同一个container
+func expandReplicas(shardId string, spec *apputil.ShardSpec) map[string]*apputil.ShardSpec {
+	r := map[string]*apputil.ShardSpec{shardId: spec}
+	if spec.ReplicaCount <= 1 {
+		return r
+	}
+	spec.Id = shardId
+	for i := 1; i < spec.ReplicaCount; i++ {
+		replica := *spec
+		replica.Replica = i
+		replica.ManualContainerId = ""
+		r[apputil.ReplicaShardId(shardId, i)] = &replica
+	}
+	return r
+}
+
+// replicaConflicted 判断container上是否有同一个shard的多个副本
+func replicaConflicted(shardIds []string) bool {
+	seen := make(map[string]struct{})
+	for _, id := range shardIds {
+		shardId, _ := apputil.ParseReplicaShardId(id)
+		if _, ok := seen[shardId]; ok {
+			return true
+		}
+		seen[shardId] = struct{}{}
+	}
+	return false
+}
+
 func (ss *smShard) maxHold(containerCnt, shardCnt int) int {
 	if containerCnt == 0 {
 		// 不做过滤
@@ -607,13 +1639,59 @@ func (ss *smShard) maxHold(containerCnt, shardCnt int) int {
 	return r
 }
 
+// stickyTargets 计算minimize movement模式下每个container均衡后持有的shard数量，
+// 均衡后container持有base或者base+1个shard，当前持有shard较多的container优先获得base+1的名额，减少shard移动
+func (ss *smShard) stickyTargets(br *balancer, shardCnt int) map[string]int {
+	targets := make(map[string]int)
+	var bcs []*balancerContainer
+	br.forEachSorted(func(bc *balancerContainer) {
+		// cordon的container不接收shard
+		if !br.filter.cordonedContainer(bc.id) {
+			bcs = append(bcs, bc)
+		}
+	})
+	if len(bcs) == 0 {
+		return targets
+	}
+	base := shardCnt / len(bcs)
+	extra := shardCnt % len(bcs)
+	sort.SliceStable(bcs, func(i, j int) bool {
+		return bcs[i].load() > bcs[j].load()
+	})
+	for _, bc := range bcs {
+		targets[bc.id] = base
+		if extra > 0 && bc.load() > base {
+			targets[bc.id]++
+			extra--
+		}
+	}
+	// 剩余的base+1名额分配给shard不足的container
+	for _, bc := range bcs {
+		if extra == 0 {
+			break
+		}
+		if targets[bc.id] == base {
+			targets[bc.id]++
+			extra--
+		}
+	}
+	return targets
+}
+
 func (ss *smShard) processEvent(key string, value interface{}) error {
 	event := value.(*workerTriggerEvent)
+	// 全局暂停期间move在worker中等待，等待中smShard关闭时保留task，由下一个governor回放
+	if !ss.waitResume() {
+		return errors.New("shard closed while scheduler paused")
+	}
+	atomic.AddInt64(&ss.queued, -1)
 	ss.lg.Info(
 		"event received",
 		zap.String("key", key),
 		zap.Reflect("ev", event),
 	)
+	// move失败的action已经进入dead letter，无论结果如何都不需要再次回放
+	defer ss.finishTask(event.TaskKey)
 
 	var mal moveActionList
 	if err := json.Unmarshal(event.Value, &mal); err != nil {
@@ -633,7 +1711,12 @@ func (ss *smShard) processEvent(key string, value interface{}) error {
 		return nil
 	}
 
-	if err := ss.operator.move(mal); err != nil {
+	// api重新入队的dead letter是人工确认过的move，reconciler的move是修正，都不需要canary
+	move := ss.operator.move
+	if (event.Type == workerEventShardChanged || event.Type == workerEventContainerChanged) && ss.canary() != nil {
+		move = ss.canaryMove
+	}
+	if err := move(mal); err != nil {
 		ss.lg.Error(
 			"move error",
 			zap.String("key", key),
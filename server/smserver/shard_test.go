@@ -16,6 +16,8 @@ package smserver
 
 import (
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -32,7 +34,7 @@ func Test_shardTask(t *testing.T) {
 }
 
 func Test_newMaintenanceWorker(t *testing.T) {
-	ctr, err := newSMContainer(ttLogger, nil)
+	ctr, err := newSMContainer(ttLogger, nil, 0, 0)
 	if err != nil {
 		t.Errorf("err: %+v", err)
 		t.SkipNow()
@@ -212,3 +214,717 @@ func Test_reallocate(t *testing.T) {
 		}
 	}
 }
+
+func Test_rebalance_minimizeMovement(t *testing.T) {
+	service := "foo.bar"
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		expect                         moveActionList
+	}{
+		// 新增container，只移动一个shard恢复均衡
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+				"s4": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+				"c3": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+				"s2": "c1",
+				"s3": "c2",
+				"s4": "c2",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s3", DropEndpoint: "c2", AddEndpoint: "c3"},
+			},
+		},
+
+		// 新增shard，分配给shard最少的container，现有分配不变
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+				"s4": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+				"s2": "c1",
+				"s3": "c2",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s4", AddEndpoint: "c2"},
+			},
+		},
+
+		// 已经均衡，不移动
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+				"s2": "c2",
+				"s3": "c2",
+			},
+			expect: nil,
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{MinimizeMovement: true}}
+
+	for idx, tt := range tests {
+		r := w.rebalance(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, nil)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_rebalance_replica(t *testing.T) {
+	service := "foo.bar"
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		expect                         moveActionList
+	}{
+		// 副本分配到不同的container
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1":   "",
+				"s1#1": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1"},
+				&moveAction{Service: service, ShardId: "s1#1", AddEndpoint: "c2"},
+			},
+		},
+
+		// 副本在同一个container上，需要移走secondary
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1":   "",
+				"s1#1": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1":   "c1",
+				"s1#1": "c1",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1#1", DropEndpoint: "c1", AddEndpoint: "c2"},
+			},
+		},
+
+		// container数量不足，多余的副本不分配
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1":   "",
+				"s1#1": "",
+				"s1#2": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1"},
+				&moveAction{Service: service, ShardId: "s1#1", AddEndpoint: "c2"},
+			},
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{MinimizeMovement: true}}
+
+	for idx, tt := range tests {
+		r := w.rebalance(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, nil)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_expandReplicas(t *testing.T) {
+	spec := apputil.ShardSpec{Service: "foo.bar", ManualContainerId: "c1", ReplicaCount: 2}
+	r := expandReplicas("s1", &spec)
+	if len(r) != 2 {
+		t.Errorf("expect 2 replicas, actual %d", len(r))
+		t.SkipNow()
+	}
+	if !r["s1"].IsPrimary() || r["s1"].ManualContainerId != "c1" {
+		t.Errorf("unexpected primary %s", r["s1"].String())
+	}
+	secondary := r["s1#1"]
+	if secondary.IsPrimary() || secondary.Id != "s1" || secondary.ManualContainerId != "" {
+		t.Errorf("unexpected secondary %s", secondary.String())
+	}
+
+	if !replicaConflicted([]string{"s1", "s2", "s1#1"}) {
+		t.Errorf("expect conflicted")
+	}
+	if replicaConflicted([]string{"s1", "s2#1"}) {
+		t.Errorf("expect not conflicted")
+	}
+}
+
+func Test_rebalance_maxShardsPerContainer(t *testing.T) {
+	service := "foo.bar"
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		expect                         moveActionList
+		unassigned                     []string
+	}{
+		// container不足，超出上限的shard不分配
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1"},
+				&moveAction{Service: service, ShardId: "s2", AddEndpoint: "c1"},
+			},
+			unassigned: []string{"s3"},
+		},
+
+		// container持有的shard超过上限，多出的shard需要drop
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+				"s2": "c1",
+				"s3": "c1",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", DropEndpoint: "c1"},
+			},
+			unassigned: []string{"s1"},
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{MinimizeMovement: true, MaxShardsPerContainer: 2}}
+
+	for idx, tt := range tests {
+		r := w.rebalance(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, nil)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+
+		bg := &balancerGroup{fixShardIdAndManualContainerId: tt.fixShardIdAndManualContainerId, hbShardIdAndContainerId: tt.hbShardIdAndContainerId}
+		if unassigned := unassignedShards(bg, r); !reflect.DeepEqual(unassigned, tt.unassigned) {
+			t.Errorf("idx: %d unexpected unassigned %v", idx, unassigned)
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_rebalance_priority(t *testing.T) {
+	service := "foo.bar"
+	shardIdAndShardSpec := map[string]*apputil.ShardSpec{
+		"s1": {Priority: 2},
+		"s2": {Priority: 0},
+		"s3": {Priority: 1},
+	}
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		expect                         moveActionList
+		unassigned                     []string
+	}{
+		// container不足，优先级高的shard先分配
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1", Spec: shardIdAndShardSpec["s1"]},
+				&moveAction{Service: service, ShardId: "s3", AddEndpoint: "c1", Spec: shardIdAndShardSpec["s3"]},
+			},
+			unassigned: []string{"s2"},
+		},
+
+		// 新增shard优先级更高，已经分配的低优先级shard被移走
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+				"s2": "c1",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s2", DropEndpoint: "c1"},
+				&moveAction{Service: service, ShardId: "s3", AddEndpoint: "c1", Spec: shardIdAndShardSpec["s3"]},
+			},
+			unassigned: []string{"s2"},
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{MinimizeMovement: true, MaxShardsPerContainer: 2}}
+
+	for idx, tt := range tests {
+		r := w.rebalance(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, shardIdAndShardSpec)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+
+		bg := &balancerGroup{fixShardIdAndManualContainerId: tt.fixShardIdAndManualContainerId, hbShardIdAndContainerId: tt.hbShardIdAndContainerId}
+		if unassigned := unassignedShards(bg, r); !reflect.DeepEqual(unassigned, tt.unassigned) {
+			t.Errorf("idx: %d unexpected unassigned %v", idx, unassigned)
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_rebalance_weight(t *testing.T) {
+	service := "foo.bar"
+	shardIdAndShardSpec := map[string]*apputil.ShardSpec{
+		"big": {Weight: 10},
+		"s1":  {},
+		"s2":  {},
+		"s3":  {},
+		"s4":  {},
+	}
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		expect                         moveActionList
+	}{
+		// weight为10的shard按照10个shard计算，其余shard都分配到另一个container
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"big": "",
+				"s1":  "",
+				"s2":  "",
+				"s3":  "",
+				"s4":  "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "big", AddEndpoint: "c1", Spec: shardIdAndShardSpec["big"]},
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c2", Spec: shardIdAndShardSpec["s1"]},
+				&moveAction{Service: service, ShardId: "s2", AddEndpoint: "c2", Spec: shardIdAndShardSpec["s2"]},
+				&moveAction{Service: service, ShardId: "s3", AddEndpoint: "c2", Spec: shardIdAndShardSpec["s3"]},
+				&moveAction{Service: service, ShardId: "s4", AddEndpoint: "c2", Spec: shardIdAndShardSpec["s4"]},
+			},
+		},
+
+		// weight超出的container只移走普通shard，weight大的shard移走也不能均衡
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"big": "",
+				"s1":  "",
+				"s2":  "",
+				"s3":  "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"big": "c1",
+				"s1":  "c1",
+				"s2":  "c2",
+				"s3":  "c2",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2", Spec: shardIdAndShardSpec["s1"]},
+			},
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{}}
+
+	for idx, tt := range tests {
+		r := w.rebalance(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, shardIdAndShardSpec)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+	}
+
+	weightOf := weightOf(shardIdAndShardSpec)
+	if overweight([]string{"big"}, weightOf, 7) {
+		t.Error("single shard over maxHold should not be overweight")
+	}
+	if !overweight([]string{"big", "s1"}, weightOf, 7) {
+		t.Error("expect overweight")
+	}
+}
+
+func Test_rebalance_moveCost(t *testing.T) {
+	service := "foo.bar"
+	shardIdAndShardSpec := map[string]*apputil.ShardSpec{
+		"s1": {MoveCost: 100},
+		"s2": {MoveCost: 1},
+		"s3": {MoveCost: 50},
+		"s4": {},
+	}
+	fixShardIdAndManualContainerId := ArmorMap{"s1": "", "s2": "", "s3": "", "s4": ""}
+	hbContainerIdAndAny := ArmorMap{"c1": "", "c2": ""}
+	hbShardIdAndContainerId := ArmorMap{"s1": "c1", "s2": "c1", "s3": "c1", "s4": "c1"}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{}}
+
+	// 移动数量相同的方案中，选择迁移代价最小的shard移走
+	r := w.rebalance(fixShardIdAndManualContainerId, hbContainerIdAndAny, hbShardIdAndContainerId, shardIdAndShardSpec)
+	expect := moveActionList{
+		&moveAction{Service: service, ShardId: "s2", DropEndpoint: "c1", AddEndpoint: "c2", Spec: shardIdAndShardSpec["s2"]},
+		&moveAction{Service: service, ShardId: "s4", DropEndpoint: "c1", AddEndpoint: "c2", Spec: shardIdAndShardSpec["s4"]},
+	}
+	if !reflect.DeepEqual(r, expect) {
+		t.Errorf("actual: %s, expect: %s", r.String(), expect.String())
+	}
+
+	// heartbeat上报的代价覆盖spec中的值
+	applyReportedCosts(shardIdAndShardSpec, map[string]*temporary{"s4": {moveCost: 200}, "s1": {}})
+	if shardIdAndShardSpec["s4"].MoveCost != 200 || shardIdAndShardSpec["s1"].MoveCost != 100 {
+		t.Errorf("unexpected cost %d %d", shardIdAndShardSpec["s4"].MoveCost, shardIdAndShardSpec["s1"].MoveCost)
+	}
+}
+
+func Test_rebalance_cordon(t *testing.T) {
+	service := "foo.bar"
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		expect                         moveActionList
+	}{
+		// cordon的container保留现有shard，新增的shard分配到其他container
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+				"s4": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+				"s2": "c1",
+				"s3": "c1",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s4", AddEndpoint: "c2"},
+			},
+		},
+
+		// cordon的container上的shard不参与均衡计算
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+				"s4": "",
+				"s5": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "",
+				"c2": "",
+				"c3": "",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s2", AddEndpoint: "c2"},
+				&moveAction{Service: service, ShardId: "s3", AddEndpoint: "c2"},
+				&moveAction{Service: service, ShardId: "s4", AddEndpoint: "c3"},
+				&moveAction{Service: service, ShardId: "s5", AddEndpoint: "c3"},
+			},
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{MinimizeMovement: true}, cordoned: map[string]struct{}{"c1": {}}}
+
+	for idx, tt := range tests {
+		r := w.rebalance(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, nil)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_binpack(t *testing.T) {
+	service := "foo.bar"
+	specs := map[string]*apputil.ShardSpec{
+		"s1": {LoadEstimate: 5, Priority: 1},
+		"s2": {LoadEstimate: 5},
+		"s3": {LoadEstimate: 5},
+		"s4": {LoadEstimate: 5},
+		"s5": {LoadEstimate: 5},
+		"s6": {LoadEstimate: 5},
+	}
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		capacities                     map[string]int
+		expect                         moveActionList
+		unassigned                     []string
+	}{
+		// 按照capacity的比例分配，大container承载更多的shard
+		{
+			fixShardIdAndManualContainerId: ArmorMap{"s1": "", "s2": "", "s3": "", "s4": "", "s5": "", "s6": ""},
+			hbContainerIdAndAny:            ArmorMap{"c1": "", "c2": ""},
+			hbShardIdAndContainerId:        ArmorMap{},
+			capacities:                     map[string]int{"c1": 20, "c2": 10},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1", Spec: specs["s1"]},
+				&moveAction{Service: service, ShardId: "s2", AddEndpoint: "c1", Spec: specs["s2"]},
+				&moveAction{Service: service, ShardId: "s3", AddEndpoint: "c2", Spec: specs["s3"]},
+				&moveAction{Service: service, ShardId: "s4", AddEndpoint: "c1", Spec: specs["s4"]},
+				&moveAction{Service: service, ShardId: "s5", AddEndpoint: "c1", Spec: specs["s5"]},
+				&moveAction{Service: service, ShardId: "s6", AddEndpoint: "c2", Spec: specs["s6"]},
+			},
+		},
+
+		// capacity不足时放不下的shard保持未分配
+		{
+			fixShardIdAndManualContainerId: ArmorMap{"s1": "", "s2": "", "s3": ""},
+			hbContainerIdAndAny:            ArmorMap{"c1": ""},
+			hbShardIdAndContainerId:        ArmorMap{},
+			capacities:                     map[string]int{"c1": 10},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1", Spec: specs["s1"]},
+				&moveAction{Service: service, ShardId: "s2", AddEndpoint: "c1", Spec: specs["s2"]},
+			},
+			unassigned: []string{"s3"},
+		},
+
+		// 超过capacity的container移出低优先级的shard，移到有空间的container
+		{
+			fixShardIdAndManualContainerId: ArmorMap{"s1": "", "s2": "", "s3": ""},
+			hbContainerIdAndAny:            ArmorMap{"c1": "", "c2": ""},
+			hbShardIdAndContainerId:        ArmorMap{"s1": "c1", "s2": "c1", "s3": "c1"},
+			capacities:                     map[string]int{"c1": 10, "c2": 10},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s2", DropEndpoint: "c1", AddEndpoint: "c2", Spec: specs["s2"]},
+			},
+		},
+
+		// 已经均衡时不产生move，manual的shard固定在指定container
+		{
+			fixShardIdAndManualContainerId: ArmorMap{"s1": "c2", "s2": "", "s3": ""},
+			hbContainerIdAndAny:            ArmorMap{"c1": "", "c2": ""},
+			hbShardIdAndContainerId:        ArmorMap{"s1": "c2", "s2": "c1", "s3": "c1"},
+			capacities:                     map[string]int{"c1": 20, "c2": 10},
+			expect:                         nil,
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{Assignor: assignorBinpack}}
+
+	for idx, tt := range tests {
+		r := w.binpack(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, specs, tt.capacities)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+
+		bg := &balancerGroup{fixShardIdAndManualContainerId: tt.fixShardIdAndManualContainerId, hbShardIdAndContainerId: tt.hbShardIdAndContainerId}
+		if unassigned := unassignedShards(bg, r); !reflect.DeepEqual(unassigned, tt.unassigned) {
+			t.Errorf("idx: %d unexpected unassigned %v", idx, unassigned)
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_withDrainEndpoints(t *testing.T) {
+	mals := moveActionList{
+		&moveAction{ShardId: "s1", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s2", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s3", DropEndpoint: "c3", AddEndpoint: "c2"},
+	}
+	withDrainEndpoints(mals, map[string]string{"s1": "c1", "s3": "c1"})
+	expect := moveActionList{
+		&moveAction{ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s2", AddEndpoint: "c2"},
+		&moveAction{ShardId: "s3", DropEndpoint: "c3", AddEndpoint: "c2"},
+	}
+	if !reflect.DeepEqual(mals, expect) {
+		t.Errorf("actual: %s, expect: %s", mals.String(), expect.String())
+	}
+}
+
+func Test_rebalance_preferredContainers(t *testing.T) {
+	service := "foo.bar"
+	w := smShard{service: service, lg: ttLogger, appSpec: &smAppSpec{}}
+	specs := map[string]*apputil.ShardSpec{
+		"s1": {},
+		"s2": {},
+		// c9不存在，按照顺序选择c3
+		"s3": {PreferredContainers: []string{"c9", "c3"}},
+		"s4": {PreferredContainers: []string{"c1"}},
+		// c1已经达到quota，走通用的分配
+		"s5": {PreferredContainers: []string{"c1"}},
+		// 已经分配的shard不因为preferred移动
+		"s6": {PreferredContainers: []string{"c3"}},
+	}
+
+	r := w.rebalance(
+		ArmorMap{"s1": "", "s2": "", "s3": "", "s4": "", "s5": "", "s6": ""},
+		ArmorMap{"c1": "", "c2": "", "c3": ""},
+		ArmorMap{"s1": "c1", "s2": "c2", "s6": "c2"},
+		specs,
+	)
+	sort.Sort(r)
+	expect := moveActionList{
+		&moveAction{Service: service, ShardId: "s3", AddEndpoint: "c3", Spec: specs["s3"]},
+		&moveAction{Service: service, ShardId: "s4", AddEndpoint: "c1", Spec: specs["s4"]},
+		&moveAction{Service: service, ShardId: "s5", AddEndpoint: "c3", Spec: specs["s5"]},
+	}
+	if !reflect.DeepEqual(r, expect) {
+		t.Errorf("actual: %s, expect: %s", r.String(), expect.String())
+	}
+}
+
+func Test_smShard_SetMinimizeMovement(t *testing.T) {
+	ss := &smShard{lg: ttLogger, appSpec: &smAppSpec{}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ss.SetMinimizeMovement(i%2 == 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ss.minimizeMovement()
+			ss.dryRunShard()
+		}
+	}()
+	wg.Wait()
+	if ss.minimizeMovement() {
+		t.Errorf("expect minimize movement disabled")
+	}
+}
+
+func Test_smShard_updateSpec(t *testing.T) {
+	ss := &smShard{lg: ttLogger, appSpec: &smAppSpec{MaxShardCount: 10}, mpr: &mapper{lg: ttLogger}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// update-spec、freeze和balanceLoop并发，-race下不能有数据竞争
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ss.SetFrozen(i%2 == 0)
+			ss.SetAssignor(assignorBinpack)
+			ss.SetMaxShardsPerContainer(i)
+			ss.SetSpreadPolicy(spreadPolicyZone)
+			ss.SetDeploymentPolicy(deploymentPolicySpread)
+			ss.SetCanary(&canarySpec{Percent: i})
+			ss.SetWarmup(&warmupSpec{})
+			ss.SetMoveCooldown(i)
+			ss.SetRebalanceInterval(i)
+			ss.SetRebalanceDebounce(i)
+			ss.SetRebalanceWindows([]string{"00:00-06:00"})
+			ss.SetHealthProbe(i%2 == 0)
+			ss.SetMaxShardCount(i + 1)
+			ss.SetMaxRecoveryTime(i%10 + 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ss.Frozen()
+			ss.binpacking()
+			ss.maxShardsPerContainer()
+			ss.spreadByZone()
+			ss.canary()
+			ss.rebalanceInterval()
+			ss.rebalanceDebounce()
+			ss.unhealthyContainers()
+			ss.mpr.recoveryWait()
+		}
+	}()
+	wg.Wait()
+
+	// 修改不影响之前读到的appSpec
+	before := ss.spec()
+	ss.SetFrozen(true)
+	if before.Frozen || !ss.Frozen() {
+		t.Errorf("expect copy on write")
+	}
+	if ss.maxShardsPerContainer() != 99 || ss.spec().MaxShardCount != 100 || ss.mpr.recoveryWait() != 10*time.Second {
+		t.Errorf("unexpected spec %+v", ss.spec())
+	}
+}
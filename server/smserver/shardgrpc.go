@@ -0,0 +1,104 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// defaultShardGrpcTimeout 和http下发使用相同的超时
+const defaultShardGrpcTimeout = 3 * time.Second
+
+// shardGrpcPool 所有service的operator共用，每个container的grpc地址复用一个连接
+type shardGrpcPool struct {
+	lg *zap.Logger
+
+	// tlsConfig 双向认证的client证书，为空时是通过 WithShardGrpcInsecure 显式开启的明文
+	tlsConfig *tls.Config
+
+	// timeout 调用方没有设置deadline时使用，deadline随请求传递给container
+	timeout time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	clients map[string]*apputil.ShardControlClient
+}
+
+func newShardGrpcPool(lg *zap.Logger, tlsConfig *tls.Config) *shardGrpcPool {
+	return &shardGrpcPool{
+		lg:        lg,
+		tlsConfig: tlsConfig,
+		timeout:   defaultShardGrpcTimeout,
+		clients:   make(map[string]*apputil.ShardControlClient),
+	}
+}
+
+func (p *shardGrpcPool) get(addr string) (*apputil.ShardControlClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, apputil.ErrClosing
+	}
+	if client, ok := p.clients[addr]; ok {
+		return client, nil
+	}
+	var (
+		client *apputil.ShardControlClient
+		err    error
+	)
+	if p.tlsConfig != nil {
+		client, err = apputil.DialShardControl(addr, p.tlsConfig)
+	} else {
+		client, err = apputil.DialInsecureShardControl(addr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	p.clients[addr] = client
+	return client, nil
+}
+
+// evict 请求失败后关闭连接，container可能已经重启或者下线，下次请求重新建立
+func (p *shardGrpcPool) evict(addr string, client *apputil.ShardControlClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients[addr] != client {
+		return
+	}
+	delete(p.clients, addr)
+	if err := client.Close(); err != nil {
+		p.lg.Warn(
+			"close grpc client error",
+			zap.String("addr", addr),
+			zap.Error(err),
+		)
+	}
+}
+
+func (p *shardGrpcPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for addr, client := range p.clients {
+		_ = client.Close()
+		delete(p.clients, addr)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultSimRounds 模拟的最大轮数，没有move时提前结束
+	defaultSimRounds = 10
+
+	// defaultSimFetchTimeout 从运行中的sm获取快照时每个请求的超时时间
+	defaultSimFetchTimeout = 10 * time.Second
+)
+
+// SimContainer 模拟中的container，属性和heartbeat中上报的一致
+type SimContainer struct {
+	Zone     string            `json:"zone,omitempty"`
+	Capacity int               `json:"capacity,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// SimSnapshot sm-sim的输入，一个service的spec、shard配置、存活的container以及当前的分配，
+// 可以手写fixture，也可以通过 FetchSimSnapshot 从运行中的sm获取
+type SimSnapshot struct {
+	Service string `json:"service"`
+
+	// Spec 和export中的spec格式相同，修改其中的策略可以评估策略变更的效果
+	Spec json.RawMessage `json:"spec,omitempty"`
+
+	// Shards key是shard id
+	Shards map[string]*apputil.ShardSpec `json:"shards"`
+
+	// Containers key是container id
+	Containers map[string]*SimContainer `json:"containers"`
+
+	// Assignment shard（开启副本时是副本id）当前所在的container，不在Containers中的container按照丢失处理
+	Assignment map[string]string `json:"assignment,omitempty"`
+
+	// Loads shard的实际负载，用于计算均衡指标，没有设置时使用shard的weight，binpack使用loadEstimate
+	Loads map[string]float64 `json:"loads,omitempty"`
+}
+
+// SimMove From为空是新分配，To为空是drop
+type SimMove struct {
+	ShardId string `json:"shardId"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+}
+
+// SimMetrics 一轮分配后的均衡指标
+type SimMetrics struct {
+	Containers int      `json:"containers"`
+	Assigned   int      `json:"assigned"`
+	Unassigned []string `json:"unassigned,omitempty"`
+
+	// MinShards 和 MaxShards container持有的shard数量范围
+	MinShards int `json:"minShards"`
+	MaxShards int `json:"maxShards"`
+
+	// MinLoad、MaxLoad、MeanLoad 和 StddevLoad container负载的统计
+	MinLoad    float64 `json:"minLoad"`
+	MaxLoad    float64 `json:"maxLoad"`
+	MeanLoad   float64 `json:"meanLoad"`
+	StddevLoad float64 `json:"stddevLoad"`
+
+	// Imbalance 最大负载和平均负载的比例，1代表完全均衡
+	Imbalance float64 `json:"imbalance"`
+}
+
+func (m *SimMetrics) String() string {
+	return fmt.Sprintf(
+		"assigned %d, unassigned %d, shards %d..%d, load min %.2f max %.2f mean %.2f stddev %.2f, imbalance %.2f",
+		m.Assigned, len(m.Unassigned), m.MinShards, m.MaxShards, m.MinLoad, m.MaxLoad, m.MeanLoad, m.StddevLoad, m.Imbalance,
+	)
+}
+
+// SimRound 一轮rebalance产生的move和执行后的指标
+type SimRound struct {
+	Round   int         `json:"round"`
+	Moves   []*SimMove  `json:"moves"`
+	Cost    int64       `json:"cost"`
+	Metrics *SimMetrics `json:"metrics"`
+}
+
+type SimReport struct {
+	Service   string      `json:"service"`
+	Initial   *SimMetrics `json:"initial"`
+	Rounds    []*SimRound `json:"rounds"`
+	Converged bool        `json:"converged"`
+
+	// Assignment 最后一轮之后的分配
+	Assignment map[string]string `json:"assignment"`
+}
+
+// Simulate 使用和leader相同的分配逻辑（planGroup）模拟最多rounds轮rebalance，每轮的move全部执行成功，
+// 不读写etcd，cordon、冷却、维护窗口等运行时状态不参与模拟
+func Simulate(snapshot *SimSnapshot, rounds int, lg *zap.Logger) (*SimReport, error) {
+	if snapshot == nil || snapshot.Service == "" {
+		return nil, errors.New("service err")
+	}
+	if rounds <= 0 {
+		rounds = defaultSimRounds
+	}
+	if lg == nil {
+		lg = zap.NewNop()
+	}
+
+	spec := smAppSpec{Service: snapshot.Service}
+	if len(snapshot.Spec) > 0 {
+		if err := json.Unmarshal(snapshot.Spec, &spec); err != nil {
+			return nil, errors.Wrap(err, "spec")
+		}
+		spec.Service = snapshot.Service
+	}
+	if err := spec.validate(); err != nil {
+		return nil, errors.Wrap(err, "spec")
+	}
+
+	// 只有内存状态的mapper，提供container的zone、capacity和labels
+	mpr := &mapper{lg: lg, appSpec: &spec}
+	mpr.containerState = newMapperState(mpr, containerTrigger)
+	mpr.shardState = newMapperState(mpr, shardTrigger)
+	containers := make(ArmorMap)
+	for id, sc := range snapshot.Containers {
+		if sc == nil {
+			sc = &SimContainer{}
+		}
+		mpr.containerState.alive[id] = &temporary{zone: sc.Zone, capacity: sc.Capacity, labels: sc.Labels}
+		containers[id] = sc.Zone
+	}
+	ss := &smShard{service: snapshot.Service, lg: lg, appSpec: &spec, mpr: mpr}
+
+	specs := make(map[string]*apputil.ShardSpec)
+	shardIdAndGroup := make(ArmorMap)
+	now := time.Now()
+	for shardId, s := range snapshot.Shards {
+		if s == nil || s.Expired(now) {
+			continue
+		}
+		for id, rs := range expandReplicas(shardId, s) {
+			specs[id] = rs
+			shardIdAndGroup[id] = rs.Group
+		}
+	}
+
+	// 丢失的container上的shard按照未分配处理
+	assignment := make(map[string]string)
+	for shardId, containerId := range snapshot.Assignment {
+		if _, ok := containers[containerId]; ok {
+			assignment[shardId] = containerId
+		}
+	}
+
+	loadOf := simLoadOf(snapshot.Loads, specs, ss.binpacking())
+	cost := costOf(specs)
+	report := SimReport{Service: snapshot.Service, Initial: simMetrics(assignment, specs, containers, loadOf)}
+	for round := 1; round <= rounds; round++ {
+		groups := make(map[string]*balancerGroup)
+		for id, s := range specs {
+			if groups[s.Group] == nil {
+				groups[s.Group] = newBalanceGroup()
+			}
+			groups[s.Group].fixShardIdAndManualContainerId[id] = s.ManualContainerId
+		}
+
+		var mals moveActionList
+		for shardId, containerId := range assignment {
+			group, ok := shardIdAndGroup[shardId]
+			if !ok {
+				// 删除的shard直接drop
+				mals = append(mals, &moveAction{Service: snapshot.Service, ShardId: shardId, DropEndpoint: containerId})
+				continue
+			}
+			groups[group].hbShardIdAndContainerId[shardId] = containerId
+		}
+		var names []string
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, r, planned := ss.planGroup(name, groups[name], containers, specs); planned {
+				mals = append(mals, r...)
+			}
+		}
+
+		sr := SimRound{Round: round, Moves: make([]*SimMove, 0, len(mals))}
+		for _, ma := range mals {
+			sr.Moves = append(sr.Moves, &SimMove{ShardId: ma.ShardId, From: ma.DropEndpoint, To: ma.AddEndpoint})
+			sr.Cost += cost(ma.ShardId)
+			if ma.AddEndpoint != "" {
+				assignment[ma.ShardId] = ma.AddEndpoint
+			} else {
+				delete(assignment, ma.ShardId)
+			}
+		}
+		sort.Slice(sr.Moves, func(i, j int) bool { return sr.Moves[i].ShardId < sr.Moves[j].ShardId })
+		sr.Metrics = simMetrics(assignment, specs, containers, loadOf)
+		report.Rounds = append(report.Rounds, &sr)
+		if len(mals) == 0 {
+			report.Converged = true
+			break
+		}
+	}
+	report.Assignment = assignment
+	return &report, nil
+}
+
+// simLoadOf 优先使用快照中的实际负载，副本没有单独的负载时使用shard的负载
+func simLoadOf(loads map[string]float64, specs map[string]*apputil.ShardSpec, binpacking bool) func(id string) float64 {
+	return func(id string) float64 {
+		if v, ok := loads[id]; ok {
+			return v
+		}
+		shardId, _ := apputil.ParseReplicaShardId(id)
+		if v, ok := loads[shardId]; ok {
+			return v
+		}
+		spec := specs[id]
+		if binpacking {
+			if spec != nil && spec.LoadEstimate > 0 {
+				return float64(spec.LoadEstimate)
+			}
+			return 1
+		}
+		return float64(shardWeight(spec))
+	}
+}
+
+func simMetrics(assignment map[string]string, specs map[string]*apputil.ShardSpec, containers ArmorMap, loadOf func(id string) float64) *SimMetrics {
+	m := SimMetrics{Containers: len(containers)}
+	shards := make(map[string]int)
+	loads := make(map[string]float64)
+	for id := range containers {
+		shards[id] = 0
+		loads[id] = 0
+	}
+	for shardId, containerId := range assignment {
+		shards[containerId]++
+		loads[containerId] += loadOf(shardId)
+	}
+	for shardId := range specs {
+		if _, ok := assignment[shardId]; ok {
+			m.Assigned++
+		} else {
+			m.Unassigned = append(m.Unassigned, shardId)
+		}
+	}
+	sort.Strings(m.Unassigned)
+	if len(containers) == 0 {
+		return &m
+	}
+
+	first := true
+	var sum float64
+	for id := range containers {
+		n, l := shards[id], loads[id]
+		if first || n < m.MinShards {
+			m.MinShards = n
+		}
+		if first || n > m.MaxShards {
+			m.MaxShards = n
+		}
+		if first || l < m.MinLoad {
+			m.MinLoad = l
+		}
+		if first || l > m.MaxLoad {
+			m.MaxLoad = l
+		}
+		first = false
+		sum += l
+	}
+	m.MeanLoad = sum / float64(len(containers))
+	var variance float64
+	for id := range containers {
+		variance += (loads[id] - m.MeanLoad) * (loads[id] - m.MeanLoad)
+	}
+	m.StddevLoad = math.Sqrt(variance / float64(len(containers)))
+	if m.MeanLoad > 0 {
+		m.Imbalance = m.MaxLoad / m.MeanLoad
+	}
+	return &m
+}
+
+// FetchSimSnapshot 通过export、containers和cluster-state接口获取运行中service的快照，
+// loadMetric为qps、cpu、memory或者业务上报的gauge名称时使用shard上报的负载，为空时不获取负载
+func FetchSimSnapshot(addr string, service string, token string, loadMetric string) (*SimSnapshot, error) {
+	if service == "" {
+		return nil, errors.New("service err")
+	}
+	addr = strings.TrimSuffix(addr, "/")
+	client := &http.Client{Timeout: defaultSimFetchTimeout}
+	get := func(path string, v interface{}) error {
+		req, err := http.NewRequest(http.MethodGet, addr+path, nil)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		if token != "" {
+			req.Header.Set(headerToken, token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("GET %s: %d %s", path, resp.StatusCode, string(b))
+		}
+		return errors.Wrap(json.Unmarshal(b, v), path)
+	}
+
+	var doc specDocument
+	if err := get("/sm/server/export?service="+url.QueryEscape(service), &doc); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if len(doc.Services) != 1 || doc.Services[0].Spec == nil {
+		return nil, errors.Errorf("service[%s] not exist", service)
+	}
+	spec, err := json.Marshal(doc.Services[0].Spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	snapshot := SimSnapshot{
+		Service:    service,
+		Spec:       spec,
+		Shards:     doc.Services[0].Shards,
+		Containers: make(map[string]*SimContainer),
+		Assignment: make(map[string]string),
+	}
+
+	var sc serviceContainers
+	if err := get("/sm/server/containers?service="+url.QueryEscape(service), &sc); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	for _, cs := range sc.Containers {
+		// 准备退出的container不参与分配
+		if cs.Draining {
+			continue
+		}
+		snapshot.Containers[cs.ContainerId] = &SimContainer{Zone: cs.Zone, Capacity: cs.Capacity, Labels: cs.Labels}
+	}
+
+	var state clusterState
+	if err := get("/sm/server/cluster-state", &state); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	for _, ds := range state.Services {
+		if ds.Service != service {
+			continue
+		}
+		for _, shard := range ds.Shards {
+			if shard.ContainerId == "" {
+				continue
+			}
+			snapshot.Assignment[shard.ShardId] = shard.ContainerId
+			if v, ok := shardLoadMetric(shard.Stats, loadMetric); ok {
+				if snapshot.Loads == nil {
+					snapshot.Loads = make(map[string]float64)
+				}
+				snapshot.Loads[shard.ShardId] = v
+			}
+		}
+	}
+	return &snapshot, nil
+}
+
+func shardLoadMetric(stats *apputil.ShardLoad, metric string) (float64, bool) {
+	if stats == nil || metric == "" {
+		return 0, false
+	}
+	switch metric {
+	case "qps":
+		return stats.QPS, true
+	case "cpu":
+		return stats.CPU, true
+	case "memory":
+		return float64(stats.Memory), true
+	}
+	v, ok := stats.Gauges[metric]
+	return v, ok
+}
@@ -0,0 +1,50 @@
+package smserver
+
+import (
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Simulate(t *testing.T) {
+	snapshot := SimSnapshot{
+		Service:    "foo",
+		Shards:     make(map[string]*apputil.ShardSpec),
+		Containers: map[string]*SimContainer{"c1": {}, "c2": {}, "c3": {}},
+		Assignment: make(map[string]string),
+	}
+	for _, id := range []string{"s1", "s2", "s3", "s4", "s5", "s6"} {
+		snapshot.Shards[id] = &apputil.ShardSpec{}
+		snapshot.Assignment[id] = "c1"
+	}
+
+	report, err := Simulate(&snapshot, 0, ttLogger)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, report.Initial.MaxShards)
+	assert.True(t, report.Converged)
+	assert.True(t, len(report.Rounds) > 1)
+	assert.NotEmpty(t, report.Rounds[0].Moves)
+	last := report.Rounds[len(report.Rounds)-1]
+	assert.Empty(t, last.Moves)
+	assert.Equal(t, 2, last.Metrics.MinShards)
+	assert.Equal(t, 2, last.Metrics.MaxShards)
+	assert.Equal(t, float64(1), last.Metrics.Imbalance)
+
+	// 丢失的container上的shard重新分配
+	snapshot.Assignment = map[string]string{"s1": "c9", "s2": "c9", "s3": "c1", "s4": "c1", "s5": "c2", "s6": "c3"}
+	report, err = Simulate(&snapshot, 0, ttLogger)
+	assert.Nil(t, err)
+	assert.Len(t, report.Initial.Unassigned, 2)
+	assert.True(t, report.Converged)
+	assert.Len(t, report.Assignment, 6)
+	for _, containerId := range report.Assignment {
+		assert.Contains(t, snapshot.Containers, containerId)
+	}
+
+	// 删除的shard被drop
+	snapshot.Assignment["s7"] = "c2"
+	report, err = Simulate(&snapshot, 0, ttLogger)
+	assert.Nil(t, err)
+	assert.NotContains(t, report.Assignment, "s7")
+}
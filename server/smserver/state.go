@@ -0,0 +1,236 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// shardState shard的生命周期:
+// Pending 已经添加但没有分配，Assigning 正在下发到container，Running 已经在container上运行，
+// Migrating 正在从一个container迁移到另一个container，Dropped 已经从container上移除并且配置已经删除
+type shardState string
+
+const (
+	shardStatePending   shardState = "Pending"
+	shardStateAssigning shardState = "Assigning"
+	shardStateRunning   shardState = "Running"
+	shardStateMigrating shardState = "Migrating"
+	shardStateDropped   shardState = "Dropped"
+)
+
+// shardStateTransitions 合法的状态转换，相同状态之间的转换用于记录重试失败的原因
+var shardStateTransitions = map[shardState][]shardState{
+	shardStatePending: {shardStateAssigning, shardStateDropped},
+	// add失败后等待下一轮rebalance
+	shardStateAssigning: {shardStateRunning, shardStatePending, shardStateDropped},
+	// container丢失后shard重新分配，或者因为优先级被驱逐
+	shardStateRunning:   {shardStateMigrating, shardStateAssigning, shardStatePending, shardStateDropped},
+	shardStateMigrating: {shardStateRunning, shardStatePending, shardStateDropped},
+	// 删除后重新添加相同id的shard
+	shardStateDropped: {shardStatePending, shardStateAssigning},
+}
+
+func canTransition(from, to shardState) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range shardStateTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// shardStateRecord 持久化在etcd中的shard状态
+type shardStateRecord struct {
+	ShardId string     `json:"shardId"`
+	State   shardState `json:"state"`
+
+	// ContainerId Running时所在的container
+	ContainerId string `json:"containerId,omitempty"`
+
+	// From 和To 在Assigning和Migrating时记录move的两端
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	// Error 当前状态下最后一次move失败的原因，move成功后清空
+	Error string `json:"error,omitempty"`
+
+	// UpdateTime unix秒，长时间停留在Assigning或者Migrating说明move卡住了
+	UpdateTime int64 `json:"updateTime"`
+}
+
+func (r *shardStateRecord) String() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// shardStateStore 由负责service的sm container在move前后转换shard的状态
+type shardStateStore struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	nodeManager *nodeManager
+}
+
+func newShardStateStore(lg *zap.Logger, client etcdutil.EtcdWrapper, nodeManager *nodeManager) *shardStateStore {
+	return &shardStateStore{lg: lg, client: client, nodeManager: nodeManager}
+}
+
+// beforeMove drop和add都有时是迁移，只有add时是分配，只有drop时等待完成后再转换
+func (s *shardStateStore) beforeMove(ma *moveAction) {
+	switch {
+	case ma.DropEndpoint != "" && ma.AddEndpoint != "":
+		s.transition(ma.Service, &shardStateRecord{ShardId: ma.ShardId, State: shardStateMigrating, From: ma.DropEndpoint, To: ma.AddEndpoint})
+	case ma.AddEndpoint != "":
+		s.transition(ma.Service, &shardStateRecord{ShardId: ma.ShardId, State: shardStateAssigning, To: ma.AddEndpoint})
+	}
+}
+
+// afterMove 失败时保持当前状态并记录原因，stuck的move可以通过get-shard看到
+func (s *shardStateStore) afterMove(ma *moveAction, err error) {
+	if s == nil {
+		return
+	}
+	// reconciler drop的是多余的container，shard仍然在记录中的container上运行
+	if ma.Reason == moveReasonReconcile && ma.AddEndpoint == "" && ma.Spec != nil {
+		return
+	}
+	if err != nil {
+		record, gerr := s.get(context.TODO(), ma.Service, ma.ShardId)
+		if gerr != nil {
+			s.lg.Error("get shard state error", zap.String("shardId", ma.ShardId), zap.Error(gerr))
+			return
+		}
+		if record == nil {
+			return
+		}
+		record.Error = err.Error()
+		s.transition(ma.Service, record)
+		return
+	}
+
+	switch {
+	case ma.AddEndpoint != "":
+		s.transition(ma.Service, &shardStateRecord{ShardId: ma.ShardId, State: shardStateRunning, ContainerId: ma.AddEndpoint})
+	case ma.Spec == nil:
+		// 配置已经删除的shard
+		s.transition(ma.Service, &shardStateRecord{ShardId: ma.ShardId, State: shardStateDropped, From: ma.DropEndpoint})
+	default:
+		// 配置还在，例如被高优先级shard驱逐，等待重新分配
+		s.transition(ma.Service, &shardStateRecord{ShardId: ma.ShardId, State: shardStatePending, From: ma.DropEndpoint})
+	}
+}
+
+// transition 写入失败只打印日志，状态是观测用的，不影响move
+func (s *shardStateStore) transition(service string, record *shardStateRecord) {
+	if s == nil {
+		return
+	}
+	prev, err := s.get(context.TODO(), service, record.ShardId)
+	if err != nil {
+		s.lg.Error("get shard state error", zap.String("shardId", record.ShardId), zap.Error(err))
+	}
+	// 状态以实际的move为准，非法的转换只做提示
+	if prev != nil && !canTransition(prev.State, record.State) {
+		s.lg.Warn(
+			"unexpected shard state transition",
+			zap.String("service", service),
+			zap.String("shardId", record.ShardId),
+			zap.String("from", string(prev.State)),
+			zap.String("to", string(record.State)),
+		)
+	}
+
+	record.UpdateTime = time.Now().Unix()
+	key := s.nodeManager.nodeServiceShardState(service) + record.ShardId
+	if _, err := s.client.Put(context.TODO(), key, record.String()); err != nil {
+		s.lg.Error(
+			"put shard state error",
+			zap.String("key", key),
+			zap.Reflect("record", record),
+			zap.Error(err),
+		)
+	}
+}
+
+// get 没有记录时返回nil
+func (s *shardStateStore) get(ctx context.Context, service string, shardId string) (*shardStateRecord, error) {
+	if s == nil {
+		return nil, nil
+	}
+	resp, err := s.client.GetKV(ctx, s.nodeManager.nodeServiceShardState(service)+shardId, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, nil
+	}
+	var record shardStateRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &record); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &record, nil
+}
+
+// removeUnassigned shard配置删除时，没有分配的shard不会产生drop，直接清理状态，
+// 已经分配的shard在drop完成后转换为Dropped
+func (s *shardStateStore) removeUnassigned(ctx context.Context, service string, shardId string) error {
+	if s == nil {
+		return nil
+	}
+	record, err := s.get(ctx, service, shardId)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if record != nil && record.State != shardStatePending {
+		return nil
+	}
+	_, err = s.client.Delete(ctx, s.nodeManager.nodeServiceShardState(service)+shardId)
+	return errors.Wrap(err, "")
+}
+
+// list 返回shard和副本的状态，没有记录的shard还没有被分配过，作为Pending返回
+func (s *shardStateStore) list(ctx context.Context, service string, shardId string, spec *apputil.ShardSpec) ([]*shardStateRecord, error) {
+	// expandReplicas会修改spec
+	cp := *spec
+	var ids []string
+	for id := range expandReplicas(shardId, &cp) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var records []*shardStateRecord
+	for _, id := range ids {
+		record, err := s.get(ctx, service, id)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		if record == nil {
+			record = &shardStateRecord{ShardId: id, State: shardStatePending}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,97 @@
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// memShardState 模拟etcd中一个shard的状态节点，GetKV返回最近一次Put的内容
+func memShardState(client *MockedEtcdWrapper) *clientv3.GetResponse {
+	resp := &clientv3.GetResponse{}
+	client.On("GetKV", mock.Anything, mock.Anything, mock.Anything).Return(resp, nil)
+	client.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		resp.Count = 1
+		resp.Kvs = []*mvccpb.KeyValue{{Key: []byte(args.String(1)), Value: []byte(args.String(2))}}
+	}).Return(&clientv3.PutResponse{}, nil)
+	return resp
+}
+
+func lastShardState(resp *clientv3.GetResponse) *shardStateRecord {
+	var record shardStateRecord
+	_ = json.Unmarshal(resp.Kvs[0].Value, &record)
+	return &record
+}
+
+func Test_shardStateStore(t *testing.T) {
+	nm := &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")}
+	client := new(MockedEtcdWrapper)
+	resp := memShardState(client)
+	s := newShardStateStore(ttLogger, client, nm)
+	spec := &apputil.ShardSpec{Service: "foo.bar"}
+
+	// 分配
+	ma := &moveAction{Service: "foo.bar", ShardId: "s1", AddEndpoint: "c1", Spec: spec}
+	s.beforeMove(ma)
+	if r := lastShardState(resp); r.State != shardStateAssigning || r.To != "c1" {
+		t.Errorf("unexpected record %s", r)
+	}
+	s.afterMove(ma, nil)
+	if r := lastShardState(resp); r.State != shardStateRunning || r.ContainerId != "c1" {
+		t.Errorf("unexpected record %s", r)
+	}
+
+	// 迁移失败，保持Migrating并记录原因
+	ma = &moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2", Spec: spec}
+	s.beforeMove(ma)
+	s.afterMove(ma, errors.New("fake"))
+	if r := lastShardState(resp); r.State != shardStateMigrating || r.From != "c1" || r.To != "c2" || r.Error != "fake" {
+		t.Errorf("unexpected record %s", r)
+	}
+
+	// 被驱逐的shard配置还在
+	ma = &moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c2", Spec: spec}
+	s.afterMove(ma, nil)
+	if r := lastShardState(resp); r.State != shardStatePending || r.Error != "" {
+		t.Errorf("unexpected record %s", r)
+	}
+
+	// 配置删除后drop
+	ma = &moveAction{Service: "foo.bar", ShardId: "s1", DropEndpoint: "c2"}
+	s.afterMove(ma, nil)
+	if r := lastShardState(resp); r.State != shardStateDropped {
+		t.Errorf("unexpected record %s", r)
+	}
+
+	// 没有记录的副本作为Pending返回
+	s = newShardStateStore(ttLogger, new(MockedEtcdWrapper), nm)
+	s.client.(*MockedEtcdWrapper).On("GetKV", mock.Anything, mock.Anything, mock.Anything).Return(&clientv3.GetResponse{}, nil)
+	list, err := s.list(context.TODO(), "foo.bar", "s2", &apputil.ShardSpec{ReplicaCount: 2})
+	if err != nil || len(list) != 2 || list[0].ShardId != "s2" || list[1].State != shardStatePending {
+		t.Errorf("unexpected list %v err %v", list, err)
+	}
+}
+
+func Test_canTransition(t *testing.T) {
+	var tests = []struct {
+		from, to shardState
+		expect   bool
+	}{
+		{shardStatePending, shardStateAssigning, true},
+		{shardStatePending, shardStateRunning, false},
+		{shardStateRunning, shardStateMigrating, true},
+		{shardStateMigrating, shardStateMigrating, true},
+		{shardStateDropped, shardStateRunning, false},
+	}
+	for idx, tt := range tests {
+		if actual := canTransition(tt.from, tt.to); actual != tt.expect {
+			t.Errorf("idx %d expect %t actual %t", idx, tt.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// workerStats service的后台goroutine的异常计数，通过 /debug/vars 查看
+type workerStats struct {
+	// panics recover的panic次数
+	panics int64
+	// errors balanceChecker、healthChecker和move任务返回的错误次数
+	errors int64
+	// restarts panic后重启goroutine的次数
+	restarts int64
+	// drifts reconciler确认并修正的分配差异数量
+	drifts int64
+}
+
+// workerError 统计返回的错误，nil不计数
+func (ss *smShard) workerError(err error) {
+	if err != nil {
+		atomic.AddInt64(&ss.stats.errors, 1)
+	}
+}
+
+// recovered 执行fn，panic只影响当前service，返回是否发生了panic
+func (ss *smShard) recovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			atomic.AddInt64(&ss.stats.panics, 1)
+			ss.lg.Error(
+				"worker panic",
+				zap.String("service", ss.service),
+				zap.String("worker", name),
+				zap.Any("panic", r),
+				zap.ByteString("stack", debug.Stack()),
+			)
+		}
+	}()
+	fn()
+	return false
+}
+
+// supervise fn正常返回代表ctx结束，panic后按照指数退避重新执行，运行时间超过最大等待时间后退避重置
+func (ss *smShard) supervise(ctx context.Context, name string, fn func(ctx context.Context)) {
+	initial := ss.workerBackoff
+	if initial <= 0 {
+		initial = defaultWorkerBackoff
+	}
+	backoff := initial
+	for {
+		start := time.Now()
+		if !ss.recovered(name, func() { fn(ctx) }) {
+			return
+		}
+		if time.Since(start) > maxWorkerBackoff {
+			backoff = initial
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		atomic.AddInt64(&ss.stats.restarts, 1)
+		ss.lg.Warn(
+			"worker restart",
+			zap.String("service", ss.service),
+			zap.String("worker", name),
+			zap.Duration("backoff", backoff),
+		)
+		backoff *= 2
+		if backoff > maxWorkerBackoff {
+			backoff = maxWorkerBackoff
+		}
+	}
+}
+
+// handleEvent trigger的worker是所有事件共用的，processEvent的panic转换为错误
+func (ss *smShard) handleEvent(key string, value interface{}) error {
+	var err error
+	if ss.recovered("processEvent", func() { err = ss.processEvent(key, value) }) {
+		err = errors.New("processEvent panic")
+	}
+	ss.workerError(err)
+	return err
+}
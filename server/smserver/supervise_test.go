@@ -0,0 +1,44 @@
+package smserver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_smShard_supervise(t *testing.T) {
+	ss := smShard{service: "foo.bar", lg: ttLogger, workerBackoff: time.Millisecond}
+
+	// 前两次panic，第三次正常返回
+	var runs int
+	ss.supervise(context.Background(), "test", func(ctx context.Context) {
+		runs++
+		if runs < 3 {
+			panic("fake")
+		}
+	})
+	if runs != 3 || ss.stats.panics != 2 || ss.stats.restarts != 2 {
+		t.Errorf("unexpected runs %d stats %+v", runs, ss.stats)
+	}
+
+	// ctx结束后不再重启
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ss.supervise(ctx, "test", func(ctx context.Context) {
+		panic("fake")
+	})
+	if ss.stats.panics != 3 || ss.stats.restarts != 2 {
+		t.Errorf("unexpected stats %+v", ss.stats)
+	}
+}
+
+func Test_smShard_handleEvent(t *testing.T) {
+	ss := smShard{service: "foo.bar", lg: ttLogger}
+	// value类型错误导致processEvent panic
+	if err := ss.handleEvent(workerTrigger, "bad"); err == nil {
+		t.Error("expect err")
+	}
+	if ss.stats.panics != 1 || ss.stats.errors != 1 {
+		t.Errorf("unexpected stats %+v", ss.stats)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+)
+
+// encryptTask 开启task加密时，shard写入etcd之前加密Task，校验需要在加密之前完成，sm自身的shard不加密
+func (c *smContainer) encryptTask(spec *apputil.ShardSpec) error {
+	if c.taskKey == nil {
+		return nil
+	}
+	task, err := apputil.EncryptTask(c.taskKey, spec.Task)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	spec.Task = task
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// taskPriority 值越小越先回放，和 moveQueue 的优先级顺序一致
+func taskPriority(ev *workerTriggerEvent) int {
+	return int(movePriorityFailover - ev.Priority)
+}
+
+// taskKey 按照优先级和入队时间排序，etcd前缀查询后按照key排序即为回放顺序
+func taskKey(ev *workerTriggerEvent) string {
+	return fmt.Sprintf("%d-%019d", taskPriority(ev), time.Now().UnixNano())
+}
+
+// persistTask 写入失败只打印日志，事件仍然在内存中处理，只是leader切换时无法回放
+func (ss *smShard) persistTask(ev *workerTriggerEvent) string {
+	b, _ := json.Marshal(ev)
+	key := ss.container.nodeManager.nodeServiceTask(ss.service) + taskKey(ev)
+	if _, err := ss.container.Client.Put(context.TODO(), key, string(b)); err != nil {
+		ss.lg.Error(
+			"persist task error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		return ""
+	}
+	return key
+}
+
+// finishTask 删除失败的task会在下次回放时重复下发，move本身是幂等的
+func (ss *smShard) finishTask(key string) {
+	if key == "" {
+		return
+	}
+	if _, err := ss.container.Client.Delete(context.TODO(), key); err != nil {
+		ss.lg.Error(
+			"delete task error",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+	}
+}
+
+// loadTasks 按照回放顺序返回etcd中没有处理完的task
+func (ss *smShard) loadTasks(ctx context.Context) ([]*workerTriggerEvent, error) {
+	prefix := ss.container.nodeManager.nodeServiceTask(ss.service)
+	kvs, err := ss.container.Client.GetKVs(ctx, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var r []*workerTriggerEvent
+	for _, key := range keys {
+		var ev workerTriggerEvent
+		if err := json.Unmarshal([]byte(kvs[key]), &ev); err != nil {
+			// 无法解析的task不能回放，删除防止每次启动都失败
+			ss.lg.Error(
+				"Unmarshal task error",
+				zap.String("key", key),
+				zap.String("value", kvs[key]),
+				zap.Error(err),
+			)
+			ss.finishTask(prefix + key)
+			continue
+		}
+		ev.TaskKey = prefix + key
+		r = append(r, &ev)
+	}
+	return r, nil
+}
+
+// replayTasks 冻结的service不回放，task保留在etcd中，下次接管service时再回放
+func (ss *smShard) replayTasks(ctx context.Context) error {
+	if ss.Frozen() {
+		ss.lg.Warn(
+			"service frozen, skip replay tasks",
+			zap.String("service", ss.service),
+		)
+		return nil
+	}
+	tasks, err := ss.loadTasks(ctx)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	for _, ev := range tasks {
+		ss.put(ev)
+		ss.lg.Info(
+			"task replayed",
+			zap.String("service", ss.service),
+			zap.String("taskKey", ev.TaskKey),
+			zap.Reflect("event", ev),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/mock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_smShard_tasks(t *testing.T) {
+	client := new(MockedEtcdWrapper)
+	container := &smContainer{
+		lg:          ttLogger,
+		Container:   &apputil.Container{},
+		nodeManager: &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")},
+	}
+	container.Client = client
+	ss := &smShard{container: container, lg: ttLogger, service: "foo.bar"}
+	prefix := container.nodeManager.nodeServiceTask("foo.bar")
+
+	// 持久化的key按照move的优先级排序
+	client.On("Put", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&clientv3.PutResponse{}, nil)
+	key := ss.persistTask(&workerTriggerEvent{Service: "foo.bar", Type: workerEventShardChanged, Priority: movePriorityManual})
+	if !strings.HasPrefix(key, prefix+"1-") {
+		t.Errorf("unexpected task key %s", key)
+		t.SkipNow()
+	}
+
+	// 回放时container变化的task先于shard变化的task，无法解析的task被删除
+	shardChanged, _ := json.Marshal(&workerTriggerEvent{Service: "foo.bar", Type: workerEventShardChanged})
+	containerChanged, _ := json.Marshal(&workerTriggerEvent{Service: "foo.bar", Type: workerEventContainerChanged})
+	client.On("GetKVs", mock.Anything, prefix).Return(map[string]string{
+		"1-0000000000000000001": string(shardChanged),
+		"0-0000000000000000002": string(containerChanged),
+		"2-0000000000000000003": "foo",
+	}, nil)
+	client.On("Delete", mock.Anything, prefix+"2-0000000000000000003", mock.Anything).Return(&clientv3.DeleteResponse{}, nil)
+	tasks, err := ss.loadTasks(context.TODO())
+	if err != nil || len(tasks) != 2 {
+		t.Errorf("unexpected tasks %v err %v", tasks, err)
+		t.SkipNow()
+	}
+	if tasks[0].Type != workerEventContainerChanged || tasks[0].TaskKey != prefix+"0-0000000000000000002" || tasks[1].Type != workerEventShardChanged {
+		t.Errorf("unexpected task order %+v %+v", tasks[0], tasks[1])
+	}
+	client.AssertCalled(t, "Delete", mock.Anything, prefix+"2-0000000000000000003", mock.Anything)
+}
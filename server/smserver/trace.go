@@ -0,0 +1,72 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceHandler 每个api请求一个span，非leader转发的请求在leader上继续同一个trace
+func traceHandler(path string, handler func(c *gin.Context)) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := apputil.ExtractTraceHeader(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := apputil.Tracer().Start(ctx, path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		handler(c)
+
+		status := c.Writer.Status()
+		span.SetAttributes(
+			attribute.String("http.method", c.Request.Method),
+			attribute.Int("http.status_code", status),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// traceMoves 每个move一个span，关联最近修改shard的api调用，operator和目标container在这个span下继续
+func traceMoves(ctx context.Context, service string, mals moveActionList) {
+	ctx, span := apputil.Tracer().Start(ctx, "smShard.rebalance", trace.WithAttributes(attribute.String("service", service)))
+	defer span.End()
+
+	for _, ma := range mals {
+		opts := []trace.SpanStartOption{
+			trace.WithAttributes(
+				attribute.String("shardId", ma.ShardId),
+				attribute.String("dropEndpoint", ma.DropEndpoint),
+				attribute.String("addEndpoint", ma.AddEndpoint),
+			),
+		}
+		if ma.Spec != nil {
+			if sc := ma.Spec.TraceContext.SpanContext(); sc.IsValid() {
+				opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+			}
+		}
+		maCtx, maSpan := apputil.Tracer().Start(ctx, "moveAction", opts...)
+		ma.TraceContext = apputil.InjectTraceContext(maCtx)
+		maSpan.End()
+	}
+}
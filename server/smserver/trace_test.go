@@ -0,0 +1,59 @@
+package smserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func Test_traceMoves(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	// api调用的span
+	apiCtx, apiSpan := apputil.Tracer().Start(context.TODO(), "/sm/server/add-shard")
+	apiSpan.End()
+
+	mals := moveActionList{
+		{Service: "foo", ShardId: "s1", AddEndpoint: "c1", Spec: &apputil.ShardSpec{TraceContext: apputil.InjectTraceContext(apiCtx)}},
+		{Service: "foo", ShardId: "s2", AddEndpoint: "c1", Spec: &apputil.ShardSpec{}},
+	}
+	traceMoves(context.TODO(), "foo", mals)
+
+	var moveSpans []sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == "moveAction" {
+			moveSpans = append(moveSpans, s)
+		}
+	}
+	assert.Len(t, moveSpans, 2)
+	assert.Len(t, moveSpans[0].Links(), 1)
+	assert.Equal(t, apiSpan.SpanContext().TraceID(), moveSpans[0].Links()[0].SpanContext.TraceID())
+	assert.Len(t, moveSpans[1].Links(), 0)
+
+	// operator下发时通过header传递给container
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+	o := newOperator(ttLogger, "foo")
+	mals[0].AddEndpoint = strings.TrimPrefix(srv.URL, "http://")
+	assert.Nil(t, o.dropOrAdd(mals[0]))
+
+	moveTraceId := trace.SpanContextFromContext(mals[0].TraceContext.Extract(context.TODO())).TraceID()
+	assert.True(t, moveTraceId.IsValid())
+	assert.Contains(t, traceparent, moveTraceId.String())
+}
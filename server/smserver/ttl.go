@@ -0,0 +1,74 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"go.uber.org/zap"
+)
+
+// expireShards 删除etcd中过期的shard，和del-shard一样，存活的shard由balanceChecker drop，失败下一轮重试
+func (ss *smShard) expireShards(ctx context.Context) {
+	pfx := ss.container.nodeManager.nodeServiceShard(ss.service, "")
+	kvs, err := ss.container.Client.GetKVs(ctx, pfx)
+	if err != nil {
+		ss.lg.Error(
+			"GetKVs error",
+			zap.String("pfx", pfx),
+			zap.Error(err),
+		)
+		return
+	}
+
+	now := time.Now()
+	for shardId, value := range kvs {
+		var spec apputil.ShardSpec
+		if err := json.Unmarshal([]byte(value), &spec); err != nil {
+			continue
+		}
+		if !spec.Expired(now) {
+			continue
+		}
+
+		key := ss.container.nodeManager.nodeServiceShard(ss.service, shardId)
+		if _, err := ss.container.Client.Delete(ctx, key); err != nil {
+			ss.lg.Error(
+				"delete expired shard error",
+				zap.String("key", key),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err := ss.container.states.removeUnassigned(ctx, ss.service, shardId); err != nil {
+			ss.lg.Warn(
+				"removeUnassigned error",
+				zap.String("service", ss.service),
+				zap.String("shardId", shardId),
+				zap.Error(err),
+			)
+		}
+		ss.container.events.append(eventSpecChange, ss.service, "", "shard "+shardId+" expired")
+		ss.lg.Info(
+			"shard expired",
+			zap.String("service", ss.service),
+			zap.String("shardId", shardId),
+			zap.Int64("expireAt", spec.ExpireAt),
+		)
+	}
+}
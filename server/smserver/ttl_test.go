@@ -0,0 +1,35 @@
+package smserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/mock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func Test_smShard_expireShards(t *testing.T) {
+	client := new(MockedEtcdWrapper)
+	container := &smContainer{
+		lg:          ttLogger,
+		Container:   &apputil.Container{},
+		nodeManager: &nodeManager{smService: "sm", etcdPath: apputil.NewEtcdPath("")},
+	}
+	container.Client = client
+	ss := &smShard{container: container, lg: ttLogger, service: "foo.bar"}
+
+	expired := apputil.ShardSpec{Service: "foo.bar", ExpireAt: time.Now().Add(-time.Second).Unix()}
+	alive := apputil.ShardSpec{Service: "foo.bar", ExpireAt: time.Now().Add(time.Hour).Unix()}
+	client.On("GetKVs", mock.Anything, container.nodeManager.nodeServiceShard("foo.bar", "")).Return(map[string]string{
+		"s1": expired.String(),
+		"s2": alive.String(),
+		"s3": (&apputil.ShardSpec{Service: "foo.bar"}).String(),
+	}, nil)
+	client.On("Delete", mock.Anything, mock.Anything, mock.Anything).Return(&clientv3.DeleteResponse{Deleted: 1}, nil)
+
+	ss.expireShards(context.TODO())
+	client.AssertCalled(t, "Delete", mock.Anything, container.nodeManager.nodeServiceShard("foo.bar", "s1"), mock.Anything)
+	client.AssertNumberOfCalls(t, "Delete", 1)
+}
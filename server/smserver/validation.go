@@ -0,0 +1,282 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+)
+
+// ShardValidator 业务注册的shard校验，shard写入etcd之前执行，返回error时拒绝请求，
+// 用于提前拦截container无法处理的Task，不要在这里做耗时的操作
+type ShardValidator func(service string, shardId string, spec *apputil.ShardSpec) error
+
+var (
+	taskSchemaTypes = map[string]struct{}{
+		"object":  {},
+		"array":   {},
+		"string":  {},
+		"number":  {},
+		"integer": {},
+		"boolean": {},
+		"null":    {},
+	}
+
+	// taskSchemaKeywords 支持的JSON Schema关键字，不认识的关键字直接拒绝，防止误以为生效
+	taskSchemaKeywords = map[string]struct{}{
+		"$schema":              {},
+		"$id":                  {},
+		"title":                {},
+		"description":          {},
+		"default":              {},
+		"examples":             {},
+		"type":                 {},
+		"properties":           {},
+		"required":             {},
+		"additionalProperties": {},
+		"items":                {},
+		"enum":                 {},
+		"minimum":              {},
+		"maximum":              {},
+		"minLength":            {},
+		"maxLength":            {},
+		"pattern":              {},
+	}
+)
+
+// taskSchema JSON Schema的子集，spec中配置后要求shard的Task是满足schema的json
+type taskSchema struct {
+	Type                 string                     `json:"type"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties *bool                      `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	Enum                 []interface{}              `json:"enum"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              string                     `json:"pattern"`
+
+	properties map[string]*taskSchema
+	items      *taskSchema
+	pattern    *regexp.Regexp
+}
+
+// compileTaskSchema path用于错误提示，根节点是 $
+func compileTaskSchema(raw json.RawMessage, path string) (*taskSchema, error) {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &keywords); err != nil {
+		return nil, errors.Wrapf(err, "schema %s", path)
+	}
+	for k := range keywords {
+		if _, ok := taskSchemaKeywords[k]; !ok {
+			return nil, errors.Errorf("schema %s: unsupported keyword %s", path, k)
+		}
+	}
+
+	var s taskSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, errors.Wrapf(err, "schema %s", path)
+	}
+	if s.Type != "" {
+		if _, ok := taskSchemaTypes[s.Type]; !ok {
+			return nil, errors.Errorf("schema %s: unknown type %s", path, s.Type)
+		}
+	}
+	if s.Pattern != "" {
+		p, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "schema %s", path)
+		}
+		s.pattern = p
+	}
+	if len(s.Properties) > 0 {
+		s.properties = make(map[string]*taskSchema)
+		for name, child := range s.Properties {
+			cs, err := compileTaskSchema(child, path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+			s.properties[name] = cs
+		}
+	}
+	if len(s.Items) > 0 {
+		cs, err := compileTaskSchema(s.Items, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		s.items = cs
+	}
+	return &s, nil
+}
+
+// validateTask Task不是json或者不满足schema时返回error
+func (s *taskSchema) validateTask(task string) error {
+	var v interface{}
+	if err := json.Unmarshal([]byte(task), &v); err != nil {
+		return errors.Wrap(err, "task is not json")
+	}
+	return s.validate(v, "$")
+}
+
+func (s *taskSchema) validate(v interface{}, path string) error {
+	if s.Type != "" && !taskSchemaTypeMatch(s.Type, v) {
+		return errors.Errorf("%s: expect %s", path, s.Type)
+	}
+	if len(s.Enum) > 0 {
+		var found bool
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("%s: not in enum", path)
+		}
+	}
+
+	switch tv := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(tv)
+		if s.MinLength != nil && n < *s.MinLength {
+			return errors.Errorf("%s: length %d less than %d", path, n, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return errors.Errorf("%s: length %d greater than %d", path, n, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(tv) {
+			return errors.Errorf("%s: not match %s", path, s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && tv < *s.Minimum {
+			return errors.Errorf("%s: %v less than %v", path, tv, *s.Minimum)
+		}
+		if s.Maximum != nil && tv > *s.Maximum {
+			return errors.Errorf("%s: %v greater than %v", path, tv, *s.Maximum)
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := tv[name]; !ok {
+				return errors.Errorf("%s: missing %s", path, name)
+			}
+		}
+		// 按照key排序，同一个task每次返回相同的错误
+		names := make([]string, 0, len(tv))
+		for name := range tv {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cs, ok := s.properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return errors.Errorf("%s: unexpected %s", path, name)
+				}
+				continue
+			}
+			if err := cs.validate(tv[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.items != nil {
+			for i, item := range tv {
+				if err := s.items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func taskSchemaTypeMatch(typ string, v interface{}) bool {
+	switch tv := v.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case float64:
+		return typ == "number" || (typ == "integer" && tv == math.Trunc(tv))
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	}
+	return false
+}
+
+// validateTaskSchema 写入spec前确认schema可以编译
+func (s *smAppSpec) validateTaskSchema() error {
+	if len(s.TaskSchema) == 0 {
+		return nil
+	}
+	_, err := compileTaskSchema(s.TaskSchema, "$")
+	return err
+}
+
+// validateShards shard写入etcd之前按照service的taskSchema和注册的 ShardValidator 校验
+func (ss *smShardApi) validateShards(appSpec *smAppSpec, specs map[string]*apputil.ShardSpec) error {
+	var schema *taskSchema
+	if len(appSpec.TaskSchema) > 0 {
+		s, err := compileTaskSchema(appSpec.TaskSchema, "$")
+		if err != nil {
+			return err
+		}
+		schema = s
+	}
+
+	shardIds := make([]string, 0, len(specs))
+	for shardId := range specs {
+		shardIds = append(shardIds, shardId)
+	}
+	sort.Strings(shardIds)
+	for _, shardId := range shardIds {
+		spec := specs[shardId]
+		// 导入的shard可能已经加密，按照明文校验
+		if apputil.TaskEncrypted(spec.Task) {
+			task, err := apputil.DecryptTask(ss.container.taskKey, spec.Task)
+			if err != nil {
+				return errors.Wrapf(err, "shard %s", shardId)
+			}
+			decrypted := *spec
+			decrypted.Task = task
+			spec = &decrypted
+		}
+		if schema != nil {
+			if err := schema.validateTask(spec.Task); err != nil {
+				return errors.Wrapf(err, "shard %s", shardId)
+			}
+		}
+		for _, fn := range ss.container.shardValidators {
+			if err := fn(appSpec.Service, shardId, spec); err != nil {
+				return errors.Wrapf(err, "shard %s", shardId)
+			}
+		}
+	}
+	return nil
+}
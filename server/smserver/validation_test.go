@@ -0,0 +1,94 @@
+package smserver
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/pkg/errors"
+)
+
+func Test_taskSchema(t *testing.T) {
+	raw := json.RawMessage(`{
+		"type": "object",
+		"required": ["topic", "partitions"],
+		"additionalProperties": false,
+		"properties": {
+			"topic": {"type": "string", "pattern": "^[a-z.]+$", "maxLength": 16},
+			"partitions": {"type": "array", "items": {"type": "integer", "minimum": 0}},
+			"mode": {"enum": ["latest", "earliest"]}
+		}
+	}`)
+	s, err := compileTaskSchema(raw, "$")
+	if err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+
+	var tests = []struct {
+		task string
+		err  bool
+	}{
+		{task: `{"topic": "foo.bar", "partitions": [0, 1], "mode": "latest"}`},
+		{task: `{"topic": "foo.bar"}`, err: true},
+		{task: `{"topic": "Foo", "partitions": []}`, err: true},
+		{task: `{"topic": "foo", "partitions": [1.5]}`, err: true},
+		{task: `{"topic": "foo", "partitions": [-1]}`, err: true},
+		{task: `{"topic": "foo", "partitions": [], "mode": "none"}`, err: true},
+		{task: `{"topic": "foo", "partitions": [], "extra": 1}`, err: true},
+		{task: `foo`, err: true},
+	}
+	for idx, tt := range tests {
+		err := s.validateTask(tt.task)
+		if (err != nil) != tt.err {
+			t.Errorf("idx %d task %s err %v", idx, tt.task, err)
+		}
+	}
+
+	for _, bad := range []string{`{"type": "map"}`, `{"format": "email"}`, `{"pattern": "("}`, `{"properties": {"a": {"oneOf": []}}}`} {
+		if _, err := compileTaskSchema(json.RawMessage(bad), "$"); err == nil {
+			t.Errorf("schema %s expect err", bad)
+		}
+	}
+}
+
+func Test_validateShards(t *testing.T) {
+	var called []string
+	ss := &smShardApi{
+		container: &smContainer{
+			shardValidators: []ShardValidator{
+				func(service string, shardId string, spec *apputil.ShardSpec) error {
+					called = append(called, shardId)
+					if spec.Priority < 0 {
+						return errors.New("negative priority")
+					}
+					return nil
+				},
+			},
+		},
+		lg: ttLogger,
+	}
+	appSpec := &smAppSpec{Service: "foo.bar", TaskSchema: json.RawMessage(`{"type": "object", "required": ["topic"]}`)}
+
+	specs := map[string]*apputil.ShardSpec{
+		"s2": {Task: `{"topic": "t2"}`},
+		"s1": {Task: `{"topic": "t1"}`},
+	}
+	if err := ss.validateShards(appSpec, specs); err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+	if len(called) != 2 || called[0] != "s1" || called[1] != "s2" {
+		t.Fatalf("unexpected validator calls %v", called)
+	}
+
+	if err := ss.validateShards(appSpec, map[string]*apputil.ShardSpec{"s1": {Task: `{}`}}); err == nil {
+		t.Fatal("expect schema err")
+	}
+	if err := ss.validateShards(appSpec, map[string]*apputil.ShardSpec{"s1": {Task: `{"topic": "t1"}`, Priority: -1}}); err == nil {
+		t.Fatal("expect validator err")
+	}
+
+	// 没有schema时task可以不是json
+	if err := ss.validateShards(&smAppSpec{Service: "foo.bar"}, map[string]*apputil.ShardSpec{"s1": {Task: "1"}}); err != nil {
+		t.Fatalf("err: %+v", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// warmCache 非leader的smserver提前watch sm自身的container和shard的heartbeat，
+// 当选leader后直接接管已经构建好的mapper，省掉全量扫描，并且缓存预热时间超过 stabilizationDelay 时不再等待
+type warmCache struct {
+	lg *zap.Logger
+
+	mu sync.Mutex
+	// mpr standby状态的mapper，被leader接管后置空
+	mpr *mapper
+	// warmSince mapper完成全量加载的时间
+	warmSince time.Time
+}
+
+func newWarmCache(lg *zap.Logger) *warmCache {
+	return &warmCache{lg: lg}
+}
+
+// set 保存新构建的standby mapper，已经存在时关闭新的mapper
+func (w *warmCache) set(mpr *mapper) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.mpr != nil {
+		mpr.Close()
+		return
+	}
+	w.mpr = mpr
+	w.warmSince = time.Now()
+}
+
+// ready 缓存中存在standby mapper
+func (w *warmCache) ready() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.mpr != nil
+}
+
+// warmFor 缓存预热的时长，没有缓存时返回0
+func (w *warmCache) warmFor() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.mpr == nil {
+		return 0
+	}
+	return time.Since(w.warmSince)
+}
+
+// take leader接管service对应的standby mapper，使用最新的appSpec
+func (w *warmCache) take(service string, appSpec *smAppSpec) *mapper {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.mpr == nil || w.mpr.appSpec.Service != service {
+		return nil
+	}
+	mpr := w.mpr
+	w.mpr = nil
+	mpr.promote(appSpec)
+	w.lg.Info(
+		"warm mapper taken",
+		zap.String("service", service),
+		zap.Duration("warmFor", time.Since(w.warmSince)),
+	)
+	return mpr
+}
+
+func (w *warmCache) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.mpr != nil {
+		w.mpr.Close()
+		w.mpr = nil
+	}
+}
+
+// warmUp 竞选leader之前构建sm自身的standby mapper，失败时当选后退化为全量扫描
+func (c *smContainer) warmUp(ctx context.Context) {
+	if c.warm.ready() {
+		return
+	}
+	mpr, err := c.newStandbyMapper(ctx)
+	if err != nil {
+		c.lg.Error(
+			"warm up error",
+			zap.String("service", c.Service()),
+			zap.Error(err),
+		)
+		return
+	}
+	c.warm.set(mpr)
+}
+
+func (c *smContainer) newStandbyMapper(ctx context.Context) (*mapper, error) {
+	resp, err := c.Client.GetKV(ctx, c.nodeManager.nodeServiceSpec(c.Service()), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if resp.Count == 0 {
+		return nil, errors.Errorf("service not config %s", c.Service())
+	}
+	var appSpec smAppSpec
+	if err := json.Unmarshal(resp.Kvs[0].Value, &appSpec); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return newStandbyMapper(c.lg, c, &appSpec)
+}
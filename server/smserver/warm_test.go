@@ -0,0 +1,40 @@
+package smserver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_warmCache_take(t *testing.T) {
+	w := newWarmCache(ttLogger)
+	if w.warmFor() != 0 || w.take("foo", &smAppSpec{Service: "foo"}) != nil {
+		t.Error("empty cache should not be taken")
+		t.SkipNow()
+	}
+
+	mpr := &mapper{lg: ttLogger, appSpec: &smAppSpec{Service: "foo"}, standby: true, maxRecoveryTime: defaultMaxRecoveryTime}
+	w.set(mpr)
+	w.warmSince = time.Now().Add(-time.Minute)
+	if w.warmFor() < time.Minute {
+		t.Errorf("warmFor %s", w.warmFor())
+		t.SkipNow()
+	}
+
+	if w.take("bar", &smAppSpec{Service: "bar"}) != nil {
+		t.Error("other service should not take warm mapper")
+		t.SkipNow()
+	}
+
+	got := w.take("foo", &smAppSpec{Service: "foo", MaxRecoveryTime: 5})
+	if got != mpr {
+		t.Error("warm mapper should be taken")
+		t.SkipNow()
+	}
+	if got.isStandby() || got.maxRecoveryTime != 5*time.Second {
+		t.Errorf("promote failed, standby %v, maxRecoveryTime %s", got.isStandby(), got.maxRecoveryTime)
+		t.SkipNow()
+	}
+	if w.ready() || w.take("foo", &smAppSpec{Service: "foo"}) != nil {
+		t.Error("warm mapper should be taken only once")
+	}
+}
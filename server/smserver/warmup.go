@@ -0,0 +1,159 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// defaultWarmupWindow container启动后按照新container处理的时间
+const defaultWarmupWindow = 300 * time.Second
+
+// warmupSpec 新启动的container分批接收shard，每批之间至少间隔Interval，
+// 批次中的shard声明了更长的Warmup时等待shard预热完成
+type warmupSpec struct {
+	// Batch 每批下发给新container的shard数量
+	Batch int `json:"batch"`
+
+	// Interval 两批之间的最小间隔，单位s
+	Interval int `json:"interval"`
+
+	// Window container进程启动后多久之内分批接收，单位s，<=0时使用默认的300s
+	Window int `json:"window,omitempty"`
+}
+
+func (w *warmupSpec) Validate() error {
+	if w.Batch < 1 {
+		return errors.Errorf("warmup batch %d should be positive", w.Batch)
+	}
+	if w.Interval < 0 || w.Window < 0 {
+		return errors.New("warmup interval and window should not be negative")
+	}
+	return nil
+}
+
+func (w *warmupSpec) window() time.Duration {
+	if w.Window <= 0 {
+		return defaultWarmupWindow
+	}
+	return time.Duration(w.Window) * time.Second
+}
+
+// warmupThrottle 记录每个新container下一批shard最早的下发时间，leader切换后重新开始记录
+type warmupThrottle struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+func newWarmupThrottle() *warmupThrottle {
+	return &warmupThrottle{next: make(map[string]time.Time)}
+}
+
+// stagger 返回本轮可以下发的move和推迟到之后的move，starts是container进程启动的unix秒。
+// 人工指定container的shard不受限制；没有drop的add（新增或者container丢失后没有归属的shard）优先保证可用，
+// 不推迟，但是占用批次的额度；从其他container迁移过来的shard超出额度时推迟，shard留在原来的container上
+func (t *warmupThrottle) stagger(spec *warmupSpec, starts map[string]int64, mals moveActionList, now time.Time) (moveActionList, moveActionList) {
+	if spec == nil || len(mals) == 0 {
+		return mals, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	warming := func(containerId string) bool {
+		start := starts[containerId]
+		return start > 0 && now.Sub(time.Unix(start, 0)) < spec.window()
+	}
+	for containerId := range t.next {
+		if !warming(containerId) {
+			delete(t.next, containerId)
+		}
+	}
+
+	budgets := make(map[string]int)
+	waits := make(map[string]time.Duration)
+	var allowed, deferred moveActionList
+	for _, ma := range mals {
+		id := ma.AddEndpoint
+		if id == "" || !warming(id) || (ma.Spec != nil && ma.Spec.ManualContainerId == id) {
+			allowed = append(allowed, ma)
+			continue
+		}
+		budget, ok := budgets[id]
+		if !ok {
+			if now.Before(t.next[id]) {
+				budget = 0
+			} else {
+				budget = spec.Batch
+			}
+		}
+		if budget <= 0 && ma.DropEndpoint != "" {
+			budgets[id] = budget
+			deferred = append(deferred, ma)
+			continue
+		}
+		if budget > 0 {
+			budget--
+		}
+		budgets[id] = budget
+		allowed = append(allowed, ma)
+
+		wait := time.Duration(spec.Interval) * time.Second
+		if ma.Spec != nil && time.Duration(ma.Spec.Warmup)*time.Second > wait {
+			wait = time.Duration(ma.Spec.Warmup) * time.Second
+		}
+		if wait > waits[id] {
+			waits[id] = wait
+		}
+	}
+	for id, wait := range waits {
+		// 没有归属的shard不受额度限制，不能提前上一批的预热时间
+		if next := now.Add(wait); next.After(t.next[id]) {
+			t.next[id] = next
+		}
+	}
+	return allowed, deferred
+}
+
+// staggerWarmup 推迟的move不会进入队列，下一轮balance check重新计算
+func (ss *smShard) staggerWarmup(events []*balanceEvent, now time.Time) []*balanceEvent {
+	spec := ss.spec()
+	if spec == nil || spec.Warmup == nil || ss.warmup == nil || ss.mpr == nil {
+		return events
+	}
+	starts := make(map[string]int64)
+	for id, cd := range ss.mpr.ContainerDeployments() {
+		starts[id] = cd.startTime
+	}
+
+	var r []*balanceEvent
+	for _, be := range events {
+		allowed, deferred := ss.warmup.stagger(spec.Warmup, starts, be.mals, now)
+		if len(deferred) > 0 {
+			ss.lg.Info(
+				"container warming up, defer moves",
+				zap.String("service", ss.service),
+				zap.Reflect("deferred", deferred),
+			)
+		}
+		if len(allowed) > 0 {
+			r = append(r, &balanceEvent{typ: be.typ, mals: allowed})
+		}
+	}
+	return r
+}
@@ -0,0 +1,55 @@
+package smserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_warmupThrottle_stagger(t *testing.T) {
+	now := time.Now()
+	spec := &warmupSpec{Batch: 2, Interval: 10}
+	// c2刚启动，c1启动超过了window
+	starts := map[string]int64{"c1": now.Add(-time.Hour).Unix(), "c2": now.Add(-time.Minute).Unix()}
+	move := func(shardId string, from string, to string, warmup int) *moveAction {
+		return &moveAction{ShardId: shardId, DropEndpoint: from, AddEndpoint: to, Spec: &apputil.ShardSpec{Warmup: warmup}}
+	}
+
+	w := newWarmupThrottle()
+	mals := moveActionList{
+		move("s1", "c1", "c2", 0),
+		move("s2", "c1", "c2", 30),
+		move("s3", "c1", "c2", 0),
+		move("s4", "c2", "c1", 0),
+	}
+	allowed, deferred := w.stagger(spec, starts, mals, now)
+	assert.Equal(t, moveActionList{mals[0], mals[1], mals[3]}, allowed)
+	assert.Equal(t, moveActionList{mals[2]}, deferred)
+
+	// 批次中s2的warmup更长，interval之后仍然等待
+	allowed, deferred = w.stagger(spec, starts, moveActionList{mals[2]}, now.Add(15*time.Second))
+	assert.Empty(t, allowed)
+	assert.Equal(t, moveActionList{mals[2]}, deferred)
+
+	// 没有归属的shard不推迟，人工指定的shard不受限制
+	unassigned := move("s5", "", "c2", 0)
+	manual := move("s6", "c1", "c2", 0)
+	manual.Spec.ManualContainerId = "c2"
+	allowed, deferred = w.stagger(spec, starts, moveActionList{unassigned, manual, mals[2]}, now.Add(15*time.Second))
+	assert.Equal(t, moveActionList{unassigned, manual}, allowed)
+	assert.Equal(t, moveActionList{mals[2]}, deferred)
+	allowed, _ = w.stagger(spec, starts, moveActionList{mals[2]}, now.Add(28*time.Second))
+	assert.Empty(t, allowed)
+
+	// 预热完成后下发下一批
+	allowed, deferred = w.stagger(spec, starts, moveActionList{mals[2]}, now.Add(time.Minute))
+	assert.Equal(t, moveActionList{mals[2]}, allowed)
+	assert.Empty(t, deferred)
+
+	// 超过window之后不再分批
+	allowed, deferred = w.stagger(spec, starts, mals[:3], now.Add(10*time.Minute))
+	assert.Equal(t, mals[:3], allowed)
+	assert.Empty(t, deferred)
+}
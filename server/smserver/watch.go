@@ -0,0 +1,186 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+type watchEventType string
+
+const (
+	watchShardAssigned   watchEventType = "shardAssigned"
+	watchShardDropped    watchEventType = "shardDropped"
+	watchContainerJoined watchEventType = "containerJoined"
+	watchContainerLeft   watchEventType = "containerLeft"
+	watchLeaderChanged   watchEventType = "leaderChanged"
+
+	// watchKeepAlive 没有事件时发送注释，防止代理断开空闲连接
+	watchKeepAlive = 15 * time.Second
+)
+
+// watchEvent /sm/server/watch 推送的一条事件，对应etcd中heartbeat或者leader term的变化
+type watchEvent struct {
+	Type        watchEventType `json:"type"`
+	Service     string         `json:"service"`
+	ShardId     string         `json:"shardId,omitempty"`
+	ContainerId string         `json:"containerId,omitempty"`
+
+	// Term leaderChanged时的任期
+	Term int64 `json:"term,omitempty"`
+
+	// Revision etcd revision，客户端可以用来去重
+	Revision int64 `json:"revision"`
+}
+
+// heartbeatId heartbeat的key是 <dir>/<id>/<lease>，id在倒数第二段
+func heartbeatId(key string) string {
+	arr := strings.Split(key, "/")
+	if len(arr) < 2 {
+		return ""
+	}
+	return arr[len(arr)-2]
+}
+
+// shardWatchEvent shard heartbeat创建和删除对应shard的add和drop，heartbeat刷新不推送
+func shardWatchEvent(service string, ev *clientv3.Event) *watchEvent {
+	we := watchEvent{Service: service, ShardId: heartbeatId(string(ev.Kv.Key)), Revision: ev.Kv.ModRevision}
+	kv := ev.Kv
+	switch {
+	case ev.Type == mvccpb.DELETE:
+		we.Type = watchShardDropped
+		kv = ev.PrevKv
+	case ev.IsCreate():
+		we.Type = watchShardAssigned
+	default:
+		return nil
+	}
+	if kv != nil {
+		var hb apputil.ShardHeartbeat
+		if err := json.Unmarshal(kv.Value, &hb); err == nil {
+			we.ContainerId = hb.ContainerId
+		}
+	}
+	return &we
+}
+
+// containerWatchEvent container heartbeat创建和删除对应container的加入和离开
+func containerWatchEvent(service string, ev *clientv3.Event) *watchEvent {
+	we := watchEvent{Service: service, ContainerId: heartbeatId(string(ev.Kv.Key)), Revision: ev.Kv.ModRevision}
+	switch {
+	case ev.Type == mvccpb.DELETE:
+		we.Type = watchContainerLeft
+	case ev.IsCreate():
+		we.Type = watchContainerJoined
+	default:
+		return nil
+	}
+	return &we
+}
+
+// leaderWatchEvent 新的leader当选后写入term
+func leaderWatchEvent(service string, ev *clientv3.Event) *watchEvent {
+	if ev.Type != mvccpb.PUT {
+		return nil
+	}
+	var term leaderTerm
+	if err := json.Unmarshal(ev.Kv.Value, &term); err != nil {
+		return nil
+	}
+	return &watchEvent{Type: watchLeaderChanged, Service: service, ContainerId: term.ContainerId, Term: term.Term, Revision: ev.Kv.ModRevision}
+}
+
+// @Description stream shard assignment changes, container joins and leaves and leader changes as server-sent events
+// @Tags  shard
+// @Produce  text/event-stream
+// @Param service query string true "param"
+// @success 200
+// @Router /sm/server/watch [get]
+func (ss *smShardApi) GinWatch(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	// 请求结束时取消etcd的watch
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	nm := ss.container.nodeManager
+	shardc := ss.container.Client.Watch(ctx, nm.nodeServiceShardHb(service), clientv3.WithPrefix(), clientv3.WithPrevKV())
+	containerc := ss.container.Client.Watch(ctx, nm.nodeServiceContainerHb(service), clientv3.WithPrefix())
+	termc := ss.container.Client.Watch(ctx, nm.nodeSMTerm())
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(200)
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(watchKeepAlive)
+	defer ticker.Stop()
+	for {
+		var (
+			wr    clientv3.WatchResponse
+			ok    bool
+			parse func(service string, ev *clientv3.Event) *watchEvent
+		)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = c.Writer.WriteString(": keepalive\n\n")
+			c.Writer.Flush()
+			continue
+		case wr, ok = <-shardc:
+			parse = shardWatchEvent
+		case wr, ok = <-containerc:
+			parse = containerWatchEvent
+		case wr, ok = <-termc:
+			parse = leaderWatchEvent
+		}
+		if !ok || wr.Err() != nil {
+			// watch被etcd取消，例如revision被compact，客户端重新连接即可
+			err := wr.Err()
+			if err == nil {
+				err = errors.New("watch closed")
+			}
+			ss.lg.Warn("watch stopped", zap.String("service", service), zap.Error(err))
+			c.SSEvent("error", gin.H{"error": err.Error()})
+			c.Writer.Flush()
+			return
+		}
+		for _, ev := range wr.Events {
+			if we := parse(service, ev); we != nil {
+				c.SSEvent(string(we.Type), we)
+			}
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,81 @@
+package smserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func (suite *ApiTestSuite) TestGinWatch_emptyService() {
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/watch", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+	assert.Equal(suite.T(), w.Code, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestGinWatch_success() {
+	shardc := make(chan clientv3.WatchResponse)
+	containerc := make(chan clientv3.WatchResponse)
+	termc := make(chan clientv3.WatchResponse)
+	mockedEtcdWrapper := new(MockedEtcdWrapper)
+	mockedEtcdWrapper.On("Watch", mock.Anything, "/sm/app/serviceA/shardhb/").Return(clientv3.WatchChan(shardc))
+	mockedEtcdWrapper.On("Watch", mock.Anything, "/sm/app/serviceA/containerhb/").Return(clientv3.WatchChan(containerc))
+	mockedEtcdWrapper.On("Watch", mock.Anything, "/sm/app/foo/term").Return(clientv3.WatchChan(termc))
+	suite.container.Client = mockedEtcdWrapper
+
+	go func() {
+		shardc <- clientv3.WatchResponse{Events: []*clientv3.Event{
+			{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/sm/app/serviceA/shardhb/s1/1a"), Value: []byte(`{"containerId":"c1"}`), CreateRevision: 5, ModRevision: 5}},
+			// heartbeat刷新不推送
+			{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/sm/app/serviceA/shardhb/s2/1a"), Value: []byte(`{"containerId":"c1"}`), CreateRevision: 4, ModRevision: 6}},
+		}}
+		containerc <- clientv3.WatchResponse{Events: []*clientv3.Event{
+			{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte("/sm/app/serviceA/containerhb/c2/2b"), ModRevision: 7}},
+		}}
+		termc <- clientv3.WatchResponse{Events: []*clientv3.Event{
+			{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/sm/app/foo/term"), Value: []byte(`{"term":3,"containerId":"sm1"}`), ModRevision: 8}},
+		}}
+		close(termc)
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/sm/server/watch?service=serviceA", nil)
+	w := httptest.NewRecorder()
+	suite.testRouter.ServeHTTP(w, req)
+
+	body := w.Body.String()
+	assert.Equal(suite.T(), w.Code, http.StatusOK)
+	assert.Contains(suite.T(), body, `event:shardAssigned`)
+	assert.Contains(suite.T(), body, `"shardId":"s1","containerId":"c1"`)
+	assert.NotContains(suite.T(), body, `"shardId":"s2"`)
+	assert.Contains(suite.T(), body, `event:containerLeft`)
+	assert.Contains(suite.T(), body, `"containerId":"c2"`)
+	assert.Contains(suite.T(), body, `event:leaderChanged`)
+	assert.Contains(suite.T(), body, `"term":3`)
+	// 按照etcd的顺序推送，watch关闭后结束
+	assert.True(suite.T(), strings.Index(body, "shardAssigned") < strings.Index(body, "containerLeft"))
+	assert.Contains(suite.T(), body, `event:error`)
+}
+
+func Test_shardWatchEvent(t *testing.T) {
+	// drop时从PrevKv中获取container
+	ev := &clientv3.Event{
+		Type:   mvccpb.DELETE,
+		Kv:     &mvccpb.KeyValue{Key: []byte("/sm/app/foo.bar/shardhb/s1/1a"), ModRevision: 9},
+		PrevKv: &mvccpb.KeyValue{Value: []byte(`{"containerId":"c1"}`)},
+	}
+	we := shardWatchEvent("foo.bar", ev)
+	if we == nil || we.Type != watchShardDropped || we.ShardId != "s1" || we.ContainerId != "c1" || we.Revision != 9 {
+		t.Errorf("unexpected event %+v", we)
+	}
+
+	ev = &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/sm/app/foo.bar/containerhb/c1/1a"), CreateRevision: 3, ModRevision: 3}}
+	if we := containerWatchEvent("foo.bar", ev); we == nil || we.Type != watchContainerJoined || we.ContainerId != "c1" {
+		t.Errorf("unexpected event %+v", we)
+	}
+}
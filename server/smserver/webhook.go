@@ -0,0 +1,448 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/entertainment-venue/sm/pkg/etcdutil"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/zd3tl/evtrigger"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookTrigger = "webhookTrigger"
+
+	// webhookSignatureHeader 配置了secret时，body的hmac-sha256签名，格式为 sha256=<hex>
+	webhookSignatureHeader = "X-SM-Signature"
+
+	// defaultWebhookRetry 投递失败后的重试次数
+	defaultWebhookRetry = 3
+	// defaultWebhookBackoff 第一次重试前的等待时间，之后每次翻倍
+	defaultWebhookBackoff = time.Second
+)
+
+type webhookEventType string
+
+const (
+	webhookEventAssigned webhookEventType = "assigned"
+	webhookEventDropped  webhookEventType = "dropped"
+	webhookEventMoved    webhookEventType = "moved"
+)
+
+// webhook service注册的回调地址
+type webhook struct {
+	Id      string `json:"id"`
+	Service string `json:"service"`
+	URL     string `json:"url"`
+
+	// Secret 用于签名，查询时不返回
+	Secret string `json:"secret,omitempty"`
+
+	CreateTime int64 `json:"createTime"`
+}
+
+func (w *webhook) String() string {
+	b, _ := json.Marshal(w)
+	return string(b)
+}
+
+// webhookEvent 投递给webhook的内容，对应一个执行成功的move
+type webhookEvent struct {
+	Type    webhookEventType `json:"type"`
+	Service string           `json:"service"`
+	ShardId string           `json:"shardId"`
+
+	// From 和To 分别是drop和add的container
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	Timestamp int64 `json:"timestamp"`
+}
+
+func newWebhookEvent(ma *moveAction) *webhookEvent {
+	ev := webhookEvent{
+		Service:   ma.Service,
+		ShardId:   ma.ShardId,
+		From:      ma.DropEndpoint,
+		To:        ma.AddEndpoint,
+		Timestamp: time.Now().Unix(),
+	}
+	switch {
+	case ma.DropEndpoint != "" && ma.AddEndpoint != "":
+		ev.Type = webhookEventMoved
+	case ma.AddEndpoint != "":
+		ev.Type = webhookEventAssigned
+	default:
+		ev.Type = webhookEventDropped
+	}
+	return &ev
+}
+
+// webhookStatus webhook的投递状态
+type webhookStatus struct {
+	LastEvent *webhookEvent `json:"lastEvent"`
+
+	// LastDeliveryTime unix秒
+	LastDeliveryTime int64  `json:"lastDeliveryTime"`
+	LastStatusCode   int    `json:"lastStatusCode"`
+	LastError        string `json:"lastError,omitempty"`
+	LastAttempts     int    `json:"lastAttempts"`
+
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+}
+
+func (s *webhookStatus) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// webhookNotifier move执行成功后异步通知service注册的webhook，不阻塞move
+type webhookNotifier struct {
+	lg          *zap.Logger
+	client      etcdutil.EtcdWrapper
+	nodeManager *nodeManager
+	httpClient  *http.Client
+
+	trigger *evtrigger.Trigger
+	donec   chan struct{}
+
+	retry   int
+	backoff time.Duration
+
+	// queued 等待投递的事件数量，debug使用
+	queued int64
+}
+
+func newWebhookNotifier(lg *zap.Logger, client etcdutil.EtcdWrapper, nodeManager *nodeManager) *webhookNotifier {
+	n := webhookNotifier{
+		lg:          lg,
+		client:      client,
+		nodeManager: nodeManager,
+		httpClient:  newHttpClient(),
+		donec:       make(chan struct{}),
+		retry:       defaultWebhookRetry,
+		backoff:     defaultWebhookBackoff,
+	}
+	n.trigger, _ = evtrigger.NewTrigger(
+		evtrigger.WithLogger(lg),
+		evtrigger.WithWorkerSize(1),
+	)
+	_ = n.trigger.Register(webhookTrigger, n.process)
+	return &n
+}
+
+func (n *webhookNotifier) Close() {
+	close(n.donec)
+	n.trigger.Close()
+}
+
+// notify 只通知执行成功的move
+func (n *webhookNotifier) notify(ma *moveAction) {
+	if n == nil {
+		return
+	}
+	if err := n.trigger.Put(&evtrigger.TriggerEvent{Key: webhookTrigger, Value: newWebhookEvent(ma)}); err == nil {
+		atomic.AddInt64(&n.queued, 1)
+	}
+}
+
+// queueDepth 等待投递的事件数量
+func (n *webhookNotifier) queueDepth() int64 {
+	if n == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&n.queued)
+}
+
+func (n *webhookNotifier) process(_ string, value interface{}) error {
+	ev := value.(*webhookEvent)
+	atomic.AddInt64(&n.queued, -1)
+	hooks, err := n.list(context.TODO(), ev.Service)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	for _, hook := range hooks {
+		attempts, code, err := n.deliver(hook, ev)
+		if err := n.updateStatus(hook, ev, attempts, code, err); err != nil {
+			n.lg.Error(
+				"update webhook status error",
+				zap.String("id", hook.Id),
+				zap.String("service", hook.Service),
+				zap.Error(err),
+			)
+		}
+	}
+	return nil
+}
+
+// deliver 失败后按照指数退避重试，返回执行的次数、最后一次的http状态码和错误
+func (n *webhookNotifier) deliver(hook *webhook, ev *webhookEvent) (int, int, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "")
+	}
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		code, err := n.post(hook, body)
+		if err == nil || attempt > n.retry {
+			return attempt, code, err
+		}
+		n.lg.Warn(
+			"deliver webhook error, retry later",
+			zap.String("url", hook.URL),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+		select {
+		case <-n.donec:
+			return attempt, code, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) post(hook *webhook, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(hook.Secret, body))
+	}
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, errors.Errorf("webhook %s response %d", hook.URL, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookSignature 接收方使用相同的secret计算body的签名并比较
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *webhookNotifier) updateStatus(hook *webhook, ev *webhookEvent, attempts int, code int, deliverErr error) error {
+	status, err := n.status(context.TODO(), hook.Service, hook.Id)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	status.LastEvent = ev
+	status.LastDeliveryTime = time.Now().Unix()
+	status.LastStatusCode = code
+	status.LastAttempts = attempts
+	status.LastError = ""
+	if deliverErr != nil {
+		status.LastError = deliverErr.Error()
+		status.Failed++
+	} else {
+		status.Delivered++
+	}
+	_, err = n.client.Put(context.TODO(), n.nodeManager.nodeServiceWebhookStatus(hook.Service)+hook.Id, status.String())
+	return errors.Wrap(err, "")
+}
+
+// status 没有投递过时返回零值
+func (n *webhookNotifier) status(ctx context.Context, service string, id string) (*webhookStatus, error) {
+	resp, err := n.client.GetKV(ctx, n.nodeManager.nodeServiceWebhookStatus(service)+id, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var status webhookStatus
+	if resp.Count == 0 {
+		return &status, nil
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, &status); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return &status, nil
+}
+
+func (n *webhookNotifier) list(ctx context.Context, service string) ([]*webhook, error) {
+	resp, err := n.client.GetKV(ctx, n.nodeManager.nodeServiceWebhook(service), []clientv3.OpOption{clientv3.WithPrefix()})
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var hooks []*webhook
+	for _, kv := range resp.Kvs {
+		var hook webhook
+		if err := json.Unmarshal(kv.Value, &hook); err != nil {
+			n.lg.Warn(
+				"unexpected webhook",
+				zap.String("key", string(kv.Key)),
+				zap.Error(err),
+			)
+			continue
+		}
+		hooks = append(hooks, &hook)
+	}
+	return hooks, nil
+}
+
+type addWebhookRequest struct {
+	Service string `json:"service" binding:"required"`
+	URL     string `json:"url" binding:"required"`
+	Secret  string `json:"secret"`
+}
+
+// @Description register a webhook notified when shards of the service are assigned, dropped or moved
+// @Tags  webhook
+// @Accept  json
+// @Produce  json
+// @Param param body addWebhookRequest true "param"
+// @success 200
+// @Router /sm/server/add-webhook [post]
+func (ss *smShardApi) GinAddWebhook(c *gin.Context) {
+	var req addWebhookRequest
+	if err := c.ShouldBind(&req); err != nil {
+		ss.lg.Error("ShouldBind err", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		err := errors.Errorf("invalid url %s", req.URL)
+		ss.lg.Error("url error", zap.Error(err))
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	hook := webhook{
+		Id:         strconv.FormatInt(time.Now().UnixNano(), 10),
+		Service:    req.Service,
+		URL:        req.URL,
+		Secret:     req.Secret,
+		CreateTime: time.Now().Unix(),
+	}
+	key := ss.container.nodeManager.nodeServiceWebhook(req.Service) + hook.Id
+	if err := ss.container.Client.CreateAndGet(context.TODO(), []string{key}, []string{hook.String()}, clientv3.NoLease); err != nil {
+		ss.lg.Error("CreateAndGet err",
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		apiErrorResponse(c, etcdErrCode(err, errCodeConflict), err)
+		return
+	}
+	ss.container.events.append(eventSpecChange, req.Service, c.ClientIP(), fmt.Sprintf("add webhook %s %s", hook.Id, hook.URL))
+	ss.lg.Info(
+		"add webhook success",
+		zap.String("service", req.Service),
+		zap.String("id", hook.Id),
+		zap.String("url", hook.URL),
+	)
+	c.JSON(http.StatusOK, gin.H{"id": hook.Id})
+}
+
+// @Description delete webhook of the service
+// @Tags  webhook
+// @Produce  json
+// @Param service query string true "param"
+// @Param id query string true "param"
+// @success 200
+// @Router /sm/server/del-webhook [get]
+func (ss *smShardApi) GinDelWebhook(c *gin.Context) {
+	service, id := c.Query("service"), c.Query("id")
+	if service == "" || id == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service or id",
+			zap.String("service", service),
+			zap.String("id", id),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+	for _, key := range []string{
+		ss.container.nodeManager.nodeServiceWebhook(service) + id,
+		ss.container.nodeManager.nodeServiceWebhookStatus(service) + id,
+	} {
+		if _, err := ss.container.Client.Delete(context.TODO(), key); err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+	}
+	ss.container.events.append(eventSpecChange, service, c.ClientIP(), "delete webhook "+id)
+	ss.lg.Info(
+		"delete webhook success",
+		zap.String("service", service),
+		zap.String("id", id),
+	)
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+type webhookWithStatus struct {
+	*webhook
+	Status *webhookStatus `json:"status"`
+}
+
+// @Description list webhooks of the service with delivery status
+// @Tags  webhook
+// @Produce  json
+// @Param service query string true "param"
+// @success 200
+// @Router /sm/server/webhooks [get]
+func (ss *smShardApi) GinWebhooks(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		err := errors.Errorf("param error")
+		ss.lg.Error(
+			"empty service",
+			zap.String("service", service),
+		)
+		apiErrorResponse(c, errCodeParam, err)
+		return
+	}
+
+	hooks, err := ss.container.webhooks.list(context.TODO(), service)
+	if err != nil {
+		apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+		return
+	}
+	var r []*webhookWithStatus
+	for _, hook := range hooks {
+		status, err := ss.container.webhooks.status(context.TODO(), service, hook.Id)
+		if err != nil {
+			apiErrorResponse(c, etcdErrCode(err, errCodeInternal), err)
+			return
+		}
+		hook.Secret = ""
+		r = append(r, &webhookWithStatus{webhook: hook, Status: status})
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": r})
+}
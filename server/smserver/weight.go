@@ -0,0 +1,104 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"sort"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+)
+
+// shardWeight 没有设置weight的shard按照1计算
+func shardWeight(spec *apputil.ShardSpec) int {
+	if spec == nil || spec.Weight <= 0 {
+		return 1
+	}
+	return spec.Weight
+}
+
+// weightOf 返回按照shard id查询weight的函数，shardIdAndShardSpec中不存在的shard按照1计算
+func weightOf(shardIdAndShardSpec map[string]*apputil.ShardSpec) func(shardId string) int {
+	return func(shardId string) int {
+		return shardWeight(shardIdAndShardSpec[shardId])
+	}
+}
+
+// weighted shard中存在weight大于1的shard时，按照shard数量的分配方式不能均衡weight，需要逐个shard选择负载最低的container
+func weighted(shardIds []string, weightOf func(shardId string) int) bool {
+	for _, shardId := range shardIds {
+		if weightOf(shardId) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// totalWeight shard的weight之和，weight都为1时等于shard数量
+func totalWeight(shardIds []string, weightOf func(shardId string) int) int {
+	var r int
+	for _, shardId := range shardIds {
+		r += weightOf(shardId)
+	}
+	return r
+}
+
+// overweight container持有的weight超过maxHold，并且可以通过移走某个shard降低超出的部分，
+// 单个shard的weight超过maxHold时移走也不能均衡，不认为超出
+func overweight(shardIds []string, weightOf func(shardId string) int, maxHold int) bool {
+	excess := totalWeight(shardIds, weightOf) - maxHold
+	if excess <= 0 {
+		return false
+	}
+	for _, shardId := range shardIds {
+		if weightOf(shardId) <= excess {
+			return true
+		}
+	}
+	return false
+}
+
+// load container持有的shard的weight之和
+func (bc *balancerContainer) load() int {
+	var r int
+	for _, bs := range bc.shards {
+		r += bs.weight
+	}
+	return r
+}
+
+// lightest 返回可以接收shard的container中weight之和最小的，相同时按照container id选择，保证结果稳定，
+// limit大于0时container接收shard后的weight不能超过limit，没有可以接收的container时返回nil
+func (b *balancer) lightest(shardId string, weight int, limit int) *balancerContainer {
+	var ids []string
+	for id := range b.bcs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var r *balancerContainer
+	for _, id := range ids {
+		bc := b.bcs[id]
+		if bc.hasReplica(shardId) || !b.allowed(bc, shardId) {
+			continue
+		}
+		if limit > 0 && bc.load()+weight > limit {
+			continue
+		}
+		if r == nil || bc.load() < r.load() {
+			r = bc
+		}
+	}
+	return r
+}
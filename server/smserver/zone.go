@@ -0,0 +1,165 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smserver
+
+import (
+	"sort"
+
+	"github.com/entertainment-venue/sm/pkg/apputil"
+)
+
+// spreadPolicyZone 同一个shard的副本分散到不同zone
+const spreadPolicyZone = "zone"
+
+// setZones 记录container所在zone，没有上报zone的container视为在同一个zone
+func (b *balancer) setZones(containerIdAndZone ArmorMap) {
+	for id, bc := range b.bcs {
+		bc.zone = containerIdAndZone[id]
+	}
+}
+
+// replicaZones shard的所有副本在每个zone上的数量
+func (b *balancer) replicaZones(id string) map[string]int {
+	shardId, _ := apputil.ParseReplicaShardId(id)
+	r := make(map[string]int)
+	b.forEach(func(bc *balancerContainer) {
+		for _, bs := range bc.shards {
+			if sid, _ := apputil.ParseReplicaShardId(bs.id); sid == shardId {
+				r[bc.zone]++
+			}
+		}
+	})
+	return r
+}
+
+// zoneConflicts 同一个shard的多个副本在同一个zone，并且存在没有副本的zone中有持有shard更少的container时，
+// 返回需要移走的副本和所在container，primary优先保留，不为了zone分散打破container之间的均衡
+func (b *balancer) zoneConflicts() map[string]string {
+	type located struct {
+		bs *balancerShard
+		bc *balancerContainer
+	}
+	// shard => zone => 副本
+	shardIdAndZoneReplicas := make(map[string]map[string][]*located)
+	b.forEachSorted(func(bc *balancerContainer) {
+		for _, bs := range bc.shards {
+			shardId, _ := apputil.ParseReplicaShardId(bs.id)
+			zoneReplicas, ok := shardIdAndZoneReplicas[shardId]
+			if !ok {
+				zoneReplicas = make(map[string][]*located)
+				shardIdAndZoneReplicas[shardId] = zoneReplicas
+			}
+			zoneReplicas[bc.zone] = append(zoneReplicas[bc.zone], &located{bs: bs, bc: bc})
+		}
+	})
+
+	r := make(map[string]string)
+	for _, zoneReplicas := range shardIdAndZoneReplicas {
+		var zones []string
+		for zone := range zoneReplicas {
+			zones = append(zones, zone)
+		}
+		sort.Strings(zones)
+
+		for _, zone := range zones {
+			replicas := zoneReplicas[zone]
+			sort.Slice(replicas, func(i, j int) bool {
+				_, ri := apputil.ParseReplicaShardId(replicas[i].bs.id)
+				_, rj := apputil.ParseReplicaShardId(replicas[j].bs.id)
+				return ri < rj
+			})
+			for _, l := range replicas[1:] {
+				if l.bs.isManual {
+					continue
+				}
+
+				// 找到没有副本的zone中持有shard更少的container才移动
+				var target *balancerContainer
+				b.forEachSorted(func(bc *balancerContainer) {
+					if _, ok := zoneReplicas[bc.zone]; ok || target != nil {
+						return
+					}
+					if len(bc.shards) < len(l.bc.shards) {
+						target = bc
+					}
+				})
+				if target == nil {
+					break
+				}
+				r[l.bs.id] = l.bc.id
+				// 目标zone视为已经有副本，避免多个副本移动到同一个zone
+				zoneReplicas[target.zone] = append(zoneReplicas[target.zone], l)
+			}
+		}
+	}
+	return r
+}
+
+// pickContainer spread为zone时为shard选择container，在quota以内、没有该shard副本且满足placement约束的container中：
+// 1 优先选择没有该shard副本的zone
+// 2 移动的shard优先留在原zone，减少跨zone流量
+// 3 持有shard的weight之和少的container优先，最后按照container id保证结果稳定
+func (b *balancer) pickContainer(shardId string, from string, quota func(bc *balancerContainer) int) *balancerContainer {
+	replicaZones := b.replicaZones(shardId)
+	fromBc, moved := b.bcs[from]
+
+	var (
+		r        *balancerContainer
+		bestRank [3]int
+	)
+	b.forEachSorted(func(bc *balancerContainer) {
+		if bc.load() >= quota(bc) || bc.hasReplica(shardId) || !b.allowed(bc, shardId) {
+			return
+		}
+
+		var rank [3]int
+		if replicaZones[bc.zone] > 0 {
+			rank[0] = 1
+		}
+		if moved && bc.zone != fromBc.zone {
+			rank[1] = 1
+		}
+		rank[2] = bc.load()
+
+		// forEachSorted保证相同rank时选择id小的container
+		if r == nil || rankLess(rank, bestRank) {
+			r = bc
+			bestRank = rank
+		}
+	})
+	return r
+}
+
+func rankLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// zoneConflicted 判断group中是否有需要分散到其他zone的副本
+func zoneConflicted(bg *balancerGroup, containerIdAndZone ArmorMap) bool {
+	br := &balancer{bcs: make(map[string]*balancerContainer)}
+	for shardId, containerId := range bg.hbShardIdAndContainerId {
+		br.put(containerId, shardId, bg.fixShardIdAndManualContainerId[shardId] != "", 0, 1)
+	}
+	for containerId := range containerIdAndZone {
+		br.addContainer(containerId)
+	}
+	br.setZones(containerIdAndZone)
+	return len(br.zoneConflicts()) > 0
+}
@@ -0,0 +1,108 @@
+package smserver
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func Test_rebalance_zone(t *testing.T) {
+	service := "foo.bar"
+	var tests = []struct {
+		fixShardIdAndManualContainerId ArmorMap
+		hbContainerIdAndAny            ArmorMap
+		hbShardIdAndContainerId        ArmorMap
+		expect                         moveActionList
+	}{
+		// 新增shard的副本分配到不同zone
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1":   "",
+				"s1#1": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "a",
+				"c2": "a",
+				"c3": "b",
+			},
+			hbShardIdAndContainerId: ArmorMap{},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", AddEndpoint: "c1"},
+				&moveAction{Service: service, ShardId: "s1#1", AddEndpoint: "c3"},
+			},
+		},
+
+		// 副本在同一个zone，移动到没有副本的zone
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1":   "",
+				"s1#1": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "a",
+				"c2": "a",
+				"c3": "b",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1":   "c1",
+				"s1#1": "c2",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1#1", DropEndpoint: "c2", AddEndpoint: "c3"},
+			},
+		},
+
+		// 移动的shard优先留在原zone
+		{
+			fixShardIdAndManualContainerId: ArmorMap{
+				"s1": "",
+				"s2": "",
+				"s3": "",
+				"s4": "",
+			},
+			hbContainerIdAndAny: ArmorMap{
+				"c1": "a",
+				"c2": "a",
+				"c3": "b",
+			},
+			hbShardIdAndContainerId: ArmorMap{
+				"s1": "c1",
+				"s2": "c1",
+				"s3": "c1",
+				"s4": "c3",
+			},
+			expect: moveActionList{
+				&moveAction{Service: service, ShardId: "s1", DropEndpoint: "c1", AddEndpoint: "c2"},
+			},
+		},
+	}
+
+	logger, _ := zap.NewDevelopment()
+	w := smShard{service: service, lg: logger, appSpec: &smAppSpec{SpreadPolicy: spreadPolicyZone}}
+
+	for idx, tt := range tests {
+		r := w.rebalance(tt.fixShardIdAndManualContainerId, tt.hbContainerIdAndAny, tt.hbShardIdAndContainerId, nil)
+		if !reflect.DeepEqual(r, tt.expect) {
+			t.Errorf("idx: %d actual: %s, expect: %s", idx, r.String(), tt.expect.String())
+			t.SkipNow()
+		}
+	}
+}
+
+func Test_zoneConflicted(t *testing.T) {
+	bg := &balancerGroup{
+		fixShardIdAndManualContainerId: ArmorMap{"s1": "", "s1#1": ""},
+		hbShardIdAndContainerId:        ArmorMap{"s1": "c1", "s1#1": "c2"},
+	}
+	if !zoneConflicted(bg, ArmorMap{"c1": "a", "c2": "a", "c3": "b"}) {
+		t.Error("replicas in zone a should be conflicted")
+	}
+	if zoneConflicted(bg, ArmorMap{"c1": "a", "c2": "b", "c3": "b"}) {
+		t.Error("replicas in different zones should not be conflicted")
+	}
+	// 没有其他zone可以接收
+	if zoneConflicted(bg, ArmorMap{"c1": "a", "c2": "a"}) {
+		t.Error("no other zone should not be conflicted")
+	}
+}
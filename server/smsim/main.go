@@ -0,0 +1,167 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smsim
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/entertainment-venue/sm/server/smserver"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type config struct {
+	Snapshot string
+	Addr     string
+	Service  string
+	Token    string
+
+	LoadMetric string
+	Spec       string
+	Rounds     int
+	Dump       string
+	Json       bool
+	Verbose    bool
+}
+
+// Main sm-sim的入口，使用sm的分配逻辑模拟rebalance，评估策略变更的效果
+func Main() {
+	var cfg config
+	flag.StringVar(&cfg.Snapshot, "snapshot", "", "Snapshot fixture file with spec, shards, containers, assignment and loads")
+	flag.StringVar(&cfg.Addr, "addr", "", "Address of a running sm like 'http://127.0.0.1:8888', used when snapshot is empty")
+	flag.StringVar(&cfg.Service, "service", "", "Service to fetch from the running sm")
+	flag.StringVar(&cfg.Token, "token", "", "Api token when the running sm enables authentication")
+	flag.StringVar(&cfg.LoadMetric, "load-metric", "", "Shard load reported to the running sm used for balance metrics: qps, cpu, memory or a gauge name, empty uses weight")
+	flag.StringVar(&cfg.Spec, "spec", "", "Json file with spec fields overriding the snapshot spec, e.g. {\"assignor\": \"binpack\"}")
+	flag.IntVar(&cfg.Rounds, "rounds", 10, "Max rebalance rounds, stops early when a round has no move")
+	flag.StringVar(&cfg.Dump, "dump", "", "Save the snapshot (after spec overrides) to the file, reusable with -snapshot")
+	flag.BoolVar(&cfg.Json, "json", false, "Print the report as json")
+	flag.BoolVar(&cfg.Verbose, "v", false, "Log the decisions of the assignor")
+	flag.Parse()
+
+	if err := run(&cfg, os.Stdout); err != nil {
+		fmt.Printf("sm-sim exit: %+v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg *config, w io.Writer) error {
+	snapshot, err := loadSnapshot(cfg)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if cfg.Spec != "" {
+		b, err := ioutil.ReadFile(cfg.Spec)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		snapshot.Spec, err = mergeSpec(snapshot.Spec, b)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	if cfg.Dump != "" {
+		b, _ := json.MarshalIndent(snapshot, "", "  ")
+		if err := ioutil.WriteFile(cfg.Dump, b, 0644); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+
+	lg := zap.NewNop()
+	if cfg.Verbose {
+		lg, _ = zap.NewDevelopment()
+	}
+	report, err := smserver.Simulate(snapshot, cfg.Rounds, lg)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if cfg.Json {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		_, err := fmt.Fprintln(w, string(b))
+		return err
+	}
+	printReport(w, snapshot, report)
+	return nil
+}
+
+func loadSnapshot(cfg *config) (*smserver.SimSnapshot, error) {
+	if cfg.Snapshot == "" {
+		if cfg.Addr == "" {
+			return nil, errors.New("snapshot or addr required")
+		}
+		return smserver.FetchSimSnapshot(cfg.Addr, cfg.Service, cfg.Token, cfg.LoadMetric)
+	}
+	b, err := ioutil.ReadFile(cfg.Snapshot)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var snapshot smserver.SimSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil, errors.Wrap(err, cfg.Snapshot)
+	}
+	return &snapshot, nil
+}
+
+// mergeSpec override中的字段覆盖spec中的同名字段，其他字段保持不变
+func mergeSpec(spec json.RawMessage, override []byte) (json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(spec) > 0 {
+		if err := json.Unmarshal(spec, &fields); err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	var overrides map[string]json.RawMessage
+	if err := json.Unmarshal(override, &overrides); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	for k, v := range overrides {
+		fields[k] = v
+	}
+	b, err := json.Marshal(fields)
+	return b, errors.Wrap(err, "")
+}
+
+func printReport(w io.Writer, snapshot *smserver.SimSnapshot, report *smserver.SimReport) {
+	fmt.Fprintf(w, "service %s: %d containers, %d shards\n", report.Service, report.Initial.Containers, len(snapshot.Shards))
+	fmt.Fprintf(w, "initial: %s\n", report.Initial)
+	for _, round := range report.Rounds {
+		if len(round.Moves) == 0 {
+			fmt.Fprintf(w, "round %d: no moves\n", round.Round)
+			continue
+		}
+		fmt.Fprintf(w, "round %d: %d moves, cost %d\n", round.Round, len(round.Moves), round.Cost)
+		for _, m := range round.Moves {
+			from, to := m.From, m.To
+			if from == "" {
+				from = "-"
+			}
+			if to == "" {
+				to = "-"
+			}
+			fmt.Fprintf(w, "  %s %s -> %s\n", m.ShardId, from, to)
+		}
+		fmt.Fprintf(w, "  %s\n", round.Metrics)
+	}
+	if report.Converged {
+		fmt.Fprintf(w, "converged after %d rounds\n", len(report.Rounds))
+	} else {
+		fmt.Fprintf(w, "not converged after %d rounds\n", len(report.Rounds))
+	}
+}
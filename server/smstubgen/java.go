@@ -0,0 +1,247 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smstubgen
+
+// javaTemplate 只依赖jdk11+，不引入json库，shard的spec以原始json交给业务解析
+const javaTemplate = `// Code generated by sm-stubgen. DO NOT EDIT.
+//
+// Shard callback stub of service {{.Service}}, see Documentation/shard-callback.md of sm.
+{{if .Package}}
+package {{.Package}};
+{{end}}
+import com.sun.net.httpserver.HttpExchange;
+import com.sun.net.httpserver.HttpServer;
+
+import java.io.IOException;
+import java.io.OutputStream;
+import java.net.InetSocketAddress;
+import java.net.URI;
+import java.net.http.HttpClient;
+import java.net.http.HttpRequest;
+import java.net.http.HttpResponse;
+import java.nio.charset.StandardCharsets;
+import java.time.Duration;
+import java.util.ArrayList;
+import java.util.Base64;
+import java.util.HashMap;
+import java.util.List;
+import java.util.Map;
+import java.util.concurrent.Executors;
+import java.util.concurrent.ScheduledExecutorService;
+import java.util.concurrent.TimeUnit;
+import java.util.logging.Level;
+import java.util.logging.Logger;
+import java.util.regex.Matcher;
+import java.util.regex.Pattern;
+
+public class {{.Class}} {
+    public static final String SERVICE = "{{.Service}}";
+    public static final String ETCD_PREFIX = "{{.EtcdPrefix}}";
+    public static final int SESSION_TTL = {{.SessionTTL}};
+    public static final int HEARTBEAT_INTERVAL = {{.HeartbeatInterval}};
+
+    public static final String ADD_SHARD_PATH = "{{.AddShardPath}}";
+    public static final String DROP_SHARD_PATH = "{{.DropShardPath}}";
+    public static final String HEALTH_PATH = "{{.HealthPath}}";
+
+    static final String APP_PREFIX = ETCD_PREFIX + "/app/" + SERVICE;
+
+    // ShardMessage和etcd gateway的返回都是golang encoding/json的输出，"id"是ShardMessage的第一个字段
+    private static final Pattern ID = Pattern.compile("^\\s*\\{\\s*\"id\"\\s*:\\s*\"([^\"]+)\"");
+    private static final Pattern MANUAL = Pattern.compile("\"manualContainerId\"\\s*:\\s*\"([^\"]*)\"");
+    private static final Pattern LEASE = Pattern.compile("\"ID\"\\s*:\\s*\"?(-?\\d+)");
+    private static final Pattern TTL = Pattern.compile("\"TTL\"\\s*:\\s*\"?(-?\\d+)");
+    private static final Pattern COUNT = Pattern.compile("\"count\"\\s*:\\s*\"?(\\d+)");
+
+    private static final Logger LOG = Logger.getLogger("sm");
+
+    /** Business implementation, the same as ShardInterface of apputil. */
+    public interface Shard {
+        /** message is the raw ShardMessage json. */
+        void add(String shardId, String message) throws Exception;
+
+        void drop(String shardId) throws Exception;
+
+        String load(String shardId);
+    }
+
+    private final String id;
+    private final String etcdEndpoint;
+    private final Shard shard;
+    private final HttpClient http = HttpClient.newHttpClient();
+    private final Map<String, String> shards = new HashMap<>();
+    private final ScheduledExecutorService heartbeat = Executors.newSingleThreadScheduledExecutor();
+    private long lease;
+
+    /** id is host:port, sm calls http://id/sm/admin/... */
+    public {{.Class}}(String id, String etcdEndpoint, Shard shard) {
+        this.id = id;
+        this.etcdEndpoint = etcdEndpoint.replaceAll("/+$", "");
+        this.shard = shard;
+    }
+
+    public void serveForever() throws Exception {
+        if (count(APP_PREFIX + "/containerhb/" + id + "/") > 0) {
+            throw new IllegalStateException("container " + id + " is already running");
+        }
+        lease = parseLong(LEASE, etcd("/v3/lease/grant", "{\"TTL\":" + SESSION_TTL + "}"));
+        heartbeat();
+        heartbeat.scheduleWithFixedDelay(() -> {
+            try {
+                keepalive();
+                heartbeat();
+            } catch (Exception e) {
+                LOG.log(Level.WARNING, "heartbeat failed", e);
+            }
+        }, HEARTBEAT_INTERVAL, HEARTBEAT_INTERVAL, TimeUnit.SECONDS);
+
+        int port = Integer.parseInt(id.substring(id.lastIndexOf(':') + 1));
+        HttpServer server = HttpServer.create(new InetSocketAddress(port), 0);
+        server.createContext(HEALTH_PATH, ex -> reply(ex, 200, ""));
+        server.createContext(ADD_SHARD_PATH, ex -> handle(ex, true));
+        server.createContext(DROP_SHARD_PATH, ex -> handle(ex, false));
+        server.setExecutor(Executors.newCachedThreadPool());
+        server.start();
+    }
+
+    private void handle(HttpExchange ex, boolean add) throws IOException {
+        if (!"POST".equals(ex.getRequestMethod())) {
+            reply(ex, 404, "not found");
+            return;
+        }
+        String message = new String(ex.getRequestBody().readAllBytes(), StandardCharsets.UTF_8);
+        Matcher m = ID.matcher(message);
+        if (!m.find()) {
+            reply(ex, 400, "id required");
+            return;
+        }
+        String shardId = m.group(1);
+        try {
+            if (add) {
+                Matcher manual = MANUAL.matcher(message);
+                if (manual.find() && !manual.group(1).isEmpty() && !manual.group(1).equals(id)) {
+                    reply(ex, 400, "unexpected container");
+                    return;
+                }
+                add(shardId, message);
+            } else {
+                drop(shardId);
+            }
+            reply(ex, 200, "");
+        } catch (Exception e) {
+            LOG.log(Level.WARNING, ex.getRequestURI().getPath() + " failed", e);
+            reply(ex, 500, String.valueOf(e.getMessage()));
+        }
+    }
+
+    private void add(String shardId, String message) throws Exception {
+        synchronized (shards) {
+            if (shards.containsKey(shardId)) {
+                return;
+            }
+            shard.add(shardId, message);
+            shards.put(shardId, message);
+        }
+        shardHeartbeat(shardId, System.currentTimeMillis() / 1000);
+    }
+
+    private void drop(String shardId) throws Exception {
+        synchronized (shards) {
+            if (!shards.containsKey(shardId)) {
+                return;
+            }
+            shard.drop(shardId);
+            shards.remove(shardId);
+        }
+        etcd("/v3/kv/deleterange", "{\"key\":\"" + b64(shardKey(shardId)) + "\"}");
+    }
+
+    private void heartbeat() throws Exception {
+        long now = System.currentTimeMillis() / 1000;
+        put(String.format("%s/containerhb/%s/%x", APP_PREFIX, id, lease), "{\"timestamp\":" + now + ",\"watch\":false}");
+
+        List<String> ids;
+        synchronized (shards) {
+            ids = new ArrayList<>(shards.keySet());
+        }
+        for (String shardId : ids) {
+            shardHeartbeat(shardId, now);
+        }
+    }
+
+    private void shardHeartbeat(String shardId, long now) throws Exception {
+        String load = shard.load(shardId);
+        put(shardKey(shardId), "{\"timestamp\":" + now + ",\"load\":\"" + escape(load == null ? "" : load)
+                + "\",\"containerId\":\"" + escape(id) + "\"}");
+    }
+
+    private String shardKey(String shardId) {
+        return String.format("%s/shardhb/%s/%x", APP_PREFIX, shardId, lease);
+    }
+
+    private void keepalive() throws Exception {
+        if (parseLong(TTL, etcd("/v3/lease/keepalive", "{\"ID\":" + lease + "}")) <= 0) {
+            throw new IllegalStateException(String.format("lease %x expired", lease));
+        }
+    }
+
+    private long count(String prefix) throws Exception {
+        // prefix以"/"结尾，range_end把最后一个字符加一
+        String end = prefix.substring(0, prefix.length() - 1) + (char) (prefix.charAt(prefix.length() - 1) + 1);
+        String resp = etcd("/v3/kv/range", "{\"key\":\"" + b64(prefix) + "\",\"range_end\":\"" + b64(end) + "\",\"count_only\":true}");
+        Matcher m = COUNT.matcher(resp);
+        return m.find() ? Long.parseLong(m.group(1)) : 0;
+    }
+
+    private void put(String key, String value) throws Exception {
+        etcd("/v3/kv/put", "{\"key\":\"" + b64(key) + "\",\"value\":\"" + b64(value) + "\",\"lease\":" + lease + "}");
+    }
+
+    private String etcd(String path, String body) throws Exception {
+        HttpRequest req = HttpRequest.newBuilder(URI.create(etcdEndpoint + path))
+                .timeout(Duration.ofSeconds(HEARTBEAT_INTERVAL))
+                .header("Content-Type", "application/json")
+                .POST(HttpRequest.BodyPublishers.ofString(body))
+                .build();
+        HttpResponse<String> resp = http.send(req, HttpResponse.BodyHandlers.ofString());
+        if (resp.statusCode() != 200) {
+            throw new IOException(path + " " + resp.statusCode() + " " + resp.body());
+        }
+        return resp.body();
+    }
+
+    private static long parseLong(Pattern p, String s) {
+        Matcher m = p.matcher(s);
+        return m.find() ? Long.parseLong(m.group(1)) : 0;
+    }
+
+    private static String b64(String s) {
+        return Base64.getEncoder().encodeToString(s.getBytes(StandardCharsets.UTF_8));
+    }
+
+    private static String escape(String s) {
+        return s.replace("\\", "\\\\").replace("\"", "\\\"");
+    }
+
+    private static void reply(HttpExchange ex, int status, String error) throws IOException {
+        byte[] body = (error.isEmpty() ? "{}" : "{\"error\":\"" + escape(error) + "\"}").getBytes(StandardCharsets.UTF_8);
+        ex.getResponseHeaders().set("Content-Type", "application/json");
+        ex.sendResponseHeaders(status, body.length);
+        try (OutputStream os = ex.getResponseBody()) {
+            os.write(body);
+        }
+    }
+}
+`
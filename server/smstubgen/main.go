@@ -0,0 +1,77 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smstubgen
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+type config struct {
+	Lang    string
+	Out     string
+	Service string
+	Package string
+	Class   string
+
+	EtcdPrefix        string
+	SessionTTL        int
+	HeartbeatInterval int
+}
+
+// Main sm-stubgen的入口，生成非go语言接入sm的container代码
+func Main() {
+	var cfg config
+	flag.StringVar(&cfg.Lang, "lang", "python", "Stub language, python or java")
+	flag.StringVar(&cfg.Out, "out", "", "Output file, default stdout")
+	flag.StringVar(&cfg.Service, "service", "", "Service name of the sharded application")
+	flag.StringVar(&cfg.Package, "package", "", "Java package of the stub")
+	flag.StringVar(&cfg.Class, "class", defaultJavaClass, "Java class name of the stub")
+	flag.StringVar(&cfg.EtcdPrefix, "etcd-prefix", defaultEtcdPrefix, "Etcd prefix of sm")
+	flag.IntVar(&cfg.SessionTTL, "session-ttl", defaultSessionTTL, "Ttl in seconds of the container lease")
+	flag.IntVar(&cfg.HeartbeatInterval, "heartbeat-interval", defaultHeartbeatInterval, "Heartbeat interval in seconds")
+	flag.Parse()
+
+	if err := run(&cfg); err != nil {
+		fmt.Printf("sm-stubgen exit: %+v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg *config) error {
+	c := contract{
+		Service:           cfg.Service,
+		Package:           cfg.Package,
+		Class:             cfg.Class,
+		EtcdPrefix:        cfg.EtcdPrefix,
+		SessionTTL:        cfg.SessionTTL,
+		HeartbeatInterval: cfg.HeartbeatInterval,
+	}
+
+	var w io.Writer = os.Stdout
+	if cfg.Out != "" {
+		f, err := os.Create(cfg.Out)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		defer f.Close()
+		w = f
+	}
+	return generate(w, cfg.Lang, &c)
+}
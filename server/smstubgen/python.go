@@ -0,0 +1,222 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smstubgen
+
+// pythonTemplate 只依赖python3.7+标准库，通过etcd的json gateway维持心跳
+const pythonTemplate = `# Code generated by sm-stubgen. DO NOT EDIT.
+#
+# Shard callback stub of service {{.Service}}, see Documentation/shard-callback.md of sm.
+
+import base64
+import json
+import logging
+import threading
+import time
+import urllib.request
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+SERVICE = "{{.Service}}"
+ETCD_PREFIX = "{{.EtcdPrefix}}"
+SESSION_TTL = {{.SessionTTL}}
+HEARTBEAT_INTERVAL = {{.HeartbeatInterval}}
+
+ADD_SHARD_PATH = "{{.AddShardPath}}"
+DROP_SHARD_PATH = "{{.DropShardPath}}"
+HEALTH_PATH = "{{.HealthPath}}"
+
+APP_PREFIX = ETCD_PREFIX + "/app/" + SERVICE
+
+log = logging.getLogger("sm")
+
+
+class Shard:
+    """Business implementation, the same as ShardInterface of apputil."""
+
+    def add(self, shard_id, spec):
+        raise NotImplementedError
+
+    def drop(self, shard_id):
+        raise NotImplementedError
+
+    def load(self, shard_id):
+        return ""
+
+
+def _b64(s):
+    return base64.b64encode(s.encode()).decode()
+
+
+class Etcd:
+    """Minimal client of the etcd v3 json gateway."""
+
+    def __init__(self, endpoint):
+        self.endpoint = endpoint.rstrip("/")
+
+    def _call(self, path, body):
+        req = urllib.request.Request(
+            self.endpoint + path,
+            data=json.dumps(body).encode(),
+            headers={"Content-Type": "application/json"},
+        )
+        with urllib.request.urlopen(req, timeout=HEARTBEAT_INTERVAL) as resp:
+            return json.loads(resp.read() or b"{}")
+
+    def grant(self, ttl):
+        return int(self._call("/v3/lease/grant", {"TTL": ttl})["ID"])
+
+    def keepalive(self, lease):
+        result = self._call("/v3/lease/keepalive", {"ID": lease}).get("result", {})
+        if int(result.get("TTL", 0)) <= 0:
+            raise RuntimeError("lease %x expired" % lease)
+
+    def count(self, prefix):
+        # prefix以"/"结尾，range_end把最后一个字符加一
+        end = prefix[:-1] + chr(ord(prefix[-1]) + 1)
+        return int(self._call("/v3/kv/range", {"key": _b64(prefix), "range_end": _b64(end), "count_only": True}).get("count", 0))
+
+    def put(self, key, value, lease):
+        self._call("/v3/kv/put", {"key": _b64(key), "value": _b64(value), "lease": lease})
+
+    def delete(self, key):
+        self._call("/v3/kv/deleterange", {"key": _b64(key)})
+
+
+class Container:
+    """Serves the shard callback api and keeps heartbeats of the container and its shards."""
+
+    def __init__(self, container_id, etcd_endpoint, shard, zone="", labels=None, capacity=0):
+        # container_id is host:port, sm calls http://<container_id>/sm/admin/...
+        self.id = container_id
+        self.etcd = Etcd(etcd_endpoint)
+        self.shard = shard
+        self.zone = zone
+        self.labels = labels or {}
+        self.capacity = capacity
+
+        self.lease = 0
+        self.shards = {}
+        self.mu = threading.Lock()
+
+    def serve_forever(self):
+        if self.etcd.count(APP_PREFIX + "/containerhb/" + self.id + "/") > 0:
+            raise RuntimeError("container %s is already running" % self.id)
+        self.lease = self.etcd.grant(SESSION_TTL)
+        self._heartbeat()
+        threading.Thread(target=self._heartbeat_loop, daemon=True).start()
+
+        port = int(self.id.rsplit(":", 1)[1])
+        ThreadingHTTPServer(("", port), self._handler()).serve_forever()
+
+    def _container_key(self):
+        return "%s/containerhb/%s/%x" % (APP_PREFIX, self.id, self.lease)
+
+    def _shard_key(self, shard_id):
+        return "%s/shardhb/%s/%x" % (APP_PREFIX, shard_id, self.lease)
+
+    def _heartbeat_loop(self):
+        while True:
+            time.sleep(HEARTBEAT_INTERVAL)
+            try:
+                self.etcd.keepalive(self.lease)
+                self._heartbeat()
+            except Exception:
+                log.exception("heartbeat failed")
+
+    def _heartbeat(self):
+        now = int(time.time())
+        hb = {"timestamp": now, "watch": False}
+        if self.zone:
+            hb["zone"] = self.zone
+        if self.labels:
+            hb["labels"] = self.labels
+        if self.capacity:
+            hb["capacity"] = self.capacity
+        self.etcd.put(self._container_key(), json.dumps(hb), self.lease)
+
+        with self.mu:
+            ids = list(self.shards)
+        for shard_id in ids:
+            self._shard_heartbeat(shard_id, now)
+
+    def _shard_heartbeat(self, shard_id, now):
+        hb = {"timestamp": now, "load": self.shard.load(shard_id), "containerId": self.id}
+        self.etcd.put(self._shard_key(shard_id), json.dumps(hb), self.lease)
+
+    def add(self, msg):
+        shard_id, spec = msg.get("id"), msg.get("spec")
+        if not shard_id or not spec:
+            return 400, "id and spec required"
+        manual = spec.get("manualContainerId")
+        if manual and manual != self.id:
+            return 400, "unexpected container"
+
+        with self.mu:
+            if shard_id in self.shards:
+                return 200, ""
+            self.shard.add(shard_id, spec)
+            self.shards[shard_id] = spec
+        self._shard_heartbeat(shard_id, int(time.time()))
+        return 200, ""
+
+    def drop(self, msg):
+        shard_id = msg.get("id")
+        if not shard_id:
+            return 400, "id required"
+
+        with self.mu:
+            if shard_id not in self.shards:
+                return 200, ""
+            self.shard.drop(shard_id)
+            del self.shards[shard_id]
+        self.etcd.delete(self._shard_key(shard_id))
+        return 200, ""
+
+    def _handler(self):
+        container = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def _reply(self, status, error=""):
+                body = json.dumps({"error": error} if error else {}).encode()
+                self.send_response(status)
+                self.send_header("Content-Type", "application/json")
+                self.send_header("Content-Length", str(len(body)))
+                self.end_headers()
+                self.wfile.write(body)
+
+            def do_GET(self):
+                if self.path == HEALTH_PATH:
+                    self._reply(200)
+                else:
+                    self._reply(404, "not found")
+
+            def do_POST(self):
+                routes = {ADD_SHARD_PATH: container.add, DROP_SHARD_PATH: container.drop}
+                fn = routes.get(self.path)
+                if fn is None:
+                    self._reply(404, "not found")
+                    return
+                try:
+                    msg = json.loads(self.rfile.read(int(self.headers.get("Content-Length", 0))))
+                except ValueError as e:
+                    self._reply(400, str(e))
+                    return
+                try:
+                    self._reply(*fn(msg))
+                except Exception as e:
+                    log.exception("%s failed", self.path)
+                    self._reply(500, str(e))
+
+        return Handler
+`
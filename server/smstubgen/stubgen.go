@@ -0,0 +1,107 @@
+// Copyright 2021 The entertainment-venue Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smstubgen
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultEtcdPrefix        = "/sm"
+	defaultJavaClass         = "ShardContainer"
+	defaultSessionTTL        = 5
+	defaultHeartbeatInterval = 3
+
+	// 和 apputil.ShardServer 注册的路径保持一致
+	addShardPath  = "/sm/admin/add-shard"
+	dropShardPath = "/sm/admin/drop-shard"
+	healthPath    = "/sm/admin/health"
+)
+
+var (
+	templates = map[string]*template.Template{
+		"python": template.Must(template.New("python").Parse(pythonTemplate)),
+		"java":   template.Must(template.New("java").Parse(javaTemplate)),
+	}
+
+	javaIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+)
+
+// contract 生成stub需要的参数，协议细节见 Documentation/shard-callback.md
+type contract struct {
+	Service string
+
+	// Package 和 Class 只用于java
+	Package string
+	Class   string
+
+	EtcdPrefix        string
+	SessionTTL        int
+	HeartbeatInterval int
+}
+
+func (c *contract) AddShardPath() string  { return addShardPath }
+func (c *contract) DropShardPath() string { return dropShardPath }
+func (c *contract) HealthPath() string    { return healthPath }
+
+func (c *contract) Validate() error {
+	if c.Service == "" || strings.ContainsAny(c.Service, "/\"\\") {
+		return errors.Errorf("invalid service %q", c.Service)
+	}
+	if c.EtcdPrefix == "" || !strings.HasPrefix(c.EtcdPrefix, "/") || strings.ContainsAny(c.EtcdPrefix, "\"\\") {
+		return errors.Errorf("invalid etcd prefix %q", c.EtcdPrefix)
+	}
+	if c.SessionTTL <= 0 || c.HeartbeatInterval <= 0 || c.HeartbeatInterval >= c.SessionTTL {
+		return errors.Errorf("heartbeat interval %d should be less than session ttl %d", c.HeartbeatInterval, c.SessionTTL)
+	}
+	return nil
+}
+
+func (c *contract) validateJava() error {
+	if !javaIdentifier.MatchString(c.Class) {
+		return errors.Errorf("invalid class %q", c.Class)
+	}
+	if c.Package == "" {
+		return nil
+	}
+	for _, p := range strings.Split(c.Package, ".") {
+		if !javaIdentifier.MatchString(p) {
+			return errors.Errorf("invalid package %q", c.Package)
+		}
+	}
+	return nil
+}
+
+// generate 按照lang生成stub写入w
+func generate(w io.Writer, lang string, c *contract) error {
+	tmpl, ok := templates[lang]
+	if !ok {
+		return errors.Errorf("unsupported lang %q", lang)
+	}
+	if err := c.Validate(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	if lang == "java" {
+		if err := c.validateJava(); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	return errors.Wrap(tmpl.Execute(w, c), "")
+}
@@ -0,0 +1,50 @@
+package smstubgen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_generate(t *testing.T) {
+	c := contract{
+		Service:           "foo.bar",
+		Package:           "com.example.sm",
+		Class:             defaultJavaClass,
+		EtcdPrefix:        defaultEtcdPrefix,
+		SessionTTL:        defaultSessionTTL,
+		HeartbeatInterval: defaultHeartbeatInterval,
+	}
+
+	for _, lang := range []string{"python", "java"} {
+		var buf bytes.Buffer
+		if err := generate(&buf, lang, &c); err != nil {
+			t.Fatalf("lang %s err: %+v", lang, err)
+		}
+		for _, s := range []string{addShardPath, dropShardPath, healthPath, `"foo.bar"`, `"/sm"`} {
+			if !strings.Contains(buf.String(), s) {
+				t.Fatalf("lang %s expect %s", lang, s)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := generate(&buf, "ruby", &c); err == nil {
+		t.Fatal("expect unsupported lang")
+	}
+
+	bad := c
+	bad.Package = "com.example-sm"
+	if err := generate(&buf, "java", &bad); err == nil {
+		t.Fatal("expect invalid package")
+	}
+	if err := generate(&buf, "python", &bad); err != nil {
+		t.Fatalf("package should be ignored by python: %+v", err)
+	}
+
+	bad = c
+	bad.HeartbeatInterval = bad.SessionTTL
+	if err := generate(&buf, "python", &bad); err == nil {
+		t.Fatal("expect invalid heartbeat interval")
+	}
+}